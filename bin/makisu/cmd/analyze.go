@@ -0,0 +1,199 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type analyzeCmd struct {
+	*cobra.Command
+
+	top            int
+	format         string
+	maxWasted      string
+	pull           bool
+	registryConfig string
+	storageDir     string
+}
+
+// layerReport is the space used by a layer of the analyzed image.
+type layerReport struct {
+	Digest         image.Digest `json:"digest"`
+	CompressedSize int64        `json:"compressed_size"`
+	CreatedBy      string       `json:"created_by,omitempty"`
+	snapshot.LayerUsage
+}
+
+// imageAnalysis is the output of the analyze command.
+type imageAnalysis struct {
+	Image      string               `json:"image"`
+	Layers     []layerReport        `json:"layers"`
+	Size       int64                `json:"size"`
+	Wasted     int64                `json:"wasted"`
+	Efficiency float64              `json:"efficiency"`
+	Largest    []snapshot.FileUsage `json:"largest"`
+}
+
+func getAnalyzeCmd() *analyzeCmd {
+	analyzeCmd := &analyzeCmd{
+		Command: &cobra.Command{
+			Use:                   "analyze [flags] <image name>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Report the size of each layer of an image, the space wasted by files overwritten or deleted by later layers, and the largest files",
+		},
+	}
+	analyzeCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Requires an image name as argument")
+		}
+		return nil
+	}
+	analyzeCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := analyzeCmd.Analyze(args[0]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	analyzeCmd.PersistentFlags().IntVar(&analyzeCmd.top, "top", 10, "Number of largest files of the image to report")
+	analyzeCmd.PersistentFlags().StringVar(&analyzeCmd.format, "format", "text", "Format of the report printed to stdout, 'text' or 'json'")
+	analyzeCmd.PersistentFlags().StringVar(&analyzeCmd.maxWasted, "max-wasted", "", "Fail if the layers waste more space than this, like 20MB, for CI. No limit if empty")
+	analyzeCmd.PersistentFlags().BoolVar(&analyzeCmd.pull, "pull", false, "Always pull the image from its registry, even if an image with the same name was built or pulled in the storage dir")
+	analyzeCmd.PersistentFlags().StringVar(&analyzeCmd.registryConfig, "registry-config", "", "Registry configuration, for the credentials and TLS settings of the registry")
+	analyzeCmd.PersistentFlags().StringVar(&analyzeCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for temp files and cached layers")
+
+	analyzeCmd.Flags().SortFlags = false
+	analyzeCmd.PersistentFlags().SortFlags = false
+
+	return analyzeCmd
+}
+
+// Analyze reads the layers of an image, built or pulled in the storage dir or
+// pulled from its registry, and prints how they use space to stdout.
+func (cmd *analyzeCmd) Analyze(imageFullName string) error {
+	if cmd.format != "text" && cmd.format != "json" {
+		return fmt.Errorf("invalid format %q, must be 'text' or 'json'", cmd.format)
+	}
+	var maxWasted int64 = -1
+	if cmd.maxWasted != "" {
+		var err error
+		if maxWasted, err = storage.ParseSize(cmd.maxWasted); err != nil {
+			return fmt.Errorf("invalid --max-wasted: %s", err)
+		}
+	}
+	if err := initRegistryConfig(cmd.registryConfig); err != nil {
+		return fmt.Errorf("failed to initialize registry configuration: %s", err)
+	}
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("failed to init image store: %s", err)
+	}
+	defer store.CleanupSandbox()
+
+	manifest, err := getImageManifest(store, imageFullName, cmd.pull)
+	if err != nil {
+		return err
+	}
+	config, err := getImageConfig(store, manifest)
+	if err != nil {
+		return fmt.Errorf("get config of %s: %s", imageFullName, err)
+	}
+	analysis, err := builder.AnalyzeImage(store, manifest, cmd.top)
+	if err != nil {
+		return fmt.Errorf("failed to analyze %s: %s", imageFullName, err)
+	}
+
+	report := imageAnalysis{
+		Image:      imageFullName,
+		Layers:     make([]layerReport, len(manifest.Layers)),
+		Size:       analysis.Size,
+		Wasted:     analysis.Wasted,
+		Efficiency: analysis.Efficiency(),
+		Largest:    analysis.Largest,
+	}
+	// History entries that aren't empty layers map to the layers in order.
+	var createdBy []string
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+	for i, descriptor := range manifest.Layers {
+		report.Layers[i] = layerReport{
+			Digest:         descriptor.Digest,
+			CompressedSize: descriptor.Size,
+			LayerUsage:     analysis.Layers[i],
+		}
+		if len(createdBy) == len(manifest.Layers) {
+			report.Layers[i].CreatedBy = createdBy[i]
+		}
+	}
+
+	if cmd.format == "json" {
+		output, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal analysis: %s", err)
+		}
+		fmt.Println(string(output))
+	} else {
+		printImageAnalysis(os.Stdout, report)
+	}
+
+	if maxWasted >= 0 && report.Wasted > maxWasted {
+		return fmt.Errorf("layers of %s waste %s, more than --max-wasted %s",
+			imageFullName, storage.FormatSize(report.Wasted), cmd.maxWasted)
+	}
+	return nil
+}
+
+// printImageAnalysis writes the analysis as text tables.
+func printImageAnalysis(w io.Writer, report imageAnalysis) {
+	fmt.Fprintf(w, "%s: %d layers, %s of files, %s wasted, %.1f%% efficiency\n\n",
+		report.Image, len(report.Layers), storage.FormatSize(report.Size),
+		storage.FormatSize(report.Wasted), report.Efficiency*100)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tSIZE\tWASTED\tFILES\tCOMPRESSED\tCREATED BY")
+	for i, l := range report.Layers {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\t%s\n", i, storage.FormatSize(l.Size),
+			storage.FormatSize(l.Wasted), l.Files, storage.FormatSize(l.CompressedSize), l.CreatedBy)
+	}
+	tw.Flush()
+
+	if len(report.Largest) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tLAYER\tPATH")
+	for _, f := range report.Largest {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", storage.FormatSize(f.Size), f.Layer, f.Path)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,137 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/uber/makisu/lib/bake"
+	"github.com/uber/makisu/lib/log"
+
+	"github.com/spf13/cobra"
+)
+
+type bakeCmd struct {
+	*cobra.Command
+
+	file string
+	jobs int
+}
+
+func getBakeCmd() *bakeCmd {
+	bakeCmd := &bakeCmd{
+		Command: &cobra.Command{
+			Use:                   "bake [flags] [<target or group>...] [-- <build flags>]",
+			DisableFlagsInUseLine: true,
+			Short:                 "Build the targets of a bake file, each with its own context, dockerfile, build args and tags",
+			Long: "Build the targets of a bake file, each with its own context, dockerfile, build args and tags. " +
+				"Without targets, the 'default' group is built if the file defines one, and all targets otherwise. " +
+				"Each target is built by a separate makisu build process, with the build flags after -- first. " +
+				"Targets share the storage dir, and so the cache, of the build flags. " +
+				"The output of each build is prefixed with the name of its target.",
+		},
+	}
+	bakeCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if bakeCmd.jobs < 1 {
+			return errors.New("--jobs must be at least 1")
+		}
+		return nil
+	}
+	bakeCmd.Run = func(cmd *cobra.Command, args []string) {
+		var names, buildFlags []string
+		if n := cmd.ArgsLenAtDash(); n >= 0 {
+			names, buildFlags = args[:n], args[n:]
+		} else {
+			names = args
+		}
+		exitCode, err := bakeCmd.Bake(names, buildFlags)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(exitCode)
+	}
+
+	bakeCmd.PersistentFlags().StringVarP(&bakeCmd.file, "file", "f", "makisu-bake.yaml", "Bake file defining the targets, in YAML or JSON")
+	bakeCmd.PersistentFlags().IntVarP(&bakeCmd.jobs, "jobs", "j", 1, "Number of targets built at the same time. Builds modify their root, so parallel builds require --rootless in the build flags, and each target gets a --rootless-dir of its own")
+
+	bakeCmd.Flags().SortFlags = false
+	bakeCmd.PersistentFlags().SortFlags = false
+
+	return bakeCmd
+}
+
+// Bake builds the targets, and returns the exit code of the first target that
+// failed, or 0.
+func (cmd *bakeCmd) Bake(names, buildFlags []string) (int, error) {
+	file, err := bake.Load(cmd.file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load bake file: %s", err)
+	}
+	targets, err := file.Select(names)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select targets: %s", err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find makisu executable: %s", err)
+	}
+	opts := bake.Options{
+		Executable: executable,
+		BuildFlags: buildFlags,
+		Jobs:       cmd.jobs,
+	}
+	if cmd.jobs > 1 && len(targets) > 1 {
+		if !hasFlag(buildFlags, "rootless") {
+			return 0, errors.New("parallel builds require --rootless in the build flags")
+		}
+		opts.TargetFlags = func(name string) []string {
+			return []string{"--rootless-dir", filepath.Join(os.TempDir(), "makisu-rootfs-"+name)}
+		}
+	}
+
+	log.Infof("Baking %d targets with %d jobs: %v", len(targets), cmd.jobs, targets)
+	exitCode := 0
+	for _, result := range bake.Run(opts, file, targets, os.Stdout) {
+		if result.Err != nil {
+			log.Errorf("Failed to build %s: %s", result.Target, result.Err)
+		} else if result.ExitCode != 0 {
+			log.Errorf("Failed to build %s with exit code %d after %s",
+				result.Target, result.ExitCode, result.Duration)
+		} else {
+			log.Infof("Built %s in %s", result.Target, result.Duration)
+		}
+		if result.Failed() && exitCode == 0 {
+			exitCode = result.ExitCode
+			if exitCode == 0 {
+				exitCode = 1
+			}
+		}
+	}
+	return exitCode, nil
+}
+
+// hasFlag returns true if the boolean flag is set in args.
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "--"+name || arg == "--"+name+"=true" {
+			return true
+		}
+	}
+	return false
+}
@@ -15,49 +15,107 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/uber/makisu/lib/budget"
 	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/failure"
+	"github.com/uber/makisu/lib/isolation"
+	"github.com/uber/makisu/lib/lockfile"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/metrics"
+	"github.com/uber/makisu/lib/notify"
+	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/platform"
+	"github.com/uber/makisu/lib/policy"
+	"github.com/uber/makisu/lib/profile"
+	"github.com/uber/makisu/lib/progress"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/report"
+	"github.com/uber/makisu/lib/scan"
+	"github.com/uber/makisu/lib/secrets"
+	"github.com/uber/makisu/lib/shell"
+	"github.com/uber/makisu/lib/signature"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/steplog"
 	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/tracing"
+	"github.com/uber/makisu/lib/userns"
 	"github.com/uber/makisu/lib/utils"
-	"github.com/uber/makisu/lib/utils/stringset"
 
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 )
 
+// _buildTimeoutGrace is how long after --build-timeout the build is
+// interrupted if it isn't running a RUN step.
+const _buildTimeoutGrace = 10 * time.Second
+
 type buildCmd struct {
 	*cobra.Command
 
 	dockerfilePath string
+	contextSource  string
+	buildContexts  []string
+	contextChown   string
 	tag            string
 
 	pushRegistries []string
 	replicas       []string
+	standbys       []string
+	sign           string
+	annotations    []string
 	registryConfig string
 	destination    string
+	outputFormat   string
+	platform       string
+	targetPlatform platform.Platform
 
 	target        string
 	buildArgs     []string
+	secretArgs    []string
 	allowModifyFS bool
+	rootless      bool
+	rootlessDir   string
 	commit        string
 	blacklists    []string
+	autoBlacklist bool
+	excludes      []string
+	cleanCaches   bool
+	detectSecrets string
+	secretAllows  []string
+	squash        bool
+	squashFrom    int
+	resume        bool
+	dryRun        bool
+	basePolicy    string
+	baseUpdates   bool
+	lockfile      string
+	locked        bool
+	scanCommand   string
+	scanSeverity  string
+	scanWarnOnly  bool
 
-	localCacheTTL      time.Duration
-	redisCacheAddress  string
-	redisCachePassword string
-	redisCacheTTL      time.Duration
-	httpCacheAddress   string
-	httpCacheHeaders   []string
+	templateOptions
+	parseOptions
+	cacheOptions
 
 	dockerHost    string
 	dockerVersion string
@@ -65,9 +123,124 @@ type buildCmd struct {
 	doLoad        bool
 
 	storageDir       string
+	sharedBlobDir    string
+	scratchDir       string
+	scratchDirSize   string
 	compressionLevel string
 
+	numericCompressionLevel int
+	compressionThreads      int
+	sourceDateEpoch         string
+	epoch                   string
+	created                 string
+	gitMetadata             bool
+	contextDigest           bool
+	streamLayers            bool
+	chunkStore              bool
+	incrementalScan         bool
+	overlaySnapshot         bool
+	isolation               string
+	ociRuntime              string
+	hermetic                bool
+	defaultPath             string
+	defaultShell            string
+	runEnvPassthrough       []string
+	scanConcurrency         int
+	paranoid                bool
+	digestAlgorithm         string
+	fips                    bool
+	profileOutput           string
+	profileFormat           string
+	failureReport           string
+	stepTimeout             time.Duration
+	runRetries              int
+	runRetryBackoff         time.Duration
+	runRetryExitCodes       []int
+	buildTimeout            time.Duration
+	stepLogDir              string
+	stepLogMaxSize          string
+	stepLogMaxBytes         int64
+	maxBaseSize             string
+	maxBaseFiles            int
+	maxBaseDepth            int
+	maxImageSize            string
+	maxLayerSize            string
+	sizeBudgetWarnOnly      bool
+	maxLayerFiles           int
+	metricsOutput           string
+	metricsPush             string
+	reportOutput            string
+	reportFormat            string
+	otlpEndpoint            string
+	otlpHeaders             []string
+	notifyURL               string
+	notifySecret            string
+	progressMode            string
+	progressOutput          string
+	configEntrypoint        string
+	configCmd               string
+	configEnvs              []string
+	configUser              string
+	configWorkdir           string
+
 	preserveRoot bool
+
+	// namedContexts are the sources of --build-context by name, with local
+	// dirs made absolute.
+	namedContexts map[string]string
+	// quiet is the global --quiet flag.
+	quiet bool
+	// extractLimits are the parsed --max-base-* limits.
+	extractLimits snapshot.ExtractLimits
+	// scratchMaxSize is the parsed --scratch-dir-size.
+	scratchMaxSize int64
+	// sizeBudget is the parsed --max-image-size and --max-layer-size.
+	sizeBudget budget.Limits
+	// createdTime is the parsed --created, or the time of --source-date-epoch.
+	createdTime *time.Time
+	// epochTime is the parsed --epoch.
+	epochTime *time.Time
+	// gitLabels are added to the image by --git-metadata.
+	gitLabels map[string]string
+	// contextDigestValue is the digest of the context, with --context-digest.
+	contextDigestValue image.Digest
+	// configOverrides are the parsed --entrypoint, --cmd, --env, --user and
+	// --workdir.
+	configOverrides *builder.ConfigOverrides
+	// imageAnnotations are the parsed --annotation.
+	imageAnnotations image.Annotations
+	// failures records the details of a failure of the build.
+	failures *failure.Recorder
+	// profile records the duration of the phases of the build.
+	profile *profile.Recorder
+	// start is when the build started.
+	start time.Time
+	// warnings collects the warnings logged for the summary of
+	// --report-output.
+	warnings *report.Warnings
+	// imageSize is the compressed size of the layers and config of the
+	// built image.
+	imageSize int64
+	// layers are the layers of the built image and their files, counted with
+	// --max-layer-files.
+	layers []budget.Layer
+	// tracer exports the trace of the build if --otlp-endpoint is set.
+	tracer *tracing.Exporter
+	// notifier sends the lifecycle events of the build if --notify-url is
+	// set.
+	notifier *notify.Notifier
+	// progress writes the progress of the build if --progress is rawjson.
+	progress *progress.Writer
+	// digest is the digest of the manifest of the built image.
+	digest image.Digest
+	// signer signs the pushed images if --sign is set.
+	signer signature.Signer
+	// policy verifies the base images if --base-image-policy is set.
+	policy *policy.Policy
+	// scanner scans the image before it's pushed if --scan is set.
+	scanner scan.Scanner
+	// scanThreshold is the parsed --scan-severity.
+	scanThreshold scan.Severity
 }
 
 func getBuildCmd() *buildCmd {
@@ -79,51 +252,152 @@ func getBuildCmd() *buildCmd {
 		},
 	}
 	buildCmd.Args = func(cmd *cobra.Command, args []string) error {
-		if len(args) != 1 {
+		if buildCmd.contextSource != "" && len(args) != 0 {
+			return errors.New("Build context is set by --context, and cannot be an argument")
+		} else if buildCmd.contextSource == "" && len(args) != 1 {
 			return errors.New("Requires build context as argument")
 		}
 		return nil
 	}
 	buildCmd.Run = func(cmd *cobra.Command, args []string) {
 		if err := buildCmd.processFlags(); err != nil {
-			log.Errorf("failed to process flags: %s", err)
-			os.Exit(1)
+			buildCmd.fail(fmt.Errorf("failed to process flags: %s", err))
 		}
 
-		if err := buildCmd.Build(args[0]); err != nil {
-			log.Error(err)
-			os.Exit(1)
+		if buildCmd.rootless && !buildCmd.dryRun && !userns.InNamespace() {
+			code, err := reexecRootless()
+			if err != nil {
+				buildCmd.fail(fmt.Errorf("failed to run in user namespace: %s", err))
+			}
+			os.Exit(code)
 		}
+
+		buildCmd.quiet, _ = cmd.Flags().GetBool("quiet")
+		contextSource := buildCmd.contextSource
+		if contextSource == "" {
+			contextSource = args[0]
+		}
+		if err := buildCmd.Build(contextSource); err != nil {
+			buildCmd.fail(err)
+		}
+		buildCmd.reportMetrics(metrics.ResultSuccess)
+		buildCmd.reportSummary(metrics.ResultSuccess)
+		buildCmd.exportTrace(nil)
+		buildCmd.notifier.Notify(notify.Event{
+			Type:   notify.EventBuildSucceeded,
+			Digest: string(buildCmd.digest),
+		})
+		buildCmd.notifier.Close()
 	}
 
 	buildCmd.PersistentFlags().StringVarP(&buildCmd.dockerfilePath, "file", "f", "Dockerfile", "The absolute path to the dockerfile")
+	buildCmd.PersistentFlags().StringVarP(&buildCmd.contextSource, "context", "c", "", "Build context, instead of the argument. Either a local directory, - for a tar read from stdin, an http(s) URL of a tar, or a git URL like https://host/repo.git#<ref>:<subdir>. Tars can be compressed with gzip or zstd")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.contextChown, "context-chown", "", "Numeric \"<uid>[:<gid>]\" owning the files ADD and COPY copy from the contexts without --chown, instead of root, whatever their owner on the host is. Archives extracted by ADD keep their owners")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.buildContexts, "build-context", nil, "Additional context that 'COPY --from=<name>' can copy from, as \"<name>=<source>\". The source is a local directory, an http(s) or git URL like --context, or docker-image://<image> to also replace <name> in FROM")
 	buildCmd.PersistentFlags().StringVarP(&buildCmd.tag, "tag", "t", "", "Image tag (required)")
 
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.pushRegistries, "push", nil, "Registry to push image to")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.replicas, "replica", nil, "Push targets with alternative full image names \"<registry>/<repo>:<tag>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.standbys, "push-standby", nil, "Standby registry to push image to when pushing to a --push registry fails, tried in order")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.sign, "sign", "", "Key to sign the image with after it's pushed, in the format of cosign: the path of a private key file, decrypted with $COSIGN_PASSWORD if encrypted, or a KMS reference like awskms:///<key id or alias> or hashivault://<key name>. The signature is pushed next to the image with the same registry credentials")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.annotations, "annotation", nil, "Annotation of the image, as \"[<scope>:]<key>=<value>\". Scope 'manifest', the default, annotates the manifest of the image, which is then an OCI manifest. Scope 'index' annotates an OCI index of the image pushed as the tag, and the index of --output-format=oci")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.registryConfig, "registry-config", "", "Set build-time variables")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.destination, "dest", "", "Destination of the image tar")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.outputFormat, "output-format", "docker", "Format of the image saved to --dest, 'docker' for a docker save tar, or 'oci' for an OCI image layout, written as a tar unless --dest is a directory or ends with /")
 
 	buildCmd.PersistentFlags().StringVar(&buildCmd.target, "target", "", "Set the target build stage to build.")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.platform, "platform", "", "Platform of the image, like linux/arm64 or linux/arm/v7, whose manifest is pulled from the manifest lists of base images. RUN steps of foreign architectures run under qemu-user emulation, registered in binfmt_misc. Defaults to linux with the architecture of makisu")
 	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.buildArgs, "build-arg", nil, "Argument to the dockerfile as per the spec of ARG. Format is \"--build-arg <arg>=<value>\"")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.secretArgs, "secret-build-arg", nil, "Build arg whose value is masked in logs, failure reports and image history. Either the name of a --build-arg, a pattern like 'AWS_*' matching names of build args, or <arg>=<value> to pass the arg as well")
+	buildCmd.templateOptions.addFlags(buildCmd.Command)
+	buildCmd.parseOptions.addFlags(buildCmd.Command)
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.allowModifyFS, "modifyfs", false, "Allow makisu to modify files outside of its internal storage dir")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.rootless, "rootless", false, "Build in --rootless-dir as the root of a user and mount namespace instead of /, so RUN steps run and files are owned as root without makisu running as root. Non-root users need subordinate IDs in /etc/subuid and /etc/subgid, and newuidmap and newgidmap, to map users other than root")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.rootlessDir, "rootless-dir", "/tmp/makisu-rootfs", "Directory used as the root of the build with --rootless. Its content is deleted before the build")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.commit, "commit", "implicit", "Set to explicit to only commit at steps with '#!COMMIT' annotations; Set to implicit to commit at every ADD/COPY/RUN step")
-	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.blacklists, "blacklist", nil, "Makisu will ignore all changes to these locations in the resulting docker images")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.blacklists, "blacklist", nil, "Makisu will ignore all changes to these locations in the resulting docker images. Entries containing *, ? or [ are path patterns, e.g. **/.git")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.autoBlacklist, "auto-blacklist", true, "Also blacklist the mountpoints of pseudo file systems like proc, sysfs or devpts found in /proc/mounts, and /var/run if it contains a mountpoint")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.excludes, "exclude", nil, "Path pattern left out of the layers committed by RUN steps, e.g. /var/cache/apt or **/*.pyc. Unlike --blacklist, excluded files are still visible to later steps. A step can add its own patterns with a '#!EXCLUDE <pattern>...' annotation")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.cleanCaches, "clean-package-caches", false, "Leave the caches of apt, yum, dnf and apk that RUN steps installing packages with them write, like /var/lib/apt/lists/*, out of their layers. Caches already in the base image or earlier layers stay in the image. The caches stay visible to later steps")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.detectSecrets, "detect-secrets", "off", "Scan the files of the layers committed by steps for secrets like AWS keys, private keys or npm tokens. Set to 'fail' to fail the build with exit code 10 if one is found, 'warn' to only log them, or 'off'")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.secretAllows, "secret-allow", nil, "Path pattern of files never scanned by --detect-secrets, like --exclude, e.g. /usr/lib/python3*/test")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.squash, "squash", false, "Squash the layers of the target stage into a single layer on top of its base image. History is preserved in the image config")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.squashFrom, "squash-from", 0, "Only squash the layers of the target stage from this step onwards, numbered as in the build logs. Implies --squash")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.configEntrypoint, "entrypoint", "", "Entrypoint of the image, overriding the one of the dockerfile: a JSON array, '[]' to clear it, or a command run by /bin/sh -c like in dockerfiles")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.configCmd, "cmd", "", "Cmd of the image, overriding the one of the dockerfile, in the same format as --entrypoint")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.configEnvs, "env", nil, "Environment variable of the image, as \"<key>=<value>\", set after the ENV steps of the dockerfile. Only in the config of the image, RUN steps don't see it")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.configUser, "user", "", "User of the image, overriding the one of the dockerfile. RUN steps still run as the users of the dockerfile")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.configWorkdir, "workdir", "", "Absolute working directory of the image, overriding the one of the dockerfile. It's not created if missing")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.resume, "resume", false, "Resume an interrupted build of the same image from its last committed step, reusing the layers checkpointed in the storage dir")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.dryRun, "dry-run", false, "Parse the dockerfile, resolve base images and look up the cache, then print which steps would hit the cache and which layers would be pushed, without executing any step")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.basePolicy, "base-image-policy", "", "YAML file of the policy base images must comply with before they're pulled: each rule pins the digests of a repository, or requires them to be signed in the format of cosign. Non-compliant base images fail the build with exit code 8")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.baseUpdates, "warn-base-updates", false, "Warn if a base image was updated in its registry since it was last pulled in the storage dir, since the layers cached on top of it still reuse the previous one. See makisu outdated")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.maxBaseSize, "max-base-size", "", "Fail if the layers of a FROM or COPY --from image expand to more than this size, like '20G', so a malicious base image can't fill the disk. Unlimited if not set")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.maxBaseFiles, "max-base-files", 0, "Fail if the layers of a FROM or COPY --from image have more than this number of files, so a malicious base image can't exhaust inodes. Unlimited if 0")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.maxBaseDepth, "max-base-path-depth", 0, "Fail if a path in the layers of a FROM or COPY --from image has more than this number of components. Unlimited if 0")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.lockfile, "lockfile", lockfile.DefaultName, "Lockfile pinning the FROM and COPY --from images of the dockerfile to digests, as written by makisu lock. Relative to the context. Images are pulled at their locked digests if it exists")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.locked, "locked", false, "Fail the build with exit code 8 unless the lockfile exists, has all the images of the dockerfile, and their tags still point to the locked digests")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.maxImageSize, "max-image-size", "", "Fail the build with exit code 12 before anything is pushed if the compressed layers and config of the image are larger than this, like '500MB', and log its largest layers. Unlimited if not set")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.maxLayerSize, "max-layer-size", "", "Fail the build with exit code 12 before anything is pushed if a compressed layer of the image is larger than this, like '200MB', and log the layers over it. Unlimited if not set")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.sizeBudgetWarnOnly, "size-budget-warn-only", false, "Only log the layers over --max-image-size or --max-layer-size, without failing the build")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.maxLayerFiles, "max-layer-files", 0, "Count the files of each layer of the image after the build, log them and add them to --report-output, and warn about the layers with more files than this, like node_modules trees, which are slow to push and pull. Not counted if 0")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.scanCommand, "scan", "", "Vulnerability scanner command run by sh on the built image before it's pushed, saved or loaded, like 'trivy image -q -f json --input {}'. {} is replaced by the path of the image as an OCI image layout, appended if missing. The command must print a JSON report of Trivy or Grype")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.scanSeverity, "scan-severity", "high", "Lowest severity of the vulnerabilities found by --scan that fail the build with exit code 9, one of unknown, negligible, low, medium, high or critical")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.scanWarnOnly, "scan-warn-only", false, "Only log the vulnerabilities found by --scan at or above --scan-severity, without failing the build")
 
-	buildCmd.PersistentFlags().DurationVar(&buildCmd.localCacheTTL, "local-cache-ttl", time.Hour*336, "Time-To-Live for local cache")
-	buildCmd.PersistentFlags().StringVar(&buildCmd.redisCacheAddress, "redis-cache-addr", "", "The address of a redis server for cacheID to layer sha mapping")
-	buildCmd.PersistentFlags().StringVar(&buildCmd.redisCachePassword, "redis-cache-password", "", "The password of the Redis server, should match 'requirepass' in redis.conf")
-	buildCmd.PersistentFlags().DurationVar(&buildCmd.redisCacheTTL, "redis-cache-ttl", time.Hour*336, "Time-To-Live for redis cache")
-	buildCmd.PersistentFlags().StringVar(&buildCmd.httpCacheAddress, "http-cache-addr", "", "The address of the http server for cacheID to layer sha mapping")
-	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.httpCacheHeaders, "http-cache-header", nil, "Request header for http cache server. Format is \"--http-cache-header <header>:<value>\"")
+	buildCmd.cacheOptions.addFlags(buildCmd.Command)
 
 	buildCmd.PersistentFlags().StringVar(&buildCmd.dockerHost, "docker-host", utils.DefaultEnv("DOCKER_HOST", "unix:///var/run/docker.sock"), "Docker host to load images to")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.dockerVersion, "docker-version", utils.DefaultEnv("DOCKER_VERSION", "1.21"), "Version string for loading images to docker")
 	buildCmd.PersistentFlags().StringVar(&buildCmd.dockerScheme, "docker-scheme", utils.DefaultEnv("DOCKER_SCHEME", "http"), "Scheme for api calls to docker daemon")
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.doLoad, "load", false, "Load image into docker daemon after build. Requires access to docker socket at location defined by ${DOCKER_HOST}")
 
-	buildCmd.PersistentFlags().StringVar(&buildCmd.storageDir, "storage", "", "Directory that makisu uses for temp files and cached layers. Mount this path for better caching performance. If modifyfs is set, default to /makisu-storage; Otherwise default to /tmp/makisu-storage")
-	buildCmd.PersistentFlags().StringVar(&buildCmd.compressionLevel, "compression", "default", "Image compression level, could be 'no', 'speed', 'size', 'default'")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.storageDir, "storage", "", "Directory that makisu uses for temp files and cached layers. Mount this path for better caching performance. If modifyfs is set, default to /makisu-storage; Otherwise default to /tmp/makisu-storage. Concurrent builds can share it, each one using its own sandbox in it")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.sharedBlobDir, "shared-blob-dir", "", "Directory on a volume shared by several builders, like NFS or CephFS, to keep pulled and committed layers in instead of the storage dir, so a pool of builders pulls each base layer once")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.scratchDir, "scratch-dir", "", "Fast directory, like a memory-backed emptyDir, for the temp files of the build that fit in it: extracted ADD archives and remote contexts. The ones that don't spill over to the storage dir, which keeps the layers. The upper dirs of RUN overlays, which can't spill over, stay in the storage dir")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.scratchDirSize, "scratch-dir-size", "", "Maximum size of the temp files the build keeps in --scratch-dir, like '1GB'. Defaults to the free space of its file system")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.compressionLevel, "compression", "default", "Image compression level, could be 'no', 'speed', 'size', 'default' for gzip, 'estargz' for seekable gzip layers that can be lazily pulled, or 'zstd[:<level>]' for zstd with an optional level between 1 and 22")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.numericCompressionLevel, "compression-level", -1, "Numeric compression level overriding the level of --compression, 0-9 for gzip and 1-22 for zstd. Ignored if negative")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.compressionThreads, "compression-threads", runtime.NumCPU(), "Number of threads compressing each layer in parallel")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.sourceDateEpoch, "source-date-epoch", os.Getenv("SOURCE_DATE_EPOCH"), "Unix timestamp in seconds set as the mtime of all files in generated layers, which also strips user/group names and gzip header fields to make layers reproducible. Defaults to $SOURCE_DATE_EPOCH")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.epoch, "epoch", "", "Unix timestamp in seconds, like $SOURCE_DATE_EPOCH, set as every time the image records: the mtime of the files of generated layers like --source-date-epoch, the creation time of the image, and the times of all its history entries, the ones of the base image included. Use 0 to zero them and get the same digests for the same inputs. Cannot be combined with --created or --source-date-epoch, and overrides $SOURCE_DATE_EPOCH")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.created, "created", "", "Creation time of the image and of the history entries of its steps, as an RFC 3339 timestamp or a number of seconds since the epoch. Defaults to --source-date-epoch if set, or the time they are built at")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.gitMetadata, "git-metadata", false, "If the context is a git repository, pass the GIT_SHA, GIT_BRANCH and GIT_DIRTY build args, label the image with them, and use the commit time as --created if it's not set. --build-arg and LABEL override them")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.contextDigest, "context-digest", false, "Compute the sha256 digest of the context, without the files its .dockerignore ignores, label the image with it as makisu.context.digest, and report it in --metrics-output, so the context that produced an image can be verified")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.streamLayers, "stream-layers", false, "Upload layers to the first --push registry while they are being committed, instead of after the build. Requires chunked uploads")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.chunkStore, "experimental-chunk-store", false, "Dedup cached layers of the storage dir into content-defined chunks after build, and rebuild them on demand. Dedups best with --compression=no")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.incrementalScan, "incremental-scan", false, "Watch the file system with inotify during RUN steps, and only scan the directories they changed instead of the whole file system. Falls back to full scans if the watcher overflows")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.overlaySnapshot, "overlay-snapshot", false, "Run RUN steps in an overlayfs mounted on top of the file system, and derive their layers from its upper dir instead of scanning the whole file system. Requires the permission to mount overlayfs, and the storage dir on a mounted volume. Falls back to scans otherwise")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.isolation, "isolation", "none", "Set to 'namespace' to run RUN steps in mount, pid, ipc and uts namespaces of their own, with the root of the build as their root, the storage, context and internal dirs of makisu hidden, and /proc/sys read-only. Set to 'oci' to run them the same way with --oci-runtime, in a container generated from the root of the build and the config of the image. Set to 'none' to run them in the root of makisu")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.ociRuntime, "oci-runtime", "runc", "OCI runtime running RUN steps with --isolation=oci, like runc or crun. Looked up in PATH if it has no slash")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.hermetic, "hermetic", false, "Fail unless the build only consumes declared inputs: FROM and COPY --from images must be pinned by digest, ADD can't fetch URLs, and RUN steps run with namespace isolation and in a network namespace with no network access")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.defaultPath, "default-path", context.DefaultPath, "PATH set in the env of the image if its base image sets none, like scratch or stripped images, so RUN steps don't run with the PATH of makisu. Set to '' to leave it unset")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.defaultShell, "default-shell", strings.Join(context.DefaultShell, " "), "Shell running the commands of RUN steps, split on whitespace, with the command as last argument. RUN steps fail early if its path is missing from the image")
+	buildCmd.PersistentFlags().StringSliceVar(&buildCmd.runEnvPassthrough, "run-env-passthrough", nil, "Variables of the env of makisu passed to the commands of RUN steps, by name or with wildcards like 'GOPROXY' or 'HTTP*_PROXY'. RUN steps otherwise only get the ENV and ARGs of the stage, and HOME. Set to '*' to pass the whole env of makisu")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.scanConcurrency, "scan-concurrency", runtime.NumCPU(), "Number of directories listed and files hashed in parallel when scanning the file system and the context")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.paranoid, "paranoid", false, "Hash the content of all files when scanning the file system, instead of only the ones whose inode or ctime changed. Slower, but catches files rewritten with the same size and mtime")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.digestAlgorithm, "digest-algorithm", "sha256", "Algorithm of the digests of the layers, config and manifest of the image, 'sha256' or 'sha512'. Registries must support it to push the image")
+	buildCmd.PersistentFlags().BoolVar(&buildCmd.fips, "fips", false, "Only use FIPS 140 approved hash algorithms: cache IDs are computed with SHA-256 instead of CRC32 and xxhash. Changes all cache IDs")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.profileOutput, "profile-output", "", "File to write the duration of each build phase and step to, in addition to the timing table logged at the end of the build")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.profileFormat, "profile-format", "json", "Format of --profile-output, 'json', or 'trace' for the Chrome trace event format that chrome://tracing and Perfetto open")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.failureReport, "failure-report", "", "File to write a JSON report to if the build fails, with the kind of failure, the failing step, and the command and last lines of output of a failing RUN step")
+	buildCmd.PersistentFlags().DurationVar(&buildCmd.stepTimeout, "step-timeout", 0, "Maximum duration of the command of each RUN step, e.g. 30m. Its process group is killed once reached, and the build fails with exit code 11. No limit if 0")
+	buildCmd.PersistentFlags().DurationVar(&buildCmd.buildTimeout, "build-timeout", 0, "Maximum duration of the build, e.g. 1h. The command of the current RUN step is killed once reached, and the build fails with exit code 11. No limit if 0")
+	buildCmd.PersistentFlags().IntVar(&buildCmd.runRetries, "retry-run-steps", 0, "Number of times the command of a RUN step is run again if it fails, for flaky steps like package installs. A '#!RETRY [<count>]' annotation retries a single step. Retries are recorded in --profile-output and --metrics-output")
+	buildCmd.PersistentFlags().DurationVar(&buildCmd.runRetryBackoff, "retry-run-steps-backoff", 5*time.Second, "Delay before the first retry of a RUN step, doubled before each of the next ones")
+	buildCmd.PersistentFlags().IntSliceVar(&buildCmd.runRetryExitCodes, "retry-run-steps-exit-codes", nil, "Only retry RUN steps whose command exits with one of these codes, e.g. 100 for apt-get. All non-zero exit codes are retried if empty")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.stepLogDir, "step-log-dir", "", "Directory to write the stdout and stderr of each RUN step to, as <stage>-<step>.stdout.log and <stage>-<step>.stderr.log, in addition to the console")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.stepLogMaxSize, "step-log-max-size", "10MB", "Maximum size of each file written to --step-log-dir, like 512KB. Larger logs keep their first and last halves. No limit if 0")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.metricsOutput, "metrics-output", "", "File to write a JSON summary of the build to at the end: its result, the duration of each phase, its cache hits and misses, and the bytes pulled and pushed")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.reportOutput, "report-output", "", "File to write a summary of the build to at the end, with its steps and their cache hits, the digest and size of the image, and the warnings logged. Defaults to $GITHUB_STEP_SUMMARY with --report-format=github")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.reportFormat, "report-format", "json", "Format of --report-output: 'json', 'github' for the markdown of a GitHub Actions job summary, appended to the file, or 'gitlab' for a GitLab metrics report")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.metricsPush, "metrics-push", "", "URL of a Prometheus pushgateway to push the metrics of the build to at the end, under the job 'makisu'")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.otlpEndpoint, "otlp-endpoint", "", "Base URL of an OpenTelemetry collector to export the trace of the build to at the end, over OTLP/HTTP, like http://collector:4318. Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT. The build is traced as a child of $TRACEPARENT if it's set")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.progressMode, "progress", "log", "Set to 'rawjson' to also write the progress of the build as JSON status lines of BuildKit, like 'docker buildx build --progress=rawjson', for UIs rendering BuildKit builds. Set to 'log' to only log it")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.progressOutput, "progress-output", "", "File to write the progress of --progress=rawjson to. Defaults to stderr")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.notifyURL, "notify-url", "", "URL to POST JSON events of the build to: build.started, step.completed, push.completed, build.succeeded and build.failed")
+	buildCmd.PersistentFlags().StringVar(&buildCmd.notifySecret, "notify-secret", "", "Secret to sign the events of --notify-url with, in the X-Makisu-Signature header as sha256=<hex HMAC-SHA256 of the body>. Better set with $MAKISU_NOTIFY_SECRET")
+	buildCmd.PersistentFlags().StringArrayVar(&buildCmd.otlpHeaders, "otlp-header", nil, "Header to send to --otlp-endpoint, as \"<name>=<value>\", e.g. for authentication")
 
 	buildCmd.PersistentFlags().BoolVar(&buildCmd.preserveRoot, "preserve-root", false, "Copy / in the storage dir and copy it back after build.")
 
@@ -135,27 +409,229 @@ func getBuildCmd() *buildCmd {
 }
 
 func (cmd *buildCmd) processFlags() error {
-	if err := maybeBlacklistVarRun(); err != nil {
-		return fmt.Errorf("failed to extend blacklist: %s", err)
-	}
-
-	if len(cmd.blacklists) != 0 {
-		newBlacklist := append(pathutils.DefaultBlacklist, cmd.blacklists...)
-		pathutils.DefaultBlacklist = stringset.FromSlice(newBlacklist).ToSlice()
-		log.Infof("Added %d new items to blacklist: %v", len(cmd.blacklists), cmd.blacklists)
-	}
-
 	if err := tario.SetCompressionLevel(cmd.compressionLevel); err != nil {
 		return fmt.Errorf("set compression level: %s", err)
 	}
+	if cmd.numericCompressionLevel >= 0 {
+		if err := tario.SetNumericCompressionLevel(cmd.numericCompressionLevel); err != nil {
+			return fmt.Errorf("set compression level: %s", err)
+		}
+	}
+	if err := tario.SetCompressionThreads(cmd.compressionThreads); err != nil {
+		return fmt.Errorf("set compression threads: %s", err)
+	}
+	if cmd.epoch != "" {
+		if cmd.created != "" {
+			return fmt.Errorf("--epoch sets the creation time, and cannot be combined with --created")
+		} else if cmd.Flags().Changed("source-date-epoch") {
+			return fmt.Errorf("--epoch sets the mtime of files, and cannot be combined with --source-date-epoch")
+		}
+		cmd.sourceDateEpoch = cmd.epoch
+	}
+	if err := tario.SetSourceDateEpoch(cmd.sourceDateEpoch); err != nil {
+		return fmt.Errorf("set source date epoch: %s", err)
+	}
+	if cmd.created != "" {
+		created, err := parseCreated(cmd.created)
+		if err != nil {
+			return fmt.Errorf("parse created time: %s", err)
+		}
+		cmd.createdTime = &created
+	} else if tario.SourceDateEpoch != nil {
+		cmd.createdTime = tario.SourceDateEpoch
+	}
+	if cmd.epoch != "" {
+		cmd.epochTime = tario.SourceDateEpoch
+	}
+	annotations, err := image.ParseAnnotations(cmd.annotations)
+	if err != nil {
+		return fmt.Errorf("parse annotations: %s", err)
+	}
+	cmd.imageAnnotations = annotations
+	overrides, err := builder.NewConfigOverrides(
+		cmd.configEntrypoint, cmd.configCmd, cmd.configEnvs, cmd.configUser, cmd.configWorkdir)
+	if err != nil {
+		return fmt.Errorf("parse image config overrides: %s", err)
+	}
+	if !overrides.IsZero() {
+		cmd.configOverrides = overrides
+	}
+	if err := snapshot.SetScanConcurrency(cmd.scanConcurrency); err != nil {
+		return fmt.Errorf("set scan concurrency: %s", err)
+	}
+	snapshot.Paranoid = cmd.paranoid
+	if err := image.SetDigestAlgorithm(cmd.digestAlgorithm); err != nil {
+		return fmt.Errorf("set digest algorithm: %s", err)
+	}
+	step.FIPS = cmd.fips
 
 	if cmd.commit != "explicit" && cmd.commit != "implicit" {
 		return fmt.Errorf("invalid commit option: %s", cmd.commit)
+	} else if cmd.commit == "explicit" && cmd.parseOptions.strict {
+		return errors.New("--strict requires --commit=implicit")
+	}
+	if cmd.outputFormat != "docker" && cmd.outputFormat != "oci" {
+		return fmt.Errorf("invalid output format: %s", cmd.outputFormat)
+	}
+	if cmd.detectSecrets != "off" && cmd.detectSecrets != "warn" && cmd.detectSecrets != "fail" {
+		return fmt.Errorf("invalid detect secrets option: %s", cmd.detectSecrets)
+	}
+	if cmd.profileFormat != "json" && cmd.profileFormat != "trace" {
+		return fmt.Errorf("invalid profile format: %s", cmd.profileFormat)
+	}
+	if err := report.ValidFormat(cmd.reportFormat); err != nil {
+		return err
+	}
+	if cmd.reportOutput == "" && cmd.reportFormat == report.FormatGitHub {
+		cmd.reportOutput = os.Getenv("GITHUB_STEP_SUMMARY")
+	}
+	if err := validateImageNames(cmd.tag, cmd.replicas); err != nil {
+		return err
+	}
+	if len(cmd.standbys) > 0 && len(cmd.pushRegistries) == 0 {
+		return fmt.Errorf("--push-standby requires --push")
+	}
+	buildArgs, err := addSecretBuildArgs(cmd.secretArgs, cmd.buildArgs)
+	if err != nil {
+		return err
+	}
+	cmd.buildArgs = buildArgs
+	if err := cmd.loadValues(); err != nil {
+		return err
+	}
+	cmd.targetPlatform = platform.Default()
+	if cmd.platform != "" {
+		p, err := platform.Parse(cmd.platform)
+		if err != nil {
+			return fmt.Errorf("parse platform: %s", err)
+		}
+		cmd.targetPlatform = p
 	}
 
 	if err := initRegistryConfig(cmd.registryConfig); err != nil {
 		return fmt.Errorf("failed to initialize registry configuration: %s", err)
 	}
+	if cmd.sign != "" {
+		if len(cmd.pushRegistries) == 0 && len(cmd.replicas) == 0 {
+			return fmt.Errorf("--sign requires --push or --replica")
+		}
+		signer, err := signature.NewSigner(cmd.sign)
+		if err != nil {
+			return fmt.Errorf("failed to load signing key: %s", err)
+		}
+		cmd.signer = signer
+	}
+	if cmd.basePolicy != "" {
+		p, err := policy.Load(cmd.basePolicy)
+		if err != nil {
+			return fmt.Errorf("failed to load base image policy: %s", err)
+		}
+		cmd.policy = p
+	}
+	if cmd.scanCommand != "" {
+		threshold, err := scan.ParseSeverity(cmd.scanSeverity)
+		if err != nil {
+			return fmt.Errorf("parse scan severity: %s", err)
+		}
+		cmd.scanner = scan.NewExecScanner(cmd.scanCommand)
+		cmd.scanThreshold = threshold
+	}
+
+	if cmd.rootless {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("rootless builds are only supported on linux")
+		} else if cmd.allowModifyFS || cmd.preserveRoot {
+			return fmt.Errorf("--rootless builds in --rootless-dir, and cannot be combined with --modifyfs or --preserve-root")
+		}
+		dir, err := filepath.Abs(cmd.rootlessDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve rootless dir: %s", err)
+		} else if dir == "/" {
+			return fmt.Errorf("rootless dir cannot be /")
+		}
+		cmd.rootlessDir = dir
+	}
+
+	cmd.extractLimits = snapshot.ExtractLimits{
+		Files:     cmd.maxBaseFiles,
+		PathDepth: cmd.maxBaseDepth,
+	}
+	if cmd.maxBaseSize != "" {
+		maxSize, err := storage.ParseSize(cmd.maxBaseSize)
+		if err != nil {
+			return fmt.Errorf("failed to parse max base size: %s", err)
+		}
+		cmd.extractLimits.Size = maxSize
+	}
+	if cmd.maxImageSize != "" {
+		maxSize, err := storage.ParseSize(cmd.maxImageSize)
+		if err != nil {
+			return fmt.Errorf("failed to parse max image size: %s", err)
+		}
+		cmd.sizeBudget.ImageSize = maxSize
+	}
+	if cmd.maxLayerSize != "" {
+		maxSize, err := storage.ParseSize(cmd.maxLayerSize)
+		if err != nil {
+			return fmt.Errorf("failed to parse max layer size: %s", err)
+		}
+		cmd.sizeBudget.LayerSize = maxSize
+	}
+
+	if cmd.stepLogDir != "" {
+		maxSize, err := storage.ParseSize(cmd.stepLogMaxSize)
+		if err != nil {
+			return fmt.Errorf("failed to parse step log max size: %s", err)
+		}
+		dir, err := filepath.Abs(cmd.stepLogDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve step log dir: %s", err)
+		}
+		cmd.stepLogDir, cmd.stepLogMaxBytes = dir, maxSize
+	}
+
+	if cmd.otlpEndpoint == "" {
+		cmd.otlpEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if cmd.otlpEndpoint != "" {
+		cmd.tracer = &tracing.Exporter{
+			Endpoint: cmd.otlpEndpoint,
+			Headers:  make(map[string]string),
+			Parent:   os.Getenv("TRACEPARENT"),
+		}
+		for _, header := range cmd.otlpHeaders {
+			parts := strings.SplitN(header, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return fmt.Errorf("invalid otlp header: %s", header)
+			}
+			cmd.tracer.Headers[parts[0]] = parts[1]
+		}
+	} else if len(cmd.otlpHeaders) != 0 {
+		return fmt.Errorf("--otlp-header requires --otlp-endpoint")
+	}
+	if cmd.notifySecret != "" && cmd.notifyURL == "" {
+		return fmt.Errorf("--notify-secret requires --notify-url")
+	}
+	if cmd.progressMode != "log" && cmd.progressMode != "rawjson" {
+		return fmt.Errorf("invalid progress mode: %s", cmd.progressMode)
+	} else if cmd.progressOutput != "" && cmd.progressMode != "rawjson" {
+		return fmt.Errorf("--progress-output requires --progress=rawjson")
+	}
+
+	if cmd.isolation != "none" && cmd.isolation != "namespace" && cmd.isolation != "oci" {
+		return fmt.Errorf("invalid isolation option: %s", cmd.isolation)
+	} else if cmd.isolation != "none" && runtime.GOOS != "linux" {
+		return fmt.Errorf("%s isolation is only supported on linux", cmd.isolation)
+	} else if cmd.isolation == "oci" {
+		if _, err := exec.LookPath(cmd.ociRuntime); err != nil {
+			return fmt.Errorf("failed to find OCI runtime: %s", err)
+		}
+	} else if cmd.hermetic && runtime.GOOS != "linux" {
+		return fmt.Errorf("hermetic builds are only supported on linux")
+	}
+	if len(strings.Fields(cmd.defaultShell)) == 0 {
+		return fmt.Errorf("default shell can't be empty")
+	}
 
 	// If modifyfs is true, verify it's not running on Mac.
 	if cmd.allowModifyFS && runtime.GOOS == "darwin" {
@@ -176,6 +652,64 @@ func (cmd *buildCmd) processFlags() error {
 		return fmt.Errorf("storage dir cannot be under internal dir %s",
 			pathutils.DefaultInternalDir)
 	}
+
+	blacklists := cmd.blacklists
+	if cmd.sharedBlobDir != "" {
+		blacklists = append(blacklists, cmd.sharedBlobDir)
+	}
+
+	if cmd.contextChown != "" {
+		uid, gid, err := utils.ParseNumericChown(cmd.contextChown)
+		if err != nil {
+			return fmt.Errorf("invalid context chown %s: %s", cmd.contextChown, err)
+		}
+		cmd.contextChown = fmt.Sprintf("%d:%d", uid, gid)
+	}
+
+	cmd.namedContexts = make(map[string]string)
+	for _, value := range cmd.buildContexts {
+		name, source, err := context.ParseNamedContext(value)
+		if err != nil {
+			return fmt.Errorf("invalid build context: %s", err)
+		} else if _, ok := cmd.namedContexts[name]; ok {
+			return fmt.Errorf("duplicate build context: %s", name)
+		}
+		if strings.HasPrefix(source, context.DockerImagePrefix) {
+			ref := strings.TrimPrefix(source, context.DockerImagePrefix)
+			if parsed, err := image.ParseNameForPull(ref); err != nil || !parsed.IsValid() {
+				return fmt.Errorf("invalid image of build context %s: %s", name, ref)
+			}
+		} else if !context.IsRemoteSource(source) {
+			// Local contexts must not be removed or committed, like the
+			// main context.
+			if source, err = filepath.Abs(source); err != nil {
+				return fmt.Errorf("failed to resolve build context %s: %s", name, err)
+			}
+			blacklists = append(blacklists, source)
+		}
+		cmd.namedContexts[name] = source
+	}
+	if cmd.scratchDir != "" {
+		if cmd.scratchDir, err = filepath.Abs(cmd.scratchDir); err != nil {
+			return fmt.Errorf("failed to resolve scratch dir: %s", err)
+		}
+		blacklists = append(blacklists, cmd.scratchDir)
+	}
+	if cmd.scratchDirSize != "" {
+		if cmd.scratchDir == "" {
+			return fmt.Errorf("--scratch-dir-size requires --scratch-dir")
+		}
+		if cmd.scratchMaxSize, err = storage.ParseSize(cmd.scratchDirSize); err != nil {
+			return fmt.Errorf("parse scratch dir size: %s", err)
+		}
+	}
+	if cmd.stepLogDir != "" {
+		// Logs written during the build must not end up in layers.
+		blacklists = append(blacklists, cmd.stepLogDir)
+	}
+	if err := extendBlacklist(cmd.storageDir, blacklists, cmd.autoBlacklist); err != nil {
+		return fmt.Errorf("failed to extend blacklist: %s", err)
+	}
 	return nil
 }
 
@@ -184,41 +718,208 @@ func (cmd *buildCmd) newBuildPlan(
 	replicas []image.Name) (*builder.BuildPlan, error) {
 
 	// Read in and parse dockerfile.
-	dockerfile, err := cmd.getDockerfile(buildContext.ContextDir)
+	dockerfile, err := readDockerfile(
+		buildContext.ContextDir, cmd.dockerfilePath, cmd.buildArgs, cmd.templateOptions, cmd.parseOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get dockerfile: %s", err)
 	}
+	if err := cmd.applyLockfile(buildContext, dockerfile); err != nil {
+		return nil, err
+	}
 
-	// Remove image manifest if an image with the same name already exists.
-	if err := cleanManifest(buildContext, imageName); err != nil {
-		return nil, fmt.Errorf("failed to clean manifest: %s", err)
+	// Init cache manager.
+	var registryAddr string
+	if len(cmd.pushRegistries) != 0 {
+		registryAddr = cmd.pushRegistries[0]
+	}
+	cacheMgr, err := cmd.newCacheManager(buildContext, registryAddr, imageName)
+	if err != nil {
+		return nil, failure.Errorf(failure.KindCache, "failed to init cache: %s", err)
 	}
-	for _, replica := range replicas {
-		if err := cleanManifest(buildContext, replica); err != nil {
-			return nil, fmt.Errorf("failed to clean manifest: %s", err)
+	// Dry runs leave the manifests and checkpoints of the storage dir
+	// untouched.
+	if !cmd.dryRun {
+		// Remove image manifest if an image with the same name already exists.
+		if err := cleanManifest(buildContext, imageName); err != nil {
+			return nil, failure.Errorf(failure.KindError, "failed to clean manifest: %s", err)
+		}
+		for _, replica := range replicas {
+			if err := cleanManifest(buildContext, replica); err != nil {
+				return nil, failure.Errorf(failure.KindError, "failed to clean manifest: %s", err)
+			}
+		}
+		cacheMgr, err = cache.NewCheckpointManager(buildContext.ImageStore, imageName, cmd.resume, cacheMgr)
+		if err != nil {
+			return nil, failure.Errorf(failure.KindCache, "failed to init checkpoint: %s", err)
+		}
+		if cmd.streamLayers && registryAddr != "" {
+			buildContext.StartLayerStream = func() (context.LayerStream, error) {
+				return registry.New(
+					buildContext.ImageStore, registryAddr, imageName.GetRepository()).StartLayerUpload()
+			}
 		}
 	}
 
-	// Init cache manager.
-	cacheMgr := cmd.newCacheManager(buildContext, imageName)
-
 	// forceCommit will make every step attempt to commit a layer.
 	// Commit is noop for steps other than ADD/COPY/RUN if they are not after an
 	// uncommitted RUN, so this won't generate extra empty layers.
 	forceCommit := cmd.commit == "implicit"
 
 	// Create BuildPlan and validate it.
-	return builder.NewBuildPlan(
-		buildContext, imageName, replicas, cacheMgr, dockerfile, cmd.allowModifyFS, forceCommit, cmd.target)
+	plan, err := builder.NewBuildPlan(
+		buildContext, imageName, replicas, cacheMgr, dockerfile, cmd.allowModifyFS || cmd.rootless,
+		forceCommit, cmd.target)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.squash || cmd.squashFrom > 0 {
+		plan.SetSquash(cmd.squashFrom)
+	}
+	if cmd.epochTime != nil {
+		plan.SetEpoch(*cmd.epochTime)
+	} else if cmd.createdTime != nil {
+		plan.SetCreated(*cmd.createdTime)
+	}
+	labels := cmd.gitLabels
+	if cmd.contextDigestValue != "" {
+		labels = utils.MergeStringMaps(labels, map[string]string{
+			context.ContextDigestLabel: string(cmd.contextDigestValue),
+		})
+	}
+	if len(labels) != 0 {
+		plan.SetLabels(labels)
+	}
+	if cmd.configOverrides != nil {
+		plan.SetConfigOverrides(cmd.configOverrides)
+	}
+	if len(cmd.imageAnnotations.Manifest) != 0 {
+		plan.SetAnnotations(cmd.imageAnnotations.Manifest)
+	}
+	return plan, nil
+}
+
+// applyLockfile pins the images of the dockerfile at their digests in the
+// lockfile, like image contexts. With --locked, it first checks that the
+// lockfile is up to date.
+func (cmd *buildCmd) applyLockfile(
+	buildContext *context.BuildContext, stages dockerfile.Stages) error {
+
+	path := cmd.lockfile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(buildContext.ContextDir, path)
+	}
+	l, err := lockfile.Load(path)
+	if os.IsNotExist(err) && !cmd.locked {
+		return nil
+	} else if os.IsNotExist(err) {
+		return failure.Errorf(failure.KindPolicy, "--locked requires a lockfile, run makisu lock to create %s", cmd.lockfile)
+	} else if err != nil {
+		return fmt.Errorf("failed to load lockfile: %s", err)
+	}
+
+	var images []string
+	for _, img := range stages.Images() {
+		_, isDir := buildContext.NamedContexts[img]
+		_, isImage := buildContext.NamedImages[img]
+		if !isDir && !isImage {
+			images = append(images, img)
+		}
+	}
+	if cmd.locked {
+		if err := l.Verify(images, resolveImageDigest(buildContext.ImageStore)); err != nil {
+			return failure.Errorf(failure.KindPolicy, "lockfile %s is outdated: %s", cmd.lockfile, err)
+		}
+	}
+	for _, img := range images {
+		if pinned, ok := l.Pin(img); ok {
+			log.Infof("Using %s from lockfile", pinned)
+			buildContext.NamedImages[img] = pinned
+		}
+	}
+	return nil
+}
+
+// applyGitMetadata adds the build args and labels of the git metadata of the
+// context, and uses its commit time as creation time unless it's set.
+func (cmd *buildCmd) applyGitMetadata(metadata *context.GitMetadata) {
+	if metadata == nil {
+		log.Warnf("Build context is not a git repository, ignoring --git-metadata")
+		return
+	}
+	log.Infow("Using git metadata of build context",
+		"git_sha", metadata.SHA, "git_branch", metadata.Branch, "git_dirty", metadata.Dirty)
+	// Build args given later take precedence.
+	cmd.buildArgs = append(metadata.BuildArgs(), cmd.buildArgs...)
+	cmd.gitLabels = metadata.Labels()
+	if cmd.createdTime == nil {
+		cmd.createdTime = &metadata.CommitTime
+	}
 }
 
 // Build image from the specified dockerfile.
 // If --push is specified, will also push the image to those registries.
 // If --load is specified, will load the image into the local docker daemon.
-func (cmd *buildCmd) Build(contextDir string) error {
+func (cmd *buildCmd) Build(contextSource string) error {
 	log.Infof("Starting Makisu build (version=%s)", utils.BuildHash)
+	recorder := profile.NewRecorder()
+	defer cmd.reportProfile(recorder)
+	cmd.profile, cmd.start = recorder, time.Now()
+	cmd.failures = failure.NewRecorder()
+	if cmd.reportOutput != "" {
+		cmd.warnings = &report.Warnings{}
+		log.SetLogger(log.GetLogger().Desugar().WithOptions(zap.Hooks(cmd.warnings.Hook)).Sugar())
+	}
+	if cmd.notifyURL != "" {
+		cmd.notifier = notify.New(cmd.notifyURL, cmd.notifySecret, cmd.tag)
+		cmd.notifier.Notify(notify.Event{Type: notify.EventBuildStarted})
+	}
+	if cmd.progressMode == "rawjson" {
+		var output io.Writer = os.Stderr
+		if cmd.progressOutput != "" {
+			f, err := os.Create(cmd.progressOutput)
+			if err != nil {
+				return fmt.Errorf("failed to create progress output: %s", err)
+			}
+			defer f.Close()
+			output = f
+		}
+		cmd.progress = progress.NewWriter(output)
+	}
+	var deadline time.Time
+	if cmd.buildTimeout > 0 {
+		deadline = time.Now().Add(cmd.buildTimeout)
+		// RUN steps are killed at the deadline and fail the build. The other
+		// phases, like pulls, are interrupted a bit later, so RUN steps are
+		// reported first.
+		timer := time.AfterFunc(cmd.buildTimeout+_buildTimeoutGrace, func() {
+			cmd.failures.SetTimeout("build")
+			cmd.fail(fmt.Errorf("build timed out after %s", cmd.buildTimeout))
+		})
+		defer timer.Stop()
+	}
 
-	// Create BuildContext.
+	imageStore, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("failed to init image store: %s", err)
+	}
+	// Make sure sandbox is cleaned after build.
+	defer imageStore.CleanupSandbox()
+	if cmd.scratchDir != "" {
+		if err := imageStore.SetScratchDir(cmd.scratchDir, cmd.scratchMaxSize); err != nil {
+			return fmt.Errorf("failed to init scratch dir: %s", err)
+		}
+	}
+
+	// Create BuildContext. Remote contexts are fetched in the sandbox.
+	contextDir := contextSource
+	var gitMetadata *context.GitMetadata
+	if context.IsRemoteSource(contextSource) {
+		contextDir, gitMetadata, err = context.FetchContextWithGitMetadata(
+			contextSource, filepath.Join(imageStore.TempDir(-1), "context"), os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to fetch build context: %s", err)
+		}
+	}
 	contextDirAbs, err := filepath.Abs(contextDir)
 	if err != nil {
 		return fmt.Errorf("failed to resolve context dir: %s", err)
@@ -226,19 +927,117 @@ func (cmd *buildCmd) Build(contextDir string) error {
 	if contextDirAbs == "/" {
 		return fmt.Errorf("the absolute path for context directory %s is /. Cannot use root as context", contextDir)
 	}
-	imageStore, err := storage.NewImageStore(cmd.storageDir)
-	if err != nil {
-		return fmt.Errorf("failed to init image store: %s", err)
+	if cmd.gitMetadata {
+		if !context.IsRemoteSource(contextSource) {
+			if gitMetadata, err = context.ReadGitMetadata(contextDirAbs); err != nil {
+				return fmt.Errorf("failed to read git metadata: %s", err)
+			}
+		}
+		cmd.applyGitMetadata(gitMetadata)
+	}
+	if cmd.contextDigest {
+		if cmd.contextDigestValue, err = context.Digest(contextDirAbs); err != nil {
+			return fmt.Errorf("failed to compute context digest: %s", err)
+		}
+		log.Infow(fmt.Sprintf("Computed context digest %s", cmd.contextDigestValue),
+			"context_digest", cmd.contextDigestValue)
+	}
+	if cmd.sharedBlobDir != "" {
+		if err := imageStore.Layers.EnableSharedBlobStore(cmd.sharedBlobDir); err != nil {
+			return fmt.Errorf("failed to init shared blob store: %s", err)
+		}
+	}
+	if cmd.chunkStore {
+		if err := imageStore.Layers.EnableChunkStore(cmd.storageDir); err != nil {
+			return fmt.Errorf("failed to init chunk store: %s", err)
+		}
+		defer func() {
+			if err := imageStore.Layers.DedupStoreFiles(); err != nil {
+				log.Warnf("Failed to dedup cached layers: %s", err)
+			}
+		}()
+	}
+	// Rootless builds leave the root of the namespace after the build plan
+	// is executed, to write their outputs. Its content is removed first, like
+	// with --modifyfs.
+	var buildContext *context.BuildContext
+	leaveRootlessRoot := func() {}
+	if cmd.rootless && !cmd.dryRun {
+		restore, err := cmd.enterRootlessRoot(contextDirAbs)
+		if err != nil {
+			return fmt.Errorf("failed to enter rootless dir: %s", err)
+		}
+		var left bool
+		leaveRootlessRoot = func() {
+			if left {
+				return
+			}
+			left = true
+			if buildContext != nil {
+				buildContext.MemFS.Remove()
+			}
+			if err := restore(); err != nil {
+				// Outputs would be written in the rootless dir.
+				log.Fatalf("Failed to leave rootless dir: %s", err)
+			}
+		}
+		defer leaveRootlessRoot()
 	}
-	buildContext, err := context.NewBuildContext("/", contextDirAbs, imageStore)
+	buildContext, err = context.NewBuildContext("/", contextDirAbs, imageStore)
 	if err != nil {
 		return fmt.Errorf("failed to create initial build context: %s", err)
 	}
 	defer buildContext.Cleanup()
+	buildContext.Excludes = cmd.excludes
+	buildContext.CleanPackageCaches = cmd.cleanCaches
+	if cmd.detectSecrets != "off" {
+		buildContext.Secrets = secrets.NewDetector(cmd.secretAllows, cmd.detectSecrets == "warn")
+	}
+	buildContext.IncrementalScan = cmd.incrementalScan
+	buildContext.OverlaySnapshot = cmd.overlaySnapshot
+	buildContext.IsolateRuns = cmd.isolation != "none"
+	if cmd.isolation == "oci" {
+		buildContext.Runtime = isolation.OCIRuntime{Path: cmd.ociRuntime}
+	}
+	buildContext.Hermetic = cmd.hermetic
+	buildContext.ContextChown = cmd.contextChown
+	buildContext.Strict = cmd.parseOptions.strict
+	buildContext.DefaultPath = cmd.defaultPath
+	buildContext.Shell = strings.Fields(cmd.defaultShell)
+	buildContext.StepTimeout = cmd.stepTimeout
+	buildContext.RunRetry = shell.RetryPolicy{
+		Retries:   cmd.runRetries,
+		Backoff:   cmd.runRetryBackoff,
+		ExitCodes: cmd.runRetryExitCodes,
+	}
+	buildContext.RunEnv = shell.PassthroughEnv(os.Environ(), cmd.runEnvPassthrough)
+	buildContext.Deadline = deadline
+	if cmd.stepLogDir != "" {
+		if buildContext.StepLogs, err = steplog.NewDir(cmd.stepLogDir, cmd.stepLogMaxBytes); err != nil {
+			return fmt.Errorf("failed to init step logs: %s", err)
+		}
+	}
+	buildContext.Profile = recorder
+	buildContext.Failure = cmd.failures
+	buildContext.Notifier = cmd.notifier
+	buildContext.Progress = cmd.progress
+	buildContext.Platform = cmd.targetPlatform
+	buildContext.WarnBaseUpdates = cmd.baseUpdates
+	buildContext.ExtractLimits = cmd.extractLimits
+	if cmd.policy != nil {
+		buildContext.VerifyBaseImage = func(name image.Name) (image.Digest, error) {
+			return cmd.verifyBaseImage(imageStore, name)
+		}
+	}
+	if err := addNamedContexts(buildContext, cmd.namedContexts); err != nil {
+		return fmt.Errorf("failed to add build contexts: %s", err)
+	}
+
+	if cmd.dryRun {
+		return cmd.dryRunBuild(buildContext)
+	}
 
-	// Make sure sandbox is cleaned after build.
 	// Optionally remove everything before and after build.
-	defer storage.CleanupSandbox(cmd.storageDir)
 	if cmd.allowModifyFS {
 		if cmd.preserveRoot {
 			rootPreserver, err := storage.NewRootPreserver("/", cmd.storageDir, pathutils.DefaultBlacklist)
@@ -260,43 +1059,335 @@ func (cmd *buildCmd) Build(contextDir string) error {
 	for _, replica := range cmd.replicas {
 		parsedReplicas = append(parsedReplicas, image.MustParseName(replica))
 	}
+	parseStart := time.Now()
 	buildPlan, err := cmd.newBuildPlan(buildContext, imageName, parsedReplicas)
 	if err != nil {
-		return fmt.Errorf("failed to create build plan: %s", err)
+		return failure.Errorf(failure.KindOf(err, failure.KindParse), "failed to create build plan: %s", err)
 	}
-	if _, err = buildPlan.Execute(); err != nil {
+	recorder.Record(profile.PhaseParse, parseStart, 0)
+	defer storage.LogSpaceUsage(buildContext.ImageStore.SandboxDir)
+	manifest, err := buildPlan.Execute()
+	leaveRootlessRoot()
+	if err != nil {
 		return fmt.Errorf("failed to execute build plan: %s", err)
 	}
-	log.Infof("Successfully built image %s", imageName.ShortName())
+	// The digest of the manifest, as saved in the store and pushed.
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %s", err)
+	}
+	digest, err := image.NewDigester().FromBytes(manifestJSON)
+	if err != nil {
+		return fmt.Errorf("failed to compute manifest digest: %s", err)
+	}
+	cmd.digest = digest
+	cmd.imageSize = manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		cmd.imageSize += layer.Size
+	}
+	log.Infow(fmt.Sprintf("Successfully built image %s", imageName.ShortName()),
+		"image", imageName.ShortName(), "digest", digest)
+	if err := cache.RemoveCheckpoint(buildContext.ImageStore, imageName); err != nil {
+		log.Warnf("Failed to remove build checkpoint: %s", err)
+	}
+
+	if !cmd.sizeBudget.IsZero() {
+		if err := cmd.checkSizeBudget(buildContext, manifest); err != nil {
+			return err
+		}
+	}
+	if cmd.maxLayerFiles > 0 {
+		cmd.checkLayerFiles(buildContext, manifest)
+	}
+
+	// Scan the image for vulnerabilities before it leaves the builder.
+	if cmd.scanner != nil {
+		scanStart := time.Now()
+		if err := cmd.scanImage(buildContext, imageName); err != nil {
+			return err
+		}
+		recorder.Record(profile.PhaseVulnScan, scanStart, 0)
+	}
 
 	// Push image to registries that were specified in the --push flag.
+	pushStart := time.Now()
+	// Each target is a list of endpoints, tried in order until one of them
+	// accepts the image. Only --push registries fail over to standbys.
+	var targets [][]image.Name
 	for _, registry := range cmd.pushRegistries {
-		target := imageName.WithRegistry(registry)
-		if err := pushImage(buildContext, target); err != nil {
-			return fmt.Errorf("failed to push image: %s", err)
+		endpoints := []image.Name{imageName.WithRegistry(registry)}
+		for _, standby := range cmd.standbys {
+			endpoints = append(endpoints, imageName.WithRegistry(standby))
 		}
+		targets = append(targets, endpoints)
 	}
 	for _, replica := range cmd.replicas {
-		target := image.MustParseName(replica)
-		if err := pushImage(buildContext, target); err != nil {
-			return fmt.Errorf("failed to push image: %s", err)
+		targets = append(targets, []image.Name{image.MustParseName(replica)})
+	}
+	for _, endpoints := range targets {
+		// Images with index annotations are pushed as an index, which is what
+		// their tag references, signs and reports.
+		pushed := digest
+		target, err := registry.PushWithFailover(endpoints, func(name image.Name) error {
+			vertex := "pushing " + name.String()
+			cmd.progress.Start(vertex)
+			var err error
+			if len(cmd.imageAnnotations.Index) != 0 {
+				pushed, err = pushImageIndex(buildContext, name, cmd.imageAnnotations.Index)
+			} else {
+				err = pushImage(buildContext, name)
+			}
+			cmd.progress.Complete(vertex, err)
+			return err
+		})
+		if err != nil {
+			return failure.Errorf(failure.KindPush, "failed to push image: %s", err)
+		}
+		if cmd.signer != nil {
+			if err := signImage(buildContext, target, pushed, cmd.signer); err != nil {
+				return failure.Errorf(failure.KindPush, "failed to sign image: %s", err)
+			}
 		}
+		cmd.notifier.Notify(notify.Event{
+			Type:   notify.EventPushCompleted,
+			Image:  target.String(),
+			Digest: string(pushed),
+		})
+	}
+	if len(cmd.pushRegistries) > 0 || len(cmd.replicas) > 0 {
+		recorder.Record(profile.PhasePush, pushStart, 0)
 	}
 
 	// Optionally save image as a tar file.
 	if cmd.destination != "" {
+		saveStart := time.Now()
 		if err := cmd.saveImage(buildContext, imageName); err != nil {
 			return fmt.Errorf("failed to save image: %s", err)
 		}
+		recorder.Record(profile.PhaseSave, saveStart, 0)
 	}
 
 	// Optionally load image to local docker daemon.
 	if cmd.doLoad {
+		loadStart := time.Now()
 		if err := cmd.loadImage(buildContext, imageName); err != nil {
 			return fmt.Errorf("failed to load image: %s", err)
 		}
+		recorder.Record(profile.PhaseLoad, loadStart, 0)
 	}
 
 	log.Infof("Finished building %s", imageName.ShortName())
+	if cmd.quiet {
+		fmt.Println(digest)
+	}
 	return nil
 }
+
+// dryRunBuild prints the plan of the build to stdout, without executing any
+// step or pushing anything.
+func (cmd *buildCmd) dryRunBuild(buildContext *context.BuildContext) error {
+	imageName, err := cmd.getTargetImageName()
+	if err != nil {
+		return fmt.Errorf("failed to get target image name: %s", err)
+	}
+	targets := make([]image.Name, 0)
+	for _, registry := range cmd.pushRegistries {
+		targets = append(targets, imageName.WithRegistry(registry))
+	}
+	var parsedReplicas []image.Name
+	for _, replica := range cmd.replicas {
+		parsedReplicas = append(parsedReplicas, image.MustParseName(replica))
+		targets = append(targets, image.MustParseName(replica))
+	}
+	buildPlan, err := cmd.newBuildPlan(buildContext, imageName, parsedReplicas)
+	if err != nil {
+		return failure.Errorf(failure.KindOf(err, failure.KindParse), "failed to create build plan: %s", err)
+	}
+
+	store := buildContext.ImageStore
+	plan, err := buildPlan.DryRun(func(name image.Name) (image.Digest, *image.DistributionManifest, error) {
+		if cmd.policy != nil {
+			if _, err := cmd.verifyBaseImage(store, name); err != nil {
+				return "", nil, err
+			}
+		}
+		client := registry.New(
+			store, name.GetRegistry(), name.GetRepository()).WithPlatform(cmd.targetPlatform)
+		digest, err := client.ResolveManifestDigest(name.GetTag())
+		if err != nil {
+			return "", nil, fmt.Errorf("resolve manifest digest: %s", err)
+		}
+		manifest, err := client.PullManifest(name.GetTag())
+		if err != nil {
+			return "", nil, fmt.Errorf("pull manifest: %s", err)
+		}
+		return digest, manifest, nil
+	})
+	if err != nil {
+		return failure.Errorf(failure.KindPull, "failed to dry run build plan: %s", err)
+	}
+
+	// Layers are pushed unless all push targets already have them.
+	for i := range plan.Layers {
+		layer := &plan.Layers[i]
+		for _, target := range targets {
+			if layer.Digest == "" {
+				layer.Push = true
+				break
+			}
+			exists, err := registry.New(store, target.GetRegistry(), target.GetRepository()).LayerExists(layer.Digest)
+			if err != nil {
+				return failure.Errorf(failure.KindPush, "failed to check layer %s in %s: %s", layer.Digest, target, err)
+			} else if !exists {
+				layer.Push = true
+				break
+			}
+		}
+	}
+	return plan.Write(os.Stdout)
+}
+
+// verifyBaseImage checks a base image against the base image policy, and
+// returns the digest to pull it at.
+func (cmd *buildCmd) verifyBaseImage(store *storage.ImageStore, name image.Name) (image.Digest, error) {
+	client := registry.New(store, name.GetRegistry(), name.GetRepository())
+	digest, err := cmd.policy.Check(client, name)
+	if _, ok := err.(*policy.Violation); ok {
+		cmd.failures.SetKind(failure.KindPolicy)
+	}
+	return digest, err
+}
+
+// parseCreated parses an RFC 3339 timestamp, or a number of seconds since the
+// epoch.
+func parseCreated(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// fail logs the error of a failed build, writes the failure report if
+// --failure-report is set, and exits with the code of the kind of failure.
+func (cmd *buildCmd) fail(err error) {
+	log.Error(err)
+	report := cmd.failures.Report(err)
+	if cmd.failureReport != "" {
+		if err := report.Write(cmd.failureReport); err != nil {
+			log.Warnf("Failed to write failure report: %s", err)
+		}
+	}
+	cmd.reportMetrics(string(report.Kind))
+	cmd.reportSummary(string(report.Kind))
+	cmd.exportTrace(errors.New(report.Error))
+	cmd.notifier.Notify(notify.Event{
+		Type:      notify.EventBuildFailed,
+		Stage:     report.Stage,
+		Step:      report.Step,
+		Directive: report.Directive,
+		Kind:      string(report.Kind),
+		ExitCode:  report.ExitCode,
+		Error:     report.Error,
+	})
+	cmd.notifier.Close()
+	os.Exit(report.ExitCode)
+}
+
+// exportTrace exports the trace of the build to --otlp-endpoint, if it's set.
+func (cmd *buildCmd) exportTrace(err error) {
+	if cmd.tracer == nil || cmd.start.IsZero() {
+		return
+	}
+	build := &tracing.Build{
+		Name:       "makisu build",
+		Start:      cmd.start,
+		End:        time.Now(),
+		Spans:      cmd.profile.Spans(),
+		Err:        err,
+		Attributes: map[string]string{"makisu.tag": cmd.tag, "makisu.version": utils.BuildHash},
+	}
+	if err := cmd.tracer.Export(build); err != nil {
+		log.Warnf("Failed to export trace: %s", err)
+	}
+}
+
+// reportMetrics writes the metrics summary of the build to --metrics-output,
+// and pushes its metrics to --metrics-push, if they're set.
+func (cmd *buildCmd) reportMetrics(result string) {
+	if cmd.metricsOutput == "" && cmd.metricsPush == "" {
+		return
+	}
+	var duration time.Duration
+	if !cmd.start.IsZero() {
+		duration = time.Since(cmd.start)
+	}
+	summary := metrics.NewSummary(cmd.profile.Spans(), duration, result)
+	summary.ContextDigest = string(cmd.contextDigestValue)
+	if cmd.metricsOutput != "" {
+		if err := summary.Write(cmd.metricsOutput); err != nil {
+			log.Warnf("Failed to write metrics output: %s", err)
+		}
+	}
+	if cmd.metricsPush != "" {
+		m := metrics.New()
+		m.Observe(summary)
+		if err := m.Push(cmd.metricsPush, "makisu"); err != nil {
+			log.Warnf("Failed to push metrics: %s", err)
+		}
+	}
+}
+
+// reportSummary writes the summary of the build to --report-output, if it's
+// set.
+func (cmd *buildCmd) reportSummary(result string) {
+	if cmd.reportOutput == "" {
+		return
+	}
+	var duration time.Duration
+	if !cmd.start.IsZero() {
+		duration = time.Since(cmd.start)
+	}
+	summary := report.NewSummary(cmd.tag, result, duration, cmd.profile.Spans())
+	summary.Digest = string(cmd.digest)
+	summary.Size = cmd.imageSize
+	for _, l := range cmd.layers {
+		summary.Layers = append(summary.Layers, report.Layer{
+			Digest:    string(l.Digest),
+			Size:      l.Size,
+			Files:     l.Files,
+			CreatedBy: l.CreatedBy,
+		})
+	}
+	if cmd.warnings != nil {
+		summary.Warnings = cmd.warnings.Messages()
+	}
+	if err := summary.Write(cmd.reportOutput, cmd.reportFormat); err != nil {
+		log.Warnf("Failed to write report output: %s", err)
+	}
+}
+
+// reportProfile logs the timing table of the build, and writes the profile to
+// --profile-output if it's set.
+func (cmd *buildCmd) reportProfile(recorder *profile.Recorder) {
+	var table bytes.Buffer
+	if err := recorder.WriteTable(&table); err == nil {
+		log.Infof("Build timing:\n%s", table.String())
+	}
+	if cmd.profileOutput == "" {
+		return
+	}
+	f, err := os.Create(cmd.profileOutput)
+	if err != nil {
+		log.Warnf("Failed to create profile output: %s", err)
+		return
+	}
+	defer f.Close()
+	if cmd.profileFormat == "trace" {
+		err = recorder.WriteTrace(f)
+	} else {
+		err = recorder.WriteJSON(f)
+	}
+	if err != nil {
+		log.Warnf("Failed to write profile output: %s", err)
+	}
+}
@@ -0,0 +1,287 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/utils"
+
+	"github.com/spf13/cobra"
+)
+
+// cacheOptions holds the flags that configure the cacheID key-value store.
+type cacheOptions struct {
+	localCacheTTL      time.Duration
+	redisCacheAddress  string
+	redisCachePassword string
+	redisCacheTTL      time.Duration
+	httpCacheAddress   string
+	httpCacheHeaders   []string
+
+	memcachedCacheAddresses []string
+	memcachedCacheUsername  string
+	memcachedCachePassword  string
+	memcachedCacheTTL       time.Duration
+
+	cacheRepo string
+}
+
+func (opts *cacheOptions) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().DurationVar(&opts.localCacheTTL, "local-cache-ttl", time.Hour*336, "Time-To-Live for local cache")
+	cmd.PersistentFlags().StringVar(&opts.redisCacheAddress, "redis-cache-addr", "", "The address of a redis server for cacheID to layer sha mapping")
+	cmd.PersistentFlags().StringVar(&opts.redisCachePassword, "redis-cache-password", "", "The password of the Redis server, should match 'requirepass' in redis.conf")
+	cmd.PersistentFlags().DurationVar(&opts.redisCacheTTL, "redis-cache-ttl", time.Hour*336, "Time-To-Live for redis cache")
+	cmd.PersistentFlags().StringVar(&opts.httpCacheAddress, "http-cache-addr", "", "The address of the http server for cacheID to layer sha mapping")
+	cmd.PersistentFlags().StringArrayVar(&opts.httpCacheHeaders, "http-cache-header", nil, "Request header for http cache server. Format is \"--http-cache-header <header>:<value>\"")
+	cmd.PersistentFlags().StringArrayVar(&opts.memcachedCacheAddresses, "memcached-cache-addr", nil, "The address of a memcached server for cacheID to layer sha mapping. Repeat to shard keys across multiple servers")
+	cmd.PersistentFlags().StringVar(&opts.memcachedCacheUsername, "memcached-cache-username", "", "The SASL username of the memcached servers. SASL is disabled if empty")
+	cmd.PersistentFlags().StringVar(&opts.memcachedCachePassword, "memcached-cache-password", "", "The SASL password of the memcached servers")
+	cmd.PersistentFlags().DurationVar(&opts.memcachedCacheTTL, "memcached-cache-ttl", time.Hour*336, "Time-To-Live for memcached cache")
+	cmd.PersistentFlags().StringVar(&opts.cacheRepo, "cache-repo", "", "Repository to push cache layers to and pull them from instead of the repository of the image, e.g. registry.example.com/cache/makisu. Defaults to the push registry if it has none. Each layer pushed is tagged with makisu-cache-<UTC time>-<cache ID>, so the registry doesn't garbage collect it and old tags can be deleted by date")
+}
+
+func getCacheCmd() *cobra.Command {
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the distributed layer cache",
+	}
+	cacheCmd.AddCommand(getCacheWarmCmd().Command)
+	return cacheCmd
+}
+
+type cacheWarmCmd struct {
+	*cobra.Command
+
+	image          string
+	dockerfilePath string
+	registryConfig string
+
+	target        string
+	buildArgs     []string
+	allowModifyFS bool
+	commit        string
+	excludes      []string
+	cleanCaches   bool
+
+	templateOptions
+	parseOptions
+	cacheOptions
+
+	storageDir string
+}
+
+func getCacheWarmCmd() *cacheWarmCmd {
+	warmCmd := &cacheWarmCmd{
+		Command: &cobra.Command{
+			Use:                   "warm --image=<image_name> [flags] <context_path>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Seed the cache with the layers of an image previously built from the same dockerfile",
+		},
+	}
+	warmCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Requires build context as argument")
+		}
+		return nil
+	}
+	warmCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := warmCmd.processFlags(); err != nil {
+			log.Errorf("failed to process flags: %s", err)
+			os.Exit(1)
+		}
+
+		if err := warmCmd.Warm(args[0]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	warmCmd.PersistentFlags().StringVar(&warmCmd.image, "image", "", "Existing image \"<registry>/<repo>:<tag>\" built from the dockerfile (required)")
+	warmCmd.PersistentFlags().StringVarP(&warmCmd.dockerfilePath, "file", "f", "Dockerfile", "The absolute path to the dockerfile")
+	warmCmd.PersistentFlags().StringVar(&warmCmd.registryConfig, "registry-config", "", "Registry configuration, for the credentials and TLS settings of the registry")
+
+	warmCmd.PersistentFlags().StringVar(&warmCmd.target, "target", "", "Set the target build stage the image was built from.")
+	warmCmd.PersistentFlags().StringArrayVar(&warmCmd.buildArgs, "build-arg", nil, "Argument to the dockerfile as per the spec of ARG. Format is \"--build-arg <arg>=<value>\"")
+	warmCmd.templateOptions.addFlags(warmCmd.Command)
+	warmCmd.parseOptions.addFlags(warmCmd.Command)
+	warmCmd.PersistentFlags().BoolVar(&warmCmd.allowModifyFS, "modifyfs", false, "Must match the value future builds use, since it is part of the cache IDs")
+	warmCmd.PersistentFlags().StringVar(&warmCmd.commit, "commit", "implicit", "Must match the value future builds use. Set to explicit to only commit at steps with '#!COMMIT' annotations; Set to implicit to commit at every ADD/COPY/RUN step")
+
+	warmCmd.PersistentFlags().StringArrayVar(&warmCmd.excludes, "exclude", nil, "Must match the values future builds use, since they are part of the cache IDs")
+	warmCmd.PersistentFlags().BoolVar(&warmCmd.cleanCaches, "clean-package-caches", false, "Must match the value future builds use, since it is part of the cache IDs")
+
+	warmCmd.cacheOptions.addFlags(warmCmd.Command)
+
+	warmCmd.PersistentFlags().StringVar(&warmCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for temp files and cached layers")
+
+	warmCmd.MarkFlagRequired("image")
+	warmCmd.Flags().SortFlags = false
+	warmCmd.PersistentFlags().SortFlags = false
+
+	return warmCmd
+}
+
+func (cmd *cacheWarmCmd) processFlags() error {
+	if cmd.commit != "explicit" && cmd.commit != "implicit" {
+		return fmt.Errorf("invalid commit option: %s", cmd.commit)
+	}
+
+	if err := initRegistryConfig(cmd.registryConfig); err != nil {
+		return fmt.Errorf("failed to initialize registry configuration: %s", err)
+	}
+	return nil
+}
+
+// Warm replays the dockerfile against the history of an existing image and
+// stores the resulting cacheID to layer mappings in the cache, so the next
+// build of that dockerfile can reuse the layers of the image.
+func (cmd *cacheWarmCmd) Warm(contextDir string) error {
+	log.Infof("Starting Makisu cache warm-up (version=%s)", utils.BuildHash)
+
+	contextDirAbs, err := filepath.Abs(contextDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve context dir: %s", err)
+	}
+	imageStore, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("failed to init image store: %s", err)
+	}
+	defer imageStore.CleanupSandbox()
+	buildContext, err := context.NewBuildContext("/", contextDirAbs, imageStore)
+	if err != nil {
+		return fmt.Errorf("failed to create initial build context: %s", err)
+	}
+	defer buildContext.Cleanup()
+	buildContext.Excludes = cmd.excludes
+	buildContext.CleanPackageCaches = cmd.cleanCaches
+
+	stages, err := readDockerfile(
+		buildContext.ContextDir, cmd.dockerfilePath, cmd.buildArgs, cmd.templateOptions, cmd.parseOptions)
+	if err != nil {
+		return fmt.Errorf("failed to get dockerfile: %s", err)
+	}
+	baseLayers, err := cmd.countBaseLayers(imageStore, stages)
+	if err != nil {
+		return fmt.Errorf("failed to get base image layers: %s", err)
+	}
+
+	imageName, err := image.ParseNameForPull(cmd.image)
+	if err != nil || !imageName.IsValid() {
+		return fmt.Errorf("invalid image name: %s", cmd.image)
+	}
+	manifest, config, err := pullImageMetadata(imageStore, imageName)
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %s", imageName, err)
+	}
+
+	// The layers already exist in the repository of the image, so the cache
+	// manager will skip pushing them, unless it uses a cache repository.
+	cacheMgr, err := cmd.newCacheManager(buildContext, imageName.GetRegistry(), imageName)
+	if err != nil {
+		return fmt.Errorf("failed to init cache: %s", err)
+	}
+	plan, err := builder.NewBuildPlan(
+		buildContext, imageName, nil, cacheMgr, stages, cmd.allowModifyFS,
+		cmd.commit == "implicit", cmd.target)
+	if err != nil {
+		return fmt.Errorf("failed to create build plan: %s", err)
+	}
+	n, err := plan.SeedCache(manifest, config, baseLayers)
+	if err != nil {
+		return fmt.Errorf("failed to seed cache: %s", err)
+	}
+	log.Infof("Finished warming cache with %d entries from %s", n, imageName.ShortName())
+	return nil
+}
+
+// countBaseLayers returns the number of layers in the base image of the target
+// stage.
+func (cmd *cacheWarmCmd) countBaseLayers(
+	store *storage.ImageStore, stages []*dockerfile.Stage) (int, error) {
+
+	if len(stages) == 0 {
+		return 0, fmt.Errorf("no stage in dockerfile")
+	}
+	aliases := make(map[string]struct{})
+	target := stages[len(stages)-1]
+	for _, stage := range stages {
+		if stage.From.Alias == cmd.target && cmd.target != "" {
+			target = stage
+			break
+		}
+		aliases[stage.From.Alias] = struct{}{}
+	}
+
+	if _, ok := aliases[target.From.Image]; ok {
+		return 0, fmt.Errorf("target stage is based on stage %s, which is not supported", target.From.Image)
+	} else if strings.EqualFold(target.From.Image, image.Scratch) {
+		return 0, nil
+	}
+	baseName, err := image.ParseNameForPull(target.From.Image)
+	if err != nil || !baseName.IsValid() {
+		return 0, fmt.Errorf("invalid base image name: %s", target.From.Image)
+	}
+	manifest, err := registry.New(
+		store, baseName.GetRegistry(), baseName.GetRepository()).PullManifest(baseName.GetTag())
+	if err != nil {
+		return 0, fmt.Errorf("pull manifest of %s: %s", baseName, err)
+	}
+	return len(manifest.Layers), nil
+}
+
+// pullImageMetadata pulls the manifest and config of an image, without its
+// layers.
+func pullImageMetadata(
+	store *storage.ImageStore,
+	imageName image.Name) (*image.DistributionManifest, *image.Config, error) {
+
+	client := registry.New(store, imageName.GetRegistry(), imageName.GetRepository())
+	manifest, err := client.PullManifest(imageName.GetTag())
+	if err != nil {
+		return nil, nil, fmt.Errorf("pull manifest: %s", err)
+	}
+	if _, err := client.PullImageConfig(manifest.Config.Digest); err != nil {
+		return nil, nil, fmt.Errorf("pull image config: %s", err)
+	}
+	reader, err := store.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	if err != nil {
+		return nil, nil, fmt.Errorf("get image config reader: %s", err)
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read image config: %s", err)
+	}
+	config := new(image.Config)
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, nil, fmt.Errorf("unmarshal image config: %s", err)
+	}
+	return manifest, config, nil
+}
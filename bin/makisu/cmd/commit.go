@@ -0,0 +1,130 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/uber/makisu/lib/commit"
+	"github.com/uber/makisu/lib/log"
+
+	"github.com/spf13/cobra"
+)
+
+type commitCmd struct {
+	*cobra.Command
+
+	changes commit.Changes
+	tag     string
+}
+
+func getCommitCmd() *commitCmd {
+	commitCmd := &commitCmd{
+		Command: &cobra.Command{
+			Use:                   "commit [flags] [<context>] [-- <build flags>]",
+			DisableFlagsInUseLine: true,
+			Short:                 "Apply changes to an existing image, without writing a dockerfile",
+			Long: "Apply changes to an existing image, without writing a dockerfile. " +
+				"The changes are turned into a dockerfile, applying env, copies, runs, labels and then raw instructions, " +
+				"which is built by a separate makisu build process with the build flags after --. " +
+				"Copies are relative to the context, which defaults to the current directory. " +
+				"The exit code of the build is propagated.",
+		},
+	}
+	commitCmd.Args = func(cmd *cobra.Command, args []string) error {
+		n := cmd.ArgsLenAtDash()
+		if n < 0 {
+			n = len(args)
+		}
+		if n > 1 {
+			return errors.New("Requires at most one context as argument")
+		} else if commitCmd.changes.Base == "" {
+			return errors.New("--base is required")
+		} else if commitCmd.tag == "" {
+			return errors.New("--tag is required")
+		}
+		return nil
+	}
+	commitCmd.Run = func(cmd *cobra.Command, args []string) {
+		context, buildFlags := ".", args
+		if n := cmd.ArgsLenAtDash(); n == 1 || (n < 0 && len(args) == 1) {
+			context, buildFlags = args[0], args[1:]
+		}
+		exitCode, err := commitCmd.Commit(context, buildFlags)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		} else if exitCode != 0 {
+			log.Errorf("Build failed with exit code %d", exitCode)
+			os.Exit(exitCode)
+		}
+	}
+
+	commitCmd.PersistentFlags().StringVar(&commitCmd.changes.Base, "base", "", "The image the changes are applied to")
+	commitCmd.PersistentFlags().StringVarP(&commitCmd.tag, "tag", "t", "", "Image tag of the result")
+	commitCmd.PersistentFlags().StringArrayVar(&commitCmd.changes.Env, "env", nil, "Environment variable set in the image, as key=value. Can be repeated")
+	commitCmd.PersistentFlags().StringArrayVar(&commitCmd.changes.Copy, "copy", nil, "File or directory copied from the context into the image, as src:dst. Can be repeated")
+	commitCmd.PersistentFlags().StringArrayVar(&commitCmd.changes.Run, "run", nil, "Shell command run in the image. Can be repeated")
+	commitCmd.PersistentFlags().StringArrayVar(&commitCmd.changes.Labels, "label", nil, "Label set on the image, as key=value. Can be repeated")
+	commitCmd.PersistentFlags().StringArrayVar(&commitCmd.changes.Instructions, "change", nil, "Raw dockerfile instruction applied last, such as 'CMD [\"/bin/app\"]'. Can be repeated")
+
+	commitCmd.Flags().SortFlags = false
+	commitCmd.PersistentFlags().SortFlags = false
+
+	return commitCmd
+}
+
+// Commit builds the changes with the given context, and returns the exit code
+// of the build.
+func (cmd *commitCmd) Commit(context string, buildFlags []string) (int, error) {
+	contents, err := cmd.changes.Dockerfile()
+	if err != nil {
+		return 0, fmt.Errorf("invalid changes: %s", err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find makisu executable: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "makisu-commit")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create dockerfile dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(dockerfile, []byte(contents), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write dockerfile: %s", err)
+	}
+	log.Infof("Committing changes to %s as %s:\n%s", cmd.changes.Base, cmd.tag, contents)
+
+	args := append([]string{"build", "-f", dockerfile, "-t", cmd.tag}, buildFlags...)
+	build := exec.Command(executable, append(args, context)...)
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() > 0 {
+				return status.ExitStatus(), nil
+			}
+		}
+		return 0, fmt.Errorf("failed to run build: %s", err)
+	}
+	return 0, nil
+}
@@ -18,12 +18,74 @@ import (
 	"fmt"
 	"os"
 	"runtime/pprof"
+	"strings"
 
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/redact"
+	"github.com/uber/makisu/lib/utils/flagconfig"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// applyConfig sets the flags of the command being executed that weren't set on
+// the command line, from MAKISU_<FLAG> env vars and the config file.
+func (cmd *rootCmd) applyConfig() error {
+	ccmd, _, err := cmd.Find(os.Args[1:])
+	if err != nil {
+		return fmt.Errorf("find command: %s", err)
+	}
+	path := cmd.configPath
+	if path == "" {
+		if _, err := os.Stat(flagconfig.DefaultPath); err == nil {
+			path = flagconfig.DefaultPath
+		}
+	}
+	var config *flagconfig.Config
+	if path != "" {
+		if config, err = flagconfig.Load(path); err != nil {
+			return err
+		}
+		if err := config.Validate(commandFlags(cmd.Command)); err != nil {
+			return fmt.Errorf("invalid config file %s: %s", path, err)
+		}
+	}
+	if err := config.Apply(ccmd.Flags(), commandPath(ccmd), "config", "help"); err != nil {
+		return fmt.Errorf("apply config: %s", err)
+	}
+	return nil
+}
+
+// commandFlags returns the flags of all commands, including inherited ones,
+// indexed by command path.
+func commandFlags(root *cobra.Command) map[string]*pflag.FlagSet {
+	commands := make(map[string]*pflag.FlagSet)
+	var walk func(c *cobra.Command)
+	walk = func(c *cobra.Command) {
+		flags := pflag.NewFlagSet(c.Name(), pflag.ContinueOnError)
+		flags.AddFlagSet(c.LocalFlags())
+		flags.AddFlagSet(c.InheritedFlags())
+		commands[commandPath(c)] = flags
+		for _, sub := range c.Commands() {
+			walk(sub)
+		}
+	}
+	walk(root)
+	return commands
+}
+
+// commandPath returns the path of a command without the root command, like
+// "cache warm".
+func commandPath(c *cobra.Command) string {
+	path := c.CommandPath()
+	if i := strings.Index(path, " "); i >= 0 {
+		return path[i+1:]
+	}
+	return ""
+}
+
 func (cmd *rootCmd) processGlobalFlags() error {
 	// Initializes logger.
 	logger, err := cmd.getLogger()
@@ -52,6 +114,9 @@ func (cmd *rootCmd) getLogger() (*zap.Logger, error) {
 	if err := config.Level.UnmarshalText([]byte(cmd.logLevel)); err != nil {
 		return nil, fmt.Errorf("parse log level: %s", err)
 	}
+	if cmd.quiet {
+		config.Level.SetLevel(zapcore.ErrorLevel)
+	}
 
 	config.Encoding = cmd.logFormat
 	config.DisableStacktrace = true
@@ -62,7 +127,7 @@ func (cmd *rootCmd) getLogger() (*zap.Logger, error) {
 		config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	}
 
-	return config.Build()
+	return config.Build(zap.WrapCore(redact.Core))
 }
 
 func setupProfiler() error {
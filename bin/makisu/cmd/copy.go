@@ -0,0 +1,101 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type copyCmd struct {
+	*cobra.Command
+
+	srcRegistryConfig  string
+	destRegistryConfig string
+	storageDir         string
+}
+
+func getCopyCmd() *copyCmd {
+	copyCmd := &copyCmd{
+		Command: &cobra.Command{
+			Use:                   "copy [flags] <source image name> <destination image name>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Copy an image from a registry to another, including all the images of a manifest list",
+		},
+	}
+	copyCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("Requires source and destination image names as arguments")
+		}
+		return nil
+	}
+	copyCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := copyCmd.Copy(args[0], args[1]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	copyCmd.PersistentFlags().StringVar(&copyCmd.srcRegistryConfig, "src-registry-config", "", "Registry configuration used to pull the source image")
+	copyCmd.PersistentFlags().StringVar(&copyCmd.destRegistryConfig, "dest-registry-config", "", "Registry configuration used to push the destination image")
+	copyCmd.PersistentFlags().StringVar(&copyCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for temp files and cached layers")
+
+	copyCmd.Flags().SortFlags = false
+	copyCmd.PersistentFlags().SortFlags = false
+
+	return copyCmd
+}
+
+// Copy copies an image between registries. Each registry client takes its
+// configuration when it's created, so source and destination can use
+// different credentials for the same registry.
+func (cmd *copyCmd) Copy(srcFullName, destFullName string) error {
+	srcName, err := image.ParseNameForPull(srcFullName)
+	if err != nil {
+		return fmt.Errorf("parse source image %s: %s", srcFullName, err)
+	}
+	destName, err := image.ParseNameForPull(destFullName)
+	if err != nil {
+		return fmt.Errorf("parse destination image %s: %s", destFullName, err)
+	}
+
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("failed to init image store: %s", err)
+	}
+	defer store.CleanupSandbox()
+
+	if err := initRegistryConfig(cmd.srcRegistryConfig); err != nil {
+		return fmt.Errorf("failed to initialize source registry configuration: %s", err)
+	}
+	src := registry.New(store, srcName.GetRegistry(), srcName.GetRepository())
+	if err := initRegistryConfig(cmd.destRegistryConfig); err != nil {
+		return fmt.Errorf("failed to initialize destination registry configuration: %s", err)
+	}
+	dest := registry.New(store, destName.GetRegistry(), destName.GetRepository())
+
+	if err := registry.Copy(src, dest, srcName.GetTag(), destName.GetTag()); err != nil {
+		return fmt.Errorf("failed to copy image %s to %s: %s", srcName, destName, err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	ctx "context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/uber/makisu/lib/daemon"
+	"github.com/uber/makisu/lib/log"
+
+	"github.com/spf13/cobra"
+)
+
+type daemonCmd struct {
+	*cobra.Command
+
+	listen              string
+	socket              string
+	maxConcurrentBuilds int
+	maxQueuedBuilds     int
+	contextCacheDir     string
+	tokenFile           string
+}
+
+func getDaemonCmd() *daemonCmd {
+	daemonCmd := &daemonCmd{
+		Command: &cobra.Command{
+			Use:                   "daemon [flags] [-- <build flags>]",
+			DisableFlagsInUseLine: true,
+			Short:                 "Run a build server, that queues build requests and streams their logs back",
+			Long: "Run a build server, that queues build requests and streams their logs back. " +
+				"Builds are requested with POST /build, either with the arguments of makisu as a JSON array in the body, " +
+				"or with a context tar in the body and the build flags as \"args\" query parameters. " +
+				"Clients can also sync the context by content, uploading only the files the daemon doesn't have, with POST /context. " +
+				"The build flags after -- are added to every build, and can't be overridden by requests, which can only pass the flags describing the image, not the ones configuring the host. Requests on --listen can only build context tars, synced contexts and git or http(s) URLs. " +
+				"Requests on --listen need the token of --token-file as a bearer token, and POST /exit, which stops the daemon, is only served on --socket. " +
+				"The metrics of the builds are served in the Prometheus format on GET /metrics.",
+		},
+	}
+	daemonCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := daemonCmd.Serve(args); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	daemonCmd.PersistentFlags().StringVar(&daemonCmd.listen, "listen", "", "TCP address to listen on, e.g. :9000")
+	daemonCmd.PersistentFlags().StringVar(&daemonCmd.socket, "socket", "", "Unix socket to listen on, for clients sharing a volume with the daemon")
+	daemonCmd.PersistentFlags().StringVar(&daemonCmd.tokenFile, "token-file", "", "File holding the token requests on --listen must send as 'Authorization: Bearer <token>'. Required with --listen")
+	daemonCmd.PersistentFlags().IntVar(&daemonCmd.maxConcurrentBuilds, "max-concurrent-builds", 1, "Number of builds running at the same time. Must be 1 if the build flags have --modifyfs")
+	daemonCmd.PersistentFlags().IntVar(&daemonCmd.maxQueuedBuilds, "max-queued-builds", 10, "Number of builds waiting for a running slot. Requests are rejected with 503 once the queue is full")
+
+	daemonCmd.PersistentFlags().StringVar(&daemonCmd.contextCacheDir, "context-cache-dir", "/tmp/makisu-daemon-contexts", "Directory keeping the content of synced contexts, so repeated builds only upload the files that changed. Context sync is disabled if empty")
+
+	daemonCmd.Flags().SortFlags = false
+	daemonCmd.PersistentFlags().SortFlags = false
+
+	return daemonCmd
+}
+
+// Serve runs the build server until a client requests POST /exit.
+func (cmd *daemonCmd) Serve(buildFlags []string) error {
+	if cmd.listen == "" && cmd.socket == "" {
+		return errors.New("requires --listen or --socket")
+	} else if cmd.listen != "" && cmd.tokenFile == "" {
+		return errors.New("--listen requires --token-file")
+	}
+	var token string
+	if cmd.tokenFile != "" {
+		content, err := ioutil.ReadFile(cmd.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read token file: %s", err)
+		}
+		token = strings.TrimSpace(string(content))
+		if token == "" {
+			return fmt.Errorf("empty token in %s", cmd.tokenFile)
+		}
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find makisu executable: %s", err)
+	}
+	server, err := daemon.NewServer(daemon.Options{
+		Executable:          executable,
+		BuildFlags:          buildFlags,
+		MaxConcurrentBuilds: cmd.maxConcurrentBuilds,
+		MaxQueuedBuilds:     cmd.maxQueuedBuilds,
+		ContextCacheDir:     cmd.contextCacheDir,
+		Token:               token,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create build server: %s", err)
+	}
+
+	var listeners []net.Listener
+	var httpServers []*http.Server
+	if cmd.listen != "" {
+		l, err := net.Listen("tcp", cmd.listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %s", cmd.listen, err)
+		}
+		listeners = append(listeners, l)
+		httpServers = append(httpServers, &http.Server{Handler: server.TCPHandler()})
+	}
+	if cmd.socket != "" {
+		os.Remove(cmd.socket)
+		l, err := net.Listen("unix", cmd.socket)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %s", cmd.socket, err)
+		}
+		listeners = append(listeners, l)
+		httpServers = append(httpServers, &http.Server{Handler: server.Handler()})
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		log.Infof("Build server listening on %s", l.Addr())
+		go func(l net.Listener, httpServer *http.Server) { errs <- httpServer.Serve(l) }(l, httpServers[i])
+	}
+	select {
+	case err := <-errs:
+		return fmt.Errorf("failed to serve: %s", err)
+	case <-server.Exit():
+		log.Infof("Build server exiting, waiting for running builds")
+		for _, httpServer := range httpServers {
+			if err := httpServer.Shutdown(ctx.Background()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,120 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type deleteCmd struct {
+	*cobra.Command
+
+	registryConfig string
+	dryRun         bool
+	yes            bool
+}
+
+func getDeleteCmd() *deleteCmd {
+	deleteCmd := &deleteCmd{
+		Command: &cobra.Command{
+			Use:                   "delete [flags] <image name>...",
+			DisableFlagsInUseLine: true,
+			Short:                 "Delete images from their registry by tag or digest",
+		},
+	}
+	deleteCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("Requires at least one image name as argument")
+		}
+		return nil
+	}
+	deleteCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := deleteCmd.Delete(args, os.Stdin); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	deleteCmd.PersistentFlags().StringVar(&deleteCmd.registryConfig, "registry-config", "", "Registry configuration, for the credentials and TLS settings of the registry")
+	deleteCmd.PersistentFlags().BoolVar(&deleteCmd.dryRun, "dry-run", false, "Only print the digests that would be deleted")
+	deleteCmd.PersistentFlags().BoolVarP(&deleteCmd.yes, "yes", "y", false, "Delete without asking for confirmation")
+
+	deleteCmd.Flags().SortFlags = false
+	deleteCmd.PersistentFlags().SortFlags = false
+
+	return deleteCmd
+}
+
+// Delete deletes the manifests of the given images. Tags are resolved to the
+// digests of their manifests, and deleting a manifest also removes the other
+// tags pointing to it, so each deletion is confirmed on stdin unless --yes is
+// set.
+func (cmd *deleteCmd) Delete(imageFullNames []string, stdin io.Reader) error {
+	if err := initRegistryConfig(cmd.registryConfig); err != nil {
+		return fmt.Errorf("failed to initialize registry configuration: %s", err)
+	}
+
+	// The registry client needs a store, though deletes don't use it.
+	store, err := storage.NewImageStore("/tmp/makisu-storage")
+	if err != nil {
+		return fmt.Errorf("failed to init image store: %s", err)
+	}
+	defer store.CleanupSandbox()
+
+	confirm := bufio.NewReader(stdin)
+	for _, imageFullName := range imageFullNames {
+		imageName, err := image.ParseNameForPull(imageFullName)
+		if err != nil {
+			return fmt.Errorf("parse image %s: %s", imageFullName, err)
+		}
+		client := registry.New(store, imageName.GetRegistry(), imageName.GetRepository())
+		digest, err := client.ResolveManifestDigest(imageName.GetTag())
+		if err != nil {
+			return fmt.Errorf("failed to resolve digest of %s: %s", imageName, err)
+		}
+		target := fmt.Sprintf("%s/%s@%s", imageName.GetRegistry(), imageName.GetRepository(), digest)
+		if cmd.dryRun {
+			log.Infof("Would delete %s (%s)", target, imageName)
+			continue
+		}
+		if !cmd.yes {
+			fmt.Printf("Delete %s, and all the tags pointing to it? [y/N] ", target)
+			answer, err := confirm.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read confirmation: %s", err)
+			}
+			if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+				log.Infof("Skipped deleting %s", target)
+				continue
+			}
+		}
+		if err := client.DeleteManifest(digest); err != nil {
+			return fmt.Errorf("failed to delete %s: %s", target, err)
+		}
+	}
+	return nil
+}
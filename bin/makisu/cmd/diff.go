@@ -5,16 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 
 	"github.com/andres-erbsen/clock"
-	"github.com/google/go-cmp/cmp"
-	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/spf13/cobra"
+
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
-	"github.com/uber/makisu/lib/registry"
 	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/tario"
@@ -22,15 +20,29 @@ import (
 
 type diffCmd struct {
 	*cobra.Command
-	ignoreModTime bool
+	ignoreModTime  bool
+	format         string
+	pull           bool
+	registryConfig string
+	storageDir     string
+}
+
+// imageDiff is the output of the diff command.
+type imageDiff struct {
+	Images    [2]string            `json:"images"`
+	Layers    [2]int               `json:"layers"`
+	Sizes     [2]int64             `json:"sizes"`
+	Config    []image.ConfigChange `json:"config"`
+	Files     snapshot.FSDiff      `json:"files"`
+	SizeDelta int64                `json:"size_delta"`
 }
 
 func getDiffCmd() *diffCmd {
 	diffCmd := &diffCmd{
 		Command: &cobra.Command{
-			Use:                   "diff <image name> <image name>",
+			Use:                   "diff [flags] <image name> <image name>",
 			DisableFlagsInUseLine: true,
-			Short:                 "Compare docker images from registry",
+			Short:                 "Compare the configs and files of two images, listing the files added, removed or modified by the second one with their sizes",
 		},
 	}
 
@@ -49,80 +61,152 @@ func getDiffCmd() *diffCmd {
 	}
 
 	diffCmd.PersistentFlags().BoolVar(&diffCmd.ignoreModTime, "ignoreModTime", true, "Ignore mod time of image files when comparing images")
+	diffCmd.PersistentFlags().StringVar(&diffCmd.format, "format", "text", "Format of the diff printed to stdout, 'text' or 'json'")
+	diffCmd.PersistentFlags().BoolVar(&diffCmd.pull, "pull", false, "Always pull the images from their registry, even if images with the same names were built or pulled in the storage dir")
+	diffCmd.PersistentFlags().StringVar(&diffCmd.registryConfig, "registry-config", "", "Registry configuration, for the credentials and TLS settings of the registry")
+	diffCmd.PersistentFlags().StringVar(&diffCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for temp files and cached layers")
+
+	diffCmd.Flags().SortFlags = false
+	diffCmd.PersistentFlags().SortFlags = false
+
 	return diffCmd
 }
 
+// Diff compares two images, built or pulled in the storage dir or pulled from
+// their registry, and prints the differences to stdout.
 func (cmd *diffCmd) Diff(imagesFullName []string) error {
-	var pullImages []image.Name
-	for _, imageFullName := range imagesFullName {
-		pullImage, err := image.ParseNameForPull(imageFullName)
-		if err != nil {
-			return fmt.Errorf("parse image %s: %s", pullImage, err)
-		}
-		pullImages = append(pullImages, pullImage)
+	if cmd.format != "text" && cmd.format != "json" {
+		return fmt.Errorf("invalid format %q, must be 'text' or 'json'", cmd.format)
 	}
-
-	if err := initRegistryConfig(""); err != nil {
+	if err := initRegistryConfig(cmd.registryConfig); err != nil {
 		return fmt.Errorf("failed to initialize registry configuration: %s", err)
 	}
 
-	store, err := storage.NewImageStore("/tmp/makisu-storage/")
+	store, err := storage.NewImageStore(cmd.storageDir)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to init image store: %s", err)
 	}
+	defer store.CleanupSandbox()
 
+	var diff imageDiff
 	var memFSArr []*snapshot.MemFS
 	var imageConfigs []*image.Config
-	for i, pullImage := range pullImages {
-		client := registry.New(store, pullImage.GetRegistry(), pullImage.GetRepository())
-		manifest, err := client.Pull(pullImage.GetTag())
+	for i, imageFullName := range imagesFullName {
+		manifest, err := getImageManifest(store, imageFullName, cmd.pull)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		diff.Images[i] = imageFullName
+		diff.Layers[i] = len(manifest.Layers)
+		for _, descriptor := range manifest.Layers {
+			diff.Sizes[i] += descriptor.Size
 		}
 
-		memfs, err := snapshot.NewMemFS(clock.New(), "/tmp/makisu-storage/", nil)
+		memfs, err := snapshot.NewMemFS(clock.New(), store.SandboxDir, nil)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("create memfs: %s", err)
 		}
-
 		for _, descriptor := range manifest.Layers {
-			reader, err := store.Layers.GetStoreFileReader(descriptor.Digest.Hex())
-			if err != nil {
-				panic(fmt.Errorf("get reader from image %d layer: %s", i+1, err))
-			}
-			gzipReader, err := tario.NewGzipReader(reader)
-			if err != nil {
-				panic(fmt.Errorf("create gzip reader for layer: %s", err))
-			}
-			if err = memfs.UpdateFromTarReader(tar.NewReader(gzipReader), false); err != nil {
-				panic(fmt.Errorf("untar image %d layer reader: %s", i+1, err))
+			if err := applyLayer(store, memfs, descriptor); err != nil {
+				return fmt.Errorf("apply layer %s of %s: %s", descriptor.Digest.Hex(), imageFullName, err)
 			}
 		}
-
 		memFSArr = append(memFSArr, memfs)
-		reader, err := store.Layers.GetStoreFileReader(manifest.GetConfigDigest().Hex())
+
+		config, err := getImageConfig(store, manifest)
 		if err != nil {
-			panic(fmt.Errorf("get image%d config file reader %s: %s", i+1, manifest.GetConfigDigest().Hex(), err))
+			return fmt.Errorf("get config of %s: %s", imageFullName, err)
 		}
+		imageConfigs = append(imageConfigs, config)
+	}
 
-		configBytes, err := ioutil.ReadAll(reader)
+	diff.Config, err = image.DiffConfigs(imageConfigs[0], imageConfigs[1])
+	if err != nil {
+		return fmt.Errorf("diff configs: %s", err)
+	}
+	if diff.Config == nil {
+		diff.Config = make([]image.ConfigChange, 0)
+	}
+	diff.Files = snapshot.DiffFS(memFSArr[0], memFSArr[1], cmd.ignoreModTime)
+	diff.SizeDelta = diff.Files.Delta()
+
+	if cmd.format == "json" {
+		output, err := json.MarshalIndent(diff, "", "  ")
 		if err != nil {
-			panic(fmt.Errorf("read image%d config file %s: %s", i+1, manifest.GetConfigDigest().Hex(), err))
+			return fmt.Errorf("marshal diff: %s", err)
 		}
+		fmt.Println(string(output))
+		return nil
+	}
+	printImageDiff(os.Stdout, diff)
+	return nil
+}
+
+// applyLayer updates memfs with the files of a layer, without writing them.
+func applyLayer(store *storage.ImageStore, memfs *snapshot.MemFS, descriptor image.Descriptor) error {
+	reader, err := store.Layers.GetStoreFileReader(descriptor.Digest.Hex())
+	if err != nil {
+		return fmt.Errorf("get reader from layer: %s", err)
+	}
+	defer reader.Close()
+	gzipReader, err := tario.NewDecompressReader(reader)
+	if err != nil {
+		return fmt.Errorf("create decompress reader for layer: %s", err)
+	}
+	if err := memfs.UpdateFromTarReader(tar.NewReader(gzipReader), false); err != nil {
+		return fmt.Errorf("untar layer: %s", err)
+	}
+	return nil
+}
 
-		config := new(image.Config)
-		if err := json.Unmarshal(configBytes, config); err != nil {
-			panic(fmt.Errorf("unmarshal image%d config file %s: %s", i+1, manifest.GetConfigDigest().Hex(), err))
+// printImageDiff writes the diff as text, with the largest changes first.
+func printImageDiff(w io.Writer, diff imageDiff) {
+	for i, prefix := range []string{"---", "+++"} {
+		fmt.Fprintf(w, "%s %s (%d layers, %s compressed)\n",
+			prefix, diff.Images[i], diff.Layers[i], storage.FormatSize(diff.Sizes[i]))
+	}
+	if len(diff.Config) > 0 {
+		fmt.Fprintf(w, "\nConfig:\n")
+		for _, c := range diff.Config {
+			fmt.Fprintf(w, "  %s: %s -> %s\n", c.Field, orUnset(c.Old), orUnset(c.New))
+		}
+	}
+	for _, section := range []struct {
+		title   string
+		sign    string
+		changes []snapshot.FileChange
+	}{
+		{"Added", "+", diff.Files.Added},
+		{"Removed", "-", diff.Files.Removed},
+		{"Modified", "~", diff.Files.Modified},
+	} {
+		if len(section.changes) == 0 {
+			continue
+		}
+		var delta int64
+		for _, c := range section.changes {
+			delta += c.Delta()
+		}
+		fmt.Fprintf(w, "\n%s files (%d, %s):\n", section.title, len(section.changes), formatDelta(delta))
+		for _, c := range section.changes {
+			fmt.Fprintf(w, "  %s %10s  %s %s\n", section.sign, formatDelta(c.Delta()), c.Mode, c.Path)
 		}
-		imageConfigs = append(imageConfigs, config)
 	}
+	fmt.Fprintf(w, "\nTotal file size change: %s\n", formatDelta(diff.SizeDelta))
+}
 
-	log.Infof("* Diff image configs ")
-	if configDiff := cmp.Diff(imageConfigs[0], imageConfigs[1], cmpopts.IgnoreUnexported(image.Config{})); configDiff != "" {
-		log.Infof("-image %s +image %s):\n%s", pullImages[0].GetRepository()+":"+pullImages[0].GetTag(), pullImages[1].GetRepository()+":"+pullImages[1].GetTag(), configDiff)
+// formatDelta returns a human readable size change, like "+1.5GB".
+func formatDelta(n int64) string {
+	if n < 0 {
+		return "-" + storage.FormatSize(-n)
 	}
+	return "+" + storage.FormatSize(n)
+}
 
-	log.Infof("* Diff image layers")
-	snapshot.CompareFS(memFSArr[0], memFSArr[1], pullImages[0], pullImages[1], cmd.ignoreModTime)
-	return nil
+// orUnset returns the value of a config setting, or "<unset>".
+func orUnset(value string) string {
+	if value == "" {
+		return "<unset>"
+	}
+	return value
 }
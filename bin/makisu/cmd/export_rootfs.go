@@ -0,0 +1,104 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/uber/makisu/lib/builder"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type exportRootFSCmd struct {
+	*cobra.Command
+
+	pull           bool
+	registryConfig string
+	storageDir     string
+}
+
+func getExportRootFSCmd() *exportRootFSCmd {
+	exportRootFSCmd := &exportRootFSCmd{
+		Command: &cobra.Command{
+			Use:                   "export-rootfs [flags] <image name> <destination tar>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Apply all the layers of an image, whiteouts included, into a single rootfs tarball",
+		},
+	}
+	exportRootFSCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("Requires an image name and a destination tar as arguments")
+		}
+		return nil
+	}
+	exportRootFSCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := exportRootFSCmd.Export(args[0], args[1]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	exportRootFSCmd.PersistentFlags().BoolVar(&exportRootFSCmd.pull, "pull", false, "Always pull the image from its registry, even if an image with the same name was built or pulled in the storage dir")
+	exportRootFSCmd.PersistentFlags().StringVar(&exportRootFSCmd.registryConfig, "registry-config", "", "Registry configuration, for the credentials and TLS settings of the registry")
+	exportRootFSCmd.PersistentFlags().StringVar(&exportRootFSCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for temp files and cached layers")
+
+	exportRootFSCmd.Flags().SortFlags = false
+	exportRootFSCmd.PersistentFlags().SortFlags = false
+
+	return exportRootFSCmd
+}
+
+// Export writes the root filesystem of an image to dest, or to stdout if dest
+// is "-". Images built or pulled in the storage dir are used as they are,
+// others are pulled from their registry.
+func (cmd *exportRootFSCmd) Export(imageFullName, dest string) error {
+	if err := initRegistryConfig(cmd.registryConfig); err != nil {
+		return fmt.Errorf("failed to initialize registry configuration: %s", err)
+	}
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("failed to init image store: %s", err)
+	}
+	defer store.CleanupSandbox()
+
+	manifest, err := getImageManifest(store, imageFullName, cmd.pull)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if dest != "-" {
+		f, err := os.Create(dest)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %s", dest, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := builder.ExportRootFS(store, manifest, w); err != nil {
+		if dest != "-" {
+			os.Remove(dest)
+		}
+		return fmt.Errorf("failed to export rootfs of %s: %s", imageFullName, err)
+	}
+	log.Infof("Exported rootfs of %s with %d layers to %s", imageFullName, len(manifest.Layers), dest)
+	return nil
+}
@@ -0,0 +1,114 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type inspectCmd struct {
+	*cobra.Command
+
+	registryConfig string
+	storageDir     string
+}
+
+func getInspectCmd() *inspectCmd {
+	inspectCmd := &inspectCmd{
+		Command: &cobra.Command{
+			Use:                   "inspect [flags] <image name>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Print the manifest, config and layer sizes of an image in a registry as JSON",
+		},
+	}
+	inspectCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Requires an image name as argument")
+		}
+		return nil
+	}
+	inspectCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := inspectCmd.Inspect(args[0]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	inspectCmd.PersistentFlags().StringVar(&inspectCmd.registryConfig, "registry-config", "", "Registry configuration, for the credentials and TLS settings of the registry")
+	inspectCmd.PersistentFlags().StringVar(&inspectCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for temp files and cached layers")
+
+	inspectCmd.Flags().SortFlags = false
+	inspectCmd.PersistentFlags().SortFlags = false
+
+	return inspectCmd
+}
+
+// Inspect pulls the manifest and config of an image, and prints them to stdout
+// as JSON. Layers are not pulled.
+func (cmd *inspectCmd) Inspect(imageFullName string) error {
+	imageName, err := image.ParseNameForPull(imageFullName)
+	if err != nil {
+		return fmt.Errorf("parse image %s: %s", imageFullName, err)
+	}
+	if err := initRegistryConfig(cmd.registryConfig); err != nil {
+		return fmt.Errorf("failed to initialize registry configuration: %s", err)
+	}
+
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("failed to init image store: %s", err)
+	}
+	defer store.CleanupSandbox()
+
+	client := registry.New(store, imageName.GetRegistry(), imageName.GetRepository())
+	manifest, err := client.PullManifest(imageName.GetTag())
+	if err != nil {
+		return fmt.Errorf("failed to pull manifest of %s: %s", imageName, err)
+	}
+	if _, err := client.PullImageConfig(manifest.Config.Digest); err != nil {
+		return fmt.Errorf("failed to pull config of %s: %s", imageName, err)
+	}
+	reader, err := store.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to get config reader: %s", err)
+	}
+	defer reader.Close()
+	configBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+	config, err := image.NewImageConfigFromJSON(configBytes)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal config: %s", err)
+	}
+
+	output, err := json.MarshalIndent(image.NewInspection(imageName, *manifest, config), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal inspection: %s", err)
+	}
+	fmt.Println(string(output))
+	return nil
+}
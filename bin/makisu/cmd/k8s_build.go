@@ -0,0 +1,178 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/k8s"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/snapshot"
+
+	"github.com/spf13/cobra"
+)
+
+type k8sBuildCmd struct {
+	*cobra.Command
+
+	kubeconfig           string
+	kubeContext          string
+	namespace            string
+	image                string
+	helperImage          string
+	contextPVC           string
+	registryConfigSecret string
+	serviceAccount       string
+	timeout              time.Duration
+	keep                 bool
+}
+
+func getK8sBuildCmd() *k8sBuildCmd {
+	k8sBuildCmd := &k8sBuildCmd{
+		Command: &cobra.Command{
+			Use:                   "k8s-build [flags] <context> [-- <build flags>]",
+			DisableFlagsInUseLine: true,
+			Short:                 "Run a build in a kubernetes job, and stream its logs",
+			Long: "Run a build in a kubernetes job, and stream its logs. " +
+				"The context is either a local directory, uploaded to the job, a git URL, cloned by an init container, " +
+				"an http(s) URL of a tar, or a path in the volume claim of --context-pvc. " +
+				"The build flags after -- are passed to makisu build, and the exit code of the build is propagated.",
+		},
+	}
+	k8sBuildCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if n := cmd.ArgsLenAtDash(); n != 1 && !(n == -1 && len(args) == 1) {
+			return errors.New("Requires build context as argument")
+		}
+		return nil
+	}
+	k8sBuildCmd.Run = func(cmd *cobra.Command, args []string) {
+		exitCode, err := k8sBuildCmd.Build(args[0], args[1:])
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		} else if exitCode != 0 {
+			log.Errorf("Build failed with exit code %d", exitCode)
+			os.Exit(exitCode)
+		}
+	}
+
+	k8sBuildCmd.PersistentFlags().StringVar(&k8sBuildCmd.kubeconfig, "kubeconfig", "", "Path to the kubeconfig. Defaults to $KUBECONFIG or ~/.kube/config, then to the service account of the pod makisu runs in")
+	k8sBuildCmd.PersistentFlags().StringVar(&k8sBuildCmd.kubeContext, "kube-context", "", "Context of the kubeconfig to use. Defaults to the current context")
+	k8sBuildCmd.PersistentFlags().StringVarP(&k8sBuildCmd.namespace, "namespace", "n", "", "Namespace of the job. Defaults to the namespace of the context")
+	k8sBuildCmd.PersistentFlags().StringVar(&k8sBuildCmd.image, "image", "gcr.io/uber-container-tools/makisu:latest", "Makisu image the job runs")
+	k8sBuildCmd.PersistentFlags().StringVar(&k8sBuildCmd.helperImage, "helper-image", "alpine/git:latest", "Image of the init container that extracts uploaded contexts and clones git contexts. Requires sh, tar and git")
+	k8sBuildCmd.PersistentFlags().StringVar(&k8sBuildCmd.contextPVC, "context-pvc", "", "Persistent volume claim holding the context. The context argument is then a path in the volume")
+	k8sBuildCmd.PersistentFlags().StringVar(&k8sBuildCmd.registryConfigSecret, "registry-config-secret", "", "Secret with a registry.yaml key, passed to makisu as --registry-config")
+	k8sBuildCmd.PersistentFlags().StringVar(&k8sBuildCmd.serviceAccount, "service-account", "", "Service account of the pod of the job")
+	k8sBuildCmd.PersistentFlags().DurationVar(&k8sBuildCmd.timeout, "timeout", 0, "Maximum duration of the job, e.g. 1h. No limit if 0")
+	k8sBuildCmd.PersistentFlags().BoolVar(&k8sBuildCmd.keep, "keep", false, "Keep the job and its pod after the build, for debugging")
+
+	k8sBuildCmd.Flags().SortFlags = false
+	k8sBuildCmd.PersistentFlags().SortFlags = false
+
+	return k8sBuildCmd
+}
+
+// Build runs the build in a kubernetes job, and returns the exit code of
+// makisu in the job.
+func (cmd *k8sBuildCmd) Build(contextSource string, buildFlags []string) (int, error) {
+	config, err := cmd.loadKubeConfig()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load kubernetes config: %s", err)
+	}
+	if cmd.namespace != "" {
+		config.Namespace = cmd.namespace
+	}
+
+	spec := k8s.BuildSpec{
+		Name:                 k8s.NewBuildName(),
+		Namespace:            config.Namespace,
+		Image:                cmd.image,
+		HelperImage:          cmd.helperImage,
+		Context:              contextSource,
+		ContextPVC:           cmd.contextPVC,
+		BuildFlags:           buildFlags,
+		RegistryConfigSecret: cmd.registryConfigSecret,
+		ServiceAccount:       cmd.serviceAccount,
+		Timeout:              cmd.timeout,
+		Keep:                 cmd.keep,
+	}
+	if cmd.contextPVC == "" && !context.IsRemoteSource(contextSource) {
+		if spec.ContextTar, err = tarLocalContext(contextSource); err != nil {
+			return 0, err
+		}
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			close(stop)
+		}
+	}()
+
+	exitCode, err := k8s.RunBuild(k8s.NewClient(config), spec, os.Stdout, stop)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run build job %s: %s", spec.Name, err)
+	}
+	return exitCode, nil
+}
+
+func (cmd *k8sBuildCmd) loadKubeConfig() (*k8s.Config, error) {
+	path := cmd.kubeconfig
+	if path == "" {
+		path = k8s.DefaultConfigPath()
+	}
+	if path == "" {
+		return k8s.InClusterConfig()
+	}
+	return k8s.LoadConfig(path, cmd.kubeContext)
+}
+
+// tarLocalContext returns the gzip tar of a local context to upload.
+func tarLocalContext(dir string) ([]byte, error) {
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("context %s is not a directory", dir)
+	}
+	tmpDir, err := ioutil.TempDir("", "makisu-k8s-build")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	target := filepath.Join(tmpDir, "context.tar.gz")
+	if err := snapshot.CreateTarFromDirectory(target, dir); err != nil {
+		return nil, fmt.Errorf("failed to tar context: %s", err)
+	}
+	content, err := ioutil.ReadFile(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read context tar: %s", err)
+	}
+	if len(content) > k8s.MaxUploadSize {
+		return nil, fmt.Errorf(
+			"compressed context is %d bytes, more than the %d bytes that can be uploaded: "+
+				"use a git context or --context-pvc instead", len(content), k8s.MaxUploadSize)
+	}
+	return content, nil
+}
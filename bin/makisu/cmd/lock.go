@@ -0,0 +1,113 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/uber/makisu/lib/lockfile"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type lockCmd struct {
+	*cobra.Command
+
+	dockerfilePath string
+	buildArgs      []string
+	registryConfig string
+	storageDir     string
+	lockfile       string
+
+	templateOptions
+	parseOptions
+}
+
+func getLockCmd() *lockCmd {
+	lockCmd := &lockCmd{
+		Command: &cobra.Command{
+			Use:                   "lock [flags] <context path>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Write a lockfile pinning the FROM and COPY --from images of a dockerfile to the digests their tags point to",
+		},
+	}
+	lockCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Requires a build context as argument")
+		}
+		return nil
+	}
+	lockCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := initRegistryConfig(lockCmd.registryConfig); err != nil {
+			log.Errorf("failed to initialize registry configuration: %s", err)
+			os.Exit(1)
+		}
+		if err := lockCmd.Lock(args[0]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	lockCmd.PersistentFlags().StringVarP(&lockCmd.dockerfilePath, "file", "f", "Dockerfile", "The absolute path to the dockerfile")
+	lockCmd.PersistentFlags().StringArrayVar(&lockCmd.buildArgs, "build-arg", nil, "Argument to the dockerfile as per the spec of ARG. Format is \"--build-arg <arg>=<value>\"")
+	lockCmd.templateOptions.addFlags(lockCmd.Command)
+	lockCmd.parseOptions.addFlags(lockCmd.Command)
+	lockCmd.PersistentFlags().StringVar(&lockCmd.registryConfig, "registry-config", "", "Registry configuration, for the credentials and TLS settings of the registry")
+	lockCmd.PersistentFlags().StringVar(&lockCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for temp files")
+	lockCmd.PersistentFlags().StringVar(&lockCmd.lockfile, "lockfile", lockfile.DefaultName, "Path of the lockfile, relative to the context")
+
+	lockCmd.Flags().SortFlags = false
+	lockCmd.PersistentFlags().SortFlags = false
+
+	return lockCmd
+}
+
+// Lock resolves the images of the dockerfile of the context in their
+// registries, and writes their digests to the lockfile. Images pinned by
+// digest in the dockerfile are left out.
+func (cmd *lockCmd) Lock(contextDir string) error {
+	stages, err := readDockerfile(contextDir, cmd.dockerfilePath, cmd.buildArgs, cmd.templateOptions, cmd.parseOptions)
+	if err != nil {
+		return err
+	}
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return fmt.Errorf("failed to init image store: %s", err)
+	}
+	defer store.CleanupSandbox()
+
+	l, err := lockfile.Lock(dockerfile.Stages(stages).Images(), resolveImageDigest(store))
+	if err != nil {
+		return fmt.Errorf("failed to lock images: %s", err)
+	}
+	path := cmd.lockfile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(contextDir, path)
+	}
+	if err := l.Save(path); err != nil {
+		return err
+	}
+	for img, digest := range l.Images {
+		log.Infof("Locked %s at %s", img, digest)
+	}
+	log.Infof("Wrote lockfile %s", path)
+	return nil
+}
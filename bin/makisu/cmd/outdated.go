@@ -0,0 +1,160 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/platform"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type outdatedCmd struct {
+	*cobra.Command
+
+	dockerfilePath string
+	buildArgs      []string
+	registryConfig string
+	storageDir     string
+	platform       string
+	exitCode       bool
+
+	templateOptions
+	parseOptions
+}
+
+func getOutdatedCmd() *outdatedCmd {
+	outdatedCmd := &outdatedCmd{
+		Command: &cobra.Command{
+			Use:                   "outdated [flags] <context path>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Report the base images of a dockerfile that were updated in their registry since they were last pulled in the storage dir",
+		},
+	}
+	outdatedCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Requires a build context as argument")
+		}
+		return nil
+	}
+	outdatedCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := initRegistryConfig(outdatedCmd.registryConfig); err != nil {
+			log.Errorf("failed to initialize registry configuration: %s", err)
+			os.Exit(1)
+		}
+		outdated, err := outdatedCmd.Outdated(args[0], os.Stdout)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		} else if outdated && outdatedCmd.exitCode {
+			os.Exit(2)
+		}
+	}
+
+	outdatedCmd.PersistentFlags().StringVarP(&outdatedCmd.dockerfilePath, "file", "f", "Dockerfile", "The absolute path to the dockerfile")
+	outdatedCmd.PersistentFlags().StringArrayVar(&outdatedCmd.buildArgs, "build-arg", nil, "Argument to the dockerfile as per the spec of ARG. Format is \"--build-arg <arg>=<value>\"")
+	outdatedCmd.templateOptions.addFlags(outdatedCmd.Command)
+	outdatedCmd.parseOptions.addFlags(outdatedCmd.Command)
+	outdatedCmd.PersistentFlags().StringVar(&outdatedCmd.registryConfig, "registry-config", "", "Registry configuration, for the credentials and TLS settings of the registry")
+	outdatedCmd.PersistentFlags().StringVar(&outdatedCmd.storageDir, "storage", "/tmp/makisu-storage", "Storage dir of the builds, whose base images are compared with their registries")
+	outdatedCmd.PersistentFlags().StringVar(&outdatedCmd.platform, "platform", "", "Platform of the images compared, like linux/arm64. Defaults to linux with the architecture of makisu")
+	outdatedCmd.PersistentFlags().BoolVar(&outdatedCmd.exitCode, "exit-code", false, "Exit with code 2 if a base image is outdated, for scheduled pipelines refreshing base images")
+
+	outdatedCmd.Flags().SortFlags = false
+	outdatedCmd.PersistentFlags().SortFlags = false
+
+	return outdatedCmd
+}
+
+// Outdated compares the base images of the dockerfile of the context in the
+// storage dir with their registries, and writes a table of their status to w.
+// It returns true if one of them is outdated. Images pinned by digest can't be
+// outdated, and images never pulled are only reported.
+func (cmd *outdatedCmd) Outdated(contextDir string, w io.Writer) (bool, error) {
+	p := platform.Default()
+	if cmd.platform != "" {
+		var err error
+		if p, err = platform.Parse(cmd.platform); err != nil {
+			return false, fmt.Errorf("invalid platform: %s", err)
+		}
+	}
+	stages, err := readDockerfile(contextDir, cmd.dockerfilePath, cmd.buildArgs, cmd.templateOptions, cmd.parseOptions)
+	if err != nil {
+		return false, err
+	}
+	store, err := storage.NewImageStore(cmd.storageDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to init image store: %s", err)
+	}
+	defer store.CleanupSandbox()
+
+	var outdated, failed bool
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tSTATUS\tLOCAL\tREMOTE")
+	for _, img := range dockerfile.Stages(stages).Images() {
+		name, err := image.ParseNameForPull(img)
+		if err != nil {
+			return false, fmt.Errorf("invalid image name %s: %s", img, err)
+		} else if name.HasDigest() {
+			fmt.Fprintf(tw, "%s\tpinned\t-\t-\n", img)
+			continue
+		}
+		update, err := registry.New(store, name.GetRegistry(), name.GetRepository()).
+			WithPlatform(p).CheckUpdate(name.GetTag())
+		if err != nil {
+			log.Errorf("Failed to check image %s: %s", img, err)
+			fmt.Fprintf(tw, "%s\terror\t%s\t-\n", img, shortDigest(update.Local))
+			failed = true
+			continue
+		}
+		status := "up to date"
+		if update.Local == "" {
+			status = "not pulled"
+		} else if update.Outdated() {
+			status = "outdated"
+			outdated = true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			img, status, shortDigest(update.Local), shortDigest(update.Remote))
+	}
+	tw.Flush()
+	if failed {
+		return outdated, errors.New("failed to check some base images")
+	}
+	return outdated, nil
+}
+
+// shortDigest returns the first 12 characters of the hex of a digest, like
+// docker prints image IDs, or - if it's empty.
+func shortDigest(d image.Digest) string {
+	if d == "" {
+		return "-"
+	}
+	hex := d.Hex()
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
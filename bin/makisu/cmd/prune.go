@@ -0,0 +1,95 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/storage"
+
+	"github.com/spf13/cobra"
+)
+
+type pruneCmd struct {
+	*cobra.Command
+
+	storageDir string
+	maxAge     time.Duration
+	maxSize    string
+	dryRun     bool
+}
+
+func getPruneCmd() *pruneCmd {
+	pruneCmd := &pruneCmd{
+		Command: &cobra.Command{
+			Use:                   "prune [flags]",
+			DisableFlagsInUseLine: true,
+			Short:                 "Remove stale sandboxes, and old cached layers and manifests from the storage directory",
+		},
+	}
+	pruneCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := pruneCmd.Prune(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	pruneCmd.PersistentFlags().StringVar(&pruneCmd.storageDir, "storage", "/tmp/makisu-storage", "Directory that makisu uses for temp files and cached layers")
+	pruneCmd.PersistentFlags().DurationVar(&pruneCmd.maxAge, "max-age", 0, "Remove cached layers, manifests and build checkpoints not written for longer than this. Disabled if 0")
+	pruneCmd.PersistentFlags().StringVar(&pruneCmd.maxSize, "max-size", "", "Size budget of the storage directory, e.g. 50GB. The oldest cached layers and manifests are removed until the rest fits. Disabled if empty")
+	pruneCmd.PersistentFlags().BoolVar(&pruneCmd.dryRun, "dry-run", false, "Only report what would be removed")
+
+	pruneCmd.Flags().SortFlags = false
+	pruneCmd.PersistentFlags().SortFlags = false
+
+	return pruneCmd
+}
+
+// Prune removes the sandboxes of builds that were killed, and the cached files
+// of the storage dir that are too old or exceed the size budget. Files written
+// since the oldest running build started are kept.
+func (cmd *pruneCmd) Prune() error {
+	opts := storage.PruneOptions{MaxAge: cmd.maxAge, DryRun: cmd.dryRun}
+	if cmd.maxSize != "" {
+		maxSize, err := storage.ParseSize(cmd.maxSize)
+		if err != nil {
+			return fmt.Errorf("invalid max size: %s", err)
+		}
+		opts.MaxSize = maxSize
+	}
+
+	report, err := storage.Prune(cmd.storageDir, opts)
+	if err != nil {
+		return fmt.Errorf("failed to prune storage dir %s: %s", cmd.storageDir, err)
+	}
+	verb := "Removed"
+	if cmd.dryRun {
+		verb = "Would remove"
+	}
+	for _, f := range report.Removed {
+		log.Infof("%s %s (%s, last written %s)",
+			verb, f.Path, storage.FormatSize(f.Size), f.ModTime.Format(time.RFC3339))
+	}
+	verb = "Freed"
+	if cmd.dryRun {
+		verb = "Would free"
+	}
+	log.Infof("%s %s in %s, %s left", verb, storage.FormatSize(report.Freed),
+		cmd.storageDir, storage.FormatSize(report.Kept))
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/andres-erbsen/clock"
 	"github.com/spf13/cobra"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/docker/reference"
 	"github.com/uber/makisu/lib/registry"
 	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/storage"
@@ -57,13 +58,18 @@ func (cmd *pullCmd) Pull(repository string) {
 	if err != nil {
 		panic(err)
 	}
+	defer store.CleanupSandbox()
 
 	registry.DefaultDockerHubConfiguration.Security.TLS.CA.Cert.Path = cmd.cacerts
 	registry.ConfigurationMap[image.DockerHubRegistry] = make(registry.RepositoryMap)
 	registry.ConfigurationMap[image.DockerHubRegistry]["library/*"] = registry.DefaultDockerHubConfiguration
 
-	client := registry.New(store, cmd.registry, repository)
-	manifest, err := client.Pull(cmd.tag)
+	name, err := cmd.parseImageName(repository)
+	if err != nil {
+		panic(err)
+	}
+	client := registry.New(store, name.GetRegistry(), name.GetRepository())
+	manifest, err := client.Pull(name.GetTag())
 	if err != nil {
 		panic(err)
 	}
@@ -76,6 +82,28 @@ func (cmd *pullCmd) Pull(repository string) {
 	cmd.Extract(store, manifest)
 }
 
+// parseImageName parses the image to pull. The registry and tag of the image
+// default to the ones of the flags.
+func (cmd *pullCmd) parseImageName(input string) (image.Name, error) {
+	ref, err := reference.Parse(input)
+	if err != nil {
+		return image.Name{}, err
+	}
+	name := ref.Name()
+	if ref.Registry() == "" {
+		name = cmd.registry + "/" + name
+	}
+	switch {
+	case ref.Digest() != "":
+		name += "@" + ref.Digest()
+	case ref.Tag() != "":
+		name += ":" + ref.Tag()
+	default:
+		name += ":" + cmd.tag
+	}
+	return image.ParseNameForPull(name)
+}
+
 func (cmd *pullCmd) Extract(store *storage.ImageStore, manifest *image.DistributionManifest) {
 	config := &image.Config{}
 	if reader, err := store.Layers.GetStoreFileReader(manifest.Config.Digest.Hex()); err != nil {
@@ -102,9 +130,9 @@ func (cmd *pullCmd) Extract(store *storage.ImageStore, manifest *image.Distribut
 		if err != nil {
 			panic(fmt.Errorf("get reader from layer: %s", err))
 		}
-		gzipReader, err := tario.NewGzipReader(reader)
+		gzipReader, err := tario.NewDecompressReader(reader)
 		if err != nil {
-			panic(fmt.Errorf("create gzip reader for layer: %s", err))
+			panic(fmt.Errorf("create decompress reader for layer: %s", err))
 		}
 		if err = memfs.UpdateFromTarReader(tar.NewReader(gzipReader), true); err != nil {
 			panic(fmt.Errorf("untar reader: %s", err))
@@ -38,9 +38,10 @@ type pushCmd struct {
 
 	tag string
 
-	pushRegistries []string
-	replicas       []string
-	registryConfig string
+	pushRegistries  []string
+	replicas        []string
+	registryConfig  string
+	digestAlgorithm string
 }
 
 func getPushCmd() *pushCmd {
@@ -74,6 +75,7 @@ func getPushCmd() *pushCmd {
 	pushCmd.PersistentFlags().StringArrayVar(&pushCmd.pushRegistries, "push", nil, "Registry to push image to")
 	pushCmd.PersistentFlags().StringArrayVar(&pushCmd.replicas, "replica", nil, "Push targets with alternative full image names \"<registry>/<repo>:<tag>\"")
 	pushCmd.PersistentFlags().StringVar(&pushCmd.registryConfig, "registry-config", "", "Set build-time variables")
+	pushCmd.PersistentFlags().StringVar(&pushCmd.digestAlgorithm, "digest-algorithm", "sha256", "Algorithm of the digests of the layers, config and manifest of the pushed image, 'sha256' or 'sha512'. Registries must support it")
 
 	pushCmd.MarkFlagRequired("tag")
 	pushCmd.Flags().SortFlags = false
@@ -83,9 +85,15 @@ func getPushCmd() *pushCmd {
 }
 
 func (cmd *pushCmd) processFlags() error {
+	if err := validateImageNames(cmd.tag, cmd.replicas); err != nil {
+		return err
+	}
 	if err := initRegistryConfig(cmd.registryConfig); err != nil {
 		return fmt.Errorf("failed to initialize registry configuration: %s", err)
 	}
+	if err := image.SetDigestAlgorithm(cmd.digestAlgorithm); err != nil {
+		return fmt.Errorf("set digest algorithm: %s", err)
+	}
 
 	return nil
 }
@@ -104,6 +112,7 @@ func (cmd *pushCmd) Push(imageTarPath string) error {
 	if err != nil {
 		return fmt.Errorf("unable to create internal store: %s", err)
 	}
+	defer store.CleanupSandbox()
 
 	if err := cmd.loadImageTarIntoStore(store, imageName, cmd.replicas, imageTarPath); err != nil {
 		return fmt.Errorf("unable to import image: %s", err)
@@ -133,7 +142,11 @@ func (cmd *pushCmd) getTargetImageName() (image.Name, error) {
 		return image.Name{}, errors.New(msg)
 	}
 
-	return image.MustParseName(cmd.tag), nil
+	imageName, err := image.ParseName(cmd.tag)
+	if err != nil {
+		return image.Name{}, fmt.Errorf("invalid target image name: %s", err)
+	}
+	return imageName, nil
 }
 
 func (cmd *pushCmd) loadImageTarIntoStore(
@@ -18,7 +18,10 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/uber/makisu/lib/isolation"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/userns"
+	"github.com/uber/makisu/lib/utils"
 
 	"github.com/spf13/cobra"
 )
@@ -26,9 +29,11 @@ import (
 type rootCmd struct {
 	*cobra.Command
 
+	configPath string
 	logLevel   string
 	logOutput  string
 	logFormat  string
+	quiet      bool
 	cpuProfile bool
 
 	cleanup func()
@@ -45,9 +50,11 @@ func getRootCmd() *rootCmd {
 		},
 	}
 
+	rootCmd.PersistentFlags().StringVar(&rootCmd.configPath, "config", utils.DefaultEnv("MAKISU_CONFIG", ""), "YAML config file setting flags not set on the command line, which MAKISU_<FLAG> env vars override. Defaults to /etc/makisu/makisu.yaml if it exists")
 	rootCmd.PersistentFlags().StringVar(&rootCmd.logLevel, "log-level", "info", "Verbose level of logs. Valid values are \"debug\", \"info\", \"warn\", \"error\"")
 	rootCmd.PersistentFlags().StringVar(&rootCmd.logOutput, "log-output", "stdout", "The output file path for the logs. Set to \"stdout\" to output to stdout")
 	rootCmd.PersistentFlags().StringVar(&rootCmd.logFormat, "log-fmt", "json", "The format of the logs. Valid values are \"json\" and \"console\"")
+	rootCmd.PersistentFlags().BoolVarP(&rootCmd.quiet, "quiet", "q", false, "Only log errors, overriding --log-level. Build prints the digest of the built image to stdout, for scripts")
 	rootCmd.PersistentFlags().BoolVar(&rootCmd.cpuProfile, "cpu-profile", false, "Profile the application")
 
 	rootCmd.Flags().SortFlags = false
@@ -71,12 +78,42 @@ func getRootCmd() *rootCmd {
 }
 
 func Execute() {
+	// Builds re-executed in a user namespace by --rootless wait for it to be
+	// set up first.
+	userns.Init()
+	// RUN steps isolated by --isolation run makisu again to set up their
+	// namespaces.
+	isolation.Init()
+
 	rootCmd := getRootCmd()
 	rootCmd.AddCommand(getBuildCmd().Command)
+	rootCmd.AddCommand(getBakeCmd().Command)
+	rootCmd.AddCommand(getCommitCmd().Command)
 	rootCmd.AddCommand(getVersionCmd())
 	rootCmd.AddCommand(getPullCmd().Command)
 	rootCmd.AddCommand(getPushCmd().Command)
 	rootCmd.AddCommand(getDiffCmd().Command)
+	rootCmd.AddCommand(getCacheCmd())
+	rootCmd.AddCommand(getPruneCmd().Command)
+	rootCmd.AddCommand(getInspectCmd().Command)
+	rootCmd.AddCommand(getAnalyzeCmd().Command)
+	rootCmd.AddCommand(getExportRootFSCmd().Command)
+	rootCmd.AddCommand(getValidateCmd().Command)
+	rootCmd.AddCommand(getOutdatedCmd().Command)
+	rootCmd.AddCommand(getLockCmd().Command)
+	rootCmd.AddCommand(getCopyCmd().Command)
+	rootCmd.AddCommand(getDeleteCmd().Command)
+	rootCmd.AddCommand(getDaemonCmd().Command)
+	rootCmd.AddCommand(getK8sBuildCmd().Command)
+
+	// Flags are set from env vars and the config file once the command line
+	// is parsed, before args are validated.
+	cobra.OnInitialize(func() {
+		if err := rootCmd.applyConfig(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	})
 	if err := rootCmd.Execute(); err != nil {
 		log.Error(err)
 		os.Exit(1)
@@ -16,26 +16,41 @@ package cmd
 
 import (
 	ctx "context"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/user"
 	"path"
+	"sort"
 	"strings"
 
+	"github.com/uber/makisu/lib/budget"
+	"github.com/uber/makisu/lib/builder"
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/cache/keyvalue"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/cli"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/docker/reference"
+	"github.com/uber/makisu/lib/failure"
 	"github.com/uber/makisu/lib/fileio"
+	"github.com/uber/makisu/lib/lockfile"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/mountutils"
 	"github.com/uber/makisu/lib/parser/dockerfile"
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/redact"
 	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/signature"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/userns"
 	"github.com/uber/makisu/lib/utils/stringset"
+
+	"github.com/spf13/cobra"
 )
 
 func initRegistryConfig(registryConfig string) error {
@@ -49,10 +64,53 @@ func initRegistryConfig(registryConfig string) error {
 	return nil
 }
 
-// Finds a way to get the dockerfile.
-// If the context passed in is not a local path, then it will try to clone the
-// git repo.
-func (cmd *buildCmd) getDockerfile(contextDir string) ([]*dockerfile.Stage, error) {
+// templateOptions holds the flags of the frontend rendering dockerfiles as Go
+// templates before they are parsed.
+type templateOptions struct {
+	template       bool
+	templateValues []string
+
+	// values are read from the files of --template-values by loadValues.
+	values map[string]interface{}
+}
+
+func (opts *templateOptions) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolVar(&opts.template, "template", false, "Render the dockerfile as a Go template before parsing it, with the values of --template-values and the build args. Referencing a value that is not set fails")
+	cmd.PersistentFlags().StringArrayVar(&opts.templateValues, "template-values", nil, "YAML file of values of the dockerfile template, overriding the top level values of the previous ones. Build args override them. Implies --template")
+}
+
+// loadValues reads the files of --template-values, unless they were read
+// already. Rootless builds read them before entering the rootless dir.
+func (opts *templateOptions) loadValues() error {
+	if opts.values != nil {
+		return nil
+	}
+	values, err := dockerfile.LoadTemplateValues(opts.templateValues)
+	if err != nil {
+		return fmt.Errorf("load template values: %s", err)
+	}
+	opts.values = values
+	return nil
+}
+
+// parseOptions holds the flags changing how dockerfiles are parsed.
+type parseOptions struct {
+	allowUnsupported bool
+	strict           bool
+}
+
+func (opts *parseOptions) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolVar(&opts.allowUnsupported, "allow-unsupported", false, "Log the instructions makisu doesn't support, like ONBUILD or SHELL, with their line, and ignore them instead of failing. Builds record them as empty layers in the history of the image")
+	cmd.PersistentFlags().BoolVar(&opts.strict, "strict", false, "Fail on the extensions of makisu that docker build doesn't support, like includes, templates and '#!COMMIT' annotations, and build with the semantics of docker build where makisu differs: ENTRYPOINT clears the CMD of the base image, and WORKDIR creates its directory owned by the USER")
+}
+
+// readDockerfile reads and parses the dockerfile at dockerfilePath, which is
+// relative to contextDir unless absolute. It's rendered as a template first if
+// the template options enable it.
+func readDockerfile(
+	contextDir, dockerfilePath string, buildArgs []string,
+	tmpl templateOptions, parse parseOptions) ([]*dockerfile.Stage, error) {
+
 	fi, err := os.Lstat(contextDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to lstat build context %s: %s", contextDir, err)
@@ -60,7 +118,6 @@ func (cmd *buildCmd) getDockerfile(contextDir string) ([]*dockerfile.Stage, erro
 		return nil, fmt.Errorf("build context provided is not a directory: %s", contextDir)
 	}
 
-	dockerfilePath := cmd.dockerfilePath
 	if !path.IsAbs(dockerfilePath) {
 		dockerfilePath = path.Join(contextDir, dockerfilePath)
 	}
@@ -70,23 +127,103 @@ func (cmd *buildCmd) getDockerfile(contextDir string) ([]*dockerfile.Stage, erro
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate/find dockerfile in context: %s", err)
 	}
+	if parse.strict && parse.allowUnsupported {
+		return nil, errors.New("--strict is incompatible with --allow-unsupported")
+	} else if parse.strict && (tmpl.template || len(tmpl.templateValues) != 0) {
+		return nil, errors.New("--strict is incompatible with --template")
+	}
+	// Strict builds fail on include lines instead of expanding them.
+	expanded := string(contents)
+	if !parse.strict {
+		if expanded, err = dockerfile.ExpandIncludes(expanded, dockerfilePath); err != nil {
+			return nil, fmt.Errorf("failed to expand dockerfile includes: %s", err)
+		}
+	}
 
 	buildArgMap := make(map[string]string)
-	for _, pair := range cmd.buildArgs {
-		parts := strings.Split(pair, "=")
+	for _, pair := range buildArgs {
+		parts := strings.SplitN(pair, "=", 2)
 		if len(parts) != 2 {
-			return nil, fmt.Errorf("failed to parse build-arg %s: %s", pair, err)
+			return nil, fmt.Errorf("failed to parse build-arg %s", pair)
 		}
 		buildArgMap[parts[0]] = parts[1]
 	}
 
-	dockerfile, err := dockerfile.ParseFile(string(contents), buildArgMap)
+	if tmpl.template || len(tmpl.templateValues) != 0 {
+		if err := tmpl.loadValues(); err != nil {
+			return nil, err
+		}
+		values := make(map[string]interface{})
+		for k, v := range tmpl.values {
+			values[k] = v
+		}
+		for k, v := range buildArgMap {
+			values[k] = v
+		}
+		if expanded, err = dockerfile.RenderTemplate(expanded, values); err != nil {
+			return nil, fmt.Errorf("failed to render dockerfile template: %s", err)
+		}
+	}
+
+	opts := dockerfile.ParseOptions{Strict: parse.strict}
+	if parse.allowUnsupported {
+		opts.Unsupported = func(line int, instruction, args string) {
+			log.Warnf("Ignoring unsupported instruction at %s line %d: %s %s",
+				dockerfilePath, line, instruction, args)
+		}
+	}
+	dockerfile, err := dockerfile.ParseFileWithOptions(expanded, buildArgMap, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse dockerfile: %s", err)
 	}
 	return dockerfile, nil
 }
 
+// validateImageNames returns an error if the target image name or one of the
+// replicas isn't a valid image name.
+func validateImageNames(tag string, replicas []string) error {
+	if tag != "" {
+		if _, err := image.ParseName(tag); err != nil {
+			return fmt.Errorf("invalid target image name: %s", err)
+		}
+	}
+	for _, replica := range replicas {
+		if _, err := image.ParseName(replica); err != nil {
+			return fmt.Errorf("invalid replica: %s", err)
+		}
+	}
+	return nil
+}
+
+// addSecretBuildArgs masks the values of secret build args in the logs,
+// reports and image history. Secrets are the names of build args, patterns
+// matching them, or <arg>=<value> to pass the arg as well. It returns
+// buildArgs with the args passed as secrets.
+func addSecretBuildArgs(secrets, buildArgs []string) ([]string, error) {
+	for _, secret := range secrets {
+		if parts := strings.SplitN(secret, "=", 2); len(parts) == 2 {
+			buildArgs = append(buildArgs, secret)
+			redact.Add(parts[1])
+			continue
+		}
+		if _, err := path.Match(secret, ""); err != nil {
+			return nil, fmt.Errorf("invalid secret build arg %s: %s", secret, err)
+		}
+		matched := false
+		for _, pair := range buildArgs {
+			parts := strings.SplitN(pair, "=", 2)
+			if ok, _ := path.Match(secret, parts[0]); ok && len(parts) == 2 {
+				redact.Add(parts[1])
+				matched = true
+			}
+		}
+		if !matched {
+			log.Warnf("Secret build arg %s matches no --build-arg", secret)
+		}
+	}
+	return buildArgs, nil
+}
+
 func (cmd *buildCmd) getTargetImageName() (image.Name, error) {
 	if cmd.tag == "" {
 		msg := "please specify a target image name: makisu build -t=(<registry:port>/)<repo>:<tag> ./"
@@ -94,7 +231,10 @@ func (cmd *buildCmd) getTargetImageName() (image.Name, error) {
 	}
 
 	// Parse the target's image name into its components.
-	targetImageName := image.MustParseName(cmd.tag)
+	targetImageName, err := image.ParseName(cmd.tag)
+	if err != nil {
+		return image.Name{}, fmt.Errorf("invalid target image name: %s", err)
+	}
 	if len(cmd.pushRegistries) == 0 {
 		return targetImageName, nil
 	}
@@ -121,6 +261,196 @@ func pushImage(buildContext *context.BuildContext, imageName image.Name) error {
 	return nil
 }
 
+// pushImageIndex pushes the specified image to docker registry, as an OCI
+// index with the given annotations, and returns the digest of the index.
+func pushImageIndex(
+	buildContext *context.BuildContext, imageName image.Name,
+	annotations map[string]string) (image.Digest, error) {
+
+	registryClient := registry.New(
+		buildContext.ImageStore, imageName.GetRegistry(), imageName.GetRepository())
+	digest, err := registryClient.PushIndex(imageName.GetTag(), annotations)
+	if err != nil {
+		return "", fmt.Errorf("failed to push image: %s", err)
+	}
+	log.Infof("Successfully pushed %s to %s, as index %s", imageName, imageName.GetRegistry(), digest)
+	return digest, nil
+}
+
+// signImage signs the manifest digest of a pushed image, and pushes the
+// signature to its repository.
+func signImage(
+	buildContext *context.BuildContext, imageName image.Name, digest image.Digest,
+	signer signature.Signer) error {
+
+	repository := imageName.GetRegistry() + "/" + imageName.GetRepository()
+	payload, err := signature.Payload(repository, digest)
+	if err != nil {
+		return fmt.Errorf("create signature payload: %s", err)
+	}
+	sig, err := signer.Sign(payload)
+	if err != nil {
+		return fmt.Errorf("sign payload: %s", err)
+	}
+	registryClient := registry.New(
+		buildContext.ImageStore, imageName.GetRegistry(), imageName.GetRepository())
+	if err := registryClient.PushSignature(
+		digest, payload, base64.StdEncoding.EncodeToString(sig)); err != nil {
+		return fmt.Errorf("push signature: %s", err)
+	}
+	log.Infof("Successfully signed %s@%s", repository, digest)
+	return nil
+}
+
+// scanImage scans the image with the scanner of --scan, and fails if it has
+// vulnerabilities at or above --scan-severity unless --scan-warn-only is set.
+func (cmd *buildCmd) scanImage(buildContext *context.BuildContext, imageName image.Name) error {
+	log.Infof("Scanning image %s for vulnerabilities", imageName.ShortName())
+	layoutDir := path.Join(buildContext.ImageStore.SandboxDir, "scan")
+	defer os.RemoveAll(layoutDir)
+	tarer := cli.NewDefaultImageTarer(buildContext.ImageStore)
+	if err := tarer.WriteOCILayout(imageName, layoutDir); err != nil {
+		return failure.Errorf(failure.KindScan, "failed to write OCI image layout to scan: %s", err)
+	}
+	report, err := cmd.scanner.Scan(layoutDir)
+	if err != nil {
+		return failure.Errorf(failure.KindScan, "failed to scan image: %s", err)
+	}
+	findings := report.AtLeast(cmd.scanThreshold)
+	if len(findings) == 0 {
+		log.Infof("Found %d vulnerabilities, none at or above severity %s",
+			len(report.Findings), cmd.scanThreshold)
+		return nil
+	}
+	for _, f := range findings {
+		log.Warnf("* %s", f)
+	}
+	if cmd.scanWarnOnly {
+		log.Warnf("Found %d vulnerabilities at or above severity %s",
+			len(findings), cmd.scanThreshold)
+		return nil
+	}
+	return failure.Errorf(failure.KindScan, "found %d vulnerabilities at or above severity %s",
+		len(findings), cmd.scanThreshold)
+}
+
+// checkSizeBudget logs the layers of the built image over --max-image-size or
+// --max-layer-size, and fails unless --size-budget-warn-only is set.
+func (cmd *buildCmd) checkSizeBudget(
+	buildContext *context.BuildContext, manifest *image.DistributionManifest) error {
+
+	// The history only names the steps of the layers.
+	config, err := getImageConfig(buildContext.ImageStore, manifest)
+	if err != nil {
+		log.Warnf("Failed to read image config for size budget: %s", err)
+	}
+	v := budget.Check(cmd.sizeBudget, manifest, config)
+	if v == nil {
+		log.Infof("Image size %s is within its budget", storage.FormatSize(cmd.imageSize))
+		return nil
+	}
+	for _, l := range v.Layers {
+		log.Warnf("* %s", l)
+	}
+	if cmd.sizeBudgetWarnOnly {
+		log.Warnf("Image over size budget: %s", v)
+		return nil
+	}
+	return failure.Errorf(failure.KindBudget, "image over size budget: %s", v)
+}
+
+// checkLayerFiles counts the files of each layer of the built image, logs
+// them, and warns about the layers over --max-layer-files. Failures are only
+// logged, since the counts are informational.
+func (cmd *buildCmd) checkLayerFiles(
+	buildContext *context.BuildContext, manifest *image.DistributionManifest) {
+
+	files, err := builder.CountImageFiles(buildContext.ImageStore, manifest)
+	if err != nil {
+		log.Warnf("Failed to count files of layers: %s", err)
+		return
+	}
+	config, err := getImageConfig(buildContext.ImageStore, manifest)
+	if err != nil {
+		log.Warnf("Failed to read image config for layer files: %s", err)
+	}
+	layers := budget.Layers(manifest, config)
+	for i := range layers {
+		layers[i].Files = files[i]
+		log.Infof("* %s", layers[i])
+	}
+	cmd.layers = layers
+	for _, l := range budget.OverFiles(layers, cmd.maxLayerFiles) {
+		log.Warnf("Layer %d (%s) has %d files, more than --max-layer-files %d",
+			l.Index, l.Digest, l.Files, cmd.maxLayerFiles)
+	}
+}
+
+// reexecRootless runs makisu again in a user namespace where root is the
+// current user, and returns its exit code.
+func reexecRootless() (int, error) {
+	if os.Geteuid() == 0 {
+		// Root only needs a mount namespace of its own.
+		return userns.Reexec(nil)
+	}
+	u, err := user.Current()
+	if err != nil {
+		return 0, fmt.Errorf("get current user: %s", err)
+	}
+	m, err := userns.NewMapping(u.Username, os.Geteuid(), os.Getegid())
+	if err != nil {
+		return 0, fmt.Errorf("get user namespace mapping: %s", err)
+	}
+	if m.RootOnly() {
+		log.Warnf("No subordinate IDs of %s in %s and %s, only root can own the files of the image",
+			u.Username, userns.SubUIDFile, userns.SubGIDFile)
+	}
+	log.Infof("Running build in a user namespace as %s", u.Username)
+	return userns.Reexec(m)
+}
+
+// enterRootlessRoot makes the rootless dir the root of makisu, with the
+// directories read during the build mounted in it at the same location. They
+// are all blacklisted.
+func (cmd *buildCmd) enterRootlessRoot(contextDir string) (func() error, error) {
+	binds := []string{
+		"/dev", "/proc", "/sys", "/etc/resolv.conf", "/etc/hosts", "/etc/hostname",
+		pathutils.DefaultInternalDir, cmd.storageDir, contextDir,
+	}
+	if cmd.sharedBlobDir != "" {
+		binds = append(binds, cmd.sharedBlobDir)
+	}
+	if cmd.stepLogDir != "" {
+		// Created first, so it can be mounted.
+		if err := os.MkdirAll(cmd.stepLogDir, 0755); err != nil {
+			return nil, fmt.Errorf("create step log dir: %s", err)
+		}
+		binds = append(binds, cmd.stepLogDir)
+	}
+	for _, source := range cmd.namedContexts {
+		if !strings.HasPrefix(source, context.DockerImagePrefix) && !context.IsRemoteSource(source) {
+			binds = append(binds, source)
+		}
+	}
+	if path.IsAbs(cmd.dockerfilePath) &&
+		!pathutils.IsDescendantOfAny(cmd.dockerfilePath, []string{contextDir}) {
+		binds = append(binds, cmd.dockerfilePath)
+		pathutils.DefaultBlacklist = append(pathutils.DefaultBlacklist, cmd.dockerfilePath)
+	}
+	for _, bind := range binds {
+		if pathutils.IsDescendantOfAny(bind, []string{cmd.rootlessDir}) ||
+			pathutils.IsDescendantOfAny(cmd.rootlessDir, []string{bind}) {
+			return nil, fmt.Errorf("rootless dir %s overlaps with %s", cmd.rootlessDir, bind)
+		}
+	}
+	// System certs are loaded on first use, which must happen while they're
+	// still in reach.
+	x509.SystemCertPool()
+
+	log.Infof("Using %s as the root of the build", cmd.rootlessDir)
+	return userns.EnterRoot(cmd.rootlessDir, binds)
+}
+
 // loadImage loads the image into the local docker daemon.
 // This is only used for testing purposes.
 func (cmd *buildCmd) loadImage(buildContext *context.BuildContext, imageName image.Name) error {
@@ -145,6 +475,10 @@ func (cmd *buildCmd) loadImage(buildContext *context.BuildContext, imageName ima
 func (cmd *buildCmd) saveImage(buildContext *context.BuildContext, imageName image.Name) error {
 	log.Infof("Saving image %s at location %s", imageName.ShortName(), cmd.destination)
 	tarer := cli.NewDefaultImageTarer(buildContext.ImageStore)
+	tarer.IndexAnnotations = cmd.imageAnnotations.Index
+	if cmd.outputFormat == "oci" {
+		return saveOCIImage(tarer, imageName, cmd.destination)
+	}
 	if tar, err := tarer.CreateTarReadCloser(imageName); err != nil {
 		return fmt.Errorf("failed to create a tarball from image layers and manifests: %s", err)
 	} else if err := fileio.ReaderToFile(tar, cmd.destination); err != nil {
@@ -153,6 +487,56 @@ func (cmd *buildCmd) saveImage(buildContext *context.BuildContext, imageName ima
 	return nil
 }
 
+// saveOCIImage saves the image as an OCI image layout, in dest if it's a
+// directory or ends with /, or in a tar at dest otherwise.
+func saveOCIImage(tarer cli.DefaultImageTarer, imageName image.Name, dest string) error {
+	if fi, err := os.Stat(dest); err == nil && fi.IsDir() || strings.HasSuffix(dest, "/") {
+		if err := tarer.WriteOCILayout(imageName, dest); err != nil {
+			return fmt.Errorf("failed to write OCI image layout to %s: %s", dest, err)
+		}
+		return nil
+	}
+	if tar, err := tarer.CreateOCITarReadCloser(imageName); err != nil {
+		return fmt.Errorf("failed to create an OCI image layout tarball: %s", err)
+	} else if err := fileio.ReaderToFile(tar, dest); err != nil {
+		return fmt.Errorf("failed to write OCI image layout tarball to destination %s: %s", dest, err)
+	}
+	return nil
+}
+
+// addNamedContexts adds the contexts of --build-context to the build context.
+// Remote contexts are fetched in the sandbox.
+func addNamedContexts(buildContext *context.BuildContext, sources map[string]string) error {
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		source := sources[name]
+		if strings.HasPrefix(source, context.DockerImagePrefix) {
+			buildContext.NamedImages[name] = strings.TrimPrefix(source, context.DockerImagePrefix)
+			continue
+		}
+		dir := source
+		if context.IsRemoteSource(source) {
+			var err error
+			dir, err = context.FetchContext(source, path.Join(
+				buildContext.ImageStore.SandboxDir, fmt.Sprintf("context-%d", i)), nil)
+			if err != nil {
+				return fmt.Errorf("failed to fetch build context %s: %s", name, err)
+			}
+		}
+		if fi, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("failed to stat build context %s: %s", name, err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("build context %s is not a directory: %s", name, dir)
+		}
+		buildContext.NamedContexts[name] = dir
+	}
+	return nil
+}
+
 // cleanManifest removes specified image manifest from local filesystem.
 func cleanManifest(buildContext *context.BuildContext, imageName image.Name) error {
 	repo, tag := imageName.GetRepository(), imageName.GetTag()
@@ -163,58 +547,187 @@ func cleanManifest(buildContext *context.BuildContext, imageName image.Name) err
 	return nil
 }
 
-// newCacheManager inits and returns a cache manager object.
-func (cmd *buildCmd) newCacheManager(buildContext *context.BuildContext, imageName image.Name) cache.Manager {
+// newCacheManager inits and returns a cache manager object. Cache layers are
+// pushed to and pulled from registryAddr, or only kept locally if it is empty.
+// With --cache-repo, they are pushed to the cache repository instead.
+func (opts *cacheOptions) newCacheManager(
+	buildContext *context.BuildContext, registryAddr string,
+	imageName image.Name) (cache.Manager, error) {
+
 	var kvStore keyvalue.Store
 	var err error
-	if cmd.redisCacheAddress != "" {
-		log.Infof("Using redis at %s for cacheID storage", cmd.redisCacheAddress)
+	if opts.redisCacheAddress != "" {
+		log.Infof("Using redis at %s for cacheID storage", opts.redisCacheAddress)
 
-		kvStore, err = keyvalue.NewRedisStore(cmd.redisCacheAddress, cmd.redisCachePassword, cmd.redisCacheTTL)
+		kvStore, err = keyvalue.NewRedisStore(opts.redisCacheAddress, opts.redisCachePassword, opts.redisCacheTTL)
 		if err != nil {
 			log.Errorf("Failed to connect to redis store: %s", err)
 		}
-	} else if cmd.httpCacheAddress != "" {
-		log.Infof("Using http server at %s for cacheID storage", cmd.httpCacheAddress)
+	} else if opts.httpCacheAddress != "" {
+		log.Infof("Using http server at %s for cacheID storage", opts.httpCacheAddress)
 
-		kvStore, err = keyvalue.NewHTTPStore(cmd.httpCacheAddress, cmd.httpCacheHeaders...)
+		kvStore, err = keyvalue.NewHTTPStore(opts.httpCacheAddress, opts.httpCacheHeaders...)
 		if err != nil {
 			log.Errorf("Failed to instantiate cache id store: %s", err)
 		}
-	} else if cmd.localCacheTTL != 0 {
+	} else if len(opts.memcachedCacheAddresses) != 0 {
+		log.Infof("Using memcached at %v for cacheID storage", opts.memcachedCacheAddresses)
+
+		kvStore, err = keyvalue.NewMemcachedStore(
+			opts.memcachedCacheAddresses, opts.memcachedCacheUsername,
+			opts.memcachedCachePassword, opts.memcachedCacheTTL)
+		if err != nil {
+			log.Errorf("Failed to connect to memcached store: %s", err)
+		}
+	} else if opts.localCacheTTL != 0 {
 		fullpath := path.Join(buildContext.ImageStore.RootDir, pathutils.CacheKeyValueFileName)
 		log.Infof("Using local file at %s for cacheID storage", fullpath)
 
 		kvStore, err = keyvalue.NewFSStore(
-			fullpath, buildContext.ImageStore.SandboxDir, cmd.localCacheTTL)
+			fullpath, buildContext.ImageStore.SandboxDir, opts.localCacheTTL)
 		if err != nil {
 			log.Errorf("Failed to init local cache ID store: %s", err)
 		}
 	} else {
 		log.Infof("No cache option provided, not using cache")
-		return cache.NewNoopCacheManager()
+		return cache.NewNoopCacheManager(), nil
 	}
 
 	var registryClient registry.Client
-	if len(cmd.pushRegistries) == 0 {
-		log.Infof("No registry information provided, using cached layers")
-		registryClient = nil
-	} else {
-		registryAddr := cmd.pushRegistries[0]
+	if registryAddr != "" {
 		registryClient = registry.New(
 			buildContext.ImageStore, registryAddr, imageName.GetRepository())
 	}
-	return cache.New(buildContext.ImageStore, kvStore, registryClient)
+	if opts.cacheRepo != "" {
+		ref, err := reference.Parse(opts.cacheRepo)
+		if err != nil {
+			return nil, fmt.Errorf("parse cache repository %s: %s", opts.cacheRepo, err)
+		} else if ref.Tag() != "" || ref.Digest() != "" {
+			return nil, fmt.Errorf("cache repository %s must not have a tag or digest", opts.cacheRepo)
+		}
+		cacheRegistry := ref.Registry()
+		if cacheRegistry == "" {
+			cacheRegistry = registryAddr
+		}
+		if cacheRegistry != "" {
+			log.Infof("Using repository %s/%s for cache layers", cacheRegistry, ref.Repository())
+			cacheClient := registry.New(buildContext.ImageStore, cacheRegistry, ref.Repository())
+			return cache.NewWithCacheRepo(buildContext.ImageStore, kvStore, cacheClient, registryClient), nil
+		}
+	}
+	if registryClient == nil {
+		log.Infof("No registry information provided, using cached layers")
+	}
+	return cache.New(buildContext.ImageStore, kvStore, registryClient), nil
 }
 
-func maybeBlacklistVarRun() error {
-	if found, err := mountutils.ContainsMountpoint("/var/run"); err != nil {
-		return err
-	} else if found {
-		pathutils.DefaultBlacklist = stringset.FromSlice(
-			append(pathutils.DefaultBlacklist, "/var/run")).ToSlice()
-		log.Warnf("Blacklisted /var/run because it contains a mountpoint inside. " +
-			"No changes of that directory will be reflected in the final image.")
+// extendBlacklist adds the storage dir and the given entries to the blacklist.
+// With autoDetect, it also adds the mountpoints of pseudo file systems, and
+// /var/run if it contains a mountpoint.
+func extendBlacklist(storageDir string, entries []string, autoDetect bool) error {
+	blacklist := append(pathutils.DefaultBlacklist, storageDir)
+	if autoDetect {
+		mountpoints, err := mountutils.PseudoMountpoints()
+		if err != nil {
+			return fmt.Errorf("detect pseudo file systems: %s", err)
+		}
+		blacklist = append(blacklist, mountpoints...)
+
+		if found, err := mountutils.ContainsMountpoint("/var/run"); err != nil {
+			return err
+		} else if found {
+			blacklist = append(blacklist, "/var/run")
+			log.Warnf("Blacklisted /var/run because it contains a mountpoint inside. " +
+				"No changes of that directory will be reflected in the final image.")
+		}
+	}
+	if len(entries) != 0 {
+		blacklist = append(blacklist, entries...)
+		log.Infof("Added %d new items to blacklist: %v", len(entries), entries)
 	}
+	pathutils.DefaultBlacklist = stringset.FromSlice(blacklist).ToSlice()
 	return nil
 }
+
+// getImageManifest returns the manifest of an image from the storage dir, or
+// pulls the image if it's missing there or pull is set.
+func getImageManifest(
+	store *storage.ImageStore, imageFullName string, pull bool) (*image.DistributionManifest, error) {
+
+	if !pull {
+		if manifest, err := getStoredManifest(store, imageFullName); err == nil {
+			return manifest, nil
+		}
+	}
+	imageName, err := image.ParseNameForPull(imageFullName)
+	if err != nil {
+		return nil, fmt.Errorf("parse image %s: %s", imageFullName, err)
+	}
+	client := registry.New(store, imageName.GetRegistry(), imageName.GetRepository())
+	manifest, err := client.Pull(imageName.GetTag())
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull %s: %s", imageName, err)
+	}
+	return manifest, nil
+}
+
+// getStoredManifest returns the manifest of an image in the storage dir, if all
+// its layers are there too.
+func getStoredManifest(
+	store *storage.ImageStore, imageFullName string) (*image.DistributionManifest, error) {
+
+	imageName, err := image.ParseName(imageFullName)
+	if err != nil {
+		return nil, err
+	}
+	r, err := store.Manifests.GetStoreFileReader(imageName.GetRepository(), imageName.GetTag())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	manifest, _, err := image.UnmarshalDistributionManifest(image.MediaTypeManifest, b)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range manifest.Layers {
+		if _, err := store.Layers.GetStoreFileStat(layer.Digest.Hex()); err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("Using image %s from the storage dir", imageName)
+	return &manifest, nil
+}
+
+// getImageConfig returns the config of the image described by manifest, from
+// the storage dir.
+func getImageConfig(
+	store *storage.ImageStore, manifest *image.DistributionManifest) (*image.Config, error) {
+
+	reader, err := store.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get config reader: %s", err)
+	}
+	defer reader.Close()
+	configBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %s", err)
+	}
+	config, err := image.NewImageConfigFromJSON(configBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal config: %s", err)
+	}
+	return config, nil
+}
+
+// resolveImageDigest returns a lockfile.Resolver asking the registries of
+// images for the digests of their manifests.
+func resolveImageDigest(store *storage.ImageStore) lockfile.Resolver {
+	return func(name image.Name) (image.Digest, error) {
+		return registry.New(store, name.GetRegistry(), name.GetRepository()).
+			ResolveManifestDigest(name.GetTag())
+	}
+}
@@ -0,0 +1,90 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/uber/makisu/lib/log"
+
+	"github.com/spf13/cobra"
+)
+
+type validateCmd struct {
+	*cobra.Command
+
+	dockerfilePath string
+	buildArgs      []string
+
+	templateOptions
+	parseOptions
+}
+
+func getValidateCmd() *validateCmd {
+	validateCmd := &validateCmd{
+		Command: &cobra.Command{
+			Use:                   "validate [flags] <context path>",
+			DisableFlagsInUseLine: true,
+			Short:                 "Parse a dockerfile and print its stages, without building it. Windows dockerfiles are accepted",
+		},
+	}
+	validateCmd.Args = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Requires a build context as argument")
+		}
+		return nil
+	}
+	validateCmd.Run = func(cmd *cobra.Command, args []string) {
+		if err := validateCmd.Validate(args[0]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	validateCmd.PersistentFlags().StringVarP(&validateCmd.dockerfilePath, "file", "f", "Dockerfile", "The absolute path to the dockerfile")
+	validateCmd.PersistentFlags().StringArrayVar(&validateCmd.buildArgs, "build-arg", nil, "Argument to the dockerfile as per the spec of ARG. Format is \"--build-arg <arg>=<value>\"")
+	validateCmd.templateOptions.addFlags(validateCmd.Command)
+	validateCmd.parseOptions.addFlags(validateCmd.Command)
+
+	validateCmd.Flags().SortFlags = false
+	validateCmd.PersistentFlags().SortFlags = false
+
+	return validateCmd
+}
+
+// Validate parses the dockerfile of the context, and prints the base image and
+// number of directives of each stage to stdout. Stages building Windows images
+// are marked as such, since they can't be built.
+func (cmd *validateCmd) Validate(contextDir string) error {
+	stages, err := readDockerfile(contextDir, cmd.dockerfilePath, cmd.buildArgs, cmd.templateOptions, cmd.parseOptions)
+	if err != nil {
+		return err
+	}
+	for i, stage := range stages {
+		name := stage.From.Alias
+		if name == "" {
+			name = fmt.Sprintf("%d", i)
+		}
+		system := "linux"
+		if stage.Windows() {
+			system = "windows"
+		}
+		fmt.Printf("stage %s: FROM %s, %d directives, %s\n",
+			name, stage.From.Image, len(stage.Directives), system)
+	}
+	return nil
+}
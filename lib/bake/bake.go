@@ -0,0 +1,162 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bake builds several images in one invocation, from a file defining
+// targets with their context, dockerfile, build args and tags. Like with the
+// build server of package daemon, each target is built by a separate makisu
+// process, since builds modify the file system and global state. Targets share
+// the storage dir, and so the cache, of the build flags.
+package bake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/uber/makisu/lib/context"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultGroup is the group of targets built if none is requested.
+const DefaultGroup = "default"
+
+// Target is an image to build.
+type Target struct {
+	// Context is the build context. Local paths are relative to the bake file.
+	Context string `yaml:"context"`
+	// Dockerfile is the path of the dockerfile, relative to the context.
+	Dockerfile string `yaml:"dockerfile"`
+	// Target is the stage to build.
+	Target string `yaml:"target"`
+	// Args are the build args of the dockerfile.
+	Args map[string]string `yaml:"args"`
+	// Tags are the names of the image. The first one is its tag, the other
+	// ones are full names it is pushed to, like --replica.
+	Tags []string `yaml:"tags"`
+	// Flags are additional flags of makisu build.
+	Flags []string `yaml:"flags"`
+}
+
+// File defines the targets of a bake.
+type File struct {
+	Targets map[string]*Target `yaml:"targets"`
+	// Groups are named lists of targets, that can be requested like targets.
+	Groups map[string][]string `yaml:"groups"`
+}
+
+// Load reads a bake file. JSON is read as YAML.
+func Load(path string) (*File, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read bake file: %s", err)
+	}
+	var file File
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("unmarshal bake file %s: %s", path, err)
+	}
+	if len(file.Targets) == 0 {
+		return nil, fmt.Errorf("bake file %s defines no target", path)
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("resolve bake file dir: %s", err)
+	}
+	for name, target := range file.Targets {
+		if target == nil {
+			target = &Target{}
+			file.Targets[name] = target
+		}
+		if _, ok := file.Groups[name]; ok {
+			return nil, fmt.Errorf("target %s conflicts with group %s", name, name)
+		} else if len(target.Tags) == 0 {
+			return nil, fmt.Errorf("target %s has no tag", name)
+		}
+		if target.Context == "" {
+			target.Context = "."
+		}
+		if !context.IsRemoteSource(target.Context) && !filepath.IsAbs(target.Context) {
+			target.Context = filepath.Join(dir, target.Context)
+		}
+	}
+	for group, names := range file.Groups {
+		for _, name := range names {
+			if _, ok := file.Targets[name]; !ok {
+				return nil, fmt.Errorf("group %s has unknown target %s", group, name)
+			}
+		}
+	}
+	return &file, nil
+}
+
+// Select returns the sorted names of the targets to build for the given
+// target and group names. Without names, the default group is built if the
+// file defines one, and all targets otherwise.
+func (f *File) Select(names []string) ([]string, error) {
+	if len(names) == 0 {
+		if _, ok := f.Groups[DefaultGroup]; ok {
+			names = []string{DefaultGroup}
+		} else {
+			names = make([]string, 0, len(f.Targets))
+			for name := range f.Targets {
+				names = append(names, name)
+			}
+		}
+	}
+	selected := make(map[string]bool)
+	for _, name := range names {
+		if group, ok := f.Groups[name]; ok {
+			for _, target := range group {
+				selected[target] = true
+			}
+		} else if _, ok := f.Targets[name]; ok {
+			selected[name] = true
+		} else {
+			return nil, fmt.Errorf("unknown target or group: %s", name)
+		}
+	}
+	var targets []string
+	for name := range selected {
+		targets = append(targets, name)
+	}
+	sort.Strings(targets)
+	return targets, nil
+}
+
+// BuildArgs returns the arguments of makisu to build the target, with the
+// given build flags first, so the flags of the target override them.
+func (t *Target) BuildArgs(buildFlags []string) []string {
+	args := append([]string{"build"}, buildFlags...)
+	args = append(args, "-t", t.Tags[0])
+	for _, replica := range t.Tags[1:] {
+		args = append(args, "--replica", replica)
+	}
+	if t.Dockerfile != "" {
+		args = append(args, "-f", t.Dockerfile)
+	}
+	if t.Target != "" {
+		args = append(args, "--target", t.Target)
+	}
+	var keys []string
+	for key := range t.Args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--build-arg", key+"="+t.Args[key])
+	}
+	args = append(args, t.Flags...)
+	return append(args, t.Context)
+}
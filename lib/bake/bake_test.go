@@ -0,0 +1,158 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bake
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const _testFile = `
+targets:
+  api:
+    context: services/api
+    dockerfile: build/Dockerfile
+    target: release
+    args:
+      VERSION: "1.0"
+      BASE: alpine
+    tags: [api:1.0, registry.example.com/api:1.0]
+  worker:
+    context: https://github.com/example/worker.git
+    tags: [worker:latest]
+    flags: [--compression=speed]
+  debug:
+    tags: [debug:latest]
+groups:
+  default: [api, worker]
+`
+
+func writeTestFile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "bake.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoad(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := writeTestFile(t, _testFile)
+	defer cleanup()
+
+	file, err := Load(path)
+	require.NoError(err)
+	require.Len(file.Targets, 3)
+	dir := filepath.Dir(path)
+	require.Equal(filepath.Join(dir, "services/api"), file.Targets["api"].Context)
+	require.Equal("https://github.com/example/worker.git", file.Targets["worker"].Context)
+	require.Equal(dir, file.Targets["debug"].Context)
+
+	require.Equal([]string{
+		"build", "--storage", "/cache",
+		"-t", "api:1.0",
+		"--replica", "registry.example.com/api:1.0",
+		"-f", "build/Dockerfile",
+		"--target", "release",
+		"--build-arg", "BASE=alpine",
+		"--build-arg", "VERSION=1.0",
+		filepath.Join(dir, "services/api"),
+	}, file.Targets["api"].BuildArgs([]string{"--storage", "/cache"}))
+	require.Equal([]string{
+		"build", "-t", "worker:latest", "--compression=speed",
+		"https://github.com/example/worker.git",
+	}, file.Targets["worker"].BuildArgs(nil))
+
+	for _, content := range []string{
+		"targets: {}",
+		"targets: {api: {context: .}}",
+		"targets: {api: {tags: [a]}}\ngroups: {all: [api, missing]}",
+		"targets: {api: {tags: [a]}}\ngroups: {api: [api]}",
+		"targets: {api: {tags: [a], unknown: b}}",
+	} {
+		path, cleanup := writeTestFile(t, content)
+		defer cleanup()
+		_, err := Load(path)
+		require.Error(err, content)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	require := require.New(t)
+
+	path, cleanup := writeTestFile(t, _testFile)
+	defer cleanup()
+	file, err := Load(path)
+	require.NoError(err)
+
+	targets, err := file.Select(nil)
+	require.NoError(err)
+	require.Equal([]string{"api", "worker"}, targets)
+
+	targets, err = file.Select([]string{"debug", "default"})
+	require.NoError(err)
+	require.Equal([]string{"api", "debug", "worker"}, targets)
+
+	_, err = file.Select([]string{"missing"})
+	require.Error(err)
+
+	// All targets are built without a default group.
+	delete(file.Groups, DefaultGroup)
+	targets, err = file.Select(nil)
+	require.NoError(err)
+	require.Equal([]string{"api", "debug", "worker"}, targets)
+}
+
+func TestRun(t *testing.T) {
+	require := require.New(t)
+
+	file := &File{Targets: map[string]*Target{
+		"a": {Context: "/a", Tags: []string{"a"}},
+		"b": {Context: "/b", Tags: []string{"b"}},
+	}}
+	var out bytes.Buffer
+	results := Run(Options{
+		Executable: "echo",
+		BuildFlags: []string{"--rootless"},
+		Jobs:       2,
+		TargetFlags: func(name string) []string {
+			return []string{"--rootless-dir", "/tmp/" + name}
+		},
+	}, file, []string{"a", "b"}, &out)
+	require.Len(results, 2)
+	require.Equal("a", results[0].Target)
+	require.False(results[0].Failed())
+	require.False(results[1].Failed())
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.ElementsMatch([]string{
+		"[a] build --rootless --rootless-dir /tmp/a -t a /a",
+		"[b] build --rootless --rootless-dir /tmp/b -t b /b",
+	}, lines)
+
+	results = Run(Options{Executable: "false"}, file, []string{"a"}, &out)
+	require.True(results[0].Failed())
+	require.Equal(1, results[0].ExitCode)
+
+	results = Run(Options{Executable: "/nonexistent"}, file, []string{"a"}, &out)
+	require.True(results[0].Failed())
+	require.Error(results[0].Err)
+}
@@ -0,0 +1,147 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bake
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Options configures Run.
+type Options struct {
+	// Executable is the makisu binary that builds the targets.
+	Executable string
+	// BuildFlags are added to the flags of every target.
+	BuildFlags []string
+	// Jobs is the number of targets built at the same time.
+	Jobs int
+	// TargetFlags, if set, returns flags added to the build flags of a target,
+	// like a rootless dir of its own.
+	TargetFlags func(name string) []string
+}
+
+// Result is the outcome of the build of a target.
+type Result struct {
+	Target   string
+	ExitCode int
+	Duration time.Duration
+	// Err is set if the build could not be started.
+	Err error
+}
+
+// Failed returns true if the target was not built.
+func (r Result) Failed() bool {
+	return r.Err != nil || r.ExitCode != 0
+}
+
+// Run builds the targets of the file, and returns their results in the same
+// order. The output of the builds is written to out, each line prefixed with
+// the name of its target. All targets are built even if some fail.
+func Run(opts Options, file *File, targets []string, out io.Writer) []Result {
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]Result, len(targets))
+	slots := make(chan struct{}, jobs)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, name := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			flags := opts.BuildFlags
+			if opts.TargetFlags != nil {
+				flags = append(append([]string(nil), flags...), opts.TargetFlags(name)...)
+			}
+			w := &prefixWriter{mu: &mu, out: out, prefix: "[" + name + "] "}
+			start := time.Now()
+			code, err := run(opts.Executable, file.Targets[name].BuildArgs(flags), w)
+			w.flush()
+			results[i] = Result{
+				Target:   name,
+				ExitCode: code,
+				Duration: time.Since(start),
+				Err:      err,
+			}
+		}(i, name)
+	}
+	wg.Wait()
+	return results
+}
+
+// run runs makisu with the given args, and returns its exit code.
+func run(executable string, args []string, out io.Writer) (int, error) {
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("start build: %s", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() > 0 {
+				return status.ExitStatus(), nil
+			}
+		}
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// prefixWriter writes complete lines to out with a prefix, so the lines of
+// concurrent builds don't interleave.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes the last line, if it has no newline.
+func (w *prefixWriter) flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	io.WriteString(w.out, w.prefix)
+	w.out.Write(line)
+}
@@ -0,0 +1,168 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package budget checks built images against size budgets, so CI can reject
+// images that grew too large before they are pushed.
+package budget
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/storage"
+)
+
+// _maxBreakdown is the number of largest layers listed when the image is over
+// its budget.
+const _maxBreakdown = 10
+
+// Limits are the budgets of an image, in compressed bytes. A budget of 0 is
+// unlimited.
+type Limits struct {
+	// ImageSize is the budget of the layers and config of the image.
+	ImageSize int64
+	// LayerSize is the budget of each layer.
+	LayerSize int64
+}
+
+// IsZero returns true if no budget is set.
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Layer is a layer of a checked image.
+type Layer struct {
+	// Index is the position of the layer in the manifest.
+	Index     int
+	Digest    image.Digest
+	Size      int64
+	CreatedBy string
+	// Files is the number of files of the layer, if they were counted.
+	Files int
+}
+
+func (l Layer) String() string {
+	s := fmt.Sprintf("layer %d (%s): %s", l.Index, l.Digest, storage.FormatSize(l.Size))
+	if l.Files > 0 {
+		s += fmt.Sprintf(", %d files", l.Files)
+	}
+	if l.CreatedBy != "" {
+		s += ", created by " + l.CreatedBy
+	}
+	return s
+}
+
+// Layers returns the layers of the image of manifest, in order. The history of
+// config, which can be nil, tells which steps created them.
+func Layers(manifest *image.DistributionManifest, config *image.Config) []Layer {
+	layers := make([]Layer, len(manifest.Layers))
+	for i, descriptor := range manifest.Layers {
+		layers[i] = Layer{Index: i, Digest: descriptor.Digest, Size: descriptor.Size}
+	}
+	if config == nil {
+		return layers
+	}
+	// History entries that aren't empty layers map to the layers in order.
+	var createdBy []string
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+	if len(createdBy) == len(layers) {
+		for i := range layers {
+			layers[i].CreatedBy = createdBy[i]
+		}
+	}
+	return layers
+}
+
+// OverFiles returns the layers with more than maxFiles files, by decreasing
+// number of files.
+func OverFiles(layers []Layer, maxFiles int) []Layer {
+	var over []Layer
+	for _, l := range layers {
+		if l.Files > maxFiles {
+			over = append(over, l)
+		}
+	}
+	sort.SliceStable(over, func(i, j int) bool { return over[i].Files > over[j].Files })
+	return over
+}
+
+// Violation is the error of an image over its budgets.
+type Violation struct {
+	Limits Limits
+	// ImageSize is the compressed size of the image.
+	ImageSize int64
+	// Layers are the layers over the layer budget, or the largest layers of
+	// the image if none is but the image is over its budget, by decreasing
+	// size.
+	Layers []Layer
+}
+
+func (v *Violation) Error() string {
+	var reasons []string
+	if v.Limits.ImageSize > 0 && v.ImageSize > v.Limits.ImageSize {
+		reasons = append(reasons, fmt.Sprintf("image is %s, over the budget of %s",
+			storage.FormatSize(v.ImageSize), storage.FormatSize(v.Limits.ImageSize)))
+	}
+	var over int
+	for _, l := range v.Layers {
+		if v.Limits.LayerSize > 0 && l.Size > v.Limits.LayerSize {
+			over++
+		}
+	}
+	if over > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d layers are over the layer budget of %s",
+			over, storage.FormatSize(v.Limits.LayerSize)))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Check returns a Violation if the image of manifest is over the limits, or nil
+// otherwise. The history of config, which can be nil, tells which steps
+// created the layers.
+func Check(limits Limits, manifest *image.DistributionManifest, config *image.Config) *Violation {
+	layers := Layers(manifest, config)
+	size := manifest.Config.Size
+	for _, l := range layers {
+		size += l.Size
+	}
+	sort.SliceStable(layers, func(i, j int) bool { return layers[i].Size > layers[j].Size })
+
+	v := &Violation{Limits: limits, ImageSize: size}
+	if limits.LayerSize > 0 {
+		for _, l := range layers {
+			if l.Size > limits.LayerSize {
+				v.Layers = append(v.Layers, l)
+			}
+		}
+	}
+	if limits.ImageSize > 0 && size > limits.ImageSize {
+		if len(v.Layers) == 0 {
+			v.Layers = layers
+			if len(v.Layers) > _maxBreakdown {
+				v.Layers = v.Layers[:_maxBreakdown]
+			}
+		}
+		return v
+	}
+	if len(v.Layers) > 0 {
+		return v
+	}
+	return nil
+}
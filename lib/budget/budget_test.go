@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package budget
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	require := require.New(t)
+
+	manifest := &image.DistributionManifest{
+		Config: image.Descriptor{Digest: "sha256:config", Size: 100},
+		Layers: []image.Descriptor{
+			{Digest: "sha256:base", Size: 3000},
+			{Digest: "sha256:deps", Size: 5000},
+			{Digest: "sha256:app", Size: 1000},
+		},
+	}
+	config := &image.Config{History: []image.History{
+		{CreatedBy: "FROM alpine"},
+		{CreatedBy: "ENV A=1", EmptyLayer: true},
+		{CreatedBy: "RUN npm install"},
+		{CreatedBy: "COPY . /app"},
+	}}
+
+	require.Nil(Check(Limits{}, manifest, config))
+	require.Nil(Check(Limits{ImageSize: 9100, LayerSize: 5000}, manifest, config))
+
+	// Layers over their budget are listed by decreasing size.
+	v := Check(Limits{LayerSize: 2000}, manifest, config)
+	require.NotNil(v)
+	require.Equal([]Layer{
+		{Index: 1, Digest: "sha256:deps", Size: 5000, CreatedBy: "RUN npm install"},
+		{Index: 0, Digest: "sha256:base", Size: 3000, CreatedBy: "FROM alpine"},
+	}, v.Layers)
+	require.Equal("2 layers are over the layer budget of 2.0KB", v.Error())
+
+	// Images over their budget list their largest layers.
+	v = Check(Limits{ImageSize: 9000}, manifest, nil)
+	require.NotNil(v)
+	require.Equal(int64(9100), v.ImageSize)
+	require.Len(v.Layers, 3)
+	require.Equal(image.Digest("sha256:app"), v.Layers[2].Digest)
+	require.Empty(v.Layers[0].CreatedBy)
+	require.Equal("image is 8.9KB, over the budget of 8.8KB", v.Error())
+}
+
+func TestOverFiles(t *testing.T) {
+	require := require.New(t)
+
+	layers := []Layer{
+		{Index: 0, Digest: "sha256:base", Files: 3000},
+		{Index: 1, Digest: "sha256:deps", Files: 900000},
+		{Index: 2, Digest: "sha256:app", Files: 12},
+	}
+	require.Empty(OverFiles(layers, 900000))
+	over := OverFiles(layers, 1000)
+	require.Len(over, 2)
+	require.Equal(1, over[0].Index)
+	require.Equal(0, over[1].Index)
+	require.Equal("layer 1 (sha256:deps): 0B, 900000 files", over[0].String())
+}
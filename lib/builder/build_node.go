@@ -24,8 +24,13 @@ import (
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/failure"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/profile"
+	"github.com/uber/makisu/lib/redact"
 	"github.com/uber/makisu/lib/tario"
+
+	"github.com/pkg/errors"
 )
 
 // buildNodeOptions wraps options that are specified when a node is built.
@@ -55,6 +60,18 @@ func newBuildNode(ctx *context.BuildContext, step step.BuildStep) *buildNode {
 	}
 }
 
+// String returns the string representation of the step, with secret values
+// masked, as it is logged and reported.
+func (n *buildNode) String() string {
+	return redact.String(n.BuildStep.String())
+}
+
+// CreatedBy returns the description of the step in the history of the image,
+// with secret values masked.
+func (n *buildNode) CreatedBy() string {
+	return redact.String(n.BuildStep.CreatedBy())
+}
+
 // Build applies the image config, builds the step unless it should be skipped or was cached, and
 // generates a resulting config for the next step. Also pushes cache layers if this step commits
 // a layer.
@@ -74,6 +91,7 @@ func (n *buildNode) Build(
 		// Update MemFS, and only untar layers if modifyFS is strue.
 		for _, pair := range n.digestPairs {
 			if err := n.applyLayer(pair, opts.modifyFS); err != nil {
+				n.ctx.Failure.SetKind(failure.KindCache)
 				return nil, fmt.Errorf("apply cache: %s", err)
 			}
 		}
@@ -99,12 +117,35 @@ func (n *buildNode) Build(
 	return config, nil
 }
 
+// size returns the compressed size of the layers of the node.
+func (n *buildNode) size() int64 {
+	var size int64
+	for _, digestPair := range n.digestPairs {
+		size += digestPair.GzipDescriptor.Size
+	}
+	return size
+}
+
+// cacheStatus returns how the cache applies to the node before it's built:
+// "hit" if its layer was pulled from the cache, "skipped" if a later step
+// was, and "miss" otherwise.
+func (n *buildNode) cacheStatus(opts *buildNodeOptions) string {
+	if opts.skipBuild {
+		return "skipped"
+	} else if n.digestPairs != nil {
+		return "hit"
+	}
+	return "miss"
+}
+
 func (n *buildNode) doCommit(cacheMgr cache.Manager, opts *buildNodeOptions) error {
 	var err error
+	start := time.Now()
 	n.digestPairs, err = n.Commit(n.ctx)
 	if err != nil {
 		return fmt.Errorf("commit: %s", err)
 	}
+	n.ctx.Profile.Record(profile.PhaseCommit, start, n.size())
 
 	// If the number of digestPairs is greater than 1 then we cannot push
 	// the resulting layer mappings to the distributed cache.
@@ -113,6 +154,7 @@ func (n *buildNode) doCommit(cacheMgr cache.Manager, opts *buildNodeOptions) err
 	}
 
 	if err := n.pushCacheLayer(cacheMgr); err != nil {
+		n.ctx.Failure.SetKind(failure.KindCache)
 		return fmt.Errorf("push cache: %s", err)
 	}
 	return nil
@@ -124,6 +166,12 @@ func (n *buildNode) doExecute(cacheMgr cache.Manager, opts *buildNodeOptions) er
 	if err != nil {
 		return fmt.Errorf("execute step: %s", err)
 	}
+	// FROM steps pull and extract their base image.
+	if _, ok := n.BuildStep.(*step.FromStep); ok {
+		n.ctx.Profile.Record(profile.PhasePull, start, 0)
+	} else {
+		n.ctx.Profile.Record(profile.PhaseExec, start, 0)
+	}
 	log.Infow(fmt.Sprintf("* Executed %s", n.String()), "duration", time.Since(start))
 	return nil
 }
@@ -135,9 +183,9 @@ func (n *buildNode) applyLayer(digestPair *image.DigestPair, modifyfs bool) erro
 	if err != nil {
 		return fmt.Errorf("get reader from layer: %s", err)
 	}
-	gzipReader, err := tario.NewGzipReader(reader)
+	gzipReader, err := tario.NewDecompressReader(reader)
 	if err != nil {
-		return fmt.Errorf("create gzip reader for layer: %s", err)
+		return fmt.Errorf("create decompress reader for layer: %s", err)
 	}
 	log.Infof("* Applying cache layer %s (unpack=%v)",
 		digestPair.GzipDescriptor.Digest.Hex(), modifyfs)
@@ -165,9 +213,11 @@ func (n *buildNode) pushCacheLayer(cacheMgr cache.Manager) error {
 // pullCacheLayer pulls cached layers for this node's digest pair(s).
 func (n *buildNode) pullCacheLayer(cacheMgr cache.Manager) bool {
 	digestPair, err := cacheMgr.PullCache(n.CacheID())
-	if err != nil {
-		// TODO: distinguish cache not found and pull failure.
-		log.Errorf("Failed to fetch intermediate layer with cache ID %s: %s", n.CacheID(), err)
+	if errors.Cause(err) == cache.ErrorLayerNotFound {
+		log.Infof("* Cache miss for cache ID %s", n.CacheID())
+		return false
+	} else if err != nil {
+		log.Warnf("Failed to fetch intermediate layer with cache ID %s: %s", n.CacheID(), err)
 		return false
 	} else if digestPair == nil {
 		return true
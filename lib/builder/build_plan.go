@@ -16,10 +16,12 @@ package builder
 
 import (
 	"fmt"
-	"hash/crc32"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/uber/makisu/lib/builder/step"
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
@@ -34,6 +36,13 @@ type buildPlanOptions struct {
 	allowModifyFS bool
 }
 
+// squashOptions configures squashing of the target stage at export time. It
+// doesn't change cache IDs, since individual layers are still committed.
+type squashOptions struct {
+	enabled  bool
+	fromStep int
+}
+
 // BuildPlan describes a list of named buildStages, that can copy files between
 // one another.
 type BuildPlan struct {
@@ -58,7 +67,19 @@ type BuildPlan struct {
 	// stages list to support `COPY --from=<image>`.
 	stageIndexAliases map[string]*buildStage
 
-	opts *buildPlanOptions
+	opts   *buildPlanOptions
+	squash squashOptions
+	// created is the creation time of the image, if it's fixed.
+	created *time.Time
+	// epoch replaces the times of all the history entries of the image, if
+	// it's set.
+	epoch *time.Time
+	// labels are added to the config of the image.
+	labels map[string]string
+	// overrides replace parts of the config of the image.
+	overrides *ConfigOverrides
+	// annotations are added to the manifest of the image.
+	annotations map[string]string
 }
 
 // NewBuildPlan takes in contextDir, a target image and an ImageStore, and
@@ -93,15 +114,30 @@ func NewBuildPlan(
 func (plan *BuildPlan) processStagesAndAliases(
 	ctx *context.BuildContext, parsedStages dockerfile.Stages) error {
 
-	checksum := crc32.ChecksumIEEE([]byte(utils.BuildHash + fmt.Sprintf("%v", plan.opts)))
-	seedCacheID := fmt.Sprintf("%x", checksum)
+	seed := utils.BuildHash + fmt.Sprintf("%v", plan.opts)
+	if len(ctx.Excludes) > 0 {
+		// Excludes change all layers committed by scan.
+		seed += strings.Join(ctx.Excludes, " ")
+	}
+	seedCacheID := step.CacheIDFromString(seed)
+
+	if ctx.Hermetic {
+		// Check before creating the steps, which would fail on URLs first.
+		if err := checkHermetic(ctx, parsedStages); err != nil {
+			return err
+		}
+	}
 
 	existingAliases := make(map[string]struct{})
 	for i, parsedStage := range parsedStages {
+		replaceNamedImages(ctx, parsedStage)
+
 		// Record alias.
 		if parsedStage.From.Alias != "" {
 			if _, ok := existingAliases[parsedStage.From.Alias]; ok {
 				return fmt.Errorf("duplicate stage alias: %s", parsedStage.From.Alias)
+			} else if isNamedContext(ctx, parsedStage.From.Alias) {
+				return fmt.Errorf("stage alias conflicts with build context: %s", parsedStage.From.Alias)
 			} else if _, err := strconv.Atoi(parsedStage.From.Alias); err == nil {
 				// Note: Docker would return `name can't start with a number or
 				// contain symbols`.
@@ -111,6 +147,11 @@ func (plan *BuildPlan) processStagesAndAliases(
 			parsedStage.From.Alias = strconv.Itoa(i)
 		}
 		existingAliases[parsedStage.From.Alias] = struct{}{}
+		if parsedStage.Windows() {
+			return fmt.Errorf(
+				"stage %s builds a Windows image, which can be parsed but not built",
+				parsedStage.From.Alias)
+		}
 
 		// Add this stage to the plan.
 		stage, err := newBuildStage(
@@ -170,18 +211,84 @@ func (plan *BuildPlan) processStagesAndAliases(
 	return nil
 }
 
+// replaceNamedImages replaces the names of image contexts with their images in
+// the FROM and COPY --from directives of a stage.
+func replaceNamedImages(ctx *context.BuildContext, parsedStage *dockerfile.Stage) {
+	if img, ok := ctx.NamedImages[parsedStage.From.Image]; ok {
+		parsedStage.From.Image = img
+	}
+	for _, directive := range parsedStage.Directives {
+		if copyDirective, ok := directive.(*dockerfile.CopyDirective); ok {
+			if img, ok := ctx.NamedImages[copyDirective.FromStage]; ok {
+				copyDirective.FromStage = img
+			}
+		}
+	}
+}
+
+// isNamedContext returns true if name is one of the additional contexts.
+func isNamedContext(ctx *context.BuildContext, name string) bool {
+	_, isDir := ctx.NamedContexts[name]
+	_, isImage := ctx.NamedImages[name]
+	return isDir || isImage
+}
+
+// SetSquash makes the plan squash the layers of the target stage into a single
+// layer, from the given step onwards. Steps are numbered from 1 like in the
+// build logs; the layers of the base image are always kept.
+func (plan *BuildPlan) SetSquash(fromStep int) {
+	plan.squash = squashOptions{enabled: true, fromStep: fromStep}
+}
+
+// SetCreated sets the creation time of the image and of the history entries of
+// its steps, instead of the time they are built at. Base image history is kept
+// as is.
+func (plan *BuildPlan) SetCreated(created time.Time) {
+	plan.created = &created
+}
+
+// SetEpoch sets the creation time of the image and of all its history
+// entries, the ones inherited from the base image included, so the config only
+// depends on the inputs of the build.
+func (plan *BuildPlan) SetEpoch(epoch time.Time) {
+	plan.created = &epoch
+	plan.epoch = &epoch
+}
+
+// SetLabels adds labels to the config of the image. Labels set by the
+// dockerfile take precedence.
+func (plan *BuildPlan) SetLabels(labels map[string]string) {
+	plan.labels = labels
+}
+
+// SetConfigOverrides replaces parts of the config of the image once the target
+// stage is built, after the dockerfile set them.
+func (plan *BuildPlan) SetConfigOverrides(overrides *ConfigOverrides) {
+	plan.overrides = overrides
+}
+
+// SetAnnotations adds annotations to the manifest of the image, which makes it
+// an OCI manifest.
+func (plan *BuildPlan) SetAnnotations(annotations map[string]string) {
+	plan.annotations = annotations
+}
+
 // Execute executes all build stages in order.
 func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 	// We need to backup the original env to restore it between stages
 	orignalEnv := utils.ConvertStringSliceToMap(os.Environ())
 
+	plan.prefetchCache()
+
 	var currStage *buildStage
 	for k := 0; k < len(plan.stages); k++ {
 		currStage = plan.stages[k]
 
 		// TODO: Implicit stages from "COPY --from=<image>" might introduce
 		// confusion here. Print stageIndexAliases instead.
-		log.Infof("* Stage %d/%d : %s", k+1, len(plan.stages), currStage.String())
+		log.Infow(fmt.Sprintf("* Stage %d/%d : %s", k+1, len(plan.stages), currStage.String()),
+			"stage", currStage.alias, "stage_index", k+1, "stages", len(plan.stages))
+		start := time.Now()
 
 		// Try to pull reusable layers cached from previous builds.
 		currStage.pullCacheLayers(plan.cacheMgr)
@@ -192,6 +299,8 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 		if err := plan.executeStage(currStage, lastStage, copiedFrom); err != nil {
 			return nil, fmt.Errorf("execute stage: %s", err)
 		}
+		log.Infow(fmt.Sprintf("* Finished stage %d/%d", k+1, len(plan.stages)),
+			"stage", currStage.alias, "stage_index", k+1, "duration", time.Since(start))
 
 		// Restore env
 		os.Clearenv()
@@ -208,16 +317,33 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 	// Wait for cache layers to be pushed. This will make them available to
 	// other builds ongoing on different machines.
 	if err := plan.cacheMgr.WaitForPush(); err != nil {
-		log.Errorf("Failed to push cache: %s", err)
+		log.Warnf("Failed to push cache: %s", err)
+	}
+
+	if len(plan.labels) != 0 {
+		config := currStage.lastImageConfig.Config
+		config.Labels = utils.MergeStringMaps(plan.labels, config.Labels)
+	}
+	if plan.overrides != nil {
+		plan.overrides.apply(currStage.lastImageConfig.Config)
+	}
+
+	if plan.squash.enabled {
+		if err := currStage.squash(plan.squash.fromStep, plan.created); err != nil {
+			return nil, fmt.Errorf("squash stage %s: %s", currStage.alias, err)
+		}
+	}
+	if plan.epoch != nil {
+		setEpoch(currStage.lastImageConfig, *plan.epoch)
 	}
 
 	// Save image manifest.
-	manifest, err := currStage.saveManifest(plan.baseCtx.ImageStore, plan.target)
+	manifest, err := currStage.saveManifest(plan.baseCtx.ImageStore, plan.target, plan.annotations)
 	if err != nil {
 		return nil, fmt.Errorf("save image manifest %s: %s", plan.target, err)
 	}
 	for _, replica := range plan.replicas {
-		_, err := currStage.saveManifest(plan.baseCtx.ImageStore, replica)
+		_, err := currStage.saveManifest(plan.baseCtx.ImageStore, replica, plan.annotations)
 		if err != nil {
 			return nil, fmt.Errorf("save alias manifest %s: %s", replica, err)
 		}
@@ -233,8 +359,30 @@ func (plan *BuildPlan) Execute() (*image.DistributionManifest, error) {
 	return manifest, nil
 }
 
+// prefetchCache looks up the cache IDs of all the stages up to the target one
+// in one batch, instead of one round trip to the KV store per step.
+func (plan *BuildPlan) prefetchCache() {
+	var cacheIDs []string
+	target := plan.targetStage()
+	for _, stage := range plan.stages {
+		cacheIDs = append(cacheIDs, stage.cacheIDs()...)
+		if stage == target {
+			break
+		}
+	}
+	plan.cacheMgr.PrefetchCache(cacheIDs)
+}
+
+// setEpoch sets the creation time of config and of all its history entries.
+func setEpoch(config *image.Config, epoch time.Time) {
+	config.Created = epoch
+	for i := range config.History {
+		config.History[i].Created = epoch
+	}
+}
+
 func (plan *BuildPlan) executeStage(stage *buildStage, lastStage, copiedFrom bool) error {
-	if err := stage.build(plan.cacheMgr, lastStage, copiedFrom); err != nil {
+	if err := stage.build(plan.cacheMgr, lastStage, copiedFrom, plan.created); err != nil {
 		return fmt.Errorf("build stage %s: %s", stage.alias, err)
 	}
 
@@ -17,7 +17,9 @@ package builder
 import (
 	"encoding/json"
 	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
@@ -62,8 +64,196 @@ func TestBuildPlanExecution(t *testing.T) {
 	require.NoError(err)
 	var config image.Config
 	require.NoError(json.Unmarshal(b, &config))
-	require.Equal(2, len(config.History))
 	require.Equal(2, len(config.RootFS.DiffIDs))
+
+	// Directives that don't commit a layer have empty layer history entries.
+	require.Equal(4, len(config.History))
+	require.Equal("/bin/sh -c #(nop)  ENV TESTENV=test", config.History[0].CreatedBy)
+	require.True(config.History[0].EmptyLayer)
+	require.Equal("/bin/sh -c ls .", config.History[1].CreatedBy)
+	require.False(config.History[1].EmptyLayer)
+	require.True(config.History[2].EmptyLayer)
+	require.Equal("/bin/sh -c ls ..", config.History[3].CreatedBy)
+	require.False(config.History[3].EmptyLayer)
+}
+
+func TestBuildPlanCreated(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.EnvDirectiveFixture("TESTENV=test", map[string]string{"TESTENV": "test"}),
+		dockerfile.RunDirectiveFixture("ls .", "ls ."),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+	created := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	plan.SetCreated(created)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.True(created.Equal(config.Created))
+	require.Len(config.History, 2)
+	for _, h := range config.History {
+		require.True(created.Equal(h.Created))
+	}
+}
+
+func TestBuildPlanEpoch(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.RunDirectiveFixture("ls .", "ls ."),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+	epoch := time.Unix(0, 0).UTC()
+	plan.SetEpoch(epoch)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.True(epoch.Equal(config.Created))
+	require.Len(config.History, 1)
+	require.True(epoch.Equal(config.History[0].Created))
+
+	// History inherited from the base image is rewritten too.
+	base := &image.Config{
+		History: []image.History{
+			{Created: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC), CreatedBy: "base"},
+			{Created: time.Date(2019, 1, 3, 3, 4, 5, 0, time.UTC), EmptyLayer: true},
+		},
+	}
+	base.Created = time.Date(2019, 1, 3, 3, 4, 5, 0, time.UTC)
+	setEpoch(base, epoch)
+	require.True(epoch.Equal(base.Created))
+	for _, h := range base.History {
+		require.True(epoch.Equal(h.Created))
+	}
+	require.Equal("base", base.History[0].CreatedBy)
+	require.True(base.History[1].EmptyLayer)
+}
+
+func TestBuildPlanLabels(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.LabelDirectiveFixture("a=dockerfile", map[string]string{"a": "dockerfile"}),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+	plan.SetLabels(map[string]string{"a": "plan", "b": "plan"})
+	manifest, err := plan.Execute()
+	require.NoError(err)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.Equal(map[string]string{"a": "dockerfile", "b": "plan"}, config.Config.Labels)
+}
+
+func TestBuildPlanAnnotations(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	stages := []*dockerfile.Stage{{From: from}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+	plan.SetAnnotations(map[string]string{"a": "b"})
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Equal(image.MediaTypeOCIManifest, manifest.MediaType)
+	require.Equal(image.MediaTypeOCIConfig, manifest.Config.MediaType)
+	require.Equal(map[string]string{"a": "b"}, manifest.Annotations)
+
+	r, err := ctx.ImageStore.Manifests.GetStoreFileReader(target.GetRepository(), target.GetTag())
+	require.NoError(err)
+	defer r.Close()
+	var saved image.DistributionManifest
+	require.NoError(json.NewDecoder(r).Decode(&saved))
+	require.Equal(*manifest, saved)
+}
+
+func TestBuildPlanConfigOverrides(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.EnvDirectiveFixture("A=dockerfile B=dockerfile", map[string]string{"A": "dockerfile", "B": "dockerfile"}),
+		dockerfile.EntrypointDirectiveFixture("app", []string{"app"}),
+		dockerfile.CmdDirectiveFixture("--help", []string{"--help"}),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+	overrides, err := NewConfigOverrides("", "[]", []string{"B=flag", "C=flag"}, "nobody", "/app")
+	require.NoError(err)
+	plan.SetConfigOverrides(overrides)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+	require.Equal([]string{"app"}, config.Config.Entrypoint)
+	require.Empty(config.Config.Cmd)
+	require.Contains(config.Config.Env, "A=dockerfile")
+	require.Contains(config.Config.Env, "B=flag")
+	require.Contains(config.Config.Env, "C=flag")
+	require.Equal("nobody", config.Config.User)
+	require.Equal("/app", config.Config.WorkingDir)
 }
 
 func TestBuildPlanContextDirs(t *testing.T) {
@@ -123,6 +313,85 @@ func TestBuildPlanContextDirs(t *testing.T) {
 	require.Error(err)
 }
 
+func TestBuildPlanNamedContexts(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	ctx.NamedContexts["vendor"] = ctx.ContextDir
+	ctx.NamedImages["base"] = "alpine:3.19"
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "hello"), nil, 0644))
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	// Named contexts don't need stages, and image contexts are pulled.
+	from := dockerfile.FromDirectiveFixture("", "base", "")
+	directives := []dockerfile.Directive{
+		dockerfile.CopyDirectiveFixture("", "", "vendor", []string{"/hello"}, "/hello"),
+		dockerfile.CopyDirectiveFixture("", "", "base", []string{"/etc/hosts"}, "/hosts"),
+	}
+	stages := []*dockerfile.Stage{{from, directives}}
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	require.NoError(err)
+	require.Equal("alpine:3.19", from.Image)
+	require.Len(plan.copyFromDirs, 1)
+	require.Contains(plan.copyFromDirs, "alpine:3.19")
+	require.Len(plan.stages, 2)
+
+	// Stage aliases cannot shadow named contexts.
+	from = dockerfile.FromDirectiveFixture("", "scratch", "vendor")
+	stages = []*dockerfile.Stage{{from, nil}}
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	require.Error(err)
+}
+
+func TestBuildPlanHermetic(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	ctx.Hermetic = true
+	ctx.NamedContexts["vendor"] = ctx.ContextDir
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "b"), nil, 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "d.tar"), nil, 0644))
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	pinned := "alpine:3.19@sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3"
+
+	// Stages, named contexts and pinned images are declared inputs.
+	stages := []*dockerfile.Stage{
+		{dockerfile.FromDirectiveFixture("", "scratch", "builder"), nil},
+		{dockerfile.FromDirectiveFixture("", pinned, ""), []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("", "", "builder", []string{"/a"}, "/a"),
+			dockerfile.CopyDirectiveFixture("", "", "vendor", []string{"/b"}, "/b"),
+			dockerfile.CopyDirectiveFixture("", "", pinned, []string{"/c"}, "/c"),
+			dockerfile.AddDirectiveFixture("", "", []string{"d.tar"}, "/d"),
+		}},
+	}
+	_, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	require.NoError(err)
+
+	// All violations are reported at once.
+	stages = []*dockerfile.Stage{
+		{dockerfile.FromDirectiveFixture("", "alpine:3.19", ""), []dockerfile.Directive{
+			dockerfile.CopyDirectiveFixture("", "", "busybox", []string{"/c"}, "/c"),
+			dockerfile.AddDirectiveFixture("", "", []string{"https://example.com/d.tar"}, "/d"),
+		}},
+	}
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	require.Error(err)
+	require.Contains(err.Error(), "FROM alpine:3.19 is not pinned by digest, pin it as alpine:3.19@sha256:<digest>")
+	require.Contains(err.Error(), "COPY --from=busybox is not pinned by digest")
+	require.Contains(err.Error(), "ADD https://example.com/d.tar fetches a URL")
+
+	ctx.Hermetic = false
+	stages[0].Directives = stages[0].Directives[:1]
+	_, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, false, "")
+	require.NoError(err)
+}
+
 func TestBuildPlanBadRun(t *testing.T) {
 	require := require.New(t)
 
@@ -178,6 +447,24 @@ func TestDuplicateStageAlias(t *testing.T) {
 	require.NoError(err)
 }
 
+func TestBuildPlanWindowsStage(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+
+	from := dockerfile.FromDirectiveFixture("", "scratch", "windows")
+	workdir := dockerfile.WorkdirDirectiveFixture(`C:\app`, `C:\app`)
+	stages := []*dockerfile.Stage{{From: from, Directives: []dockerfile.Directive{workdir}}}
+
+	_, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, false, false, "")
+	require.EqualError(err, "process stages and aliases: "+
+		"stage windows builds a Windows image, which can be parsed but not built")
+}
+
 func TestTargetStageMissing(t *testing.T) {
 	require := require.New(t)
 
@@ -15,8 +15,6 @@
 package builder
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -28,8 +26,11 @@ import (
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/failure"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/notify"
 	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/profile"
 	"github.com/uber/makisu/lib/storage"
 )
 
@@ -50,6 +51,9 @@ type buildStage struct {
 	nodes           []*buildNode
 	lastImageConfig *image.Config
 
+	// squashed is set if the layers of the stage were squashed.
+	squashed *squashedLayer
+
 	opts *buildStageOptions
 }
 
@@ -64,6 +68,33 @@ func newBuildStage(
 	if err != nil {
 		return nil, fmt.Errorf("create stage build context: %s", err)
 	}
+	ctx.Excludes = baseCtx.Excludes
+	ctx.CleanPackageCaches = baseCtx.CleanPackageCaches
+	ctx.Secrets = baseCtx.Secrets
+	ctx.StartLayerStream = baseCtx.StartLayerStream
+	ctx.VerifyBaseImage = baseCtx.VerifyBaseImage
+	ctx.WarnBaseUpdates = baseCtx.WarnBaseUpdates
+	ctx.ExtractLimits = baseCtx.ExtractLimits
+	ctx.IncrementalScan = baseCtx.IncrementalScan
+	ctx.OverlaySnapshot = baseCtx.OverlaySnapshot
+	ctx.IsolateRuns = baseCtx.IsolateRuns
+	ctx.Runtime = baseCtx.Runtime
+	ctx.Hermetic = baseCtx.Hermetic
+	ctx.RunEnv = baseCtx.RunEnv
+	ctx.StepTimeout = baseCtx.StepTimeout
+	ctx.Deadline = baseCtx.Deadline
+	ctx.StepLogs = baseCtx.StepLogs
+	ctx.NamedContexts = baseCtx.NamedContexts
+	ctx.NamedImages = baseCtx.NamedImages
+	ctx.ContextChown = baseCtx.ContextChown
+	ctx.Platform = baseCtx.Platform
+	ctx.DefaultPath = baseCtx.DefaultPath
+	ctx.Shell = baseCtx.Shell
+	ctx.Strict = baseCtx.Strict
+	ctx.Profile = baseCtx.Profile
+	ctx.Failure = baseCtx.Failure
+	ctx.Notifier = baseCtx.Notifier
+	ctx.Progress = baseCtx.Progress
 
 	// Create steps from parsed stage.
 	steps, err := createDockerfileSteps(ctx, seed, parsedStage, planOpts)
@@ -85,6 +116,14 @@ func newRemoteImageStage(
 	if err != nil {
 		return nil, fmt.Errorf("create stage build context: %s", err)
 	}
+	ctx.VerifyBaseImage = baseCtx.VerifyBaseImage
+	ctx.WarnBaseUpdates = baseCtx.WarnBaseUpdates
+	ctx.ExtractLimits = baseCtx.ExtractLimits
+	ctx.Platform = baseCtx.Platform
+	ctx.Profile = baseCtx.Profile
+	ctx.Failure = baseCtx.Failure
+	ctx.Notifier = baseCtx.Notifier
+	ctx.Progress = baseCtx.Progress
 
 	// Create from step.
 	from, err := step.NewFromStep(alias, alias, alias)
@@ -120,9 +159,10 @@ func newBuildStageHelper(
 		newNode := newBuildNode(ctx, step)
 		nodes = append(nodes, newNode)
 
-		// Add context dirs for cross-stage copy, if any.
+		// Add context dirs for cross-stage copy, if any. Named contexts are
+		// read in place.
 		alias, dirs := step.ContextDirs()
-		if len(dirs) > 0 {
+		if _, named := ctx.NamedContexts[alias]; len(dirs) > 0 && !named {
 			if _, ok := copyFromDirs[alias]; !ok {
 				copyFromDirs[alias] = make([]string, 0)
 			}
@@ -167,8 +207,11 @@ func createDockerfileSteps(
 }
 
 // build performs the build for that stage. There are side effects that should
-// be expected on each node within the stage.
-func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom bool) error {
+// be expected on each node within the stage. The image config and new history
+// entries are created at the given time if it's set.
+func (stage *buildStage) build(
+	cacheMgr cache.Manager, lastStage, copiedFrom bool, created *time.Time) error {
+
 	var err error
 	diffIDs := make([]image.Digest, 0)
 	histories := make([]image.History, 0)
@@ -188,29 +231,107 @@ func (stage *buildStage) build(cacheMgr cache.Manager, lastStage, copiedFrom boo
 			modifyFS:    modifyFS,
 		}
 
-		log.Infof("* Step %d/%d (%s) : %s", i+1, len(stage.nodes), nodeOpts.String(), node.String())
+		log.Infow(fmt.Sprintf("* Step %d/%d (%s) : %s", i+1, len(stage.nodes), nodeOpts.String(), node.String()),
+			"stage", stage.alias, "step", i+1, "steps", len(stage.nodes))
+		start := time.Now()
+		cacheStatus := node.cacheStatus(nodeOpts)
+		stage.ctx.Profile.StartStep(stage.alias, i+1, node.String())
+		stage.ctx.StepLogs.StartStep(stage.alias, i+1)
+		stage.ctx.Profile.SetStepCache(cacheStatus)
+		stage.ctx.Progress.StartStep(stage.alias, i+1, len(stage.nodes), node.String())
 		stage.lastImageConfig, err = node.Build(cacheMgr, stage.lastImageConfig, nodeOpts)
+		stage.ctx.Profile.EndStep()
+		stage.ctx.Progress.EndStep(cacheStatus != "miss", err)
 		if err != nil {
+			if _, ok := node.BuildStep.(*step.FromStep); ok {
+				stage.ctx.Failure.SetKind(failure.KindPull)
+			}
+			stage.ctx.Failure.SetKind(failure.KindStep)
+			stage.ctx.Failure.SetStep(stage.alias, i+1, node.String())
 			return fmt.Errorf("build node: %s", err)
 		}
+		log.Infow(fmt.Sprintf("* Finished step %d/%d", i+1, len(stage.nodes)),
+			"stage", stage.alias, "step", i+1, "cache", cacheStatus, "duration", time.Since(start))
+		stage.ctx.Notifier.Notify(notify.Event{
+			Type:      notify.EventStepCompleted,
+			Stage:     stage.alias,
+			Step:      i + 1,
+			Directive: node.String(),
+			Cache:     cacheStatus,
+			Duration:  time.Since(start).Seconds(),
+		})
 
 		// Update diff IDs and history information.
 		for _, digestPair := range node.digestPairs {
 			diffIDs = append(diffIDs, digestPair.TarDigest)
-			histories = append(histories, image.History{
-				Created:   time.Now(),
-				CreatedBy: fmt.Sprintf("makisu: %s", node.String()),
-				Author:    "makisu",
-			})
+		}
+		if i == 0 {
+			// The config is the one of the base image at this point.
+			histories = append(histories, baseHistory(node, stage.lastImageConfig)...)
+		} else {
+			histories = append(histories, nodeHistory(node, createdAt(created))...)
 		}
 	}
-	stage.lastImageConfig.Created = time.Now()
+	stage.lastImageConfig.Created = createdAt(created)
 	stage.lastImageConfig.History = histories
 	stage.lastImageConfig.RootFS.DiffIDs = diffIDs
 	stage.lastImageConfig.ContainerConfiguration = nil
 	return nil
 }
 
+// baseHistory returns the history of the base image, or one entry per layer if
+// it's missing or doesn't match the layers.
+func baseHistory(node *buildNode, config *image.Config) []image.History {
+	var layers int
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			layers++
+		}
+	}
+	if layers == len(node.digestPairs) {
+		return append([]image.History(nil), config.History...)
+	}
+	histories := make([]image.History, 0)
+	for range node.digestPairs {
+		histories = append(histories, image.History{
+			Created:   config.Created,
+			CreatedBy: node.CreatedBy(),
+		})
+	}
+	return histories
+}
+
+// nodeHistory returns the history entries of a node: one per layer, or an
+// empty layer entry if it didn't commit any, like docker build does for
+// directives that only change the config.
+func nodeHistory(node *buildNode, created time.Time) []image.History {
+	if len(node.digestPairs) == 0 {
+		return []image.History{{
+			Created:    created,
+			CreatedBy:  node.CreatedBy(),
+			Author:     "makisu",
+			EmptyLayer: true,
+		}}
+	}
+	histories := make([]image.History, 0)
+	for range node.digestPairs {
+		histories = append(histories, image.History{
+			Created:   created,
+			CreatedBy: node.CreatedBy(),
+			Author:    "makisu",
+		})
+	}
+	return histories
+}
+
+// createdAt returns created if it's set, or the current time.
+func createdAt(created *time.Time) time.Time {
+	if created != nil {
+		return *created
+	}
+	return time.Now()
+}
+
 // GetDistributionManifest returns the distribution manifest produced at the end of the stage.
 func (stage *buildStage) GetDistributionManifest(
 	store *storage.ImageStore) (*image.DistributionManifest, error) {
@@ -219,21 +340,23 @@ func (stage *buildStage) GetDistributionManifest(
 	if err != nil {
 		return nil, fmt.Errorf("marshal image config: %s", err)
 	}
-	imageConfigDigester := sha256.New()
-	imageConfigDigester.Write(imageConfigJSON)
-	imageConfigSHA256 := hex.EncodeToString(imageConfigDigester.Sum(nil))
+	imageConfigDigest, err := image.NewDigester().FromBytes(imageConfigJSON)
+	if err != nil {
+		return nil, fmt.Errorf("digest image config: %s", err)
+	}
+	imageConfigHex := imageConfigDigest.Hex()
 
-	imageConfigPath := path.Join(stage.ctx.ImageStore.SandboxDir, imageConfigSHA256)
+	imageConfigPath := path.Join(stage.ctx.ImageStore.SandboxDir, imageConfigHex)
 	if err := ioutil.WriteFile(imageConfigPath, imageConfigJSON, 0755); err != nil {
 		return nil, fmt.Errorf("write image config: %s", err)
 	}
 	// If this is for a replica, image config might already exists in store.
 	// Ignore
-	err = store.Layers.LinkStoreFileFrom(imageConfigSHA256, imageConfigPath)
+	err = store.Layers.LinkStoreFileFrom(imageConfigHex, imageConfigPath)
 	if err != nil && !os.IsExist(err) {
 		return nil, fmt.Errorf("commit image config to store: %s", err)
 	}
-	imageConfigStat, err := store.Layers.GetStoreFileStat(imageConfigSHA256)
+	imageConfigStat, err := store.Layers.GetStoreFileStat(imageConfigHex)
 	if err != nil {
 		return nil, fmt.Errorf("get image config file stat: %s", err)
 	}
@@ -247,28 +370,34 @@ func (stage *buildStage) GetDistributionManifest(
 	distributionManifest.Config = image.Descriptor{
 		MediaType: image.MediaTypeConfig,
 		Size:      imageConfigStat.Size(),
-		Digest:    image.Digest("sha256:" + imageConfigSHA256),
+		Digest:    imageConfigDigest,
 	}
 
 	descriptors := []image.Descriptor{}
-	for _, node := range stage.nodes {
-		for _, digestPair := range node.digestPairs {
-			descriptors = append(descriptors, digestPair.GzipDescriptor)
-		}
+	for _, digestPair := range stage.layers() {
+		descriptors = append(descriptors, digestPair.GzipDescriptor)
 	}
 
 	distributionManifest.Layers = descriptors
 	return &distributionManifest, nil
 }
 
-// saveManifest saves the image produced at the end of this stage.
+// saveManifest saves the image produced at the end of this stage, with an OCI
+// manifest if it has annotations.
 func (stage *buildStage) saveManifest(
-	store *storage.ImageStore, imageName image.Name) (*image.DistributionManifest, error) {
+	store *storage.ImageStore, imageName image.Name,
+	annotations map[string]string) (*image.DistributionManifest, error) {
 
 	manifest, err := stage.GetDistributionManifest(store)
 	if err != nil {
 		return nil, fmt.Errorf("get distribution manifest: %s", err)
 	}
+	if len(annotations) != 0 {
+		// Docker manifests have no annotations.
+		oci := image.NewOCIManifestFromDistribution(*manifest)
+		oci.Annotations = annotations
+		manifest = &oci
+	}
 	manifestJSON, err := json.Marshal(manifest)
 	if err != nil {
 		return nil, fmt.Errorf("marshal manifest: %s", err)
@@ -301,10 +430,14 @@ func (stage *buildStage) pullCacheLayers(cacheMgr cache.Manager) {
 	// from cache because the step itself will pull the right layers when it
 	// gets executed.
 	if len(stage.nodes) > 1 {
-		for _, node := range stage.nodes[1:] {
+		for i, node := range stage.nodes[1:] {
 			// Stop once the cache chain is broken.
 			if node.HasCommit() || stage.opts.forceCommit {
-				if !node.pullCacheLayer(cacheMgr) {
+				start := time.Now()
+				pulled := node.pullCacheLayer(cacheMgr)
+				stage.ctx.Profile.RecordStep(profile.PhaseCachePull,
+					stage.alias, i+2, node.String(), start, node.size())
+				if !pulled {
 					return
 				}
 			}
@@ -312,6 +445,20 @@ func (stage *buildStage) pullCacheLayers(cacheMgr cache.Manager) {
 	}
 }
 
+// cacheIDs returns the cache IDs of the nodes that pullCacheLayers may pull
+// from the distributed cache.
+func (stage *buildStage) cacheIDs() []string {
+	var cacheIDs []string
+	if len(stage.nodes) > 1 {
+		for _, node := range stage.nodes[1:] {
+			if node.HasCommit() || stage.opts.forceCommit {
+				cacheIDs = append(cacheIDs, node.CacheID())
+			}
+		}
+	}
+	return cacheIDs
+}
+
 func (stage *buildStage) latestFetched() int {
 	latest := -1
 
@@ -148,3 +148,15 @@ func TestPullCacheLayers(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildNodeCacheStatus(t *testing.T) {
+	require := require.New(t)
+
+	node := &buildNode{}
+	require.Equal("miss", node.cacheStatus(&buildNodeOptions{}))
+	require.Equal("skipped", node.cacheStatus(&buildNodeOptions{skipBuild: true}))
+
+	node.digestPairs = []*image.DigestPair{_testDigestPair}
+	require.Equal("hit", node.cacheStatus(&buildNodeOptions{}))
+	require.Equal("skipped", node.cacheStatus(&buildNodeOptions{skipBuild: true}))
+}
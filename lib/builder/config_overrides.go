@@ -0,0 +1,104 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// ConfigOverrides replaces parts of the config of the image once its target
+// stage is built, without editing the dockerfile. Nil commands and empty
+// strings keep the values of the dockerfile.
+type ConfigOverrides struct {
+	Entrypoint []string
+	Cmd        []string
+	Env        map[string]string
+	User       string
+	WorkingDir string
+}
+
+// NewConfigOverrides parses the overrides of the config of the image.
+// Entrypoint and cmd are a JSON array, '[]' to clear them, or a command run by
+// /bin/sh -c like in dockerfiles. Envs are KEY=VALUE pairs, and the working dir
+// must be absolute.
+func NewConfigOverrides(
+	entrypoint, cmd string, envs []string, user, workingDir string) (*ConfigOverrides, error) {
+
+	o := &ConfigOverrides{
+		Entrypoint: parseCommand(entrypoint),
+		Cmd:        parseCommand(cmd),
+		User:       user,
+		WorkingDir: workingDir,
+	}
+	if len(envs) > 0 {
+		o.Env = make(map[string]string, len(envs))
+	}
+	for _, env := range envs {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid env %q, must be KEY=VALUE", env)
+		}
+		o.Env[kv[0]] = kv[1]
+	}
+	if workingDir != "" && !path.IsAbs(workingDir) {
+		return nil, fmt.Errorf("working dir %s is not absolute", workingDir)
+	}
+	return o, nil
+}
+
+// parseCommand parses an entrypoint or cmd like the dockerfile parser, and
+// returns nil if s is empty.
+func parseCommand(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var l []string
+	if err := json.NewDecoder(strings.NewReader(s)).Decode(&l); err == nil {
+		return l
+	}
+	return []string{"/bin/sh", "-c", s}
+}
+
+// IsZero returns true if nothing is overridden.
+func (o *ConfigOverrides) IsZero() bool {
+	return o.Entrypoint == nil && o.Cmd == nil && len(o.Env) == 0 &&
+		o.User == "" && o.WorkingDir == ""
+}
+
+// apply overrides the config of an image. Envs are merged with the ones of the
+// image like ENV steps.
+func (o *ConfigOverrides) apply(config *image.ContainerConfig) {
+	if o.Entrypoint != nil {
+		config.Entrypoint = o.Entrypoint
+	}
+	if o.Cmd != nil {
+		config.Cmd = o.Cmd
+	}
+	if len(o.Env) != 0 {
+		config.Env = utils.MergeEnv(config.Env, o.Env)
+	}
+	if o.User != "" {
+		config.User = o.User
+	}
+	if o.WorkingDir != "" {
+		config.WorkingDir = o.WorkingDir
+	}
+}
@@ -0,0 +1,70 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConfigOverrides(t *testing.T) {
+	require := require.New(t)
+
+	o, err := NewConfigOverrides("", "", nil, "", "")
+	require.NoError(err)
+	require.True(o.IsZero())
+
+	o, err = NewConfigOverrides(`["/app", "-v"]`, "[]", []string{"A=1", "B=x=y", "C="}, "app:app", "/srv")
+	require.NoError(err)
+	require.False(o.IsZero())
+	require.Equal([]string{"/app", "-v"}, o.Entrypoint)
+	require.NotNil(o.Cmd)
+	require.Empty(o.Cmd)
+	require.Equal(map[string]string{"A": "1", "B": "x=y", "C": ""}, o.Env)
+
+	o, err = NewConfigOverrides("", "echo $HOME", nil, "", "")
+	require.NoError(err)
+	require.Equal([]string{"/bin/sh", "-c", "echo $HOME"}, o.Cmd)
+
+	_, err = NewConfigOverrides("", "", []string{"A"}, "", "")
+	require.Error(err)
+	_, err = NewConfigOverrides("", "", []string{"=1"}, "", "")
+	require.Error(err)
+	_, err = NewConfigOverrides("", "", nil, "", "srv")
+	require.Error(err)
+}
+
+func TestConfigOverridesApply(t *testing.T) {
+	require := require.New(t)
+
+	config := &image.ContainerConfig{
+		Entrypoint: []string{"app"},
+		Cmd:        []string{"--help"},
+		Env:        []string{"PATH=/bin", "A=1"},
+		User:       "root",
+		WorkingDir: "/",
+	}
+	o, err := NewConfigOverrides("", "", []string{"A=2", "B=3"}, "", "/srv")
+	require.NoError(err)
+	o.apply(config)
+	require.Equal([]string{"app"}, config.Entrypoint)
+	require.Equal([]string{"--help"}, config.Cmd)
+	require.Equal([]string{"PATH=/bin", "A=2", "B=3"}, config.Env)
+	require.Equal("root", config.User)
+	require.Equal("/srv", config.WorkingDir)
+}
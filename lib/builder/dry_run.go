@@ -0,0 +1,293 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+
+	"github.com/pkg/errors"
+)
+
+// Statuses of the steps of a dry run.
+const (
+	// StepPull is the status of FROM steps, that pull their base image.
+	StepPull = "pull"
+	// StepCached is the status of steps whose layer is found in the cache.
+	StepCached = "cached"
+	// StepSkipped is the status of steps covered by the cached layer of a
+	// later step.
+	StepSkipped = "skipped"
+	// StepExecute is the status of steps that would be executed.
+	StepExecute = "execute"
+)
+
+// ImageResolver returns the digest and the manifest of a base image.
+type ImageResolver func(name image.Name) (image.Digest, *image.DistributionManifest, error)
+
+// PlannedStep is a step of a dry run.
+type PlannedStep struct {
+	Stage     string
+	Step      int
+	Directive string
+	CacheID   string
+	Status    string
+	// Commit is true if the step would commit a layer when executed.
+	Commit bool
+}
+
+// PlannedLayer is a layer of the image produced by a dry run. The digest of
+// layers committed by executed steps is unknown.
+type PlannedLayer struct {
+	Digest image.Digest
+	Size   int64
+	// Source is either "base", "cached" or "new".
+	Source string
+	// CreatedBy is the base image or the directive of the step that produces
+	// the layer.
+	CreatedBy string
+	// Push is true if the layer would be pushed. It's set by the caller, that
+	// knows the push registries.
+	Push bool
+
+	// node is the index of the node producing the layer in its stage.
+	node int
+}
+
+// BaseImage is a base image resolved by a dry run.
+type BaseImage struct {
+	Stage  string
+	Image  string
+	Digest image.Digest
+}
+
+// DryRunPlan describes what a build would do, as found without executing it.
+type DryRunPlan struct {
+	BaseImages []BaseImage
+	Steps      []PlannedStep
+	// Layers are the layers of the target stage.
+	Layers []PlannedLayer
+}
+
+// DryRun resolves the base images of the plan and looks up the cache IDs of
+// its steps, to find which steps would hit the cache and which layers the
+// image would have, without executing any step or writing any layer. The
+// cache lookups follow the same rules as Execute.
+func (plan *BuildPlan) DryRun(resolve ImageResolver) (*DryRunPlan, error) {
+	result := &DryRunPlan{}
+	target := plan.targetStage()
+	plan.prefetchCache()
+	for k, stage := range plan.stages {
+		lastStage := k == len(plan.stages)-1
+		layers, err := plan.dryRunStage(stage, lastStage, resolve, result)
+		if err != nil {
+			return nil, fmt.Errorf("dry run stage %s: %s", stage.alias, err)
+		}
+		if stage == target {
+			result.Layers = layers
+			break
+		}
+	}
+	if plan.squash.enabled {
+		result.Layers = squashPlannedLayers(result.Layers, plan.squash.fromStep)
+	}
+	return result, nil
+}
+
+// dryRunStage adds the base image and the steps of the stage to result, and
+// returns the layers of the image the stage would produce.
+func (plan *BuildPlan) dryRunStage(
+	stage *buildStage, lastStage bool, resolve ImageResolver,
+	result *DryRunPlan) ([]PlannedLayer, error) {
+
+	var layers []PlannedLayer
+	fromStep, ok := stage.nodes[0].BuildStep.(*step.FromStep)
+	if !ok {
+		return nil, fmt.Errorf("first step is not FROM")
+	}
+	if !strings.EqualFold(fromStep.GetImage(), image.Scratch) {
+		name, err := image.ParseNameForPull(fromStep.GetImage())
+		if err != nil {
+			return nil, fmt.Errorf("parse base image: %s", err)
+		}
+		digest, manifest, err := resolve(name)
+		if err != nil {
+			return nil, fmt.Errorf("resolve base image %s: %s", name, err)
+		}
+		result.BaseImages = append(result.BaseImages, BaseImage{
+			Stage:  stage.alias,
+			Image:  fromStep.GetImage(),
+			Digest: digest,
+		})
+		for _, descriptor := range manifest.Layers {
+			layers = append(layers, PlannedLayer{
+				Digest:    descriptor.Digest,
+				Size:      descriptor.Size,
+				Source:    "base",
+				CreatedBy: fromStep.GetImage(),
+				node:      0,
+			})
+		}
+	}
+	result.Steps = append(result.Steps, PlannedStep{
+		Stage:     stage.alias,
+		Step:      1,
+		Directive: stage.nodes[0].String(),
+		CacheID:   stage.nodes[0].CacheID(),
+		Status:    StepPull,
+	})
+
+	// Look up the cache like pullCacheLayers, then find the latest cached
+	// step like latestFetched.
+	hits := make(map[int]*image.DigestPair)
+	for i := 1; i < len(stage.nodes); i++ {
+		node := stage.nodes[i]
+		if !node.HasCommit() && !stage.opts.forceCommit {
+			continue
+		}
+		digestPair, err := plan.cacheMgr.LookupCache(node.CacheID())
+		if errors.Cause(err) == cache.ErrorLayerNotFound {
+			break
+		} else if err != nil {
+			log.Warnf("Failed to look up cache ID %s: %s", node.CacheID(), err)
+			break
+		}
+		hits[i] = digestPair
+	}
+	latest := -1
+	for i := 1; i < len(stage.nodes); i++ {
+		if stage.nodes[i].HasCommit() {
+			if hits[i] == nil {
+				break
+			}
+			latest = i
+		}
+	}
+
+	pending := false
+	for i := 1; i < len(stage.nodes); i++ {
+		node := stage.nodes[i]
+		lastStep := i == len(stage.nodes)-1
+		commit := node.HasCommit() || stage.opts.forceCommit || (lastStage && lastStep)
+		digestPair, cached := hits[i]
+
+		status := StepExecute
+		if cached {
+			status = StepCached
+		} else if i < latest {
+			status = StepSkipped
+		}
+		result.Steps = append(result.Steps, PlannedStep{
+			Stage:     stage.alias,
+			Step:      i + 1,
+			Directive: node.String(),
+			CacheID:   node.CacheID(),
+			Status:    status,
+			Commit:    status == StepExecute && commit,
+		})
+
+		switch status {
+		case StepCached:
+			pending = false
+			if digestPair != nil {
+				layers = append(layers, PlannedLayer{
+					Digest:    digestPair.GzipDescriptor.Digest,
+					Size:      digestPair.GzipDescriptor.Size,
+					Source:    "cached",
+					CreatedBy: node.String(),
+					node:      i,
+				})
+			}
+		case StepExecute:
+			pending = pending || producesLayer(node)
+			if commit && pending {
+				layers = append(layers, PlannedLayer{
+					Source:    "new",
+					CreatedBy: node.String(),
+					node:      i,
+				})
+				pending = false
+			}
+		}
+	}
+	return layers, nil
+}
+
+// squashPlannedLayers replaces the layers that squash would merge with a
+// single new layer.
+func squashPlannedLayers(layers []PlannedLayer, fromStep int) []PlannedLayer {
+	from := fromStep - 1
+	if from < 1 {
+		from = 1
+	}
+	var kept []PlannedLayer
+	var squashed int
+	for _, layer := range layers {
+		if layer.node < from {
+			kept = append(kept, layer)
+		} else {
+			squashed++
+		}
+	}
+	if squashed < 2 {
+		return layers
+	}
+	return append(kept, PlannedLayer{
+		Source:    "new",
+		CreatedBy: fmt.Sprintf("squash of %d layers", squashed),
+		node:      from,
+	})
+}
+
+// Write prints the plan as tables to w.
+func (p *DryRunPlan) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tBASE IMAGE\tDIGEST")
+	for _, base := range p.BaseImages {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", base.Stage, base.Image, base.Digest)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "STAGE\tSTEP\tSTATUS\tCOMMIT\tDIRECTIVE")
+	for _, s := range p.Steps {
+		commit := ""
+		if s.Commit {
+			commit = "yes"
+		}
+		// Directives end with their cache ID.
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", s.Stage, s.Step, s.Status, commit, s.Directive)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "LAYER\tSOURCE\tSIZE\tPUSH\tCREATED BY")
+	for _, layer := range p.Layers {
+		digest, size := "<unknown>", "-"
+		if layer.Digest != "" {
+			digest = string(layer.Digest)
+			size = fmt.Sprintf("%d", layer.Size)
+		}
+		push := ""
+		if layer.Push {
+			push = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", digest, layer.Source, size, push, layer.CreatedBy)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,120 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildPlanDryRun(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	stages := func(base string) []*dockerfile.Stage {
+		from := dockerfile.FromDirectiveFixture("", base, "")
+		directives := []dockerfile.Directive{
+			dockerfile.RunDirectiveFixture("ls .", "ls ."),
+			dockerfile.EnvDirectiveFixture("TESTENV=test", map[string]string{"TESTENV": "test"}),
+			dockerfile.RunDirectiveFixture("ls ..", "ls .."),
+		}
+		return []*dockerfile.Stage{{From: from, Directives: directives}}
+	}
+	noResolve := func(name image.Name) (image.Digest, *image.DistributionManifest, error) {
+		require.FailNow("unexpected resolve", name.String())
+		return "", nil, nil
+	}
+
+	// Nothing is cached yet.
+	kvStore := keyvalue.MockStore{}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages("scratch"), true, true, "")
+	require.NoError(err)
+	result, err := plan.DryRun(noResolve)
+	require.NoError(err)
+	require.Empty(result.BaseImages)
+	require.Len(result.Steps, 4)
+	require.Equal(StepPull, result.Steps[0].Status)
+	for _, s := range result.Steps[1:] {
+		require.Equal(StepExecute, s.Status)
+		require.True(s.Commit)
+	}
+	require.Len(result.Layers, 2)
+	for _, layer := range result.Layers {
+		require.Equal("new", layer.Source)
+		require.Empty(layer.Digest)
+	}
+	require.Empty(kvStore)
+
+	// Build the image, which fills the cache.
+	plan, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages("scratch"), true, true, "")
+	require.NoError(err)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(manifest.Layers, 2)
+
+	// All steps hit the cache now.
+	plan, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages("scratch"), true, true, "")
+	require.NoError(err)
+	result, err = plan.DryRun(noResolve)
+	require.NoError(err)
+	for _, s := range result.Steps[1:] {
+		require.Equal(StepCached, s.Status)
+		require.False(s.Commit)
+	}
+	require.Len(result.Layers, 2)
+	for i, layer := range result.Layers {
+		require.Equal("cached", layer.Source)
+		require.Equal(manifest.Layers[i].Digest, layer.Digest)
+	}
+
+	// Squash merges the cached layers into a new one.
+	plan.SetSquash(0)
+	result, err = plan.DryRun(noResolve)
+	require.NoError(err)
+	require.Len(result.Layers, 1)
+	require.Equal("new", result.Layers[0].Source)
+
+	// Base images are resolved, and their layers kept.
+	baseDigest := image.Digest("sha256:" + "0123456789012345678901234567890123456789012345678901234567890123")
+	baseLayer := image.Descriptor{
+		MediaType: image.MediaTypeLayer,
+		Size:      10,
+		Digest:    image.Digest("sha256:" + "3210987654321098765432109876543210987654321098765432109876543210"),
+	}
+	plan, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages("alpine:3.9"), true, true, "")
+	require.NoError(err)
+	result, err = plan.DryRun(func(name image.Name) (image.Digest, *image.DistributionManifest, error) {
+		require.Equal("library/alpine", name.GetRepository())
+		return baseDigest, &image.DistributionManifest{Layers: []image.Descriptor{baseLayer}}, nil
+	})
+	require.NoError(err)
+	require.Len(result.BaseImages, 1)
+	require.Equal(baseDigest, result.BaseImages[0].Digest)
+	require.Len(result.Layers, 3)
+	require.Equal("base", result.Layers[0].Source)
+	require.Equal(baseLayer.Digest, result.Layers[0].Digest)
+}
@@ -0,0 +1,98 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+)
+
+// checkHermetic returns an error listing the inputs of the stages that a
+// hermetic build cannot consume: base images and 'COPY --from' images that are
+// not pinned by digest, and ADD sources fetched from URLs. Image contexts are
+// checked like the images they replace.
+func checkHermetic(ctx *context.BuildContext, parsedStages dockerfile.Stages) error {
+	aliases := make(map[string]struct{})
+	for _, parsedStage := range parsedStages {
+		aliases[parsedStage.From.Alias] = struct{}{}
+	}
+
+	var violations []string
+	for i, parsedStage := range parsedStages {
+		stage := parsedStage.From.Alias
+		if stage == "" {
+			stage = strconv.Itoa(i)
+		}
+		if v := checkPinned(ctx, parsedStage.From.Image); v != "" {
+			violations = append(violations, fmt.Sprintf("stage %s: FROM %s", stage, v))
+		}
+		for _, directive := range parsedStage.Directives {
+			switch d := directive.(type) {
+			case *dockerfile.CopyDirective:
+				if _, ok := ctx.NamedContexts[d.FromStage]; ok || d.FromStage == "" {
+					continue
+				} else if _, ok := aliases[d.FromStage]; ok {
+					continue
+				} else if _, err := strconv.Atoi(d.FromStage); err == nil {
+					continue
+				}
+				if v := checkPinned(ctx, d.FromStage); v != "" {
+					violations = append(violations, fmt.Sprintf("stage %s: COPY --from=%s", stage, v))
+				}
+			case *dockerfile.AddDirective:
+				for _, src := range d.Srcs {
+					if isURL(src) {
+						violations = append(violations, fmt.Sprintf(
+							"stage %s: ADD %s fetches a URL, download it into the context "+
+								"and ADD or COPY it from there instead", stage, src))
+					}
+				}
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("hermetic build forbids undeclared inputs:\n  %s",
+			strings.Join(violations, "\n  "))
+	}
+	return nil
+}
+
+// checkPinned returns a description of the problem if img is not pinned by
+// digest, or an empty string if it is, or is scratch.
+func checkPinned(ctx *context.BuildContext, img string) string {
+	if named, ok := ctx.NamedImages[img]; ok {
+		img = named
+	}
+	if strings.EqualFold(img, image.Scratch) {
+		return ""
+	}
+	name, err := image.ParseNameForPull(img)
+	if err != nil {
+		return fmt.Sprintf("%s is not a valid image name: %s", img, err)
+	} else if !name.HasDigest() {
+		return fmt.Sprintf("%s is not pinned by digest, pin it as %s@sha256:<digest>", img, img)
+	}
+	return ""
+}
+
+// isURL returns true if the source of an ADD is a remote URL.
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/storage"
+)
+
+// ExportRootFS writes the root filesystem of the image described by manifest
+// to w as a single tarball, applying its layers from the store on top of each
+// other.
+func ExportRootFS(
+	store *storage.ImageStore, manifest *image.DistributionManifest, w io.Writer) error {
+
+	tw := tar.NewWriter(w)
+	if err := snapshot.FlattenLayers(layerOpeners(store, manifest), tw); err != nil {
+		return fmt.Errorf("flatten layers: %s", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("close tar writer: %s", err)
+	}
+	return nil
+}
+
+// AnalyzeImage returns the space used and wasted by the layers of the image
+// described by manifest, and its top largest files.
+func AnalyzeImage(
+	store *storage.ImageStore, manifest *image.DistributionManifest, top int) (*snapshot.LayerAnalysis, error) {
+
+	return snapshot.AnalyzeLayers(layerOpeners(store, manifest), top)
+}
+
+// CountImageFiles returns the number of files of each layer of the image
+// described by manifest.
+func CountImageFiles(store *storage.ImageStore, manifest *image.DistributionManifest) ([]int, error) {
+	openers := layerOpeners(store, manifest)
+	files := make([]int, len(openers))
+	for i, open := range openers {
+		n, err := snapshot.CountLayerFiles(open)
+		if err != nil {
+			return nil, fmt.Errorf("count files of layer %d: %s", i, err)
+		}
+		files[i] = n
+	}
+	return files, nil
+}
+
+// layerOpeners returns openers of the uncompressed layers of the image
+// described by manifest, from the store.
+func layerOpeners(
+	store *storage.ImageStore, manifest *image.DistributionManifest) []snapshot.LayerOpener {
+
+	openers := make([]snapshot.LayerOpener, len(manifest.Layers))
+	for i, descriptor := range manifest.Layers {
+		openers[i] = openLayer(store, &image.DigestPair{GzipDescriptor: descriptor})
+	}
+	return openers
+}
@@ -0,0 +1,70 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportRootFS(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "hello"), []byte("hello"), 0644))
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	from := dockerfile.FromDirectiveFixture("", "scratch", "")
+	directives := []dockerfile.Directive{
+		dockerfile.CopyDirectiveFixture("", "", "", []string{"hello"}, "/a"),
+		dockerfile.CopyDirectiveFixture("", "", "", []string{"hello"}, "/b"),
+	}
+	stages := []*dockerfile.Stage{{From: from, Directives: directives}}
+	plan, err := NewBuildPlan(ctx, target, nil, cacheMgr, stages, true, true, "")
+	require.NoError(err)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(manifest.Layers, 2)
+
+	var rootfs bytes.Buffer
+	require.NoError(ExportRootFS(ctx.ImageStore, manifest, &rootfs))
+	contents := make(map[string]string)
+	tr := tar.NewReader(&rootfs)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(err)
+		contents[hdr.Name] = string(content)
+	}
+	require.Equal(map[string]string{"a": "hello", "b": "hello"}, contents)
+}
@@ -0,0 +1,157 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+
+	"github.com/stretchr/testify/require"
+)
+
+// requireImageConfig returns the config of the image described by manifest,
+// checking that its diff IDs and history agree with the layers of the manifest.
+func requireImageConfig(
+	t *testing.T, ctx *context.BuildContext, manifest *image.DistributionManifest) *image.Config {
+
+	require := require.New(t)
+
+	manifestJSON, err := json.Marshal(manifest)
+	require.NoError(err)
+	require.Contains(string(manifestJSON), `"layers":[`)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	configJSON, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Contains(string(configJSON), `"diff_ids":[`)
+
+	config, err := image.NewImageConfigFromJSON(configJSON)
+	require.NoError(err)
+	require.Len(config.RootFS.DiffIDs, len(manifest.Layers))
+	var layers int
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			layers++
+		}
+	}
+	require.Equal(len(manifest.Layers), layers, "history entries with a layer")
+	return config
+}
+
+// requireLayerFiles returns the names of the files in each layer of the image
+// described by manifest.
+func requireLayerFiles(
+	t *testing.T, ctx *context.BuildContext, manifest *image.DistributionManifest) [][]string {
+
+	require := require.New(t)
+
+	var files [][]string
+	for _, descriptor := range manifest.Layers {
+		r, err := openLayer(ctx.ImageStore, &image.DigestPair{GzipDescriptor: descriptor})()
+		require.NoError(err)
+		var names []string
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			names = append(names, hdr.Name)
+		}
+		r.Close()
+		files = append(files, names)
+	}
+	return files
+}
+
+func TestBuildPlanScratch(t *testing.T) {
+	copyHello := func(dst string) dockerfile.Directive {
+		return dockerfile.CopyDirectiveFixture("", "", "", []string{"hello"}, dst)
+	}
+	env := dockerfile.EnvDirectiveFixture("A=b", map[string]string{"A": "b"})
+	tests := []struct {
+		name        string
+		directives  []dockerfile.Directive
+		forceCommit bool
+		layers      [][]string
+		history     int
+	}{
+		{"from only", nil, true, nil, 0},
+		{"config only", []dockerfile.Directive{
+			env,
+			dockerfile.LabelDirectiveFixture("x=y", map[string]string{"x": "y"}),
+			dockerfile.UserDirectiveFixture("65532", "65532"),
+		}, true, nil, 3},
+		{"copy", []dockerfile.Directive{
+			copyHello("/hello"),
+		}, true, [][]string{{"hello"}}, 1},
+		{"copy then config", []dockerfile.Directive{
+			copyHello("/hello"),
+			env,
+			dockerfile.EntrypointDirectiveFixture("[\"/hello\"]", []string{"/hello"}),
+			dockerfile.UserDirectiveFixture("65532", "65532"),
+		}, true, [][]string{{"hello"}}, 4},
+		{"workdir then copy", []dockerfile.Directive{
+			dockerfile.WorkdirDirectiveFixture("/app", "/app"),
+			copyHello("/app/hello"),
+		}, true, [][]string{{"app", "app/hello"}}, 2},
+		{"copies", []dockerfile.Directive{
+			copyHello("/a"),
+			copyHello("/b"),
+		}, true, [][]string{{"a"}, {"b"}}, 2},
+		{"copies explicit commit", []dockerfile.Directive{
+			copyHello("/a"),
+			copyHello("/b"),
+			env,
+		}, false, [][]string{{"a", "b"}}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require := require.New(t)
+
+			ctx, cleanup := context.BuildContextFixture()
+			defer cleanup()
+			require.NoError(ioutil.WriteFile(
+				filepath.Join(ctx.ContextDir, "hello"), []byte("hello"), 0644))
+
+			target := image.NewImageName("", "testrepo", "testtag")
+			cacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+			from := dockerfile.FromDirectiveFixture("", "scratch", "")
+			stages := []*dockerfile.Stage{{From: from, Directives: test.directives}}
+			plan, err := NewBuildPlan(
+				ctx, target, nil, cacheMgr, stages, true, test.forceCommit, "")
+			require.NoError(err)
+			manifest, err := plan.Execute()
+			require.NoError(err)
+
+			config := requireImageConfig(t, ctx, manifest)
+			require.Len(config.History, test.history)
+			require.Equal(test.layers, requireLayerFiles(t, ctx, manifest))
+		})
+	}
+}
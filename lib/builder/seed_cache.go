@@ -0,0 +1,138 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+// SeedCache replays the target stage of the plan against an existing image
+// that was built from the same dockerfile, and pushes the resulting cacheID to
+// layer mappings through the cache manager, without executing any step.
+// baseLayers is the number of layers the image inherited from the base image
+// of the target stage. Returns the number of cache entries pushed.
+func (plan *BuildPlan) SeedCache(
+	manifest *image.DistributionManifest, config *image.Config, baseLayers int) (int, error) {
+
+	stage := plan.targetStage()
+	lastStage := stage == plan.stages[len(plan.stages)-1]
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return 0, fmt.Errorf("layer digests and descriptors count doesn't match: %d != %d",
+			len(config.RootFS.DiffIDs), len(manifest.Layers))
+	} else if baseLayers > len(manifest.Layers) {
+		return 0, fmt.Errorf("image has fewer layers than its base image: %d < %d",
+			len(manifest.Layers), baseLayers)
+	}
+	histories := layerHistories(config)
+
+	// Walk the steps the same way they would be committed during a build: a
+	// commit following ADD/COPY/RUN produces the next layer of the image, any
+	// other commit produces an empty cache entry.
+	type cacheEntry struct {
+		node       *buildNode
+		digestPair *image.DigestPair
+	}
+	var entries []cacheEntry
+	next := baseLayers
+	pending := false
+	for i, node := range stage.nodes[1:] {
+		pending = pending || producesLayer(node)
+		lastStep := i == len(stage.nodes)-2
+		commit := node.HasCommit() || stage.opts.forceCommit
+		if !commit && !(lastStage && lastStep) {
+			continue
+		}
+
+		var digestPair *image.DigestPair
+		if pending {
+			if next >= len(manifest.Layers) {
+				return 0, fmt.Errorf("image has fewer layers than the dockerfile produces")
+			}
+			digestPair = &image.DigestPair{
+				TarDigest:      config.RootFS.DiffIDs[next],
+				GzipDescriptor: manifest.Layers[next],
+			}
+			if histories != nil && histories[next] != "" {
+				log.Infof("* Matched %s with layer created by: %s", node.String(), histories[next])
+			}
+			next++
+			pending = false
+		}
+		// The last step of the last stage always commits, but it only looks
+		// up the cache if it would commit in other positions as well.
+		if commit {
+			entries = append(entries, cacheEntry{node, digestPair})
+		}
+	}
+	if next != len(manifest.Layers) {
+		return 0, fmt.Errorf("image has %d layers on top of its base image, dockerfile produces %d",
+			len(manifest.Layers)-baseLayers, next-baseLayers)
+	}
+
+	for _, entry := range entries {
+		if entry.digestPair != nil {
+			log.Infof("* Seeding cache ID %s with layer %s",
+				entry.node.CacheID(), entry.digestPair.GzipDescriptor.Digest)
+		} else {
+			log.Infof("* Seeding cache ID %s with empty entry", entry.node.CacheID())
+		}
+		if err := plan.cacheMgr.PushCache(entry.node.CacheID(), entry.digestPair); err != nil {
+			return 0, fmt.Errorf("push cache: %s", err)
+		}
+	}
+	if err := plan.cacheMgr.WaitForPush(); err != nil {
+		return 0, fmt.Errorf("wait for cache push: %s", err)
+	}
+	return len(entries), nil
+}
+
+// targetStage returns the stage the plan builds towards.
+func (plan *BuildPlan) targetStage() *buildStage {
+	for _, stage := range plan.stages {
+		if plan.stageTarget != "" && stage.alias == plan.stageTarget {
+			return stage
+		}
+	}
+	return plan.stages[len(plan.stages)-1]
+}
+
+// producesLayer returns true if executing the node changes the filesystem.
+func producesLayer(node *buildNode) bool {
+	switch node.BuildStep.(type) {
+	case *step.RunStep, *step.AddStep, *step.CopyStep:
+		return true
+	}
+	return false
+}
+
+// layerHistories returns the CreatedBy field of the history entries that
+// produced a layer, indexed by layer. Returns nil if the history is missing or
+// inconsistent with the layers.
+func layerHistories(config *image.Config) []string {
+	var histories []string
+	for _, history := range config.History {
+		if !history.EmptyLayer {
+			histories = append(histories, history.CreatedBy)
+		}
+	}
+	if len(histories) != len(config.RootFS.DiffIDs) {
+		return nil
+	}
+	return histories
+}
@@ -0,0 +1,86 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+	"github.com/uber/makisu/lib/registry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildPlanSeedCache(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.NewImageName("", "testrepo", "testtag")
+	stages := func() []*dockerfile.Stage {
+		from := dockerfile.FromDirectiveFixture("", "scratch", "")
+		directives := []dockerfile.Directive{
+			dockerfile.RunDirectiveFixture("ls .", "ls ."),
+			dockerfile.EnvDirectiveFixture("TESTENV=test", map[string]string{"TESTENV": "test"}),
+			dockerfile.RunDirectiveFixture("ls ..", "ls .."),
+		}
+		return []*dockerfile.Stage{{From: from, Directives: directives}}
+	}
+
+	// Build the image without cache.
+	noopCacheMgr := cache.New(ctx.ImageStore, nil, registry.NoopClientFixture())
+	plan, err := NewBuildPlan(ctx, target, nil, noopCacheMgr, stages(), true, true, "")
+	require.NoError(err)
+	manifest, err := plan.Execute()
+	require.NoError(err)
+	require.Len(manifest.Layers, 2)
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(manifest.Config.Digest.Hex())
+	require.NoError(err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	var config image.Config
+	require.NoError(json.Unmarshal(b, &config))
+
+	// Seed the cache from the image.
+	kvStore := keyvalue.MockStore{}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+	plan, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages(), true, true, "")
+	require.NoError(err)
+	_, err = plan.SeedCache(manifest, &config, 1)
+	require.Error(err)
+	n, err := plan.SeedCache(manifest, &config, 0)
+	require.NoError(err)
+	require.Equal(3, n)
+	require.Len(kvStore, 3)
+
+	// A new build finds all of its layers in the cache.
+	plan, err = NewBuildPlan(ctx, target, nil, cacheMgr, stages(), true, true, "")
+	require.NoError(err)
+	stage := plan.stages[0]
+	stage.pullCacheLayers(cacheMgr)
+	require.Len(stage.nodes[1].digestPairs, 1)
+	require.Equal(manifest.Layers[0].Digest, stage.nodes[1].digestPairs[0].GzipDescriptor.Digest)
+	require.Len(stage.nodes[2].digestPairs, 0)
+	require.Len(stage.nodes[3].digestPairs, 1)
+	require.Equal(manifest.Layers[1].Digest, stage.nodes[3].digestPairs[0].GzipDescriptor.Digest)
+}
@@ -0,0 +1,140 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// squashedLayer is the layer replacing the layers of a stage from one of its
+// nodes onwards.
+type squashedLayer struct {
+	from       int
+	digestPair *image.DigestPair
+}
+
+// layerReadCloser closes both the decompressed reader and the layer file.
+type layerReadCloser struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (r layerReadCloser) Close() error {
+	r.ReadCloser.Close()
+	return r.file.Close()
+}
+
+// openLayer returns an opener of the uncompressed content of a layer.
+func openLayer(store *storage.ImageStore, digestPair *image.DigestPair) snapshot.LayerOpener {
+	return func() (io.ReadCloser, error) {
+		reader, err := store.Layers.GetStoreFileReader(digestPair.GzipDescriptor.Digest.Hex())
+		if err != nil {
+			return nil, fmt.Errorf("get reader from layer: %s", err)
+		}
+		decompressed, err := tario.NewDecompressReader(reader)
+		if err != nil {
+			reader.Close()
+			return nil, fmt.Errorf("create decompress reader for layer: %s", err)
+		}
+		return layerReadCloser{decompressed, reader}, nil
+	}
+}
+
+// squash merges the layers committed by the nodes of the stage from the given
+// step onwards into a single layer. Steps are numbered from 1, like in the
+// build logs, and the layers of the FROM step are always kept.
+// The image config keeps the history of the squashed steps as empty layers.
+func (stage *buildStage) squash(fromStep int, created *time.Time) error {
+	from := fromStep - 1
+	if from < 1 {
+		from = 1
+	}
+	var kept int
+	var digestPairs []*image.DigestPair
+	for i, node := range stage.nodes {
+		if i < from {
+			kept += len(node.digestPairs)
+		} else {
+			digestPairs = append(digestPairs, node.digestPairs...)
+		}
+	}
+	if len(digestPairs) < 2 {
+		log.Infof("* Skipping squash of stage %s, only %d layer(s) to squash",
+			stage.alias, len(digestPairs))
+		return nil
+	}
+
+	openers := make([]snapshot.LayerOpener, len(digestPairs))
+	for i, digestPair := range digestPairs {
+		openers[i] = openLayer(stage.ctx.ImageStore, digestPair)
+	}
+	digestPair, err := step.CommitTarLayer(stage.ctx, func(w *tar.Writer) error {
+		return snapshot.SquashLayers(openers, w)
+	})
+	if err != nil {
+		return fmt.Errorf("commit squashed layer: %s", err)
+	}
+	log.Infof("* Squashed %d layers of stage %s into %s",
+		len(digestPairs), stage.alias, digestPair.GzipDescriptor.Digest)
+
+	config := stage.lastImageConfig
+	// Keep the history up to the entry of the last kept layer.
+	var keptHistory, layers int
+	for keptHistory < len(config.History) && layers < kept {
+		if !config.History[keptHistory].EmptyLayer {
+			layers++
+		}
+		keptHistory++
+	}
+	histories := config.History[:keptHistory:keptHistory]
+	for _, h := range config.History[keptHistory:] {
+		h.EmptyLayer = true
+		histories = append(histories, h)
+	}
+	config.History = append(histories, image.History{
+		Created:   createdAt(created),
+		CreatedBy: fmt.Sprintf("makisu: squash steps %d-%d", from+1, len(stage.nodes)),
+		Author:    "makisu",
+		Comment:   fmt.Sprintf("squashed %d layers", len(digestPairs)),
+	})
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs[:kept:kept], digestPair.TarDigest)
+	stage.squashed = &squashedLayer{from: from, digestPair: digestPair}
+	return nil
+}
+
+// layers returns the layers of the image produced by the stage.
+func (stage *buildStage) layers() []*image.DigestPair {
+	var digestPairs []*image.DigestPair
+	for i, node := range stage.nodes {
+		if stage.squashed != nil && i >= stage.squashed.from {
+			break
+		}
+		digestPairs = append(digestPairs, node.digestPairs...)
+	}
+	if stage.squashed != nil {
+		digestPairs = append(digestPairs, stage.squashed.digestPair)
+	}
+	return digestPairs
+}
@@ -0,0 +1,122 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/tar"
+	"io"
+	"testing"
+
+	"github.com/uber/makisu/lib/builder/step"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSquash(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	parsedStage := &dockerfile.Stage{
+		From: dockerfile.FromDirectiveFixture("FROM alpine", "alpine", ""),
+		Directives: []dockerfile.Directive{
+			dockerfile.RunDirectiveFixture("ls", "ls"),
+			dockerfile.RunDirectiveFixture("ls", "ls"),
+			dockerfile.RunDirectiveFixture("ls", "ls"),
+		},
+	}
+	stage, err := newBuildStage(ctx, "alpine", "seed", parsedStage, &buildPlanOptions{})
+	require.NoError(err)
+
+	// Each step writes one file, the last one overwrites the file of the
+	// previous step.
+	config := image.NewDefaultImageConfig()
+	for i, name := range []string{"base", "a", "b", "b"} {
+		content := []byte(name + string(rune('0'+i)))
+		digestPair, err := step.CommitTarLayer(ctx, func(w *tar.Writer) error {
+			if err := w.WriteHeader(&tar.Header{
+				Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)),
+			}); err != nil {
+				return err
+			}
+			_, err := w.Write(content)
+			return err
+		})
+		require.NoError(err)
+		stage.nodes[i].digestPairs = []*image.DigestPair{digestPair}
+		config.History = append(config.History, image.History{CreatedBy: name})
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digestPair.TarDigest)
+	}
+	stage.lastImageConfig = &config
+
+	require.NoError(stage.squash(0, nil))
+
+	layers := stage.layers()
+	require.Len(layers, 2)
+	require.Equal(stage.nodes[0].digestPairs[0], layers[0])
+	require.Equal([]image.Digest{
+		layers[0].TarDigest, layers[1].TarDigest,
+	}, config.RootFS.DiffIDs)
+	require.Len(config.History, 5)
+	require.False(config.History[0].EmptyLayer)
+	for _, h := range config.History[1:4] {
+		require.True(h.EmptyLayer)
+	}
+	require.False(config.History[4].EmptyLayer)
+
+	r, err := openLayer(ctx.ImageStore, layers[1])()
+	require.NoError(err)
+	defer r.Close()
+	contents := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		content := make([]byte, hdr.Size)
+		_, err = io.ReadFull(tr, content)
+		require.NoError(err)
+		contents[hdr.Name] = string(content)
+	}
+	require.Equal(map[string]string{"a": "a1", "b": "b3"}, contents)
+}
+
+func TestSquashSingleLayer(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	parsedStage := &dockerfile.Stage{
+		From: dockerfile.FromDirectiveFixture("FROM alpine", "alpine", ""),
+		Directives: []dockerfile.Directive{
+			dockerfile.RunDirectiveFixture("ls", "ls"),
+		},
+	}
+	stage, err := newBuildStage(ctx, "alpine", "seed", parsedStage, &buildPlanOptions{})
+	require.NoError(err)
+	stage.nodes[0].digestPairs = []*image.DigestPair{_testDigestPair}
+	stage.nodes[1].digestPairs = []*image.DigestPair{_testDigestPair}
+
+	require.NoError(stage.squash(0, nil))
+	require.Nil(stage.squashed)
+	require.Len(stage.layers(), 2)
+}
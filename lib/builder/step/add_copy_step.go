@@ -16,15 +16,18 @@ package step
 
 import (
 	"fmt"
-	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/uber/makisu/lib/concurrency"
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 )
 
@@ -49,7 +52,8 @@ import (
 // - COPY dir1  /target/dir1/
 // - COPY dir1  /target/dir1  (same as prev)
 // - COPY dir1, dir2 ...   /tmp/dir1/
-// It also supports a "from" flag to specify a prev stage to copy files from.
+// It also supports a "from" flag to specify a prev stage or a named context to
+// copy files from.
 type addCopyStep struct {
 	*baseStep
 
@@ -87,6 +91,13 @@ func newAddCopyStep(
 // to read the users file to translate user/group name to uid/gid.
 func (s *addCopyStep) RequireOnDisk() bool { return s.chown != "" }
 
+// CreatedBy returns the description of the step in the history of the image,
+// with the sources and destination like docker build.
+func (s *addCopyStep) CreatedBy() string {
+	return fmt.Sprintf("/bin/sh -c #(nop) %s %s in %s ",
+		s.directive, strings.Join(s.fromPaths, " "), s.toPath)
+}
+
 // ContextDirs returns the stage and directories that a 'COPY --from=<stage>' depends on.
 func (s *addCopyStep) ContextDirs() (string, []string) {
 	if s.fromStage == "" {
@@ -101,12 +112,12 @@ func (s *addCopyStep) ContextDirs() (string, []string) {
 // identical.
 func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 	// Initialize the checksum with the seed, directive and args.
-	checksum := crc32.NewIEEE()
+	checksum := newCacheIDHash()
 	_, err := checksum.Write([]byte(seed + string(s.directive) + s.args))
 	if err != nil {
 		return fmt.Errorf("hash copy directive: %s", err)
 	}
-	if s.fromStage != "" {
+	if _, named := s.namedContext(ctx); s.fromStage != "" && !named {
 		// It is copying from a previous stage, rely on the fact that cache IDs
 		// are chained between stages.
 		// TODO: Properly calculate cache ID based on content of files.
@@ -115,8 +126,14 @@ func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 		if err := s.calculateContextChecksum(ctx, checksum); err != nil {
 			return fmt.Errorf("hash context sources: %s", err)
 		}
+		// The owner of the copied files depends on --context-chown.
+		if s.chown == "" && ctx.ContextChown != "" {
+			if _, err := checksum.Write([]byte("context-chown " + ctx.ContextChown)); err != nil {
+				return fmt.Errorf("hash context chown: %s", err)
+			}
+		}
 	}
-	s.cacheID = fmt.Sprintf("%x", checksum.Sum32())
+	s.cacheID = formatCacheID(checksum)
 
 	return nil
 }
@@ -126,6 +143,12 @@ func (s *addCopyStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 func (s *addCopyStep) Execute(ctx *context.BuildContext, modifyFS bool) (err error) {
 	sourceRoot := s.contextRootDir(ctx)
 	sources := s.resolveFromPaths(ctx)
+	var archives []string
+	if s.directive == Add && s.fromStage == "" {
+		if sources, archives, err = splitArchives(sources); err != nil {
+			return err
+		}
+	}
 	relPaths := make([]string, len(sources))
 	for i, source := range sources {
 		relPaths[i], err = pathutils.TrimRoot(source, sourceRoot)
@@ -134,37 +157,156 @@ func (s *addCopyStep) Execute(ctx *context.BuildContext, modifyFS bool) (err err
 		}
 	}
 
-	internal := s.fromStage != ""
-	blacklist := append(pathutils.DefaultBlacklist, ctx.ImageStore.RootDir)
-	copyOp, err := snapshot.NewCopyOperation(
-		relPaths, sourceRoot, s.workingDir, s.toPath, s.chown, blacklist, internal, s.preserveOwner)
-	if err != nil {
-		return fmt.Errorf("invalid copy operation: %s", err)
+	_, named := s.namedContext(ctx)
+	internal := s.fromStage != "" && !named
+	// Not appended in place, see context.NewBuildContext.
+	blacklist := append(append([]string{}, pathutils.DefaultBlacklist...), ctx.ImageStore.RootDir)
+	// Names are resolved against the files of the stage, which previous
+	// steps may have changed.
+	chown := s.chown
+	if chown != "" {
+		uid, gid, err := ctx.Users.ResolveChown(chown)
+		if err != nil {
+			return fmt.Errorf("resolve chown: %s", err)
+		}
+		chown = fmt.Sprintf("%d:%d", uid, gid)
+	}
+	// Files of contexts are owned by root, or by --context-chown, whatever
+	// their owner on the host is.
+	copyChown := chown
+	if copyChown == "" && !internal {
+		copyChown = ctx.ContextChown
+	}
+	var copyOps []*snapshot.CopyOperation
+	if len(relPaths) > 0 {
+		copyOp, err := snapshot.NewCopyOperation(relPaths, sourceRoot, s.workingDir, s.toPath,
+			copyChown, blacklist, internal, s.preserveOwner && copyChown == "")
+		if err != nil {
+			return fmt.Errorf("invalid copy operation: %s", err)
+		}
+		copyOps = append(copyOps, copyOp)
+	}
+	for _, archive := range archives {
+		copyOp, err := s.extractArchive(ctx, archive, chown)
+		if err != nil {
+			return err
+		}
+		copyOps = append(copyOps, copyOp)
 	}
 
-	ctx.CopyOps = append(ctx.CopyOps, copyOp)
+	ctx.CopyOps = append(ctx.CopyOps, copyOps...)
 	if modifyFS {
-		return copyOp.Execute()
+		for _, copyOp := range copyOps {
+			if err := copyOp.Execute(); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// splitArchives splits the sources of an ADD step into the local tar
+// archives, which are extracted into the destination like docker does, and
+// the other files, which are copied.
+func splitArchives(sources []string) ([]string, []string, error) {
+	var files, archives []string
+	for _, source := range sources {
+		fi, err := os.Stat(source)
+		if err != nil || !fi.Mode().IsRegular() {
+			// Missing sources fail when they are copied.
+			files = append(files, source)
+			continue
+		}
+		if ok, err := tario.IsArchive(source); err != nil {
+			return nil, nil, fmt.Errorf("check if %s is an archive: %s", source, err)
+		} else if ok {
+			archives = append(archives, source)
+		} else {
+			files = append(files, source)
+		}
+	}
+	return files, archives, nil
+}
+
+// extractArchive extracts an archive added by the step to a dir of the
+// sandbox, and returns the operation copying its content into the
+// destination, which is a directory even without a trailing slash. Entries
+// keep the owners of the archive unless --chown is set.
+func (s *addCopyStep) extractArchive(
+	ctx *context.BuildContext, archive, chown string) (*snapshot.CopyOperation, error) {
+
+	// Archives are at least as large once extracted.
+	size := int64(-1)
+	if info, err := os.Stat(archive); err == nil {
+		size = info.Size()
+	}
+	dir, err := ioutil.TempDir(ctx.ImageStore.TempDir(size), "add-")
+	if err != nil {
+		return nil, fmt.Errorf("create archive dir: %s", err)
+	}
+	log.Infof("* Extracting %s to %s", filepath.Base(archive), s.toPath)
+	if err := tario.ExtractArchive(archive, dir); err != nil {
+		return nil, err
+	}
+	copyOp, err := snapshot.NewCopyOperation(
+		[]string{"/"}, dir, s.workingDir, s.toPath, chown, nil, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid copy operation: %s", err)
+	}
+	return copyOp, nil
+}
+
 // Updates the checksum passed in based on the content of files to be copied in.
+// Files are hashed in parallel, and their hashes are written to the checksum in
+// walk order.
 func (s *addCopyStep) calculateContextChecksum(ctx *context.BuildContext, checksum io.Writer) error {
-	if s.fromStage != "" {
+	if _, named := s.namedContext(ctx); s.fromStage != "" && !named {
 		return fmt.Errorf("not supported: the copy step has from stage flag")
 	}
 
+	root := s.contextRootDir(ctx)
+	var entries []*contextEntry
 	for _, source := range s.resolveFromPaths(ctx) {
 		if err := filepath.Walk(source, func(path string, fi os.FileInfo, err error) error {
 			if err != nil {
 				return fmt.Errorf("prev error during walk: %s", err)
 			}
-			return checksumPathContents(ctx, path, fi, checksum)
+			entry, err := newContextEntry(root, path, fi)
+			if entry != nil {
+				entries = append(entries, entry)
+			}
+			return err
 		}); err != nil {
 			return fmt.Errorf("walk %s: %s", source, err)
 		}
 	}
+
+	multiError := utils.NewMultiErrors()
+	workers := concurrency.NewWorkerPool(snapshot.ScanConcurrency)
+	for _, entry := range entries {
+		if entry.file == "" {
+			continue
+		}
+		entry := entry
+		workers.Do(func() {
+			if err := entry.hashFile(); err != nil {
+				multiError.Add(err)
+				workers.Stop()
+			}
+		})
+	}
+	workers.Wait()
+	if err := multiError.Collect(); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, err := checksum.Write([]byte(entry.path)); err != nil {
+			return fmt.Errorf("write path to checksum: %v", err)
+		} else if _, err := checksum.Write(entry.content); err != nil {
+			return fmt.Errorf("write content of %s to checksum: %v", entry.path, err)
+		}
+	}
 	return nil
 }
 
@@ -183,56 +325,85 @@ func (s *addCopyStep) resolveFromPaths(ctx *context.BuildContext) []string {
 	return sources
 }
 
+// namedContext returns the dir of the named context the step copies from, if
+// any.
+func (s *addCopyStep) namedContext(ctx *context.BuildContext) (string, bool) {
+	if s.fromStage == "" {
+		return "", false
+	}
+	dir, ok := ctx.NamedContexts[s.fromStage]
+	return dir, ok
+}
+
 func (s *addCopyStep) contextRootDir(ctx *context.BuildContext) string {
-	if s.fromStage != "" {
+	if dir, ok := s.namedContext(ctx); ok {
+		return dir
+	} else if s.fromStage != "" {
 		return ctx.CopyFromRoot(s.fromStage)
 	}
 	return ctx.ContextDir
 }
 
+// contextEntry is a path of the context hashed into the cache ID of a step.
+type contextEntry struct {
+	path string
+	// file is set for regular files, whose content is hashed by hashFile.
+	file string
+	// content is the symlink target, or the hash of the file content.
+	content []byte
+}
+
+// newContextEntry returns the entry of a walked path, or nil if the path is
+// skipped.
 // TODO: Consider file metadata?
-func checksumPathContents(
-	ctx *context.BuildContext, path string, fi os.FileInfo, checksum io.Writer) error {
+func newContextEntry(root, path string, fi os.FileInfo) (*contextEntry, error) {
 
 	// Skip special files.
 	if utils.IsSpecialFile(fi) {
 		if fi.IsDir() {
-			return filepath.SkipDir
+			return nil, filepath.SkipDir
 		}
-		return nil
+		return nil, nil
 	}
 
-	trimmedPath, err := filepath.Rel(ctx.ContextDir, path)
+	trimmedPath, err := filepath.Rel(root, path)
 	if err != nil {
-		return fmt.Errorf("write path is outside of context dir (%s,%s): %v",
-			ctx.ContextDir, path, err)
-	}
-
-	if _, err := checksum.Write([]byte(trimmedPath)); err != nil {
-		return fmt.Errorf("write path to checksum: %v", err)
+		return nil, fmt.Errorf("write path is outside of context dir (%s,%s): %v",
+			root, path, err)
 	}
+	entry := &contextEntry{path: trimmedPath}
 
 	// If it is a directory, just return after checksumming the dir name.
 	if fi.IsDir() {
-		return nil
+		return entry, nil
 	}
 
 	// If it's a symlink, don't follow.
 	if fi.Mode()&os.ModeSymlink != 0 {
 		target, err := os.Readlink(path)
 		if err != nil {
-			return fmt.Errorf("read link %s: %s", path, err)
+			return nil, fmt.Errorf("read link %s: %s", path, err)
 		}
-		_, err = checksum.Write([]byte(target))
-		return err
+		entry.content = []byte(target)
+		return entry, nil
 	}
+	entry.file = path
+	return entry, nil
+}
 
-	fh, err := os.Open(path)
+// hashFile hashes the content of the file with xxhash, which is much faster
+// than cryptographic hashes, unless FIPS is set. Cache IDs only need to change
+// with the content, they aren't trusted.
+func (e *contextEntry) hashFile() error {
+	fh, err := os.Open(e.file)
 	if err != nil {
-		return fmt.Errorf("open %s: %s", path, err)
+		return fmt.Errorf("open %s: %s", e.file, err)
 	}
-	if _, err := io.Copy(checksum, fh); err != nil {
-		return fmt.Errorf("read %s: %s", path, err)
+	defer fh.Close()
+	h := newContentHash()
+	if _, err := io.Copy(h, fh); err != nil {
+		return fmt.Errorf("read %s: %s", e.file, err)
 	}
+	e.content = h.Sum(nil)
 	return nil
 }
@@ -15,8 +15,16 @@
 package step
 
 import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/tario"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -54,3 +62,88 @@ func TestTrimmingPaths(t *testing.T) {
 	require.Equal("/from/path", ac.fromPaths[0])
 	require.Equal("/to/path", ac.toPath)
 }
+
+func TestAddStepExtractsArchives(t *testing.T) {
+	// layerFiles commits the step, and returns the content of the regular
+	// files of its layer.
+	layerFiles := func(t *testing.T, ctx *context.BuildContext, step BuildStep) map[string]string {
+		require := require.New(t)
+		require.NoError(step.Execute(ctx, false))
+		digestPairs, err := step.Commit(ctx)
+		require.NoError(err)
+		require.Len(digestPairs, 1)
+
+		r, err := ctx.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+		require.NoError(err)
+		defer r.Close()
+		gzipReader, err := tario.NewGzipReader(r)
+		require.NoError(err)
+		defer gzipReader.Close()
+		files := make(map[string]string)
+		tr := tar.NewReader(gzipReader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return files
+			}
+			require.NoError(err)
+			if hdr.Typeflag == tar.TypeReg {
+				content, err := ioutil.ReadAll(tr)
+				require.NoError(err)
+				files[hdr.Name] = string(content)
+			}
+		}
+	}
+
+	writeSources := func(t *testing.T, ctx *context.BuildContext) {
+		require := require.New(t)
+		f, err := os.Create(filepath.Join(ctx.ContextDir, "archive.tar.gz"))
+		require.NoError(err)
+		defer f.Close()
+		gw, err := tario.NewGzipWriter(f)
+		require.NoError(err)
+		tw := tar.NewWriter(gw)
+		for _, name := range []string{"dir/a", ".wh.b"} {
+			require.NoError(tw.WriteHeader(&tar.Header{
+				Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 3,
+				Uid: os.Getuid(), Gid: os.Getgid()}))
+			_, err = tw.Write([]byte("foo"))
+			require.NoError(err)
+		}
+		require.NoError(tw.Close())
+		require.NoError(gw.Close())
+		require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("bar"), 0644))
+	}
+
+	t.Run("Add", func(t *testing.T) {
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+		writeSources(t, ctx)
+
+		step := AddStepFixtureNoChown("", []string{"archive.tar.gz", "file"}, "/out/", true, false)
+		require.Equal(t, map[string]string{
+			"out/dir/a": "foo",
+			"out/file":  "bar",
+		}, layerFiles(t, ctx, step))
+	})
+
+	t.Run("AddWithoutTrailingSlash", func(t *testing.T) {
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+		writeSources(t, ctx)
+
+		step := AddStepFixtureNoChown("", []string{"archive.tar.gz"}, "/out", true, false)
+		require.Equal(t, map[string]string{"out/dir/a": "foo"}, layerFiles(t, ctx, step))
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		ctx, cleanup := context.BuildContextFixture()
+		defer cleanup()
+		writeSources(t, ctx)
+
+		step := CopyStepFixtureNoChown("", "", []string{"archive.tar.gz"}, "/out/", true, false)
+		files := layerFiles(t, ctx, step)
+		require.Len(t, files, 1)
+		require.Contains(t, files, "out/archive.tar.gz")
+	})
+}
@@ -16,7 +16,6 @@ package step
 
 import (
 	"fmt"
-	"hash/crc32"
 	"os"
 	"strconv"
 
@@ -57,12 +56,18 @@ func (s *baseStep) String() string {
 	return fmt.Sprintf("%s %s %s (%s)", s.directive, s.args, commitStr, s.cacheID)
 }
 
+// CreatedBy returns the description of the step in the history of the image.
+// Steps that only change the image config are marked with #(nop), like in
+// docker build.
+func (s *baseStep) CreatedBy() string {
+	return fmt.Sprintf("/bin/sh -c #(nop)  %s %s", s.directive, s.args)
+}
+
 // SetCacheID sets the cache ID of the step given a seed SHA256 value.
 // Special steps like FROM, ADD, COPY have their own implementations.
 func (s *baseStep) SetCacheID(ctx *context.BuildContext, seed string) error {
 	commitStr := fmt.Sprintf("%v", s.commit)
-	checksum := crc32.ChecksumIEEE([]byte(seed + string(s.directive) + s.args + commitStr))
-	s.cacheID = fmt.Sprintf("%x", checksum)
+	s.cacheID = CacheIDFromString(seed + string(s.directive) + s.args + commitStr)
 	return nil
 }
 
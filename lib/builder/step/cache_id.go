@@ -0,0 +1,62 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// FIPS makes cache IDs be computed with SHA-256, a FIPS 140 approved
+// algorithm, instead of CRC32 and xxhash. Cache IDs computed in either mode
+// differ, so switching mode misses the cache once.
+var FIPS bool
+
+// newCacheIDHash returns the hash the cache IDs of steps are computed with.
+func newCacheIDHash() hash.Hash {
+	if FIPS {
+		return sha256.New()
+	}
+	return crc32.NewIEEE()
+}
+
+// newContentHash returns the hash the content of context files is hashed
+// with, before being added to cache IDs.
+func newContentHash() hash.Hash {
+	if FIPS {
+		return sha256.New()
+	}
+	return xxhash.New()
+}
+
+// formatCacheID returns the cache ID of the content written to h, a hash
+// returned by newCacheIDHash.
+func formatCacheID(h hash.Hash) string {
+	if h32, ok := h.(hash.Hash32); ok {
+		return fmt.Sprintf("%x", h32.Sum32())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// CacheIDFromString returns the cache ID of s.
+func CacheIDFromString(s string) string {
+	h := newCacheIDHash()
+	h.Write([]byte(s))
+	return formatCacheID(h)
+}
@@ -0,0 +1,60 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheIDFromString(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("352441c2", CacheIDFromString("abc"))
+
+	FIPS = true
+	defer func() { FIPS = false }()
+	require.Equal(
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		CacheIDFromString("abc"))
+}
+
+func TestCopyStepSetCacheIDFIPS(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("content"), 0644))
+	step := CopyStepFixture("", "", []string{"file"}, "/file", false, false)
+	require.NoError(step.SetCacheID(ctx, ""))
+	crcID := step.CacheID()
+
+	FIPS = true
+	defer func() { FIPS = false }()
+	require.NoError(step.SetCacheID(ctx, ""))
+	require.Len(step.CacheID(), 64)
+	require.NotEqual(crcID, step.CacheID())
+
+	// The content of files is still hashed into the cache ID.
+	id := step.CacheID()
+	require.NoError(ioutil.WriteFile(filepath.Join(ctx.ContextDir, "file"), []byte("changed"), 0644))
+	require.NoError(step.SetCacheID(ctx, ""))
+	require.NotEqual(id, step.CacheID())
+}
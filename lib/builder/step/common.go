@@ -16,23 +16,32 @@ package step
 
 import (
 	"archive/tar"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"hash"
+	"io"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/failure"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/profile"
+	"github.com/uber/makisu/lib/secrets"
 	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/stream"
 	"github.com/uber/makisu/lib/tario"
 )
 
 // tarAndGzipDiffs tars and gzips files to a temporary location.
+// The tarball is also written to tarSink if not nil, and the compressed content
+// to the given sinks, as they're produced.
 // It returns two digesters and the temporary file name.
-func tarAndGzipDiffs(ctx *context.BuildContext, writeDiffs func(*tar.Writer) error) (
+func tarAndGzipDiffs(
+	ctx *context.BuildContext, writeDiffs func(*tar.Writer) error, tarSink io.Writer,
+	sinks ...io.Writer) (
 	gzipDigester hash.Hash, tarDigester hash.Hash, name string, err error) {
 
 	tempGzipTar, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "layertar-")
@@ -41,17 +50,22 @@ func tarAndGzipDiffs(ctx *context.BuildContext, writeDiffs func(*tar.Writer) err
 	}
 	defer tempGzipTar.Close()
 
-	gzipDigester = sha256.New()
-	tarDigester = sha256.New()
+	gzipDigester = image.DigestAlgorithm().New()
+	tarDigester = image.DigestAlgorithm().New()
 
-	gzipMulti := stream.NewConcurrentMultiWriter(tempGzipTar, gzipDigester)
-	gzipper, err := tario.NewGzipWriter(gzipMulti)
+	gzipMulti := stream.NewConcurrentMultiWriter(
+		append([]io.Writer{tempGzipTar, gzipDigester}, sinks...)...)
+	gzipper, err := tario.NewCompressWriter(gzipMulti)
 	if err != nil {
-		return nil, nil, "", fmt.Errorf("new gzip writer: %s", err)
+		return nil, nil, "", fmt.Errorf("new compress writer: %s", err)
 	}
 	defer gzipper.Close()
 
-	multiWriter := stream.NewConcurrentMultiWriter(tarDigester, gzipper)
+	tarWriters := []io.Writer{tarDigester, gzipper}
+	if tarSink != nil {
+		tarWriters = append(tarWriters, tarSink)
+	}
+	multiWriter := stream.NewConcurrentMultiWriter(tarWriters...)
 	tarWriter := tar.NewWriter(multiWriter)
 	defer tarWriter.Close()
 
@@ -62,12 +76,124 @@ func tarAndGzipDiffs(ctx *context.BuildContext, writeDiffs func(*tar.Writer) err
 	return gzipDigester, tarDigester, tempGzipTar.Name(), nil
 }
 
+// tarAndEstargzDiffs tars files and converts them to an eStargz layer in a
+// temporary location. The tarball is streamed to the conversion through a
+// pipe, so it's never stored on disk.
+// The tarball is also written to tarSink if not nil, and the compressed content
+// to the given sinks, as they're produced.
+// It returns two digesters, the eStargz file name and the annotations of the
+// layer descriptor.
+func tarAndEstargzDiffs(
+	ctx *context.BuildContext, writeDiffs func(*tar.Writer) error, tarSink io.Writer,
+	sinks ...io.Writer) (
+	gzipDigester hash.Hash, tarDigester hash.Hash, name string,
+	annotations map[string]string, err error) {
+
+	tempEstargz, err := ioutil.TempFile(ctx.ImageStore.SandboxDir, "layerestargz-")
+	if err != nil {
+		return nil, nil, "", nil, fmt.Errorf("temp estargz file: %s", err)
+	}
+	defer tempEstargz.Close()
+
+	pipeReader, pw := io.Pipe()
+	var pr io.Reader = pipeReader
+	if tarSink != nil {
+		pr = io.TeeReader(pipeReader, tarSink)
+	}
+	writeErr := make(chan error, 1)
+	go func() {
+		tarWriter := tar.NewWriter(pw)
+		err := writeDiffs(tarWriter)
+		if err == nil {
+			err = tarWriter.Close()
+		}
+		pw.CloseWithError(err)
+		writeErr <- err
+	}()
+
+	gzipDigester = image.DigestAlgorithm().New()
+	tarDigester = image.DigestAlgorithm().New()
+	annotations, err = tario.WriteEstargz(
+		tar.NewReader(pr),
+		io.MultiWriter(append([]io.Writer{tempEstargz, gzipDigester}, sinks...)...),
+		tarDigester)
+	if err == nil {
+		// Drain the end of the tarball, which the tar reader doesn't need.
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	// Unblock the writer if conversion failed.
+	pipeReader.CloseWithError(err)
+	if werr := <-writeErr; werr != nil {
+		return nil, nil, "", nil, fmt.Errorf("write diffs: %s", werr)
+	} else if err != nil {
+		return nil, nil, "", nil, fmt.Errorf("write estargz: %s", err)
+	}
+	return gzipDigester, tarDigester, tempEstargz.Name(), annotations, nil
+}
+
+// layerStreamWriter forwards layer content to a context.LayerStream on a best
+// effort basis: failures are logged and never fail the commit, since the
+// layer is pushed from the local store later anyway.
+type layerStreamWriter struct {
+	stream context.LayerStream
+	err    error
+}
+
+// startLayerStream returns a new layerStreamWriter, or nil if the context
+// doesn't stream layers or the stream could not be started.
+func startLayerStream(ctx *context.BuildContext) *layerStreamWriter {
+	if ctx.StartLayerStream == nil {
+		return nil
+	}
+	s, err := ctx.StartLayerStream()
+	if err != nil {
+		log.Warnf("Failed to start streaming layer: %s", err)
+		return nil
+	}
+	return &layerStreamWriter{stream: s}
+}
+
+// Write implements io.Writer. It never fails, and stops forwarding content
+// after the first error.
+func (w *layerStreamWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.stream.Write(p)
+	}
+	return len(p), nil
+}
+
+// finish commits the stream with the digest of the layer, or cancels it if
+// the layer could not be written.
+func (w *layerStreamWriter) finish(digest image.Digest, err error) {
+	if err == nil {
+		err = w.err
+	}
+	if err != nil {
+		log.Warnf("Failed to stream layer: %s", err)
+		w.stream.Cancel()
+		return
+	}
+	if err := w.stream.Commit(digest); err != nil {
+		log.Warnf("Failed to commit streamed layer %s: %s", digest, err)
+	}
+}
+
 // commitLayer commits a layer by either scan or copy operations, depending on
 // the context.
 func commitLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
 	var writeDiffs func(w *tar.Writer) error
 	if ctx.MustScan {
-		writeDiffs = ctx.MemFS.AddLayerByScan
+		if len(ctx.CopyOps) > 0 {
+			// Copies aren't run in overlays, so only a full scan finds them.
+			ctx.MemFS.ResetOverlayChanges()
+		}
+		excludes := append(append([]string{}, ctx.Excludes...), ctx.ScanExcludes...)
+		writeDiffs = func(w *tar.Writer) error {
+			// The scan writes the changed files to the layer as it finds
+			// them, so this includes the time spent compressing them.
+			defer ctx.Profile.Record(profile.PhaseScan, time.Now(), 0)
+			return ctx.MemFS.AddLayerByScanExcluding(excludes, w)
+		}
 	} else if len(ctx.CopyOps) > 0 {
 		writeDiffs = func(w *tar.Writer) error {
 			return ctx.MemFS.AddLayerByCopyOps(ctx.CopyOps, w)
@@ -77,35 +203,108 @@ func commitLayer(ctx *context.BuildContext) ([]*image.DigestPair, error) {
 		return nil, nil
 	}
 
-	gzipTarDigester, tarDigester, tempFileName, err := tarAndGzipDiffs(ctx, writeDiffs)
+	var secretScanner *secrets.TarScanner
+	var tarSink io.Writer
+	if ctx.Secrets != nil {
+		secretScanner = ctx.Secrets.NewTarScanner()
+		tarSink = secretScanner
+	}
+	digestPair, err := commitTarLayer(ctx, writeDiffs, tarSink)
+	if secretScanner != nil {
+		if serr := checkSecrets(ctx, secretScanner); err == nil && serr != nil {
+			err = serr
+		}
+	}
 	if err != nil {
+		return nil, err
+	}
+	ctx.MustScan = false
+	ctx.ScanExcludes = nil
+	ctx.CopyOps = make([]*snapshot.CopyOperation, 0)
+	return []*image.DigestPair{digestPair}, nil
+}
+
+// checkSecrets waits for the secrets found in a committed layer, and fails
+// unless the detector only warns about them.
+func checkSecrets(ctx *context.BuildContext, scanner *secrets.TarScanner) error {
+	findings, err := scanner.Close()
+	if err != nil {
+		return fmt.Errorf("detect secrets: %s", err)
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+	for _, f := range findings {
+		log.Warnf("* Found secret %s", f)
+	}
+	if ctx.Secrets.WarnOnly {
+		log.Warnf("Found %d secrets in layer", len(findings))
+		return nil
+	}
+	ctx.Failure.SetKind(failure.KindSecret)
+	return fmt.Errorf("found %d secrets in layer, first at %s", len(findings), findings[0])
+}
+
+// CommitTarLayer compresses the tarball written by writeDiffs with the
+// configured format, and moves it into the layer store.
+func CommitTarLayer(
+	ctx *context.BuildContext, writeDiffs func(*tar.Writer) error) (*image.DigestPair, error) {
+
+	return commitTarLayer(ctx, writeDiffs, nil)
+}
+
+// commitTarLayer is CommitTarLayer, also writing the tarball to tarSink if not
+// nil.
+func commitTarLayer(
+	ctx *context.BuildContext, writeDiffs func(*tar.Writer) error,
+	tarSink io.Writer) (*image.DigestPair, error) {
+
+	var sinks []io.Writer
+	layerStream := startLayerStream(ctx)
+	if layerStream != nil {
+		sinks = append(sinks, layerStream)
+	}
+
+	var gzipTarDigester, tarDigester hash.Hash
+	var tempFileName string
+	var annotations map[string]string
+	var err error
+	if tario.CompressionFormat == tario.CompressionEstargz {
+		gzipTarDigester, tarDigester, tempFileName, annotations, err = tarAndEstargzDiffs(ctx, writeDiffs, tarSink, sinks...)
+	} else {
+		gzipTarDigester, tarDigester, tempFileName, err = tarAndGzipDiffs(ctx, writeDiffs, tarSink, sinks...)
+	}
+	if err != nil {
+		if layerStream != nil {
+			layerStream.finish("", err)
+		}
 		return nil, fmt.Errorf("failed to generate diff layer: %s", err)
 	}
 	defer os.Remove(tempFileName)
 
-	tarSHA256 := hex.EncodeToString(tarDigester.Sum(nil))
-	gzipTarSHA256 := hex.EncodeToString(gzipTarDigester.Sum(nil))
+	layerTarDigest := image.NewDigest(image.DigestAlgorithm(), tarDigester)
+	gzipTarDigest := image.NewDigest(image.DigestAlgorithm(), gzipTarDigester)
+	if layerStream != nil {
+		layerStream.finish(gzipTarDigest, nil)
+	}
 	if err := ctx.ImageStore.Layers.LinkStoreFileFrom(
-		gzipTarSHA256, tempFileName); err != nil && !os.IsExist(err) {
-		return nil, fmt.Errorf("link store file %s from %s: %s", gzipTarSHA256, tempFileName, err)
+		gzipTarDigest.Hex(), tempFileName); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("link store file %s from %s: %s", gzipTarDigest.Hex(), tempFileName, err)
 	}
-	info, err := ctx.ImageStore.Layers.GetStoreFileStat(gzipTarSHA256)
+	info, err := ctx.ImageStore.Layers.GetStoreFileStat(gzipTarDigest.Hex())
 	if err != nil {
-		return nil, fmt.Errorf("get store file stat %s: %s", gzipTarSHA256, err)
+		return nil, fmt.Errorf("get store file stat %s: %s", gzipTarDigest.Hex(), err)
 	}
+	storage.AddWritten(storage.SpacePhaseCommit, info.Size())
 
-	layerTarDigest := image.Digest("sha256:" + tarSHA256)
 	layerGzipDescriptor := image.Descriptor{
-		MediaType: image.MediaTypeLayer,
-		Size:      info.Size(),
-		Digest:    image.Digest("sha256:" + gzipTarSHA256),
+		MediaType:   tario.LayerMediaType(tario.CompressionFormat),
+		Size:        info.Size(),
+		Digest:      gzipTarDigest,
+		Annotations: annotations,
 	}
-	ctx.MustScan = false
-	ctx.CopyOps = make([]*snapshot.CopyOperation, 0)
-	return []*image.DigestPair{
-		{
-			TarDigest:      layerTarDigest,
-			GzipDescriptor: layerGzipDescriptor,
-		},
+	return &image.DigestPair{
+		TarDigest:      layerTarDigest,
+		GzipDescriptor: layerGzipDescriptor,
 	}, nil
 }
@@ -16,6 +16,7 @@ package step
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -27,6 +28,7 @@ import (
 	"time"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/snapshot"
 	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/tario"
 
@@ -148,6 +150,29 @@ func TestCopyStepSetCacheID(t *testing.T) {
 		require.NotEqual(hash1, step.CacheID())
 	})
 
+	t.Run("ScanConcurrency", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+		defer snapshot.SetScanConcurrency(snapshot.ScanConcurrency)
+
+		for i := 0; i < 20; i++ {
+			require.NoError(ioutil.WriteFile(
+				filepath.Join(context.ContextDir, fmt.Sprintf("file%d", i)), []byte{byte(i)}, 0644))
+		}
+
+		step := CopyStepFixture("", "", []string{"."}, "tmp", false, false)
+		var hashes []string
+		for _, concurrency := range []int{1, 8} {
+			require.NoError(snapshot.SetScanConcurrency(concurrency))
+			require.NoError(step.SetCacheID(context, "seed"))
+			hashes = append(hashes, step.CacheID())
+		}
+
+		// Files are hashed in parallel, but added to the cache ID in order.
+		require.Equal(hashes[0], hashes[1])
+	})
+
 	t.Run("CopyFromStage", func(t *testing.T) {
 		require := require.New(t)
 		context, cleanup := context.BuildContextFixture()
@@ -166,6 +191,29 @@ func TestCopyStepSetCacheID(t *testing.T) {
 		// `COPY --from=<>`, but now it should be the same.
 		require.Equal(hash1, hash2)
 	})
+
+	t.Run("CopyFromNamedContext", func(t *testing.T) {
+		require := require.New(t)
+		context, cleanup := context.BuildContextFixture()
+		defer cleanup()
+
+		namedDir, err := ioutil.TempDir(context.RootDir, "testCopyStepNamed")
+		require.NoError(err)
+		require.NoError(ioutil.WriteFile(filepath.Join(namedDir, "file"), []byte("v1"), 0644))
+		context.NamedContexts["vendor"] = namedDir
+
+		step := CopyStepFixture("", "vendor", []string{"file"}, "/tmp/", false, false)
+		require.NoError(step.SetCacheID(context, "seed"))
+		hash1 := step.CacheID()
+
+		// The content of named contexts is hashed like the main context.
+		require.NoError(ioutil.WriteFile(filepath.Join(namedDir, "file"), []byte("v2"), 0644))
+		require.NoError(step.SetCacheID(context, "seed"))
+		require.NotEqual(hash1, step.CacheID())
+
+		require.NoError(step.Execute(context, false))
+		require.Len(context.CopyOps, 1)
+	})
 }
 
 func TestCopyStepExecuteOnCriticalPath(t *testing.T) {
@@ -418,3 +466,98 @@ func TestCopyStepCommitOnNonCriticalPath(t *testing.T) {
 		}
 	})
 }
+
+func TestCopyStepChownNames(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(os.MkdirAll(filepath.Join(context.RootDir, "etc"), 0755))
+	passwdPath := filepath.Join(context.RootDir, "etc/passwd")
+	require.NoError(ioutil.WriteFile(passwdPath, []byte("root:x:0:0::/root:/bin/sh\n"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(context.RootDir, "etc/group"),
+		[]byte("root:x:0:\nstaff:x:50:app\n"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, "file"), []byte("content"), 0644))
+
+	// The user doesn't exist yet.
+	step, err := NewCopyStep("", "app:staff", "", []string{"file"}, "/file", true, false)
+	require.NoError(err)
+	err = step.Execute(context, false)
+	require.Error(err)
+	require.Contains(err.Error(), "no such user")
+
+	// Like after a RUN step running useradd.
+	require.NoError(ioutil.WriteFile(passwdPath, []byte(
+		"root:x:0:0::/root:/bin/sh\napp:x:1234:1234::/home/app:/bin/sh\n"), 0644))
+	require.NoError(step.Execute(context, false))
+	digestPairs, err := step.Commit(context)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+
+	r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	var found bool
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		if header.Name == "file" {
+			found = true
+			require.Equal(1234, header.Uid)
+			require.Equal(50, header.Gid)
+		}
+	}
+	require.True(found)
+}
+
+func TestCopyStepContextChown(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	require.NoError(ioutil.WriteFile(filepath.Join(context.ContextDir, "file"), []byte("content"), 0644))
+
+	step, err := NewCopyStep("file /file", "", "", []string{"file"}, "/file", true, false)
+	require.NoError(err)
+	require.NoError(step.SetCacheID(context, ""))
+	rootCacheID := step.CacheID()
+
+	// The owner of the files is part of the cache ID.
+	context.ContextChown = "1000:100"
+	require.NoError(step.SetCacheID(context, ""))
+	require.NotEqual(rootCacheID, step.CacheID())
+
+	require.NoError(step.Execute(context, false))
+	digestPairs, err := step.Commit(context)
+	require.NoError(err)
+	require.Len(digestPairs, 1)
+
+	r, err := context.ImageStore.Layers.GetStoreFileReader(digestPairs[0].GzipDescriptor.Digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	gzipReader, err := tario.NewGzipReader(r)
+	require.NoError(err)
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	var found bool
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		if header.Name == "file" {
+			found = true
+			require.Equal(1000, header.Uid)
+			require.Equal(100, header.Gid)
+		}
+	}
+	require.True(found)
+}
@@ -29,6 +29,9 @@ import (
 type EntrypointStep struct {
 	*baseStep
 	entrypoint []string
+
+	// cmdSet is true if a CMD step precedes it in its stage.
+	cmdSet bool
 }
 
 // NewEntrypointStep returns a BuildStep from given arguments.
@@ -49,5 +52,10 @@ func (s *EntrypointStep) UpdateCtxAndConfig(
 		return nil, fmt.Errorf("copy image config: %s", err)
 	}
 	config.Config.Entrypoint = s.entrypoint
+	if ctx.Strict && !s.cmdSet {
+		// Like docker build, the CMD of the base image is meant for its
+		// entrypoint.
+		config.Config.Cmd = nil
+	}
 	return config, nil
 }
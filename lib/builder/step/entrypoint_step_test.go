@@ -49,3 +49,28 @@ func TestEntrypointStepNilConfig(t *testing.T) {
 	_, err := step.UpdateCtxAndConfig(ctx, nil)
 	require.Error(err)
 }
+
+func TestEntrypointStepStrictClearsCmd(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	c := image.NewDefaultImageConfig()
+	c.Config.Cmd = []string{"bash"}
+	step := NewEntrypointStep("", []string{"ls"}, false).(*EntrypointStep)
+
+	result, err := step.UpdateCtxAndConfig(ctx, &c)
+	require.NoError(err)
+	require.Equal([]string{"bash"}, result.Config.Cmd)
+
+	ctx.Strict = true
+	result, err = step.UpdateCtxAndConfig(ctx, &c)
+	require.NoError(err)
+	require.Nil(result.Config.Cmd)
+
+	step.cmdSet = true
+	result, err = step.UpdateCtxAndConfig(ctx, &c)
+	require.NoError(err)
+	require.Equal([]string{"bash"}, result.Config.Cmd)
+}
@@ -18,7 +18,6 @@ import (
 	"archive/tar"
 	"encoding/json"
 	"fmt"
-	"hash/crc32"
 	"io/ioutil"
 	"strings"
 
@@ -31,11 +30,7 @@ import (
 	"github.com/uber/makisu/lib/utils"
 )
 
-const (
-	defaultAuthor       = "ubuild"
-	defaultArchitecture = "amd64"
-	defaultOS           = "linux"
-)
+const defaultAuthor = "ubuild"
 
 // FromStep implements BuildStep and execute FROM directive
 type FromStep struct {
@@ -52,7 +47,9 @@ type FromStep struct {
 func NewFromStep(args, imageName, alias string) (*FromStep, error) {
 	if !strings.EqualFold(imageName, image.Scratch) {
 		image, err := image.ParseNameForPull(imageName)
-		if err != nil || !image.IsValid() {
+		if err != nil {
+			return nil, fmt.Errorf("Invalid image name: %s", err)
+		} else if !image.IsValid() {
 			return nil, fmt.Errorf("Invalid image name: %s", imageName)
 		}
 		imageName = image.String()
@@ -69,6 +66,12 @@ func (s *FromStep) GetImage() string {
 	return s.image
 }
 
+// CreatedBy returns the description of the layers of the base image, for
+// images without history.
+func (s *FromStep) CreatedBy() string {
+	return "/bin/sh -c #(nop)  FROM " + s.image
+}
+
 // GetAlias returns stage alias defined in From step.
 func (s *FromStep) GetAlias() string {
 	return s.alias
@@ -77,8 +80,7 @@ func (s *FromStep) GetAlias() string {
 // SetCacheID sets the cacheID of the step using the name of the base image.
 // TODO: Use the sha of that image instead of the image name itself.
 func (s *FromStep) SetCacheID(ctx *context.BuildContext, seed string) error {
-	checksum := crc32.ChecksumIEEE([]byte(seed + string(s.directive) + s.image))
-	s.cacheID = fmt.Sprintf("%x", checksum)
+	s.cacheID = CacheIDFromString(seed + string(s.directive) + s.image)
 	return nil
 }
 
@@ -99,7 +101,7 @@ func (s *FromStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 	}
 
 	// Otherwise, pull image.
-	manifest, err := s.getManifest(ctx.ImageStore)
+	manifest, err := s.getManifest(ctx)
 	if err != nil {
 		return fmt.Errorf("get manifest: %s", err)
 	}
@@ -109,25 +111,27 @@ func (s *FromStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 		return fmt.Errorf("get config: %s", err)
 	}
 
-	if config.RootFS.DiffIDs == nil || manifest.Layers == nil {
-		return fmt.Errorf("empty layer digests or descriptors: %s", err)
-	} else if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
-		return fmt.Errorf("layer digests and descriptors count doesn't match: %s", err)
+	// Images built from scratch with only config directives have no layers.
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("layer digests and descriptors count doesn't match: %d != %d",
+			len(config.RootFS.DiffIDs), len(manifest.Layers))
 	}
 
 	// Apply each layer to the memFS.
 	// If modifyFS is true, writes it to the local file system.
+	counter := ctx.ExtractLimits.NewCounter()
 	for _, descriptor := range manifest.Layers {
 		reader, err := ctx.ImageStore.Layers.GetStoreFileReader(descriptor.Digest.Hex())
 		if err != nil {
 			return fmt.Errorf("get reader from layer: %s", err)
 		}
-		gzipReader, err := tario.NewGzipReader(reader)
+		gzipReader, err := tario.NewDecompressReader(reader)
 		if err != nil {
-			return fmt.Errorf("create gzip reader for layer: %s", err)
+			return fmt.Errorf("create decompress reader for layer: %s", err)
 		}
 		log.Infof("* Processing FROM layer %s", descriptor.Digest.Hex())
-		err = ctx.MemFS.UpdateFromTarReader(tar.NewReader(gzipReader), modifyFS)
+		err = ctx.MemFS.UpdateFromTarReaderWithLimits(
+			tar.NewReader(gzipReader), modifyFS, counter)
 		if err != nil {
 			return fmt.Errorf("untar reader: %s", err)
 		}
@@ -141,7 +145,7 @@ func (s *FromStep) Commit(ctx *context.BuildContext) ([]*image.DigestPair, error
 		return nil, nil
 	}
 
-	manifest, err := s.getManifest(ctx.ImageStore)
+	manifest, err := s.getManifest(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("get manifest: %s", err)
 	}
@@ -150,11 +154,14 @@ func (s *FromStep) Commit(ctx *context.BuildContext) ([]*image.DigestPair, error
 	if err != nil {
 		return nil, fmt.Errorf("get config: %s", err)
 	}
+	if config.Architecture != "" && !ctx.Platform.Compatible(config.Platform()) {
+		log.Warnf("Base image %s is for platform %s, not %s",
+			s.image, config.Platform(), ctx.Platform)
+	}
 
-	if config.RootFS.DiffIDs == nil || manifest.Layers == nil {
-		return nil, fmt.Errorf("empty layer digests or descriptors: %s", err)
-	} else if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
-		return nil, fmt.Errorf("layer digests and descriptors count doesn't match: %s", err)
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("layer digests and descriptors count doesn't match: %d != %d",
+			len(config.RootFS.DiffIDs), len(manifest.Layers))
 	}
 
 	digestPairs := make([]*image.DigestPair, len(config.RootFS.DiffIDs))
@@ -175,10 +182,14 @@ func (s *FromStep) UpdateCtxAndConfig(
 
 	if isScratch(s.image) {
 		config := image.NewDefaultImageConfig()
+		config.SetPlatform(ctx.Platform)
+		// Replace the PATH of the default config by the one of the context.
+		config.Config.Env = nil
+		s.setDefaultPath(ctx, &config)
 		return &config, nil
 	}
 
-	manifest, err := s.getManifest(ctx.ImageStore)
+	manifest, err := s.getManifest(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("get manifest: %s", err)
 	}
@@ -187,6 +198,11 @@ func (s *FromStep) UpdateCtxAndConfig(
 	if err != nil {
 		return nil, fmt.Errorf("get config: %s", err)
 	}
+	if config.Architecture != "" && !ctx.Platform.Compatible(config.Platform()) {
+		log.Warnf("Base image %s is for platform %s, not %s",
+			s.image, config.Platform(), ctx.Platform)
+	}
+	s.setDefaultPath(ctx, config)
 
 	// Update in-memory map of merged stage vars from ARG and ENV.
 	envMap := utils.ConvertStringSliceToMap(config.Config.Env)
@@ -197,7 +213,26 @@ func (s *FromStep) UpdateCtxAndConfig(
 	return config, nil
 }
 
-func (s *FromStep) getManifest(store *storage.ImageStore) (*image.DistributionManifest, error) {
+// setDefaultPath sets the PATH of config to the default PATH of the context if
+// the base image sets none, so RUN steps find commands in images based on
+// scratch or on stripped images.
+func (s *FromStep) setDefaultPath(ctx *context.BuildContext, config *image.Config) {
+	if ctx.DefaultPath == "" {
+		return
+	}
+	for _, env := range config.Config.Env {
+		if strings.HasPrefix(env, "PATH=") {
+			return
+		}
+	}
+	if !isScratch(s.image) {
+		log.Infof("* Base image %s sets no PATH, using %s", s.image, ctx.DefaultPath)
+	}
+	config.Config.Env = append(config.Config.Env, "PATH="+ctx.DefaultPath)
+	ctx.StageVars["PATH"] = ctx.DefaultPath
+}
+
+func (s *FromStep) getManifest(ctx *context.BuildContext) (*image.DistributionManifest, error) {
 	if s.manifest != nil {
 		return s.manifest, nil
 	}
@@ -207,11 +242,30 @@ func (s *FromStep) getManifest(store *storage.ImageStore) (*image.DistributionMa
 	if err != nil {
 		return nil, fmt.Errorf("parse pull image %s: %s", pullImage, err)
 	}
-	s.setRegistryClient(registry.New(store, pullImage.GetRegistry(), pullImage.GetRepository()))
-	manifest, err := s.client.Pull(pullImage.GetTag())
+	tag := pullImage.GetTag()
+	if ctx.VerifyBaseImage != nil {
+		digest, err := ctx.VerifyBaseImage(pullImage)
+		if err != nil {
+			return nil, fmt.Errorf("verify image %s: %s", s.image, err)
+		} else if digest != "" {
+			tag = string(digest)
+		}
+	}
+	client := registry.New(
+		ctx.ImageStore, pullImage.GetRegistry(), pullImage.GetRepository()).WithPlatform(ctx.Platform)
+	var previous *image.DistributionManifest
+	if ctx.WarnBaseUpdates {
+		previous, _ = client.StoredManifest(tag)
+	}
+	s.setRegistryClient(client)
+	manifest, err := s.client.Pull(tag)
 	if err != nil {
 		return nil, fmt.Errorf("pull image %s: %s", s.image, err)
 	}
+	if previous != nil && previous.Config.Digest != manifest.Config.Digest {
+		log.Warnf("Base image %s was updated since it was last pulled, from image %s to %s",
+			s.image, previous.Config.Digest, manifest.Config.Digest)
+	}
 	s.manifest = manifest
 	return manifest, nil
 }
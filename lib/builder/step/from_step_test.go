@@ -16,6 +16,7 @@ package step
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"path/filepath"
 	"testing"
@@ -124,6 +125,27 @@ func TestFromStepScratch(t *testing.T) {
 	require.Equal(image.NewDefaultImageConfig(), *conf)
 }
 
+func TestFromStepScratchDefaultPath(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	step, err := NewFromStep("", image.Scratch, "")
+	require.NoError(err)
+
+	ctx.DefaultPath = "/bin"
+	conf, err := step.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+	require.Equal([]string{"PATH=/bin"}, conf.Config.Env)
+	require.Equal("/bin", ctx.StageVars["PATH"])
+
+	ctx.DefaultPath = ""
+	conf, err = step.UpdateCtxAndConfig(ctx, nil)
+	require.NoError(err)
+	require.Empty(conf.Config.Env)
+}
+
 func TestFromStepRegularFlow(t *testing.T) {
 	require := require.New(t)
 
@@ -161,3 +183,73 @@ func TestFromStepRegularFlow(t *testing.T) {
 	require.NoError(json.Unmarshal(expectedConfBytes, &expectedConf))
 	require.Equal(expectedConf, *conf)
 }
+
+func TestFromStepVerifyBaseImage(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	testFileDirAlpine := "../../../testdata/files/alpine"
+	newStep := func() *FromStep {
+		p, err := registry.PullClientFixture(ctx,
+			filepath.Join(testFileDirAlpine, "test_distribution_manifest"),
+			filepath.Join(testFileDirAlpine, "test_image_config"),
+			filepath.Join(testFileDirAlpine, "test_layer.tar"))
+		require.NoError(err)
+		step, err := NewFromStep("", "fakeregistry.dev/library/alpine:latest", "")
+		require.NoError(err)
+		step.setRegistryClient(p)
+		return step
+	}
+
+	var verified []string
+	ctx.VerifyBaseImage = func(name image.Name) (image.Digest, error) {
+		verified = append(verified, name.String())
+		return "", nil
+	}
+	require.NoError(newStep().Execute(ctx, false))
+	require.Equal([]string{"fakeregistry.dev/library/alpine:latest"}, verified)
+
+	ctx.VerifyBaseImage = func(name image.Name) (image.Digest, error) {
+		return "", errors.New("policy violation")
+	}
+	require.EqualError(newStep().Execute(ctx, false),
+		"get manifest: verify image fakeregistry.dev/library/alpine:latest: policy violation")
+
+	// The image is pulled at the verified digest, which the fixture only
+	// serves by tag.
+	ctx.VerifyBaseImage = func(name image.Name) (image.Digest, error) {
+		return "sha256:abcd", nil
+	}
+	require.Error(newStep().Execute(ctx, false))
+}
+
+func TestFromStepNoLayers(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Images built from scratch with only config directives have no layers,
+	// and older builds left out their diff IDs.
+	config := image.NewDefaultImageConfig()
+	config.RootFS.DiffIDs = nil
+	b, err := json.Marshal(config)
+	require.NoError(err)
+	digest, err := image.NewDigester().FromBytes(b)
+	require.NoError(err)
+	configPath := filepath.Join(ctx.ImageStore.SandboxDir, digest.Hex())
+	require.NoError(ioutil.WriteFile(configPath, b, 0644))
+	require.NoError(ctx.ImageStore.Layers.LinkStoreFileFrom(digest.Hex(), configPath))
+
+	step, err := NewFromStep("", "fakeregistry.dev/library/empty:latest", "")
+	require.NoError(err)
+	step.manifest = &image.DistributionManifest{
+		Config: image.Descriptor{Digest: digest},
+	}
+	require.NoError(step.Execute(ctx, false))
+	digestPairs, err := step.Commit(ctx)
+	require.NoError(err)
+	require.Empty(digestPairs)
+}
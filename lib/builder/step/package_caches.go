@@ -0,0 +1,59 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"regexp"
+)
+
+// packageManager is a package manager whose caches are left out of the layers
+// of the RUN steps running it, with context.CleanPackageCaches.
+type packageManager struct {
+	// command matches the commands installing packages or updating their
+	// indexes, up to the next command of the shell.
+	command *regexp.Regexp
+	// caches are exclude patterns of the content of the caches, which leave
+	// their directories in place.
+	caches []string
+}
+
+var _packageManagers = []packageManager{
+	{
+		command: regexp.MustCompile(
+			`\bapt(-get)?\s+[^;&|]*\b(install|update|upgrade|dist-upgrade|full-upgrade)\b`),
+		caches: []string{"/var/lib/apt/lists/*", "/var/cache/apt/*.bin", "/var/cache/apt/archives/*.deb"},
+	},
+	{
+		command: regexp.MustCompile(
+			`\b(yum|dnf|microdnf)\s+[^;&|]*\b(install|reinstall|groupinstall|update|upgrade|makecache)\b`),
+		caches: []string{"/var/cache/yum/*", "/var/cache/dnf/*"},
+	},
+	{
+		command: regexp.MustCompile(`\bapk\s+[^;&|]*\b(add|update|upgrade)\b`),
+		caches:  []string{"/var/cache/apk/*"},
+	},
+}
+
+// packageCaches returns the exclude patterns of the caches of the package
+// managers cmd runs to install packages.
+func packageCaches(cmd string) []string {
+	var caches []string
+	for _, m := range _packageManagers {
+		if m.command.MatchString(cmd) {
+			caches = append(caches, m.caches...)
+		}
+	}
+	return caches
+}
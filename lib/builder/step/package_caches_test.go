@@ -0,0 +1,48 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageCaches(t *testing.T) {
+	apt := []string{"/var/lib/apt/lists/*", "/var/cache/apt/*.bin", "/var/cache/apt/archives/*.deb"}
+	yum := []string{"/var/cache/yum/*", "/var/cache/dnf/*"}
+	apk := []string{"/var/cache/apk/*"}
+	tests := []struct {
+		cmd    string
+		caches []string
+	}{
+		{"apt-get update && apt-get install -y --no-install-recommends curl", apt},
+		{"apt install -y git", apt},
+		{"DEBIAN_FRONTEND=noninteractive apt-get -q dist-upgrade", apt},
+		{"yum -y install httpd && yum clean all", yum},
+		{"microdnf install -y shadow-utils", yum},
+		{"apk add --no-cache bash", apk},
+		{"apk update; apt-get install -y make", append(append([]string{}, apt...), apk...)},
+		{"apt-cache policy curl", nil},
+		{"apt-get remove -y curl; echo install", nil},
+		{"pip install requests", nil},
+		{"echo apk; make install", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.cmd, func(t *testing.T) {
+			require.Equal(t, test.caches, packageCaches(test.cmd))
+		})
+	}
+}
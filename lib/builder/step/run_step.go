@@ -16,19 +16,46 @@ package step
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/failure"
+	"github.com/uber/makisu/lib/isolation"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/platform"
+	"github.com/uber/makisu/lib/progress"
+	"github.com/uber/makisu/lib/redact"
 	"github.com/uber/makisu/lib/shell"
+	"github.com/uber/makisu/lib/utils"
 )
 
+// _overlayDir is the dir of the sandbox where overlays are mounted.
+const _overlayDir = "overlay"
+
+// _isolationDir is the dir of the sandbox where isolated commands mount their
+// root.
+const _isolationDir = "isolation"
+
 // RunStep implements BuildStep and execute RUN directive
 type RunStep struct {
 	*baseStep
 
 	cmd string
 
+	// excludes are path patterns left out of the layer.
+	excludes []string
+	// retries overrides the number of retries of the retry policy of the
+	// context, if set.
+	retries int
+
 	// Used by the user step and the run step to determine which user should run a command (format should be <user>[:<group>] or <UID>[:<GID>], default is "" which is 0:0)
 	user string
 }
@@ -60,12 +87,254 @@ func (s *RunStep) ApplyCtxAndConfig(ctx *context.BuildContext, imageConfig *imag
 	return nil
 }
 
+// CreatedBy returns the command of the step, as docker build records it.
+func (s *RunStep) CreatedBy() string {
+	return "/bin/sh -c " + s.cmd
+}
+
+// SetCacheID sets the cache ID of the step given a seed SHA256 value.
+// Exclude annotations, package caches and shells other than the default one
+// change the layer, so they are part of the cache ID.
+func (s *RunStep) SetCacheID(ctx *context.BuildContext, seed string) error {
+	if len(s.excludes) > 0 {
+		seed += strings.Join(s.excludes, " ")
+	}
+	if caches := s.packageCaches(ctx); len(caches) > 0 {
+		seed += strings.Join(caches, " ")
+	}
+	if shell := strings.Join(ctx.Shell, " "); shell != strings.Join(context.DefaultShell, " ") {
+		seed += shell
+	}
+	return s.baseStep.SetCacheID(ctx, seed)
+}
+
 // Execute executes the step.
 // It shells out to run the specified command, which might change local file system.
 func (s *RunStep) Execute(ctx *context.BuildContext, modifyFS bool) error {
 	if !modifyFS {
 		return errors.New("attempted to execute RUN step without modifying file system")
 	}
+	// Changes of previous steps of the layer weren't recorded unless they were
+	// run in overlays, so the watcher and overlays can only be started by the
+	// first one.
+	first := !ctx.MustScan && len(ctx.CopyOps) == 0
+	ctx.ScanExcludes = append(ctx.ScanExcludes, s.excludes...)
+	if caches := s.packageCaches(ctx); len(caches) > 0 {
+		log.Infof("* Leaving package manager caches out of the layer: %s", strings.Join(caches, " "))
+		ctx.ScanExcludes = append(ctx.ScanExcludes, caches...)
+	}
+	if ctx.OverlaySnapshot && (first || ctx.MemFS.HasOverlayChanges()) {
+		// The upper dir grows with the writes of the step, and can't spill
+		// over once they fill the scratch dir, so it stays in the storage dir.
+		o, err := ctx.MemFS.MountOverlay(filepath.Join(ctx.ImageStore.SandboxDir, _overlayDir))
+		if err == nil {
+			ctx.MustScan = true
+			output := failure.NewTail(failure.MaxOutputLines)
+			execErr := s.execCommand(ctx, o.Root(), output)
+			if err := ctx.MemFS.CommitOverlay(o); err != nil {
+				return fmt.Errorf("commit overlay: %s", err)
+			}
+			if execErr != nil {
+				ctx.Failure.SetCommand(s.cmd, output.Lines())
+			}
+			return execErr
+		}
+		log.Warnf("Failed to mount overlay, falling back to scan: %s", err)
+		ctx.OverlaySnapshot = false
+		ctx.MemFS.ResetOverlayChanges()
+	}
+	if ctx.IncrementalScan && first {
+		if err := ctx.MemFS.StartWatching(); err != nil {
+			log.Warnf("Failed to watch file system, falling back to full scan: %s", err)
+		}
+	}
 	ctx.MustScan = true
-	return shell.ExecCommand(log.Infof, log.Errorf, s.workingDir, s.user, "sh", "-c", s.cmd)
+	output := failure.NewTail(failure.MaxOutputLines)
+	err := s.execCommand(ctx, "", output)
+	if err != nil {
+		ctx.Failure.SetCommand(s.cmd, output.Lines())
+	}
+	return err
+}
+
+// packageCaches returns the exclude patterns of the caches of the package
+// managers the command installs packages with, if the context cleans them.
+func (s *RunStep) packageCaches(ctx *context.BuildContext) []string {
+	if !ctx.CleanPackageCaches {
+		return nil
+	}
+	return packageCaches(s.cmd)
+}
+
+// execCommand runs the command of the step chrooted in root, or in the root
+// of the context if root is empty. Its output is logged, written to output,
+// and to the step logs and progress of the context, with secret values masked.
+// The command is killed at ctx.Deadline, or after ctx.StepTimeout, whichever
+// comes first, which is recorded as a timeout failure.
+func (s *RunStep) execCommand(ctx *context.BuildContext, root string, output io.Writer) error {
+	deadline, limit := ctx.Deadline, "build"
+	if ctx.StepTimeout > 0 {
+		if d := time.Now().Add(ctx.StepTimeout); deadline.IsZero() || d.Before(deadline) {
+			deadline, limit = d, "step"
+		}
+	}
+	stdoutLog, stderrLog, err := ctx.StepLogs.Open()
+	if err != nil {
+		return fmt.Errorf("open step logs: %s", err)
+	}
+	stdout := teeStream(log.Infof, redact.Writer(io.MultiWriter(
+		output, stdoutLog, ctx.Progress.Stream(progress.StreamStdout))))
+	stderr := teeStream(log.Errorf, redact.Writer(io.MultiWriter(
+		output, stderrLog, ctx.Progress.Stream(progress.StreamStderr))))
+	err = s.runWithRetries(ctx, root, deadline, stdout, stderr)
+	for _, w := range []io.Closer{stdoutLog, stderrLog} {
+		if closeErr := w.Close(); closeErr != nil {
+			log.Warnf("Failed to write step log: %s", closeErr)
+		}
+	}
+	if err == shell.ErrTimeout {
+		ctx.Failure.SetTimeout(limit)
+		if limit == "step" {
+			return fmt.Errorf("RUN step timed out after %s", ctx.StepTimeout)
+		}
+		return errors.New("build timed out during RUN step")
+	}
+	return err
+}
+
+// runWithRetries runs the command of the step until it succeeds, or fails in a
+// way the retry policy of the context doesn't retry. The step deadline is the
+// one of all attempts. The number of retries is recorded in the profile.
+func (s *RunStep) runWithRetries(ctx *context.BuildContext, root string, deadline time.Time,
+	stdout, stderr func(string, ...interface{})) error {
+
+	policy := ctx.RunRetry
+	if s.retries > 0 {
+		policy.Retries = s.retries
+	}
+	attempt := 1
+	for {
+		err := s.runCommand(ctx, root, deadline, stdout, stderr)
+		if !policy.Retryable(err, attempt) {
+			return err
+		}
+		delay := policy.Delay(attempt)
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		log.Warnf("RUN step failed: %s. Retrying in %s (attempt %d/%d)",
+			err, delay, attempt+1, policy.Retries+1)
+		time.Sleep(delay)
+		attempt++
+		ctx.Profile.SetStepRetries(attempt - 1)
+	}
+}
+
+// runCommand runs the command of the step with the shell of the context until
+// deadline. With ctx.IsolateRuns or ctx.Hermetic, the command is isolated by
+// ctx.Runtime, and the dirs of makisu are hidden from it. With ctx.Hermetic, it also has
+// no network access.
+func (s *RunStep) runCommand(ctx *context.BuildContext, root string, deadline time.Time,
+	stdout, stderr func(string, ...interface{})) error {
+
+	args := append(append([]string(nil), ctx.Shell[1:]...), s.cmd)
+	env := commandEnv(ctx)
+	if !ctx.IsolateRuns && !ctx.Hermetic {
+		if err := checkShell(root, ctx.Shell[0]); err != nil {
+			return err
+		} else if err := checkEmulation(root, ctx.Platform); err != nil {
+			return err
+		}
+		return shell.ExecCommandInRoot(
+			stdout, stderr, deadline, root, env, s.workingDir, s.user, ctx.Shell[0], args...)
+	}
+	if root == "" {
+		root = ctx.RootDir
+	}
+	if err := checkShell(root, ctx.Shell[0]); err != nil {
+		return err
+	} else if err := checkEmulation(root, ctx.Platform); err != nil {
+		return err
+	}
+	masked := []string{pathutils.DefaultInternalDir, ctx.ImageStore.RootDir, ctx.ContextDir}
+	if ctx.ImageStore.ScratchDir != "" {
+		masked = append(masked, ctx.ImageStore.ScratchDir)
+	}
+	for _, dir := range ctx.NamedContexts {
+		masked = append(masked, dir)
+	}
+	runtime := ctx.Runtime
+	if runtime == nil {
+		runtime = isolation.Namespaces
+	}
+	return shell.ExecCommandIsolated(stdout, stderr, deadline, runtime, root,
+		filepath.Join(ctx.ImageStore.SandboxDir, _isolationDir), masked,
+		ctx.Hermetic, env, s.workingDir, s.user, ctx.Shell[0], args...)
+}
+
+// commandEnv returns the env of the command of a RUN step: ctx.RunEnv
+// overridden by the ENV and ARGs of the stage, sorted by name. It returns nil,
+// so the command runs with the env of makisu, if ctx.RunEnv is nil.
+func commandEnv(ctx *context.BuildContext) []string {
+	if ctx.RunEnv == nil {
+		return nil
+	}
+	vars := utils.ConvertStringSliceToMap(ctx.RunEnv)
+	for k := range ctx.StageVars {
+		// Set in the env of makisu by SetEnvFromContext, unquoted and
+		// expanded.
+		vars[k] = os.Getenv(k)
+	}
+	env := make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// checkShell returns an error if shell is an absolute path missing from root,
+// like in images based on scratch, instead of failing to start it with a
+// confusing error.
+func checkShell(root, shell string) error {
+	if !filepath.IsAbs(shell) {
+		return nil
+	}
+	if _, err := os.Lstat(filepath.Join("/", root, shell)); os.IsNotExist(err) {
+		return fmt.Errorf("RUN step requires the shell %s, which is missing from the image", shell)
+	}
+	return nil
+}
+
+// checkEmulation returns an error if the host can't run the commands of p,
+// natively or with a qemu-user emulator registered in binfmt_misc, which then
+// runs them transparently. Emulators not registered with the F flag must
+// exist in root, which commands are chrooted in.
+func checkEmulation(root string, p platform.Platform) error {
+	if p == (platform.Platform{}) || platform.Native(p) {
+		return nil
+	}
+	emulator, err := platform.FindEmulator(p)
+	if err != nil {
+		return fmt.Errorf("RUN step can't run: %s", err)
+	}
+	if !emulator.FixBinary {
+		if _, err := os.Stat(filepath.Join("/", root, emulator.Interpreter)); err != nil {
+			return fmt.Errorf("RUN step requires the emulator %s in the image, since binfmt_misc entry %s "+
+				"isn't registered with the F flag", emulator.Interpreter, emulator.Name)
+		}
+	}
+	log.Infof("* Emulating %s with %s", p, emulator.Interpreter)
+	return nil
+}
+
+// teeStream returns a stream writing the output of a command to both stream and
+// w.
+func teeStream(
+	stream func(string, ...interface{}), w io.Writer) func(string, ...interface{}) {
+
+	return func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format, args...)
+		stream(format, args...)
+	}
 }
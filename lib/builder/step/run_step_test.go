@@ -15,9 +15,17 @@
 package step
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/failure"
+	"github.com/uber/makisu/lib/profile"
+	"github.com/uber/makisu/lib/shell"
 
 	"github.com/stretchr/testify/require"
 )
@@ -31,3 +39,149 @@ func TestRunStepExecutionFail(t *testing.T) {
 	err := step.Execute(context, false)
 	require.Error(err)
 }
+
+func TestRunStepRecordsFailure(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	context.Failure = failure.NewRecorder()
+
+	cmd := "echo out; echo err >&2; sleep 0.1; exit 3"
+	step := NewRunStep("", cmd, false)
+	err := step.Execute(context, true)
+	require.Error(err)
+
+	report := context.Failure.Report(err)
+	require.Equal(cmd, report.Command)
+	require.Contains(report.Output, "out")
+	require.Contains(report.Output, "err")
+	require.Contains(report.Output, "Command exited with 3")
+}
+
+func TestRunStepExcludes(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	step := NewRunStep("", "true", false)
+	require.NoError(step.SetCacheID(context, "seed"))
+	cacheID := step.CacheID()
+
+	step.excludes = []string{"/var/cache/apt"}
+	require.NoError(step.SetCacheID(context, "seed"))
+	require.NotEqual(cacheID, step.CacheID())
+
+	require.NoError(step.Execute(context, true))
+	require.True(context.MustScan)
+	require.Equal([]string{"/var/cache/apt"}, context.ScanExcludes)
+}
+
+func TestRunStepPackageCaches(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	step := NewRunStep("", "apk add --no-cache bash || true", false)
+	require.NoError(step.SetCacheID(context, "seed"))
+	cacheID := step.CacheID()
+
+	context.CleanPackageCaches = true
+	require.NoError(step.SetCacheID(context, "seed"))
+	require.NotEqual(cacheID, step.CacheID())
+
+	require.NoError(step.Execute(context, true))
+	require.Equal([]string{"/var/cache/apk/*"}, context.ScanExcludes)
+}
+
+func TestRunStepShell(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	context.Failure = failure.NewRecorder()
+
+	step := NewRunStep("", "echo $FOO; exit 1", false)
+	require.NoError(step.SetCacheID(context, "seed"))
+	cacheID := step.CacheID()
+
+	// The command is the last argument of the shell.
+	context.Shell = []string{"/usr/bin/env", "FOO=bar", "/bin/sh", "-c"}
+	require.NoError(step.SetCacheID(context, "seed"))
+	require.NotEqual(cacheID, step.CacheID())
+	err := step.Execute(context, true)
+	require.Error(err)
+	require.Contains(context.Failure.Report(err).Output, "bar")
+
+	context.Shell = []string{"/missing/sh", "-c"}
+	require.EqualError(step.Execute(context, true),
+		"RUN step requires the shell /missing/sh, which is missing from the image")
+}
+
+func TestRunStepRetries(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	context.Profile = profile.NewRecorder()
+
+	tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmp)
+
+	// The command fails with exit code 100 until its third attempt.
+	counter := filepath.Join(tmp, "attempts")
+	cmd := fmt.Sprintf(
+		"n=$(cat %[1]s 2>/dev/null || echo 0); n=$((n+1)); echo $n > %[1]s; [ $n -ge 3 ] || exit 100",
+		counter)
+	context.RunRetry = shell.RetryPolicy{Retries: 1, Backoff: time.Millisecond}
+	step := NewRunStep("", cmd, false)
+	require.Error(step.Execute(context, true))
+	content, err := ioutil.ReadFile(counter)
+	require.NoError(err)
+	require.Equal("2\n", string(content))
+
+	// Other exit codes are not retried.
+	require.NoError(os.Remove(counter))
+	context.RunRetry.ExitCodes = []int{1}
+	step.retries = 5
+	require.Error(step.Execute(context, true))
+	content, err = ioutil.ReadFile(counter)
+	require.NoError(err)
+	require.Equal("1\n", string(content))
+
+	// The annotation of the step overrides the number of retries.
+	require.NoError(os.Remove(counter))
+	context.RunRetry.ExitCodes = []int{1, 100}
+	context.Profile.StartStep("0", 1, "RUN flaky")
+	require.NoError(step.Execute(context, true))
+	context.Profile.EndStep()
+	require.Equal(2, context.Profile.Spans()[0].Retries)
+}
+
+func TestRunStepEnv(t *testing.T) {
+	require := require.New(t)
+	context, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmp)
+
+	os.Setenv("MAKISU_TEST_LEAKED", "leaked")
+	defer os.Unsetenv("MAKISU_TEST_LEAKED")
+	os.Setenv("MAKISU_TEST_PASSED", "passed")
+	defer os.Unsetenv("MAKISU_TEST_PASSED")
+	defer os.Unsetenv("MAKISU_TEST_STAGE")
+
+	context.RunEnv = shell.PassthroughEnv(os.Environ(), []string{"MAKISU_TEST_PASS*"})
+	context.StageVars["MAKISU_TEST_STAGE"] = "stage"
+	output := filepath.Join(tmp, "env")
+	step := NewRunStep("", "env > "+output, false)
+	require.NoError(step.ApplyCtxAndConfig(context, nil))
+	require.NoError(step.Execute(context, true))
+
+	content, err := ioutil.ReadFile(output)
+	require.NoError(err)
+	require.Contains(string(content), "MAKISU_TEST_STAGE=stage\n")
+	require.Contains(string(content), "MAKISU_TEST_PASSED=passed\n")
+	require.Contains(string(content), "HOME=/root\n")
+	require.NotContains(string(content), "MAKISU_TEST_LEAKED")
+}
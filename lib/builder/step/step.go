@@ -81,6 +81,10 @@ type BuildStep interface {
 	// HasCommit returns whether or not a particular commit step has a commit
 	// annotation.
 	HasCommit() bool
+
+	// CreatedBy returns the description of the step in the history of the
+	// image, following the conventions of docker build.
+	CreatedBy() string
 }
 
 // NewDockerfileStep initializes a build step from a dockerfile directive.
@@ -104,7 +108,9 @@ func NewDockerfileStep(
 		step, err = NewCopyStep(s.Args, s.Chown, s.FromStage, s.Srcs, s.Dst, s.Commit, s.PreserveOwner)
 	case *dockerfile.EntrypointDirective:
 		s, _ := d.(*dockerfile.EntrypointDirective)
-		step = NewEntrypointStep(s.Args, s.Entrypoint, s.Commit)
+		entrypointStep := NewEntrypointStep(s.Args, s.Entrypoint, s.Commit).(*EntrypointStep)
+		entrypointStep.cmdSet = s.CmdSet
+		step = entrypointStep
 	case *dockerfile.EnvDirective:
 		s, _ := d.(*dockerfile.EnvDirective)
 		step = NewEnvStep(s.Args, s.Envs, s.Commit)
@@ -126,10 +132,16 @@ func NewDockerfileStep(
 		step = NewMaintainerStep(s.Args, s.Author, s.Commit)
 	case *dockerfile.RunDirective:
 		s, _ := d.(*dockerfile.RunDirective)
-		step = NewRunStep(s.Args, s.Cmd, s.Commit)
+		runStep := NewRunStep(s.Args, s.Cmd, s.Commit)
+		runStep.excludes = s.Excludes
+		runStep.retries = s.Retries
+		step = runStep
 	case *dockerfile.StopsignalDirective:
 		s, _ := d.(*dockerfile.StopsignalDirective)
 		step = NewStopsignalStep(s.Args, s.Signal, s.Commit)
+	case *dockerfile.UnsupportedDirective:
+		s, _ := d.(*dockerfile.UnsupportedDirective)
+		step = NewUnsupportedStep(s.Instruction, s.Args, s.Line)
 	case *dockerfile.UserDirective:
 		s, _ := d.(*dockerfile.UserDirective)
 		step = NewUserStep(s.Args, s.User, s.Commit)
@@ -132,3 +132,20 @@ func TestNewDockerfileStep(t *testing.T) {
 		require.Error(err)
 	})
 }
+
+func TestCreatedBy(t *testing.T) {
+	require := require.New(t)
+
+	run := NewRunStep("", "make install", false)
+	require.Equal("/bin/sh -c make install", run.CreatedBy())
+
+	env := NewEnvStep("key=val", map[string]string{"key": "val"}, false)
+	require.Equal("/bin/sh -c #(nop)  ENV key=val", env.CreatedBy())
+
+	workdir := NewWorkdirStep("", "/app", false)
+	require.Equal("/bin/sh -c #(nop) WORKDIR /app", workdir.CreatedBy())
+
+	copy, err := NewCopyStep("", "", "", []string{"a", "b"}, "/dst/", false, false)
+	require.NoError(err)
+	require.Equal("/bin/sh -c #(nop) COPY a b in /dst/ ", copy.CreatedBy())
+}
@@ -0,0 +1,42 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package step
+
+import (
+	"fmt"
+)
+
+// UnsupportedStep implements BuildStep for instructions makisu doesn't
+// support, kept by --allow-unsupported. It doesn't change the image, and is
+// only recorded in its history.
+type UnsupportedStep struct {
+	*baseStep
+
+	Line int
+}
+
+// NewUnsupportedStep returns a BuildStep from given arguments.
+func NewUnsupportedStep(instruction, args string, line int) BuildStep {
+	return &UnsupportedStep{
+		baseStep: newBaseStep(Directive(instruction), args, false),
+		Line:     line,
+	}
+}
+
+// CreatedBy returns the description of the step in the history of the image,
+// marked as unsupported.
+func (s *UnsupportedStep) CreatedBy() string {
+	return fmt.Sprintf("%s # unsupported, ignored by makisu (line %d)", s.baseStep.CreatedBy(), s.Line)
+}
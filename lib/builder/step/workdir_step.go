@@ -38,6 +38,12 @@ func NewWorkdirStep(args string, workingDir string, commit bool) BuildStep {
 	}
 }
 
+// CreatedBy returns the description of the step in the history of the image.
+// Unlike other config changes, docker build only puts one space after #(nop).
+func (s *WorkdirStep) CreatedBy() string {
+	return "/bin/sh -c #(nop) WORKDIR " + s.workingDir
+}
+
 // UpdateCtxAndConfig updates mutable states in build context, and generates a
 // new image config base on config from previous step.
 func (s *WorkdirStep) UpdateCtxAndConfig(
@@ -48,7 +54,10 @@ func (s *WorkdirStep) UpdateCtxAndConfig(
 		return nil, fmt.Errorf("copy image config: %s", err)
 	}
 
-	workdir := os.ExpandEnv(s.workingDir)
+	workdir := s.workingDir
+	if !ctx.Strict {
+		workdir = os.ExpandEnv(workdir)
+	}
 	if filepath.IsAbs(workdir) {
 		config.Config.WorkingDir = ctx.RootDir
 	}
@@ -57,12 +66,61 @@ func (s *WorkdirStep) UpdateCtxAndConfig(
 	// Create this workdir if it does not exist already.
 	if _, err := os.Lstat(config.Config.WorkingDir); err != nil {
 		if os.IsNotExist(err) {
+			created := firstMissingDir(config.Config.WorkingDir)
 			if err := os.MkdirAll(config.Config.WorkingDir, 0755); err != nil {
 				return nil, fmt.Errorf("mkdir all working dir %s: %s", config.Config.WorkingDir, err)
 			}
+			if ctx.Strict && config.Config.User != "" {
+				if err := chownCreatedDirs(ctx, created, config.Config.WorkingDir, config.Config.User); err != nil {
+					return nil, err
+				}
+			}
 		} else {
 			return nil, fmt.Errorf("lstat working dir %s: %s", config.Config.WorkingDir, err)
 		}
 	}
 	return config, nil
 }
+
+// SetCacheID sets the cache ID of the step given a seed SHA256 value. Strict
+// builds create the workdir with another owner, so they don't share cache
+// IDs with other builds.
+func (s *WorkdirStep) SetCacheID(ctx *context.BuildContext, seed string) error {
+	if !ctx.Strict {
+		return s.baseStep.SetCacheID(ctx, seed)
+	}
+	s.cacheID = CacheIDFromString(fmt.Sprintf("%s%s%s%v strict", seed, s.directive, s.args, s.commit))
+	return nil
+}
+
+// firstMissingDir returns the highest ancestor of the missing dir that
+// doesn't exist, which is the first one MkdirAll creates.
+func firstMissingDir(dir string) string {
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		} else if _, err := os.Lstat(parent); err == nil {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// chownCreatedDirs chowns the dirs from created down to dir to user, like
+// docker build does for the dirs WORKDIR creates.
+func chownCreatedDirs(ctx *context.BuildContext, created, dir, user string) error {
+	uid, gid, err := ctx.Users.ResolveChown(user)
+	if err != nil {
+		return fmt.Errorf("resolve workdir owner: %s", err)
+	}
+	for {
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return fmt.Errorf("chown working dir %s: %s", dir, err)
+		}
+		if dir == created || filepath.Dir(dir) == dir {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
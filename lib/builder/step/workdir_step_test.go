@@ -15,7 +15,9 @@
 package step
 
 import (
+	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/uber/makisu/lib/context"
@@ -50,3 +52,29 @@ func TestWorkdirStepNilConfig(t *testing.T) {
 	_, err := step.UpdateCtxAndConfig(ctx, nil)
 	require.Error(err)
 }
+
+func TestWorkdirStepStrict(t *testing.T) {
+	require := require.New(t)
+
+	if os.Geteuid() != 0 {
+		t.Skip("chown requires root")
+	}
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	ctx.Strict = true
+	require.NoError(os.Mkdir(filepath.Join(ctx.RootDir, "home"), 0755))
+
+	c := image.NewDefaultImageConfig()
+	c.Config.User = "1000:1001"
+	step := NewWorkdirStep("", "/home/app/$HOME", false)
+	result, err := step.UpdateCtxAndConfig(ctx, &c)
+	require.NoError(err)
+
+	// The env of makisu isn't expanded, and only created dirs are chowned.
+	require.Equal(filepath.Join(ctx.RootDir, "/home/app/$HOME"), result.Config.WorkingDir)
+	for path, uid := range map[string]uint32{"home": 0, "home/app": 1000, "home/app/$HOME": 1000} {
+		fi, err := os.Stat(filepath.Join(ctx.RootDir, path))
+		require.NoError(err)
+		require.Equal(uid, fi.Sys().(*syscall.Stat_t).Uid, path)
+	}
+}
@@ -15,7 +15,9 @@
 package cache
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
@@ -26,6 +28,7 @@ import (
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/registry"
 	"github.com/uber/makisu/lib/storage"
+	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 
 	"github.com/pkg/errors"
@@ -34,9 +37,20 @@ import (
 const _cachePrefix = "makisu_builder_cache_"
 const _cacheEmptyEntry = "MAKISU_CACHE_EMPTY"
 
+// _cacheTagPrefix is the prefix of the tags of the layers pushed to a cache
+// repository.
+const _cacheTagPrefix = "makisu-cache-"
+
 // Manager is the interface through which we interact with the cacheID -> image layer mapping.
 type Manager interface {
 	PullCache(cacheID string) (*image.DigestPair, error)
+	// LookupCache returns the layer mapped to the cache ID like PullCache,
+	// without pulling it. The size of the layer is unknown.
+	LookupCache(cacheID string) (*image.DigestPair, error)
+	// PrefetchCache looks up the layers mapped to the cache IDs in one batch,
+	// so the following pulls and lookups of those IDs don't query the KV
+	// store one by one. Failures are only logged.
+	PrefetchCache(cacheIDs []string)
 	PushCache(cacheID string, digestPair *image.DigestPair) error
 	WaitForPush() error
 }
@@ -53,6 +67,12 @@ func (manager noopCacheManager) PullCache(cacheID string) (*image.DigestPair, er
 	return nil, errors.Wrapf(ErrorLayerNotFound, "Unable to find layer %s in Noop cache", cacheID)
 }
 
+func (manager noopCacheManager) LookupCache(cacheID string) (*image.DigestPair, error) {
+	return manager.PullCache(cacheID)
+}
+
+func (manager noopCacheManager) PrefetchCache(cacheIDs []string) {}
+
 func (manager noopCacheManager) PushCache(cacheID string, digestPair *image.DigestPair) error {
 	return nil
 }
@@ -81,8 +101,27 @@ type registryCacheManager struct {
 	// the following stage.
 	memKVStore map[string]string
 
+	// prefetched stores the entries of cache keys prefetched from kvStore,
+	// with empty entries for keys that were not found.
+	prefetched map[string]string
+
 	// registryClient is the client for docker registry.
 	registryClient registry.Client
+
+	// tagClient tags the layers pushed to a cache repository, if set.
+	tagClient TagClient
+
+	// fallbackClient pulls the layers missing from the cache repository, if
+	// set. They were pushed to the repository of the image by builds that
+	// didn't use a cache repository.
+	fallbackClient registry.Client
+}
+
+// TagClient is a registry client that can tag layers, which is needed to
+// keep them in a repository dedicated to cache layers.
+type TagClient interface {
+	registry.Client
+	PushLayerTag(tag string, layer image.Descriptor, diffID image.Digest) error
 }
 
 var (
@@ -106,10 +145,35 @@ func New(
 		imageStore:     imageStore,
 		kvStore:        kvStore,
 		memKVStore:     make(map[string]string),
+		prefetched:     make(map[string]string),
 		registryClient: registryClient,
 	}
 }
 
+// NewWithCacheRepo returns a new cache manager like New, that pushes the cache
+// layers to a repository dedicated to them through cacheClient. Registries
+// garbage collect the blobs that no manifest references, so each pushed layer
+// is also tagged with CacheTag. Layers are pulled from the cache repository,
+// or through imageClient if they are missing from it.
+func NewWithCacheRepo(
+	imageStore *storage.ImageStore, kvStore keyvalue.Store,
+	cacheClient TagClient, imageClient registry.Client) Manager {
+
+	manager := New(imageStore, kvStore, cacheClient)
+	if m, ok := manager.(*registryCacheManager); ok {
+		m.tagClient = cacheClient
+		m.fallbackClient = imageClient
+	}
+	return manager
+}
+
+// CacheTag returns the tag of a layer pushed to a cache repository at t. The
+// tags start with the UTC time of the push, so that retention policies and
+// cleanup scripts can delete the old ones by comparing them.
+func CacheTag(cacheID string, t time.Time) string {
+	return _cacheTagPrefix + t.UTC().Format("20060102T150405Z") + "-" + cacheID
+}
+
 // PullCache tries to fetch the layer corresponding to the cache ID.
 // If the layer is not found, it returns ErrorLayerNotFound.
 // This function is blocking.
@@ -117,31 +181,10 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 	manager.Lock()
 	defer manager.Unlock()
 
-	var entry string
-	var err error
-	key := _cachePrefix + cacheID
-	entry, ok := manager.memKVStore[key]
-	if ok {
-		log.Infof("Found mapping in cacheID mem kv store: %s => %s", cacheID, entry)
-	} else {
-		for i := 0; ; i++ {
-			entry, err = manager.kvStore.Get(key)
-			if err == nil && entry != "" {
-				break
-			} else if entry == "" {
-				return nil, errors.Wrapf(ErrorLayerNotFound, "find layer %s", cacheID)
-			} else {
-				if i >= 2 {
-					return nil, fmt.Errorf("query cache id %s: %s", cacheID, err)
-				}
-				log.Info("Retrying query for cacheID %s", cacheID)
-				time.Sleep(time.Second)
-			}
-		}
-		log.Infof("Found mapping in cacheID kv store: %s => %s", cacheID, entry)
-	}
-
-	if entry == _cacheEmptyEntry {
+	entry, err := manager.getEntry(cacheID)
+	if err != nil {
+		return nil, err
+	} else if entry == _cacheEmptyEntry {
 		return nil, nil
 	}
 
@@ -161,6 +204,10 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 
 		// Pull layer from docker registry.
 		info, err = manager.registryClient.PullLayer(gzipDigest)
+		if err != nil && manager.fallbackClient != nil {
+			log.Infof("Failed to pull layer %s from cache repository, pulling it from image repository: %s", entry, err)
+			info, err = manager.fallbackClient.PullLayer(gzipDigest)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("pull layer %s: %s", entry, err)
 		}
@@ -171,16 +218,106 @@ func (manager *registryCacheManager) PullCache(cacheID string) (*image.DigestPai
 	if info != nil {
 		size = info.Size()
 	}
+	descriptor := image.Descriptor{
+		Size:   size,
+		Digest: gzipDigest,
+	}
+	describeLayer(manager.imageStore, &descriptor)
 	return &image.DigestPair{
-		TarDigest: tarDigest,
-		GzipDescriptor: image.Descriptor{
-			MediaType: image.MediaTypeLayer,
-			Size:      size,
-			Digest:    gzipDigest,
-		},
+		TarDigest:      tarDigest,
+		GzipDescriptor: descriptor,
 	}, nil
 }
 
+// LookupCache returns the layer mapped to the cache ID, without pulling it.
+func (manager *registryCacheManager) LookupCache(cacheID string) (*image.DigestPair, error) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	entry, err := manager.getEntry(cacheID)
+	if err != nil {
+		return nil, err
+	} else if entry == _cacheEmptyEntry {
+		return nil, nil
+	}
+	tarDigest, gzipDigest, err := parseEntry(entry)
+	if err != nil {
+		return nil, errors.Wrapf(ErrorLayerNotFound, "parse entry %s", entry)
+	}
+	return &image.DigestPair{
+		TarDigest:      tarDigest,
+		GzipDescriptor: image.Descriptor{Digest: gzipDigest},
+	}, nil
+}
+
+// PrefetchCache gets the entries of the cache IDs from the kv store in one
+// batch. The kv store isn't queried again for those IDs.
+func (manager *registryCacheManager) PrefetchCache(cacheIDs []string) {
+	var keys []string
+	manager.Lock()
+	for _, cacheID := range cacheIDs {
+		key := _cachePrefix + cacheID
+		if _, ok := manager.memKVStore[key]; ok {
+			continue
+		} else if _, ok := manager.prefetched[key]; ok {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	manager.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	// The lock isn't held while querying the kv store, so pushes don't wait.
+	start := time.Now()
+	entries, err := keyvalue.GetMany(manager.kvStore, keys)
+	if err != nil {
+		log.Warnf("Failed to prefetch %d cache IDs, looking them up one by one: %s", len(keys), err)
+		return
+	}
+	manager.Lock()
+	defer manager.Unlock()
+	var found int
+	for i, key := range keys {
+		manager.prefetched[key] = entries[i]
+		if entries[i] != "" {
+			found++
+		}
+	}
+	log.Infof("Prefetched %d cache IDs, found %d, in %s", len(keys), found, time.Since(start))
+}
+
+// getEntry returns the entry of the cache ID, from the mem kv store or the kv
+// store. It must be called with the lock held.
+func (manager *registryCacheManager) getEntry(cacheID string) (string, error) {
+	key := _cachePrefix + cacheID
+	if entry, ok := manager.memKVStore[key]; ok {
+		log.Infof("Found mapping in cacheID mem kv store: %s => %s", cacheID, entry)
+		return entry, nil
+	}
+	if entry, ok := manager.prefetched[key]; ok {
+		if entry == "" {
+			return "", errors.Wrapf(ErrorLayerNotFound, "find layer %s", cacheID)
+		}
+		log.Infof("Found mapping in prefetched cacheID entries: %s => %s", cacheID, entry)
+		return entry, nil
+	}
+	for i := 0; ; i++ {
+		entry, err := manager.kvStore.Get(key)
+		if err == nil && entry != "" {
+			log.Infof("Found mapping in cacheID kv store: %s => %s", cacheID, entry)
+			return entry, nil
+		} else if entry == "" {
+			return "", errors.Wrapf(ErrorLayerNotFound, "find layer %s", cacheID)
+		} else if i >= 2 {
+			return "", fmt.Errorf("query cache id %s: %s", cacheID, err)
+		}
+		log.Infof("Retrying query for cacheID %s", cacheID)
+		time.Sleep(time.Second)
+	}
+}
+
 // PushCache tries to push an image layer asynchronously.
 func (manager *registryCacheManager) PushCache(cacheID string, digestPair *image.DigestPair) error {
 	manager.Lock()
@@ -205,6 +342,14 @@ func (manager *registryCacheManager) PushCache(cacheID string, digestPair *image
 				manager.pushErrors.Add(fmt.Errorf("push layer %s: %s", digestPair.GzipDescriptor.Digest, err))
 				return
 			}
+			if manager.tagClient != nil {
+				// The layer can be used without its tag until the registry
+				// is garbage collected, so failures are only logged.
+				tag := CacheTag(cacheID, time.Now())
+				if err := manager.tagClient.PushLayerTag(tag, digestPair.GzipDescriptor, digestPair.TarDigest); err != nil {
+					log.Warnf("Failed to tag cache layer %s: %s", digestPair.GzipDescriptor.Digest, err)
+				}
+			}
 		}
 
 		manager.Lock()
@@ -236,17 +381,69 @@ func (manager *registryCacheManager) WaitForPush() error {
 	}
 }
 
+// describeLayer sets the media type and annotations of a layer in the image
+// store, based on its content. Defaults to a gzip layer if it can't be read.
+func describeLayer(imageStore *storage.ImageStore, descriptor *image.Descriptor) {
+	descriptor.MediaType = image.MediaTypeLayer
+	reader, err := imageStore.Layers.GetStoreFileReader(descriptor.Digest.Hex())
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	format, err := tario.DetectCompression(bufio.NewReader(reader))
+	if err != nil {
+		return
+	}
+	descriptor.MediaType = tario.LayerMediaType(format)
+	if format != tario.CompressionGzip {
+		return
+	}
+
+	// eStargz layers need the digest of their TOC to be lazily pulled.
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	tocDigest, err := tario.EstargzTOCDigest(reader, size)
+	if err != nil {
+		log.Warnf("Failed to read eStargz TOC of layer %s: %s", descriptor.Digest, err)
+	} else if tocDigest != "" {
+		descriptor.Annotations = map[string]string{
+			tario.EstargzTOCDigestAnnotation: string(tocDigest),
+		}
+	}
+}
+
+// parseEntry parses the tar and gzip digests of a cache entry. Digests
+// without algorithm are sha256 ones.
 func parseEntry(entry string) (image.Digest, image.Digest, error) {
 	if strings.Index(entry, ",") == -1 {
 		return image.NewEmptyDigest(), image.NewEmptyDigest(), errors.Errorf("parse redis entry: %s", entry)
 	}
 	split := strings.SplitN(entry, ",", 2)
-	return image.Digest("sha256:" + split[0]), image.Digest("sha256:" + split[1]), nil
+	return parseEntryDigest(split[0]), parseEntryDigest(split[1]), nil
+}
+
+func parseEntryDigest(s string) image.Digest {
+	if strings.Contains(s, ":") {
+		return image.Digest(s)
+	}
+	return image.Digest(string(image.SHA256) + ":" + s)
 }
 
+// createEntry returns the cache entry of a layer. Only the hex part of sha256
+// digests is kept, for compatibility with older versions.
 func createEntry(pair *image.DigestPair) string {
 	if pair == nil {
 		return _cacheEmptyEntry
 	}
-	return fmt.Sprintf("%s,%s", pair.TarDigest.Hex(), pair.GzipDescriptor.Digest.Hex())
+	return fmt.Sprintf("%s,%s",
+		createEntryDigest(pair.TarDigest), createEntryDigest(pair.GzipDescriptor.Digest))
+}
+
+func createEntryDigest(d image.Digest) string {
+	if d.Algorithm() == image.SHA256 {
+		return d.Hex()
+	}
+	return string(d)
 }
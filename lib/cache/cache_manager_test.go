@@ -15,8 +15,13 @@
 package cache_test
 
 import (
+	"fmt"
+	"os"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/uber/makisu/lib/cache"
 	"github.com/uber/makisu/lib/cache/keyvalue"
@@ -80,6 +85,30 @@ func TestCachePushAndPull(t *testing.T) {
 	require.NoError(err)
 }
 
+func TestCacheLookup(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	// Lookups never pull layers.
+	mockRegistry := mockregistry.NewMockClient(ctrl)
+	kvStore := keyvalue.MockStore{}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, mockRegistry)
+
+	_, err := cacheMgr.LookupCache("cacheid1")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+
+	require.NoError(kvStore.Put("makisu_builder_cache_cacheid2", "test,testgzip"))
+	digestPair, err := cacheMgr.LookupCache("cacheid2")
+	require.NoError(err)
+	require.Equal(image.Digest("sha256:test"), digestPair.TarDigest)
+	require.Equal(image.Digest("sha256:testgzip"), digestPair.GzipDescriptor.Digest)
+}
+
 func TestCachePullWithOngoingPushing(t *testing.T) {
 	require := require.New(t)
 
@@ -122,3 +151,139 @@ func TestCachePullWithOngoingPushing(t *testing.T) {
 	_, err = cacheMgr.PullCache("cacheid2")
 	require.NoError(err)
 }
+
+type countingStore struct {
+	keyvalue.MockStore
+	gets int32
+}
+
+func (s *countingStore) Get(key string) (string, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.MockStore.Get(key)
+}
+
+func TestCachePrefetch(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	mockRegistry := mockregistry.NewMockClient(ctrl)
+	kvStore := &countingStore{MockStore: keyvalue.MockStore{}}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, mockRegistry)
+
+	require.NoError(kvStore.Put("makisu_builder_cache_cacheid1", "test,testgzip"))
+	cacheMgr.PrefetchCache([]string{"cacheid1", "cacheid2"})
+	require.Equal(int32(2), atomic.LoadInt32(&kvStore.gets))
+
+	// Prefetched entries, found or not, are served without another round trip.
+	digestPair, err := cacheMgr.LookupCache("cacheid1")
+	require.NoError(err)
+	require.Equal(image.Digest("sha256:test"), digestPair.TarDigest)
+	_, err = cacheMgr.LookupCache("cacheid2")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+	require.Equal(int32(2), atomic.LoadInt32(&kvStore.gets))
+
+	// Already prefetched IDs are skipped.
+	cacheMgr.PrefetchCache([]string{"cacheid1", "cacheid2"})
+	require.Equal(int32(2), atomic.LoadInt32(&kvStore.gets))
+}
+
+func TestCacheEntryDigestAlgorithm(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	kvStore := keyvalue.MockStore{}
+	cacheMgr := cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+
+	// Only the hex part of sha256 digests is stored, like older versions do.
+	require.NoError(cacheMgr.PushCache("cacheid1", &image.DigestPair{
+		TarDigest:      image.Digest("sha256:test"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:testgzip")},
+	}))
+	require.NoError(cacheMgr.PushCache("cacheid2", &image.DigestPair{
+		TarDigest:      image.Digest("sha512:test"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha512:testgzip")},
+	}))
+	require.NoError(cacheMgr.WaitForPush())
+
+	entry, err := kvStore.Get("makisu_builder_cache_cacheid1")
+	require.NoError(err)
+	require.Equal("test,testgzip", entry)
+	entry, err = kvStore.Get("makisu_builder_cache_cacheid2")
+	require.NoError(err)
+	require.Equal("sha512:test,sha512:testgzip", entry)
+
+	cacheMgr = cache.New(ctx.ImageStore, kvStore, registry.NoopClientFixture())
+	digestPair, err := cacheMgr.LookupCache("cacheid2")
+	require.NoError(err)
+	require.Equal(image.Digest("sha512:test"), digestPair.TarDigest)
+	require.Equal(image.Digest("sha512:testgzip"), digestPair.GzipDescriptor.Digest)
+}
+
+// cacheRepoClient is a cache repository missing all layers, which records the
+// layers it tags.
+type cacheRepoClient struct {
+	registry.Client
+	sync.Mutex
+	tags map[string]image.Digest
+}
+
+func (c *cacheRepoClient) PullLayer(layerDigest image.Digest) (os.FileInfo, error) {
+	return nil, fmt.Errorf("blob unknown")
+}
+
+func (c *cacheRepoClient) PushLayerTag(tag string, layer image.Descriptor, diffID image.Digest) error {
+	c.Lock()
+	defer c.Unlock()
+	c.tags[tag] = layer.Digest
+	return nil
+}
+
+func TestCacheRepo(t *testing.T) {
+	require := require.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	cacheClient := &cacheRepoClient{Client: registry.NoopClientFixture(), tags: make(map[string]image.Digest)}
+	imageClient := mockregistry.NewMockClient(ctrl)
+	kvStore := keyvalue.MockStore{}
+	cacheMgr := cache.NewWithCacheRepo(ctx.ImageStore, kvStore, cacheClient, imageClient)
+
+	// Pushed layers are tagged in the cache repository.
+	require.NoError(cacheMgr.PushCache("cacheid1", &image.DigestPair{
+		TarDigest:      image.Digest("sha256:test"),
+		GzipDescriptor: image.Descriptor{Digest: image.Digest("sha256:testgzip")},
+	}))
+	require.NoError(cacheMgr.PushCache("cacheid2", nil))
+	require.NoError(cacheMgr.WaitForPush())
+	require.Len(cacheClient.tags, 1)
+	for tag, digest := range cacheClient.tags {
+		require.Regexp(regexp.MustCompile(`^makisu-cache-\d{8}T\d{6}Z-cacheid1$`), tag)
+		require.Equal(image.Digest("sha256:testgzip"), digest)
+	}
+
+	// Layers missing from the cache repository are pulled from the image
+	// repository.
+	require.NoError(kvStore.Put("makisu_builder_cache_cacheid3", "test3,testgzip3"))
+	imageClient.EXPECT().PullLayer(image.Digest("sha256:testgzip3")).Return(nil, nil)
+	digestPair, err := cacheMgr.PullCache("cacheid3")
+	require.NoError(err)
+	require.Equal(image.Digest("sha256:testgzip3"), digestPair.GzipDescriptor.Digest)
+}
+
+func TestCacheTag(t *testing.T) {
+	require := require.New(t)
+
+	tag := cache.CacheTag("abc", time.Date(2026, 10, 16, 9, 5, 3, 0, time.FixedZone("", 3600)))
+	require.Equal("makisu-cache-20261016T080503Z-abc", tag)
+}
@@ -0,0 +1,130 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/uber/makisu/lib/cache/keyvalue"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/storage"
+)
+
+// _checkpointTTL is how long an interrupted build can be resumed.
+const _checkpointTTL = 7 * 24 * time.Hour
+
+// checkpointManager records the layers committed by a build in a file of the
+// storage dir as soon as they are committed, so that an interrupted build can
+// resume from its last committed step instead of starting over. The image
+// config needs no checkpoint, since it is generated again from the steps.
+// Layers missing from the checkpoint are looked up in the wrapped manager.
+type checkpointManager struct {
+	Manager
+
+	imageStore *storage.ImageStore
+	store      keyvalue.Store
+}
+
+// checkpointPath returns the path of the checkpoint file of a target image.
+func checkpointPath(imageStore *storage.ImageStore, target image.Name) string {
+	name := fmt.Sprintf("%x.json", sha256.Sum256([]byte(target.String())))
+	return filepath.Join(imageStore.RootDir, storage.CheckpointsDir, name)
+}
+
+// NewCheckpointManager returns a Manager that checkpoints the build of the
+// target image on top of manager. With resume, the layers recorded by a
+// previous build of the same target are reused, otherwise the previous
+// checkpoint is discarded.
+func NewCheckpointManager(
+	imageStore *storage.ImageStore, target image.Name, resume bool,
+	manager Manager) (Manager, error) {
+
+	p := checkpointPath(imageStore, target)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, fmt.Errorf("create checkpoints dir: %s", err)
+	}
+	if !resume {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("remove checkpoint: %s", err)
+		}
+	} else if _, err := os.Stat(p); err == nil {
+		log.Infof("Resuming build of %s from checkpoint %s", target, p)
+	} else {
+		log.Infof("No checkpoint to resume the build of %s from", target)
+	}
+	store, err := keyvalue.NewFSStore(p, imageStore.SandboxDir, _checkpointTTL)
+	if err != nil {
+		return nil, fmt.Errorf("init checkpoint store: %s", err)
+	}
+	return &checkpointManager{
+		Manager:    manager,
+		imageStore: imageStore,
+		store:      store,
+	}, nil
+}
+
+// RemoveCheckpoint removes the checkpoint of the target image, once its build
+// succeeded.
+func RemoveCheckpoint(imageStore *storage.ImageStore, target image.Name) error {
+	if err := os.Remove(checkpointPath(imageStore, target)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// PullCache returns the layer recorded in the checkpoint if it is still in the
+// image store, or pulls it from the wrapped manager otherwise.
+func (manager *checkpointManager) PullCache(cacheID string) (*image.DigestPair, error) {
+	entry, err := manager.store.Get(_cachePrefix + cacheID)
+	if err != nil || entry == "" {
+		return manager.Manager.PullCache(cacheID)
+	} else if entry == _cacheEmptyEntry {
+		log.Infof("Found empty layer in checkpoint for cache ID %s", cacheID)
+		return nil, nil
+	}
+	tarDigest, gzipDigest, err := parseEntry(entry)
+	if err != nil {
+		return manager.Manager.PullCache(cacheID)
+	}
+	info, err := manager.imageStore.Layers.GetStoreFileStat(gzipDigest.Hex())
+	if err != nil {
+		log.Warnf("Layer %s of checkpoint is gone: %s", gzipDigest, err)
+		return manager.Manager.PullCache(cacheID)
+	}
+	log.Infof("Found layer in checkpoint for cache ID %s: %s", cacheID, gzipDigest)
+	descriptor := image.Descriptor{
+		Size:   info.Size(),
+		Digest: gzipDigest,
+	}
+	describeLayer(manager.imageStore, &descriptor)
+	return &image.DigestPair{
+		TarDigest:      tarDigest,
+		GzipDescriptor: descriptor,
+	}, nil
+}
+
+// PushCache records the layer in the checkpoint before it's pushed by the
+// wrapped manager, which is usually asynchronous.
+func (manager *checkpointManager) PushCache(cacheID string, digestPair *image.DigestPair) error {
+	if err := manager.store.Put(_cachePrefix+cacheID, createEntry(digestPair)); err != nil {
+		return fmt.Errorf("checkpoint cache ID %s: %s", cacheID, err)
+	}
+	return manager.Manager.PushCache(cacheID, digestPair)
+}
@@ -0,0 +1,93 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/uber/makisu/lib/cache"
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	target := image.MustParseName("repo/name:tag")
+	gzipDigest := image.Digest("sha256:" + digestHex("gzip"))
+	digestPair := &image.DigestPair{
+		TarDigest:      image.Digest("sha256:" + digestHex("tar")),
+		GzipDescriptor: image.Descriptor{Digest: gzipDigest},
+	}
+	require.NoError(ctx.ImageStore.Layers.CreateDownloadFile(gzipDigest.Hex(), 0))
+	require.NoError(ctx.ImageStore.Layers.MoveDownloadFileToStore(gzipDigest.Hex()))
+
+	// The first build is interrupted after committing two steps.
+	cacheMgr, err := cache.NewCheckpointManager(
+		ctx.ImageStore, target, false, cache.NewNoopCacheManager())
+	require.NoError(err)
+	require.NoError(cacheMgr.PushCache("cacheid1", digestPair))
+	require.NoError(cacheMgr.PushCache("cacheid2", nil))
+
+	// The resumed build reuses the layers.
+	cacheMgr, err = cache.NewCheckpointManager(
+		ctx.ImageStore, target, true, cache.NewNoopCacheManager())
+	require.NoError(err)
+	pulled, err := cacheMgr.PullCache("cacheid1")
+	require.NoError(err)
+	require.Equal(digestPair.TarDigest, pulled.TarDigest)
+	require.Equal(gzipDigest, pulled.GzipDescriptor.Digest)
+	pulled, err = cacheMgr.PullCache("cacheid2")
+	require.NoError(err)
+	require.Nil(pulled)
+	_, err = cacheMgr.PullCache("cacheid3")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+
+	// Other targets don't share the checkpoint.
+	cacheMgr, err = cache.NewCheckpointManager(
+		ctx.ImageStore, image.MustParseName("repo/other:tag"), true, cache.NewNoopCacheManager())
+	require.NoError(err)
+	_, err = cacheMgr.PullCache("cacheid1")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+
+	// Builds that don't resume start over.
+	cacheMgr, err = cache.NewCheckpointManager(
+		ctx.ImageStore, target, false, cache.NewNoopCacheManager())
+	require.NoError(err)
+	_, err = cacheMgr.PullCache("cacheid1")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+
+	// The checkpoint is removed once the build succeeded.
+	require.NoError(cacheMgr.PushCache("cacheid1", digestPair))
+	require.NoError(cache.RemoveCheckpoint(ctx.ImageStore, target))
+	cacheMgr, err = cache.NewCheckpointManager(
+		ctx.ImageStore, target, true, cache.NewNoopCacheManager())
+	require.NoError(err)
+	_, err = cacheMgr.PullCache("cacheid1")
+	require.Equal(cache.ErrorLayerNotFound, errors.Cause(err))
+	require.NoError(cache.RemoveCheckpoint(ctx.ImageStore, target))
+}
+
+func digestHex(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
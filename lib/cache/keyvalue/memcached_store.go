@@ -0,0 +1,428 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memcached binary protocol constants.
+// See https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped.
+const (
+	_memcachedMagicRequest  = 0x80
+	_memcachedMagicResponse = 0x81
+
+	_memcachedOpGet      = 0x00
+	_memcachedOpSet      = 0x01
+	_memcachedOpGetQ     = 0x09
+	_memcachedOpNoop     = 0x0a
+	_memcachedOpSASLAuth = 0x21
+
+	_memcachedStatusOK          = 0x0000
+	_memcachedStatusKeyNotFound = 0x0001
+
+	_memcachedHeaderLen = 24
+
+	// Responses with larger bodies are rejected instead of allocated. It's
+	// well above the 1MB item size limit of memcached by default, and the
+	// values of the cache are digests.
+	_memcachedMaxBodyLen = 16 << 20
+
+	// Expiration values larger than 30 days are interpreted by memcached as
+	// absolute unix timestamps instead of relative offsets.
+	_memcachedMaxRelativeTTL = 30 * 24 * time.Hour
+
+	// Number of points each server gets on the hash ring.
+	_memcachedVirtualNodes = 160
+)
+
+type memcachedStore struct {
+	ring     *hashRing
+	servers  map[string]*memcachedConn
+	username string
+	password string
+	ttl      time.Duration
+}
+
+// NewMemcachedStore returns a new instance of Store backed by a fleet of
+// memcached servers, using the binary protocol.
+// Keys are distributed across servers using consistent hashing. If username
+// is not empty, connections authenticate with SASL PLAIN.
+// In this constructor we try to open a connection to each server. If any
+// attempt fails we return an error.
+func NewMemcachedStore(
+	addrs []string, username, password string, ttl time.Duration) (Store, error) {
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no memcached server address provided")
+	}
+	store := &memcachedStore{
+		ring:     newHashRing(addrs, _memcachedVirtualNodes),
+		servers:  make(map[string]*memcachedConn),
+		username: username,
+		password: password,
+		ttl:      ttl,
+	}
+	for _, addr := range addrs {
+		c := &memcachedConn{addr: addr, username: username, password: password}
+		if err := c.connect(); err != nil {
+			store.Cleanup()
+			return nil, fmt.Errorf("connect to memcached server %s: %s", addr, err)
+		}
+		store.servers[addr] = c
+	}
+	return store, nil
+}
+
+func (store *memcachedStore) Get(key string) (string, error) {
+	status, value, err := store.serverFor(key).do(_memcachedOpGet, key, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("memcached get key: %s", err)
+	} else if status == _memcachedStatusKeyNotFound {
+		return "", nil
+	} else if status != _memcachedStatusOK {
+		return "", fmt.Errorf("memcached get key: %s", memcachedStatusError(status, value))
+	}
+	// Get responses carry 4 bytes of flags as extras before the value.
+	if len(value) < 4 {
+		return "", fmt.Errorf("memcached get key: malformed response")
+	}
+	return string(value[4:]), nil
+}
+
+// GetMany gets the keys of each server in one round trip, from all servers
+// concurrently.
+func (store *memcachedStore) GetMany(keys []string) ([]string, error) {
+	indexes := make(map[string][]int)
+	for i, key := range keys {
+		addr := store.ring.get(key)
+		indexes[addr] = append(indexes[addr], i)
+	}
+	values := make([]string, len(keys))
+	errs := make(chan error, len(indexes))
+	for addr, serverIndexes := range indexes {
+		go func(c *memcachedConn, serverIndexes []int) {
+			serverKeys := make([]string, len(serverIndexes))
+			for i, index := range serverIndexes {
+				serverKeys[i] = keys[index]
+			}
+			serverValues, err := c.getMulti(serverKeys)
+			if err == nil {
+				// Each goroutine sets different indexes.
+				for i, index := range serverIndexes {
+					values[index] = serverValues[i]
+				}
+			}
+			errs <- err
+		}(store.servers[addr], serverIndexes)
+	}
+	var err error
+	for range indexes {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("memcached get keys: %s", err)
+	}
+	return values, nil
+}
+
+func (store *memcachedStore) Put(key, value string) error {
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[4:], memcachedExpiration(store.ttl, time.Now()))
+	status, body, err := store.serverFor(key).do(_memcachedOpSet, key, extras, []byte(value))
+	if err != nil {
+		return fmt.Errorf("memcached set key: %s", err)
+	} else if status != _memcachedStatusOK {
+		return fmt.Errorf("memcached set key: %s", memcachedStatusError(status, body))
+	}
+	return nil
+}
+
+func (store *memcachedStore) Cleanup() error {
+	for _, c := range store.servers {
+		c.close()
+	}
+	return nil
+}
+
+func (store *memcachedStore) serverFor(key string) *memcachedConn {
+	return store.servers[store.ring.get(key)]
+}
+
+// memcachedExpiration converts ttl to the expiration field of a set request.
+func memcachedExpiration(ttl time.Duration, now time.Time) uint32 {
+	if ttl <= 0 {
+		return 0
+	} else if ttl > _memcachedMaxRelativeTTL {
+		return uint32(now.Add(ttl).Unix())
+	}
+	return uint32(ttl / time.Second)
+}
+
+func memcachedStatusError(status uint16, body []byte) error {
+	return fmt.Errorf("status 0x%04x: %s", status, string(body))
+}
+
+// memcachedConn is a single connection to one memcached server. Requests on
+// the same connection are serialized.
+type memcachedConn struct {
+	sync.Mutex
+
+	addr     string
+	username string
+	password string
+
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+func (c *memcachedConn) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, DialTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	if c.username != "" {
+		auth := []byte("\x00" + c.username + "\x00" + c.password)
+		status, body, err := c.roundTrip(_memcachedOpSASLAuth, "PLAIN", nil, auth)
+		if err != nil {
+			c.close()
+			return fmt.Errorf("sasl auth: %s", err)
+		} else if status != _memcachedStatusOK {
+			c.close()
+			return fmt.Errorf("sasl auth: %s", memcachedStatusError(status, body))
+		}
+	}
+	return nil
+}
+
+func (c *memcachedConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// do sends one request, reconnecting and retrying up to MaxRetires times on
+// network errors.
+func (c *memcachedConn) do(
+	opcode byte, key string, extras, value []byte) (uint16, []byte, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	var err error
+	for i := 0; i < MaxRetires; i++ {
+		if c.conn == nil {
+			if err = c.connect(); err != nil {
+				continue
+			}
+		}
+		var status uint16
+		var body []byte
+		status, body, err = c.roundTrip(opcode, key, extras, value)
+		if err == nil {
+			return status, body, nil
+		}
+		c.close()
+	}
+	return 0, nil, err
+}
+
+// getMulti gets keys with quiet gets, which the server only answers for hits,
+// followed by a noop that it answers once it answered all the gets. Values are
+// empty for the keys that were not found.
+func (c *memcachedConn) getMulti(keys []string) ([]string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var err error
+	for i := 0; i < MaxRetires; i++ {
+		if c.conn == nil {
+			if err = c.connect(); err != nil {
+				continue
+			}
+		}
+		var values []string
+		values, err = c.pipelineGets(keys)
+		if err == nil {
+			return values, nil
+		}
+		c.close()
+	}
+	return nil, err
+}
+
+// pipelineGets writes the quiet gets of getMulti and reads their responses.
+func (c *memcachedConn) pipelineGets(keys []string) ([]string, error) {
+	c.conn.SetDeadline(time.Now().Add(ReadTimeout + WriteTimeout))
+
+	// The opaque field of each get is the index of its key.
+	for i, key := range keys {
+		if err := c.writeRequest(_memcachedOpGetQ, key, nil, nil, uint32(i)); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.writeRequest(_memcachedOpNoop, "", nil, nil, uint32(len(keys))); err != nil {
+		return nil, err
+	}
+	if err := c.rw.Flush(); err != nil {
+		return nil, fmt.Errorf("flush request: %s", err)
+	}
+
+	values := make([]string, len(keys))
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if resp.opcode == _memcachedOpNoop {
+			return values, nil
+		} else if resp.opcode != _memcachedOpGetQ || int(resp.opaque) >= len(keys) {
+			return nil, fmt.Errorf("unexpected response opcode 0x%02x", resp.opcode)
+		} else if resp.status != _memcachedStatusOK {
+			return nil, memcachedStatusError(resp.status, resp.body)
+		} else if len(resp.body) < 4 {
+			return nil, fmt.Errorf("malformed get response")
+		}
+		values[resp.opaque] = string(resp.body[4:])
+	}
+}
+
+// roundTrip writes a request and reads the response. It returns the response
+// status and the body following the key, which includes response extras.
+func (c *memcachedConn) roundTrip(
+	opcode byte, key string, extras, value []byte) (uint16, []byte, error) {
+
+	c.conn.SetDeadline(time.Now().Add(ReadTimeout + WriteTimeout))
+
+	if err := c.writeRequest(opcode, key, extras, value, 0); err != nil {
+		return 0, nil, err
+	}
+	if err := c.rw.Flush(); err != nil {
+		return 0, nil, fmt.Errorf("flush request: %s", err)
+	}
+	resp, err := c.readResponse()
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.status, resp.body, nil
+}
+
+// memcachedResponse is a response read from a memcached server. Its body
+// includes the response extras, but not the key.
+type memcachedResponse struct {
+	opcode byte
+	status uint16
+	opaque uint32
+	body   []byte
+}
+
+// writeRequest writes a request to the buffer of the connection.
+func (c *memcachedConn) writeRequest(
+	opcode byte, key string, extras, value []byte, opaque uint32) error {
+
+	header := make([]byte, _memcachedHeaderLen)
+	header[0] = _memcachedMagicRequest
+	header[1] = opcode
+	binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(header[12:], opaque)
+	for _, b := range [][]byte{header, extras, []byte(key), value} {
+		if _, err := c.rw.Write(b); err != nil {
+			return fmt.Errorf("write request: %s", err)
+		}
+	}
+	return nil
+}
+
+// readResponse reads the next response from the connection.
+func (c *memcachedConn) readResponse() (*memcachedResponse, error) {
+	header := make([]byte, _memcachedHeaderLen)
+	if _, err := io.ReadFull(c.rw, header); err != nil {
+		return nil, fmt.Errorf("read response header: %s", err)
+	}
+	if header[0] != _memcachedMagicResponse {
+		return nil, fmt.Errorf("invalid response magic 0x%02x", header[0])
+	}
+	keyLen := int(binary.BigEndian.Uint16(header[2:]))
+	extrasLen := int(header[4])
+	bodyLen := binary.BigEndian.Uint32(header[8:])
+	if bodyLen > _memcachedMaxBodyLen {
+		return nil, fmt.Errorf("response body of %d bytes exceeds %d bytes", bodyLen, _memcachedMaxBodyLen)
+	} else if extrasLen+keyLen > int(bodyLen) {
+		return nil, fmt.Errorf(
+			"response extras and key of %d bytes exceed its body of %d bytes", extrasLen+keyLen, bodyLen)
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(c.rw, body); err != nil {
+		return nil, fmt.Errorf("read response body: %s", err)
+	}
+	if keyLen > 0 {
+		body = append(body[:extrasLen], body[extrasLen+keyLen:]...)
+	}
+	return &memcachedResponse{
+		opcode: header[1],
+		status: binary.BigEndian.Uint16(header[6:]),
+		opaque: binary.BigEndian.Uint32(header[12:]),
+		body:   body,
+	}, nil
+}
+
+// hashRing maps keys to servers using consistent hashing, so adding or
+// removing a server only remaps a fraction of the keys.
+type hashRing struct {
+	points  []uint32
+	servers map[uint32]string
+}
+
+func newHashRing(addrs []string, virtualNodes int) *hashRing {
+	r := &hashRing{servers: make(map[uint32]string)}
+	for _, addr := range addrs {
+		for i := 0; i < virtualNodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(addr + "-" + strconv.Itoa(i)))
+			if _, ok := r.servers[point]; ok {
+				continue
+			}
+			r.servers[point] = addr
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+func (r *hashRing) get(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.servers[r.points[i]]
+}
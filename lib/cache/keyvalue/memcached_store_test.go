@@ -0,0 +1,248 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMemcached is a minimal memcached server speaking the binary protocol.
+// It supports GET, GETQ, NOOP, SET and SASL PLAIN authentication.
+type fakeMemcached struct {
+	sync.Mutex
+
+	listener net.Listener
+	auth     string
+	entries  map[string][]byte
+}
+
+func newFakeMemcached(t *testing.T, username, password string) *fakeMemcached {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeMemcached{listener: l, entries: make(map[string][]byte)}
+	if username != "" {
+		s.auth = "\x00" + username + "\x00" + password
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeMemcached) Addr() string { return s.listener.Addr().String() }
+
+func (s *fakeMemcached) Close() { s.listener.Close() }
+
+func (s *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	authenticated := s.auth == ""
+	for {
+		header := make([]byte, _memcachedHeaderLen)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		keyLen := int(binary.BigEndian.Uint16(header[2:]))
+		extrasLen := int(header[4])
+		body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		key := string(body[extrasLen : extrasLen+keyLen])
+		value := body[extrasLen+keyLen:]
+
+		var status uint16
+		var extras, respValue []byte
+		quiet := false
+		s.Lock()
+		switch {
+		case header[1] == _memcachedOpSASLAuth:
+			if string(value) == s.auth {
+				authenticated = true
+			} else {
+				status = 0x0020
+			}
+		case !authenticated:
+			status = 0x0020
+		case header[1] == _memcachedOpGet:
+			if v, ok := s.entries[key]; ok {
+				extras, respValue = make([]byte, 4), v
+			} else {
+				status = _memcachedStatusKeyNotFound
+			}
+		case header[1] == _memcachedOpGetQ:
+			if v, ok := s.entries[key]; ok {
+				extras, respValue = make([]byte, 4), v
+			} else {
+				quiet = true
+			}
+		case header[1] == _memcachedOpSet:
+			s.entries[key] = value
+		}
+		s.Unlock()
+		if quiet {
+			continue
+		}
+
+		resp := make([]byte, _memcachedHeaderLen)
+		resp[0] = _memcachedMagicResponse
+		resp[1] = header[1]
+		resp[4] = byte(len(extras))
+		binary.BigEndian.PutUint16(resp[6:], status)
+		binary.BigEndian.PutUint32(resp[8:], uint32(len(extras)+len(respValue)))
+		copy(resp[12:16], header[12:16])
+		resp = append(append(resp, extras...), respValue...)
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestMemcachedStore(t *testing.T) {
+	t.Run("get_no_exist", func(t *testing.T) {
+		require := require.New(t)
+
+		s := newFakeMemcached(t, "", "")
+		defer s.Close()
+
+		store, err := NewMemcachedStore([]string{s.Addr()}, "", "", 10*time.Second)
+		require.NoError(err)
+		defer store.Cleanup()
+
+		loc, err := store.Get("a")
+		require.NoError(err)
+		require.Equal("", loc)
+	})
+
+	t.Run("set_then_get", func(t *testing.T) {
+		require := require.New(t)
+
+		s1 := newFakeMemcached(t, "", "")
+		defer s1.Close()
+		s2 := newFakeMemcached(t, "", "")
+		defer s2.Close()
+
+		store, err := NewMemcachedStore([]string{s1.Addr(), s2.Addr()}, "", "", 10*time.Second)
+		require.NoError(err)
+		defer store.Cleanup()
+
+		for i := 0; i < 20; i++ {
+			require.NoError(store.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)))
+		}
+		for i := 0; i < 20; i++ {
+			v, err := store.Get(fmt.Sprintf("key%d", i))
+			require.NoError(err)
+			require.Equal(fmt.Sprintf("value%d", i), v)
+		}
+		require.NotEmpty(s1.entries)
+		require.NotEmpty(s2.entries)
+
+		keys := []string{"key3", "missing", "key12", "key0"}
+		values, err := store.(BatchStore).GetMany(keys)
+		require.NoError(err)
+		require.Equal([]string{"value3", "", "value12", "value0"}, values)
+	})
+
+	t.Run("sasl", func(t *testing.T) {
+		require := require.New(t)
+
+		s := newFakeMemcached(t, "user", "pass")
+		defer s.Close()
+
+		_, err := NewMemcachedStore([]string{s.Addr()}, "user", "wrong", 10*time.Second)
+		require.Error(err)
+
+		store, err := NewMemcachedStore([]string{s.Addr()}, "user", "pass", 10*time.Second)
+		require.NoError(err)
+		defer store.Cleanup()
+
+		require.NoError(store.Put("a", "b"))
+		v, err := store.Get("a")
+		require.NoError(err)
+		require.Equal("b", v)
+	})
+}
+
+func TestHashRing(t *testing.T) {
+	require := require.New(t)
+
+	r1 := newHashRing([]string{"a:11211", "b:11211", "c:11211"}, _memcachedVirtualNodes)
+	r2 := newHashRing([]string{"a:11211", "b:11211", "c:11211", "d:11211"}, _memcachedVirtualNodes)
+
+	// Adding a server should only remap a fraction of keys.
+	var moved int
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("makisu_builder_cache_%d", i)
+		if r1.get(key) != r2.get(key) {
+			require.Equal("d:11211", r2.get(key))
+			moved++
+		}
+	}
+	require.True(moved > 0 && moved < 500)
+}
+
+func TestMemcachedExpiration(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1500000000, 0)
+	require.Equal(uint32(0), memcachedExpiration(0, now))
+	require.Equal(uint32(3600), memcachedExpiration(time.Hour, now))
+	require.Equal(uint32(now.Unix()+int64(60*24*3600)), memcachedExpiration(60*24*time.Hour, now))
+}
+
+func TestMemcachedInvalidResponses(t *testing.T) {
+	response := func(keyLen uint16, extrasLen byte, bodyLen uint32, body []byte) *memcachedConn {
+		header := make([]byte, _memcachedHeaderLen)
+		header[0] = _memcachedMagicResponse
+		binary.BigEndian.PutUint16(header[2:], keyLen)
+		header[4] = extrasLen
+		binary.BigEndian.PutUint32(header[8:], bodyLen)
+		r := bufio.NewReader(bytes.NewReader(append(header, body...)))
+		return &memcachedConn{rw: bufio.NewReadWriter(r, nil)}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		resp, err := response(3, 4, 10, []byte("flagkeyval")).readResponse()
+		require.NoError(t, err)
+		require.Equal(t, "flagval", string(resp.body))
+	})
+
+	t.Run("key and extras longer than body", func(t *testing.T) {
+		_, err := response(8, 4, 10, []byte("flagkeyval")).readResponse()
+		require.Error(t, err)
+		_, err = response(0, 4, 2, []byte("fl")).readResponse()
+		require.Error(t, err)
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		_, err := response(0, 0, 1<<31, nil).readResponse()
+		require.Error(t, err)
+	})
+}
@@ -64,6 +64,22 @@ func (store *redisStore) Get(key string) (string, error) {
 	return v, err
 }
 
+// GetMany gets the keys with a single MGET.
+func (store *redisStore) GetMany(keys []string) ([]string, error) {
+	results, err := store.cli.MGet(keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis mget keys: %s", err)
+	}
+	values := make([]string, len(keys))
+	for i, result := range results {
+		// Missing keys are nil.
+		if v, ok := result.(string); ok {
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
 func (store *redisStore) Put(key, value string) error {
 	if _, err := store.cli.Set(key, value, store.ttl).Result(); err != nil {
 		return fmt.Errorf("redis set key: %s", err)
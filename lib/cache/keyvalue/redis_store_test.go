@@ -58,4 +58,21 @@ func TestRedisStore(t *testing.T) {
 		require.NoError(err)
 		require.Equal("b", loc)
 	})
+	t.Run("get_many", func(t *testing.T) {
+		require := require.New(t)
+
+		s, err := miniredis.Run()
+		require.NoError(err)
+		defer s.Close()
+
+		store, err := NewRedisStore(s.Addr(), "", 10*time.Second)
+		require.NoError(err)
+		defer store.Cleanup()
+
+		require.NoError(store.Put("a", "1"))
+		require.NoError(store.Put("c", "3"))
+		values, err := GetMany(store, []string{"a", "b", "c"})
+		require.NoError(err)
+		require.Equal([]string{"1", "", "3"}, values)
+	})
 }
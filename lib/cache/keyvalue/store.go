@@ -14,6 +14,14 @@
 
 package keyvalue
 
+import (
+	"sync"
+)
+
+// _maxConcurrentGets is the number of keys GetMany gets concurrently from
+// stores that can't get several keys at once.
+const _maxConcurrentGets = 16
+
 // Store is the interface that the CacheManager relies on to find the mapping
 // between cacheID and layer name.
 // The Get function returns an empty string and no error if the key was not
@@ -24,3 +32,45 @@ type Store interface {
 	Put(string, string) error
 	Cleanup() error
 }
+
+// BatchStore is implemented by stores that can get several keys in one round
+// trip, like redis with MGET.
+// GetMany returns the values of the keys in the same order, with empty strings
+// for the keys that were not found.
+type BatchStore interface {
+	Store
+	GetMany([]string) ([]string, error)
+}
+
+// GetMany returns the values of keys from store, in one round trip if it is a
+// BatchStore, or with concurrent gets otherwise, so that high latency stores
+// don't add one round trip per key.
+func GetMany(store Store, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if batch, ok := store.(BatchStore); ok {
+		return batch.GetMany(keys)
+	}
+
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+	sem := make(chan struct{}, _maxConcurrentGets)
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			values[i], errs[i] = store.Get(key)
+		}(i, key)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
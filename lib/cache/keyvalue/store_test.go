@@ -0,0 +1,34 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyvalue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMany(t *testing.T) {
+	require := require.New(t)
+
+	store := MockStore{"a": "1", "c": "3"}
+	values, err := GetMany(store, []string{"a", "b", "c"})
+	require.NoError(err)
+	require.Equal([]string{"1", "", "3"}, values)
+
+	values, err = GetMany(store, nil)
+	require.NoError(err)
+	require.Empty(values)
+}
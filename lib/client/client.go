@@ -15,11 +15,13 @@
 package client
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
@@ -28,6 +30,8 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/daemon"
 	"github.com/uber/makisu/lib/fileio"
 	"github.com/uber/makisu/lib/log"
 )
@@ -36,6 +40,9 @@ import (
 type MakisuClient struct {
 	LocalSharedPath  string
 	WorkerSharedPath string
+	// SyncContext uploads the context to the worker, sending only the files
+	// it doesn't have yet, instead of copying it to the shared path.
+	SyncContext bool
 
 	WorkerLog func(line string)
 	HTTPDo    func(req *http.Request) (*http.Response, error)
@@ -82,7 +89,7 @@ func (cli *MakisuClient) Ready() (bool, error) {
 
 // Exit tells the makisu worker to exit cleanly.
 func (cli *MakisuClient) Exit() error {
-	req, err := http.NewRequest("GET", "http://localhost/exit", nil)
+	req, err := http.NewRequest("POST", "http://localhost/exit", nil)
 	if err != nil {
 		return err
 	}
@@ -99,24 +106,32 @@ func (cli *MakisuClient) Exit() error {
 
 // Build kicks off a build on the makisu worker at the context with the flags passed in.
 func (cli *MakisuClient) Build(flags []string, context string) error {
-	context, err := cli.prepareContext(context)
-	if err != nil {
-		return err
+	args := append([]string{"build"}, flags...)
+	url := "http://localhost/build"
+	if cli.SyncContext {
+		id, err := cli.syncContext(context)
+		if err != nil {
+			return err
+		}
+		url += "?context=" + id
+	} else {
+		context, err := cli.prepareContext(context)
+		if err != nil {
+			return err
+		}
+		localContext := filepath.Join(cli.LocalSharedPath, context)
+		workerContext := filepath.Join(cli.WorkerSharedPath, context)
+		defer func() {
+			log.Infof("Removing context after build: %s", localContext)
+			os.RemoveAll(localContext)
+		}()
+		args = append(args, workerContext)
 	}
-	localContext := filepath.Join(cli.LocalSharedPath, context)
-	workerContext := filepath.Join(cli.WorkerSharedPath, context)
-	defer func() {
-		log.Infof("Removing context after build: %s", localContext)
-		os.RemoveAll(localContext)
-	}()
-
-	args := append(flags, workerContext)
-	args = append([]string{"build"}, args...)
 	log.Infof("Arguments passed to Makisu worker: %v", args)
 
 	content, _ := json.Marshal(args)
 	reader := bytes.NewBuffer(content)
-	req, err := http.NewRequest("POST", "http://localhost/build", reader)
+	req, err := http.NewRequest("POST", url, reader)
 	if err != nil {
 		return err
 	}
@@ -134,6 +149,101 @@ func (cli *MakisuClient) Build(flags []string, context string) error {
 	return nil
 }
 
+// syncContext sends the manifest of a context to the worker, uploads the
+// content it is missing, and returns the id of the context on the worker.
+func (cli *MakisuClient) syncContext(dir string) (string, error) {
+	start := time.Now()
+	manifest, err := context.NewManifest(dir)
+	if err != nil {
+		return "", err
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("marshal context manifest: %s", err)
+	}
+	req, err := http.NewRequest("POST", "http://localhost/context", bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var sync daemon.ContextSync
+	if err := cli.do(req, &sync); err != nil {
+		return "", fmt.Errorf("sync context manifest: %s", err)
+	}
+
+	if len(sync.Missing) > 0 {
+		r, w := io.Pipe()
+		go func() { w.CloseWithError(writeBlobs(w, dir, manifest.Digests(), sync.Missing)) }()
+		req, err := http.NewRequest("POST", "http://localhost/context/blobs", r)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-tar")
+		if err := cli.do(req, nil); err != nil {
+			r.CloseWithError(err)
+			return "", fmt.Errorf("upload context files: %s", err)
+		}
+	}
+	log.Infow("Synced context", "files", len(manifest.Entries),
+		"uploaded", len(sync.Missing), "duration", time.Since(start))
+	return sync.ID, nil
+}
+
+// writeBlobs writes a tar of the files of the missing digests, named by their
+// digest.
+func writeBlobs(w io.Writer, dir string, paths map[string]string, missing []string) error {
+	tw := tar.NewWriter(w)
+	for _, digest := range missing {
+		p, ok := paths[digest]
+		if !ok {
+			return fmt.Errorf("worker requested unknown digest: %s", digest)
+		}
+		if err := writeBlob(tw, filepath.Join(dir, filepath.FromSlash(p)), digest); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeBlob(tw *tar.Writer, p, digest string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: digest, Typeflag: tar.TypeReg, Mode: 0644, Size: fi.Size()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// A file modified since its digest was computed is rejected by the
+	// worker.
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// do sends a request, and decodes its JSON response into v if not nil.
+func (cli *MakisuClient) do(req *http.Request, v interface{}) error {
+	resp, err := cli.HTTPDo(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("bad status code from worker: %v: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return fmt.Errorf("decode response: %s", err)
+		}
+	}
+	return nil
+}
+
 // Takes in the local path of the context, copies the files to a new directory inside the worker's
 // mount namespace and returns the context path inside the shared mount location.
 // Example: prepareContext("/home/joe/test/context") => context-12345
@@ -0,0 +1,151 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package commit turns ad-hoc changes to an existing image into the dockerfile
+// that applies them, so that they are built by the regular builder.
+package commit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/uber/makisu/lib/parser/dockerfile"
+)
+
+// Changes are the modifications applied to a base image. They are applied
+// in the order: env, copies, runs, labels and then raw instructions, so that
+// commands see the env and copied files.
+type Changes struct {
+	// Base is the image the changes are applied to.
+	Base string
+	// Env are the environment variables set in the image, as key=value.
+	Env []string
+	// Copy are the files copied from the context, as src:dst.
+	Copy []string
+	// Run are the shell commands run in the image.
+	Run []string
+	// Labels are the labels set on the image, as key=value.
+	Labels []string
+	// Instructions are raw dockerfile instructions, such as
+	// 'CMD ["/bin/app"]' or 'USER app'.
+	Instructions []string
+}
+
+// Dockerfile returns the dockerfile applying the changes to the base image.
+func (c Changes) Dockerfile() (string, error) {
+	if c.Base == "" {
+		return "", errors.New("no base image")
+	}
+	lines := []string{"FROM " + c.Base}
+	if len(c.Env) > 0 {
+		env, err := keyVals(c.Env)
+		if err != nil {
+			return "", fmt.Errorf("invalid env: %s", err)
+		}
+		lines = append(lines, "ENV "+env)
+	}
+	for _, cp := range c.Copy {
+		parts := strings.SplitN(cp, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "", fmt.Errorf("invalid copy %q: expected src:dst", cp)
+		}
+		args, err := json.Marshal(parts)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal copy %q: %s", cp, err)
+		}
+		lines = append(lines, "COPY "+string(args))
+	}
+	for _, run := range c.Run {
+		if err := singleLine(run); err != nil {
+			return "", fmt.Errorf("invalid run %q: %s", run, err)
+		}
+		lines = append(lines, "RUN "+run)
+	}
+	if len(c.Labels) > 0 {
+		labels, err := keyVals(c.Labels)
+		if err != nil {
+			return "", fmt.Errorf("invalid label: %s", err)
+		}
+		lines = append(lines, "LABEL "+labels)
+	}
+	for _, instruction := range c.Instructions {
+		if err := singleLine(instruction); err != nil {
+			return "", fmt.Errorf("invalid instruction %q: %s", instruction, err)
+		}
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(instruction)), "FROM") {
+			return "", fmt.Errorf("invalid instruction %q: the base image is set by --base", instruction)
+		}
+		lines = append(lines, instruction)
+	}
+	contents := strings.Join(lines, "\n") + "\n"
+	if err := validate(contents); err != nil {
+		return "", err
+	}
+	return contents, nil
+}
+
+// keyVals joins the key=value pairs into the arguments of ENV or LABEL,
+// quoting the values.
+func keyVals(pairs []string) (string, error) {
+	kvs := make(map[string]string, len(pairs))
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return "", fmt.Errorf("%q: expected key=value", pair)
+		}
+		if strings.ContainsAny(parts[0], " \t\"=\\") {
+			return "", fmt.Errorf("%q: invalid key", pair)
+		}
+		if err := singleLine(parts[1]); err != nil {
+			return "", fmt.Errorf("%q: %s", pair, err)
+		}
+		if _, ok := kvs[parts[0]]; !ok {
+			keys = append(keys, parts[0])
+		}
+		kvs[parts[0]] = parts[1]
+	}
+	sort.Strings(keys)
+	args := make([]string, len(keys))
+	for i, key := range keys {
+		args[i] = fmt.Sprintf(`%s="%s"`, key, strings.Replace(kvs[key], `"`, `\"`, -1))
+	}
+	return strings.Join(args, " "), nil
+}
+
+// singleLine returns an error if s spans several lines, or would continue
+// onto the next line, which a generated instruction cannot do.
+func singleLine(s string) error {
+	if strings.ContainsAny(s, "\r\n") {
+		return errors.New("contains a newline")
+	} else if strings.HasSuffix(s, `\`) {
+		return errors.New("ends with a backslash")
+	}
+	return nil
+}
+
+// validate parses the dockerfile, and checks that it has a single stage.
+func validate(contents string) error {
+	stages, err := dockerfile.ParseFile(contents, nil)
+	if err != nil {
+		return fmt.Errorf("failed to parse changes: %s", err)
+	}
+	if len(stages) != 1 {
+		return fmt.Errorf("changes define %d stages, expected 1", len(stages))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commit
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/parser/dockerfile"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangesDockerfile(t *testing.T) {
+	require := require.New(t)
+
+	contents, err := Changes{
+		Base:         "alpine:3.9",
+		Env:          []string{"PATH=/opt/bin:/bin", "GREETING=hello \"world\""},
+		Copy:         []string{"app:/opt/bin/app"},
+		Run:          []string{"apk add --no-cache curl && chmod +x /opt/bin/app"},
+		Labels:       []string{"version=1.2"},
+		Instructions: []string{`CMD ["/opt/bin/app"]`},
+	}.Dockerfile()
+	require.NoError(err)
+	require.Equal(`FROM alpine:3.9
+ENV GREETING="hello \"world\"" PATH="/opt/bin:/bin"
+COPY ["app","/opt/bin/app"]
+RUN apk add --no-cache curl && chmod +x /opt/bin/app
+LABEL version="1.2"
+CMD ["/opt/bin/app"]
+`, contents)
+
+	stages, err := dockerfile.ParseFile(contents, nil)
+	require.NoError(err)
+	require.Len(stages, 1)
+	env, ok := stages[0].Directives[0].(*dockerfile.EnvDirective)
+	require.True(ok)
+	require.Equal(map[string]string{
+		"GREETING": `hello "world"`,
+		"PATH":     "/opt/bin:/bin",
+	}, env.Envs)
+}
+
+func TestChangesDockerfileInvalid(t *testing.T) {
+	for _, changes := range []Changes{
+		{},
+		{Base: "alpine", Env: []string{"PATH"}},
+		{Base: "alpine", Env: []string{"A B=c"}},
+		{Base: "alpine", Copy: []string{"app"}},
+		{Base: "alpine", Run: []string{"echo a\necho b"}},
+		{Base: "alpine", Run: []string{`echo \`}},
+		{Base: "alpine", Instructions: []string{"FROM scratch"}},
+		{Base: "alpine", Instructions: []string{"BOGUS x"}},
+	} {
+		_, err := changes.Dockerfile()
+		require.Error(t, err, "%+v", changes)
+	}
+}
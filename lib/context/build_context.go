@@ -17,11 +17,24 @@ package context
 import (
 	"encoding/base64"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/failure"
+	"github.com/uber/makisu/lib/isolation"
+	"github.com/uber/makisu/lib/notify"
+	"github.com/uber/makisu/lib/passwd"
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/platform"
+	"github.com/uber/makisu/lib/profile"
+	"github.com/uber/makisu/lib/progress"
+	"github.com/uber/makisu/lib/secrets"
+	"github.com/uber/makisu/lib/shell"
 	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/steplog"
 	"github.com/uber/makisu/lib/storage"
 
 	"github.com/andres-erbsen/clock"
@@ -31,6 +44,26 @@ const (
 	_stagesDir = "stages"
 )
 
+// DefaultPath is the PATH of images whose base image doesn't set one, like in
+// docker build.
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// DefaultShell is the shell running the commands of RUN steps, like in docker
+// build.
+var DefaultShell = []string{"/bin/sh", "-c"}
+
+// LayerStream receives the compressed content of a layer while it is being
+// committed, e.g. to upload it to a registry.
+type LayerStream interface {
+	io.Writer
+
+	// Commit is called once the layer is complete, with its digest.
+	Commit(digest image.Digest) error
+
+	// Cancel is called instead of Commit if the layer could not be streamed.
+	Cancel()
+}
+
 // BuildContext stores build state for one build stage.
 type BuildContext struct {
 	RootDir    string // Root of the build file system. Always "/" in production.
@@ -47,9 +80,98 @@ type BuildContext struct {
 	MemFS      *snapshot.MemFS     // Merged view of base layers. Layers should be merged in order.
 	ImageStore *storage.ImageStore // Stores image layers and manifests.
 
+	// Users resolves the user and group names of the stage, against the
+	// /etc/passwd and /etc/group files of its root.
+	Users *passwd.DB
+
 	CopyOps   []*snapshot.CopyOperation
 	MustScan  bool
 	stagesDir string // Contains dirs with files needed for 'copy --from' operations.
+
+	// Excludes are path patterns left out of all layers committed by scan.
+	// ScanExcludes are added by the steps of the next layer only.
+	Excludes     []string
+	ScanExcludes []string
+	// CleanPackageCaches leaves the caches of apt, yum, dnf and apk out of
+	// the layers of the RUN steps installing packages with them.
+	CleanPackageCaches bool
+
+	// IncrementalScan makes RUN steps watch the file system, so only the
+	// directories they changed are scanned.
+	IncrementalScan bool
+	// OverlaySnapshot makes RUN steps run in an overlay of the root, so the
+	// directories they changed are derived from its upper dir.
+	OverlaySnapshot bool
+	// IsolateRuns makes RUN steps run in namespaces of their own, where the
+	// files of makisu are hidden, see package isolation.
+	IsolateRuns bool
+	// Runtime runs the isolated RUN steps. isolation.Namespaces if nil.
+	Runtime isolation.Runtime
+	// Hermetic makes RUN steps run isolated and without network access.
+	// Base images must also be pinned by digest, see builder.NewBuildPlan.
+	Hermetic bool
+	// StepTimeout, if set, is how long the command of a RUN step can run.
+	// Deadline, if set, is when the build times out, which also kills the
+	// command of the current RUN step.
+	StepTimeout time.Duration
+	Deadline    time.Time
+	// RunRetry is how the commands of RUN steps are retried when they fail.
+	// '#!RETRY' annotations override its number of retries.
+	RunRetry shell.RetryPolicy
+	// RunEnv, if not nil, is the env of the commands of RUN steps, before the
+	// ENV and ARGs of the stage, instead of the env of makisu.
+	RunEnv []string
+	// StepLogs, if set, writes the output of RUN steps to files.
+	StepLogs *steplog.Dir
+
+	// Secrets, if set, detects secrets in the layers committed by steps.
+	Secrets *secrets.Detector
+
+	// StartLayerStream, if set, is called for each committed layer.
+	StartLayerStream func() (LayerStream, error)
+	// ExtractLimits bound what each base image expands to when extracted.
+	ExtractLimits snapshot.ExtractLimits
+	// WarnBaseUpdates logs a warning if a base image changed since it was
+	// last pulled in the image store.
+	WarnBaseUpdates bool
+	// VerifyBaseImage, if set, is called before pulling a base image. It
+	// returns the digest to pull the image at, or an empty digest to pull it
+	// by tag.
+	VerifyBaseImage func(name image.Name) (image.Digest, error)
+
+	// NamedContexts are the additional context dirs that 'COPY --from=<name>'
+	// reads from, by name.
+	NamedContexts map[string]string
+	// NamedImages are the images that replace <name> in 'FROM <name>' and
+	// 'COPY --from=<name>'.
+	NamedImages map[string]string
+	// ContextChown, if set, is the numeric "<uid>:<gid>" owning the files
+	// copied from contexts without --chown, instead of root.
+	ContextChown string
+
+	// Platform is the platform of the image, whose manifest is pulled from
+	// the manifest lists of base images.
+	Platform platform.Platform
+	// DefaultPath is set as the PATH of images whose base image doesn't set
+	// one, like scratch, so RUN steps don't run with the PATH of makisu. No
+	// PATH is set if empty.
+	DefaultPath string
+	// Shell runs the commands of RUN steps, given as its last argument.
+	Shell []string
+	// Strict builds with the semantics of docker build where makisu differs:
+	// ENTRYPOINT clears the CMD of the base image, and WORKDIR creates its
+	// directory owned by the USER without expanding the env of makisu.
+	Strict bool
+
+	// Profile records the duration of the phases of the build, if set.
+	Profile *profile.Recorder
+	// Failure records the details of a failure of the build, if set.
+	Failure *failure.Recorder
+	// Notifier sends the lifecycle events of the build to a webhook, if set.
+	Notifier *notify.Notifier
+	// Progress writes the progress of the build in the BuildKit format, if
+	// set.
+	Progress *progress.Writer
 }
 
 // NewBuildContext inits a new BuildContext object.
@@ -61,21 +183,33 @@ func NewBuildContext(
 		return nil, fmt.Errorf("create stages dir: %s", err)
 	}
 
-	blacklist := append(pathutils.DefaultBlacklist, contextDir, imageStore.RootDir)
+	// Append to a copy, the default blacklist can have spare capacity and
+	// another append to it would overwrite the context dir entry.
+	blacklist := append(
+		append([]string{}, pathutils.DefaultBlacklist...), contextDir, imageStore.RootDir)
 	memFS, err := snapshot.NewMemFS(clock.New(), rootDir, blacklist)
 	if err != nil {
 		return nil, fmt.Errorf("init memfs: %s", err)
 	}
+	memFS.SpaceCheck = func(size int64) error {
+		return storage.CheckFreeSpace(imageStore.SandboxDir, size, "commit layer")
+	}
 
 	return &BuildContext{
-		RootDir:    rootDir,
-		ContextDir: contextDir,
-		StageVars:  make(map[string]string, 0),
-		MemFS:      memFS,
-		ImageStore: imageStore,
-		CopyOps:    make([]*snapshot.CopyOperation, 0),
-		MustScan:   false,
-		stagesDir:  stagesDir,
+		RootDir:       rootDir,
+		ContextDir:    contextDir,
+		StageVars:     make(map[string]string, 0),
+		MemFS:         memFS,
+		ImageStore:    imageStore,
+		Users:         passwd.New(rootDir),
+		CopyOps:       make([]*snapshot.CopyOperation, 0),
+		MustScan:      false,
+		stagesDir:     stagesDir,
+		NamedContexts: make(map[string]string),
+		NamedImages:   make(map[string]string),
+		Platform:      platform.Default(),
+		DefaultPath:   DefaultPath,
+		Shell:         DefaultShell,
 	}, nil
 }
 
@@ -89,5 +223,6 @@ func (ctx *BuildContext) CopyFromRoot(alias string) string {
 
 // Cleanup cleans up files kept across stages after the build is completed.
 func (ctx *BuildContext) Cleanup() error {
+	ctx.MemFS.StopWatching()
 	return os.RemoveAll(ctx.stagesDir)
 }
@@ -0,0 +1,160 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+// DockerignoreFile is the file of a context listing the patterns of the files
+// left out of it.
+const DockerignoreFile = ".dockerignore"
+
+// ContextDigestLabel is the label of images with the digest of their context.
+const ContextDigestLabel = "makisu.context.digest"
+
+// ReadDockerignore returns the patterns of the .dockerignore file of a context
+// dir, or nil if it has none. Patterns prefixed with '!' are exceptions.
+func ReadDockerignore(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, DockerignoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("open %s: %s", DockerignoreFile, err)
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		exception := strings.HasPrefix(line, "!")
+		line = path.Clean(strings.TrimPrefix(strings.TrimPrefix(line, "!"), "/"))
+		if line == "." {
+			continue
+		}
+		if exception {
+			line = "!" + line
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %s", DockerignoreFile, err)
+	}
+	return patterns, nil
+}
+
+// isIgnored returns true if the path relative to the context matches the
+// patterns of a .dockerignore file. Like docker, the last matching pattern
+// wins, and patterns also match the content of directories.
+func isIgnored(rel string, patterns []string) bool {
+	ignored := false
+	for _, pattern := range patterns {
+		exception := strings.HasPrefix(pattern, "!")
+		if pathutils.MatchesAnyPattern(rel, []string{strings.TrimPrefix(pattern, "!")}) {
+			ignored = !exception
+		}
+	}
+	return ignored
+}
+
+// Digest returns the sha256 digest of the content of a context dir, without
+// the files its .dockerignore file ignores. It covers the paths, types,
+// permissions, symlink targets and content of files, but not their owners nor
+// times, so checkouts of the same sources have the same digest.
+func Digest(dir string) (image.Digest, error) {
+	patterns, err := ReadDockerignore(dir)
+	if err != nil {
+		return "", err
+	}
+	hasExceptions := false
+	for _, pattern := range patterns {
+		hasExceptions = hasExceptions || strings.HasPrefix(pattern, "!")
+	}
+
+	h := sha256.New()
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		} else if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if isIgnored(rel, patterns) {
+			// Exceptions can bring back files of ignored directories.
+			if fi.IsDir() && !hasExceptions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		mode := fi.Mode()
+		switch {
+		case mode.IsDir():
+			fmt.Fprintf(h, "d %o %q\n", mode.Perm(), rel)
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "l %o %q %q\n", mode.Perm(), rel, target)
+		case mode.IsRegular():
+			sum, err := fileSHA256(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "f %o %q %s\n", mode.Perm(), rel, sum)
+		default:
+			fmt.Fprintf(h, "o %o %q\n", mode, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("walk context: %s", err)
+	}
+	return image.Digest("sha256:" + hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// fileSHA256 returns the hex sha256 of the content of a file.
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
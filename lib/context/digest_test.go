@@ -0,0 +1,103 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDockerignore(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	patterns, err := ReadDockerignore(dir)
+	require.NoError(err)
+	require.Nil(patterns)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, DockerignoreFile),
+		[]byte("# comment\n\n/build/\n  *.log \n!keep.log\n.\n"), 0644))
+	patterns, err = ReadDockerignore(dir)
+	require.NoError(err)
+	require.Equal([]string{"build", "*.log", "!keep.log"}, patterns)
+
+	require.True(isIgnored("build", patterns))
+	require.True(isIgnored("build/out/bin", patterns))
+	require.True(isIgnored("debug.log", patterns))
+	require.False(isIgnored("keep.log", patterns))
+	require.False(isIgnored("src/debug.log", patterns))
+	require.False(isIgnored("main.go", patterns))
+}
+
+func TestDigest(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		require.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(ioutil.WriteFile(p, []byte(content), 0644))
+	}
+	write("src/main.go", "package main")
+	write("build/bin", "binary")
+	write("app.log", "log")
+	write(DockerignoreFile, "build\n*.log\n")
+
+	digest, err := Digest(dir)
+	require.NoError(err)
+	require.True(strings.HasPrefix(string(digest), "sha256:"))
+
+	// Ignored files don't change the digest.
+	write("build/bin", "other binary")
+	write("app.log", "other log")
+	same, err := Digest(dir)
+	require.NoError(err)
+	require.Equal(digest, same)
+
+	// Content, permissions and symlinks do.
+	write("src/main.go", "package main\n")
+	changed, err := Digest(dir)
+	require.NoError(err)
+	require.NotEqual(digest, changed)
+
+	require.NoError(os.Chmod(filepath.Join(dir, "src/main.go"), 0755))
+	chmoded, err := Digest(dir)
+	require.NoError(err)
+	require.NotEqual(changed, chmoded)
+
+	require.NoError(os.Symlink("src/main.go", filepath.Join(dir, "link")))
+	linked, err := Digest(dir)
+	require.NoError(err)
+	require.NotEqual(chmoded, linked)
+
+	// Exceptions bring back files of ignored dirs.
+	write(DockerignoreFile, "build\n*.log\n!build/bin\n")
+	withException, err := Digest(dir)
+	require.NoError(err)
+	write("build/bin", "binary")
+	changedException, err := Digest(dir)
+	require.NoError(err)
+	require.NotEqual(withException, changedException)
+}
@@ -0,0 +1,109 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Labels set on images from the git metadata of their context.
+const (
+	GitRevisionLabel = "org.opencontainers.image.revision"
+	GitBranchLabel   = "makisu.git.branch"
+	GitDirtyLabel    = "makisu.git.dirty"
+)
+
+// GitMetadata describes the commit a build context is checked out at.
+type GitMetadata struct {
+	SHA string
+	// Branch is empty if the commit is not checked out from a branch.
+	Branch string
+	// Dirty is true if the work tree has uncommitted changes.
+	Dirty      bool
+	CommitTime time.Time
+}
+
+// ReadGitMetadata reads the metadata of the git repository dir is in. It
+// returns nil if dir is not in a git repository.
+func ReadGitMetadata(dir string) (*GitMetadata, error) {
+	if _, err := gitOutput(dir, "rev-parse", "--git-dir"); err != nil {
+		return nil, nil
+	}
+	sha, err := gitOutput(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	// Detached heads are not on a branch, symbolic-ref fails for them.
+	branch, _ := gitOutput(dir, "symbolic-ref", "-q", "--short", "HEAD")
+	status, err := gitOutput(dir, "status", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := gitOutput(dir, "log", "-1", "--format=%ct")
+	if err != nil {
+		return nil, err
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse commit time %q: %s", timestamp, err)
+	}
+	return &GitMetadata{
+		SHA:        sha,
+		Branch:     branch,
+		Dirty:      status != "",
+		CommitTime: time.Unix(seconds, 0).UTC(),
+	}, nil
+}
+
+// BuildArgs returns the GIT_SHA, GIT_BRANCH and GIT_DIRTY build args, in the
+// format of --build-arg.
+func (m *GitMetadata) BuildArgs() []string {
+	return []string{
+		"GIT_SHA=" + m.SHA,
+		"GIT_BRANCH=" + m.Branch,
+		"GIT_DIRTY=" + strconv.FormatBool(m.Dirty),
+	}
+}
+
+// Labels returns the labels describing the commit, without the branch if it's
+// unknown.
+func (m *GitMetadata) Labels() map[string]string {
+	labels := map[string]string{
+		GitRevisionLabel: m.SHA,
+		GitDirtyLabel:    strconv.FormatBool(m.Dirty),
+	}
+	if m.Branch != "" {
+		labels[GitBranchLabel] = m.Branch
+	}
+	return labels
+}
+
+// gitOutput runs a git command in dir and returns its trimmed output.
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %s", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
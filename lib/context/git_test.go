@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadGitMetadata(t *testing.T) {
+	require := require.New(t)
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmp)
+
+	metadata, err := ReadGitMetadata(tmp)
+	require.NoError(err)
+	require.Nil(metadata)
+
+	require.NoError(os.MkdirAll(filepath.Join(tmp, "app"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmp, "app/Dockerfile"), []byte("FROM alpine"), 0644))
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"checkout", "-q", "-b", "release"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = tmp
+		cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE=1600000000 +0000")
+		out, err := cmd.CombinedOutput()
+		require.NoError(err, string(out))
+	}
+
+	metadata, err = ReadGitMetadata(filepath.Join(tmp, "app"))
+	require.NoError(err)
+	require.Len(metadata.SHA, 40)
+	require.Equal("release", metadata.Branch)
+	require.False(metadata.Dirty)
+	require.Equal(time.Unix(1600000000, 0).UTC(), metadata.CommitTime)
+	require.Equal([]string{
+		"GIT_SHA=" + metadata.SHA, "GIT_BRANCH=release", "GIT_DIRTY=false"}, metadata.BuildArgs())
+	require.Equal(map[string]string{
+		GitRevisionLabel: metadata.SHA,
+		GitBranchLabel:   "release",
+		GitDirtyLabel:    "false",
+	}, metadata.Labels())
+
+	require.NoError(ioutil.WriteFile(filepath.Join(tmp, "app/Dockerfile"), []byte("FROM debian"), 0644))
+	metadata, err = ReadGitMetadata(filepath.Join(tmp, "app"))
+	require.NoError(err)
+	require.True(metadata.Dirty)
+	require.Equal("true", metadata.Labels()[GitDirtyLabel])
+}
@@ -0,0 +1,126 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestEntry is a file of a context manifest.
+type ManifestEntry struct {
+	// Path is relative to the context, with slashes.
+	Path string `json:"path"`
+	// Mode holds the type and permissions of the file.
+	Mode os.FileMode `json:"mode"`
+	// Digest is the hex sha256 of the content of regular files.
+	Digest string `json:"digest,omitempty"`
+	// Link is the target of symlinks.
+	Link string `json:"link,omitempty"`
+}
+
+// Manifest lists the files of a context dir with the digests of their
+// content, so a context can be synced by sending only the content a receiver
+// doesn't have yet.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// NewManifest returns the manifest of a context dir. Entries are in lexical
+// order, so parents come before their content.
+func NewManifest(dir string) (*Manifest, error) {
+	m := &Manifest{Entries: []ManifestEntry{}}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		} else if rel == "." {
+			return nil
+		}
+		entry := ManifestEntry{Path: filepath.ToSlash(rel), Mode: fi.Mode()}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if entry.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if fi.Mode().IsRegular() {
+			if entry.Digest, err = fileSHA256(p); err != nil {
+				return err
+			}
+		}
+		m.Entries = append(m.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk context: %s", err)
+	}
+	return m, nil
+}
+
+// Digests returns the digests of the content of the regular files, once
+// each, and a path of a file of each.
+func (m *Manifest) Digests() map[string]string {
+	digests := make(map[string]string)
+	for _, entry := range m.Entries {
+		if entry.Mode.IsRegular() {
+			if _, ok := digests[entry.Digest]; !ok {
+				digests[entry.Digest] = entry.Path
+			}
+		}
+	}
+	return digests
+}
+
+// Validate returns an error if an entry would be written outside of the
+// context, either because its path escapes it or because it is under a
+// symlink.
+func (m *Manifest) Validate() error {
+	symlinks := make(map[string]bool)
+	for _, entry := range m.Entries {
+		p := entry.Path
+		if p == "" || path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("invalid path in context manifest: %q", p)
+		}
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if symlinks[dir] {
+				return fmt.Errorf("path under symlink in context manifest: %q", p)
+			}
+		}
+		if entry.Mode&os.ModeSymlink != 0 {
+			symlinks[p] = true
+		} else if entry.Mode.IsRegular() && !isSHA256(entry.Digest) {
+			return fmt.Errorf("invalid digest of %q in context manifest: %q", p, entry.Digest)
+		}
+	}
+	return nil
+}
+
+// isSHA256 returns true if s is a hex sha256.
+func isSHA256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
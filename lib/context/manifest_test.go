@@ -0,0 +1,67 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewManifest(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	require.NoError(os.MkdirAll(filepath.Join(dir, "src"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "src", "a"), []byte("same"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "src", "b"), []byte("same"), 0755))
+	require.NoError(os.Symlink("src/a", filepath.Join(dir, "link")))
+
+	m, err := NewManifest(dir)
+	require.NoError(err)
+	require.NoError(m.Validate())
+	require.Len(m.Entries, 4)
+	require.Equal("link", m.Entries[0].Path)
+	require.Equal("src/a", m.Entries[0].Link)
+	require.Equal("src", m.Entries[1].Path)
+	require.True(m.Entries[1].Mode.IsDir())
+	require.Equal("src/a", m.Entries[2].Path)
+	require.Equal(os.FileMode(0755), m.Entries[3].Mode)
+
+	// Files with the same content share their digest.
+	sum, err := fileSHA256(filepath.Join(dir, "src", "a"))
+	require.NoError(err)
+	require.Equal(sum, m.Entries[3].Digest)
+	require.Equal(map[string]string{sum: "src/a"}, m.Digests())
+}
+
+func TestManifestValidate(t *testing.T) {
+	digest := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	for _, entries := range [][]ManifestEntry{
+		{{Path: "/etc/passwd", Mode: 0644, Digest: digest}},
+		{{Path: "../passwd", Mode: 0644, Digest: digest}},
+		{{Path: "a/../../passwd", Mode: 0644, Digest: digest}},
+		{{Path: "a", Mode: 0644, Digest: "../passwd"}},
+		{{Path: "etc", Mode: os.ModeSymlink | 0777, Link: "/etc"}, {Path: "etc/passwd", Mode: 0644, Digest: digest}},
+	} {
+		m := &Manifest{Entries: entries}
+		require.Error(t, m.Validate(), "%v", entries)
+	}
+}
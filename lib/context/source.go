@@ -0,0 +1,264 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// StdinContext is the context source of a tar read from stdin.
+const StdinContext = "-"
+
+// DockerImagePrefix is the prefix of named contexts that are images.
+const DockerImagePrefix = "docker-image://"
+
+// _contextDownloadTimeout bounds the download of a remote context tar.
+const _contextDownloadTimeout = 30 * time.Minute
+
+// _gzipMagic is the magic number of gzip content.
+var _gzipMagic = []byte{0x1f, 0x8b}
+
+// GitSource is a git repository to clone a context from, in the same syntax as
+// docker: "<url>#<ref>:<subdir>", where the ref and subdir are optional.
+type GitSource struct {
+	URL    string
+	Ref    string
+	Subdir string
+}
+
+// ParseGitSource parses a git context source. It returns false if source is
+// not a git URL: one starting with git://, git@ or ssh://, or an http(s) URL
+// whose path ends with .git.
+func ParseGitSource(source string) (GitSource, bool) {
+	url, fragment := source, ""
+	if i := strings.Index(source, "#"); i >= 0 {
+		url, fragment = source[:i], source[i+1:]
+	}
+	isGit := false
+	for _, prefix := range []string{"git://", "git@", "ssh://"} {
+		if strings.HasPrefix(url, prefix) {
+			isGit = true
+		}
+	}
+	if isHTTPSource(url) && strings.HasSuffix(url, ".git") {
+		isGit = true
+	}
+	if !isGit {
+		return GitSource{}, false
+	}
+	git := GitSource{URL: url}
+	if i := strings.Index(fragment, ":"); i >= 0 {
+		git.Ref, git.Subdir = fragment[:i], fragment[i+1:]
+	} else {
+		git.Ref = fragment
+	}
+	return git, true
+}
+
+func isHTTPSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// IsRemoteSource returns true if the context source is not a local directory,
+// and must be fetched with FetchContext.
+func IsRemoteSource(source string) bool {
+	_, isGit := ParseGitSource(source)
+	return source == StdinContext || isHTTPSource(source) || isGit
+}
+
+// ParseNamedContext parses an additional named context "<name>=<source>". The
+// source is either an image prefixed by DockerImagePrefix, or a context source
+// other than StdinContext.
+func ParseNamedContext(value string) (name, source string, err error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected <name>=<source>: %s", value)
+	}
+	name, source = parts[0], parts[1]
+	if _, err := strconv.Atoi(name); err == nil {
+		return "", "", fmt.Errorf("context name cannot be a number: %s", name)
+	} else if source == StdinContext {
+		return "", "", fmt.Errorf("context %s cannot be read from stdin", name)
+	} else if source == DockerImagePrefix {
+		return "", "", fmt.Errorf("missing image of context %s", name)
+	}
+	return name, source, nil
+}
+
+// FetchContext writes the context from a remote source in dir, and returns the
+// directory of the context, which is a sub dir of dir for git sources with a
+// subdir. The source is either StdinContext for a tar, optionally compressed,
+// read from stdin, a git URL, or an http(s) URL of a tar.
+func FetchContext(source, dir string, stdin io.Reader) (string, error) {
+	contextDir, _, err := FetchContextWithGitMetadata(source, dir, stdin)
+	return contextDir, err
+}
+
+// FetchContextWithGitMetadata is like FetchContext, but also returns the
+// metadata of the commit of git sources, read before their .git dirs are
+// removed. It's nil for other sources.
+func FetchContextWithGitMetadata(
+	source, dir string, stdin io.Reader) (string, *GitMetadata, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("create context dir: %s", err)
+	}
+	if git, ok := ParseGitSource(source); ok {
+		return fetchGitContext(git, dir)
+	}
+	if source == StdinContext {
+		log.Infof("Reading build context from stdin")
+		return dir, nil, untarContext(stdin, dir)
+	}
+	if !isHTTPSource(source) {
+		return "", nil, fmt.Errorf("unsupported context source: %s", source)
+	}
+	log.Infof("Downloading build context from %s", source)
+	resp, err := httputil.Send("GET", source, httputil.SendTimeout(_contextDownloadTimeout))
+	if err != nil {
+		return "", nil, fmt.Errorf("download context: %s", err)
+	}
+	defer resp.Body.Close()
+	return dir, nil, untarContext(resp.Body, dir)
+}
+
+// untarContext extracts a tar, plain or compressed with gzip or zstd, in dir.
+func untarContext(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(_gzipMagic))
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("read context: %s", err)
+	}
+	format, err := tario.DetectCompression(br)
+	if err != nil {
+		return fmt.Errorf("detect context compression: %s", err)
+	}
+	var tr io.Reader = br
+	if bytes.Equal(magic, _gzipMagic) || format == tario.CompressionZstd {
+		decompressed, err := tario.NewDecompressReader(br)
+		if err != nil {
+			return fmt.Errorf("decompress context: %s", err)
+		}
+		defer decompressed.Close()
+		tr = decompressed
+	}
+	if err := tario.Untar(tr, dir); err != nil {
+		return fmt.Errorf("untar context: %s", err)
+	}
+	return nil
+}
+
+// fetchGitContext makes a shallow clone of the ref of a git repository in dir,
+// and returns the metadata of its commit. The .git dirs are removed, so they
+// don't end up in images.
+func fetchGitContext(git GitSource, dir string) (string, *GitMetadata, error) {
+	ref := git.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	log.Infof("Cloning build context from %s at %s", git.URL, ref)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"remote", "add", "origin", git.URL},
+		// Fetching a single ref works with branches, tags and commit shas.
+		{"fetch", "-q", "--depth", "1", "origin", ref},
+		{"checkout", "-q", "FETCH_HEAD"},
+		{"submodule", "update", "-q", "--init", "--recursive", "--depth", "1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", nil, fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	metadata, err := ReadGitMetadata(dir)
+	if err != nil {
+		return "", nil, fmt.Errorf("read git metadata: %s", err)
+	}
+	if metadata != nil {
+		// FETCH_HEAD is checked out detached.
+		metadata.Branch = remoteBranch(dir, ref)
+	}
+	if err := removeGitDirs(dir); err != nil {
+		return "", nil, fmt.Errorf("remove .git: %s", err)
+	}
+
+	contextDir := filepath.Join(dir, filepath.FromSlash(git.Subdir))
+	if rel, err := filepath.Rel(dir, contextDir); err != nil || strings.HasPrefix(rel, "..") {
+		return "", nil, fmt.Errorf("invalid context subdir: %s", git.Subdir)
+	}
+	if fi, err := os.Stat(contextDir); err != nil || !fi.IsDir() {
+		return "", nil, fmt.Errorf("context subdir %s is not a directory in %s", git.Subdir, git.URL)
+	}
+	return contextDir, metadata, nil
+}
+
+// remoteBranch returns the branch of origin a fetched ref is, or the branch
+// HEAD points to, or an empty string if it's a tag or a commit sha.
+func remoteBranch(dir, ref string) string {
+	if ref == "HEAD" {
+		// Prints "ref: refs/heads/<branch>\tHEAD" first.
+		out, err := gitOutput(dir, "ls-remote", "--symref", "origin", "HEAD")
+		if err != nil || !strings.HasPrefix(out, "ref: refs/heads/") {
+			return ""
+		}
+		return strings.Fields(strings.TrimPrefix(out, "ref: refs/heads/"))[0]
+	}
+	branch := strings.TrimPrefix(ref, "refs/heads/")
+	out, err := gitOutput(dir, "ls-remote", "--heads", "origin", "refs/heads/"+branch)
+	if err != nil || out == "" {
+		return ""
+	}
+	return branch
+}
+
+// removeGitDirs removes the .git dirs of a clone and its submodules.
+func removeGitDirs(dir string) error {
+	var gitDirs []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Name() == ".git" {
+			gitDirs = append(gitDirs, p)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range gitDirs {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGitSource(t *testing.T) {
+	require := require.New(t)
+
+	for source, expected := range map[string]GitSource{
+		"https://github.com/uber/makisu.git":             {URL: "https://github.com/uber/makisu.git"},
+		"https://github.com/uber/makisu.git#v1.0":        {URL: "https://github.com/uber/makisu.git", Ref: "v1.0"},
+		"git@github.com:uber/makisu.git#master:testdata": {URL: "git@github.com:uber/makisu.git", Ref: "master", Subdir: "testdata"},
+		"git://host/repo#:sub/dir":                       {URL: "git://host/repo", Subdir: "sub/dir"},
+	} {
+		git, ok := ParseGitSource(source)
+		require.True(ok, source)
+		require.Equal(expected, git, source)
+		require.True(IsRemoteSource(source))
+	}
+	for _, source := range []string{"https://example.com/context.tar.gz", "./context", "-"} {
+		_, ok := ParseGitSource(source)
+		require.False(ok, source)
+	}
+	require.True(IsRemoteSource("-"))
+	require.True(IsRemoteSource("https://example.com/context.tar.gz"))
+	require.False(IsRemoteSource("./context"))
+}
+
+func TestParseNamedContext(t *testing.T) {
+	require := require.New(t)
+
+	name, source, err := ParseNamedContext("vendor=./third_party")
+	require.NoError(err)
+	require.Equal("vendor", name)
+	require.Equal("./third_party", source)
+
+	name, source, err = ParseNamedContext("base=docker-image://alpine:3.19")
+	require.NoError(err)
+	require.Equal("base", name)
+	require.Equal("docker-image://alpine:3.19", source)
+
+	for _, value := range []string{"vendor", "=dir", "vendor=", "0=dir", "vendor=-", "base=docker-image://"} {
+		_, _, err := ParseNamedContext(value)
+		require.Error(err, value)
+	}
+}
+
+func makeContextTar(t *testing.T, compress bool) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	gw := gzip.NewWriter(&buf)
+	if compress {
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	for _, hdr := range []*tar.Header{
+		{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "app/Dockerfile", Typeflag: tar.TypeReg, Mode: 0644, Size: 11},
+		{Name: "app/link", Typeflag: tar.TypeSymlink, Linkname: "Dockerfile"},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("FROM alpine"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	if compress {
+		require.NoError(t, gw.Close())
+	}
+	return buf.Bytes()
+}
+
+func TestFetchContext(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmp)
+
+	checkContext := func(dir string) {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "app/Dockerfile"))
+		require.NoError(err)
+		require.Equal("FROM alpine", string(content))
+		target, err := os.Readlink(filepath.Join(dir, "app/link"))
+		require.NoError(err)
+		require.Equal("Dockerfile", target)
+	}
+
+	// Plain and compressed tars from stdin.
+	for i, compress := range []bool{false, true} {
+		dir := filepath.Join(tmp, "stdin", string(rune('a'+i)))
+		contextDir, err := FetchContext(StdinContext, dir, bytes.NewReader(makeContextTar(t, compress)))
+		require.NoError(err)
+		require.Equal(dir, contextDir)
+		checkContext(contextDir)
+	}
+
+	// Tar from a URL.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(makeContextTar(t, true))
+	}))
+	defer server.Close()
+	contextDir, err := FetchContext(server.URL+"/context.tar.gz", filepath.Join(tmp, "http"), nil)
+	require.NoError(err)
+	checkContext(contextDir)
+}
+
+func TestFetchGitContext(t *testing.T) {
+	require := require.New(t)
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmp)
+
+	repo := filepath.Join(tmp, "repo")
+	require.NoError(os.MkdirAll(filepath.Join(repo, "app"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(repo, "app/Dockerfile"), []byte("FROM alpine"), 0644))
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+		{"tag", "v1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		require.NoError(err, string(out))
+	}
+
+	dir := filepath.Join(tmp, "clone")
+	require.NoError(os.MkdirAll(dir, 0755))
+	contextDir, metadata, err := fetchGitContext(GitSource{URL: repo, Ref: "v1", Subdir: "app"}, dir)
+	require.NoError(err)
+	require.Equal(filepath.Join(dir, "app"), contextDir)
+	require.Len(metadata.SHA, 40)
+	require.Equal("", metadata.Branch)
+	require.False(metadata.Dirty)
+	content, err := ioutil.ReadFile(filepath.Join(contextDir, "Dockerfile"))
+	require.NoError(err)
+	require.Equal("FROM alpine", string(content))
+	_, err = os.Stat(filepath.Join(dir, ".git"))
+	require.True(os.IsNotExist(err))
+
+	// The default branch depends on the git config.
+	branch, err := gitOutput(repo, "symbolic-ref", "--short", "HEAD")
+	require.NoError(err)
+	dir = filepath.Join(tmp, "clone2")
+	require.NoError(os.MkdirAll(dir, 0755))
+	_, metadata, err = fetchGitContext(GitSource{URL: repo}, dir)
+	require.NoError(err)
+	require.Equal(branch, metadata.Branch)
+
+	dir = filepath.Join(tmp, "clone3")
+	require.NoError(os.MkdirAll(dir, 0755))
+	_, _, err = fetchGitContext(GitSource{URL: repo, Subdir: "../.."}, dir)
+	require.Error(err)
+}
@@ -0,0 +1,210 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/uber/makisu/lib/context"
+)
+
+// _requestFlags are the build flags requests can pass, and whether they take a
+// value. The others configure the host the daemon runs on: its credentials,
+// its storage, the files it reads and writes, and the commands and URLs it
+// runs and calls.
+var _requestFlags = map[string]bool{
+	"file":                       true,
+	"context":                    true,
+	"tag":                        true,
+	"push":                       true,
+	"replica":                    true,
+	"push-standby":               true,
+	"annotation":                 true,
+	"target":                     true,
+	"platform":                   true,
+	"build-arg":                  true,
+	"secret-build-arg":           true,
+	"commit":                     true,
+	"blacklist":                  true,
+	"auto-blacklist":             false,
+	"exclude":                    true,
+	"clean-package-caches":       false,
+	"detect-secrets":             true,
+	"secret-allow":               true,
+	"squash":                     false,
+	"squash-from":                true,
+	"entrypoint":                 true,
+	"cmd":                        true,
+	"env":                        true,
+	"user":                       true,
+	"workdir":                    true,
+	"dry-run":                    false,
+	"warn-base-updates":          false,
+	"max-base-size":              true,
+	"max-base-files":             true,
+	"max-base-path-depth":        true,
+	"locked":                     false,
+	"max-image-size":             true,
+	"max-layer-size":             true,
+	"size-budget-warn-only":      false,
+	"max-layer-files":            true,
+	"compression":                true,
+	"compression-level":          true,
+	"source-date-epoch":          true,
+	"epoch":                      true,
+	"created":                    true,
+	"git-metadata":               false,
+	"context-digest":             false,
+	"incremental-scan":           false,
+	"hermetic":                   false,
+	"default-path":               true,
+	"default-shell":              true,
+	"digest-algorithm":           true,
+	"step-timeout":               true,
+	"build-timeout":              true,
+	"retry-run-steps":            true,
+	"retry-run-steps-backoff":    true,
+	"retry-run-steps-exit-codes": true,
+	"template":                   false,
+	"log-level":                  true,
+	"log-fmt":                    true,
+}
+
+// _flagShorthands maps the shorthands of build flags to their names.
+var _flagShorthands = map[string]string{
+	"f": "file",
+	"c": "context",
+	"t": "tag",
+}
+
+// checkArgs returns an error if the arguments of a request pass a flag that
+// isn't in _requestFlags, or one of the build flags of the server. Contexts
+// must be remote, a git or http(s) URL, unless local is true: clients of the
+// unix socket share a volume with the daemon, and pass the path of their
+// context on it.
+func (s *Server) checkArgs(args []string, local bool) error {
+	set := make(map[string]bool)
+	for _, arg := range s.opts.BuildFlags {
+		if name, _, ok := parseFlag(arg); ok {
+			set[name] = true
+		}
+	}
+	for i := 0; i < len(args); i++ {
+		name, value, ok := parseFlag(args[i])
+		if args[i] == "--" {
+			// Everything after it is an argument.
+			for _, arg := range args[i+1:] {
+				if err := checkContext(arg, local); err != nil {
+					return err
+				}
+			}
+			return nil
+		} else if !ok {
+			if err := checkContext(args[i], local); err != nil {
+				return err
+			}
+			continue
+		}
+		hasValue, allowed := _requestFlags[name]
+		if !allowed {
+			return fmt.Errorf("flag %s is not allowed in requests", args[i])
+		} else if set[name] {
+			return fmt.Errorf("flag --%s is set by the daemon and can't be overridden", name)
+		}
+		if hasValue && !strings.Contains(args[i], "=") && !isShorthandWithValue(args[i]) {
+			if i+1 == len(args) {
+				return fmt.Errorf("flag --%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		switch name {
+		case "context":
+			if err := checkContext(value, local); err != nil {
+				return err
+			}
+		case "file":
+			if err := checkDockerfile(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkContext returns an error if a context passed by a request is not a git
+// or http(s) URL, unless local contexts are allowed.
+func checkContext(source string, local bool) error {
+	if source == context.StdinContext {
+		return fmt.Errorf("context %s is only set by the daemon for context tars", source)
+	} else if !local && !context.IsRemoteSource(source) {
+		return fmt.Errorf("context %s is not a git or http(s) URL", source)
+	}
+	return nil
+}
+
+// checkDockerfile returns an error if the dockerfile of a request is not a
+// path in its context.
+func checkDockerfile(p string) error {
+	if p == "" || filepath.IsAbs(p) {
+		return fmt.Errorf("dockerfile %q is not relative to the context", p)
+	}
+	if clean := filepath.Clean(p); clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("dockerfile %s is outside of the context", p)
+	}
+	return nil
+}
+
+// parseFlag returns the name and the value, if any, of a flag argument, with
+// shorthands resolved to the name of their flag.
+func parseFlag(arg string) (name, value string, ok bool) {
+	if strings.HasPrefix(arg, "--") && len(arg) > 2 {
+		name = arg[2:]
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], name[i+1:]
+		}
+		return name, value, true
+	} else if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+		name = arg[1:2]
+		if long, ok := _flagShorthands[name]; ok {
+			name = long
+		}
+		return name, strings.TrimPrefix(arg[2:], "="), true
+	}
+	return "", "", false
+}
+
+// isShorthandWithValue returns true if arg is a shorthand followed by its
+// value, like -tapp:v1.
+func isShorthandWithValue(arg string) bool {
+	return !strings.HasPrefix(arg, "--") && len(arg) > 2
+}
+
+// modifyFS returns true if the build flags enable --modifyfs.
+func modifyFS(flags []string) bool {
+	enabled := false
+	for _, arg := range flags {
+		if name, value, ok := parseFlag(arg); ok && name == "modifyfs" {
+			enabled = true
+			if value != "" {
+				enabled, _ = strconv.ParseBool(value)
+			}
+		}
+	}
+	return enabled
+}
@@ -0,0 +1,239 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/uber/makisu/lib/context"
+)
+
+// ContextSync is the response of POST /context.
+type ContextSync struct {
+	// ID is passed to POST /build to build the context.
+	ID string `json:"id"`
+	// Missing are the digests of the content to upload to POST /context/blobs
+	// before the build.
+	Missing []string `json:"missing"`
+}
+
+// contextStore keeps the content of synced contexts by digest, and their
+// manifests by id, so repeated builds of a context only upload the files that
+// changed. Blobs and manifests are written to a temp file and renamed, so
+// concurrent syncs don't need locking.
+type contextStore struct {
+	dir string
+}
+
+func newContextStore(dir string) (*contextStore, error) {
+	for _, d := range []string{"blobs", "manifests", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("create context cache dir: %s", err)
+		}
+	}
+	return &contextStore{dir: dir}, nil
+}
+
+func (s *contextStore) blobPath(digest string) string {
+	return filepath.Join(s.dir, "blobs", digest)
+}
+
+func (s *contextStore) manifestPath(id string) string {
+	return filepath.Join(s.dir, "manifests", id+".json")
+}
+
+// putManifest saves a manifest, and returns its id and the digests of the
+// content the store is missing.
+func (s *contextStore) putManifest(m *context.Manifest) (string, []string, error) {
+	if err := m.Validate(); err != nil {
+		return "", nil, err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", nil, fmt.Errorf("marshal context manifest: %s", err)
+	}
+	sum := sha256.Sum256(b)
+	id := hex.EncodeToString(sum[:])
+	if err := s.writeFile(s.manifestPath(id), b); err != nil {
+		return "", nil, err
+	}
+	missing := []string{}
+	for digest := range m.Digests() {
+		if _, err := os.Stat(s.blobPath(digest)); os.IsNotExist(err) {
+			missing = append(missing, digest)
+		} else if err != nil {
+			return "", nil, fmt.Errorf("stat context blob: %s", err)
+		}
+	}
+	sort.Strings(missing)
+	return id, missing, nil
+}
+
+// putBlobs saves the content of a tar whose entries are named by the digest
+// of their content.
+func (s *contextStore) putBlobs(r io.Reader) (int, error) {
+	tr := tar.NewReader(r)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("read context blobs: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return n, fmt.Errorf("invalid context blob %q: not a regular file", hdr.Name)
+		}
+		if err := s.putBlob(hdr.Name, tr); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func (s *contextStore) putBlob(digest string, r io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Join(s.dir, "tmp"), "blob")
+	if err != nil {
+		return fmt.Errorf("create context blob: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return fmt.Errorf("write context blob: %s", err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("invalid context blob %q: content has digest %s", digest, actual)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write context blob: %s", err)
+	}
+	if err := os.Rename(f.Name(), s.blobPath(digest)); err != nil {
+		return fmt.Errorf("save context blob: %s", err)
+	}
+	return nil
+}
+
+// materialize writes the context of a manifest to dst. Blobs are copied
+// rather than linked, so builds can't modify the store.
+func (s *contextStore) materialize(id, dst string) error {
+	if !isManifestID(id) {
+		return fmt.Errorf("invalid context id: %q", id)
+	}
+	b, err := ioutil.ReadFile(s.manifestPath(id))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("unknown context id: %s", id)
+	} else if err != nil {
+		return fmt.Errorf("read context manifest: %s", err)
+	}
+	var m context.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("unmarshal context manifest: %s", err)
+	} else if err := m.Validate(); err != nil {
+		return err
+	}
+
+	// Permissions of directories are set last, since they may not allow
+	// writing their content.
+	var dirs []context.ManifestEntry
+	for _, entry := range m.Entries {
+		p := filepath.Join(dst, filepath.FromSlash(entry.Path))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return fmt.Errorf("create context dir: %s", err)
+		}
+		switch {
+		case entry.Mode.IsDir():
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return fmt.Errorf("create context dir: %s", err)
+			}
+			dirs = append(dirs, entry)
+		case entry.Mode&os.ModeSymlink != 0:
+			if err := os.Symlink(entry.Link, p); err != nil {
+				return fmt.Errorf("create context symlink: %s", err)
+			}
+		case entry.Mode.IsRegular():
+			if err := s.copyBlob(entry.Digest, p, entry.Mode.Perm()); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		p := filepath.Join(dst, filepath.FromSlash(dirs[i].Path))
+		if err := os.Chmod(p, dirs[i].Mode.Perm()); err != nil {
+			return fmt.Errorf("chmod context dir: %s", err)
+		}
+	}
+	return nil
+}
+
+func (s *contextStore) copyBlob(digest, p string, perm os.FileMode) error {
+	src, err := os.Open(s.blobPath(digest))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("missing context blob: %s", digest)
+	} else if err != nil {
+		return fmt.Errorf("open context blob: %s", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("create context file: %s", err)
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("copy context blob: %s", err)
+	}
+	// The mode given to OpenFile is masked by the umask.
+	if err := dst.Chmod(perm); err != nil {
+		return fmt.Errorf("chmod context file: %s", err)
+	}
+	return dst.Close()
+}
+
+func (s *contextStore) writeFile(p string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Join(s.dir, "tmp"), "manifest")
+	if err != nil {
+		return fmt.Errorf("create context manifest: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return fmt.Errorf("write context manifest: %s", err)
+	} else if err := f.Close(); err != nil {
+		return fmt.Errorf("write context manifest: %s", err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("save context manifest: %s", err)
+	}
+	return nil
+}
+
+// isManifestID returns true if id is a hex sha256, so it can't name a file
+// outside of the store.
+func isManifestID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,442 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package daemon implements a long-running build server. Each build runs in a
+// separate makisu process, since builds modify the file system and global
+// state, and its output is streamed back to the client.
+// The protocol is the one lib/client talks: POST /build takes the arguments of
+// makisu as a JSON array, and the response ends with a JSON line holding the
+// "build_code" of the build. The metrics of the builds are served on
+// GET /metrics. POST /exit stops the server, and is only served on the unix
+// socket, whose file permissions control who can use it. Requests on TCP need
+// the token of the server.
+//
+// Contexts can also be synced by content: POST /context takes the manifest of
+// a context, and returns its id and the digests of the files the server
+// doesn't have. POST /context/blobs uploads those as a tar of files named by
+// their digest, and POST /build?context=<id> builds the synced context. Repeated
+// builds of a big context only upload the files that changed.
+package daemon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/failure"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/metrics"
+)
+
+// _tarContentTypes are the content types of build requests that upload their
+// context as a tar, instead of passing arguments in a JSON body.
+var _tarContentTypes = map[string]bool{
+	"application/x-tar":  true,
+	"application/gzip":   true,
+	"application/x-gzip": true,
+	"application/zstd":   true,
+}
+
+// Options configures a Server.
+type Options struct {
+	// Executable is the makisu binary that runs builds.
+	Executable string
+	// BuildFlags are added to the flags of every build. Requests can't pass
+	// them again to override them, and can only pass the flags of
+	// _requestFlags.
+	BuildFlags []string
+	// MaxConcurrentBuilds is the number of builds running at the same time.
+	MaxConcurrentBuilds int
+	// MaxQueuedBuilds is the number of builds waiting for a slot. Requests are
+	// rejected once the queue is full.
+	MaxQueuedBuilds int
+	// ContextCacheDir keeps the content of synced contexts. Syncing is
+	// disabled if empty.
+	ContextCacheDir string
+	// Token is required as a bearer token by the handler of TCP listeners.
+	Token string
+}
+
+// Server queues build requests, and runs them with a limited concurrency.
+type Server struct {
+	opts    Options
+	slots   chan struct{}
+	metrics *metrics.Metrics
+	// contexts is nil if context syncing is disabled.
+	contexts *contextStore
+
+	sync.Mutex
+	queued  int
+	running int
+
+	exit     chan struct{}
+	exitOnce sync.Once
+}
+
+// NewServer returns a new Server.
+func NewServer(opts Options) (*Server, error) {
+	if opts.Executable == "" {
+		return nil, errors.New("no makisu executable")
+	} else if opts.MaxConcurrentBuilds <= 0 {
+		return nil, fmt.Errorf("invalid max concurrent builds: %d", opts.MaxConcurrentBuilds)
+	} else if opts.MaxQueuedBuilds < 0 {
+		return nil, fmt.Errorf("invalid max queued builds: %d", opts.MaxQueuedBuilds)
+	} else if opts.MaxConcurrentBuilds > 1 && modifyFS(opts.BuildFlags) {
+		return nil, errors.New("builds with --modifyfs can't run concurrently")
+	}
+	s := &Server{
+		opts:    opts,
+		slots:   make(chan struct{}, opts.MaxConcurrentBuilds),
+		metrics: metrics.New(),
+		exit:    make(chan struct{}),
+	}
+	if opts.ContextCacheDir != "" {
+		contexts, err := newContextStore(opts.ContextCacheDir)
+		if err != nil {
+			return nil, err
+		}
+		s.contexts = contexts
+	}
+	return s, nil
+}
+
+// Handler returns the HTTP handler of the server for the unix socket, whose
+// file permissions control who can use it.
+func (s *Server) Handler() http.Handler {
+	mux := s.mux(true)
+	mux.HandleFunc("/exit", s.handleExit)
+	return mux
+}
+
+// TCPHandler returns the HTTP handler of the server for TCP listeners. It
+// requires the token of the server, doesn't serve /exit, and only builds
+// remote contexts, uploaded or synced ones.
+func (s *Server) TCPHandler() http.Handler {
+	mux := s.mux(false)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// mux returns the handlers shared by all listeners. Builds of local contexts
+// are only allowed if local is true.
+func (s *Server) mux(local bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/build", func(w http.ResponseWriter, r *http.Request) {
+		s.handleBuild(w, r, local)
+	})
+	mux.HandleFunc("/context", s.handleContext)
+	mux.HandleFunc("/context/blobs", s.handleContextBlobs)
+	mux.Handle("/metrics", s.metrics.Handler())
+	return mux
+}
+
+// authorized returns true if the request has the token of the server. No
+// request is authorized if the server has no token.
+func (s *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return s.opts.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) == 1
+}
+
+// Exit returns a channel closed once a client asked the server to exit.
+func (s *Server) Exit() <-chan struct{} {
+	return s.exit
+}
+
+// handleReady returns 200 if a build would start right away, and 503 if it
+// would be queued.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if s.running+s.queued >= s.opts.MaxConcurrentBuilds {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	status := map[string]int{"running": s.running, "queued": s.queued}
+	s.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *Server) handleExit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "exit requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	s.exitOnce.Do(func() { close(s.exit) })
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleContext saves the manifest of a context to sync, and returns its id
+// and the digests of the content to upload.
+func (s *Server) handleContext(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "context sync requires POST", http.StatusMethodNotAllowed)
+		return
+	} else if s.contexts == nil {
+		http.Error(w, "context sync is disabled", http.StatusNotFound)
+		return
+	}
+	var m context.Manifest
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, fmt.Sprintf("decode context manifest: %s", err), http.StatusBadRequest)
+		return
+	}
+	id, missing, err := s.contexts.putManifest(&m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("Synced context manifest %s: %d files, %d to upload", id, len(m.Entries), len(missing))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ContextSync{ID: id, Missing: missing})
+}
+
+// handleContextBlobs saves the content of the files of contexts, from a tar of
+// files named by their digest.
+func (s *Server) handleContextBlobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "context sync requires POST", http.StatusMethodNotAllowed)
+		return
+	} else if s.contexts == nil {
+		http.Error(w, "context sync is disabled", http.StatusNotFound)
+		return
+	}
+	n, err := s.contexts.putBlobs(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("Received %d context blobs", n)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleBuild runs a build. The arguments are either a JSON array in the body,
+// or "args" query parameters if the body is a context tar, which is passed to
+// the build on stdin. With a "context" query parameter, the synced context of
+// that id is written to a temp dir, added as the last argument.
+func (s *Server) handleBuild(w http.ResponseWriter, r *http.Request, local bool) {
+	if r.Method != "POST" {
+		http.Error(w, "build requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var args []string
+	var stdin io.Reader
+	contextTar := _tarContentTypes[r.Header.Get("Content-Type")]
+	if contextTar {
+		args = append([]string{"build"}, r.URL.Query()["args"]...)
+	} else if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, fmt.Sprintf("decode build args: %s", err), http.StatusBadRequest)
+		return
+	}
+	if len(args) == 0 || args[0] != "build" {
+		http.Error(w, "only build is supported", http.StatusBadRequest)
+		return
+	} else if err := s.checkArgs(args[1:], local); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if contextTar {
+		// The tar is saved before the build starts: the server can drop the
+		// unread body of the request once the logs are flushed to the client.
+		f, err := ioutil.TempFile("", "makisu-context")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("create context tar: %s", err), http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := io.Copy(f, r.Body); err != nil {
+			http.Error(w, fmt.Sprintf("read context tar: %s", err), http.StatusBadRequest)
+			return
+		} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, fmt.Sprintf("seek context tar: %s", err), http.StatusInternalServerError)
+			return
+		}
+		args = append(args, "--context=-")
+		stdin = f
+	}
+	if id := r.URL.Query().Get("context"); id != "" {
+		if s.contexts == nil {
+			http.Error(w, "context sync is disabled", http.StatusNotFound)
+			return
+		} else if stdin != nil {
+			http.Error(w, "context tar and synced context are exclusive", http.StatusBadRequest)
+			return
+		}
+		contextDir, err := ioutil.TempDir("", "makisu-context")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("create context dir: %s", err), http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(contextDir)
+		if err := s.contexts.materialize(id, contextDir); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		args = append(args, contextDir)
+	}
+	metricsDir, err := ioutil.TempDir("", "makisu-metrics")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("create metrics dir: %s", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(metricsDir)
+	metricsOutput := filepath.Join(metricsDir, "metrics.json")
+	args = append(append([]string{"build"}, s.opts.BuildFlags...), args[1:]...)
+	args = append(args[:1], append([]string{"--metrics-output=" + metricsOutput}, args[1:]...)...)
+
+	if !s.enqueue() {
+		http.Error(w, "build queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	out := newFlushWriter(w)
+	select {
+	case s.slots <- struct{}{}:
+	case <-r.Context().Done():
+		s.dequeue(false)
+		return
+	}
+	s.dequeue(true)
+	defer s.release()
+
+	log.Infof("Starting build: %v", args)
+	code := s.run(r, args, stdin, out)
+	log.Infof("Finished build with code %d: %v", code, args)
+	s.observe(metricsOutput, code)
+	result, _ := json.Marshal(map[string]string{"build_code": fmt.Sprintf("%d", code)})
+	out.Write(append(result, '\n'))
+}
+
+// run runs makisu with the given arguments, and returns its exit code. The
+// build is stopped if the client disconnects.
+func (s *Server) run(r *http.Request, args []string, stdin io.Reader, out io.Writer) int {
+	cmd := exec.Command(s.opts.Executable, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(out, "failed to start build: %s\n", err)
+		return 1
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			// The sandbox left behind is removed by makisu prune.
+			cmd.Process.Signal(syscall.SIGTERM)
+		case <-done:
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() > 0 {
+				return status.ExitStatus()
+			}
+		}
+		return 1
+	}
+	return 0
+}
+
+// observe adds a build to the metrics, from the summary it wrote to
+// metricsOutput. Builds killed before writing it only count by result.
+func (s *Server) observe(metricsOutput string, code int) {
+	summary, err := metrics.ReadSummary(metricsOutput)
+	if err != nil {
+		result := metrics.ResultSuccess
+		if code != 0 {
+			result = string(failure.KindOfExitCode(code))
+		}
+		summary = &metrics.Summary{Result: result}
+	}
+	s.metrics.Observe(summary)
+}
+
+// enqueue adds a build to the queue, and returns false if the queue is full.
+func (s *Server) enqueue() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.queued+s.running >= s.opts.MaxConcurrentBuilds+s.opts.MaxQueuedBuilds {
+		return false
+	}
+	s.queued++
+	return true
+}
+
+// dequeue removes a build from the queue, either because it starts or because
+// its client left.
+func (s *Server) dequeue(started bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.queued--
+	if started {
+		s.running++
+	}
+}
+
+func (s *Server) release() {
+	s.Lock()
+	s.running--
+	s.Unlock()
+	<-s.slots
+}
+
+// flushWriter flushes every write to the client, so logs are streamed. Writes
+// of stdout and stderr are serialized.
+type flushWriter struct {
+	sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	flusher, _ := w.(http.Flusher)
+	return &flushWriter{w: w, flusher: flusher}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.Lock()
+	defer fw.Unlock()
+	n, err := fw.w.Write(p)
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,374 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMakisu writes a script that prints its arguments and stdin, and exits
+// with the code given by the EXIT_CODE argument, if any. Successful builds
+// write a metrics summary to --metrics-output, which isn't printed.
+func fakeMakisu(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "makisu-daemon-test")
+	require.NoError(t, err)
+	script := filepath.Join(dir, "makisu")
+	require.NoError(t, ioutil.WriteFile(script, []byte(`#!/bin/sh
+args=""
+for arg in "$@"; do case $arg in --metrics-output=*) metrics=${arg#--metrics-output=};; *) args="$args $arg";; esac; done
+echo "args:$args"
+for arg in "$@"; do case $arg in --context=-) echo "stdin: $(cat)";; esac; done
+for arg in "$@"; do case $arg in EXIT_CODE=*) exit ${arg#EXIT_CODE=};; esac; done
+echo '{"result": "success", "duration": 2, "cache_hits": 3}' > $metrics
+`), 0755))
+	return script, func() { os.RemoveAll(dir) }
+}
+
+func readBuildCode(t *testing.T, body []byte) (string, []string) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.NotEmpty(t, lines)
+	var result map[string]string
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &result))
+	return result["build_code"], lines[:len(lines)-1]
+}
+
+func TestServerBuild(t *testing.T) {
+	require := require.New(t)
+	script, cleanup := fakeMakisu(t)
+	defer cleanup()
+
+	s, err := NewServer(Options{
+		Executable:          script,
+		BuildFlags:          []string{"--modifyfs"},
+		MaxConcurrentBuilds: 1,
+		MaxQueuedBuilds:     1,
+	})
+	require.NoError(err)
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/ready")
+	require.NoError(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	// Arguments in a JSON body, like lib/client sends them.
+	resp, err = http.Post(server.URL+"/build", "application/json",
+		strings.NewReader(`["build", "-t", "app:v1", "/context"]`))
+	require.NoError(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	code, lines := readBuildCode(t, body)
+	require.Equal("0", code)
+	require.Equal([]string{"args: build --modifyfs -t app:v1 /context"}, lines)
+
+	// Context tar in the body.
+	resp, err = http.Post(server.URL+"/build?args=-t&args=app:v1&args=EXIT_CODE=3", "application/x-tar",
+		strings.NewReader("context"))
+	require.NoError(err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	code, lines = readBuildCode(t, body)
+	require.Equal("3", code)
+	require.Equal([]string{"args: build --modifyfs -t app:v1 EXIT_CODE=3 --context=-", "stdin: context"}, lines)
+
+	// Only builds are allowed.
+	resp, err = http.Post(server.URL+"/build", "application/json", strings.NewReader(`["prune"]`))
+	require.NoError(err)
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// The failed build has no summary, and counts by the kind of its exit
+	// code.
+	resp, err = http.Get(server.URL + "/metrics")
+	require.NoError(err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	require.Contains(string(body), `makisu_builds_total{result="success"} 1`)
+	require.Contains(string(body), `makisu_builds_total{result="auth"} 1`)
+	require.Contains(string(body), `makisu_build_duration_seconds_count 1`)
+	require.Contains(string(body), `makisu_cache_hits_total 3`)
+}
+
+func TestServerQueueFull(t *testing.T) {
+	require := require.New(t)
+	script, cleanup := fakeMakisu(t)
+	defer cleanup()
+
+	s, err := NewServer(Options{Executable: script, MaxConcurrentBuilds: 1})
+	require.NoError(err)
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	s.running = 1
+	resp, err := http.Get(server.URL + "/ready")
+	require.NoError(err)
+	require.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	resp, err = http.Post(server.URL+"/build", "application/json", strings.NewReader(`["build"]`))
+	require.NoError(err)
+	require.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/exit")
+	require.NoError(err)
+	require.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, err = http.Post(server.URL+"/exit", "", nil)
+	require.NoError(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	<-s.Exit()
+}
+
+func TestServerDaemonFlags(t *testing.T) {
+	require := require.New(t)
+	script, cleanup := fakeMakisu(t)
+	defer cleanup()
+
+	_, err := NewServer(Options{
+		Executable:          script,
+		BuildFlags:          []string{"--modifyfs=true"},
+		MaxConcurrentBuilds: 2,
+	})
+	require.Error(err)
+	_, err = NewServer(Options{
+		Executable:          script,
+		BuildFlags:          []string{"--modifyfs=false"},
+		MaxConcurrentBuilds: 2,
+	})
+	require.NoError(err)
+
+	s, err := NewServer(Options{
+		Executable:          script,
+		BuildFlags:          []string{"--file=/Dockerfile", "--compression", "speed"},
+		MaxConcurrentBuilds: 1,
+	})
+	require.NoError(err)
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	for _, args := range []string{
+		`["build", "--storage=/tmp/storage"]`,
+		`["build", "--registry-config", "{}"]`,
+		`["build", "--modifyfs"]`,
+		`["build", "--dest", "/etc/image.tar"]`,
+		`["build", "--compression=size"]`,
+		`["build", "-f", "other/Dockerfile"]`,
+		`["build", "-f=other/Dockerfile"]`,
+		`["build", "--log-output=/etc/passwd"]`,
+		`["build", "--config", "/etc/makisu/other.yaml"]`,
+		`["build", "--build-context", "ssh=/root/.ssh"]`,
+		`["build", "--notify-url", "http://metadata/"]`,
+		`["build", "--scan", "rm -rf /"]`,
+		`["build", "-q"]`,
+		`["build", "--tag"]`,
+		`["build", "--", "-"]`,
+	} {
+		resp, err := http.Post(server.URL+"/build", "application/json", strings.NewReader(args))
+		require.NoError(err)
+		require.Equal(http.StatusBadRequest, resp.StatusCode, args)
+	}
+	resp, err := http.Post(server.URL+"/build?args=--storage=/tmp/storage", "application/x-tar",
+		strings.NewReader("context"))
+	require.NoError(err)
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/build", "application/json", strings.NewReader(`["build", "-t", "app:v1"]`))
+	require.NoError(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	code, lines := readBuildCode(t, body)
+	require.Equal("0", code)
+	require.Equal([]string{"args: build --file=/Dockerfile --compression speed -t app:v1"}, lines)
+}
+
+func TestServerTCPContexts(t *testing.T) {
+	require := require.New(t)
+	script, cleanup := fakeMakisu(t)
+	defer cleanup()
+
+	s, err := NewServer(Options{Executable: script, MaxConcurrentBuilds: 1, Token: "secret"})
+	require.NoError(err)
+	server := httptest.NewServer(s.TCPHandler())
+	defer server.Close()
+
+	build := func(args string) int {
+		req, err := http.NewRequest("POST", server.URL+"/build", strings.NewReader(args))
+		require.NoError(err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		// The build slot is released once the response is read.
+		_, err = ioutil.ReadAll(resp.Body)
+		require.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Paths on the host of the daemon can't be built.
+	for _, args := range []string{
+		`["build", "/context"]`,
+		`["build", "--context=/"]`,
+		`["build", "-c", "/root"]`,
+		`["build", "--", "/root"]`,
+		`["build", "-f", "/etc/passwd", "https://github.com/uber/makisu.git"]`,
+		`["build", "-f", "../../etc/passwd", "https://github.com/uber/makisu.git"]`,
+	} {
+		require.Equal(http.StatusBadRequest, build(args), args)
+	}
+	for _, args := range []string{
+		`["build", "-t", "app:v1", "https://github.com/uber/makisu.git#master:testdata"]`,
+		`["build", "--context=https://example.com/context.tar.gz", "-f", "build/Dockerfile"]`,
+		`["build", "-tapp:v1", "--squash", "https://github.com/uber/makisu.git"]`,
+	} {
+		require.Equal(http.StatusOK, build(args), args)
+	}
+}
+
+func TestServerTCPHandler(t *testing.T) {
+	require := require.New(t)
+	script, cleanup := fakeMakisu(t)
+	defer cleanup()
+
+	s, err := NewServer(Options{Executable: script, MaxConcurrentBuilds: 1, Token: "secret"})
+	require.NoError(err)
+	server := httptest.NewServer(s.TCPHandler())
+	defer server.Close()
+
+	request := func(method, path, token string) int {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(`["build"]`))
+		require.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		// The build slot is released once the response is read.
+		_, err = ioutil.ReadAll(resp.Body)
+		require.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(http.StatusUnauthorized, request("GET", "/ready", ""))
+	require.Equal(http.StatusUnauthorized, request("POST", "/build", "other"))
+	require.Equal(http.StatusOK, request("GET", "/ready", "secret"))
+	require.Equal(http.StatusOK, request("POST", "/build", "secret"))
+	// Exiting is only possible on the unix socket.
+	require.Equal(http.StatusNotFound, request("POST", "/exit", "secret"))
+
+	// Without a token, no request is authorized.
+	s, err = NewServer(Options{Executable: script, MaxConcurrentBuilds: 1})
+	require.NoError(err)
+	tcpServer := httptest.NewServer(s.TCPHandler())
+	defer tcpServer.Close()
+	resp, err := http.Get(tcpServer.URL + "/ready")
+	require.NoError(err)
+	require.Equal(http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServerContextSync(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	// The script prints the synced context, its last argument.
+	script := filepath.Join(dir, "makisu")
+	require.NoError(ioutil.WriteFile(script, []byte(`#!/bin/sh
+for context; do :; done
+cd $context && find . | sort | tr '\n' ' ' && echo && cat src/main.go && echo && readlink link
+`), 0755))
+
+	s, err := NewServer(Options{
+		Executable:          script,
+		MaxConcurrentBuilds: 1,
+		ContextCacheDir:     filepath.Join(dir, "cache"),
+	})
+	require.NoError(err)
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	content := "package main"
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	manifest := context.Manifest{Entries: []context.ManifestEntry{
+		{Path: "link", Mode: os.ModeSymlink | 0777, Link: "src/main.go"},
+		{Path: "src", Mode: os.ModeDir | 0755},
+		{Path: "src/main.go", Mode: 0644, Digest: digest},
+	}}
+	syncContext := func() ContextSync {
+		b, err := json.Marshal(manifest)
+		require.NoError(err)
+		resp, err := http.Post(server.URL+"/context", "application/json", bytes.NewReader(b))
+		require.NoError(err)
+		defer resp.Body.Close()
+		require.Equal(http.StatusOK, resp.StatusCode)
+		var sync ContextSync
+		require.NoError(json.NewDecoder(resp.Body).Decode(&sync))
+		return sync
+	}
+	uploadBlob := func(name, content string) int {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(err)
+		require.NoError(tw.Close())
+		resp, err := http.Post(server.URL+"/context/blobs", "application/x-tar", &buf)
+		require.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	sync := syncContext()
+	require.Equal([]string{digest}, sync.Missing)
+
+	// The build fails until the content is uploaded, and content that
+	// doesn't match its digest is rejected.
+	resp, err := http.Post(server.URL+"/build?context="+sync.ID, "application/json", strings.NewReader(`["build"]`))
+	require.NoError(err)
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+	require.Equal(http.StatusBadRequest, uploadBlob(digest, "package other"))
+	require.Equal(http.StatusOK, uploadBlob(digest, content))
+
+	// Nothing is missing for the next sync of the same content.
+	sync = syncContext()
+	require.Empty(sync.Missing)
+
+	resp, err = http.Post(server.URL+"/build?context="+sync.ID, "application/json", strings.NewReader(`["build"]`))
+	require.NoError(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	code, lines := readBuildCode(t, body)
+	require.Equal("0", code)
+	require.Equal([]string{". ./link ./src ./src/main.go ", "package main", "src/main.go"}, lines)
+
+	resp, err = http.Post(server.URL+"/build?context=../../etc", "application/json", strings.NewReader(`["build"]`))
+	require.NoError(err)
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+}
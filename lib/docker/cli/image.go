@@ -32,6 +32,10 @@ import (
 // DefaultImageTarer exports/imports images from an ImageStore.
 type DefaultImageTarer struct {
 	store *storage.ImageStore
+
+	// IndexAnnotations are added to the index of the OCI image layouts
+	// written by the tarer.
+	IndexAnnotations map[string]string
 }
 
 // NewDefaultImageTarer creates a new DefaultImageTarer with the given
@@ -137,22 +141,30 @@ func (tarer DefaultImageTarer) createTarDir(imageName image.Name) (string, error
 }
 
 func (tarer DefaultImageTarer) getExportManifest(imageName image.Name) (image.ExportManifest, error) {
+	distribution, err := tarer.getDistributionManifest(imageName)
+	if err != nil {
+		return image.ExportManifest{}, err
+	}
+	// create export manifest from distribution manifest.
+	exportManifest := image.NewExportManifestFromDistribution(imageName, distribution)
+	return exportManifest, nil
+}
+
+func (tarer DefaultImageTarer) getDistributionManifest(imageName image.Name) (image.DistributionManifest, error) {
 	repo, tag := imageName.GetRepository(), imageName.GetTag()
 	manifestReader, err := tarer.store.Manifests.GetStoreFileReader(repo, tag)
 	if err != nil {
-		return image.ExportManifest{}, err
+		return image.DistributionManifest{}, err
 	}
+	defer manifestReader.Close()
 	manifestData, err := ioutil.ReadAll(manifestReader)
 	if err != nil {
-		return image.ExportManifest{}, err
+		return image.DistributionManifest{}, err
 	}
-	defer manifestReader.Close()
 
 	distribution, _, err := image.UnmarshalDistributionManifest(image.MediaTypeManifest, manifestData)
 	if err != nil {
-		return image.ExportManifest{}, err
+		return image.DistributionManifest{}, err
 	}
-	// create export manifest from distribution manifest.
-	exportManifest := image.NewExportManifestFromDistribution(imageName, distribution)
-	return exportManifest, nil
+	return distribution, nil
 }
@@ -0,0 +1,151 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/snapshot"
+	"github.com/uber/makisu/lib/stream"
+)
+
+// CreateOCITarReadCloser exports an image from the image store as a tar of an
+// OCI image layout, and returns a reader for the tar that automatically closes
+// on EOF.
+func (tarer DefaultImageTarer) CreateOCITarReadCloser(imageName image.Name) (io.Reader, error) {
+	dir := filepath.Join(tarer.store.SandboxDir, "oci", imageName.GetRepository(), imageName.GetTag())
+	if err := tarer.WriteOCILayout(imageName, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	targetPath := dir + ".tar"
+	if err := snapshot.CreateTarFromDirectory(targetPath, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	fh, err := os.Open(targetPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	reader := stream.NewCloseOnErrorReader(fh, func() error {
+		return os.RemoveAll(dir)
+	})
+	return reader, nil
+}
+
+// WriteOCILayout exports an image from the image store to the OCI image layout
+// in dir, creating it if needed. Images already in the layout are kept, unless
+// they have the same name.
+func (tarer DefaultImageTarer) WriteOCILayout(imageName image.Name, dir string) error {
+	distribution, err := tarer.getDistributionManifest(imageName)
+	if err != nil {
+		return fmt.Errorf("get manifest: %s", err)
+	}
+	manifest := image.NewOCIManifestFromDistribution(distribution)
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %s", err)
+	}
+	manifestDigest, err := image.NewDigester().FromBytes(manifestData)
+	if err != nil {
+		return fmt.Errorf("digest manifest: %s", err)
+	}
+
+	blobsDir := filepath.Join(dir, image.OCIBlobsDir, "sha256")
+	if err := os.MkdirAll(blobsDir, perm); err != nil {
+		return fmt.Errorf("create blobs dir: %s", err)
+	}
+	for _, descriptor := range append([]image.Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := tarer.linkOrCopyBlob(
+			descriptor.Digest.Hex(), filepath.Join(blobsDir, descriptor.Digest.Hex())); err != nil {
+			return fmt.Errorf("export blob %s: %s", descriptor.Digest, err)
+		}
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(blobsDir, manifestDigest.Hex()), manifestData, 0644); err != nil {
+		return fmt.Errorf("write manifest: %s", err)
+	}
+
+	index := image.NewOCIIndex()
+	indexPath := filepath.Join(dir, image.OCIIndexFileName)
+	if indexData, err := ioutil.ReadFile(indexPath); err == nil {
+		if err := json.Unmarshal(indexData, &index); err != nil {
+			return fmt.Errorf("unmarshal existing index: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("read existing index: %s", err)
+	}
+	index.AddManifest(imageName, image.Descriptor{
+		MediaType: image.MediaTypeOCIManifest,
+		Size:      int64(len(manifestData)),
+		Digest:    manifestDigest,
+	})
+	for k, v := range tarer.IndexAnnotations {
+		if index.Annotations == nil {
+			index.Annotations = make(map[string]string)
+		}
+		index.Annotations[k] = v
+	}
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("marshal index: %s", err)
+	}
+	if err := ioutil.WriteFile(indexPath, indexData, 0644); err != nil {
+		return fmt.Errorf("write index: %s", err)
+	}
+
+	layoutData, err := json.Marshal(image.NewOCILayout())
+	if err != nil {
+		return fmt.Errorf("marshal layout: %s", err)
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(dir, image.OCILayoutFileName), layoutData, 0644); err != nil {
+		return fmt.Errorf("write layout: %s", err)
+	}
+	return nil
+}
+
+// linkOrCopyBlob hard links a blob of the store to target, or copies it if
+// target is on another file system.
+func (tarer DefaultImageTarer) linkOrCopyBlob(name, target string) error {
+	err := tarer.store.Layers.LinkStoreFileTo(name, target)
+	if err == nil || os.IsExist(err) {
+		return nil
+	}
+	r, err := tarer.store.Layers.GetStoreFileReader(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,69 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scopes of the annotations of images.
+const (
+	AnnotationScopeManifest = "manifest"
+	AnnotationScopeIndex    = "index"
+)
+
+// Annotations are the annotations of the manifest of an image, and of an index
+// referencing it.
+type Annotations struct {
+	Manifest map[string]string
+	Index    map[string]string
+}
+
+// ParseAnnotations parses annotations formatted as "[<scope>:]<key>=<value>",
+// where scope is "manifest" by default, or "index".
+func ParseAnnotations(values []string) (Annotations, error) {
+	var a Annotations
+	for _, value := range values {
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 {
+			return Annotations{}, fmt.Errorf("invalid annotation %q, must be [<scope>:]<key>=<value>", value)
+		}
+		scope, key := AnnotationScopeManifest, kv[0]
+		if i := strings.Index(key, ":"); i >= 0 {
+			scope, key = key[:i], key[i+1:]
+		}
+		if key == "" {
+			return Annotations{}, fmt.Errorf("invalid annotation %q, key is empty", value)
+		}
+		switch scope {
+		case AnnotationScopeManifest:
+			if a.Manifest == nil {
+				a.Manifest = make(map[string]string)
+			}
+			a.Manifest[key] = kv[1]
+		case AnnotationScopeIndex:
+			if a.Index == nil {
+				a.Index = make(map[string]string)
+			}
+			a.Index[key] = kv[1]
+		default:
+			return Annotations{}, fmt.Errorf(
+				"invalid annotation scope %q, must be %s or %s",
+				scope, AnnotationScopeManifest, AnnotationScopeIndex)
+		}
+	}
+	return a, nil
+}
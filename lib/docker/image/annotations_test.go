@@ -0,0 +1,51 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	require := require.New(t)
+
+	a, err := ParseAnnotations(nil)
+	require.NoError(err)
+	require.Nil(a.Manifest)
+	require.Nil(a.Index)
+
+	a, err = ParseAnnotations([]string{
+		"org.opencontainers.image.source=https://example.com/app",
+		"manifest:a=b=c",
+		"index:org.opencontainers.image.description=App",
+		"index:empty=",
+	})
+	require.NoError(err)
+	require.Equal(map[string]string{
+		"org.opencontainers.image.source": "https://example.com/app",
+		"a":                               "b=c",
+	}, a.Manifest)
+	require.Equal(map[string]string{
+		"org.opencontainers.image.description": "App",
+		"empty":                                "",
+	}, a.Index)
+
+	for _, value := range []string{"a", "=b", "index:=b", "layer:a=b"} {
+		_, err := ParseAnnotations([]string{value})
+		require.Error(err, value)
+	}
+}
@@ -0,0 +1,96 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ConfigChange is a setting of the image config that differs between two
+// images. Values are JSON encoded, and empty if the setting is unset.
+type ConfigChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// DiffConfigs returns the settings of the container config, like Env or
+// Entrypoint, and the platform and author of the images that differ between a
+// and b, sorted by field. Creation times and history are left out, since they
+// differ between any two builds.
+func DiffConfigs(a, b *Config) ([]ConfigChange, error) {
+	settingsA, err := configSettings(a)
+	if err != nil {
+		return nil, err
+	}
+	settingsB, err := configSettings(b)
+	if err != nil {
+		return nil, err
+	}
+	var changes []ConfigChange
+	for field, value := range settingsA {
+		if settingsB[field] != value {
+			changes = append(changes, ConfigChange{field, value, settingsB[field]})
+		}
+	}
+	for field, value := range settingsB {
+		if _, ok := settingsA[field]; !ok {
+			changes = append(changes, ConfigChange{Field: field, New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+// configSettings returns the JSON encoding of the settings of config that are
+// set, by field.
+func configSettings(config *Config) (map[string]string, error) {
+	settings := make(map[string]string)
+	for field, value := range map[string]string{
+		"Architecture": config.Architecture,
+		"Variant":      config.Variant,
+		"Os":           config.OS,
+		"Author":       config.Author,
+	} {
+		if value != "" {
+			b, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("marshal %s: %s", field, err)
+			}
+			settings[field] = string(b)
+		}
+	}
+	if config.Config == nil {
+		return settings, nil
+	}
+	b, err := json.Marshal(config.Config)
+	if err != nil {
+		return nil, fmt.Errorf("marshal container config: %s", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("unmarshal container config: %s", err)
+	}
+	for field, value := range fields {
+		switch string(value) {
+		case "null", `""`, "false", "0", "[]", "{}":
+			continue
+		}
+		settings["Config."+field] = string(value)
+	}
+	return settings, nil
+}
@@ -0,0 +1,51 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	require := require.New(t)
+
+	a := NewDefaultImageConfig()
+	a.Architecture = "amd64"
+	a.Config.Entrypoint = []string{"/app"}
+	a.Config.Labels = map[string]string{"x": "y"}
+
+	b, err := NewImageConfigFromCopy(&a)
+	require.NoError(err)
+	b.Architecture = "arm64"
+	b.Config.Entrypoint = nil
+	b.Config.User = "65532"
+	b.Config.Env = append(b.Config.Env, "A=b")
+
+	changes, err := DiffConfigs(&a, b)
+	require.NoError(err)
+	require.Equal([]ConfigChange{
+		{"Architecture", `"amd64"`, `"arm64"`},
+		{"Config.Entrypoint", `["/app"]`, ""},
+		{"Config.Env", `["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"]`,
+			`["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin","A=b"]`},
+		{"Config.User", "", `"65532"`},
+	}, changes)
+
+	changes, err = DiffConfigs(&a, &a)
+	require.NoError(err)
+	require.Empty(changes)
+}
@@ -16,6 +16,7 @@ package image
 
 import (
 	"fmt"
+	"hash"
 	"io"
 	"strings"
 )
@@ -37,11 +38,24 @@ func (d Digest) Hex() string {
 	return string(d[i+1:])
 }
 
+// Algorithm returns the algorithm part of the digest.
+func (d Digest) Algorithm() Algorithm {
+	i := strings.Index(string(d), ":")
+	if i < 0 {
+		return ""
+	}
+	return Algorithm(d[:i])
+}
+
 // Equals compares the digest against the layer contained in the reader passed in as input, and
-// returns true if the two digests are the same.
+// returns true if the two digests are the same. The content is digested with
+// the algorithm of the digest.
 func (d Digest) Equals(reader io.ReadCloser) (bool, error) {
 	defer reader.Close()
-	digester := NewDigester()
+	if _, ok := _algorithms[d.Algorithm()]; !ok {
+		return false, fmt.Errorf("unsupported digest algorithm %q", d.Algorithm())
+	}
+	digester := NewDigesterWithAlgorithm(d.Algorithm())
 	computed, err := digester.FromReader(reader)
 	if err != nil {
 		return false, fmt.Errorf("digest from reader: %s", err)
@@ -49,6 +63,12 @@ func (d Digest) Equals(reader io.ReadCloser) (bool, error) {
 	return computed == d, nil
 }
 
+// NewDigest returns the digest of the content written to h, which computes
+// digests of algorithm a.
+func NewDigest(a Algorithm, h hash.Hash) Digest {
+	return Digest(fmt.Sprintf("%s:%x", a, h.Sum(nil)))
+}
+
 // NewEmptyDigest returns a 0 value digest.
 func NewEmptyDigest() Digest {
 	return Digest("")
@@ -15,30 +15,92 @@
 package image
 
 import (
-	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
 	"hash"
 	"io"
+	"strings"
 )
 
-// SHA256 is the only algorithm supported.
-var SHA256 = "sha256"
+// Algorithm is a digest algorithm registered by the OCI image spec.
+type Algorithm string
+
+// Supported digest algorithms.
+const (
+	SHA256 Algorithm = "sha256"
+	SHA512 Algorithm = "sha512"
+)
+
+var _algorithms = map[Algorithm]func() hash.Hash{
+	SHA256: sha256.New,
+	SHA512: sha512.New,
+}
+
+// _digestAlgorithm is the algorithm of the digests computed by NewDigester.
+var _digestAlgorithm = SHA256
+
+// ParseAlgorithm returns the supported algorithm with the given name.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	a := Algorithm(strings.ToLower(name))
+	if _, ok := _algorithms[a]; !ok {
+		return "", fmt.Errorf("unsupported digest algorithm %q", name)
+	}
+	return a, nil
+}
+
+// New returns a hash computing digests of the algorithm. It panics if the
+// algorithm is not supported.
+func (a Algorithm) New() hash.Hash {
+	newHash, ok := _algorithms[a]
+	if !ok {
+		panic(fmt.Sprintf("unsupported digest algorithm %q", a))
+	}
+	return newHash()
+}
+
+// DigestAlgorithm returns the algorithm of the digests of the blobs and
+// manifests makisu produces.
+func DigestAlgorithm() Algorithm {
+	return _digestAlgorithm
+}
+
+// SetDigestAlgorithm sets the algorithm of the digests of the blobs and
+// manifests makisu produces, sha256 by default. Registries must support it
+// to push images.
+func SetDigestAlgorithm(name string) error {
+	a, err := ParseAlgorithm(name)
+	if err != nil {
+		return err
+	}
+	_digestAlgorithm = a
+	return nil
+}
 
 // Digester calculates the digest of written data.
 type Digester struct {
-	hash hash.Hash
+	algorithm Algorithm
+	hash      hash.Hash
 }
 
-// NewDigester instantiates and returns a new Digester object.
+// NewDigester instantiates and returns a new Digester object, computing
+// digests of the algorithm set by SetDigestAlgorithm.
 func NewDigester() *Digester {
+	return NewDigesterWithAlgorithm(_digestAlgorithm)
+}
+
+// NewDigesterWithAlgorithm returns a new Digester computing digests of the
+// given algorithm. It panics if the algorithm is not supported.
+func NewDigesterWithAlgorithm(a Algorithm) *Digester {
 	return &Digester{
-		hash: crypto.SHA256.New(),
+		algorithm: a,
+		hash:      a.New(),
 	}
 }
 
 // Digest returns the digest of existing data.
 func (d *Digester) Digest() Digest {
-	return Digest(fmt.Sprintf("%s:%x", SHA256, d.hash.Sum(nil)))
+	return NewDigest(d.algorithm, d.hash)
 }
 
 // FromReader returns the digest of data from reader.
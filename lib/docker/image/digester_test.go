@@ -15,6 +15,7 @@
 package image
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -55,3 +56,38 @@ func TestDigestFromBytes(t *testing.T) {
 
 	require.Equal(d1, d2)
 }
+
+func TestDigestAlgorithm(t *testing.T) {
+	require := require.New(t)
+
+	_, err := ParseAlgorithm("md5")
+	require.Error(err)
+	a, err := ParseAlgorithm("SHA512")
+	require.NoError(err)
+	require.Equal(SHA512, a)
+
+	require.Error(SetDigestAlgorithm("sha1"))
+	require.Equal(SHA256, DigestAlgorithm())
+	require.NoError(SetDigestAlgorithm("sha512"))
+	defer SetDigestAlgorithm("sha256")
+
+	d, err := NewDigester().FromBytes([]byte("abc"))
+	require.NoError(err)
+	require.Equal(SHA512, d.Algorithm())
+	require.Len(d.Hex(), 128)
+	require.Equal(Digest("sha512:ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a"+
+		"2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"), d)
+
+	// Digests are verified with their own algorithm.
+	equal, err := d.Equals(ioutil.NopCloser(bytes.NewReader([]byte("abc"))))
+	require.NoError(err)
+	require.True(equal)
+	sha256Digest := Digest("sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+	equal, err = sha256Digest.Equals(ioutil.NopCloser(bytes.NewReader([]byte("abc"))))
+	require.NoError(err)
+	require.True(equal)
+
+	_, err = Digest("md5:900150983cd24fb0d6963f7d28e17f72").Equals(
+		ioutil.NopCloser(bytes.NewReader([]byte("abc"))))
+	require.Error(err)
+}
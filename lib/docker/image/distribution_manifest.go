@@ -18,17 +18,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"mime"
+
+	"github.com/uber/makisu/lib/platform"
 )
 
 const (
 	// MediaTypeManifest specifies the mediaType for the current version.
 	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
 
+	// MediaTypeManifestList specifies the mediaType of manifest lists, which
+	// reference the manifests of an image for several platforms.
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
 	// MediaTypeConfig specifies the mediaType for the image configuration.
 	MediaTypeConfig = "application/vnd.docker.container.image.v1+json"
 
 	// MediaTypeLayer is the mediaType used for layers referenced by the manifest.
 	MediaTypeLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// MediaTypeLayerOCI is the OCI mediaType for gzip compressed layers.
+	MediaTypeLayerOCI = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// MediaTypeLayerZstd is the OCI mediaType for zstd compressed layers.
+	MediaTypeLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
 )
 
 // DistributionManifest defines a schema2 manifest. It's used for docker pull and docker push.
@@ -44,6 +56,10 @@ type DistributionManifest struct {
 
 	// Layers lists descriptors for all referenced layers, starting from base layer.
 	Layers []Descriptor `json:"layers"`
+
+	// Annotations contains arbitrary metadata of the image, only in OCI
+	// manifests.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // Descriptor describes targeted content.
@@ -57,6 +73,13 @@ type Descriptor struct {
 
 	// Digest uniquely identifies the content.
 	Digest Digest `json:"digest,omitempty"`
+
+	// Annotations contains arbitrary metadata relating to the content.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Platform is the platform of the image of a manifest, in manifest lists
+	// and OCI indexes.
+	Platform *platform.Platform `json:"platform,omitempty"`
 }
 
 // DigestPair is a pair of uncompressed digest/compressed descriptor of the same layer.
@@ -81,7 +104,8 @@ func UnmarshalDistributionManifest(ctHeader string, p []byte) (DistributionManif
 		}
 	}
 
-	if mediatype != MediaTypeManifest {
+	// OCI manifests have the same structure, with annotations.
+	if mediatype != MediaTypeManifest && mediatype != MediaTypeOCIManifest {
 		return DistributionManifest{},
 			Descriptor{},
 			fmt.Errorf("unsupported manifest mediatype: %s", mediatype)
@@ -96,7 +120,7 @@ func UnmarshalDistributionManifest(ctHeader string, p []byte) (DistributionManif
 	if err != nil {
 		return DistributionManifest{}, Descriptor{}, err
 	}
-	return manifest, Descriptor{Digest: digest, Size: int64(len(p)), MediaType: MediaTypeManifest}, nil
+	return manifest, Descriptor{Digest: digest, Size: int64(len(p)), MediaType: mediatype}, nil
 }
 
 // GetLayerDigests returns the list of layer digests of the image.
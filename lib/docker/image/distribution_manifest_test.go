@@ -15,6 +15,7 @@
 package image
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -45,3 +46,23 @@ func TestUnmarshalDistributionManifest(t *testing.T) {
 	require.NoError(err)
 	require.Equal(1, len(manifest.GetLayerDigests()))
 }
+
+func TestUnmarshalDistributionManifestOCI(t *testing.T) {
+	require := require.New(t)
+
+	distribution, _, err := UnmarshalDistributionManifest(
+		MediaTypeManifest, []byte(busyboxDistManifest))
+	require.NoError(err)
+	oci := NewOCIManifestFromDistribution(distribution)
+	oci.Annotations = map[string]string{"a": "b"}
+	b, err := json.Marshal(oci)
+	require.NoError(err)
+
+	manifest, descriptor, err := UnmarshalDistributionManifest(MediaTypeOCIManifest, b)
+	require.NoError(err)
+	require.Equal(MediaTypeOCIManifest, descriptor.MediaType)
+	require.Equal(oci, manifest)
+
+	_, _, err = UnmarshalDistributionManifest(MediaTypeOCIIndex, b)
+	require.Error(err)
+}
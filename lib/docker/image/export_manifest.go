@@ -62,7 +62,7 @@ func (c ExportConfig) String() string {
 // NewExportManifestFromDistribution creates ExportManifest given repo, tag and distrubtion manifest
 func NewExportManifestFromDistribution(imageName Name, distribution DistributionManifest) ExportManifest {
 	exportConfig := ExportConfig(fmt.Sprintf("%s.%s", distribution.Config.Digest.Hex(), legacyImageConfigFileName))
-	var exportLayers []ExportLayer
+	exportLayers := make([]ExportLayer, 0, len(distribution.Layers))
 	for _, layer := range distribution.Layers {
 		exportLayer := ExportLayer(path.Join(layer.Digest.Hex(), layerTarFileName))
 		exportLayers = append(exportLayers, exportLayer)
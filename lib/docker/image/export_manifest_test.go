@@ -15,6 +15,7 @@
 package image
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -30,3 +31,12 @@ func TestExportManifest(t *testing.T) {
 	require.Equal(t, "393ccd5c4dd90344c9d725125e13f636ce0087c62f5ca89050faaacbb9e3ed5b/layer.tar", layer.String())
 	require.Equal(t, "411a417c1f6ef5b93fac71c92276013f45762dde0bb36a80a6148ca114d1b0fa", expManifest.Config.ID())
 }
+
+func TestExportManifestNoLayers(t *testing.T) {
+	require := require.New(t)
+
+	expManifest := NewExportManifestFromDistribution(Name{}, DistributionManifest{})
+	b, err := json.Marshal(expManifest)
+	require.NoError(err)
+	require.Contains(string(b), `"Layers":[]`)
+}
@@ -19,12 +19,14 @@ import (
 	"fmt"
 	"io"
 	"time"
+
+	"github.com/uber/makisu/lib/platform"
 )
 
 // RootFS describes images root filesystem
 type RootFS struct {
 	Type    string   `json:"type"`
-	DiffIDs []Digest `json:"diff_ids,omitempty"`
+	DiffIDs []Digest `json:"diff_ids"`
 }
 
 // ID is the content-addressable ID of an image.
@@ -53,6 +55,8 @@ type V1Image struct {
 	Config *ContainerConfig `json:"config,omitempty"`
 	// Architecture is the hardware that the image is build and runs on
 	Architecture string `json:"architecture,omitempty"`
+	// Variant is the variant of the architecture, like "v7" for arm
+	Variant string `json:"variant,omitempty"`
 	// OS is the operating system used to build and run the image
 	OS string `json:"os,omitempty"`
 	// Size is the total size of the image including all layers it is composed of
@@ -121,10 +125,13 @@ type Exporter interface {
 }
 
 // NewDefaultImageConfig returns a default image config that is used for images built from scratch.
+// Its platform is the one of the host.
 func NewDefaultImageConfig() Config {
+	p := platform.Default()
 	return Config{
 		V1Image: V1Image{
-			Architecture: "amd64",
+			Architecture: p.Architecture,
+			Variant:      p.Variant,
 			Config: &ContainerConfig{
 				Env: []string{
 					"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
@@ -132,7 +139,7 @@ func NewDefaultImageConfig() Config {
 			},
 			ContainerConfiguration: &ContainerConfig{},
 			DockerVersion:          "1.12.6",
-			OS:                     "linux",
+			OS:                     p.OS,
 		},
 		RootFS: &RootFS{
 			Type:    "layers",
@@ -167,3 +174,17 @@ func NewImageConfigFromCopy(imageConfig *Config) (*Config, error) {
 	}
 	return NewImageConfigFromJSON(encoded)
 }
+
+// Platform returns the platform of the image.
+func (c Config) Platform() platform.Platform {
+	return platform.Platform{
+		OS:           c.OS,
+		Architecture: c.Architecture,
+		Variant:      c.Variant,
+	}.Normalize()
+}
+
+// SetPlatform sets the platform of the image.
+func (c *Config) SetPlatform(p platform.Platform) {
+	c.OS, c.Architecture, c.Variant = p.OS, p.Architecture, p.Variant
+}
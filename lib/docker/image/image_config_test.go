@@ -28,6 +28,8 @@ func TestMarshalUnmarshalImageConfig(t *testing.T) {
 	config.Comment = "This is a test comment"
 	content, err := config.MarshalJSON()
 	require.NoError(err)
+	// Images without layers still have a diff_ids array, as the spec requires.
+	require.Contains(string(content), `"diff_ids":[]`)
 
 	newConfig, err := NewImageConfigFromJSON(content)
 	newConfig.rawJSON = nil
@@ -17,16 +17,16 @@ package image
 import (
 	"fmt"
 	"path/filepath"
-	"regexp"
 	"strings"
 
+	"github.com/uber/makisu/lib/docker/reference"
 	"github.com/uber/makisu/lib/utils"
 )
 
 // Docker hub defaults.
 const (
-	DockerHubRegistry  = "index.docker.io"
-	DockerHubNamespace = "library"
+	DockerHubRegistry  = reference.DefaultRegistry
+	DockerHubNamespace = reference.DefaultNamespace
 	Scratch            = "scratch"
 )
 
@@ -37,13 +37,23 @@ type Name struct {
 	tag        string
 }
 
-// NewImageName returns a new image name given a registry, repo and tag.
+// NewImageName returns a new image name given a registry, repo and tag. The
+// tag may be a digest. Invalid names are kept as is, so they fail where they
+// are used instead of making makisu exit.
 func NewImageName(registry, repo, tag string) Name {
-	rawName := fmt.Sprintf("%s:%s", repo, tag)
+	separator := ":"
+	if strings.Contains(tag, ":") {
+		separator = "@"
+	}
+	rawName := repo + separator + tag
 	if registry != "" {
 		rawName = filepath.Join(registry, rawName)
 	}
-	return MustParseName(rawName)
+	name, err := ParseName(rawName)
+	if err != nil {
+		return Name{registry: registry, repository: repo, tag: tag}
+	}
+	return name
 }
 
 // WithRegistry makes a copy of the image name and sets the registry.
@@ -80,11 +90,17 @@ func (name Name) IsValid() bool {
 	return name.registry != "" && name.repository != "" && name.tag != ""
 }
 
+// HasDigest returns whether the image is pinned by digest rather than by tag.
+func (name Name) HasDigest() bool {
+	// If the tag contains a :, it must be a digest tag of the form <digest-algo>:<digest>.
+	return strings.Contains(name.tag, ":")
+}
+
 // ShortName returns the name of the image without the registry information
 func (name Name) ShortName() string {
 	separator := ":"
-	// If the tag contains a :, it must be a digest tag of the form <digest-algo>:<digest>. Should stringify as <repository>@<digest-algo>:<digest>
-	if strings.Contains(name.tag, ":") {
+	// Digest tags should stringify as <repository>@<digest-algo>:<digest>
+	if name.HasDigest() {
 		separator = "@"
 	}
 	return fmt.Sprintf("%s%s%s", name.GetRepository(), separator, name.tag)
@@ -98,84 +114,44 @@ func (name Name) String() string {
 	return filepath.Join(name.registry, name.ShortName())
 }
 
-// ParseName parses image name of format <registry>/<repo>:<tag>
+// ParseName parses image name of format <registry>/<repo>:<tag> or
+// <registry>/<repo>@<digest>. Names without tag nor digest get the tag
+// "latest".
 func ParseName(input string) (Name, error) {
-	result := Name{
-		registry:   "",
-		repository: input,
-		tag:        "latest",
-	}
-
-	slashIndex := strings.LastIndex(input, "/")
-	sepIndex := strings.LastIndex(input, ":")
-	digestIndex := strings.LastIndex(input, "@")
-	if sepIndex < slashIndex || sepIndex == -1 {
-		// <ip>:<port>/<repo>
-		// <dns>:<port>/<repo>
-		// <dns>/<repo>
-		// <repo>
-		result.repository = input
-		result.tag = "latest"
-	} else if digestIndex < sepIndex && digestIndex > slashIndex {
-		result.repository = input[:digestIndex]
-		sepIndex = strings.LastIndex(result.repository, ":")
-		if sepIndex >= slashIndex && sepIndex != -1 {
-			// A tag can still be specified for informational purposes if a digest is specified
-			// <ip>:<port>/<repo>:<tag>@<digest-algo>:<digest>
-			// <dns>:<port>/<repo>:<tag>@<digest-algo>:<digest>
-			// <repo>:<tag>@<digest-algo>:<digest>
-			result.repository = input[:sepIndex]
-		}
-		// else if no tag is specified result.repository = input[:digestIndex]
-		// <ip>:<port>/<repo>@<digest-algo>:<digest>
-		// <dns>:<port>/<repo>@<digest-algo>:<digest>
-		// <repo>@<digest-algo>:<digest>
-
-		// When pulling by digest, the docker API expects <digest-algo>:<digest> to take the place of the tag
-		result.tag = input[digestIndex+1:]
-	} else {
-		// if sepIndex >= slashIndex && sepIndex != -1 && (digestIndex < slashIndex || digestIndex > sepIndex) -1)
-		// <ip>:<port>/<repo>:<tag>
-		// <dns>:<port>/<repo>:<tag>
-		// <repo>:<tag>
-		result.repository = input[:sepIndex]
-		result.tag = input[sepIndex+1:]
-	}
-
-	// Separate hostname from repo.
-	// It ignores the fact that - cannot be the first or last character, or that _ is not valid
-	// character in URL, but those checks would make the regex too complex.
-	hostnameRegexp := regexp.MustCompile(`^([\w\d\.-]+(\.[\w\d\.-]+|:[\d]+))\/`)
-	parts := hostnameRegexp.FindStringSubmatch(result.repository)
-	if parts != nil {
-		result.registry = parts[1]
-		result.repository = result.repository[len(parts[1])+1:]
+	ref, err := reference.Parse(input)
+	if err != nil {
+		return Name{}, err
 	}
-
-	return result, nil
+	return newName(ref.WithDefaultTag()), nil
 }
 
 // ParseNameForPull parses image name of format <registry>/<repo>:<tag>. If
 // input doesn't contain registry information, apply defaults for dockerhub.
 func ParseNameForPull(input string) (Name, error) {
-	result, err := ParseName(input)
+	ref, err := reference.Parse(input)
 	if err != nil {
-		return result, err
+		return Name{}, err
 	}
-
-	if result.repository == Scratch {
-		return result, nil
+	if ref.Registry() == "" && ref.Repository() == Scratch {
+		return newName(ref.WithDefaultTag()), nil
 	}
+	return newName(ref.Normalize()), nil
+}
 
-	// For docker hub registry.
-	if result.registry == "" {
-		result.registry = DockerHubRegistry
-		if !strings.Contains(result.repository, "/") {
-			result.repository = DockerHubNamespace + "/" + result.repository
-		}
+// newName returns the name of a reference with a tag or digest.
+func newName(ref reference.Reference) Name {
+	// When pulling by digest, the docker API expects <digest-algo>:<digest>
+	// to take the place of the tag. A tag specified along with a digest is
+	// only informational.
+	tag := ref.Tag()
+	if ref.Digest() != "" {
+		tag = ref.Digest()
+	}
+	return Name{
+		registry:   ref.Registry(),
+		repository: ref.Repository(),
+		tag:        tag,
 	}
-
-	return result, nil
 }
 
 // MustParseName calls ParseName on the input and panics if the parsing
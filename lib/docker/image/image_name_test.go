@@ -52,6 +52,7 @@ func TestParseImageName(t *testing.T) {
 	require.Equal(name.GetRepository(), "evanescence-golang-1")
 	require.Equal(name.GetTag(), "latest")
 	require.True(name.IsValid())
+	require.False(name.HasDigest())
 	require.Equal("127.0.0.1:5002/evanescence-golang-1:latest", name.String())
 
 	name, err = ParseNameForPull("127.0.0.1:5002/king-gizzard-golang-1@sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3")
@@ -60,6 +61,7 @@ func TestParseImageName(t *testing.T) {
 	require.Equal(name.GetRepository(), "king-gizzard-golang-1")
 	require.Equal(name.GetTag(), "sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3")
 	require.True(name.IsValid())
+	require.True(name.HasDigest())
 	require.Equal("127.0.0.1:5002/king-gizzard-golang-1@sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3", name.String())
 
 	name, err = ParseNameForPull("127.0.0.1:5002/king-gizzard-golang-1:v1.0.0@sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3")
@@ -70,13 +72,9 @@ func TestParseImageName(t *testing.T) {
 	require.True(name.IsValid())
 	require.Equal("127.0.0.1:5002/king-gizzard-golang-1@sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3", name.String())
 
-	name, err = ParseNameForPull("127.0.0.1:5002/king-gizzard-golang-1:tag-with-an-@-in-it")
-	require.NoError(err)
-	require.Equal(name.GetRegistry(), "127.0.0.1:5002")
-	require.Equal(name.GetRepository(), "king-gizzard-golang-1")
-	require.Equal(name.GetTag(), "tag-with-an-@-in-it")
-	require.True(name.IsValid())
-	require.Equal("127.0.0.1:5002/king-gizzard-golang-1:tag-with-an-@-in-it", name.String())
+	// Tags can't have an @.
+	_, err = ParseNameForPull("127.0.0.1:5002/king-gizzard-golang-1:tag-with-an-@-in-it")
+	require.Error(err)
 
 	name, err = ParseNameForPull("docker-registry01-sjc1:5055/uber-usi/haproxy-agent:sjc1-produ-0000000027")
 	require.NoError(err)
@@ -93,4 +91,33 @@ func TestParseImageName(t *testing.T) {
 	require.Equal(name.GetTag(), "latest")
 	require.True(name.IsValid())
 	require.Equal("scratch:latest", name.String())
+
+	name, err = ParseNameForPull("docker.io/alpine")
+	require.NoError(err)
+	require.Equal("index.docker.io/library/alpine:latest", name.String())
+
+	name, err = ParseName("localhost:5000")
+	require.NoError(err)
+	require.Equal("localhost", name.GetRepository())
+	require.Equal("5000", name.GetTag())
+
+	_, err = ParseName("uber-usi/DockerMover")
+	require.Error(err)
+	_, err = ParseName("docker-registry:tag/uber-usi/dockermover")
+	require.Error(err)
+}
+
+func TestNewImageName(t *testing.T) {
+	require := require.New(t)
+
+	name := NewImageName("127.0.0.1:5002", "king-gizzard-golang-1", "v1.0.0")
+	require.Equal("127.0.0.1:5002/king-gizzard-golang-1:v1.0.0", name.String())
+
+	digest := "sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3"
+	name = NewImageName("127.0.0.1:5002", "king-gizzard-golang-1", digest)
+	require.Equal("king-gizzard-golang-1", name.GetRepository())
+	require.Equal(digest, name.GetTag())
+
+	name = NewImageName("127.0.0.1:5002", "king-gizzard-golang-1", "sha256:abcd")
+	require.Equal("sha256:abcd", name.GetTag())
 }
@@ -0,0 +1,103 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"sort"
+	"time"
+)
+
+// Inspection summarizes an image for `makisu inspect`: its manifest, the
+// runtime settings and history of its config, and the size of its layers.
+type Inspection struct {
+	Name         string               `json:"name"`
+	Architecture string               `json:"architecture,omitempty"`
+	Variant      string               `json:"variant,omitempty"`
+	OS           string               `json:"os,omitempty"`
+	Created      time.Time            `json:"created"`
+	Author       string               `json:"author,omitempty"`
+	User         string               `json:"user,omitempty"`
+	Env          []string             `json:"env,omitempty"`
+	Entrypoint   []string             `json:"entrypoint,omitempty"`
+	Cmd          []string             `json:"cmd,omitempty"`
+	WorkingDir   string               `json:"workingDir,omitempty"`
+	ExposedPorts []string             `json:"exposedPorts,omitempty"`
+	Volumes      []string             `json:"volumes,omitempty"`
+	Labels       map[string]string    `json:"labels,omitempty"`
+	History      []History            `json:"history,omitempty"`
+	Layers       []InspectedLayer     `json:"layers"`
+	Size         int64                `json:"size"`
+	Manifest     DistributionManifest `json:"manifest"`
+}
+
+// InspectedLayer is a layer of an inspected image.
+type InspectedLayer struct {
+	Digest    Digest `json:"digest"`
+	DiffID    Digest `json:"diffID,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+	Size      int64  `json:"size"`
+}
+
+// NewInspection returns the Inspection of an image given its manifest and
+// config.
+func NewInspection(name Name, manifest DistributionManifest, config *Config) *Inspection {
+	inspection := &Inspection{
+		Name:         name.String(),
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+		OS:           config.OS,
+		Created:      config.Created,
+		Author:       config.Author,
+		History:      config.History,
+		Manifest:     manifest,
+	}
+	if c := config.Config; c != nil {
+		inspection.User = c.User
+		inspection.Env = c.Env
+		inspection.Entrypoint = c.Entrypoint
+		inspection.Cmd = c.Cmd
+		inspection.WorkingDir = c.WorkingDir
+		inspection.ExposedPorts = sortedKeys(c.ExposedPorts)
+		inspection.Volumes = sortedKeys(c.Volumes)
+		inspection.Labels = c.Labels
+	}
+
+	var diffIDs []Digest
+	if config.RootFS != nil && len(config.RootFS.DiffIDs) == len(manifest.Layers) {
+		diffIDs = config.RootFS.DiffIDs
+	}
+	inspection.Layers = make([]InspectedLayer, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		inspection.Layers[i] = InspectedLayer{
+			Digest:    layer.Digest,
+			MediaType: layer.MediaType,
+			Size:      layer.Size,
+		}
+		if diffIDs != nil {
+			inspection.Layers[i].DiffID = diffIDs[i]
+		}
+		inspection.Size += layer.Size
+	}
+	return inspection
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
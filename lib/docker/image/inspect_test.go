@@ -0,0 +1,48 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/platform"
+)
+
+func TestNewInspection(t *testing.T) {
+	require := require.New(t)
+
+	manifest, _, err := UnmarshalDistributionManifest(MediaTypeManifest, []byte(busyboxDistManifest))
+	require.NoError(err)
+	config := NewDefaultImageConfig()
+	config.Config.Entrypoint = []string{"/bin/sh"}
+	config.Config.ExposedPorts = map[string]struct{}{"8080/tcp": {}, "443/tcp": {}}
+	config.Config.Labels = map[string]string{"team": "builds"}
+	config.History = []History{{CreatedBy: "ADD rootfs.tar /"}}
+	config.RootFS.DiffIDs = []Digest{Digest("sha256:diff")}
+
+	inspection := NewInspection(MustParseName("registry.example.com/app:v1"), manifest, &config)
+	require.Equal("registry.example.com/app:v1", inspection.Name)
+	require.Equal(platform.Default().Architecture, inspection.Architecture)
+	require.Equal("linux", inspection.OS)
+	require.Equal([]string{"/bin/sh"}, inspection.Entrypoint)
+	require.Equal([]string{"443/tcp", "8080/tcp"}, inspection.ExposedPorts)
+	require.Equal("builds", inspection.Labels["team"])
+	require.Len(inspection.History, 1)
+	require.Len(inspection.Layers, 1)
+	require.Equal(manifest.Layers[0].Digest, inspection.Layers[0].Digest)
+	require.Equal(Digest("sha256:diff"), inspection.Layers[0].DiffID)
+	require.Equal(manifest.Layers[0].Size, inspection.Size)
+}
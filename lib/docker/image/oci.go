@@ -0,0 +1,143 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/uber/makisu/lib/platform"
+)
+
+// Media types and files of the OCI image layout.
+const (
+	// MediaTypeOCIManifest is the mediaType of OCI image manifests.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// MediaTypeOCIConfig is the mediaType of OCI image configs.
+	MediaTypeOCIConfig = "application/vnd.oci.image.config.v1+json"
+
+	// MediaTypeOCIIndex is the mediaType of OCI image indexes.
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+
+	// OCILayoutFileName is the file marking the root of an OCI image layout.
+	OCILayoutFileName = "oci-layout"
+
+	// OCIIndexFileName is the index of the images of an OCI image layout.
+	OCIIndexFileName = "index.json"
+
+	// OCIBlobsDir is the dir of an OCI image layout that contains blobs,
+	// under a sub dir per digest algorithm.
+	OCIBlobsDir = "blobs"
+
+	// OCIRefNameAnnotation is the annotation of index entries with the tag of
+	// the image.
+	OCIRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	// containerdImageNameAnnotation is the annotation containerd imports
+	// images from, with their full name.
+	containerdImageNameAnnotation = "io.containerd.image.name"
+)
+
+// OCILayout is the content of the oci-layout file.
+type OCILayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// NewOCILayout returns the content of the oci-layout file of the current
+// version of the spec.
+func NewOCILayout() OCILayout {
+	return OCILayout{ImageLayoutVersion: "1.0.0"}
+}
+
+// OCIIndex lists the manifests of the images of an OCI image layout.
+type OCIIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// NewOCIIndex returns an empty index.
+func NewOCIIndex() OCIIndex {
+	return OCIIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex, Manifests: []Descriptor{}}
+}
+
+// AddManifest adds the manifest of an image to the index, replacing any entry
+// with the same name.
+func (index *OCIIndex) AddManifest(imageName Name, descriptor Descriptor) {
+	manifests := index.Manifests[:0]
+	for _, d := range index.Manifests {
+		if d.Annotations[containerdImageNameAnnotation] != imageName.String() {
+			manifests = append(manifests, d)
+		}
+	}
+	descriptor.Annotations = map[string]string{
+		OCIRefNameAnnotation:          imageName.GetTag(),
+		containerdImageNameAnnotation: imageName.String(),
+	}
+	index.Manifests = append(manifests, descriptor)
+}
+
+// NewOCIIndexOf returns an index referencing the manifest of a single image
+// of the given platform.
+func NewOCIIndexOf(manifest Descriptor, p platform.Platform) OCIIndex {
+	manifest.Platform = &p
+	index := NewOCIIndex()
+	index.Manifests = append(index.Manifests, manifest)
+	return index
+}
+
+// SelectManifest returns the descriptor of the manifest of the index that
+// best matches a platform. Manifests without platform are ignored.
+func (index OCIIndex) SelectManifest(p platform.Platform) (Descriptor, error) {
+	var descriptors []Descriptor
+	var platforms []platform.Platform
+	var names []string
+	for _, d := range index.Manifests {
+		if d.Platform != nil {
+			descriptors = append(descriptors, d)
+			platforms = append(platforms, *d.Platform)
+			names = append(names, d.Platform.String())
+		}
+	}
+	i := p.Best(platforms)
+	if i < 0 {
+		return Descriptor{}, fmt.Errorf(
+			"no manifest for platform %s, only for %s", p, strings.Join(names, ", "))
+	}
+	return descriptors[i], nil
+}
+
+// NewOCIManifestFromDistribution converts a docker distribution manifest to an
+// OCI manifest. The config and layer blobs are the same, only their media
+// types differ.
+func NewOCIManifestFromDistribution(distribution DistributionManifest) DistributionManifest {
+	manifest := DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        distribution.Config,
+		Layers:        make([]Descriptor, 0, len(distribution.Layers)),
+		Annotations:   distribution.Annotations,
+	}
+	manifest.Config.MediaType = MediaTypeOCIConfig
+	for _, layer := range distribution.Layers {
+		if layer.MediaType == MediaTypeLayer {
+			layer.MediaType = MediaTypeLayerOCI
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	return manifest
+}
@@ -0,0 +1,84 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/uber/makisu/lib/platform"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOCIManifestFromDistribution(t *testing.T) {
+	require := require.New(t)
+
+	distribution, _, err := UnmarshalDistributionManifest(MediaTypeManifest, []byte(busyboxDistManifest))
+	require.NoError(err)
+	distribution.Layers = append(distribution.Layers, Descriptor{
+		MediaType: MediaTypeLayerZstd,
+		Digest:    Digest("sha256:abc"),
+	})
+
+	manifest := NewOCIManifestFromDistribution(distribution)
+	require.Equal(2, manifest.SchemaVersion)
+	require.Equal(MediaTypeOCIManifest, manifest.MediaType)
+	require.Equal(MediaTypeOCIConfig, manifest.Config.MediaType)
+	require.Equal(distribution.Config.Digest, manifest.Config.Digest)
+	require.Len(manifest.Layers, 2)
+	require.Equal(MediaTypeLayerOCI, manifest.Layers[0].MediaType)
+	require.Equal(distribution.Layers[0].Digest, manifest.Layers[0].Digest)
+	require.Equal(MediaTypeLayerZstd, manifest.Layers[1].MediaType)
+
+	// The distribution manifest is left as is.
+	require.Equal(MediaTypeLayer, distribution.Layers[0].MediaType)
+
+	distribution.Annotations = map[string]string{"a": "b"}
+	require.Equal(distribution.Annotations, NewOCIManifestFromDistribution(distribution).Annotations)
+
+	// Registries reject OCI manifests without a layers array.
+	b, err := json.Marshal(NewOCIManifestFromDistribution(DistributionManifest{}))
+	require.NoError(err)
+	require.Contains(string(b), `"layers":[]`)
+}
+
+func TestNewOCIIndexOf(t *testing.T) {
+	require := require.New(t)
+
+	p := platform.Platform{OS: "linux", Architecture: "arm64"}
+	index := NewOCIIndexOf(Descriptor{MediaType: MediaTypeOCIManifest, Digest: Digest("sha256:1")}, p)
+	require.Equal(MediaTypeOCIIndex, index.MediaType)
+	require.Len(index.Manifests, 1)
+	require.Equal(Digest("sha256:1"), index.Manifests[0].Digest)
+	require.Equal(&p, index.Manifests[0].Platform)
+}
+
+func TestOCIIndexAddManifest(t *testing.T) {
+	require := require.New(t)
+
+	index := NewOCIIndex()
+	index.AddManifest(MustParseName("registry.example.com/app:v1"), Descriptor{Digest: Digest("sha256:1")})
+	index.AddManifest(MustParseName("registry.example.com/app:v2"), Descriptor{Digest: Digest("sha256:2")})
+	require.Len(index.Manifests, 2)
+	require.Equal("v1", index.Manifests[0].Annotations[OCIRefNameAnnotation])
+	require.Equal("registry.example.com/app:v1", index.Manifests[0].Annotations[containerdImageNameAnnotation])
+
+	// Images with the same name are replaced.
+	index.AddManifest(MustParseName("registry.example.com/app:v1"), Descriptor{Digest: Digest("sha256:3")})
+	require.Len(index.Manifests, 2)
+	require.Equal(Digest("sha256:2"), index.Manifests[0].Digest)
+	require.Equal(Digest("sha256:3"), index.Manifests[1].Digest)
+}
@@ -0,0 +1,386 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reference parses image references of the form
+// [<registry>/]<repository>[:<tag>][@<digest>], and normalizes them with the
+// rules of docker.
+package reference
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Defaults of docker, applied by Normalize.
+const (
+	DefaultRegistry  = "index.docker.io"
+	DefaultNamespace = "library"
+	DefaultTag       = "latest"
+)
+
+const (
+	maxNameLength = 255
+	maxTagLength  = 128
+)
+
+// dockerHubAliases are the other names of DefaultRegistry.
+var dockerHubAliases = map[string]bool{
+	"docker.io":            true,
+	"registry-1.docker.io": true,
+	DefaultRegistry:        true,
+}
+
+// Error is the error returned for an invalid reference. Offset is the
+// position of the error in the input, in bytes from its start.
+type Error struct {
+	Input  string
+	Offset int
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid reference %q at position %d: %s", e.Input, e.Offset, e.Reason)
+}
+
+// Reference is a parsed image reference.
+type Reference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// Registry returns the registry of the reference, with its port if any. It is
+// empty if the reference has no registry.
+func (r Reference) Registry() string {
+	return r.registry
+}
+
+// Repository returns the repository of the reference, without its registry.
+func (r Reference) Repository() string {
+	return r.repository
+}
+
+// Tag returns the tag of the reference, or an empty string.
+func (r Reference) Tag() string {
+	return r.tag
+}
+
+// Digest returns the digest of the reference, like "sha256:<hex>", or an
+// empty string.
+func (r Reference) Digest() string {
+	return r.digest
+}
+
+// Name returns the registry and repository of the reference.
+func (r Reference) Name() string {
+	if r.registry == "" {
+		return r.repository
+	}
+	return r.registry + "/" + r.repository
+}
+
+// String returns the reference in its full form.
+func (r Reference) String() string {
+	s := r.Name()
+	if r.tag != "" {
+		s += ":" + r.tag
+	}
+	if r.digest != "" {
+		s += "@" + r.digest
+	}
+	return s
+}
+
+// Familiar returns the reference in the short form shown by docker, without
+// the docker hub registry and its library namespace.
+func (r Reference) Familiar() string {
+	if dockerHubAliases[r.registry] {
+		r.registry = ""
+		if strings.HasPrefix(r.repository, DefaultNamespace+"/") &&
+			strings.Count(r.repository, "/") == 1 {
+			r.repository = r.repository[len(DefaultNamespace)+1:]
+		}
+	}
+	return r.String()
+}
+
+// WithDefaultTag returns a copy of the reference with the tag "latest" if it
+// has neither a tag nor a digest.
+func (r Reference) WithDefaultTag() Reference {
+	if r.tag == "" && r.digest == "" {
+		r.tag = DefaultTag
+	}
+	return r
+}
+
+// Normalize returns a copy of the reference with the defaults of docker:
+// references without registry are on docker hub, repositories of docker hub
+// without namespace are in "library", and references without tag nor digest
+// have the tag "latest".
+func (r Reference) Normalize() Reference {
+	if r.registry == "" || dockerHubAliases[r.registry] {
+		r.registry = DefaultRegistry
+		if !strings.Contains(r.repository, "/") {
+			r.repository = DefaultNamespace + "/" + r.repository
+		}
+	}
+	return r.WithDefaultTag()
+}
+
+// ParseNormalized parses a reference and normalizes it.
+func ParseNormalized(s string) (Reference, error) {
+	r, err := Parse(s)
+	if err != nil {
+		return Reference{}, err
+	}
+	return r.Normalize(), nil
+}
+
+// Parse parses a reference as is, without applying any default.
+//
+// Like docker, the first component of the reference is its registry only if
+// it is followed by another component, and contains a "." or a ":", is
+// "localhost", or has upper case letters. That is, "localhost:5000" is the
+// repository "localhost" with tag "5000", while "localhost:5000/app" is the
+// repository "app" of the registry "localhost:5000".
+func Parse(s string) (Reference, error) {
+	if s == "" {
+		return Reference{}, &Error{s, 0, "empty reference"}
+	}
+	var r Reference
+
+	// The digest is after the first "@", since no other part can have one.
+	name := s
+	if i := strings.Index(s, "@"); i >= 0 {
+		name = s[:i]
+		if err := validateDigest(s, i+1); err != nil {
+			return Reference{}, err
+		}
+		r.digest = s[i+1:]
+	}
+
+	// The registry is the first component, if it looks like a hostname.
+	start := 0
+	if i := strings.Index(name, "/"); i >= 0 && isRegistry(name[:i]) {
+		if err := validateRegistry(s, 0, i); err != nil {
+			return Reference{}, err
+		}
+		r.registry = name[:i]
+		start = i + 1
+	}
+
+	// The tag is after the last ":", since repositories can't have one.
+	end := len(name)
+	if i := strings.LastIndex(name, ":"); i >= start {
+		if err := validateTag(s, i+1, end); err != nil {
+			return Reference{}, err
+		}
+		r.tag = name[i+1:]
+		end = i
+	}
+
+	if err := validateRepository(s, start, end); err != nil {
+		return Reference{}, err
+	}
+	r.repository = name[start:end]
+	if len(r.Name()) > maxNameLength {
+		return Reference{}, &Error{s, maxNameLength, fmt.Sprintf(
+			"name is longer than %d characters", maxNameLength)}
+	}
+	return r, nil
+}
+
+func isRegistry(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost" ||
+		strings.ToLower(component) != component
+}
+
+func isAlphaNum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+func isHostChar(c byte) bool {
+	return isAlphaNum(c) || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f'
+}
+
+// validateRegistry validates the hostname and optional port of s[start:end].
+// The hostname is either dot separated labels, or an IPv6 address in
+// brackets.
+func validateRegistry(s string, start, end int) error {
+	host := s[start:end]
+	hostEnd := end
+	if strings.HasPrefix(host, "[") {
+		i := strings.Index(host, "]")
+		if i < 0 {
+			return &Error{s, start, "unterminated IPv6 address"}
+		}
+		for j := start + 1; j < start+i; j++ {
+			if c := s[j]; !isHex(c) && !(c >= 'A' && c <= 'F') && c != ':' {
+				return &Error{s, j, fmt.Sprintf("invalid character %q in IPv6 address", c)}
+			}
+		}
+		hostEnd = start + i + 1
+		if hostEnd < end && s[hostEnd] != ':' {
+			return &Error{s, hostEnd, fmt.Sprintf("invalid character %q after IPv6 address", s[hostEnd])}
+		}
+	} else {
+		if i := strings.Index(host, ":"); i >= 0 {
+			hostEnd = start + i
+		}
+		labelStart := start
+		for j := start; j <= hostEnd; j++ {
+			if j < hostEnd && s[j] != '.' {
+				if c := s[j]; !isHostChar(c) && c != '-' {
+					return &Error{s, j, fmt.Sprintf("invalid character %q in registry", c)}
+				}
+				continue
+			}
+			if j == labelStart {
+				return &Error{s, j, "empty registry component"}
+			}
+			if s[labelStart] == '-' {
+				return &Error{s, labelStart, "registry component starts with '-'"}
+			}
+			if s[j-1] == '-' {
+				return &Error{s, j - 1, "registry component ends with '-'"}
+			}
+			labelStart = j + 1
+		}
+	}
+	if hostEnd < end {
+		port := s[hostEnd+1 : end]
+		if port == "" {
+			return &Error{s, hostEnd + 1, "empty port"}
+		}
+		for j := hostEnd + 1; j < end; j++ {
+			if !isDigit(s[j]) {
+				return &Error{s, hostEnd + 1, fmt.Sprintf("invalid port %q", port)}
+			}
+		}
+	}
+	return nil
+}
+
+// validateRepository validates the slash separated components of
+// s[start:end]. Components are lower case letters and digits, separated by
+// one ".", one or two "_", or any number of "-".
+func validateRepository(s string, start, end int) error {
+	if start == end {
+		return &Error{s, start, "empty repository"}
+	}
+	componentStart := start
+	for j := start; j <= end; j++ {
+		if j < end && s[j] != '/' {
+			c := s[j]
+			switch {
+			case isAlphaNum(c):
+				continue
+			case c >= 'A' && c <= 'Z':
+				return &Error{s, j, "repository must be lowercase"}
+			case c == '.' || c == '_' || c == '-':
+				if j == componentStart {
+					return &Error{s, j, fmt.Sprintf("repository component starts with %q", c)}
+				}
+				prev := s[j-1]
+				if isAlphaNum(prev) || c == '-' && prev == '-' ||
+					c == '_' && prev == '_' && j-2 >= componentStart && s[j-2] != '_' {
+					continue
+				}
+				return &Error{s, j, fmt.Sprintf("invalid separator %q", s[j-1:j+1])}
+			default:
+				return &Error{s, j, fmt.Sprintf("invalid character %q in repository", c)}
+			}
+		}
+		if j == componentStart {
+			return &Error{s, j, "empty repository component"}
+		}
+		if !isAlphaNum(s[j-1]) {
+			return &Error{s, j - 1, fmt.Sprintf("repository component ends with %q", s[j-1])}
+		}
+		componentStart = j + 1
+	}
+	return nil
+}
+
+// validateTag validates s[start:end]: up to 128 letters, digits, "_", "." and
+// "-", not starting with "." or "-".
+func validateTag(s string, start, end int) error {
+	if start == end {
+		return &Error{s, start, "empty tag"}
+	}
+	if end-start > maxTagLength {
+		return &Error{s, start + maxTagLength, fmt.Sprintf(
+			"tag is longer than %d characters", maxTagLength)}
+	}
+	for j := start; j < end; j++ {
+		c := s[j]
+		if isHostChar(c) || c == '_' || (j > start && (c == '.' || c == '-')) {
+			continue
+		}
+		return &Error{s, j, fmt.Sprintf("invalid character %q in tag", c)}
+	}
+	return nil
+}
+
+// validateDigest validates the digest at s[start:], of the form
+// <algorithm>:<encoded>. The encoded part of sha256 and sha512 digests must
+// be of the right length of lower case hex characters.
+func validateDigest(s string, start int) error {
+	digest := s[start:]
+	i := strings.Index(digest, ":")
+	if i < 0 {
+		return &Error{s, start, "digest has no algorithm"}
+	}
+	if i == 0 {
+		return &Error{s, start, "empty digest algorithm"}
+	}
+	algorithm, encoded := digest[:i], digest[i+1:]
+	for j := 0; j < len(algorithm); j++ {
+		if c := algorithm[j]; !isAlphaNum(c) && !strings.ContainsRune("+._-", rune(c)) {
+			return &Error{s, start + j, fmt.Sprintf("invalid character %q in digest algorithm", c)}
+		}
+	}
+	encodedStart := start + i + 1
+	lengths := map[string]int{"sha256": 64, "sha512": 128}
+	if n, ok := lengths[algorithm]; ok {
+		for j := 0; j < len(encoded); j++ {
+			if !isHex(encoded[j]) {
+				return &Error{s, encodedStart + j, fmt.Sprintf("invalid character %q in digest", encoded[j])}
+			}
+		}
+		if len(encoded) != n {
+			return &Error{s, encodedStart, fmt.Sprintf(
+				"%s digest has %d characters instead of %d", algorithm, len(encoded), n)}
+		}
+		return nil
+	}
+	if len(encoded) < 32 {
+		return &Error{s, encodedStart, "digest is shorter than 32 characters"}
+	}
+	for j := 0; j < len(encoded); j++ {
+		if c := encoded[j]; !isHostChar(c) && !strings.ContainsRune("=_-", rune(c)) {
+			return &Error{s, encodedStart + j, fmt.Sprintf("invalid character %q in digest", c)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reference
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const _digest = "sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input      string
+		registry   string
+		repository string
+		tag        string
+		digest     string
+	}{
+		{"alpine", "", "alpine", "", ""},
+		{"alpine:3.9", "", "alpine", "3.9", ""},
+		{"uber/makisu:v0.1.0", "", "uber/makisu", "v0.1.0", ""},
+		{"localhost", "", "localhost", "", ""},
+		{"localhost:5000", "", "localhost", "5000", ""},
+		{"localhost/app", "localhost", "app", "", ""},
+		{"localhost:5000/app:5000", "localhost:5000", "app", "5000", ""},
+		{"registry.example.com/team/app", "registry.example.com", "team/app", "", ""},
+		{"Registry/app", "Registry", "app", "", ""},
+		{"127.0.0.1:5002/app-1:latest", "127.0.0.1:5002", "app-1", "latest", ""},
+		{"[::1]:5000/app", "[::1]:5000", "app", "", ""},
+		{"b__c---d_e/f.g:TAG_1.x-y", "", "b__c---d_e/f.g", "TAG_1.x-y", ""},
+		{"app@" + _digest, "", "app", "", _digest},
+		{"localhost:5000/app:v1@" + _digest, "localhost:5000", "app", "v1", _digest},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			require := require.New(t)
+
+			r, err := Parse(test.input)
+			require.NoError(err)
+			require.Equal(test.registry, r.Registry())
+			require.Equal(test.repository, r.Repository())
+			require.Equal(test.tag, r.Tag())
+			require.Equal(test.digest, r.Digest())
+			require.Equal(test.input, r.String())
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input  string
+		offset int
+		reason string
+	}{
+		{"", 0, "empty reference"},
+		{"app:1.0/name", 4, `invalid port "1.0"`},
+		{"localhost:/app", 10, "empty port"},
+		{"reg_istry.com/app", 3, `invalid character '_' in registry`},
+		{"-registry.com/app", 0, "registry component starts with '-'"},
+		{"registry..com/app", 9, "empty registry component"},
+		{"[::1/app", 0, "unterminated IPv6 address"},
+		{"uber/Makisu", 5, "repository must be lowercase"},
+		{"uber//makisu", 5, "empty repository component"},
+		{"uber/makisu/", 12, "empty repository component"},
+		{"uber/.makisu", 5, `repository component starts with '.'`},
+		{"uber/makisu-", 11, `repository component ends with '-'`},
+		{"uber/ma..kisu", 8, `invalid separator ".."`},
+		{"uber/ma___kisu", 9, `invalid separator "__"`},
+		{"uber/ma kisu", 7, `invalid character ' ' in repository`},
+		{"registry.com/:tag", 13, "empty repository"},
+		{"app:", 4, "empty tag"},
+		{"app:.tag", 4, `invalid character '.' in tag`},
+		{"app:tag-with-an-@-in-it", 17, "digest has no algorithm"},
+		{"app:" + strings.Repeat("t", 129), 132, "tag is longer than 128 characters"},
+		{"app@sha256:abc", 11, "sha256 digest has 3 characters instead of 64"},
+		{"app@sha256:" + strings.ToUpper(_digest[7:]), 12, `invalid character 'A' in digest`},
+		{"app@:abc", 4, "empty digest algorithm"},
+		{"app@foo:short", 8, "digest is shorter than 32 characters"},
+		{strings.Repeat("a", 256), 255, "name is longer than 255 characters"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			require := require.New(t)
+
+			_, err := Parse(test.input)
+			require.Error(err)
+			e, ok := err.(*Error)
+			require.True(ok)
+			require.Equal(test.input, e.Input)
+			require.Equal(test.offset, e.Offset)
+			require.Equal(test.reason, e.Reason)
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		familiar string
+	}{
+		{"alpine", "index.docker.io/library/alpine:latest", "alpine:latest"},
+		{"uber/makisu", "index.docker.io/uber/makisu:latest", "uber/makisu:latest"},
+		{"docker.io/alpine:3.9", "index.docker.io/library/alpine:3.9", "alpine:3.9"},
+		{"registry-1.docker.io/library/alpine", "index.docker.io/library/alpine:latest", "alpine:latest"},
+		{"alpine@" + _digest, "index.docker.io/library/alpine@" + _digest, "alpine@" + _digest},
+		{"localhost:5000/app", "localhost:5000/app:latest", "localhost:5000/app:latest"},
+		{"localhost:5000", "index.docker.io/library/localhost:5000", "localhost:5000"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			require := require.New(t)
+
+			r, err := ParseNormalized(test.input)
+			require.NoError(err)
+			require.Equal(test.expected, r.String())
+			require.Equal(test.familiar, r.Familiar())
+		})
+	}
+}
@@ -0,0 +1,126 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package failure classifies build failures, which determines the exit code
+// of makisu, and describes them in a machine readable report.
+package failure
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Kind is the kind of a build failure.
+type Kind string
+
+// Kinds of failures.
+const (
+	// KindError is any failure that isn't classified otherwise.
+	KindError Kind = "error"
+	// KindParse is a failure to parse the dockerfile or create steps from it.
+	KindParse Kind = "parse"
+	// KindAuth is a failure to authenticate with a registry.
+	KindAuth Kind = "auth"
+	// KindPull is a failure to pull a base image.
+	KindPull Kind = "pull"
+	// KindStep is a failure to execute or commit a step.
+	KindStep Kind = "step"
+	// KindPush is a failure to push the image.
+	KindPush Kind = "push"
+	// KindCache is a failure to read or write the layer cache.
+	KindCache Kind = "cache"
+	// KindPolicy is a base image rejected by the base image policy.
+	KindPolicy Kind = "policy"
+	// KindScan is an image with vulnerabilities above the threshold of --scan,
+	// or a failure to scan it.
+	KindScan Kind = "scan"
+	// KindSecret is a secret found in the layer of a step by
+	// --detect-secrets.
+	KindSecret Kind = "secret"
+	// KindTimeout is a RUN step or a build running longer than
+	// --step-timeout or --build-timeout.
+	KindTimeout Kind = "timeout"
+	// KindBudget is an image over the budgets of --max-image-size or
+	// --max-layer-size.
+	KindBudget Kind = "budget"
+)
+
+var _exitCodes = map[Kind]int{
+	KindError:   1,
+	KindParse:   2,
+	KindAuth:    3,
+	KindPull:    4,
+	KindStep:    5,
+	KindPush:    6,
+	KindCache:   7,
+	KindPolicy:  8,
+	KindScan:    9,
+	KindSecret:  10,
+	KindTimeout: 11,
+	KindBudget:  12,
+}
+
+// ExitCode returns the exit code of makisu for the kind of failure.
+func (k Kind) ExitCode() int {
+	if code, ok := _exitCodes[k]; ok {
+		return code
+	}
+	return 1
+}
+
+// KindOfExitCode returns the kind of failure of an exit code of makisu, or
+// KindError if it's unknown.
+func KindOfExitCode(code int) Kind {
+	for kind, c := range _exitCodes {
+		if c == code {
+			return kind
+		}
+	}
+	return KindError
+}
+
+// Error is an error of a known kind.
+type Error struct {
+	Kind Kind
+	msg  string
+}
+
+// Errorf returns a new Error of the given kind.
+func Errorf(kind Kind, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+// KindOf returns the kind of err if it's an Error, or _default otherwise.
+func KindOf(err error, _default Kind) Kind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return _default
+}
+
+// _authErrorRegexp matches the errors of registry requests rejected with 401
+// or 403, and of token requests.
+var _authErrorRegexp = regexp.MustCompile(
+	`(?i)(\b(GET|HEAD|POST|PUT|PATCH|DELETE) \S+ (401|403)\b|\bunauthorized\b)`)
+
+// isAuthError returns true if err is caused by a registry rejecting the
+// credentials of makisu. Errors are wrapped as strings through the registry
+// client, so the status is found in the message.
+func isAuthError(err error) bool {
+	return _authErrorRegexp.MatchString(err.Error())
+}
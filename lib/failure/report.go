@@ -0,0 +1,204 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/uber/makisu/lib/redact"
+)
+
+// MaxOutputLines is the number of lines of output kept for the report.
+const MaxOutputLines = 100
+
+// MaxLineLength is the number of bytes kept of each line of output, so
+// commands printing huge lines don't blow the memory of makisu.
+const MaxLineLength = 4096
+
+// Report describes why a build failed. It is written as JSON for CI systems.
+type Report struct {
+	Kind      Kind   `json:"kind"`
+	ExitCode  int    `json:"exit_code"`
+	Error     string `json:"error"`
+	Stage     string `json:"stage,omitempty"`
+	Step      int    `json:"step,omitempty"`
+	Directive string `json:"directive,omitempty"`
+	// Command and Output are the command of the RUN step that failed, and the
+	// last lines it wrote to stdout and stderr.
+	Command string   `json:"command,omitempty"`
+	Output  []string `json:"output,omitempty"`
+	// Timeout is the limit that was exceeded by a failure of kind timeout,
+	// "step" or "build".
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// Write writes the report as JSON to path.
+func (r *Report) Write(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal report: %s", err)
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("write report: %s", err)
+	}
+	return nil
+}
+
+// Recorder records the details of a failure while a build runs. Its methods
+// can be called on a nil Recorder, which records nothing.
+type Recorder struct {
+	sync.Mutex
+
+	kind      Kind
+	stage     string
+	step      int
+	directive string
+	command   string
+	output    []string
+	timeout   string
+}
+
+// NewRecorder returns a new Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// SetKind records the kind of the failure, unless one was already recorded by
+// the code closer to the cause.
+func (r *Recorder) SetKind(kind Kind) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.kind == "" {
+		r.kind = kind
+	}
+}
+
+// SetStep records the step that failed.
+func (r *Recorder) SetStep(stage string, step int, directive string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.stage, r.step, r.directive = stage, step, directive
+}
+
+// SetCommand records the command that failed and the last lines of its output.
+func (r *Recorder) SetCommand(command string, output []string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.command, r.output = command, output
+}
+
+// SetTimeout records a timeout failure, and the limit that was exceeded.
+func (r *Recorder) SetTimeout(limit string) {
+	if r == nil {
+		return
+	}
+	r.SetKind(KindTimeout)
+	r.Lock()
+	defer r.Unlock()
+	if r.timeout == "" {
+		r.timeout = limit
+	}
+}
+
+// Report returns the report of a build that failed with err. The recorded kind
+// takes precedence over the kind of err, and failures to reach registries are
+// classified as auth failures if they were rejected for their credentials.
+// Secret values are masked in the report.
+func (r *Recorder) Report(err error) *Report {
+	report := &Report{
+		Kind:  KindOf(err, KindError),
+		Error: redact.String(err.Error()),
+	}
+	if r != nil {
+		r.Lock()
+		if r.kind != "" {
+			report.Kind = r.kind
+		}
+		report.Stage, report.Step = r.stage, r.step
+		report.Directive = redact.String(r.directive)
+		report.Command = redact.String(r.command)
+		report.Output = redact.Strings(r.output)
+		report.Timeout = r.timeout
+		r.Unlock()
+	}
+	switch report.Kind {
+	case KindPull, KindPush, KindCache, KindError:
+		if isAuthError(err) {
+			report.Kind = KindAuth
+		}
+	}
+	report.ExitCode = report.Kind.ExitCode()
+	return report
+}
+
+// Tail keeps the last lines written to it.
+type Tail struct {
+	sync.Mutex
+
+	max     int
+	lines   []string
+	partial string
+}
+
+// NewTail returns a new Tail keeping max lines.
+func NewTail(max int) *Tail {
+	return &Tail{max: max}
+}
+
+// Write implements io.Writer.
+func (t *Tail) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	lines := strings.Split(t.partial+string(p), "\n")
+	for i, line := range lines {
+		if len(line) > MaxLineLength {
+			// Copied, so the rest of the line can be freed.
+			lines[i] = string([]byte(line[:MaxLineLength]))
+		}
+	}
+	t.partial = lines[len(lines)-1]
+	t.lines = append(t.lines, lines[:len(lines)-1]...)
+	if len(t.lines) > t.max {
+		t.lines = append([]string(nil), t.lines[len(t.lines)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// Lines returns the last lines written, including an unterminated one.
+func (t *Tail) Lines() []string {
+	t.Lock()
+	defer t.Unlock()
+	lines := append([]string(nil), t.lines...)
+	if t.partial != "" {
+		lines = append(lines, t.partial)
+	}
+	if len(lines) > t.max {
+		lines = lines[len(lines)-t.max:]
+	}
+	return lines
+}
@@ -0,0 +1,137 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failure
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uber/makisu/lib/redact"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderReport(t *testing.T) {
+	require := require.New(t)
+
+	// Errors of a known kind set the exit code.
+	var r *Recorder
+	report := r.Report(Errorf(KindPush, "failed to push image: %s", "timeout"))
+	require.Equal(KindPush, report.Kind)
+	require.Equal(6, report.ExitCode)
+	require.Equal("failed to push image: timeout", report.Error)
+
+	report = r.Report(errors.New("unexpected"))
+	require.Equal(KindError, report.Kind)
+	require.Equal(1, report.ExitCode)
+
+	// Registries rejecting credentials are auth failures.
+	report = r.Report(Errorf(KindPull,
+		"pull manifest: GET https://registry.example.com/v2/repo/manifests/latest 401: denied"))
+	require.Equal(KindAuth, report.Kind)
+	require.Equal(3, report.ExitCode)
+
+	// The recorded kind and step take precedence.
+	r = NewRecorder()
+	r.SetKind(KindStep)
+	r.SetKind(KindCache)
+	r.SetStep("builder", 3, "RUN make")
+	r.SetCommand("make", []string{"error: 401"})
+	report = r.Report(errors.New("execute stage: cmd wait: exit status 2"))
+	require.Equal(KindStep, report.Kind)
+	require.Equal(5, report.ExitCode)
+	require.Equal("builder", report.Stage)
+	require.Equal(3, report.Step)
+	require.Equal("RUN make", report.Directive)
+	require.Equal("make", report.Command)
+	require.Equal([]string{"error: 401"}, report.Output)
+
+	// Timeouts record the limit that was exceeded.
+	r = NewRecorder()
+	r.SetTimeout("step")
+	r.SetTimeout("build")
+	r.SetKind(KindStep)
+	report = r.Report(errors.New("execute stage: RUN step timed out"))
+	require.Equal(KindTimeout, report.Kind)
+	require.Equal(11, report.ExitCode)
+	require.Equal("step", report.Timeout)
+
+	// Secret values are masked.
+	redact.Add("s3cr3t")
+	defer redact.Reset()
+	r = NewRecorder()
+	r.SetStep("", 2, "RUN login s3cr3t")
+	r.SetCommand("login s3cr3t", []string{"invalid token s3cr3t"})
+	report = r.Report(errors.New("run login s3cr3t: exit status 1"))
+	require.Equal("RUN login ****", report.Directive)
+	require.Equal("login ****", report.Command)
+	require.Equal([]string{"invalid token ****"}, report.Output)
+	require.Equal("run login ****: exit status 1", report.Error)
+}
+
+func TestReportWrite(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "failure")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "failure.json")
+	report := NewRecorder().Report(Errorf(KindParse, "bad dockerfile"))
+	require.NoError(report.Write(path))
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	var result map[string]interface{}
+	require.NoError(json.Unmarshal(b, &result))
+	require.Equal(map[string]interface{}{
+		"kind":      "parse",
+		"exit_code": float64(2),
+		"error":     "bad dockerfile",
+	}, result)
+}
+
+func TestTail(t *testing.T) {
+	require := require.New(t)
+
+	tail := NewTail(2)
+	require.Empty(tail.Lines())
+	tail.Write([]byte("a\nb"))
+	require.Equal([]string{"a", "b"}, tail.Lines())
+	tail.Write([]byte("c\nd\ne"))
+	require.Equal([]string{"d", "e"}, tail.Lines())
+	tail.Write([]byte("\n"))
+	require.Equal([]string{"d", "e"}, tail.Lines())
+
+	// Long lines are truncated, even if they aren't terminated yet.
+	long := strings.Repeat("x", MaxLineLength)
+	tail.Write([]byte(long + "yyy"))
+	tail.Write([]byte("zzz\nf"))
+	require.Equal([]string{long, "f"}, tail.Lines())
+}
+
+func TestKindOfExitCode(t *testing.T) {
+	require := require.New(t)
+
+	for kind := range _exitCodes {
+		require.Equal(kind, KindOfExitCode(kind.ExitCode()))
+	}
+	require.Equal(KindError, KindOfExitCode(137))
+}
@@ -0,0 +1,39 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fileio
+
+import (
+	"io"
+	"sync"
+)
+
+// _copyBufferSize is the size of the buffers of the copies the kernel can't
+// do, larger than the 32KB of io.Copy so large files take fewer syscalls.
+const _copyBufferSize = 1 << 20
+
+var _copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, _copyBufferSize)
+		return &b
+	},
+}
+
+// copyBuffered copies r to w through a pooled buffer.
+func copyBuffered(w io.Writer, r io.Reader) error {
+	b := _copyBuffers.Get().(*[]byte)
+	defer _copyBuffers.Put(b)
+	// Hide ReadFrom and WriteTo, which would copy through their own buffers.
+	_, err := io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r}, *b)
+	return err
+}
@@ -0,0 +1,74 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fileio
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// _ficlone is the FICLONE ioctl, which makes dst share the extents of src on
+// file systems supporting reflinks, like btrfs and xfs.
+const _ficlone = 0x40049409
+
+// _copyFileRangeChunk is the maximum length of a single copy_file_range call.
+const _copyFileRangeChunk = 1 << 30
+
+// _noCopyFileRange is set once the kernel turned out not to have
+// copy_file_range, so it isn't tried for every file.
+var _noCopyFileRange int32
+
+// copyContents copies the content of src to dst, which must be empty, and
+// whose offsets must be at the start. It clones src if the file system
+// supports it, or else has the kernel copy it with copy_file_range, without
+// going through userspace. Copies that neither supports, like across file
+// systems on older kernels, fall back to a buffered copy.
+func copyContents(dst, src *os.File, size int64) error {
+	// Files of /proc and the like are empty according to stat, and only
+	// copied by reading them.
+	if size == 0 {
+		return copyBuffered(dst, src)
+	}
+	if err := unix.IoctlSetInt(int(dst.Fd()), _ficlone, int(src.Fd())); err == nil {
+		return nil
+	}
+	if atomic.LoadInt32(&_noCopyFileRange) == 0 {
+		var copied int64
+		for copied < size {
+			chunk := size - copied
+			if chunk > _copyFileRangeChunk {
+				chunk = _copyFileRangeChunk
+			}
+			n, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, int(chunk), 0)
+			if err == syscall.EINTR {
+				continue
+			} else if err == syscall.ENOSYS {
+				atomic.StoreInt32(&_noCopyFileRange, 1)
+				break
+			} else if err != nil && copied > 0 {
+				return err
+			} else if err != nil || n == 0 {
+				// Not supported between these file systems, or the file
+				// shrank: the rest is copied from the offsets reached.
+				break
+			}
+			copied += int64(n)
+		}
+	}
+	// Copies what's left, like what was appended to src since it was stat'ed.
+	return copyBuffered(dst, src)
+}
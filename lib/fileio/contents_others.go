@@ -11,12 +11,14 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
+// +build !linux
 
-package snapshot
+package fileio
 
-const _whiteoutPrefix = ".wh."
+import "os"
 
-// WhiteoutMetaPrefix means it is AUFS metadata, not for removing files.
-// Should be ignored during untar.
-// TODO: There could be hardlinks pointing to files under /.wh..wh.plnk.
-const _whiteoutMetaPrefix = _whiteoutPrefix + _whiteoutPrefix
+// copyContents copies the content of src to dst, which must be empty. The
+// kernel copies are only supported on linux.
+func copyContents(dst, src *os.File, size int64) error {
+	return copyBuffered(dst, src)
+}
@@ -17,7 +17,6 @@ package fileio
 import (
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -25,6 +24,7 @@ import (
 
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 )
 
@@ -156,7 +156,7 @@ func (c *Copier) CopyDir(source, target string) error {
 }
 
 func (c *Copier) isBlacklisted(source string) bool {
-	return pathutils.IsDescendantOfAny(source, c.blacklist)
+	return pathutils.IsBlacklisted(source, c.blacklist)
 }
 
 // copyFile copies the permissions and contents of the file at src to dst.
@@ -208,7 +208,7 @@ func (c *Copier) copyRegularFile(fi os.FileInfo, src, dst string) error {
 	}
 
 	// Copy contents from src to dst.
-	if _, err := io.Copy(w, r); err != nil {
+	if err := copyContents(w, r, fi.Size()); err != nil {
 		return fmt.Errorf("copy %s to %s: %s", src, dst, err)
 	}
 
@@ -226,6 +226,10 @@ func (c *Copier) copyRegularFile(fi os.FileInfo, src, dst string) error {
 	if err := os.Chmod(dst, fi.Mode()); err != nil {
 		return fmt.Errorf("chmod %s: %s", dst, err)
 	}
+	// Xattrs are copied last too, since chown clears security.capability.
+	if err := tario.CopyXattrs(src, dst); err != nil {
+		return fmt.Errorf("copy xattrs %s: %s", dst, err)
+	}
 	return nil
 }
 
@@ -308,12 +312,10 @@ func (c *Copier) copyDir(src, dst string) error {
 		return fmt.Errorf("dst is not a directory")
 	}
 
-	// Change mode of dst to that of src, and change owner of dst accordingly.
+	// Change owner of dst to that of src accordingly, and its mode to that of
+	// src.
 	// Note: Chmod needs to be called after chown, otherwise setuid and setgid
 	// bits could be unset.
-	if err := os.Chmod(dst, srcInfo.Mode()); err != nil {
-		return fmt.Errorf("chmod %s: %s", dst, err)
-	}
 	uid, gid := getFileOwners(srcInfo)
 	if c.dstFileAndChildrenOwner != nil && c.dstFileAndChildrenOwner.overwrite {
 		uid = c.dstFileAndChildrenOwner.uid
@@ -322,6 +324,12 @@ func (c *Copier) copyDir(src, dst string) error {
 	if err := os.Chown(dst, uid, gid); err != nil {
 		return fmt.Errorf("chown %s: %s", dst, err)
 	}
+	if err := os.Chmod(dst, srcInfo.Mode()); err != nil {
+		return fmt.Errorf("chmod %s: %s", dst, err)
+	}
+	if err := tario.CopyXattrs(src, dst); err != nil {
+		return fmt.Errorf("copy xattrs %s: %s", dst, err)
+	}
 
 	return nil
 }
@@ -19,6 +19,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/uber/makisu/lib/pathutils"
@@ -38,6 +39,31 @@ func init() {
 	}
 }
 
+// _netRawCapability is the security.capability xattr of a binary with
+// cap_net_raw+ep, like ping.
+var _netRawCapability = []byte{
+	0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// _userACL is the system.posix_acl_access xattr of a 0755 file that user 1000
+// can also read, i.e. "u::rwx,u:1000:r-x,g::r-x,m::r-x,o::r-x".
+var _userACL = []byte{
+	0x02, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x07, 0x00, 0xff, 0xff, 0xff, 0xff,
+	0x02, 0x00, 0x05, 0x00, 0xe8, 0x03, 0x00, 0x00,
+	0x04, 0x00, 0x05, 0x00, 0xff, 0xff, 0xff, 0xff,
+	0x10, 0x00, 0x05, 0x00, 0xff, 0xff, 0xff, 0xff,
+	0x20, 0x00, 0x05, 0x00, 0xff, 0xff, 0xff, 0xff,
+}
+
+func getXattr(require *require.Assertions, p, name string) []byte {
+	value := make([]byte, 256)
+	size, err := syscall.Getxattr(p, name, value)
+	require.NoError(err)
+	return value[:size]
+}
+
 func TestCopyFileDanglingSymlink(t *testing.T) {
 	require := require.New(t)
 
@@ -165,6 +191,55 @@ func TestCopyFileTargetOverwrite(t *testing.T) {
 	require.Equal(testString, string(result))
 }
 
+func TestCopyFileLarge(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "testCopy")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Larger than the copy buffers, over a longer file.
+	content := make([]byte, 3*_copyBufferSize+123)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	source := filepath.Join(dir, "source")
+	target := filepath.Join(dir, "target")
+	require.NoError(ioutil.WriteFile(source, content, 0644))
+	require.NoError(ioutil.WriteFile(target, make([]byte, 4*_copyBufferSize), 0644))
+
+	c := NewCopier(pathutils.DefaultBlacklist)
+	require.NoError(c.CopyFile(source, target))
+
+	result, err := ioutil.ReadFile(target)
+	require.NoError(err)
+	require.Equal(content, result)
+}
+
+func TestCopyFileEmptyStatSize(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "testCopy")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Files of /proc have a size of 0, but a content.
+	src, err := os.Open("/proc/self/mounts")
+	if os.IsNotExist(err) {
+		t.Skip("no /proc")
+	}
+	require.NoError(err)
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(dir, "mounts"))
+	require.NoError(err)
+	defer dst.Close()
+
+	require.NoError(copyContents(dst, src, 0))
+	info, err := dst.Stat()
+	require.NoError(err)
+	require.True(info.Size() > 0)
+}
+
 func TestCopyDirectoryTargetNotExist(t *testing.T) {
 	require := require.New(t)
 
@@ -353,3 +428,42 @@ func TestCopyDirectoryInfiniteLoop(t *testing.T) {
 	_, err = os.Stat(path.Join(targetDir, path.Base(targetDir)))
 	require.True(os.IsNotExist(err))
 }
+
+func TestCopyDirectoryPreservesSpecialPermissions(t *testing.T) {
+	require := require.New(t)
+
+	sourceDir, err := ioutil.TempDir("/tmp", "testCopy")
+	require.NoError(err)
+	defer os.RemoveAll(sourceDir)
+	targetDir, err := ioutil.TempDir("/tmp", "testCopyTargetDir")
+	require.NoError(err)
+	defer os.RemoveAll(targetDir)
+
+	require.NoError(os.Mkdir(filepath.Join(sourceDir, "bin"), 0755))
+	require.NoError(os.Mkdir(filepath.Join(sourceDir, "shared"), 0775))
+	require.NoError(os.Chmod(filepath.Join(sourceDir, "shared"), 0775|os.ModeSetgid))
+	for _, name := range []string{"bin/ping", "bin/sudo", "data"} {
+		require.NoError(ioutil.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0755))
+	}
+	require.NoError(os.Chmod(filepath.Join(sourceDir, "bin/sudo"), 0755|os.ModeSetuid))
+	if err := syscall.Setxattr(
+		filepath.Join(sourceDir, "bin/ping"), "security.capability", _netRawCapability, 0); err != nil {
+		t.Skipf("File capabilities not supported: %s", err)
+	} else if err := syscall.Setxattr(
+		filepath.Join(sourceDir, "data"), "system.posix_acl_access", _userACL, 0); err != nil {
+		t.Skipf("ACLs not supported: %s", err)
+	}
+
+	// Chown clears capabilities and setuid bits, which must be restored.
+	c := NewCopier(pathutils.DefaultBlacklist, WithDstFileAndChildrenOwner(1, 1, true))
+	require.NoError(c.CopyDir(sourceDir, targetDir))
+
+	require.Equal(_netRawCapability, getXattr(require, filepath.Join(targetDir, "bin/ping"), "security.capability"))
+	require.Equal(_userACL, getXattr(require, filepath.Join(targetDir, "data"), "system.posix_acl_access"))
+	fi, err := os.Stat(filepath.Join(targetDir, "bin/sudo"))
+	require.NoError(err)
+	require.Equal(0755|os.ModeSetuid, fi.Mode())
+	fi, err = os.Stat(filepath.Join(targetDir, "shared"))
+	require.NoError(err)
+	require.Equal(0775|os.ModeDir|os.ModeSetgid, fi.Mode())
+}
@@ -0,0 +1,82 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package isolation runs the commands of RUN steps in mount, pid, ipc and uts
+// namespaces of their own. The root of the build becomes their root with
+// pivot_root, the files of makisu are hidden, and the sensitive files of
+// /proc are masked. Commands can also be run by an OCI runtime like runc or
+// crun, see OCIRuntime.
+package isolation
+
+import "os/exec"
+
+// _configEnv is set in the environment of the processes started by Command,
+// which read their Config from stdin.
+const _configEnv = "_MAKISU_ISOLATION"
+
+// Files of /proc made read-only or masked, like docker does.
+var (
+	_readOnlyProcPaths = []string{
+		"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+	}
+	_maskedProcPaths = []string{
+		"/proc/acpi", "/proc/kcore", "/proc/keys", "/proc/latency_stats",
+		"/proc/sched_debug", "/proc/scsi", "/proc/timer_list", "/proc/timer_stats",
+	}
+)
+
+// Runtime creates the commands that run configs isolated.
+type Runtime interface {
+	Command(config *Config) (*exec.Cmd, error)
+}
+
+// RuntimeFunc is a function implementing Runtime.
+type RuntimeFunc func(config *Config) (*exec.Cmd, error)
+
+// Command calls f(config).
+func (f RuntimeFunc) Command(config *Config) (*exec.Cmd, error) { return f(config) }
+
+// Namespaces is the runtime of Command, that sets up the namespaces of
+// commands itself.
+var Namespaces Runtime = RuntimeFunc(Command)
+
+// Config describes an isolated command.
+type Config struct {
+	// Root is the root file system of the command. It's bind mounted at Stage,
+	// an empty dir, which then becomes the root. OCIRuntime writes its bundle
+	// to Stage instead.
+	Root  string `json:"root"`
+	Stage string `json:"stage"`
+
+	// Masked are paths in Root hidden by an empty read-only dir, or by
+	// /dev/null for files. / is never masked.
+	Masked []string `json:"masked"`
+
+	// NoNetwork runs the command in a network namespace of its own, with no
+	// interface other than a loopback one that is down.
+	NoNetwork bool `json:"no_network"`
+
+	// Dir is the working dir of the command in the new root.
+	Dir string `json:"dir"`
+
+	// Credential sets the user and group of the command if true.
+	Credential bool `json:"credential"`
+	UID        int  `json:"uid"`
+	GID        int  `json:"gid"`
+
+	// Args are the command and its arguments. The command is looked up in the
+	// PATH of Env, in the new root.
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+}
@@ -0,0 +1,194 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Init must be called before anything else by makisu. In processes started by
+// Command, it isolates the process and executes the command, and never
+// returns.
+func Init() {
+	if os.Getenv(_configEnv) == "" {
+		return
+	}
+	var config Config
+	err := json.NewDecoder(os.Stdin).Decode(&config)
+	if err == nil {
+		err = run(&config)
+	}
+	fmt.Fprintf(os.Stderr, "Failed to isolate command: %s\n", err)
+	os.Exit(1)
+}
+
+// Command returns a command that runs makisu again in new namespaces, where
+// it executes config.Args isolated. The config is written to its stdin, so
+// the command itself reads from /dev/null.
+func Command(config *Config) (*exec.Cmd, error) {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("marshal config: %s", err)
+	}
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = []string{_configEnv + "=1"}
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWUTS,
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if config.NoNetwork {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	return cmd, nil
+}
+
+// run sets up the namespaces created by Command, and executes the command.
+// It only returns on errors.
+func run(config *Config) error {
+	if len(config.Args) == 0 {
+		return fmt.Errorf("no command")
+	}
+	// Keep the mounts from propagating to the namespace of makisu.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %s", err)
+	}
+	if err := os.MkdirAll(config.Stage, 0755); err != nil {
+		return fmt.Errorf("create stage dir: %s", err)
+	} else if err := syscall.Mount(
+		config.Root, config.Stage, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount root: %s", err)
+	}
+	for _, p := range config.Masked {
+		if p == "/" {
+			continue
+		} else if err := mask(filepath.Join(config.Stage, p)); err != nil {
+			return fmt.Errorf("mask %s: %s", p, err)
+		}
+	}
+	if err := pivotRoot(config.Stage); err != nil {
+		return err
+	} else if err := mountProc(); err != nil {
+		return err
+	}
+
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		return fmt.Errorf("open %s: %s", os.DevNull, err)
+	} else if err := syscall.Dup3(int(null.Fd()), 0, 0); err != nil {
+		return fmt.Errorf("redirect stdin: %s", err)
+	}
+	null.Close()
+
+	if config.Credential {
+		// syscall.Setuid and Setgid fail on Linux before Go 1.16, and the
+		// raw syscalls only set the credentials of the calling thread, so
+		// the command is executed by the same thread.
+		runtime.LockOSThread()
+		if err := unix.Setgroups(nil); err != nil {
+			return fmt.Errorf("set groups: %s", err)
+		} else if err := unix.Setresgid(config.GID, config.GID, config.GID); err != nil {
+			return fmt.Errorf("set gid: %s", err)
+		} else if err := unix.Setresuid(config.UID, config.UID, config.UID); err != nil {
+			return fmt.Errorf("set uid: %s", err)
+		}
+	}
+	if config.Dir != "" {
+		if err := os.Chdir(config.Dir); err != nil {
+			return fmt.Errorf("chdir: %s", err)
+		}
+	}
+
+	os.Clearenv()
+	for _, kv := range config.Env {
+		if i := strings.Index(kv, "="); i > 0 {
+			os.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+	path, err := exec.LookPath(config.Args[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, config.Args, config.Env)
+}
+
+// pivotRoot makes root, a mountpoint, the root of the mount namespace. The old
+// root is detached, so nothing outside of root is reachable.
+func pivotRoot(root string) error {
+	if err := os.Chdir(root); err != nil {
+		return fmt.Errorf("chdir to new root: %s", err)
+	}
+	// The old root ends up mounted over the new one, without needing a dir
+	// for it.
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %s", err)
+	} else if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detach old root: %s", err)
+	}
+	return os.Chdir("/")
+}
+
+// mountProc mounts the proc file system of the new pid namespace, with its
+// sensitive files masked or read-only.
+func mountProc() error {
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("proc", "/proc", "proc", flags, ""); err != nil {
+		return fmt.Errorf("mount proc: %s", err)
+	}
+	for _, p := range _readOnlyProcPaths {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		} else if err := syscall.Mount(p, p, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind mount %s: %s", p, err)
+		} else if err := syscall.Mount(p, p, "",
+			flags|syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("make %s read-only: %s", p, err)
+		}
+	}
+	for _, p := range _maskedProcPaths {
+		if err := mask(p); err != nil {
+			return fmt.Errorf("mask %s: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// mask hides the content of p with an empty read-only dir, or with /dev/null
+// if p isn't a dir. Missing paths are skipped.
+func mask(p string) error {
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return syscall.Mount("tmpfs", p, "tmpfs", syscall.MS_RDONLY, "mode=755")
+	}
+	return syscall.Mount(os.DevNull, p, "", syscall.MS_BIND, "")
+}
@@ -0,0 +1,88 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// Commands run the test binary again.
+	Init()
+	os.Exit(m.Run())
+}
+
+func TestCommand(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "isolation")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	masked := filepath.Join(dir, "masked")
+	require.NoError(os.MkdirAll(masked, 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(masked, "file"), []byte("secret"), 0644))
+
+	cmd, err := Command(&Config{
+		Root:   "/",
+		Stage:  filepath.Join(dir, "stage"),
+		Masked: []string{masked},
+		Dir:    dir,
+		Args: []string{"sh", "-c",
+			"echo $$ $FOO $(pwd); ls masked; echo x > /proc/sys/kernel/hostname || echo read-only"},
+		Env: []string{"PATH=" + os.Getenv("PATH"), "FOO=bar"},
+	})
+	require.NoError(err)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Skipf("Cannot isolate command: %s: %s", err, stderr.String())
+	}
+	require.Equal("1 bar "+dir+"\nread-only\n", stdout.String())
+
+	// The masked dir is only hidden from the command.
+	_, err = os.Stat(filepath.Join(masked, "file"))
+	require.NoError(err)
+}
+
+func TestCommandNoNetwork(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "isolation")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cmd, err := Command(&Config{
+		Root:      "/",
+		Stage:     filepath.Join(dir, "stage"),
+		NoNetwork: true,
+		Dir:       "/",
+		Args:      []string{"sh", "-c", "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '"},
+		Env:       []string{"PATH=" + os.Getenv("PATH")},
+	})
+	require.NoError(err)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Skipf("Cannot isolate command: %s: %s", err, stderr.String())
+	}
+	require.Equal("lo\n", stdout.String())
+}
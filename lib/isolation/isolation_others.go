@@ -0,0 +1,30 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package isolation
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Init does nothing, commands can't be isolated on this platform.
+func Init() {}
+
+// Command returns an error, commands can't be isolated on this platform.
+func Command(config *Config) (*exec.Cmd, error) {
+	return nil, errors.New("isolation is only supported on linux")
+}
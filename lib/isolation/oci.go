@@ -0,0 +1,189 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+// _ociVersion is the version of the OCI runtime spec of the bundles.
+const _ociVersion = "1.0.2"
+
+// _ociCapabilities are the capabilities of commands run by OCI runtimes, the
+// default ones of docker.
+var _ociCapabilities = []string{
+	"CAP_AUDIT_WRITE", "CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FOWNER", "CAP_FSETID",
+	"CAP_KILL", "CAP_MKNOD", "CAP_NET_BIND_SERVICE", "CAP_NET_RAW", "CAP_SETFCAP",
+	"CAP_SETGID", "CAP_SETPCAP", "CAP_SETUID", "CAP_SYS_CHROOT",
+}
+
+// _ociContainers counts the containers started, to name them.
+var _ociContainers int64
+
+// OCIRuntime runs commands with an OCI runtime like runc or crun. Each command
+// runs in a container of its own, whose bundle is written to the stage dir of
+// its config. Its spec is generated from the config: the root of the config
+// is the root file system of the container, masked paths are masked paths of
+// the spec, and the container gets the mounts, capabilities and masked and
+// read-only paths of /proc that docker gives containers by default.
+type OCIRuntime struct {
+	// Path is the runtime binary, looked up in PATH if it has no slash.
+	Path string
+}
+
+// Command writes the bundle of config, and returns the command running it.
+// The state of the runtime is kept in the stage dir too, so the runtime
+// doesn't need a state dir of its own.
+func (r OCIRuntime) Command(config *Config) (*exec.Cmd, error) {
+	if len(config.Args) == 0 {
+		return nil, fmt.Errorf("no command")
+	}
+	path, err := exec.LookPath(r.Path)
+	if err != nil {
+		return nil, fmt.Errorf("find OCI runtime: %s", err)
+	}
+	content, err := json.MarshalIndent(newOCISpec(config), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal OCI spec: %s", err)
+	}
+	if err := os.MkdirAll(config.Stage, 0755); err != nil {
+		return nil, fmt.Errorf("create bundle dir: %s", err)
+	} else if err := ioutil.WriteFile(
+		filepath.Join(config.Stage, "config.json"), content, 0644); err != nil {
+		return nil, fmt.Errorf("write OCI spec: %s", err)
+	}
+
+	id := fmt.Sprintf("makisu-%d-%d", os.Getpid(), atomic.AddInt64(&_ociContainers, 1))
+	cmd := exec.Command(path,
+		"--root", filepath.Join(config.Stage, "state"), "run", "--bundle", config.Stage, id)
+	// The container is in the process group of the runtime, so it's killed
+	// with it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd, nil
+}
+
+// ociSpec is the part of the OCI runtime spec that makisu sets, see
+// https://github.com/opencontainers/runtime-spec/blob/master/config.md.
+type ociSpec struct {
+	Version  string     `json:"ociVersion"`
+	Process  ociProcess `json:"process"`
+	Root     ociRoot    `json:"root"`
+	Hostname string     `json:"hostname"`
+	Mounts   []ociMount `json:"mounts"`
+	Linux    ociLinux   `json:"linux"`
+}
+
+type ociProcess struct {
+	Terminal     bool            `json:"terminal"`
+	User         ociUser         `json:"user"`
+	Args         []string        `json:"args"`
+	Env          []string        `json:"env"`
+	Cwd          string          `json:"cwd"`
+	Capabilities ociCapabilities `json:"capabilities"`
+}
+
+type ociUser struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+type ociCapabilities struct {
+	Bounding  []string `json:"bounding"`
+	Effective []string `json:"effective"`
+	Permitted []string `json:"permitted"`
+}
+
+type ociRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type ociMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type ociLinux struct {
+	Namespaces    []ociNamespace `json:"namespaces"`
+	MaskedPaths   []string       `json:"maskedPaths"`
+	ReadonlyPaths []string       `json:"readonlyPaths"`
+}
+
+type ociNamespace struct {
+	Type string `json:"type"`
+}
+
+// newOCISpec returns the spec of the container running config.
+func newOCISpec(config *Config) *ociSpec {
+	spec := &ociSpec{
+		Version: _ociVersion,
+		Process: ociProcess{
+			Args: config.Args,
+			Env:  config.Env,
+			Cwd:  config.Dir,
+			Capabilities: ociCapabilities{
+				Bounding:  _ociCapabilities,
+				Effective: _ociCapabilities,
+				Permitted: _ociCapabilities,
+			},
+		},
+		Root:     ociRoot{Path: config.Root},
+		Hostname: "makisu",
+		Mounts: []ociMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs",
+				Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts",
+				Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm",
+				Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue",
+				Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs",
+				Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+		},
+		Linux: ociLinux{
+			Namespaces: []ociNamespace{
+				{Type: "pid"}, {Type: "ipc"}, {Type: "uts"}, {Type: "mount"},
+			},
+			MaskedPaths:   append([]string{}, _maskedProcPaths...),
+			ReadonlyPaths: _readOnlyProcPaths,
+		},
+	}
+	if spec.Process.Cwd == "" {
+		spec.Process.Cwd = "/"
+	}
+	if config.Credential {
+		spec.Process.User = ociUser{UID: config.UID, GID: config.GID}
+	}
+	if config.NoNetwork {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, ociNamespace{Type: "network"})
+	}
+	for _, p := range config.Masked {
+		if p != "/" {
+			spec.Linux.MaskedPaths = append(spec.Linux.MaskedPaths, p)
+		}
+	}
+	return spec
+}
@@ -0,0 +1,93 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOCISpec(t *testing.T) {
+	require := require.New(t)
+
+	spec := newOCISpec(&Config{
+		Root:       "/rootfs",
+		Masked:     []string{"/", "/makisu-storage"},
+		NoNetwork:  true,
+		Credential: true,
+		UID:        1000,
+		GID:        100,
+		Args:       []string{"sh", "-c", "true"},
+		Env:        []string{"PATH=/bin"},
+	})
+	require.Equal("/rootfs", spec.Root.Path)
+	require.Equal("/", spec.Process.Cwd)
+	require.Equal(ociUser{UID: 1000, GID: 100}, spec.Process.User)
+	require.Equal([]string{"sh", "-c", "true"}, spec.Process.Args)
+	require.Contains(spec.Linux.MaskedPaths, "/makisu-storage")
+	require.Contains(spec.Linux.MaskedPaths, "/proc/kcore")
+	require.NotContains(spec.Linux.MaskedPaths, "/")
+	require.Contains(spec.Linux.ReadonlyPaths, "/proc/sys")
+	require.Contains(spec.Linux.Namespaces, ociNamespace{Type: "network"})
+
+	// Without NoNetwork, commands share the network of makisu.
+	spec = newOCISpec(&Config{Root: "/", Dir: "/src", Args: []string{"true"}})
+	require.Equal("/src", spec.Process.Cwd)
+	require.NotContains(spec.Linux.Namespaces, ociNamespace{Type: "network"})
+}
+
+func TestOCIRuntimeCommand(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// The fake runtime prints its arguments and the command of the bundle.
+	runtime := filepath.Join(dir, "runc")
+	require.NoError(ioutil.WriteFile(runtime, []byte(`#!/bin/sh
+echo "$@"
+grep -c '"ociVersion"' $5/config.json
+`), 0755))
+
+	stage := filepath.Join(dir, "stage")
+	r := OCIRuntime{Path: runtime}
+	cmd, err := r.Command(&Config{Root: "/", Stage: stage, Args: []string{"true"}})
+	require.NoError(err)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	require.NoError(cmd.Run())
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Len(lines, 2)
+	require.True(strings.HasPrefix(lines[0],
+		"--root "+filepath.Join(stage, "state")+" run --bundle "+stage+" makisu-"), lines[0])
+	require.Equal("1", lines[1])
+
+	content, err := ioutil.ReadFile(filepath.Join(stage, "config.json"))
+	require.NoError(err)
+	var spec ociSpec
+	require.NoError(json.Unmarshal(content, &spec))
+	require.Equal([]string{"true"}, spec.Process.Args)
+
+	_, err = OCIRuntime{Path: filepath.Join(dir, "missing")}.Command(&Config{Args: []string{"true"}})
+	require.Error(err)
+}
@@ -0,0 +1,387 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/log"
+)
+
+const (
+	_makisuContainer  = "makisu"
+	_contextContainer = "context"
+	_contextDir       = "/makisu-context"
+	_uploadDir        = "/makisu-upload"
+	_uploadFile       = "context.tar.gz"
+
+	// _registryConfigDir is where the registry config secret is mounted. The
+	// secret must have a registry.yaml key.
+	_registryConfigDir = "/registry-config"
+
+	// MaxUploadSize is the largest compressed local context that can be
+	// uploaded. ConfigMaps are limited to 1MiB, including their metadata.
+	MaxUploadSize = 1000 << 10
+)
+
+// _pollInterval is how often the pod of the job is checked.
+var _pollInterval = 2 * time.Second
+
+// _fatalWaitingReasons are the reasons of waiting containers that will never
+// start without a change to the job.
+var _fatalWaitingReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// _gitScript clones the ref $2 of the git repository $1 in the context dir,
+// like makisu does for git contexts.
+const _gitScript = `set -e
+cd ` + _contextDir + `
+git init -q
+git remote add origin "$1"
+git fetch -q --depth 1 origin "$2"
+git checkout -q FETCH_HEAD
+git submodule update -q --init --recursive --depth 1
+find . -name .git -prune -exec rm -rf {} +`
+
+// BuildSpec describes a build to run in a kubernetes job.
+type BuildSpec struct {
+	Name      string
+	Namespace string
+	// Image is the makisu image. HelperImage provisions the context in an init
+	// container, and needs sh, tar and git.
+	Image       string
+	HelperImage string
+
+	// Context is either a git URL, cloned by an init container, an http(s) URL
+	// of a tar, downloaded by makisu, or a path in ContextPVC. Local contexts
+	// are uploaded as ContextTar, a gzip tar of at most MaxUploadSize bytes.
+	Context    string
+	ContextTar []byte
+	ContextPVC string
+
+	// BuildFlags are passed to makisu build, before the context.
+	BuildFlags           []string
+	RegistryConfigSecret string
+	ServiceAccount       string
+
+	// Timeout bounds the duration of the job, if set.
+	Timeout time.Duration
+	// Keep leaves the job and its pod around after the build.
+	Keep bool
+}
+
+// NewBuildName returns a random job name.
+func NewBuildName() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return "makisu-build-" + hex.EncodeToString(b)
+}
+
+// NewBuildJob returns the job running the build of spec, and the config map
+// the local context is uploaded in, or nil.
+func NewBuildJob(spec BuildSpec) (*Job, *ConfigMap, error) {
+	labels := map[string]string{"app": "makisu-build", "makisu-build": spec.Name}
+	backoffLimit := int32(0)
+	job := &Job{
+		ObjectMeta: ObjectMeta{Name: spec.Name, Namespace: spec.Namespace, Labels: labels},
+		Spec: JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: PodTemplateSpec{
+				ObjectMeta: ObjectMeta{Labels: labels},
+				Spec: PodSpec{
+					RestartPolicy:      "Never",
+					ServiceAccountName: spec.ServiceAccount,
+				},
+			},
+		},
+	}
+	if spec.Timeout > 0 {
+		deadline := int64(spec.Timeout / time.Second)
+		job.Spec.ActiveDeadlineSeconds = &deadline
+	}
+	podSpec := &job.Spec.Template.Spec
+
+	makisu := Container{
+		Name:            _makisuContainer,
+		Image:           spec.Image,
+		ImagePullPolicy: "IfNotPresent",
+		Args:            []string{"build", "--modifyfs=true"},
+	}
+	if spec.RegistryConfigSecret != "" {
+		makisu.Args = append(makisu.Args,
+			"--registry-config="+path.Join(_registryConfigDir, "registry.yaml"))
+		makisu.VolumeMounts = append(makisu.VolumeMounts, VolumeMount{
+			Name: "registry-config", MountPath: _registryConfigDir, ReadOnly: true,
+		})
+		podSpec.Volumes = append(podSpec.Volumes, Volume{
+			Name:   "registry-config",
+			Secret: &SecretVolumeSource{SecretName: spec.RegistryConfigSecret},
+		})
+	}
+	makisu.Args = append(makisu.Args, spec.BuildFlags...)
+
+	var configMap *ConfigMap
+	contextMount := VolumeMount{Name: "context", MountPath: _contextDir}
+	git, isGit := context.ParseGitSource(spec.Context)
+	switch {
+	case spec.ContextPVC != "":
+		makisu.Args = append(makisu.Args, path.Join(_contextDir, spec.Context))
+		contextMount.ReadOnly = true
+		podSpec.Volumes = append(podSpec.Volumes, Volume{
+			Name: "context",
+			PersistentVolumeClaim: &PersistentVolumeClaimVolumeSource{
+				ClaimName: spec.ContextPVC, ReadOnly: true,
+			},
+		})
+	case spec.ContextTar != nil:
+		if len(spec.ContextTar) > MaxUploadSize {
+			return nil, nil, fmt.Errorf(
+				"compressed context is %d bytes, more than the %d bytes that can be uploaded",
+				len(spec.ContextTar), MaxUploadSize)
+		}
+		configMap = &ConfigMap{
+			ObjectMeta: ObjectMeta{Name: spec.Name, Namespace: spec.Namespace, Labels: labels},
+			BinaryData: map[string][]byte{_uploadFile: spec.ContextTar},
+		}
+		makisu.Args = append(makisu.Args, _contextDir)
+		podSpec.InitContainers = append(podSpec.InitContainers, Container{
+			Name:  _contextContainer,
+			Image: spec.HelperImage,
+			Command: []string{
+				"tar", "-xzf", path.Join(_uploadDir, _uploadFile), "-C", _contextDir,
+			},
+			VolumeMounts: []VolumeMount{
+				contextMount,
+				{Name: "upload", MountPath: _uploadDir, ReadOnly: true},
+			},
+		})
+		podSpec.Volumes = append(podSpec.Volumes,
+			Volume{Name: "context", EmptyDir: &EmptyDirVolumeSource{}},
+			Volume{Name: "upload", ConfigMap: &ConfigMapVolumeSource{Name: spec.Name}})
+	case isGit:
+		ref := git.Ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+		makisu.Args = append(makisu.Args, path.Join(_contextDir, git.Subdir))
+		podSpec.InitContainers = append(podSpec.InitContainers, Container{
+			Name:         _contextContainer,
+			Image:        spec.HelperImage,
+			Command:      []string{"sh", "-c", _gitScript, "sh", git.URL, ref},
+			VolumeMounts: []VolumeMount{contextMount},
+		})
+		podSpec.Volumes = append(podSpec.Volumes,
+			Volume{Name: "context", EmptyDir: &EmptyDirVolumeSource{}})
+	case context.IsRemoteSource(spec.Context) && spec.Context != context.StdinContext:
+		// Makisu downloads tars itself.
+		makisu.Args = append(makisu.Args, spec.Context)
+	default:
+		return nil, nil, fmt.Errorf("unsupported context: %s", spec.Context)
+	}
+	if spec.ContextPVC != "" || configMap != nil || isGit {
+		makisu.VolumeMounts = append(makisu.VolumeMounts, contextMount)
+	}
+	podSpec.Containers = []Container{makisu}
+	return job, configMap, nil
+}
+
+// RunBuild runs the build of spec in a job, copies the logs of makisu to w,
+// and returns the exit code of makisu. The job is deleted when the build is
+// over or stop is closed, unless spec.Keep is set.
+func RunBuild(client *Client, spec BuildSpec, w io.Writer, stop <-chan struct{}) (int, error) {
+	job, configMap, err := NewBuildJob(spec)
+	if err != nil {
+		return 0, err
+	}
+	if configMap != nil {
+		if err := client.CreateConfigMap(spec.Namespace, configMap); err != nil {
+			return 0, fmt.Errorf("create context config map: %s", err)
+		}
+		if !spec.Keep {
+			defer func() {
+				if err := client.DeleteConfigMap(spec.Namespace, spec.Name); err != nil && !IsNotFound(err) {
+					log.Warnf("Failed to delete config map %s: %s", spec.Name, err)
+				}
+			}()
+		}
+	}
+	if err := client.CreateJob(spec.Namespace, job); err != nil {
+		return 0, fmt.Errorf("create job: %s", err)
+	}
+	log.Infof("Created job %s in namespace %s", spec.Name, spec.Namespace)
+	if !spec.Keep {
+		defer func() {
+			if err := client.DeleteJob(spec.Namespace, spec.Name); err != nil && !IsNotFound(err) {
+				log.Warnf("Failed to delete job %s: %s", spec.Name, err)
+			} else {
+				log.Infof("Deleted job %s", spec.Name)
+			}
+		}()
+	}
+
+	r := &jobRunner{client: client, spec: spec, w: w, stop: stop}
+	if spec.Timeout > 0 {
+		r.deadline = time.Now().Add(spec.Timeout)
+	}
+	pod, err := r.waitForMakisu()
+	if err != nil {
+		return 0, err
+	}
+	if err := r.streamLogs(pod, _makisuContainer); err != nil {
+		return 0, err
+	}
+	return r.waitForExit()
+}
+
+// jobRunner follows the pod of a build job.
+type jobRunner struct {
+	client   *Client
+	spec     BuildSpec
+	w        io.Writer
+	stop     <-chan struct{}
+	deadline time.Time
+}
+
+// poll calls f until it returns true or an error, the deadline is reached, or
+// stop is closed.
+func (r *jobRunner) poll(f func() (bool, error)) error {
+	for {
+		if done, err := f(); err != nil || done {
+			return err
+		}
+		if !r.deadline.IsZero() && time.Now().After(r.deadline) {
+			return fmt.Errorf("build timed out after %s", r.spec.Timeout)
+		}
+		select {
+		case <-r.stop:
+			return errors.New("build interrupted")
+		case <-time.After(_pollInterval):
+		}
+	}
+}
+
+// getPod returns the pod of the job, or nil if it wasn't created yet.
+func (r *jobRunner) getPod() (*Pod, error) {
+	pods, err := r.client.ListPods(r.spec.Namespace, "job-name="+r.spec.Name)
+	if err != nil {
+		return nil, fmt.Errorf("list pods: %s", err)
+	} else if len(pods) == 0 {
+		return nil, nil
+	}
+	return &pods[0], nil
+}
+
+// waitForMakisu waits until the makisu container of the pod of the job
+// starts, and returns the pod.
+func (r *jobRunner) waitForMakisu() (*Pod, error) {
+	var pod *Pod
+	var waitingReason string
+	err := r.poll(func() (bool, error) {
+		var err error
+		if pod, err = r.getPod(); err != nil || pod == nil {
+			return false, err
+		}
+		for _, status := range pod.Status.InitContainerStatuses {
+			if t := status.State.Terminated; t != nil && t.ExitCode != 0 {
+				r.streamLogs(pod, status.Name)
+				return false, fmt.Errorf("container %s failed with exit code %d", status.Name, t.ExitCode)
+			} else if err := checkWaiting(status); err != nil {
+				return false, err
+			}
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != _makisuContainer {
+				continue
+			} else if status.State.Running != nil || status.State.Terminated != nil {
+				return true, nil
+			} else if err := checkWaiting(status); err != nil {
+				return false, err
+			} else if w := status.State.Waiting; w != nil && w.Reason != waitingReason {
+				waitingReason = w.Reason
+				log.Infof("Pod %s is waiting: %s", pod.Name, w.Reason)
+			}
+		}
+		if pod.Status.Phase == "Failed" {
+			return false, fmt.Errorf("pod %s failed: %s", pod.Name, pod.Status.Message)
+		}
+		return false, nil
+	})
+	return pod, err
+}
+
+// checkWaiting returns an error if a container is waiting for a reason that
+// will not resolve by itself.
+func checkWaiting(status ContainerStatus) error {
+	if w := status.State.Waiting; w != nil && _fatalWaitingReasons[w.Reason] {
+		return fmt.Errorf("container %s cannot start: %s: %s", status.Name, w.Reason, w.Message)
+	}
+	return nil
+}
+
+// streamLogs copies the logs of a container to w until it exits.
+func (r *jobRunner) streamLogs(pod *Pod, container string) error {
+	logs, err := r.client.StreamLogs(r.spec.Namespace, pod.Name, container)
+	if err != nil {
+		return fmt.Errorf("stream logs of %s: %s", container, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(r.w, logs)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		logs.Close()
+		if err != nil {
+			return fmt.Errorf("stream logs of %s: %s", container, err)
+		}
+		return nil
+	case <-r.stop:
+		logs.Close()
+		return errors.New("build interrupted")
+	}
+}
+
+// waitForExit waits until the makisu container terminates, and returns its
+// exit code.
+func (r *jobRunner) waitForExit() (int, error) {
+	var exitCode int
+	err := r.poll(func() (bool, error) {
+		pod, err := r.getPod()
+		if err != nil || pod == nil {
+			return false, err
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if t := status.State.Terminated; status.Name == _makisuContainer && t != nil {
+				exitCode = t.ExitCode
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	return exitCode, err
+}
@@ -0,0 +1,185 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAPIServer runs the pod of created jobs to completion right away, with
+// the given exit code.
+type fakeAPIServer struct {
+	sync.Mutex
+	exitCode   int
+	jobs       map[string]*Job
+	configMaps map[string]*ConfigMap
+	deleted    []string
+}
+
+func newFakeAPIServer(exitCode int) *fakeAPIServer {
+	return &fakeAPIServer{
+		exitCode:   exitCode,
+		jobs:       make(map[string]*Job),
+		configMaps: make(map[string]*ConfigMap),
+	}
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	p := r.URL.Path
+	switch {
+	case r.Method == "POST" && p == "/apis/batch/v1/namespaces/builds/jobs":
+		job := new(Job)
+		json.NewDecoder(r.Body).Decode(job)
+		s.jobs[job.Name] = job
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	case r.Method == "POST" && p == "/api/v1/namespaces/builds/configmaps":
+		configMap := new(ConfigMap)
+		json.NewDecoder(r.Body).Decode(configMap)
+		s.configMaps[configMap.Name] = configMap
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	case r.Method == "GET" && p == "/api/v1/namespaces/builds/pods":
+		name := strings.TrimPrefix(r.URL.Query().Get("labelSelector"), "job-name=")
+		var items []Pod
+		if _, ok := s.jobs[name]; ok {
+			pod := Pod{ObjectMeta: ObjectMeta{Name: name + "-pod"}}
+			pod.Status.ContainerStatuses = []ContainerStatus{{
+				Name: "makisu",
+				State: ContainerState{
+					Terminated: &ContainerStateTerminated{ExitCode: s.exitCode},
+				},
+			}}
+			items = append(items, pod)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	case r.Method == "GET" && strings.HasSuffix(p, "-pod/log"):
+		fmt.Fprintf(w, "building %s\n", r.URL.Query().Get("container"))
+	case r.Method == "DELETE":
+		s.deleted = append(s.deleted, p)
+		w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind":"Status","message":"not found"}`))
+	}
+}
+
+func TestNewBuildJobGitContext(t *testing.T) {
+	require := require.New(t)
+
+	job, configMap, err := NewBuildJob(BuildSpec{
+		Name:                 "makisu-build-test",
+		Namespace:            "builds",
+		Image:                "makisu",
+		HelperImage:          "alpine/git",
+		Context:              "https://github.com/uber/makisu.git#v0.1.0:testdata",
+		BuildFlags:           []string{"-t=test"},
+		RegistryConfigSecret: "registry",
+		Timeout:              time.Hour,
+	})
+	require.NoError(err)
+	require.Nil(configMap)
+	require.Equal(int64(3600), *job.Spec.ActiveDeadlineSeconds)
+
+	podSpec := job.Spec.Template.Spec
+	require.Len(podSpec.InitContainers, 1)
+	require.Equal(
+		[]string{"https://github.com/uber/makisu.git", "v0.1.0"},
+		podSpec.InitContainers[0].Command[4:])
+	require.Len(podSpec.Containers, 1)
+	require.Equal([]string{
+		"build", "--modifyfs=true", "--registry-config=/registry-config/registry.yaml",
+		"-t=test", "/makisu-context/testdata",
+	}, podSpec.Containers[0].Args)
+	require.Len(podSpec.Volumes, 2)
+}
+
+func TestNewBuildJobContextTooLarge(t *testing.T) {
+	require := require.New(t)
+
+	_, _, err := NewBuildJob(BuildSpec{
+		Name:       "makisu-build-test",
+		Context:    "/tmp/context",
+		ContextTar: make([]byte, MaxUploadSize+1),
+	})
+	require.Error(err)
+}
+
+func TestRunBuild(t *testing.T) {
+	require := require.New(t)
+
+	fake := newFakeAPIServer(3)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := NewClient(&Config{Server: server.URL, Namespace: "builds"})
+
+	var logs bytes.Buffer
+	exitCode, err := RunBuild(client, BuildSpec{
+		Name:        "makisu-build-test",
+		Namespace:   "builds",
+		Image:       "makisu",
+		HelperImage: "alpine/git",
+		Context:     "/tmp/context",
+		ContextTar:  []byte("context"),
+		BuildFlags:  []string{"-t=test"},
+	}, &logs, make(chan struct{}))
+	require.NoError(err)
+	require.Equal(3, exitCode)
+	require.Equal("building makisu\n", logs.String())
+
+	require.Contains(fake.jobs, "makisu-build-test")
+	require.Equal([]byte("context"), fake.configMaps["makisu-build-test"].BinaryData["context.tar.gz"])
+	require.Equal([]string{
+		"/apis/batch/v1/namespaces/builds/jobs/makisu-build-test",
+		"/api/v1/namespaces/builds/configmaps/makisu-build-test",
+	}, fake.deleted)
+}
+
+func TestRunBuildKeep(t *testing.T) {
+	require := require.New(t)
+
+	fake := newFakeAPIServer(0)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := NewClient(&Config{Server: server.URL, Namespace: "builds"})
+
+	var logs bytes.Buffer
+	exitCode, err := RunBuild(client, BuildSpec{
+		Name:      "makisu-build-test",
+		Namespace: "builds",
+		Image:     "makisu",
+		Context:   "https://example.com/context.tar.gz",
+		Keep:      true,
+	}, &logs, make(chan struct{}))
+	require.NoError(err)
+	require.Equal(0, exitCode)
+	require.Empty(fake.deleted)
+	require.Equal(
+		"https://example.com/context.tar.gz",
+		fake.jobs["makisu-build-test"].Spec.Template.Spec.Containers[0].Args[2])
+}
@@ -0,0 +1,183 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client is a minimal client of the kubernetes API, covering what is needed
+// to run build jobs.
+type Client struct {
+	config *Config
+	http   *http.Client
+}
+
+// NewClient returns a new Client.
+func NewClient(config *Config) *Client {
+	return &Client{
+		config: config,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     config.TLS,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		},
+	}
+}
+
+// Namespace returns the namespace of the config.
+func (c *Client) Namespace() string {
+	return c.config.Namespace
+}
+
+// StatusError is an error returned by the API server.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+// IsNotFound returns true if err is a 404 returned by the API server.
+func IsNotFound(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.Code == http.StatusNotFound
+}
+
+// CreateConfigMap creates a config map.
+func (c *Client) CreateConfigMap(namespace string, configMap *ConfigMap) error {
+	configMap.APIVersion, configMap.Kind = "v1", "ConfigMap"
+	p := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", namespace)
+	return c.do("POST", p, nil, configMap, nil)
+}
+
+// DeleteConfigMap deletes a config map.
+func (c *Client) DeleteConfigMap(namespace, name string) error {
+	p := fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", namespace, name)
+	return c.do("DELETE", p, nil, nil, nil)
+}
+
+// CreateJob creates a job.
+func (c *Client) CreateJob(namespace string, job *Job) error {
+	job.APIVersion, job.Kind = "batch/v1", "Job"
+	p := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", namespace)
+	return c.do("POST", p, nil, job, nil)
+}
+
+// DeleteJob deletes a job and its pods.
+func (c *Client) DeleteJob(namespace, name string) error {
+	p := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", namespace, name)
+	body := map[string]string{"propagationPolicy": "Background"}
+	return c.do("DELETE", p, nil, body, nil)
+}
+
+// ListPods returns the pods matching a label selector.
+func (c *Client) ListPods(namespace, selector string) ([]Pod, error) {
+	var list struct {
+		Items []Pod `json:"items"`
+	}
+	p := fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace)
+	if err := c.do("GET", p, url.Values{"labelSelector": {selector}}, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// StreamLogs follows the logs of a container until it exits. The caller must
+// close the returned reader.
+func (c *Client) StreamLogs(namespace, pod, container string) (io.ReadCloser, error) {
+	p := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log", namespace, pod)
+	query := url.Values{"container": {container}, "follow": {"true"}}
+	resp, err := c.send("GET", p, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// do sends a request with a JSON body, and decodes the JSON response in out if
+// it's not nil.
+func (c *Client) do(method, p string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("marshal request: %s", err)
+		}
+		body = bytes.NewReader(content)
+	}
+	resp, err := c.send(method, p, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %s", err)
+	}
+	return nil
+}
+
+// send sends a request, and returns the response if its status is 2xx.
+func (c *Client) send(method, p string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := c.config.Server + p
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %s", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	} else if c.config.Username != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s", method, p, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		// Errors are Status objects, with a human readable message.
+		var status struct {
+			Message string `json:"message"`
+		}
+		message := string(bytes.TrimSpace(content))
+		if json.Unmarshal(content, &status) == nil && status.Message != "" {
+			message = status.Message
+		}
+		return nil, &StatusError{Code: resp.StatusCode, Message: message}
+	}
+	return resp, nil
+}
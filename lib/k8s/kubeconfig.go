@@ -0,0 +1,243 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// _serviceAccountDir is where pods find the credentials of their service
+// account.
+const _serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Config is what is needed to talk to the API server of a cluster.
+type Config struct {
+	Server    string
+	Namespace string
+
+	// Token, or Username and Password, authenticate requests. Client
+	// certificates are part of TLS.
+	Token    string
+	Username string
+	Password string
+	TLS      *tls.Config
+}
+
+// kubeConfig is the subset of the kubeconfig file format makisu supports.
+// Auth providers and exec plugins are not supported.
+type kubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			Username              string `yaml:"username"`
+			Password              string `yaml:"password"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// DefaultConfigPath returns the kubeconfig used by kubectl: the first file of
+// $KUBECONFIG, or ~/.kube/config. It returns an empty string if neither is
+// set or exists.
+func DefaultConfigPath() string {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)[0]
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	p := filepath.Join(home, ".kube", "config")
+	if _, err := os.Stat(p); err != nil {
+		return ""
+	}
+	return p
+}
+
+// LoadConfig reads the cluster and user of a context from a kubeconfig file.
+// The current context is used if contextName is empty.
+func LoadConfig(path, contextName string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read kubeconfig: %s", err)
+	}
+	var kc kubeConfig
+	if err := yaml.Unmarshal(content, &kc); err != nil {
+		return nil, fmt.Errorf("unmarshal kubeconfig: %s", err)
+	}
+	if contextName == "" {
+		contextName = kc.CurrentContext
+	}
+	if contextName == "" {
+		return nil, errors.New("kubeconfig has no current context")
+	}
+	// Relative paths of certificates are relative to the kubeconfig.
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	config := &Config{Namespace: "default", TLS: &tls.Config{}}
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == contextName {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			if c.Context.Namespace != "" {
+				config.Namespace = c.Context.Namespace
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %s not found in kubeconfig", contextName)
+	}
+
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		config.Server = strings.TrimSuffix(c.Cluster.Server, "/")
+		config.TLS.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := readData(c.Cluster.CertificateAuthorityData, resolve(c.Cluster.CertificateAuthority))
+		if err != nil {
+			return nil, fmt.Errorf("read certificate authority of cluster %s: %s", clusterName, err)
+		}
+		if ca != nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("invalid certificate authority of cluster %s", clusterName)
+			}
+			config.TLS.RootCAs = pool
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %s not found in kubeconfig", clusterName)
+	} else if config.Server == "" {
+		return nil, fmt.Errorf("cluster %s has no server", clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		cert, err := readData(u.User.ClientCertificateData, resolve(u.User.ClientCertificate))
+		if err != nil {
+			return nil, fmt.Errorf("read client certificate of user %s: %s", userName, err)
+		}
+		key, err := readData(u.User.ClientKeyData, resolve(u.User.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("read client key of user %s: %s", userName, err)
+		}
+		if cert != nil || key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("load client certificate of user %s: %s", userName, err)
+			}
+			config.TLS.Certificates = []tls.Certificate{pair}
+		}
+		config.Token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := ioutil.ReadFile(resolve(u.User.TokenFile))
+			if err != nil {
+				return nil, fmt.Errorf("read token of user %s: %s", userName, err)
+			}
+			config.Token = strings.TrimSpace(string(token))
+		}
+		config.Username, config.Password = u.User.Username, u.User.Password
+	}
+	return config, nil
+}
+
+// InClusterConfig returns the config of the service account of the pod makisu
+// runs in.
+func InClusterConfig() (*Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a kubernetes cluster")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(_serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("read service account token: %s", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(_serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("read service account certificate authority: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account certificate authority")
+	}
+	config := &Config{
+		Server:    "https://" + net.JoinHostPort(host, port),
+		Namespace: "default",
+		Token:     strings.TrimSpace(string(token)),
+		TLS:       &tls.Config{RootCAs: pool},
+	}
+	if ns, err := ioutil.ReadFile(filepath.Join(_serviceAccountDir, "namespace")); err == nil {
+		config.Namespace = strings.TrimSpace(string(ns))
+	}
+	return config, nil
+}
+
+// readData returns the base64 decoded data if it's set, or the content of the
+// file if it's set, or nil.
+func readData(data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	} else if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
@@ -0,0 +1,106 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0644))
+
+	kubeconfig := `
+current-context: dev
+clusters:
+- name: dev-cluster
+  cluster:
+    server: https://dev.example.com:6443/
+    insecure-skip-tls-verify: true
+- name: prod-cluster
+  cluster:
+    server: https://prod.example.com
+contexts:
+- name: dev
+  context:
+    cluster: dev-cluster
+    user: dev-user
+    namespace: builds
+- name: prod
+  context:
+    cluster: prod-cluster
+    user: prod-user
+users:
+- name: dev-user
+  user:
+    token: dev-token
+- name: prod-user
+  user:
+    tokenFile: token
+`
+	p := filepath.Join(dir, "config")
+	require.NoError(ioutil.WriteFile(p, []byte(kubeconfig), 0644))
+
+	config, err := LoadConfig(p, "")
+	require.NoError(err)
+	require.Equal("https://dev.example.com:6443", config.Server)
+	require.Equal("builds", config.Namespace)
+	require.Equal("dev-token", config.Token)
+	require.True(config.TLS.InsecureSkipVerify)
+
+	config, err = LoadConfig(p, "prod")
+	require.NoError(err)
+	require.Equal("https://prod.example.com", config.Server)
+	require.Equal("default", config.Namespace)
+	require.Equal("file-token", config.Token)
+
+	_, err = LoadConfig(p, "staging")
+	require.Error(err)
+}
+
+func TestLoadConfigInvalidCA(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	kubeconfig := `
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com
+    certificate-authority-data: ` + base64.StdEncoding.EncodeToString([]byte("not a cert")) + `
+contexts:
+- name: dev
+  context:
+    cluster: dev
+`
+	p := filepath.Join(dir, "config")
+	require.NoError(ioutil.WriteFile(p, []byte(kubeconfig), 0644))
+	_, err = LoadConfig(p, "")
+	require.Error(err)
+}
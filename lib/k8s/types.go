@@ -0,0 +1,158 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+// The types below are the subset of the kubernetes API objects that build jobs
+// need, with the same JSON encoding.
+
+// TypeMeta is the kind and API version of an object.
+type TypeMeta struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+}
+
+// ObjectMeta is the metadata of an object.
+type ObjectMeta struct {
+	Name      string            `json:"name,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// ConfigMap holds data that pods can mount.
+type ConfigMap struct {
+	TypeMeta   `json:",inline"`
+	ObjectMeta `json:"metadata"`
+
+	// BinaryData values are base64 encoded in JSON, like []byte.
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
+}
+
+// Job runs a pod to completion.
+type Job struct {
+	TypeMeta   `json:",inline"`
+	ObjectMeta `json:"metadata"`
+
+	Spec JobSpec `json:"spec"`
+}
+
+// JobSpec is the spec of a Job.
+type JobSpec struct {
+	BackoffLimit          *int32          `json:"backoffLimit,omitempty"`
+	ActiveDeadlineSeconds *int64          `json:"activeDeadlineSeconds,omitempty"`
+	Template              PodTemplateSpec `json:"template"`
+}
+
+// PodTemplateSpec is the template of the pods of a Job.
+type PodTemplateSpec struct {
+	ObjectMeta `json:"metadata"`
+
+	Spec PodSpec `json:"spec"`
+}
+
+// PodSpec is the spec of a Pod.
+type PodSpec struct {
+	RestartPolicy      string      `json:"restartPolicy,omitempty"`
+	ServiceAccountName string      `json:"serviceAccountName,omitempty"`
+	InitContainers     []Container `json:"initContainers,omitempty"`
+	Containers         []Container `json:"containers"`
+	Volumes            []Volume    `json:"volumes,omitempty"`
+}
+
+// Container is a container of a Pod.
+type Container struct {
+	Name            string        `json:"name"`
+	Image           string        `json:"image"`
+	ImagePullPolicy string        `json:"imagePullPolicy,omitempty"`
+	Command         []string      `json:"command,omitempty"`
+	Args            []string      `json:"args,omitempty"`
+	VolumeMounts    []VolumeMount `json:"volumeMounts,omitempty"`
+}
+
+// VolumeMount mounts a volume in a container.
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	SubPath   string `json:"subPath,omitempty"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+// Volume is a volume of a Pod. Only one of the sources must be set.
+type Volume struct {
+	Name                  string                             `json:"name"`
+	EmptyDir              *EmptyDirVolumeSource              `json:"emptyDir,omitempty"`
+	ConfigMap             *ConfigMapVolumeSource             `json:"configMap,omitempty"`
+	Secret                *SecretVolumeSource                `json:"secret,omitempty"`
+	PersistentVolumeClaim *PersistentVolumeClaimVolumeSource `json:"persistentVolumeClaim,omitempty"`
+}
+
+// EmptyDirVolumeSource is an empty directory that lives as long as the Pod.
+type EmptyDirVolumeSource struct{}
+
+// ConfigMapVolumeSource mounts the keys of a ConfigMap as files.
+type ConfigMapVolumeSource struct {
+	Name string `json:"name"`
+}
+
+// SecretVolumeSource mounts the keys of a Secret as files.
+type SecretVolumeSource struct {
+	SecretName string `json:"secretName"`
+}
+
+// PersistentVolumeClaimVolumeSource mounts a PersistentVolumeClaim.
+type PersistentVolumeClaimVolumeSource struct {
+	ClaimName string `json:"claimName"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+// Pod is a Pod, with the status of its containers.
+type Pod struct {
+	ObjectMeta `json:"metadata"`
+
+	Status PodStatus `json:"status"`
+}
+
+// PodStatus is the status of a Pod.
+type PodStatus struct {
+	Phase                 string            `json:"phase"`
+	Message               string            `json:"message,omitempty"`
+	InitContainerStatuses []ContainerStatus `json:"initContainerStatuses,omitempty"`
+	ContainerStatuses     []ContainerStatus `json:"containerStatuses,omitempty"`
+}
+
+// ContainerStatus is the status of a container.
+type ContainerStatus struct {
+	Name  string         `json:"name"`
+	State ContainerState `json:"state"`
+}
+
+// ContainerState is the state of a container. Only one of the fields is set.
+type ContainerState struct {
+	Waiting    *ContainerStateWaiting    `json:"waiting,omitempty"`
+	Running    *struct{}                 `json:"running,omitempty"`
+	Terminated *ContainerStateTerminated `json:"terminated,omitempty"`
+}
+
+// ContainerStateWaiting is the state of a container that didn't start yet.
+type ContainerStateWaiting struct {
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ContainerStateTerminated is the state of a container that exited.
+type ContainerStateTerminated struct {
+	ExitCode int    `json:"exitCode"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
@@ -0,0 +1,148 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lockfile pins the base images of a dockerfile to the digests of their
+// manifests, like the lockfiles of package managers, so builds pull the same
+// images until the lockfile is updated.
+package lockfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// DefaultName is the name of lockfiles in build contexts.
+const DefaultName = "makisu.lock"
+
+const _version = 1
+
+// Lockfile maps the images of FROM and 'COPY --from' directives to the digests
+// of their manifests.
+type Lockfile struct {
+	Version int `json:"version"`
+	// Images are keyed by their names in the dockerfile, like alpine:3.19.
+	Images map[string]image.Digest `json:"images"`
+}
+
+// Resolver returns the digest of the manifest an image currently points to in
+// its registry.
+type Resolver func(name image.Name) (image.Digest, error)
+
+// Lock resolves the images, and returns a lockfile of their digests. Images
+// already pinned by digest are left out.
+func Lock(images []string, resolve Resolver) (*Lockfile, error) {
+	l := &Lockfile{Version: _version, Images: make(map[string]image.Digest)}
+	for _, img := range images {
+		name, err := parseName(img)
+		if err != nil {
+			return nil, err
+		} else if name.HasDigest() {
+			continue
+		}
+		digest, err := resolve(name)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %s", img, err)
+		}
+		l.Images[img] = digest
+	}
+	return l, nil
+}
+
+// Load reads a lockfile.
+func Load(path string) (*Lockfile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var l Lockfile
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, fmt.Errorf("unmarshal lockfile %s: %s", path, err)
+	} else if l.Version != _version {
+		return nil, fmt.Errorf("unsupported lockfile version %d", l.Version)
+	}
+	for img := range l.Images {
+		pinned, _ := l.Pin(img)
+		if _, err := image.ParseNameForPull(pinned); err != nil {
+			return nil, fmt.Errorf("invalid lockfile entry %s: %s", img, err)
+		}
+	}
+	return &l, nil
+}
+
+// Save writes the lockfile, with its images sorted so it diffs well.
+func (l *Lockfile) Save(path string) error {
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal lockfile: %s", err)
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("write lockfile: %s", err)
+	}
+	return nil
+}
+
+// Pin returns the image pinned at its digest in the lockfile, like
+// alpine:3.19@sha256:<digest>, or false if it's not in the lockfile.
+func (l *Lockfile) Pin(img string) (string, bool) {
+	digest, ok := l.Images[img]
+	if !ok {
+		return "", false
+	}
+	return img + "@" + string(digest), true
+}
+
+// Verify resolves the images, and returns an error listing the ones missing
+// from the lockfile or pointing to other digests than the locked ones.
+func (l *Lockfile) Verify(images []string, resolve Resolver) error {
+	var problems []string
+	for _, img := range images {
+		name, err := parseName(img)
+		if err != nil {
+			return err
+		} else if name.HasDigest() {
+			continue
+		}
+		locked, ok := l.Images[img]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is not in the lockfile", img))
+			continue
+		}
+		digest, err := resolve(name)
+		if err != nil {
+			return fmt.Errorf("resolve %s: %s", img, err)
+		} else if digest != locked {
+			problems = append(problems, fmt.Sprintf(
+				"%s resolves to %s, but is locked at %s", img, digest, locked))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("images differ from the lockfile, run makisu lock to update it:\n  %s",
+			strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func parseName(img string) (image.Name, error) {
+	name, err := image.ParseNameForPull(img)
+	if err != nil {
+		return image.Name{}, fmt.Errorf("invalid image name %s: %s", img, err)
+	}
+	return name, nil
+}
@@ -0,0 +1,87 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lockfile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	_alpineDigest = image.Digest("sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3")
+	_golangDigest = image.Digest("sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+)
+
+func TestLockfile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	digests := map[string]image.Digest{
+		"index.docker.io/library/alpine:3.19": _alpineDigest,
+		"index.docker.io/library/golang:1.22": _golangDigest,
+	}
+	resolve := func(name image.Name) (image.Digest, error) {
+		if d, ok := digests[name.String()]; ok {
+			return d, nil
+		}
+		return "", errors.New("manifest not found")
+	}
+	images := []string{"alpine:3.19", "golang:1.22", "busybox@" + string(_alpineDigest)}
+
+	l, err := Lock(images, resolve)
+	require.NoError(err)
+	require.Equal(map[string]image.Digest{
+		"alpine:3.19": _alpineDigest,
+		"golang:1.22": _golangDigest,
+	}, l.Images)
+	_, err = Lock([]string{"missing:1"}, resolve)
+	require.Error(err)
+
+	path := filepath.Join(dir, DefaultName)
+	require.NoError(l.Save(path))
+	l, err = Load(path)
+	require.NoError(err)
+	pinned, ok := l.Pin("alpine:3.19")
+	require.True(ok)
+	require.Equal("alpine:3.19@"+string(_alpineDigest), pinned)
+	_, ok = l.Pin("node:20")
+	require.False(ok)
+
+	require.NoError(l.Verify(images, resolve))
+
+	// The tag moved, and an image was added to the dockerfile.
+	digests["index.docker.io/library/golang:1.22"] = _alpineDigest
+	err = l.Verify(append(images, "node:20"), resolve)
+	require.Error(err)
+	require.Contains(err.Error(), "golang:1.22 resolves to "+string(_alpineDigest)+", but is locked at "+string(_golangDigest))
+	require.Contains(err.Error(), "node:20 is not in the lockfile")
+
+	require.NoError(ioutil.WriteFile(path, []byte(`{"version": 1, "images": {"alpine": "sha256:bad"}}`), 0644))
+	_, err = Load(path)
+	require.Error(err)
+	require.NoError(ioutil.WriteFile(path, []byte(`{"version": 2}`), 0644))
+	_, err = Load(path)
+	require.Error(err)
+}
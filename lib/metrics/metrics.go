@@ -0,0 +1,204 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics exposes the durations, cache hits and transfers of builds
+// as Prometheus metrics, on a /metrics handler or pushed to a pushgateway.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber/makisu/lib/profile"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// ResultSuccess is the result of a successful build. Failed builds have the
+// kind of their failure as result.
+const ResultSuccess = "success"
+
+var _pulledBytes, _pushedBytes int64
+
+// AddPulledBytes records n bytes downloaded from a registry.
+func AddPulledBytes(n int64) {
+	atomic.AddInt64(&_pulledBytes, n)
+}
+
+// AddPushedBytes records n bytes uploaded to a registry.
+func AddPushedBytes(n int64) {
+	atomic.AddInt64(&_pushedBytes, n)
+}
+
+// Summary is what a build reports to the metrics: its result, the total
+// duration of each phase, its cache hits and transfers.
+type Summary struct {
+	Result      string             `json:"result"`
+	Duration    float64            `json:"duration"`
+	Phases      map[string]float64 `json:"phases"`
+	CacheHits   int                `json:"cache_hits"`
+	CacheMisses int                `json:"cache_misses"`
+	StepRetries int                `json:"step_retries"`
+	PulledBytes int64              `json:"pulled_bytes"`
+	PushedBytes int64              `json:"pushed_bytes"`
+	// ContextDigest is the digest of the build context, with --context-digest.
+	ContextDigest string `json:"context_digest,omitempty"`
+}
+
+// NewSummary returns the summary of a build from its spans, with the bytes
+// pulled and pushed by this process so far. Steps skipped because a later
+// step was cached count as hits.
+func NewSummary(spans []profile.Span, duration time.Duration, result string) *Summary {
+	summary := &Summary{
+		Result:      result,
+		Duration:    duration.Seconds(),
+		Phases:      make(map[string]float64),
+		PulledBytes: atomic.LoadInt64(&_pulledBytes),
+		PushedBytes: atomic.LoadInt64(&_pushedBytes),
+	}
+	for _, span := range spans {
+		summary.Phases[span.Phase] += span.Duration.Seconds()
+		if span.Phase != profile.PhaseStep {
+			continue
+		}
+		summary.StepRetries += span.Retries
+		switch span.Cache {
+		case "hit", "skipped":
+			summary.CacheHits++
+		case "miss":
+			summary.CacheMisses++
+		}
+	}
+	return summary
+}
+
+// Write writes the summary as JSON to path.
+func (s *Summary) Write(path string) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("marshal metrics summary: %s", err)
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("write metrics summary: %s", err)
+	}
+	return nil
+}
+
+// ReadSummary reads a summary written by Write.
+func ReadSummary(path string) (*Summary, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read metrics summary: %s", err)
+	}
+	var summary Summary
+	if err := json.Unmarshal(content, &summary); err != nil {
+		return nil, fmt.Errorf("unmarshal metrics summary: %s", err)
+	}
+	return &summary, nil
+}
+
+// Metrics holds the metrics of the builds observed.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	builds        *prometheus.CounterVec
+	buildDuration prometheus.Histogram
+	phaseDuration *prometheus.CounterVec
+	cacheHits     prometheus.Counter
+	cacheMisses   prometheus.Counter
+	stepRetries   prometheus.Counter
+	pulledBytes   prometheus.Counter
+	pushedBytes   prometheus.Counter
+}
+
+// New returns new Metrics, with nothing observed.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		builds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "makisu_builds_total",
+			Help: "Number of builds, by result: success or the kind of failure.",
+		}, []string{"result"}),
+		buildDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "makisu_build_duration_seconds",
+			Help:    "Duration of builds.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		}),
+		phaseDuration: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "makisu_phase_duration_seconds_total",
+			Help: "Time spent in each phase of builds.",
+		}, []string{"phase"}),
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "makisu_cache_hits_total",
+			Help: "Number of steps found in the layer cache.",
+		}),
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "makisu_cache_misses_total",
+			Help: "Number of steps run because they were not found in the layer cache.",
+		}),
+		stepRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "makisu_step_retries_total",
+			Help: "Number of times the commands of RUN steps were run again after failing.",
+		}),
+		pulledBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "makisu_pulled_bytes_total",
+			Help: "Bytes downloaded from registries.",
+		}),
+		pushedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "makisu_pushed_bytes_total",
+			Help: "Bytes uploaded to registries.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.builds, m.buildDuration, m.phaseDuration,
+		m.cacheHits, m.cacheMisses, m.stepRetries, m.pulledBytes, m.pushedBytes)
+	return m
+}
+
+// Observe adds a build to the metrics. Builds without a duration, whose
+// summary is unknown, only count by result.
+func (m *Metrics) Observe(s *Summary) {
+	m.builds.WithLabelValues(s.Result).Inc()
+	if s.Duration > 0 {
+		m.buildDuration.Observe(s.Duration)
+	}
+	for phase, seconds := range s.Phases {
+		m.phaseDuration.WithLabelValues(phase).Add(seconds)
+	}
+	m.cacheHits.Add(float64(s.CacheHits))
+	m.cacheMisses.Add(float64(s.CacheMisses))
+	m.stepRetries.Add(float64(s.StepRetries))
+	m.pulledBytes.Add(float64(s.PulledBytes))
+	m.pushedBytes.Add(float64(s.PushedBytes))
+}
+
+// Handler returns a handler serving the metrics in the Prometheus format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Push pushes the metrics to the pushgateway at url, replacing the metrics
+// previously pushed for job.
+func (m *Metrics) Push(url, job string) error {
+	if err := push.New(url, job).Gatherer(m.registry).Push(); err != nil {
+		return fmt.Errorf("push metrics to %s: %s", url, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/profile"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSummary(t *testing.T) {
+	require := require.New(t)
+
+	spans := []profile.Span{
+		{Phase: profile.PhaseParse, Duration: time.Second},
+		{Phase: profile.PhaseStep, Step: 1, Duration: 2 * time.Second, Cache: "skipped"},
+		{Phase: profile.PhaseStep, Step: 2, Duration: time.Second, Cache: "hit"},
+		{Phase: profile.PhaseExec, Step: 3, Duration: 3 * time.Second},
+		{Phase: profile.PhaseStep, Step: 3, Duration: 4 * time.Second, Cache: "miss", Retries: 2},
+		{Phase: profile.PhaseStep, Step: 4, Duration: time.Second},
+	}
+	summary := NewSummary(spans, 10*time.Second, ResultSuccess)
+	require.Equal(ResultSuccess, summary.Result)
+	require.Equal(10.0, summary.Duration)
+	require.Equal(map[string]float64{"parse": 1, "step": 8, "exec": 3}, summary.Phases)
+	require.Equal(2, summary.CacheHits)
+	require.Equal(1, summary.CacheMisses)
+	require.Equal(2, summary.StepRetries)
+
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "summary.json")
+	require.NoError(summary.Write(path))
+	read, err := ReadSummary(path)
+	require.NoError(err)
+	require.Equal(summary, read)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	require := require.New(t)
+
+	m := New()
+	m.Observe(&Summary{
+		Result:      ResultSuccess,
+		Duration:    3,
+		Phases:      map[string]float64{"exec": 2},
+		CacheHits:   1,
+		CacheMisses: 2,
+		PulledBytes: 100,
+	})
+	m.Observe(&Summary{Result: "step", Duration: 1, PushedBytes: 10})
+
+	server := httptest.NewServer(m.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	for _, line := range []string{
+		`makisu_builds_total{result="success"} 1`,
+		`makisu_builds_total{result="step"} 1`,
+		`makisu_build_duration_seconds_count 2`,
+		`makisu_phase_duration_seconds_total{phase="exec"} 2`,
+		`makisu_cache_hits_total 1`,
+		`makisu_cache_misses_total 2`,
+		`makisu_pulled_bytes_total 100`,
+		`makisu_pushed_bytes_total 10`,
+	} {
+		require.Contains(string(body), line)
+	}
+}
+
+func TestMetricsPush(t *testing.T) {
+	require := require.New(t)
+
+	var method, path string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	m := New()
+	m.Observe(&Summary{Result: ResultSuccess, CacheHits: 3})
+	require.NoError(m.Push(server.URL, "makisu"))
+	require.Equal("PUT", method)
+	require.True(strings.HasSuffix(path, "/job/makisu"))
+	require.NotEmpty(body)
+
+	require.Error(m.Push("http://127.0.0.1:1", "makisu"))
+}
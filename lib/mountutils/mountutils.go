@@ -19,12 +19,34 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/uber/makisu/lib/log"
 )
 
+// _pseudoFSTypes are the types of the file systems the kernel generates, whose
+// content never belongs in an image.
+var _pseudoFSTypes = map[string]bool{
+	"autofs":      true,
+	"binfmt_misc": true,
+	"bpf":         true,
+	"cgroup":      true,
+	"cgroup2":     true,
+	"configfs":    true,
+	"debugfs":     true,
+	"devpts":      true,
+	"fusectl":     true,
+	"hugetlbfs":   true,
+	"mqueue":      true,
+	"proc":        true,
+	"pstore":      true,
+	"securityfs":  true,
+	"sysfs":       true,
+	"tracefs":     true,
+}
+
 type mountInfo struct {
 	// Map from filename to mount point description.
 	data       map[string]mountPoint
@@ -122,6 +144,30 @@ func (info *mountInfo) containsMountpoint(filename string) (bool, error) {
 	return false, nil
 }
 
+func (info *mountInfo) mountpoints() ([]string, error) {
+	return info.filterMountpoints(func(mountPoint) bool { return true })
+}
+
+func (info *mountInfo) pseudoMountpoints() ([]string, error) {
+	return info.filterMountpoints(func(mp mountPoint) bool { return _pseudoFSTypes[mp.FSType] })
+}
+
+func (info *mountInfo) filterMountpoints(f func(mountPoint) bool) ([]string, error) {
+	var err error
+	info.init.Do(func() { err = info.initialize() })
+	if err != nil {
+		return nil, fmt.Errorf("mountpoints: %s", err)
+	}
+	mountpoints := make([]string, 0, len(info.data))
+	for path, mp := range info.data {
+		if f(mp) {
+			mountpoints = append(mountpoints, path)
+		}
+	}
+	sort.Strings(mountpoints)
+	return mountpoints, nil
+}
+
 // IsMountpoint returns true if the file is a mountpoint, with an error if
 // there was a problem reading the mountpoint information. Returns false
 // on every file with no error if the mounts file was not found.
@@ -141,3 +187,15 @@ func IsMounted(filename string) (bool, error) {
 func ContainsMountpoint(filename string) (bool, error) {
 	return defaultInfo.containsMountpoint(filename)
 }
+
+// Mountpoints returns all mountpoints except /, sorted so that mountpoints come
+// before the ones they contain.
+func Mountpoints() ([]string, error) {
+	return defaultInfo.mountpoints()
+}
+
+// PseudoMountpoints returns the mountpoints of pseudo file systems like proc,
+// sysfs or devpts, sorted like Mountpoints.
+func PseudoMountpoints() ([]string, error) {
+	return defaultInfo.pseudoMountpoints()
+}
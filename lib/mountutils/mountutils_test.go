@@ -124,3 +124,47 @@ func TestInitFailure(t *testing.T) {
 		require.False(t, isMount)
 	})
 }
+
+func TestMountpoints(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "mountpoint")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.Write([]byte(`overlay / overlay rw 0 0
+cgroup /var/cache/stuff etx4 ro,nosuid,nodev,noexec,mode=755 0 0
+cgroup /etc/hosts etx4 ro,nosuid,nodev,noexec,mode=755 0 0
+cgroup /var/cache etx4 ro,nosuid,nodev,noexec,mode=755 0 0
+`))
+	require.NoError(t, err)
+
+	info := newMountInfo()
+	info.mountsFile = tmpfile.Name()
+
+	mountpoints, err := info.mountpoints()
+	require.NoError(t, err)
+	require.Equal(t, []string{"/etc/hosts", "/var/cache", "/var/cache/stuff"}, mountpoints)
+}
+
+func TestPseudoMountpoints(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "mountpoint")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.Write([]byte(`overlay / overlay rw 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+tmpfs /dev tmpfs rw,nosuid,size=65536k,mode=755 0 0
+devpts /dev/pts devpts rw,nosuid,noexec,relatime,gid=5,mode=620 0 0
+sysfs /sys sysfs ro,nosuid,nodev,noexec,relatime 0 0
+cgroup /sys/fs/cgroup cgroup2 ro,nosuid,nodev,noexec,relatime 0 0
+/dev/sda1 /etc/hosts ext4 rw,relatime 0 0
+/dev/sda1 /makisu-storage ext4 rw,relatime 0 0
+`))
+	require.NoError(t, err)
+
+	info := newMountInfo()
+	info.mountsFile = tmpfile.Name()
+
+	mountpoints, err := info.pseudoMountpoints()
+	require.NoError(t, err)
+	require.Equal(t, []string{"/dev/pts", "/proc", "/sys", "/sys/fs/cgroup"}, mountpoints)
+}
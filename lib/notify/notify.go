@@ -0,0 +1,208 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package notify posts JSON events about the lifecycle of a build to a
+// webhook, signed with HMAC-SHA256, so other systems can react to builds
+// without reading their logs.
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// Types of events.
+const (
+	EventBuildStarted   = "build.started"
+	EventStepCompleted  = "step.completed"
+	EventPushCompleted  = "push.completed"
+	EventBuildSucceeded = "build.succeeded"
+	EventBuildFailed    = "build.failed"
+)
+
+const (
+	// SignatureHeader holds "sha256=" and the hex encoded HMAC-SHA256 of the
+	// body, keyed with the secret.
+	SignatureHeader = "X-Makisu-Signature"
+	// EventHeader holds the type of the event.
+	EventHeader = "X-Makisu-Event"
+
+	_queueSize    = 256
+	_retries      = 3
+	_closeTimeout = 30 * time.Second
+)
+
+// _retryBackoff is the delay before the first retry. Later retries wait
+// longer.
+var _retryBackoff = time.Second
+
+// Event is a build lifecycle event. Fields that don't apply to the type of
+// the event are omitted.
+type Event struct {
+	Type string    `json:"type"`
+	ID   string    `json:"build_id"`
+	Time time.Time `json:"time"`
+	Tag  string    `json:"tag"`
+
+	// Step completed.
+	Stage     string  `json:"stage,omitempty"`
+	Step      int     `json:"step,omitempty"`
+	Directive string  `json:"directive,omitempty"`
+	Cache     string  `json:"cache,omitempty"`
+	Duration  float64 `json:"duration,omitempty"`
+
+	// Push completed, and build succeeded.
+	Image  string `json:"image,omitempty"`
+	Digest string `json:"digest,omitempty"`
+
+	// Build failed.
+	Kind     string `json:"kind,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Notifier sends the events of a build to a webhook, in order, without
+// blocking the build. All methods are noops on a nil Notifier.
+type Notifier struct {
+	url    string
+	secret []byte
+	id     string
+	tag    string
+	client *http.Client
+
+	events chan *Event
+	done   chan struct{}
+}
+
+// New returns a Notifier posting the events of the build of tag to url. The
+// events are signed if secret isn't empty.
+func New(url, secret, tag string) *Notifier {
+	id := make([]byte, 8)
+	rand.Read(id)
+	n := &Notifier{
+		url:    url,
+		secret: []byte(secret),
+		id:     hex.EncodeToString(id),
+		tag:    tag,
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan *Event, _queueSize),
+		done:   make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues an event. Events are dropped if the webhook falls too far
+// behind.
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+	event.ID, event.Tag = n.id, n.tag
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	select {
+	case n.events <- &event:
+	default:
+		log.Warnf("Dropped %s event, webhook queue is full", event.Type)
+	}
+}
+
+// Close sends the queued events, and waits for them to be sent for a while.
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	close(n.events)
+	select {
+	case <-n.done:
+	case <-time.After(_closeTimeout):
+		log.Warnf("Timed out sending webhook events")
+	}
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for event := range n.events {
+		if err := n.send(event); err != nil {
+			log.Warnf("Failed to send %s event: %s", event.Type, err)
+		}
+	}
+}
+
+// send posts an event, retrying on errors and 5xx responses.
+func (n *Notifier) send(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %s", err)
+	}
+	for attempt := 1; ; attempt++ {
+		err = n.post(event.Type, body)
+		if err == nil || attempt == _retries {
+			return err
+		} else if _, ok := err.(permanentError); ok {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * _retryBackoff)
+	}
+}
+
+// permanentError is a response that retrying won't change.
+type permanentError struct {
+	status int
+}
+
+func (e permanentError) Error() string {
+	return fmt.Sprintf("status %d", e.status)
+}
+
+func (n *Notifier) post(eventType string, body []byte) error {
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, eventType)
+	if len(n.secret) != 0 {
+		req.Header.Set(SignatureHeader, Sign(n.secret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	} else if resp.StatusCode >= 300 {
+		return permanentError{resp.StatusCode}
+	}
+	return nil
+}
+
+// Sign returns the signature of body, as found in SignatureHeader.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,112 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// webhook records the events it receives, and fails the first requests with
+// the given statuses.
+type webhook struct {
+	sync.Mutex
+	statuses   []int
+	events     []Event
+	signatures []string
+	types      []string
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.statuses) != 0 {
+		status := h.statuses[0]
+		h.statuses = h.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var event Event
+	json.Unmarshal(body, &event)
+	h.events = append(h.events, event)
+	h.signatures = append(h.signatures, r.Header.Get(SignatureHeader))
+	h.types = append(h.types, r.Header.Get(EventHeader))
+	if r.Header.Get(SignatureHeader) != "" && r.Header.Get(SignatureHeader) != Sign([]byte("secret"), body) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	require := require.New(t)
+
+	h := &webhook{}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	n := New(server.URL, "secret", "app:v1")
+	n.Notify(Event{Type: EventBuildStarted})
+	n.Notify(Event{Type: EventStepCompleted, Stage: "0", Step: 1, Cache: "hit", Duration: 1.5})
+	n.Notify(Event{Type: EventBuildFailed, Kind: "step", ExitCode: 5, Error: "failed"})
+	n.Close()
+
+	require.Equal([]string{EventBuildStarted, EventStepCompleted, EventBuildFailed}, h.types)
+	require.Len(h.events, 3)
+	for i, event := range h.events {
+		require.Equal(h.types[i], event.Type)
+		require.Equal(n.id, event.ID)
+		require.Equal("app:v1", event.Tag)
+		require.False(event.Time.IsZero())
+		require.NotEmpty(h.signatures[i])
+	}
+	require.Equal("hit", h.events[1].Cache)
+	require.Equal(5, h.events[2].ExitCode)
+}
+
+func TestNotifierRetries(t *testing.T) {
+	require := require.New(t)
+
+	backoff := _retryBackoff
+	_retryBackoff = time.Millisecond
+	defer func() { _retryBackoff = backoff }()
+
+	// Server errors are retried, client errors aren't: the first event is
+	// dropped after a retry.
+	h := &webhook{statuses: []int{http.StatusBadGateway, http.StatusBadRequest, http.StatusServiceUnavailable}}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	n := New(server.URL, "", "app:v1")
+	n.Notify(Event{Type: EventBuildStarted})
+	n.Notify(Event{Type: EventBuildSucceeded})
+	n.Close()
+
+	require.Equal([]string{EventBuildSucceeded}, h.types)
+	require.Equal([]string{""}, h.signatures)
+	require.Empty(h.statuses)
+}
+
+func TestNilNotifier(t *testing.T) {
+	var n *Notifier
+	n.Notify(Event{Type: EventBuildStarted})
+	n.Close()
+}
@@ -32,7 +32,7 @@ func newArgDirective(base *baseDirective, state *parsingState) (Directive, error
 	if err := base.replaceVarsCurrStageOrGlobal(state); err != nil {
 		return nil, err
 	}
-	if vars, err := parseKeyVals(base.Args); err == nil {
+	if vars, err := parseKeyVals(base.Args, state.escape); err == nil {
 		if len(vars) != 1 {
 			return nil, base.err(errNotExactlyOneArg)
 		}
@@ -45,7 +45,7 @@ func newArgDirective(base *baseDirective, state *parsingState) (Directive, error
 		return &ArgDirective{base, name, defaultVal, nil}, nil
 	}
 
-	args, err := splitArgs(base.Args, false)
+	args, err := splitArgs(base.Args, false, state.escape)
 	if err != nil {
 		return nil, base.err(err)
 	}
@@ -17,11 +17,18 @@ package dockerfile
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+// DefaultRetries is the number of retries of a '#!RETRY' annotation without
+// count.
+const DefaultRetries = 3
+
 var (
 	commitRegexp     = regexp.MustCompile(`\s*#!\s*commit\s*`)
+	excludeRegexp    = regexp.MustCompile(`(?i)#!\s*exclude\s+([^#]+)`)
+	retryRegexp      = regexp.MustCompile(`(?i)#!\s*retry\b(?:\s+(\d+))?`)
 	whitespaceRegexp = regexp.MustCompile(`\s+`)
 )
 
@@ -30,6 +37,15 @@ type baseDirective struct {
 	t      string
 	Args   string
 	Commit bool
+
+	// Excludes are the path patterns of a '#!EXCLUDE <pattern>...' annotation,
+	// left out of the layer committed by the directive.
+	Excludes []string
+
+	// Retries is the count of a '#!RETRY [<count>]' annotation, the number of
+	// times the command of a RUN directive is run again if it fails. 0 if
+	// not annotated.
+	Retries int
 }
 
 // uncomment the line
@@ -64,8 +80,20 @@ func newBaseDirective(line string) (*baseDirective, error) {
 	// Handle special commit directive comment.
 	// TODO (eoakes): handle escaped comments (\#)
 	var commit bool
+	var excludes []string
+	var retries int
 	if commentIndex := strings.Index(line, "#"); commentIndex != -1 {
 		commit = commitRegexp.MatchString(strings.ToLower(line[commentIndex:]))
+		if m := excludeRegexp.FindStringSubmatch(line[commentIndex:]); m != nil {
+			excludes = strings.Fields(m[1])
+		}
+		if m := retryRegexp.FindStringSubmatch(line[commentIndex:]); m != nil {
+			retries = DefaultRetries
+			if m[1] != "" {
+				// The regexp only matches digits.
+				retries, _ = strconv.Atoi(m[1])
+			}
+		}
 		line = uncomment(line)
 	}
 
@@ -79,7 +107,13 @@ func newBaseDirective(line string) (*baseDirective, error) {
 	}
 	t := strings.ToLower(parts[0])
 	args := strings.TrimSpace(parts[1])
-	return &baseDirective{t, args, commit}, nil
+	return &baseDirective{t, args, commit, excludes, retries}, nil
+}
+
+// annotated returns true if the directive has a '#!COMMIT', '#!EXCLUDE' or
+// '#!RETRY' annotation.
+func (d *baseDirective) annotated() bool {
+	return d.Commit || len(d.Excludes) > 0 || d.Retries > 0
 }
 
 // err provides a convenient way to format errors related to parsing
@@ -90,8 +124,8 @@ func (d *baseDirective) err(e error) error {
 
 // replaceVars replaces the variables in the directive's args string
 // using the passed map.
-func (d *baseDirective) replaceVars(vars map[string]string) error {
-	replaced, err := replaceVariables(d.Args, vars)
+func (d *baseDirective) replaceVars(vars map[string]string, escape rune) error {
+	replaced, err := replaceVariables(d.Args, vars, escape)
 	if err != nil {
 		return d.err(fmt.Errorf("Failed to replace variables in input: %s", err))
 	}
@@ -105,13 +139,13 @@ func (d *baseDirective) replaceVarsCurrStage(state *parsingState) error {
 	if state.stageVars == nil {
 		return d.err(errBeforeFirstFrom)
 	}
-	return d.replaceVars(state.stageVars)
+	return d.replaceVars(state.stageVars, state.escape)
 }
 
 // replaceVarsGlobal replaces variables in the args string using the
 // global args map.
 func (d *baseDirective) replaceVarsGlobal(state *parsingState) error {
-	return d.replaceVars(state.globalArgs)
+	return d.replaceVars(state.globalArgs, state.escape)
 }
 
 // replaceVarsCurrStageOrGlobal replaces variables in the args string as follows:
@@ -122,5 +156,5 @@ func (d *baseDirective) replaceVarsCurrStageOrGlobal(state *parsingState) error
 	if vars == nil {
 		vars = state.globalArgs
 	}
-	return d.replaceVars(vars)
+	return d.replaceVars(vars, state.escape)
 }
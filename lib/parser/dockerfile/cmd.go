@@ -36,7 +36,7 @@ func newCmdDirective(base *baseDirective, state *parsingState) (Directive, error
 		return &CmdDirective{base, cmd}, nil
 	}
 
-	args, err := splitArgs(base.Args, true)
+	args, err := splitArgs(base.Args, true, state.escape)
 	if err != nil {
 		return nil, base.err(err)
 	}
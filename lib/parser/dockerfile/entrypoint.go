@@ -20,6 +20,10 @@ import "strings"
 type EntrypointDirective struct {
 	*baseDirective
 	Entrypoint []string
+
+	// CmdSet is true if a CMD directive precedes it in its stage. Docker
+	// clears the CMD inherited from the base image otherwise.
+	CmdSet bool
 }
 
 // Variables:
@@ -32,19 +36,20 @@ func newEntrypointDirective(base *baseDirective, state *parsingState) (Directive
 		return nil, err
 	}
 
+	cmdSet := state.cmdSet()
 	if entrypoint, ok := parseJSONArray(base.Args); ok {
-		return &EntrypointDirective{base, entrypoint}, nil
+		return &EntrypointDirective{base, entrypoint, cmdSet}, nil
 	}
 
 	// This is the Shell form (https://docs.docker.com/engine/reference/builder/#shell-form-entrypoint-example)
 	// It is expected to wrap the whole entrypoint into a sh -c command)
-	args, err := splitArgs(base.Args, true)
+	args, err := splitArgs(base.Args, true, state.escape)
 	if err != nil {
 		return nil, base.err(err)
 	}
 
 	cmd := append([]string{"/bin/sh", "-c"}, strings.Join(args, " "))
-	return &EntrypointDirective{base, cmd}, nil
+	return &EntrypointDirective{base, cmd, cmdSet}, nil
 }
 
 // Add this command to the build stage.
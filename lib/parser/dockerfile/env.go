@@ -33,7 +33,7 @@ func newEnvDirective(base *baseDirective, state *parsingState) (Directive, error
 	if err := base.replaceVarsCurrStage(state); err != nil {
 		return nil, err
 	}
-	if vars, err := parseKeyVals(base.Args); err == nil {
+	if vars, err := parseKeyVals(base.Args, state.escape); err == nil {
 		return &EnvDirective{base, vars}, nil
 	}
 
@@ -16,40 +16,40 @@ package dockerfile
 
 // FromDirectiveFixture returns a FromDirective for testing purposes.
 func FromDirectiveFixture(args, image, alias string) *FromDirective {
-	return &FromDirective{&baseDirective{"from", args, false}, image, alias}
+	return &FromDirective{&baseDirective{"from", args, false, nil, 0}, image, alias}
 }
 
 // RunDirectiveFixture returns a RunDirective for testing purposes.
 func RunDirectiveFixture(args string, cmd string) *RunDirective {
-	return &RunDirective{&baseDirective{"run", args, false}, cmd}
+	return &RunDirective{&baseDirective{"run", args, false, nil, 0}, cmd}
 }
 
 // RunCommitDirectiveFixture returns a RunDirective with a commit annotation
 // for testing purposes.
 func RunCommitDirectiveFixture(args string, cmd string) *RunDirective {
-	return &RunDirective{&baseDirective{"run", args, true}, cmd}
+	return &RunDirective{&baseDirective{"run", args, true, nil, 0}, cmd}
 }
 
 // CmdDirectiveFixture returns a CmdDirective for testing purposes.
 func CmdDirectiveFixture(args string, cmd []string) *CmdDirective {
-	return &CmdDirective{&baseDirective{"cmd", args, false}, cmd}
+	return &CmdDirective{&baseDirective{"cmd", args, false, nil, 0}, cmd}
 }
 
 // LabelDirectiveFixture returns a LabelDirective for testing purposes.
 func LabelDirectiveFixture(args string, labels map[string]string) *LabelDirective {
-	return &LabelDirective{&baseDirective{"label", args, false}, labels}
+	return &LabelDirective{&baseDirective{"label", args, false, nil, 0}, labels}
 }
 
 // ExposeDirectiveFixture returns a ExposeDirective for testing purposes.
 func ExposeDirectiveFixture(args string, ports []string) *ExposeDirective {
-	return &ExposeDirective{&baseDirective{"expose", args, false}, ports}
+	return &ExposeDirective{&baseDirective{"expose", args, false, nil, 0}, ports}
 }
 
 // CopyDirectiveFixture returns a CopyDirective for testing purposes.
 func CopyDirectiveFixture(args, chown, fromStage string, srcs []string, dst string) *CopyDirective {
 	return &CopyDirective{
 		&addCopyDirective{
-			&baseDirective{"copy", args, false},
+			&baseDirective{"copy", args, false, nil, 0},
 			chown,
 			false,
 			srcs,
@@ -61,34 +61,34 @@ func CopyDirectiveFixture(args, chown, fromStage string, srcs []string, dst stri
 
 // EntrypointDirectiveFixture returns a EntrypointDirective for testing purposes.
 func EntrypointDirectiveFixture(args string, entrypoint []string) *EntrypointDirective {
-	return &EntrypointDirective{&baseDirective{"entrypoint", args, false}, entrypoint}
+	return &EntrypointDirective{&baseDirective{"entrypoint", args, false, nil, 0}, entrypoint, false}
 }
 
 // EnvDirectiveFixture returns a EnvDirective for testing purposes.
 func EnvDirectiveFixture(args string, envs map[string]string) *EnvDirective {
-	return &EnvDirective{&baseDirective{"env", args, false}, envs}
+	return &EnvDirective{&baseDirective{"env", args, false, nil, 0}, envs}
 }
 
 // UserDirectiveFixture returns a UserDirective for testing purposes.
 func UserDirectiveFixture(args, user string) *UserDirective {
-	return &UserDirective{&baseDirective{"user", args, false}, user}
+	return &UserDirective{&baseDirective{"user", args, false, nil, 0}, user}
 }
 
 // VolumeDirectiveFixture returns a VolumeDirective for testing purposes.
 func VolumeDirectiveFixture(args string, volumes []string) *VolumeDirective {
-	return &VolumeDirective{&baseDirective{"volume", args, false}, volumes}
+	return &VolumeDirective{&baseDirective{"volume", args, false, nil, 0}, volumes}
 }
 
 // WorkdirDirectiveFixture returns a WorkdirDirective for testing purposes.
 func WorkdirDirectiveFixture(args string, workdir string) *WorkdirDirective {
-	return &WorkdirDirective{&baseDirective{"workdir", args, false}, workdir}
+	return &WorkdirDirective{&baseDirective{"workdir", args, false, nil, 0}, workdir}
 }
 
 // AddDirectiveFixture returns an AddDirective for testing purposes.
 func AddDirectiveFixture(args, chown string, srcs []string, dst string) *AddDirective {
 	return &AddDirective{
 		&addCopyDirective{
-			&baseDirective{"add", args, false},
+			&baseDirective{"add", args, false, nil, 0},
 			chown,
 			false,
 			srcs,
@@ -54,7 +54,7 @@ func newHealthcheckDirective(base *baseDirective, state *parsingState) (Directiv
 		return nil, base.err(fmt.Errorf("CMD not defined"))
 	}
 
-	flags, err := splitArgs(base.Args[:cmdIndices[0]], false)
+	flags, err := splitArgs(base.Args[:cmdIndices[0]], false, state.escape)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse interval")
 	}
@@ -110,7 +110,7 @@ func newHealthcheckDirective(base *baseDirective, state *parsingState) (Directiv
 		return nil, base.err(errBeforeFirstFrom)
 	}
 	remaining := base.Args[cmdIndices[1]:]
-	replaced, err := replaceVariables(remaining, state.stageVars)
+	replaced, err := replaceVariables(remaining, state.stageVars, state.escape)
 	if err != nil {
 		return nil, base.err(fmt.Errorf("Failed to replace variables in input: %s", err))
 	}
@@ -133,7 +133,7 @@ func newHealthcheckDirective(base *baseDirective, state *parsingState) (Directiv
 	}
 
 	// Verify cmd arg is a valid array, but return the whole arg as one string.
-	args, err := splitArgs(remaining, false)
+	args, err := splitArgs(remaining, false, state.escape)
 	if err != nil {
 		return nil, base.err(err)
 	}
@@ -0,0 +1,50 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Images returns the images the stages are based on or copy files from, in
+// order of first use and without duplicates. Scratch, and the aliases and
+// indexes of stages that 'COPY --from' can refer to, are not images.
+func (stages Stages) Images() []string {
+	aliases := make(map[string]bool)
+	seen := make(map[string]bool)
+	var images []string
+	add := func(name string) {
+		if name == "" || aliases[name] || seen[name] || strings.EqualFold(name, "scratch") {
+			return
+		} else if _, err := strconv.Atoi(name); err == nil {
+			return
+		}
+		seen[name] = true
+		images = append(images, name)
+	}
+	for _, stage := range stages {
+		add(stage.From.Image)
+		for _, d := range stage.Directives {
+			if copyDirective, ok := d.(*CopyDirective); ok {
+				add(copyDirective.FromStage)
+			}
+		}
+		if stage.From.Alias != "" {
+			aliases[stage.From.Alias] = true
+		}
+	}
+	return images
+}
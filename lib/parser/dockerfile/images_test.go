@@ -0,0 +1,38 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagesImages(t *testing.T) {
+	require := require.New(t)
+
+	stages, err := ParseFile(`
+FROM golang:1.21 AS build
+COPY --from=busybox:1.36 /bin/busybox /bin/busybox
+FROM scratch
+COPY --from=build /app /app
+COPY --from=0 /etc /etc
+COPY --from=golang:1.21 /usr/local/go /go
+FROM alpine:3.19
+COPY --from=1 /app /app
+`, nil)
+	require.NoError(err)
+	require.Equal([]string{"golang:1.21", "busybox:1.36", "alpine:3.19"}, Stages(stages).Images())
+}
@@ -0,0 +1,87 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var includeRegexp = regexp.MustCompile(`^\s*#\s*include\s+(\S+)\s*$`)
+
+// ExpandIncludes replaces the "# include <path>" lines of the dockerfile at
+// path by the content of the fragments they point to, recursively, so shared
+// blocks of steps can be spliced into dockerfiles before they are parsed.
+// Include paths are relative to the file including them. Since fragments are
+// spliced as is, their ARG directives are global args if included before the
+// first FROM, and stage args otherwise. Comments and parser directives of
+// fragments are dropped. Docker sees include lines as comments.
+func ExpandIncludes(filecontents, path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("resolve dockerfile path: %s", err)
+	}
+	// Fragments are compared to the files including them with symlinks
+	// resolved, to detect cycles.
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return expandIncludes(filecontents, path, []string{path})
+}
+
+// expandIncludes expands the includes of the file at path, which is the last
+// one of the chain of files including each other.
+func expandIncludes(filecontents, path string, chain []string) (string, error) {
+	filecontents = strings.Replace(filecontents, "\r\n", "\n", -1)
+	lines := strings.Split(filecontents, "\n")
+	for i, line := range lines {
+		m := includeRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		fragment, err := resolveInclude(m[1], path)
+		if err != nil {
+			return "", fmt.Errorf("include %s (%s line %d): %s", m[1], path, i+1, err)
+		}
+		for _, p := range chain {
+			if p == fragment {
+				return "", fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), fragment)
+			}
+		}
+		content, err := ioutil.ReadFile(fragment)
+		if err != nil {
+			return "", fmt.Errorf("include %s (%s line %d): %s", m[1], path, i+1, err)
+		}
+		expanded, err := expandIncludes(
+			string(content), fragment, append(chain[:len(chain):len(chain)], fragment))
+		if err != nil {
+			return "", err
+		}
+		lines[i] = strings.TrimSuffix(removeCommentLines(expanded), "\n")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// resolveInclude returns the absolute path of a fragment included by the file
+// at path, with symlinks resolved.
+func resolveInclude(include, path string) (string, error) {
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(filepath.Dir(path), include)
+	}
+	return filepath.EvalSymlinks(include)
+}
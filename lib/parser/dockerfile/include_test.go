@@ -0,0 +1,87 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandIncludes(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmp)
+
+	require.NoError(os.MkdirAll(filepath.Join(tmp, "app"), 0755))
+	require.NoError(os.MkdirAll(filepath.Join(tmp, "fragments"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmp, "fragments/base"),
+		[]byte("# escape=`\nARG BASE=alpine\n"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmp, "fragments/certs"),
+		[]byte("# Installs certs.\nARG CERT=ca.crt\nCOPY $CERT /certs/\n# include user\n"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmp, "fragments/user"),
+		[]byte("RUN adduser app\r\n"), 0644))
+
+	dockerfilePath := filepath.Join(tmp, "app/Dockerfile")
+	contents := "# include ../fragments/base\nFROM $BASE\n# include ../fragments/certs\nUSER app\n"
+	expanded, err := ExpandIncludes(contents, dockerfilePath)
+	require.NoError(err)
+	require.Equal("ARG BASE=alpine\nFROM $BASE\n"+
+		"ARG CERT=ca.crt\nCOPY $CERT /certs/\nRUN adduser app\nUSER app\n", expanded)
+
+	stages, err := ParseFile(expanded, nil)
+	require.NoError(err)
+	require.Len(stages, 1)
+	require.Equal("alpine", stages[0].From.Image)
+	require.Len(stages[0].Directives, 4)
+	copyDirective, ok := stages[0].Directives[1].(*CopyDirective)
+	require.True(ok)
+	require.Equal([]string{"ca.crt"}, copyDirective.Srcs)
+
+	_, err = ExpandIncludes("FROM alpine\n# include missing\n", dockerfilePath)
+	require.Error(err)
+}
+
+func TestExpandIncludesCycle(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmp)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(tmp, "a"), []byte("# include b\n"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmp, "b"), []byte("# include a\n"), 0644))
+	require.NoError(os.Symlink(filepath.Join(tmp, "a"), filepath.Join(tmp, "c")))
+
+	_, err = ExpandIncludes("FROM alpine\n# include a\n", filepath.Join(tmp, "Dockerfile"))
+	require.Error(err)
+	require.Contains(err.Error(), "include cycle")
+
+	// Symlinks to the dockerfile itself are cycles too.
+	_, err = ExpandIncludes("FROM alpine\n# include c\n", filepath.Join(tmp, "a"))
+	require.Error(err)
+	require.Contains(err.Error(), "include cycle")
+
+	// Including the same fragment twice is not a cycle.
+	require.NoError(ioutil.WriteFile(filepath.Join(tmp, "d"), []byte("RUN true\n"), 0644))
+	expanded, err := ExpandIncludes("# include d\n# include d\n", filepath.Join(tmp, "Dockerfile"))
+	require.NoError(err)
+	require.Equal("RUN true\nRUN true\n", expanded)
+}
@@ -15,42 +15,151 @@
 package dockerfile
 
 import (
-	"bufio"
 	"fmt"
+	"regexp"
 	"strings"
 )
 
+var parserDirectiveRegexp = regexp.MustCompile(`^#\s*([a-zA-Z]+)\s*=\s*(.*?)\s*$`)
+
 // ParseFile parses dockerfile from given reader, returns a ParsedFile object.
+// Lines may end with CRLF, and an escape parser directive may set the escape
+// character to '`', like in Windows dockerfiles.
 func ParseFile(filecontents string, args map[string]string) ([]*Stage, error) {
-	filecontents = removeCommentLines(filecontents)
-	filecontents = strings.Replace(filecontents, "\\\n", "", -1)
-	reader := strings.NewReader(filecontents)
-	scanner := bufio.NewScanner(reader)
+	return ParseFileWithOptions(filecontents, args, ParseOptions{})
+}
+
+// ParseOptions are the options of ParseFileWithOptions.
+type ParseOptions struct {
+	// Unsupported is called with the line number, name and arguments of
+	// instructions makisu doesn't support. They are then ignored, and kept
+	// in their stage as UnsupportedDirectives. Unsupported instructions fail
+	// the parsing if it's nil.
+	Unsupported func(line int, instruction, args string)
+
+	// Strict fails the parsing on the extensions of makisu that docker build
+	// doesn't support: include lines and annotations like '#!COMMIT'.
+	Strict bool
+}
+
+// ParseFileWithOptions parses dockerfile like ParseFile, with options.
+func ParseFileWithOptions(
+	filecontents string, args map[string]string, opts ParseOptions) ([]*Stage, error) {
+
+	filecontents = strings.Replace(filecontents, "\r\n", "\n", -1)
+	escape, err := parseEscapeDirective(filecontents)
+	if err != nil {
+		return nil, err
+	}
 
 	if args == nil {
 		args = make(map[string]string)
 	}
 
+	if opts.Strict {
+		for i, line := range strings.Split(filecontents, "\n") {
+			if includeRegexp.MatchString(line) {
+				return nil, fmt.Errorf("include lines are not supported by docker (line %d)", i+1)
+			}
+		}
+	}
+
 	state := newParsingState(args)
-	var count int
-	for scanner.Scan() {
-		count++
-		if err := scanner.Err(); err != nil {
-			return nil, fmt.Errorf("file scanning failed (line %d): %s", count, err)
+	state.escape = escape
+	for _, line := range logicalLines(filecontents, escape) {
+		if opts.Strict {
+			if base, _ := newBaseDirective(line.text); base != nil && base.annotated() {
+				return nil, fmt.Errorf("annotations are not supported by docker (line %d)", line.number)
+			}
+		}
+		var directive Directive
+		if base := unsupportedBase(line.text); base != nil && opts.Unsupported != nil {
+			unsupported := newUnsupportedDirective(base, line.number)
+			opts.Unsupported(line.number, unsupported.Instruction, unsupported.Args)
+			directive = unsupported
+		} else {
+			directive, err = newDirective(line.text, state)
 		}
-		text := scanner.Text()
-		if directive, err := newDirective(text, state); err != nil {
-			return nil, fmt.Errorf("failed to create new directive (line %d): %s", count, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new directive (line %d): %s", line.number, err)
 		} else if directive == nil {
 			continue
 		} else if err := directive.update(state); err != nil {
-			return nil, fmt.Errorf("failed to update parser state (line %d): %s", count, err)
+			return nil, fmt.Errorf("failed to update parser state (line %d): %s", line.number, err)
 		}
 	}
 
 	return state.stages, nil
 }
 
+// sourceLine is a directive of a dockerfile, with the number of the line it
+// starts at.
+type sourceLine struct {
+	text   string
+	number int
+}
+
+// logicalLines returns the directives of a dockerfile, without comment and
+// empty lines, and with the lines ending with the escape character joined to
+// the next ones.
+func logicalLines(filecontents string, escape rune) []sourceLine {
+	var lines []sourceLine
+	var current *sourceLine
+	for i, line := range strings.Split(filecontents, "\n") {
+		trimmed := strings.Trim(line, " \t")
+		if len(trimmed) == 0 || trimmed[0] == '#' {
+			continue
+		}
+		if current == nil {
+			current = &sourceLine{number: i + 1}
+		}
+		if strings.HasSuffix(line, string(escape)) {
+			current.text += strings.TrimSuffix(line, string(escape))
+			continue
+		}
+		current.text += line
+		lines = append(lines, *current)
+		current = nil
+	}
+	if current != nil {
+		lines = append(lines, *current)
+	}
+	return lines
+}
+
+// parseEscapeDirective returns the escape character set by the parser directives
+// at the top of the file, or '\'. Like docker, parser directives are only
+// looked for until the first comment or directive, and unknown ones are
+// comments.
+func parseEscapeDirective(filecontents string) (rune, error) {
+	escape := '\\'
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(filecontents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m := parserDirectiveRegexp.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		name := strings.ToLower(m[1])
+		if name != "escape" && name != "syntax" {
+			break
+		} else if seen[name] {
+			return 0, fmt.Errorf("only one %s parser directive can be used", name)
+		}
+		seen[name] = true
+		if name == "escape" {
+			if m[2] != "\\" && m[2] != "`" {
+				return 0, fmt.Errorf("invalid escape character %q, must be '\\' or '`'", m[2])
+			}
+			escape = rune(m[2][0])
+		}
+	}
+	return escape, nil
+}
+
 func removeCommentLines(filecontents string) string {
 	lines := strings.Split(filecontents, "\n")
 	var output string
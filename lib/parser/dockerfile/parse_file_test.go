@@ -106,6 +106,36 @@ func TestRemoveComments(t *testing.T) {
 	})
 }
 
+func TestParseEscapeDirective(t *testing.T) {
+	tests := []struct {
+		desc       string
+		dockerfile string
+		escape     rune
+		succeed    bool
+	}{
+		{"default", "FROM alpine", '\\', true},
+		{"backtick", "# escape=`\nFROM alpine", '`', true},
+		{"backslash", "#ESCAPE = \\\nFROM alpine", '\\', true},
+		{"after syntax", "# syntax=docker/dockerfile:1\n# escape=`\nFROM alpine", '`', true},
+		{"after comment", "# comment\n# escape=`\nFROM alpine", '\\', true},
+		{"after directive", "FROM alpine\n# escape=`", '\\', true},
+		{"invalid", "# escape=^\nFROM alpine", 0, false},
+		{"duplicate", "# escape=`\n# escape=`\nFROM alpine", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			escape, err := parseEscapeDirective(test.dockerfile)
+			if !test.succeed {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.escape, escape)
+		})
+	}
+}
+
 func invalidDirective() []*test {
 	return []*test{{
 		desc:       "invalid directive",
@@ -124,7 +154,7 @@ func fromOnly() []*test {
 	`
 
 	stage := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias", false},
+		&baseDirective{"from", "alpine:latest AS alias", false, nil, 0},
 		"alpine:latest",
 		"alias",
 	})
@@ -144,17 +174,17 @@ func fromOnly() []*test {
 	`
 
 	stage1 := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias1", false},
+		&baseDirective{"from", "alpine:latest AS alias1", false, nil, 0},
 		"alpine:latest",
 		"alias1",
 	})
 	stage2 := newStage(&FromDirective{
-		&baseDirective{"from", "ubuntu:trusty AS alias2", false},
+		&baseDirective{"from", "ubuntu:trusty AS alias2", false, nil, 0},
 		"ubuntu:trusty",
 		"alias2",
 	})
 	stage3 := newStage(&FromDirective{
-		&baseDirective{"from", "ubuntu:trusty AS alias3", false},
+		&baseDirective{"from", "ubuntu:trusty AS alias3", false, nil, 0},
 		"ubuntu:trusty",
 		"alias3",
 	})
@@ -197,7 +227,7 @@ func globalArgs() []*test {
 	FROM ${image}:latest AS alias1
 	`
 	stage := newStage(&FromDirective{
-		&baseDirective{"from", "${image}:latest AS alias1", false},
+		&baseDirective{"from", "${image}:latest AS alias1", false, nil, 0},
 		"${image}:latest",
 		"alias1",
 	})
@@ -214,7 +244,7 @@ func globalArgs() []*test {
 	FROM ${image}:latest AS alias1
 	`
 	stage = newStage(&FromDirective{
-		&baseDirective{"from", "${image}:latest AS alias1", false},
+		&baseDirective{"from", "${image}:latest AS alias1", false, nil, 0},
 		"${image}:latest",
 		"alias1",
 	})
@@ -231,7 +261,7 @@ func globalArgs() []*test {
 	FROM ${image}:latest AS alias1
 	`
 	stage = newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias1", false},
+		&baseDirective{"from", "alpine:latest AS alias1", false, nil, 0},
 		"alpine:latest",
 		"alias1",
 	})
@@ -249,7 +279,7 @@ func globalArgs() []*test {
 	FROM ${image}:latest AS alias1
 	`
 	stage = newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias1", false},
+		&baseDirective{"from", "alpine:latest AS alias1", false, nil, 0},
 		"alpine:latest",
 		"alias1",
 	})
@@ -263,7 +293,7 @@ func globalArgs() []*test {
 	})
 
 	stage = newStage(&FromDirective{
-		&baseDirective{"from", "ubuntu:latest AS alias1", false},
+		&baseDirective{"from", "ubuntu:latest AS alias1", false, nil, 0},
 		"ubuntu:latest",
 		"alias1",
 	})
@@ -288,12 +318,12 @@ func stageArgs() []*test {
 	CMD ${cmd}
 	`
 	stage := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias1", false},
+		&baseDirective{"from", "alpine:latest AS alias1", false, nil, 0},
 		"alpine:latest",
 		"alias1",
 	})
 	stage.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "${cmd}", false},
+		&baseDirective{"cmd", "${cmd}", false, nil, 0},
 		[]string{"/bin/sh", "-c", "${cmd}"},
 	})
 
@@ -311,18 +341,18 @@ func stageArgs() []*test {
 	CMD ${cmd}
 	`
 	stage = newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias1", false},
+		&baseDirective{"from", "alpine:latest AS alias1", false, nil, 0},
 		"alpine:latest",
 		"alias1",
 	})
 	stage.addDirective(&ArgDirective{
-		&baseDirective{"arg", "cmd", false},
+		&baseDirective{"arg", "cmd", false, nil, 0},
 		"cmd",
 		"",
 		nil,
 	})
 	stage.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "${cmd}", false},
+		&baseDirective{"cmd", "${cmd}", false, nil, 0},
 		[]string{"/bin/sh", "-c", "${cmd}"},
 	})
 
@@ -342,28 +372,28 @@ func stageArgs() []*test {
 	CMD ${cmd}
 	`
 	stage1 := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias1", false},
+		&baseDirective{"from", "alpine:latest AS alias1", false, nil, 0},
 		"alpine:latest",
 		"alias1",
 	})
 	paramVal := "ls"
 	stage1.addDirective(&ArgDirective{
-		&baseDirective{"arg", "cmd", false},
+		&baseDirective{"arg", "cmd", false, nil, 0},
 		"cmd",
 		"",
 		&paramVal,
 	})
 	stage1.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "ls", false},
+		&baseDirective{"cmd", "ls", false, nil, 0},
 		[]string{"/bin/sh", "-c", "ls"},
 	})
 	stage2 := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias2", false},
+		&baseDirective{"from", "alpine:latest AS alias2", false, nil, 0},
 		"alpine:latest",
 		"alias2",
 	})
 	stage2.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "${cmd}", false},
+		&baseDirective{"cmd", "${cmd}", false, nil, 0},
 		[]string{"/bin/sh", "-c", "${cmd}"},
 	})
 
@@ -381,19 +411,19 @@ func stageArgs() []*test {
 	CMD ${cmd}
 	`
 	stage = newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias1", false},
+		&baseDirective{"from", "alpine:latest AS alias1", false, nil, 0},
 		"alpine:latest",
 		"alias1",
 	})
 	paramVal = "ls"
 	stage.addDirective(&ArgDirective{
-		&baseDirective{"arg", "cmd", false},
+		&baseDirective{"arg", "cmd", false, nil, 0},
 		"cmd",
 		"",
 		&paramVal,
 	})
 	stage.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "ls", false},
+		&baseDirective{"cmd", "ls", false, nil, 0},
 		[]string{"/bin/sh", "-c", "ls"},
 	})
 
@@ -433,25 +463,25 @@ func envs() []*test {
 	CMD ${cmd}
 	`
 	stage1 := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias1", false},
+		&baseDirective{"from", "alpine:latest AS alias1", false, nil, 0},
 		"alpine:latest",
 		"alias1",
 	})
 	stage1.addDirective(&EnvDirective{
-		&baseDirective{"env", "cmd ls", false},
+		&baseDirective{"env", "cmd ls", false, nil, 0},
 		map[string]string{"cmd": "ls"},
 	})
 	stage1.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "ls", false},
+		&baseDirective{"cmd", "ls", false, nil, 0},
 		[]string{"/bin/sh", "-c", "ls"},
 	})
 	stage2 := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias2", false},
+		&baseDirective{"from", "alpine:latest AS alias2", false, nil, 0},
 		"alpine:latest",
 		"alias2",
 	})
 	stage2.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "${cmd}", false},
+		&baseDirective{"cmd", "${cmd}", false, nil, 0},
 		[]string{"/bin/sh", "-c", "${cmd}"},
 	})
 
@@ -473,32 +503,32 @@ func envs() []*test {
 	CMD ${cmd2}
 	`
 	stage := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS alias1", false},
+		&baseDirective{"from", "alpine:latest AS alias1", false, nil, 0},
 		"alpine:latest",
 		"alias1",
 	})
 	stage.addDirective(&EnvDirective{
-		&baseDirective{"env", "cmd ls", false},
+		&baseDirective{"env", "cmd ls", false, nil, 0},
 		map[string]string{"cmd": "ls"},
 	})
 	stage.addDirective(&EnvDirective{
-		&baseDirective{"env", "cmd ls -la", false},
+		&baseDirective{"env", "cmd ls -la", false, nil, 0},
 		map[string]string{"cmd": "ls -la"},
 	})
 	stage.addDirective(&EnvDirective{
-		&baseDirective{"env", "cmd=\"ls -la\" cmd2=echo", false},
+		&baseDirective{"env", "cmd=\"ls -la\" cmd2=echo", false, nil, 0},
 		map[string]string{"cmd": "ls -la", "cmd2": "echo"},
 	})
 	stage.addDirective(&EnvDirective{
-		&baseDirective{"env", "empty=\"\" nonEmpty=\"true\"", false},
+		&baseDirective{"env", "empty=\"\" nonEmpty=\"true\"", false, nil, 0},
 		map[string]string{"empty": "", "nonEmpty": "true"},
 	})
 	stage.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "ls -la", false},
+		&baseDirective{"cmd", "ls -la", false, nil, 0},
 		[]string{"/bin/sh", "-c", "ls -la"},
 	})
 	stage.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "echo", false},
+		&baseDirective{"cmd", "echo", false, nil, 0},
 		[]string{"/bin/sh", "-c", "echo"},
 	})
 
@@ -551,64 +581,64 @@ func integration() []*test {
 	args := map[string]string{"alias": "test_alias", "cmd": "echo", "key": "v2"}
 
 	stage1 := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS test_alias1", false},
+		&baseDirective{"from", "alpine:latest AS test_alias1", false, nil, 0},
 		"alpine:latest",
 		"test_alias1",
 	})
 	paramVal1 := "echo"
 	stage1.addDirective(&ArgDirective{
-		&baseDirective{"arg", "cmd=ls", false},
+		&baseDirective{"arg", "cmd=ls", false, nil, 0},
 		"cmd",
 		"ls",
 		&paramVal1,
 	})
 	stage1.addDirective(&EnvDirective{
-		&baseDirective{"env", "image=ubuntu cmd=\"echo echo\"", false},
+		&baseDirective{"env", "image=ubuntu cmd=\"echo echo\"", false, nil, 0},
 		map[string]string{"image": "ubuntu", "cmd": "echo echo"},
 	})
 	stage1.addDirective(&RunDirective{
-		&baseDirective{"run", "echo echo ubuntu", false},
+		&baseDirective{"run", "echo echo ubuntu", false, nil, 0},
 		"echo echo ubuntu",
 	})
 	stage1.addDirective(&CmdDirective{
-		&baseDirective{"cmd", "echo echo ubuntu", false},
+		&baseDirective{"cmd", "echo echo ubuntu", false, nil, 0},
 		[]string{"/bin/sh", "-c", "echo echo ubuntu"},
 	})
 	stage1.addDirective(&CmdDirective{
-		&baseDirective{"cmd", `["echo echo", "ubuntu"]`, false},
+		&baseDirective{"cmd", `["echo echo", "ubuntu"]`, false, nil, 0},
 		[]string{"echo echo", "ubuntu"},
 	})
 
 	stage2 := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS test_alias2", false},
+		&baseDirective{"from", "alpine:latest AS test_alias2", false, nil, 0},
 		"alpine:latest",
 		"test_alias2",
 	})
 	paramVal2 := "v2"
 	stage2.addDirective(&ArgDirective{
-		&baseDirective{"arg", "key", false},
+		&baseDirective{"arg", "key", false, nil, 0},
 		"key",
 		"",
 		&paramVal2,
 	})
 	stage2.addDirective(&EnvDirective{
-		&baseDirective{"env", "dir1 home", false},
+		&baseDirective{"env", "dir1 home", false, nil, 0},
 		map[string]string{"dir1": "home"},
 	})
 	defaultVal1 := "dir"
 	stage2.addDirective(&ArgDirective{
-		&baseDirective{"arg", "dir2=dir", false},
+		&baseDirective{"arg", "dir2=dir", false, nil, 0},
 		"dir2",
 		"dir",
 		&defaultVal1,
 	})
 	stage2.addDirective(&LabelDirective{
-		&baseDirective{"label", "k1=v1 k2=v2", false},
+		&baseDirective{"label", "k1=v1 k2=v2", false, nil, 0},
 		map[string]string{"k1": "v1", "k2": "v2"},
 	})
 	stage2.addDirective(&CopyDirective{
 		&addCopyDirective{
-			&baseDirective{"copy", "--from=digest --chown=user:group src1 src2 src3 dst/", true},
+			&baseDirective{"copy", "--from=digest --chown=user:group src1 src2 src3 dst/", true, nil, 0},
 			"user:group",
 			false,
 			[]string{"src1", "src2", "src3"},
@@ -617,22 +647,22 @@ func integration() []*test {
 		"digest",
 	})
 	stage2.addDirective(&WorkdirDirective{
-		&baseDirective{"workdir", "/path/to/home/dir", false},
+		&baseDirective{"workdir", "/path/to/home/dir", false, nil, 0},
 		"/path/to/home/dir",
 	})
 
 	stage3 := newStage(&FromDirective{
-		&baseDirective{"from", "alpine:latest AS test_alias3", false},
+		&baseDirective{"from", "alpine:latest AS test_alias3", false, nil, 0},
 		"alpine:latest",
 		"test_alias3",
 	})
 	stage3.addDirective(&MaintainerDirective{
-		&baseDirective{"maintainer", `${alias}-maintainer <${alias}@example.com>`, false},
+		&baseDirective{"maintainer", `${alias}-maintainer <${alias}@example.com>`, false, nil, 0},
 		"${alias}-maintainer <${alias}@example.com>",
 	})
 	stage3.addDirective(&AddDirective{
 		&addCopyDirective{
-			&baseDirective{"add", `--chown=user:group ["src1", "src2", "src3", "dst/"]`, true},
+			&baseDirective{"add", `--chown=user:group ["src1", "src2", "src3", "dst/"]`, true, nil, 0},
 			"user:group",
 			false,
 			[]string{"src1", "src2", "src3"},
@@ -640,33 +670,34 @@ func integration() []*test {
 		},
 	})
 	stage3.addDirective(&ArgDirective{
-		&baseDirective{"arg", "cmd", false},
+		&baseDirective{"arg", "cmd", false, nil, 0},
 		"cmd",
 		"",
 		&paramVal1,
 	})
 	stage3.addDirective(&EntrypointDirective{
-		&baseDirective{"entrypoint", `["bash", "echo"]`, false},
+		&baseDirective{"entrypoint", `["bash", "echo"]`, false, nil, 0},
 		[]string{"bash", "echo"},
+		false,
 	})
 	stage3.addDirective(&VolumeDirective{
-		&baseDirective{"volume", "v1 v2", false},
+		&baseDirective{"volume", "v1 v2", false, nil, 0},
 		[]string{"v1", "v2"},
 	})
 	stage3.addDirective(&ExposeDirective{
-		&baseDirective{"expose", "80/tcp 81 82/udp", false},
+		&baseDirective{"expose", "80/tcp 81 82/udp", false, nil, 0},
 		[]string{"80/tcp", "81", "82/udp"},
 	})
 	stage3.addDirective(&EnvDirective{
-		&baseDirective{"env", "PATH=/tmp:$PATH", false},
+		&baseDirective{"env", "PATH=/tmp:$PATH", false, nil, 0},
 		map[string]string{"PATH": "/tmp:$PATH"},
 	})
 	stage3.addDirective(&EnvDirective{
-		&baseDirective{"env", "PATH=/tmp2:/tmp:$PATH", false},
+		&baseDirective{"env", "PATH=/tmp2:/tmp:$PATH", false, nil, 0},
 		map[string]string{"PATH": "/tmp2:/tmp:$PATH"},
 	})
 	stage3.addDirective(&UserDirective{
-		&baseDirective{"user", "udocker", false},
+		&baseDirective{"user", "udocker", false, nil, 0},
 		"udocker",
 	})
 
@@ -680,3 +711,36 @@ func integration() []*test {
 
 	return tests
 }
+
+func TestParseStrict(t *testing.T) {
+	for _, test := range []struct {
+		desc       string
+		dockerfile string
+		line       int
+	}{
+		{"commit", "FROM alpine\nRUN echo #!COMMIT\n", 2},
+		{"exclude", "FROM alpine\n\nRUN echo #!EXCLUDE /tmp\n", 3},
+		{"retry", "FROM alpine\nRUN \\\n  echo #!RETRY\n", 2},
+		{"include", "FROM alpine\n# include other.Dockerfile\n", 2},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			_, err := ParseFile(test.dockerfile, nil)
+			require.NoError(err)
+			_, err = ParseFileWithOptions(test.dockerfile, nil, ParseOptions{Strict: true})
+			require.Error(err)
+			require.Contains(err.Error(), fmt.Sprintf("(line %d)", test.line))
+		})
+	}
+}
+
+func TestParseEntrypointCmdSet(t *testing.T) {
+	require := require.New(t)
+
+	stages, err := ParseFile(
+		"FROM alpine\nENTRYPOINT [\"a\"]\nFROM alpine\nCMD [\"b\"]\nENTRYPOINT [\"a\"]\n", nil)
+	require.NoError(err)
+	require.False(stages[0].Directives[0].(*EntrypointDirective).CmdSet)
+	require.True(stages[1].Directives[1].(*EntrypointDirective).CmdSet)
+}
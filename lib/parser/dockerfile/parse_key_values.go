@@ -27,11 +27,11 @@ var (
 
 // parseKeyVals parses a whitespace-delimited string consisting of <key>=<value>
 // pairs into a map. Both keys and values may optionally contain whitespace by
-// escaping them using '\' or using double quotes.
-func parseKeyVals(input string) (map[string]string, error) {
+// escaping them using the escape character or using double quotes.
+func parseKeyVals(input string, escape rune) (map[string]string, error) {
 	var err error
 	var state parseKVsState = &parseKVsStateSpace{
-		&parseKVsBase{vars: make(map[string]string)},
+		&parseKVsBase{vars: make(map[string]string), escape: escape},
 	}
 	for i := 0; i < len(input); i++ {
 		state, err = state.nextRune(rune(input[i]))
@@ -54,6 +54,7 @@ type parseKVsBase struct {
 	vars    map[string]string
 	currKey string
 	currVal string
+	escape  rune
 	escaped bool
 }
 
@@ -118,7 +119,7 @@ type parseKVsStateEquals struct{ *parseKVsBase }
 func (s *parseKVsStateEquals) nextRune(r rune) (parseKVsState, error) {
 	if r == '"' {
 		return &parseKVsStateValQuote{s.parseKVsBase}, nil
-	} else if r == '\\' {
+	} else if r == s.escape {
 		s.escaped = true
 		return &parseKVsStateVal{s.parseKVsBase}, nil
 	}
@@ -133,10 +134,10 @@ type parseKVsStateVal struct{ *parseKVsBase }
 func (s *parseKVsStateVal) nextRune(r rune) (parseKVsState, error) {
 	if s.escaped {
 		if !unicode.IsSpace(r) && r != '"' {
-			s.currVal += string('\\')
+			s.currVal += string(s.escape)
 		}
 		s.escaped = false
-	} else if r == '\\' {
+	} else if r == s.escape {
 		s.escaped = true
 		return s, nil
 	} else if unicode.IsSpace(r) {
@@ -179,10 +180,10 @@ func (s *parseKVsStateValQuote) consumeCurrKV() error {
 func (s *parseKVsStateValQuote) nextRune(r rune) (parseKVsState, error) {
 	if s.escaped {
 		if r != '"' {
-			s.currVal += "\\"
+			s.currVal += string(s.escape)
 		}
 		s.escaped = false
-	} else if r == '\\' {
+	} else if r == s.escape {
 		s.escaped = true
 		return &parseKVsStateValQuote{s.parseKVsBase}, nil
 	} else if r == '"' {
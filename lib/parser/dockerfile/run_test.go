@@ -51,3 +51,61 @@ func TestNewRunDirective(t *testing.T) {
 		})
 	}
 }
+
+func TestNewRunDirectiveExcludes(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = make(map[string]string)
+
+	tests := []struct {
+		desc     string
+		input    string
+		commit   bool
+		excludes []string
+	}{
+		{"no annotation", `run apt-get update`, false, nil},
+		{"exclude", `run apt-get update #!EXCLUDE /var/cache/apt **/*.pyc`, false, []string{"/var/cache/apt", "**/*.pyc"}},
+		{"commit and exclude", `run pip install x #!commit #!exclude /root/.cache`, true, []string{"/root/.cache"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			require.NoError(err)
+			run, ok := directive.(*RunDirective)
+			require.True(ok)
+			require.Equal(test.commit, run.Commit)
+			require.Equal(test.excludes, run.Excludes)
+		})
+	}
+}
+
+func TestNewRunDirectiveRetries(t *testing.T) {
+	buildState := newParsingState(make(map[string]string))
+	buildState.stageVars = make(map[string]string)
+
+	tests := []struct {
+		desc     string
+		input    string
+		retries  int
+		excludes []string
+	}{
+		{"no annotation", `run apt-get update`, 0, nil},
+		{"default count", `run apt-get update #!RETRY`, DefaultRetries, nil},
+		{"count", `run apt-get update #!retry 5`, 5, nil},
+		{"retry and exclude", `run pip install x #!RETRY 2 #!EXCLUDE /root/.cache`, 2, []string{"/root/.cache"}},
+		{"not an annotation", `run echo retrying #!RETRYING`, 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			directive, err := newDirective(test.input, buildState)
+			require.NoError(err)
+			run, ok := directive.(*RunDirective)
+			require.True(ok)
+			require.Equal(test.retries, run.Retries)
+			require.Equal(test.excludes, run.Excludes)
+		})
+	}
+}
@@ -49,12 +49,16 @@ type parsingState struct {
 	// ENV directives that occurred during the current stage, used in
 	// variable replacements in other directives in the stage.
 	stageVars map[string]string
+
+	// escape is the character escaping characters in directives, '\\' unless
+	// set to '`' by an escape parser directive.
+	escape rune
 }
 
 // newParsingState initializes a blank slate parsingState to begin parsing a dockerfile.
 func newParsingState(vars map[string]string) *parsingState {
 	return &parsingState{
-		make([]*Stage, 0), vars, make(map[string]string), nil,
+		make([]*Stage, 0), vars, make(map[string]string), nil, '\\',
 	}
 }
 
@@ -69,6 +73,20 @@ func (s *parsingState) addStage(stage *Stage) {
 	s.stages = append(s.stages, stage)
 }
 
+// cmdSet returns true if the current stage has a CMD directive.
+func (s *parsingState) cmdSet() bool {
+	stage, err := s.currStage()
+	if err != nil {
+		return false
+	}
+	for _, d := range stage.Directives {
+		if _, ok := d.(*CmdDirective); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // Add this command to the build stage.
 func (s *parsingState) addToCurrStage(d Directive) error {
 	stage, err := s.currStage()
@@ -0,0 +1,60 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RenderTemplate renders a dockerfile as a Go template with the given values,
+// before it's parsed. Referencing a value that is not set is an error, unless
+// it's looked up with index, which returns an empty value instead.
+func RenderTemplate(filecontents string, values map[string]interface{}) (string, error) {
+	t, err := template.New("dockerfile").Option("missingkey=error").Parse(filecontents)
+	if err != nil {
+		return "", fmt.Errorf("parse template: %s", err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, values); err != nil {
+		return "", fmt.Errorf("render template: %s", err)
+	}
+	return b.String(), nil
+}
+
+// LoadTemplateValues reads the values of the template of a dockerfile from
+// YAML files, each a map of values. Top level values of later files override
+// the ones of earlier files.
+func LoadTemplateValues(paths []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read template values: %s", err)
+		}
+		var fileValues map[string]interface{}
+		if err := yaml.Unmarshal(b, &fileValues); err != nil {
+			return nil, fmt.Errorf("unmarshal template values %s: %s", path, err)
+		}
+		for k, v := range fileValues {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
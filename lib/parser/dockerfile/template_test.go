@@ -0,0 +1,62 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmp)
+
+	base := filepath.Join(tmp, "base.yaml")
+	require.NoError(ioutil.WriteFile(base,
+		[]byte("image: debian\nversion: 10\npackages: [curl, git]\nuser:\n  name: app\n"), 0644))
+	override := filepath.Join(tmp, "override.yaml")
+	require.NoError(ioutil.WriteFile(override, []byte("version: 11\n"), 0644))
+
+	values, err := LoadTemplateValues([]string{base, override})
+	require.NoError(err)
+
+	rendered, err := RenderTemplate(
+		"FROM {{ .image }}:{{ .version }}\nRUN apt-get install{{ range .packages }} {{ . }}{{ end }}\n"+
+			"USER {{ .user.name }}\n{{ if index . \"DEBUG\" }}ENV DEBUG=1\n{{ end }}", values)
+	require.NoError(err)
+	require.Equal("FROM debian:11\nRUN apt-get install curl git\nUSER app\n", rendered)
+
+	rendered, err = RenderTemplate(`RUN docker inspect -f '{{"{{"}}.Id{{"}}"}}' x`, values)
+	require.NoError(err)
+	require.Equal("RUN docker inspect -f '{{.Id}}' x", rendered)
+
+	// Values that are not set are errors.
+	_, err = RenderTemplate("FROM {{ .missing }}\n", values)
+	require.Error(err)
+	_, err = RenderTemplate("USER {{ .user.uid }}\n", values)
+	require.Error(err)
+	_, err = RenderTemplate("FROM {{ .image \n", values)
+	require.Error(err)
+
+	_, err = LoadTemplateValues([]string{filepath.Join(tmp, "missing.yaml")})
+	require.Error(err)
+}
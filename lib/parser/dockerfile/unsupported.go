@@ -0,0 +1,56 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"strings"
+)
+
+// UnsupportedDirective represents an instruction makisu doesn't support, kept
+// instead of failing the parsing when ParseOptions.Unsupported is set. It
+// doesn't change the image.
+type UnsupportedDirective struct {
+	*baseDirective
+	// Instruction is the name of the instruction, in upper case.
+	Instruction string
+	// Line is the number of the line of the dockerfile it starts at.
+	Line int
+}
+
+// The arguments are kept as written, without replacing variables.
+func newUnsupportedDirective(base *baseDirective, line int) *UnsupportedDirective {
+	return &UnsupportedDirective{base, strings.ToUpper(base.t), line}
+}
+
+// unsupportedBase returns the base of the directive of line if makisu doesn't
+// support its instruction, or nil.
+func unsupportedBase(line string) *baseDirective {
+	base, err := newBaseDirective(line)
+	if err != nil || base == nil {
+		return nil
+	} else if _, found := directiveConstructors[base.t]; found {
+		return nil
+	}
+	return base
+}
+
+// Add this command to the build stage. Instructions before the first stage
+// have no stage to be kept in, and are dropped.
+func (d *UnsupportedDirective) update(state *parsingState) error {
+	if len(state.stages) == 0 {
+		return nil
+	}
+	return state.addToCurrStage(d)
+}
@@ -0,0 +1,69 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUnsupportedInstructions(t *testing.T) {
+	require := require.New(t)
+
+	contents := `ONBUILD RUN echo global
+FROM alpine
+# comment
+
+RUN echo a \
+  # comment in continuation
+  b
+ONBUILD RUN \
+  echo $foo
+SHELL ["/bin/bash", "-c"]
+`
+	// Errors have the line of the instruction in the file.
+	_, err := ParseFile(strings.Replace(contents, "ONBUILD RUN echo global", "ARG foo=bar", 1), nil)
+	require.Error(err)
+	require.Contains(err.Error(), "(line 8)")
+
+	type unsupported struct {
+		line        int
+		instruction string
+		args        string
+	}
+	var seen []unsupported
+	stages, err := ParseFileWithOptions(contents, nil, ParseOptions{
+		Unsupported: func(line int, instruction, args string) {
+			seen = append(seen, unsupported{line, instruction, args})
+		},
+	})
+	require.NoError(err)
+	require.Equal([]unsupported{
+		{1, "ONBUILD", "RUN echo global"},
+		{8, "ONBUILD", "RUN   echo $foo"},
+		{10, "SHELL", `["/bin/bash", "-c"]`},
+	}, seen)
+
+	// The instruction before the first stage is dropped.
+	require.Len(stages, 1)
+	require.Len(stages[0].Directives, 3)
+	onbuild, ok := stages[0].Directives[1].(*UnsupportedDirective)
+	require.True(ok)
+	require.Equal("ONBUILD", onbuild.Instruction)
+	require.Equal("RUN   echo $foo", onbuild.Args)
+	require.Equal(8, onbuild.Line)
+}
@@ -0,0 +1,87 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"regexp"
+	"strings"
+)
+
+var drivePathRegexp = regexp.MustCompile(`^[a-zA-Z]:([\\/]|$)`)
+
+// _windowsImages are the prefixes of the repositories of Windows base images.
+var _windowsImages = []string{
+	"mcr.microsoft.com/windows",
+	"microsoft/windows",
+	"microsoft/nanoserver",
+}
+
+// _windowsTags are the parts of the tags of images built for Windows, like
+// python:3-windowsservercore-ltsc2022.
+var _windowsTags = []string{"windowsservercore", "nanoserver"}
+
+// Windows returns whether the stage builds a Windows image: its base image is a
+// Windows image, or its WORKDIR, ADD or COPY directives use drive letter paths.
+// Windows stages can be parsed, but not built.
+func (s *Stage) Windows() bool {
+	if isWindowsImage(s.From.Image) {
+		return true
+	}
+	for _, d := range s.Directives {
+		switch d := d.(type) {
+		case *WorkdirDirective:
+			if isDrivePath(d.WorkingDir) {
+				return true
+			}
+		case *AddDirective:
+			if isDrivePath(d.Dst) {
+				return true
+			}
+		case *CopyDirective:
+			if isDrivePath(d.Dst) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWindowsImage returns whether name is the name of a Windows image.
+func isWindowsImage(name string) bool {
+	name = strings.ToLower(name)
+	if i := strings.Index(name, "@"); i != -1 {
+		name = name[:i]
+	}
+	repo, tag := name, ""
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		repo, tag = name[:i], name[i+1:]
+	}
+	for _, prefix := range _windowsImages {
+		if strings.HasPrefix(repo, prefix) {
+			return true
+		}
+	}
+	for _, part := range _windowsTags {
+		if strings.Contains(tag, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDrivePath returns whether path starts with a drive letter, like C:\app.
+func isDrivePath(path string) bool {
+	return drivePathRegexp.MatchString(path)
+}
@@ -0,0 +1,70 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerfile
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWindowsDockerfile(t *testing.T) {
+	require := require.New(t)
+
+	contents, err := ioutil.ReadFile(filepath.Join(_testDir, "example-windows-dockerfile"))
+	require.NoError(err)
+	stages, err := ParseFile(string(contents), nil)
+	require.NoError(err)
+	require.Len(stages, 2)
+
+	build := stages[0]
+	require.True(build.Windows())
+	require.Equal(map[string]string{"APP_HOME": `C:\app`}, build.Directives[1].(*EnvDirective).Envs)
+	require.Equal(`C:\app`, build.Directives[2].(*WorkdirDirective).WorkingDir)
+	copy := build.Directives[3].(*CopyDirective)
+	require.Equal([]string{`bin\`}, copy.Srcs)
+	require.Equal(`C:\app\bin\`, copy.Dst)
+	require.Equal(
+		"powershell -Command     $ErrorActionPreference = 'Stop';     Write-Host $env:APP_HOME",
+		build.Directives[4].(*RunDirective).Cmd)
+
+	require.True(stages[1].Windows())
+	require.Equal(`C:\app`, stages[1].Directives[0].(*CopyDirective).Dst)
+}
+
+func TestStageWindows(t *testing.T) {
+	tests := []struct {
+		dockerfile string
+		windows    bool
+	}{
+		{"FROM alpine\nWORKDIR /app", false},
+		{"FROM mcr.microsoft.com/windows/servercore:ltsc2022", true},
+		{"FROM microsoft/nanoserver", true},
+		{"FROM python:3.11-windowsservercore-ltsc2022", true},
+		{"FROM mcr.microsoft.com/dotnet/sdk:6.0-nanoserver-1809@sha256:abc", true},
+		{"FROM golang:1.12\nWORKDIR c:/go", true},
+		{"FROM golang:1.12\nADD app.zip D:\\", true},
+		{"FROM golang:1.12\nCOPY app /c:", false},
+	}
+	for _, test := range tests {
+		t.Run(test.dockerfile, func(t *testing.T) {
+			stages, err := ParseFile(test.dockerfile, nil)
+			require.NoError(t, err)
+			require.Equal(t, test.windows, stages[0].Windows())
+		})
+	}
+}
@@ -0,0 +1,164 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package passwd resolves user and group names against the /etc/passwd and
+// /etc/group files of a build root, instead of the ones of the host.
+package passwd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of the files names are resolved against, relative to the root.
+const (
+	PasswdFile = "/etc/passwd"
+	GroupFile  = "/etc/group"
+)
+
+// DB resolves names against the files of a root. The files are parsed on the
+// first lookup, and parsed again only once they change, like after a RUN step
+// added a user.
+type DB struct {
+	sync.Mutex
+	root   string
+	passwd *idFile
+	group  *idFile
+}
+
+// New returns a DB reading the files under root.
+func New(root string) *DB {
+	return &DB{
+		root:   root,
+		passwd: &idFile{path: filepath.Join(root, PasswdFile)},
+		group:  &idFile{path: filepath.Join(root, GroupFile)},
+	}
+}
+
+// LookupUser returns the uid of a user name or numeric id.
+func (db *DB) LookupUser(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	db.Lock()
+	defer db.Unlock()
+	ids, err := db.passwd.load()
+	if err != nil {
+		return 0, fmt.Errorf("look up user '%s': %s", name, err)
+	}
+	id, ok := ids[name]
+	if !ok {
+		return 0, fmt.Errorf("look up user '%s': no such user in %s", name, PasswdFile)
+	}
+	return id, nil
+}
+
+// LookupGroup returns the gid of a group name or numeric id.
+func (db *DB) LookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	db.Lock()
+	defer db.Unlock()
+	ids, err := db.group.load()
+	if err != nil {
+		return 0, fmt.Errorf("look up group '%s': %s", name, err)
+	}
+	id, ok := ids[name]
+	if !ok {
+		return 0, fmt.Errorf("look up group '%s': no such group in %s", name, GroupFile)
+	}
+	return id, nil
+}
+
+// ResolveChown converts a chown string of the form <user>[:<group>] to uid
+// and gid, like utils.ResolveChown, but resolving names against the files of
+// the root. If <group> is not specified, gid is set to the resolved uid.
+func (db *DB) ResolveChown(chown string) (uid, gid int, err error) {
+	if chown == "" {
+		return 0, 0, nil
+	}
+	split := strings.Split(chown, ":")
+	if len(split) > 2 || split[0] == "" || len(split) == 2 && split[1] == "" {
+		return 0, 0, fmt.Errorf("invalid chown '%s', expected <user>[:<group>]", chown)
+	}
+	if uid, err = db.LookupUser(split[0]); err != nil {
+		return 0, 0, err
+	}
+	if len(split) == 1 {
+		return uid, uid, nil
+	}
+	if gid, err = db.LookupGroup(split[1]); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// idFile caches the ids by name of a passwd or group file, whose third field
+// is the id, along with the stat of the file they were parsed from.
+type idFile struct {
+	path    string
+	ids     map[string]int
+	size    int64
+	modTime time.Time
+}
+
+func (f *idFile) load() (map[string]int, error) {
+	fi, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s doesn't exist", f.path)
+	} else if err != nil {
+		return nil, fmt.Errorf("stat %s: %s", f.path, err)
+	}
+	if f.ids != nil && fi.Size() == f.size && fi.ModTime().Equal(f.modTime) {
+		return f.ids, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %s", f.path, err)
+	}
+	defer file.Close()
+	ids := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil || id < 0 {
+			continue
+		}
+		// Like libc, the first entry of a name wins.
+		if _, ok := ids[fields[0]]; !ok {
+			ids[fields[0]] = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %s", f.path, err)
+	}
+	f.ids, f.size, f.modTime = ids, fi.Size(), fi.ModTime()
+	return ids, nil
+}
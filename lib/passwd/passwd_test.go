@@ -0,0 +1,114 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package passwd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, root, passwd, group string) {
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, PasswdFile), []byte(passwd), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, GroupFile), []byte(group), 0644))
+}
+
+func TestResolveChown(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	writeFiles(t, root, `root:x:0:0:root:/root:/bin/sh
+# comment
+app:x:1000:1000::/home/app:/bin/sh
+app:x:2000:2000::/home/app:/bin/sh
+broken
+nobody:x:65534:65534::/:/sbin/nologin
+`, `root:x:0:
+staff:x:50:app
+`)
+	db := New(root)
+
+	tests := []struct {
+		desc    string
+		succeed bool
+		chown   string
+		uid     int
+		gid     int
+	}{
+		{"empty", true, "", 0, 0},
+		{"uid no group", true, "1", 1, 1},
+		{"uid and gid", true, "1:2", 1, 2},
+		{"user no group", true, "app", 1000, 1000},
+		{"user and group", true, "nobody:staff", 65534, 50},
+		{"uid and group", true, "7:staff", 7, 50},
+		{"missing group", false, "app:", 0, 0},
+		{"missing user", false, ":staff", 0, 0},
+		{"too many parts", false, "app:staff:x", 0, 0},
+		{"unknown user", false, "other", 0, 0},
+		{"unknown group", false, "app:other", 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			uid, gid, err := db.ResolveChown(test.chown)
+			if test.succeed {
+				require.NoError(err)
+				require.Equal(test.uid, uid)
+				require.Equal(test.gid, gid)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	db := New(root)
+
+	_, err = db.LookupUser("app")
+	require.Error(err)
+	require.Contains(err.Error(), "doesn't exist")
+
+	writeFiles(t, root, "root:x:0:0::/root:/bin/sh\n", "root:x:0:\n")
+	_, err = db.LookupUser("app")
+	require.Error(err)
+	require.Contains(err.Error(), "no such user")
+
+	// Files are parsed again once they change.
+	writeFiles(t, root, "root:x:0:0::/root:/bin/sh\napp:x:1000:1000::/:/bin/sh\n", "root:x:0:\n")
+	uid, err := db.LookupUser("app")
+	require.NoError(err)
+	require.Equal(1000, uid)
+
+	// And are cached until then.
+	passwdPath := filepath.Join(root, PasswdFile)
+	fi, err := os.Stat(passwdPath)
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(passwdPath, []byte("root:x:0:0::/root:/bin/sh\napp:x:1001:1001::/:/bin/sh\n"), 0644))
+	require.NoError(os.Chtimes(passwdPath, time.Now(), fi.ModTime()))
+	uid, err = db.LookupUser("app")
+	require.NoError(err)
+	require.Equal(1000, uid)
+}
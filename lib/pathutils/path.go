@@ -33,6 +33,58 @@ func IsDescendantOfAny(p string, ancestors []string) bool {
 	return false
 }
 
+// IsBlacklisted returns true if p is in the subtree of any blacklist entry.
+// Entries containing glob characters are patterns, see MatchesAnyPattern.
+func IsBlacklisted(p string, blacklist []string) bool {
+	var patterns []string
+	for _, entry := range blacklist {
+		if strings.ContainsAny(entry, "*?[") {
+			patterns = append(patterns, entry)
+		} else if IsDescendantOfAny(p, []string{entry}) {
+			return true
+		}
+	}
+	return len(patterns) != 0 && MatchesAnyPattern(p, patterns)
+}
+
+// MatchesAnyPattern returns true if p, or one of its ancestors, matches any of
+// the patterns. Patterns are absolute paths whose components are matched with
+// path.Match, where "**" matches any number of components, e.g.
+// "/var/cache/apt", "/root/.cache/*" or "**/*.pyc". Invalid patterns never
+// match.
+func MatchesAnyPattern(p string, patterns []string) bool {
+	parts := SplitPath(AbsPath(p))
+	for _, pattern := range patterns {
+		if matchParts(SplitPath(AbsPath(pattern)), parts) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchParts returns true if the pattern components match a prefix of the path
+// components.
+func matchParts(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchParts(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, err := path.Match(pattern[0], parts[0]); err != nil || !ok {
+		return false
+	}
+	return matchParts(pattern[1:], parts[1:])
+}
+
 // AbsPath fixes leading and trailing slashes of paths for all cases:
 // - Layers generated by docker doesn't have leading slashes.
 // - Internally generated paths might have leading slashes.
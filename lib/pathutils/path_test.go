@@ -109,3 +109,49 @@ func TestIsDescendantOfAny(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchesAnyPattern(t *testing.T) {
+	testCases := []struct {
+		input   string
+		pattern string
+		result  bool
+	}{
+		{"/var/cache/apt", "/var/cache/apt", true},
+		{"/var/cache/apt/archives/a.deb", "/var/cache/apt", true},
+		{"var/cache/apt/", "/var/cache/apt/", true},
+		{"/root/.cache/pip", "/root/.cache/*", true},
+		{"/a/b.pyc", "**/*.pyc", true},
+		{"/b.pyc", "**/*.pyc", true},
+		{"/a/b/__pycache__/c", "**/__pycache__", true},
+		{"/a/b/c.pyc", "/a/**/*.pyc", true},
+
+		{"/var/cache", "/var/cache/apt", false},
+		{"/var/cache/apt2", "/var/cache/apt", false},
+		{"/root/.cache", "/root/.cache/*", false},
+		{"/a/b.py", "**/*.pyc", false},
+		{"/x/b.pyc", "/a/**/*.pyc", false},
+		{"/a/b", "/a/[", false},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			require := require.New(t)
+			require.Equal(tc.result, MatchesAnyPattern(tc.input, []string{tc.pattern}))
+		})
+	}
+}
+
+func TestIsBlacklisted(t *testing.T) {
+	require := require.New(t)
+
+	blacklist := []string{"/proc", "/home/*/.cache", "**/.git"}
+	require.True(IsBlacklisted("/proc", blacklist))
+	require.True(IsBlacklisted("/proc/1/status", blacklist))
+	require.True(IsBlacklisted("/home/user/.cache/pip", blacklist))
+	require.True(IsBlacklisted("/src/repo/.git/HEAD", blacklist))
+
+	require.False(IsBlacklisted("/processes", blacklist))
+	require.False(IsBlacklisted("/home/user/.config", blacklist))
+	require.False(IsBlacklisted("/src/repo/.gitignore", blacklist))
+	require.False(IsBlacklisted("/a", nil))
+}
@@ -0,0 +1,141 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// _binfmtDir is where binfmt_misc lists the interpreters of foreign binaries.
+var _binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// _qemuArchitectures are the names qemu-user gives architectures, in the
+// names of its binfmt_misc entries, like qemu-aarch64.
+var _qemuArchitectures = map[string]string{
+	"386":      "i386",
+	"amd64":    "x86_64",
+	"arm":      "arm",
+	"arm64":    "aarch64",
+	"loong64":  "loongarch64",
+	"mips":     "mips",
+	"mipsle":   "mipsel",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+	"ppc64":    "ppc64",
+	"ppc64le":  "ppc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// Emulator is a binfmt_misc entry running the binaries of a foreign
+// architecture with qemu-user.
+type Emulator struct {
+	// Name is the name of the entry, like qemu-aarch64.
+	Name string
+	// Interpreter is the path of qemu, like /usr/bin/qemu-aarch64-static.
+	Interpreter string
+	// FixBinary is true if the kernel opened the interpreter when the entry
+	// was registered, so it runs binaries in any root, like the ones of
+	// chroots and containers. Otherwise, the interpreter must exist at its
+	// path in the root of the binaries.
+	FixBinary bool
+}
+
+// Native returns whether the host runs binaries of p natively: p is
+// compatible with the default platform, or is the 32 bit version of its
+// architecture.
+func Native(p Platform) bool {
+	host, p := Default(), p.Normalize()
+	if host.Compatible(p) {
+		return true
+	}
+	return p.OS == host.OS &&
+		(host.Architecture == "amd64" && p.Architecture == "386" ||
+			host.Architecture == "arm64" && p.Architecture == "arm")
+}
+
+// FindEmulator returns the enabled binfmt_misc entry of qemu-user running
+// binaries of p. It returns an error explaining how to register one if there
+// is none.
+func FindEmulator(p Platform) (*Emulator, error) {
+	p = p.Normalize()
+	if p.OS != "linux" {
+		return nil, fmt.Errorf("binaries of %s can't run on linux", p)
+	}
+	arch, ok := _qemuArchitectures[p.Architecture]
+	if !ok {
+		return nil, fmt.Errorf("no emulator of architecture %s", p.Architecture)
+	}
+	missing := fmt.Errorf(
+		"running binaries of %s requires binfmt_misc with the qemu-%s emulator registered, "+
+			"e.g. with 'docker run --privileged --rm tonistiigi/binfmt --install %s'",
+		p, arch, p.Architecture)
+
+	status, err := ioutil.ReadFile(filepath.Join(_binfmtDir, "status"))
+	if err != nil || strings.TrimSpace(string(status)) != "enabled" {
+		return nil, missing
+	}
+	entries, err := ioutil.ReadDir(_binfmtDir)
+	if err != nil {
+		return nil, missing
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != "qemu-"+arch && !strings.HasPrefix(name, "qemu-"+arch+"-") {
+			continue
+		}
+		emulator, enabled, err := readBinfmtEntry(filepath.Join(_binfmtDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("read binfmt_misc entry %s: %s", name, err)
+		} else if enabled {
+			return emulator, nil
+		}
+	}
+	return nil, missing
+}
+
+// readBinfmtEntry parses a binfmt_misc entry, and returns whether it is
+// enabled.
+func readBinfmtEntry(p string) (*Emulator, bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	emulator := &Emulator{Name: filepath.Base(p)}
+	enabled := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "enabled":
+			enabled = true
+		case strings.HasPrefix(line, "interpreter "):
+			emulator.Interpreter = strings.TrimSpace(strings.TrimPrefix(line, "interpreter "))
+		case strings.HasPrefix(line, "flags:"):
+			emulator.FixBinary = strings.Contains(strings.TrimPrefix(line, "flags:"), "F")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return emulator, enabled, nil
+}
@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNative(t *testing.T) {
+	require := require.New(t)
+
+	require.True(Native(Default()))
+	require.False(Native(Platform{OS: "linux", Architecture: "s390x"}))
+	require.False(Native(Platform{OS: "windows", Architecture: runtime.GOARCH}))
+	if runtime.GOARCH == "amd64" {
+		require.True(Native(Platform{OS: "linux", Architecture: "386"}))
+		require.False(Native(Platform{OS: "linux", Architecture: "arm64"}))
+	}
+}
+
+func TestFindEmulator(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func(orig string) { _binfmtDir = orig }(_binfmtDir)
+	_binfmtDir = dir
+
+	arm64 := Platform{OS: "linux", Architecture: "arm64"}
+
+	// binfmt_misc isn't mounted.
+	_, err = FindEmulator(arm64)
+	require.Error(err)
+	require.Contains(err.Error(), "tonistiigi/binfmt --install arm64")
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "status"), []byte("enabled\n"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "qemu-aarch64"), []byte(
+		"disabled\ninterpreter /usr/bin/qemu-aarch64\nflags: \noffset 0\n"), 0644))
+	_, err = FindEmulator(arm64)
+	require.Error(err)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "qemu-aarch64"), []byte(
+		"enabled\ninterpreter /usr/bin/qemu-aarch64-static\nflags: OCF\noffset 0\n"), 0644))
+	emulator, err := FindEmulator(arm64)
+	require.NoError(err)
+	require.Equal(&Emulator{
+		Name:        "qemu-aarch64",
+		Interpreter: "/usr/bin/qemu-aarch64-static",
+		FixBinary:   true,
+	}, emulator)
+
+	// Entries of other architectures don't match.
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "qemu-aarch64_be"), []byte(
+		"enabled\ninterpreter /usr/bin/qemu-aarch64_be\nflags: \n"), 0644))
+	_, err = FindEmulator(Platform{OS: "linux", Architecture: "riscv64"})
+	require.Error(err)
+
+	_, err = FindEmulator(Platform{OS: "windows", Architecture: "arm64"})
+	require.Error(err)
+}
@@ -0,0 +1,186 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package platform parses and normalizes the platforms of images, like
+// "linux/arm/v7", and matches them against the platform of a build.
+package platform
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Platform is the operating system and architecture an image runs on, with
+// the JSON keys of the platforms of manifest lists and OCI indexes.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// knownOS are the operating systems a platform of a single component is
+// parsed as, instead of an architecture.
+var knownOS = map[string]bool{
+	"aix":       true,
+	"android":   true,
+	"darwin":    true,
+	"dragonfly": true,
+	"freebsd":   true,
+	"illumos":   true,
+	"linux":     true,
+	"macos":     true,
+	"netbsd":    true,
+	"openbsd":   true,
+	"plan9":     true,
+	"solaris":   true,
+	"windows":   true,
+}
+
+// Default returns the platform of the host: linux, since images are always
+// built for linux, with the architecture makisu was compiled for.
+func Default() Platform {
+	return Platform{OS: "linux", Architecture: runtime.GOARCH}.Normalize()
+}
+
+// Parse parses and normalizes a platform of the form
+// <os>[/<architecture>[/<variant>]]. A single component is either an
+// operating system, with the architecture of the host, or an architecture,
+// for linux.
+func Parse(s string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(s), "/")
+	if len(parts) > 3 {
+		return Platform{}, fmt.Errorf("invalid platform %q: too many components", s)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return Platform{}, fmt.Errorf("invalid platform %q: empty component", s)
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+				return Platform{}, fmt.Errorf("invalid platform %q: invalid character %q", s, c)
+			}
+		}
+	}
+
+	var p Platform
+	switch len(parts) {
+	case 1:
+		if knownOS[parts[0]] {
+			p = Platform{OS: parts[0], Architecture: runtime.GOARCH}
+		} else {
+			p = Platform{OS: "linux", Architecture: parts[0]}
+		}
+	case 2:
+		p = Platform{OS: parts[0], Architecture: parts[1]}
+	case 3:
+		p = Platform{OS: parts[0], Architecture: parts[1], Variant: parts[2]}
+	}
+	return p.Normalize(), nil
+}
+
+// Normalize returns the platform with the names of GOOS and GOARCH for its
+// operating system and architecture, like "amd64" for "x86_64", and the
+// canonical name of its variant, if any.
+func (p Platform) Normalize() Platform {
+	p.OS = strings.ToLower(p.OS)
+	if p.OS == "macos" {
+		p.OS = "darwin"
+	}
+	p.Architecture = strings.ToLower(p.Architecture)
+	p.Variant = strings.ToLower(p.Variant)
+
+	switch p.Architecture {
+	case "i386", "i686", "x86", "386":
+		p.Architecture, p.Variant = "386", ""
+	case "x86_64", "x86-64", "amd64":
+		p.Architecture = "amd64"
+		if p.Variant == "v1" {
+			p.Variant = ""
+		}
+	case "aarch64", "arm64":
+		p.Architecture = "arm64"
+		switch p.Variant {
+		case "8", "v8", "v8.0":
+			p.Variant = ""
+		}
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	case "arm":
+		switch p.Variant {
+		case "", "7":
+			p.Variant = "v7"
+		case "5", "6", "8":
+			p.Variant = "v" + p.Variant
+		}
+	}
+	return p
+}
+
+// String returns the platform in the form <os>/<architecture>[/<variant>].
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// Match returns whether the platforms are the same once normalized.
+func (p Platform) Match(other Platform) bool {
+	return p.Normalize() == other.Normalize()
+}
+
+// Compatible returns whether images of the other platform run on p: they
+// match, or other is an older variant of arm.
+func (p Platform) Compatible(other Platform) bool {
+	p, other = p.Normalize(), other.Normalize()
+	if p == other {
+		return true
+	}
+	return p.OS == other.OS && p.Architecture == "arm" && other.Architecture == "arm" &&
+		armVersion(other.Variant) > 0 && armVersion(other.Variant) < armVersion(p.Variant)
+}
+
+func armVersion(variant string) int {
+	switch variant {
+	case "v5":
+		return 5
+	case "v6":
+		return 6
+	case "v7":
+		return 7
+	case "v8":
+		return 8
+	}
+	return 0
+}
+
+// Best returns the index of the candidate that best matches p: the one that
+// matches it, or else the newest compatible variant. It returns -1 if no
+// candidate is compatible with p.
+func (p Platform) Best(candidates []Platform) int {
+	best := -1
+	for i, c := range candidates {
+		if p.Match(c) {
+			return i
+		}
+		if p.Compatible(c) && (best == -1 ||
+			armVersion(c.Normalize().Variant) > armVersion(candidates[best].Normalize().Variant)) {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,86 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Platform
+	}{
+		{"linux/amd64", Platform{"linux", "amd64", ""}},
+		{"Linux/x86_64", Platform{"linux", "amd64", ""}},
+		{"linux/arm/v7", Platform{"linux", "arm", "v7"}},
+		{"linux/arm", Platform{"linux", "arm", "v7"}},
+		{"linux/arm/6", Platform{"linux", "arm", "v6"}},
+		{"linux/armhf", Platform{"linux", "arm", "v7"}},
+		{"linux/armel", Platform{"linux", "arm", "v6"}},
+		{"linux/aarch64", Platform{"linux", "arm64", ""}},
+		{"linux/arm64/v8", Platform{"linux", "arm64", ""}},
+		{"linux/i686", Platform{"linux", "386", ""}},
+		{"linux/ppc64le", Platform{"linux", "ppc64le", ""}},
+		{"macos/arm64", Platform{"darwin", "arm64", ""}},
+		{"arm64", Platform{"linux", "arm64", ""}},
+		{"windows", Platform{"windows", runtime.GOARCH, ""}.Normalize()},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			p, err := Parse(test.input)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, p)
+		})
+	}
+
+	for _, input := range []string{"", "linux/", "linux//v7", "linux/arm/v7/extra", "linux/amd 64"} {
+		_, err := Parse(input)
+		require.Error(t, err, input)
+	}
+}
+
+func TestString(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("linux/amd64", Platform{OS: "linux", Architecture: "amd64"}.String())
+	require.Equal("linux/arm/v7", Platform{OS: "linux", Architecture: "arm", Variant: "v7"}.String())
+	require.Equal("linux", Default().OS)
+}
+
+func TestBest(t *testing.T) {
+	require := require.New(t)
+
+	candidates := []Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm", Variant: "v5"},
+		{OS: "linux", Architecture: "arm", Variant: "v6"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "unknown", Architecture: "unknown"},
+	}
+	require.Equal(0, Platform{OS: "linux", Architecture: "x86_64"}.Best(candidates))
+	require.Equal(3, Platform{OS: "linux", Architecture: "arm64"}.Best(candidates))
+	require.Equal(2, Platform{OS: "linux", Architecture: "arm", Variant: "v7"}.Best(candidates))
+	require.Equal(1, Platform{OS: "linux", Architecture: "arm", Variant: "v5"}.Best(candidates))
+	require.Equal(-1, Platform{OS: "linux", Architecture: "s390x"}.Best(candidates))
+	require.Equal(-1, Platform{OS: "windows", Architecture: "amd64"}.Best(candidates))
+
+	require.True(Platform{OS: "linux", Architecture: "arm"}.Match(Platform{OS: "linux", Architecture: "arm", Variant: "7"}))
+	require.False(Platform{OS: "linux", Architecture: "arm", Variant: "v6"}.Compatible(
+		Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+}
@@ -0,0 +1,184 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy verifies base images against a policy, which pins the
+// digests of base images or requires them to be signed, before builds use
+// them.
+package policy
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/signature"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Registry is the part of the registry client used to verify images.
+type Registry interface {
+	ResolveManifestDigest(reference string) (image.Digest, error)
+	PullSignatures(digest image.Digest) ([]registry.Signature, error)
+}
+
+// Policy restricts the base images that builds can use.
+type Policy struct {
+	// Rules are matched in order against the repositories of base images, and
+	// the first matching rule applies.
+	Rules []*Rule `yaml:"rules"`
+	// AllowUnmatched allows base images that match no rule.
+	AllowUnmatched bool `yaml:"allow_unmatched"`
+}
+
+// Rule is the policy of the base images of some repositories. Images are
+// allowed if they have one of the digests, or are signed by one of the keys.
+// Images of a rule without digests or keys are all allowed.
+type Rule struct {
+	// Repository is matched against "<registry>/<repository>" like --blacklist
+	// patterns, e.g. "registry.example.com/base/*" or "index.docker.io/**".
+	// The rule also applies to the repositories under it.
+	Repository string `yaml:"repository"`
+	// Digests are the manifest digests allowed.
+	Digests []image.Digest `yaml:"digests"`
+	// Keys are the paths of public keys, in the format of cosign.
+	Keys []string `yaml:"keys"`
+
+	publicKeys []crypto.PublicKey
+}
+
+// Violation is the error of a base image rejected by the policy.
+type Violation struct {
+	Image  image.Name
+	Digest image.Digest
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	if v.Digest == "" {
+		return fmt.Sprintf("base image %s violates the base image policy: %s", v.Image, v.Reason)
+	}
+	return fmt.Sprintf(
+		"base image %s (%s) violates the base image policy: %s", v.Image, v.Digest, v.Reason)
+}
+
+// Load reads a policy from a YAML file, and the public keys of its rules.
+func Load(path string) (*Policy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy: %s", err)
+	}
+	p := new(Policy)
+	if err := yaml.UnmarshalStrict(content, p); err != nil {
+		return nil, fmt.Errorf("unmarshal policy %s: %s", path, err)
+	}
+	for i, rule := range p.Rules {
+		if rule.Repository == "" {
+			return nil, fmt.Errorf("rule %d of policy %s has no repository", i+1, path)
+		}
+		for _, keyPath := range rule.Keys {
+			key, err := signature.LoadPublicKey(keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %s", rule.Repository, err)
+			}
+			rule.publicKeys = append(rule.publicKeys, key)
+		}
+	}
+	return p, nil
+}
+
+// match returns the first rule matching the repository of an image.
+func (p *Policy) match(name image.Name) *Rule {
+	repository := name.GetRegistry() + "/" + name.GetRepository()
+	for _, rule := range p.Rules {
+		if pathutils.MatchesAnyPattern(repository, []string{rule.Repository}) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Check verifies a base image, and returns the digest it was verified at, so
+// it can be pulled at that digest. It returns an empty digest if the image is
+// allowed without being resolved.
+func (p *Policy) Check(r Registry, name image.Name) (image.Digest, error) {
+	rule := p.match(name)
+	if rule == nil {
+		if p.AllowUnmatched {
+			return "", nil
+		}
+		return "", &Violation{Image: name, Reason: "no rule matches its repository"}
+	}
+	if len(rule.Digests) == 0 && len(rule.publicKeys) == 0 {
+		return "", nil
+	}
+
+	digest := image.Digest(name.GetTag())
+	if !strings.Contains(name.GetTag(), ":") {
+		var err error
+		if digest, err = r.ResolveManifestDigest(name.GetTag()); err != nil {
+			return "", fmt.Errorf("resolve digest of %s: %s", name, err)
+		}
+	}
+	for _, allowed := range rule.Digests {
+		if digest == allowed {
+			log.Infof("* Base image %s is pinned by policy rule %s", name, rule.Repository)
+			return digest, nil
+		}
+	}
+	if len(rule.publicKeys) == 0 {
+		return "", &Violation{Image: name, Digest: digest,
+			Reason: fmt.Sprintf("digest is not allowed by rule %s", rule.Repository)}
+	}
+
+	signatures, err := r.PullSignatures(digest)
+	if err != nil {
+		return "", fmt.Errorf("pull signatures of %s: %s", name, err)
+	}
+	if err := rule.verify(signatures, digest); err != nil {
+		return "", &Violation{Image: name, Digest: digest,
+			Reason: fmt.Sprintf("%s, as required by rule %s", err, rule.Repository)}
+	}
+	log.Infof("* Verified signature of base image %s", name)
+	return digest, nil
+}
+
+// verify returns nil if one of the signatures signs the digest with one of the
+// keys of the rule.
+func (rule *Rule) verify(signatures []registry.Signature, digest image.Digest) error {
+	if len(signatures) == 0 {
+		return fmt.Errorf("no signature found")
+	}
+	for _, s := range signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Signature)
+		if err != nil {
+			continue
+		}
+		if err := signature.VerifyPayload(s.Payload, digest); err != nil {
+			continue
+		}
+		for _, key := range rule.publicKeys {
+			if signature.Verify(key, s.Payload, sig) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("none of its %d signature(s) is valid for the keys", len(signatures))
+}
@@ -0,0 +1,152 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/registry"
+	"github.com/uber/makisu/lib/signature"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistry resolves all tags to the same digest.
+type fakeRegistry struct {
+	digest     image.Digest
+	signatures []registry.Signature
+}
+
+func (r *fakeRegistry) ResolveManifestDigest(reference string) (image.Digest, error) {
+	return r.digest, nil
+}
+
+func (r *fakeRegistry) PullSignatures(digest image.Digest) ([]registry.Signature, error) {
+	if digest != r.digest {
+		return nil, fmt.Errorf("unexpected digest %s", digest)
+	}
+	return r.signatures, nil
+}
+
+func writePolicy(t *testing.T, dir, content string) *Policy {
+	policyPath := filepath.Join(dir, "policy.yaml")
+	require.NoError(t, ioutil.WriteFile(policyPath, []byte(content), 0644))
+	p, err := Load(policyPath)
+	require.NoError(t, err)
+	return p
+}
+
+func TestCheck(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "policy")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(err)
+	keyPath := filepath.Join(dir, "cosign.pub")
+	require.NoError(ioutil.WriteFile(
+		keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	p := writePolicy(t, dir, fmt.Sprintf(`
+rules:
+  - repository: index.docker.io/library/alpine
+    digests:
+      - sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3
+  - repository: registry.example.com/base/*
+    keys:
+      - %s
+  - repository: registry.example.com/trusted
+`, keyPath))
+
+	sign := func(digest image.Digest) registry.Signature {
+		payload, err := signature.Payload("registry.example.com/base/go", digest)
+		require.NoError(err)
+		hash := sha256.Sum256(payload)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+		require.NoError(err)
+		return registry.Signature{Payload: payload, Signature: base64.StdEncoding.EncodeToString(sig)}
+	}
+
+	for _, test := range []struct {
+		desc      string
+		image     string
+		registry  *fakeRegistry
+		digest    image.Digest
+		violation bool
+	}{
+		{"pinned", "alpine:3", &fakeRegistry{digest: "sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3"}, "sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3", false},
+		{"pinned by digest", "alpine@sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3", &fakeRegistry{}, "sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3", false},
+		{"not pinned", "alpine:3", &fakeRegistry{digest: "sha256:other"}, "", true},
+		{"signed", "registry.example.com/base/go:1",
+			&fakeRegistry{digest: "sha256:a", signatures: []registry.Signature{sign("sha256:a")}},
+			"sha256:a", false},
+		{"unsigned", "registry.example.com/base/go:1", &fakeRegistry{digest: "sha256:a"}, "", true},
+		{"signed other digest", "registry.example.com/base/go:1",
+			&fakeRegistry{digest: "sha256:a", signatures: []registry.Signature{sign("sha256:b")}},
+			"", true},
+		{"trusted", "registry.example.com/trusted/sub:1", &fakeRegistry{}, "", false},
+		{"unmatched", "registry.example.com/other:1", &fakeRegistry{}, "", true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			name, err := image.ParseNameForPull(test.image)
+			require.NoError(err)
+			digest, err := p.Check(test.registry, name)
+			if test.violation {
+				require.IsType(&Violation{}, err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(test.digest, digest)
+		})
+	}
+
+	p.AllowUnmatched = true
+	digest, err := p.Check(&fakeRegistry{}, image.MustParseName("registry.example.com/other:1"))
+	require.NoError(err)
+	require.Empty(digest)
+}
+
+func TestLoadErrors(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "policy")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	policyPath := filepath.Join(dir, "policy.yaml")
+	for _, content := range []string{
+		"rule: []",
+		"rules: [{digests: [sha256:a]}]",
+		"rules: [{repository: example.com/app, keys: [/does/not/exist.pub]}]",
+	} {
+		require.NoError(ioutil.WriteFile(policyPath, []byte(content), 0644))
+		_, err := Load(policyPath)
+		require.Error(err, content)
+	}
+}
@@ -0,0 +1,376 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profile records how long each phase of a build takes, so users can
+// tell whether downloads, scans or RUN commands dominate.
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/uber/makisu/lib/storage"
+)
+
+// Phases of a build. Scans happen during commits, so their durations overlap.
+const (
+	PhaseParse     = "parse"
+	PhaseStep      = "step"
+	PhaseCachePull = "cache-pull"
+	PhasePull      = "pull"
+	PhaseExec      = "exec"
+	PhaseScan      = "scan"
+	PhaseCommit    = "commit"
+	PhaseVulnScan  = "vulnerability-scan"
+	PhasePush      = "push"
+	PhaseSave      = "save"
+	PhaseLoad      = "load"
+)
+
+// Span is the duration of a phase, for a step or for the whole build.
+type Span struct {
+	Phase     string
+	Stage     string
+	Step      int
+	Directive string
+	Start     time.Time
+	Duration  time.Duration
+	// Size is the number of bytes committed or pulled, if known.
+	Size int64
+	// Cache is the cache status of a step span, "hit", "miss" or "skipped".
+	Cache string
+	// Retries is the number of times the command of a RUN step span was run
+	// again after failing.
+	Retries int
+}
+
+// Recorder records the spans of a build. Steps are built one at a time, and
+// spans recorded while a step is running are labeled with it. All methods are
+// noops on a nil Recorder.
+type Recorder struct {
+	sync.Mutex
+
+	start time.Time
+	spans []Span
+
+	// current is the step running, if Step is not 0.
+	current Span
+}
+
+// NewRecorder returns a new Recorder. The build is assumed to start now.
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// StartStep labels the next spans with a step, until EndStep is called.
+func (r *Recorder) StartStep(stage string, step int, directive string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.current = Span{
+		Phase:     PhaseStep,
+		Stage:     stage,
+		Step:      step,
+		Directive: strings.Join(strings.Fields(directive), " "),
+		Start:     time.Now(),
+	}
+}
+
+// SetStepCache records the cache status of the current step.
+func (r *Recorder) SetStepCache(status string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.current.Cache = status
+}
+
+// SetStepRetries records the number of retries of the current step.
+func (r *Recorder) SetStepRetries(retries int) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.current.Retries = retries
+}
+
+// EndStep records the span of the current step.
+func (r *Recorder) EndStep() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.current.Step == 0 {
+		return
+	}
+	span := r.current
+	span.Duration = time.Since(span.Start)
+	r.spans = append(r.spans, span)
+	r.current = Span{}
+}
+
+// Record records a phase that started at start and ends now, labeled with
+// the current step if any.
+func (r *Recorder) Record(phase string, start time.Time, size int64) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	current := r.current
+	r.Unlock()
+	r.RecordStep(phase, current.Stage, current.Step, current.Directive, start, size)
+}
+
+// RecordStep records a phase of a step that started at start and ends now,
+// for phases that run outside of the step, like cache pulls.
+func (r *Recorder) RecordStep(
+	phase, stage string, step int, directive string, start time.Time, size int64) {
+
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.spans = append(r.spans, Span{
+		Phase:     phase,
+		Stage:     stage,
+		Step:      step,
+		Directive: strings.Join(strings.Fields(directive), " "),
+		Start:     start,
+		Duration:  time.Since(start),
+		Size:      size,
+	})
+}
+
+// Spans returns the recorded spans, in the order they ended.
+func (r *Recorder) Spans() []Span {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	return append([]Span{}, r.spans...)
+}
+
+// stepRow is a line of the table, with the durations of the phases of a step.
+type stepRow struct {
+	stage     string
+	step      int
+	directive string
+	durations map[string]time.Duration
+	size      int64
+}
+
+// WriteTable writes a human readable report: the build phases that aren't
+// part of steps, then a line per step.
+func (r *Recorder) WriteTable(w io.Writer) error {
+	if r == nil {
+		return nil
+	}
+	spans := r.Spans()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	global := make(map[string]time.Duration)
+	var globalPhases []string
+	var rows []*stepRow
+	rowsByStep := make(map[string]*stepRow)
+	for _, span := range spans {
+		if span.Step == 0 {
+			if _, ok := global[span.Phase]; !ok {
+				globalPhases = append(globalPhases, span.Phase)
+			}
+			global[span.Phase] += span.Duration
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", span.Stage, span.Step)
+		row, ok := rowsByStep[key]
+		if !ok {
+			row = &stepRow{
+				stage:     span.Stage,
+				step:      span.Step,
+				directive: span.Directive,
+				durations: make(map[string]time.Duration),
+			}
+			rowsByStep[key] = row
+			rows = append(rows, row)
+		}
+		row.durations[span.Phase] += span.Duration
+		if span.Phase == PhaseCommit || span.Phase == PhasePull {
+			row.size += span.Size
+		}
+	}
+	// Rows are added when their first span ends, which is the order steps
+	// ran in, except for cache pulls that happen before the stage runs.
+	sortRows(rows)
+
+	fmt.Fprintln(tw, "PHASE\tDURATION")
+	for _, phase := range globalPhases {
+		fmt.Fprintf(tw, "%s\t%s\n", phase, formatDuration(global[phase]))
+	}
+	fmt.Fprintf(tw, "total\t%s\n", formatDuration(time.Since(r.start)))
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "STAGE\tSTEP\tDIRECTIVE\tTOTAL\tCACHE PULL\tPULL\tEXEC\tSCAN\tCOMMIT\tSIZE")
+	for _, row := range rows {
+		directive := row.directive
+		if len(directive) > 40 {
+			directive = directive[:37] + "..."
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			row.stage, row.step, directive,
+			formatDuration(row.durations[PhaseStep]),
+			formatDuration(row.durations[PhaseCachePull]),
+			formatDuration(row.durations[PhasePull]),
+			formatDuration(row.durations[PhaseExec]),
+			formatDuration(row.durations[PhaseScan]),
+			formatDuration(row.durations[PhaseCommit]),
+			formatSize(row.size))
+	}
+	return tw.Flush()
+}
+
+// sortRows sorts rows by step, keeping the stages in the order of their first
+// row.
+func sortRows(rows []*stepRow) {
+	stageOrder := make(map[string]int)
+	for _, row := range rows {
+		if _, ok := stageOrder[row.stage]; !ok {
+			stageOrder[row.stage] = len(stageOrder)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].stage != rows[j].stage {
+			return stageOrder[rows[i].stage] < stageOrder[rows[j].stage]
+		}
+		return rows[i].step < rows[j].step
+	})
+}
+
+// formatDuration formats a duration for the table, or "-" if it's 0.
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	} else if d < time.Millisecond {
+		return "<1ms"
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+// formatSize formats a size for the table, or "-" if it's 0.
+func formatSize(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return storage.FormatSize(n)
+}
+
+// jsonSpan is the JSON encoding of a Span, with times in seconds since the
+// start of the build.
+type jsonSpan struct {
+	Phase     string  `json:"phase"`
+	Stage     string  `json:"stage,omitempty"`
+	Step      int     `json:"step,omitempty"`
+	Directive string  `json:"directive,omitempty"`
+	Start     float64 `json:"start"`
+	Duration  float64 `json:"duration"`
+	Size      int64   `json:"size,omitempty"`
+	Cache     string  `json:"cache,omitempty"`
+	Retries   int     `json:"retries,omitempty"`
+}
+
+// WriteJSON writes the spans as a JSON object.
+func (r *Recorder) WriteJSON(w io.Writer) error {
+	if r == nil {
+		return nil
+	}
+	report := struct {
+		Duration float64    `json:"duration"`
+		Spans    []jsonSpan `json:"spans"`
+	}{Duration: time.Since(r.start).Seconds(), Spans: []jsonSpan{}}
+	for _, span := range r.Spans() {
+		report.Spans = append(report.Spans, jsonSpan{
+			Phase:     span.Phase,
+			Stage:     span.Stage,
+			Step:      span.Step,
+			Directive: span.Directive,
+			Start:     span.Start.Sub(r.start).Seconds(),
+			Duration:  span.Duration.Seconds(),
+			Size:      span.Size,
+			Cache:     span.Cache,
+			Retries:   span.Retries,
+		})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// traceEvent is a complete event of the Chrome trace event format, which
+// chrome://tracing and Perfetto can display.
+type traceEvent struct {
+	Name      string                 `json:"name"`
+	Category  string                 `json:"cat"`
+	Phase     string                 `json:"ph"`
+	Timestamp int64                  `json:"ts"`
+	Duration  int64                  `json:"dur"`
+	PID       int                    `json:"pid"`
+	TID       int                    `json:"tid"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+}
+
+// WriteTrace writes the spans in the Chrome trace event format. Spans nest
+// by time, so the phases of a step show under it.
+func (r *Recorder) WriteTrace(w io.Writer) error {
+	if r == nil {
+		return nil
+	}
+	events := []traceEvent{}
+	for _, span := range r.Spans() {
+		name := span.Phase
+		args := make(map[string]interface{})
+		if span.Step != 0 {
+			args["stage"], args["step"] = span.Stage, span.Step
+			if span.Phase == PhaseStep {
+				name = fmt.Sprintf("%s %d: %s", span.Stage, span.Step, span.Directive)
+			}
+		}
+		if span.Size != 0 {
+			args["size"] = span.Size
+		}
+		if span.Retries != 0 {
+			args["retries"] = span.Retries
+		}
+		events = append(events, traceEvent{
+			Name:      name,
+			Category:  span.Phase,
+			Phase:     "X",
+			Timestamp: span.Start.Sub(r.start).Nanoseconds() / 1000,
+			Duration:  span.Duration.Nanoseconds() / 1000,
+			PID:       1,
+			TID:       1,
+			Args:      args,
+		})
+	}
+	return json.NewEncoder(w).Encode(map[string]interface{}{"traceEvents": events})
+}
@@ -0,0 +1,100 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	require := require.New(t)
+
+	r := NewRecorder()
+	r.Record(PhaseParse, time.Now().Add(-time.Second), 0)
+	r.RecordStep(PhaseCachePull, "0", 2, "RUN  make (1234)", time.Now(), 0)
+	r.StartStep("0", 1, "FROM alpine (abcd)")
+	r.Record(PhasePull, time.Now().Add(-2*time.Second), 0)
+	r.EndStep()
+	r.StartStep("0", 2, "RUN  make (1234)")
+	r.SetStepCache("miss")
+	r.Record(PhaseExec, time.Now().Add(-3*time.Second), 0)
+	r.Record(PhaseCommit, time.Now(), 2048)
+	r.EndStep()
+	r.Record(PhasePush, time.Now(), 0)
+
+	spans := r.Spans()
+	require.Len(spans, 8)
+	require.Equal(PhasePull, spans[2].Phase)
+	require.Equal(1, spans[2].Step)
+	require.Equal("RUN make (1234)", spans[4].Directive)
+	require.Equal(0, spans[7].Step)
+	require.Equal("", spans[3].Cache)
+	require.Equal("miss", spans[6].Cache)
+
+	var table bytes.Buffer
+	require.NoError(r.WriteTable(&table))
+	lines := strings.Split(table.String(), "\n")
+	require.True(strings.HasPrefix(lines[1], "parse "))
+	require.True(strings.HasPrefix(lines[2], "push "))
+	require.Contains(lines[6], "FROM alpine (abcd)")
+	require.Contains(lines[7], "RUN make (1234)")
+	require.Contains(lines[7], "3s")
+	require.Contains(lines[7], "2.0KB")
+
+	var report struct {
+		Spans []struct {
+			Phase string  `json:"phase"`
+			Step  int     `json:"step"`
+			Size  int64   `json:"size"`
+			Start float64 `json:"start"`
+		} `json:"spans"`
+	}
+	var out bytes.Buffer
+	require.NoError(r.WriteJSON(&out))
+	require.NoError(json.Unmarshal(out.Bytes(), &report))
+	require.Len(report.Spans, 8)
+	require.Equal(int64(2048), report.Spans[5].Size)
+
+	var trace struct {
+		TraceEvents []struct {
+			Name  string `json:"name"`
+			Phase string `json:"ph"`
+		} `json:"traceEvents"`
+	}
+	out.Reset()
+	require.NoError(r.WriteTrace(&out))
+	require.NoError(json.Unmarshal(out.Bytes(), &trace))
+	require.Len(trace.TraceEvents, 8)
+	require.Equal("0 1: FROM alpine (abcd)", trace.TraceEvents[3].Name)
+	require.Equal("X", trace.TraceEvents[3].Phase)
+}
+
+func TestNilRecorder(t *testing.T) {
+	require := require.New(t)
+
+	var r *Recorder
+	r.StartStep("0", 1, "FROM alpine")
+	r.SetStepCache("hit")
+	r.Record(PhaseExec, time.Now(), 0)
+	r.EndStep()
+	require.Empty(r.Spans())
+	require.NoError(r.WriteTable(&bytes.Buffer{}))
+}
@@ -0,0 +1,201 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package progress writes the progress of a build in the JSON status format
+// of BuildKit, as printed by 'docker buildx build --progress=rawjson', so UIs
+// that render BuildKit builds can render makisu builds.
+package progress
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Streams of logs.
+const (
+	StreamStdout = 1
+	StreamStderr = 2
+)
+
+// _stepSuffix matches the commit marker and the cache ID at the end of the
+// string of a step, which aren't part of its name.
+var _stepSuffix = regexp.MustCompile(`\s*(#!COMMIT)?\s*\([0-9a-f]*\)$`)
+
+// Vertex is a node of the build graph: a step, or a phase of the build like
+// a push.
+type Vertex struct {
+	Digest    string     `json:"digest"`
+	Inputs    []string   `json:"inputs,omitempty"`
+	Name      string     `json:"name"`
+	Cached    bool       `json:"cached,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Completed *time.Time `json:"completed,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Log is output of a vertex. Msg is encoded in base64 in JSON, like BuildKit
+// does.
+type Log struct {
+	Vertex    string    `json:"vertex"`
+	Stream    int       `json:"stream"`
+	Timestamp time.Time `json:"timestamp"`
+	Msg       []byte    `json:"msg"`
+}
+
+// Status is a status update, written as a JSON line.
+type Status struct {
+	Vertexes []*Vertex `json:"vertexes,omitempty"`
+	Logs     []*Log    `json:"logs,omitempty"`
+}
+
+// Writer writes the progress of a build to w. Steps run one at a time, and
+// logs are attributed to the current step. All methods are noops on a nil
+// Writer.
+type Writer struct {
+	sync.Mutex
+
+	encoder  *json.Encoder
+	vertexes map[string]*Vertex
+	// last is the digest of the last step of each stage, the input of the
+	// next one.
+	last    map[string]string
+	current string
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		encoder:  json.NewEncoder(w),
+		vertexes: make(map[string]*Vertex),
+		last:     make(map[string]string),
+	}
+}
+
+// StartStep starts the vertex of a step, named like BuildKit names them,
+// e.g. "[builder 2/5] RUN make". Its input is the previous step of the stage.
+func (w *Writer) StartStep(stage string, step, steps int, directive string) {
+	if w == nil {
+		return
+	}
+	directive = strings.Join(strings.Fields(_stepSuffix.ReplaceAllString(directive, "")), " ")
+	name := fmt.Sprintf("[%s %d/%d] %s", stage, step, steps, directive)
+	digest := vertexDigest(fmt.Sprintf("%s/%d/%s", stage, step, directive))
+
+	w.Lock()
+	defer w.Unlock()
+	var inputs []string
+	if last, ok := w.last[stage]; ok {
+		inputs = []string{last}
+	}
+	w.last[stage] = digest
+	w.current = digest
+	w.start(digest, name, inputs)
+}
+
+// EndStep completes the vertex of the current step. Steps found in the cache
+// are marked as cached.
+func (w *Writer) EndStep(cached bool, err error) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.complete(w.current, cached, err)
+	w.current = ""
+}
+
+// Start starts a vertex that isn't a step, like a push.
+func (w *Writer) Start(name string) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.start(vertexDigest(name), name, nil)
+}
+
+// Complete completes a vertex started with Start.
+func (w *Writer) Complete(name string, err error) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.complete(vertexDigest(name), false, err)
+}
+
+// Stream returns a writer of the logs of the current step to stream.
+func (w *Writer) Stream(stream int) io.Writer {
+	return logWriter{w, stream}
+}
+
+func (w *Writer) start(digest, name string, inputs []string) {
+	now := time.Now().UTC()
+	v := &Vertex{Digest: digest, Inputs: inputs, Name: name, Started: &now}
+	w.vertexes[digest] = v
+	w.write(&Status{Vertexes: []*Vertex{v}})
+}
+
+func (w *Writer) complete(digest string, cached bool, err error) {
+	v, ok := w.vertexes[digest]
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	v.Completed, v.Cached = &now, cached
+	if err != nil {
+		v.Error = err.Error()
+	}
+	w.write(&Status{Vertexes: []*Vertex{v}})
+	delete(w.vertexes, digest)
+}
+
+func (w *Writer) write(status *Status) {
+	// Progress is best effort, and a closed output must not fail the build.
+	w.encoder.Encode(status)
+}
+
+// logWriter writes logs of the current step.
+type logWriter struct {
+	w      *Writer
+	stream int
+}
+
+func (lw logWriter) Write(p []byte) (int, error) {
+	if lw.w == nil {
+		return len(p), nil
+	}
+	lw.w.Lock()
+	defer lw.w.Unlock()
+	if lw.w.current != "" {
+		lw.w.write(&Status{Logs: []*Log{{
+			Vertex:    lw.w.current,
+			Stream:    lw.stream,
+			Timestamp: time.Now().UTC(),
+			Msg:       append([]byte{}, p...),
+		}}})
+	}
+	return len(p), nil
+}
+
+// vertexDigest returns a digest identifying a vertex.
+func vertexDigest(key string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(key)))
+}
@@ -0,0 +1,90 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readStatuses(t *testing.T, b []byte) []*Status {
+	var statuses []*Status
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		var status Status
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &status))
+		statuses = append(statuses, &status)
+	}
+	return statuses
+}
+
+func TestWriter(t *testing.T) {
+	require := require.New(t)
+
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.StartStep("builder", 1, 2, "FROM alpine  (abcd)")
+	w.EndStep(true, nil)
+	w.StartStep("builder", 2, 2, "RUN  make #!COMMIT (1234)")
+	fmt.Fprint(w.Stream(StreamStdout), "building\n")
+	fmt.Fprint(w.Stream(StreamStderr), "failed\n")
+	w.EndStep(false, errors.New("exit 2"))
+	fmt.Fprint(w.Stream(StreamStdout), "dropped\n")
+	w.Start("pushing registry.example.com/app:v1")
+	w.Complete("pushing registry.example.com/app:v1", nil)
+
+	statuses := readStatuses(t, b.Bytes())
+	require.Len(statuses, 8)
+
+	from, run := statuses[0].Vertexes[0], statuses[2].Vertexes[0]
+	require.Equal("[builder 1/2] FROM alpine", from.Name)
+	require.NotNil(from.Started)
+	require.Nil(from.Completed)
+	require.True(statuses[1].Vertexes[0].Cached)
+	require.NotNil(statuses[1].Vertexes[0].Completed)
+
+	require.Equal("[builder 2/2] RUN make", run.Name)
+	require.Equal([]string{from.Digest}, run.Inputs)
+
+	require.Equal(run.Digest, statuses[3].Logs[0].Vertex)
+	require.Equal(StreamStdout, statuses[3].Logs[0].Stream)
+	require.Equal("building\n", string(statuses[3].Logs[0].Msg))
+	require.Equal(StreamStderr, statuses[4].Logs[0].Stream)
+
+	require.Equal(run.Digest, statuses[5].Vertexes[0].Digest)
+	require.False(statuses[5].Vertexes[0].Cached)
+	require.Equal("exit 2", statuses[5].Vertexes[0].Error)
+
+	require.Equal("pushing registry.example.com/app:v1", statuses[6].Vertexes[0].Name)
+	require.NotNil(statuses[7].Vertexes[0].Completed)
+
+	// Logs are base64 in JSON, like BuildKit's.
+	require.Contains(b.String(), `"msg":"YnVpbGRpbmcK"`)
+}
+
+func TestNilWriter(t *testing.T) {
+	var w *Writer
+	w.StartStep("0", 1, 1, "FROM alpine")
+	fmt.Fprint(w.Stream(StreamStdout), "output\n")
+	w.EndStep(false, nil)
+	w.Start("push")
+	w.Complete("push", nil)
+}
@@ -0,0 +1,150 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redact masks secret values, like tokens passed as build args, in
+// the logs, reports and image history written by makisu.
+package redact
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Mask replaces secret values.
+const Mask = "****"
+
+// MinLength is the length of the shortest value masked. Shorter values would
+// mask unrelated text, and are too short to be secrets anyway.
+const MinLength = 4
+
+var (
+	mu     sync.RWMutex
+	values []string
+)
+
+// Add adds values to mask. Values shorter than MinLength are ignored.
+func Add(secrets ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, value := range secrets {
+		if len(value) < MinLength {
+			continue
+		}
+		values = append(values, value)
+	}
+	// Longer values first, so values containing others are masked entirely.
+	sort.SliceStable(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+}
+
+// Reset forgets the values added.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	values = nil
+}
+
+// String returns s with the values added masked.
+func String(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, value := range values {
+		if strings.Contains(s, value) {
+			s = strings.Replace(s, value, Mask, -1)
+		}
+	}
+	return s
+}
+
+// Strings returns a copy of strs with the values added masked.
+func Strings(strs []string) []string {
+	if strs == nil {
+		return nil
+	}
+	redacted := make([]string, len(strs))
+	for i, s := range strs {
+		redacted[i] = String(s)
+	}
+	return redacted
+}
+
+// Writer returns a writer masking the values added in what is written to w.
+// Values are only masked within a write, so output should be written line by
+// line.
+func Writer(w io.Writer) io.Writer {
+	return &writer{w}
+}
+
+type writer struct {
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Core returns a zap core masking the values added in the messages and string
+// fields of the entries it writes to core.
+func Core(core zapcore.Core) zapcore.Core {
+	return &redactCore{core}
+}
+
+type redactCore struct {
+	zapcore.Core
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{c.Core.With(redactFields(fields))}
+}
+
+func (c *redactCore) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return ce.AddCore(entry, c)
+	}
+	return ce
+}
+
+func (c *redactCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = String(entry.Message)
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case zapcore.StringType:
+			f.String = String(f.String)
+		case zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok {
+				f.Interface = errors.New(String(err.Error()))
+			}
+		case zapcore.StringerType:
+			if s, ok := f.Interface.(interface{ String() string }); ok {
+				f.Type, f.String, f.Interface = zapcore.StringType, String(s.String()), nil
+			}
+		}
+		redacted[i] = f
+	}
+	return redacted
+}
@@ -0,0 +1,73 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestString(t *testing.T) {
+	require := require.New(t)
+	defer Reset()
+
+	Add("s3cr3t-token", "abc", "", "s3cr3t")
+	require.Equal("curl -H 'token: ****' ****", String("curl -H 'token: s3cr3t-token' s3cr3t"))
+	require.Equal("abc", String("abc"))
+	require.Equal([]string{"****", "ok"}, Strings([]string{"s3cr3t", "ok"}))
+	require.Nil(Strings(nil))
+
+	Reset()
+	require.Equal("s3cr3t", String("s3cr3t"))
+}
+
+func TestWriter(t *testing.T) {
+	require := require.New(t)
+	defer Reset()
+
+	Add("s3cr3t")
+	var b bytes.Buffer
+	n, err := Writer(&b).Write([]byte("token=s3cr3t\n"))
+	require.NoError(err)
+	require.Equal(len("token=s3cr3t\n"), n)
+	require.Equal("token=****\n", b.String())
+}
+
+func TestCore(t *testing.T) {
+	require := require.New(t)
+	defer Reset()
+
+	Add("s3cr3t")
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := zap.New(core, zap.WrapCore(Core)).Sugar()
+	logger.With("arg", "s3cr3t").Infow("run echo s3cr3t",
+		"error", errors.New("failed: s3cr3t"), "count", 1)
+	logger.Debugf("debug s3cr3t")
+
+	entries := logs.AllUntimed()
+	require.Len(entries, 1)
+	require.Equal("run echo ****", entries[0].Message)
+	require.Equal(map[string]interface{}{
+		"arg":   "****",
+		"error": "failed: ****",
+		"count": int64(1),
+	}, entries[0].ContextMap())
+}
@@ -20,10 +20,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -32,11 +34,29 @@ import (
 	"github.com/uber/makisu/lib/concurrency"
 	"github.com/uber/makisu/lib/docker/image"
 	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/metrics"
+	"github.com/uber/makisu/lib/platform"
 	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/httputil"
 )
 
+// _pullManifestTypes are the manifest media types accepted when pulling
+// images, including the lists of multi-platform images.
+var _pullManifestTypes = strings.Join([]string{
+	image.MediaTypeManifest,
+	image.MediaTypeOCIManifest,
+	image.MediaTypeManifestList,
+	image.MediaTypeOCIIndex,
+}, ", ")
+
+// _pullImageManifestTypes are the media types of the manifests of single
+// images.
+var _pullImageManifestTypes = strings.Join([]string{
+	image.MediaTypeManifest,
+	image.MediaTypeOCIManifest,
+}, ", ")
+
 const (
 	baseManifestQuery = "https://%s/v2/%s/manifests/%s"
 	baseLayerQuery    = "https://%s/v2/%s/blobs/%s"
@@ -67,6 +87,9 @@ type DockerRegistryClient struct {
 	registry   string
 	repository string
 
+	// platform is the platform whose manifest is pulled from manifest lists.
+	platform platform.Platform
+
 	// TODO: there must be a better way to test this.
 	client *http.Client
 }
@@ -101,10 +124,18 @@ func newClient(store *storage.ImageStore, registry, repository string, client *h
 		registry:   registry,
 		repository: repository,
 		store:      store,
+		platform:   platform.Default(),
 		client:     client,
 	}
 }
 
+// WithPlatform makes a copy of the client that pulls the manifests of the
+// given platform from manifest lists.
+func (c DockerRegistryClient) WithPlatform(p platform.Platform) *DockerRegistryClient {
+	c.platform = p
+	return &c
+}
+
 // Pull tries to pull an image from its docker registry.
 // If the pull succeeded, it would store the image in the ImageStore of the client, and returns the
 // distribution manifest.
@@ -121,8 +152,9 @@ func (c DockerRegistryClient) Pull(tag string) (*image.DistributionManifest, err
 	multiError := utils.NewMultiErrors()
 	workers := concurrency.NewWorkerPool(c.config.Concurrency)
 	layerSet := make(map[string]interface{})
-	for _, layer := range manifest.GetLayerDigests() {
-		l := layer
+	for _, layer := range manifest.Layers {
+		l := layer.Digest
+		size := layer.Size
 		if _, ok := layerSet[l.Hex()]; ok {
 			// Duplicate layer.
 			continue
@@ -130,7 +162,7 @@ func (c DockerRegistryClient) Pull(tag string) (*image.DistributionManifest, err
 			layerSet[l.Hex()] = struct{}{}
 		}
 		workers.Do(func() {
-			if _, err := c.PullLayer(l); err != nil {
+			if _, err := c.pullLayerHelper(l, size, false); err != nil {
 				multiError.Add(fmt.Errorf("pull layer %s: %s", l, err))
 				workers.Stop()
 				return
@@ -139,7 +171,7 @@ func (c DockerRegistryClient) Pull(tag string) (*image.DistributionManifest, err
 	}
 	l := manifest.GetConfigDigest()
 	workers.Do(func() {
-		if _, err := c.PullLayer(l); err != nil {
+		if _, err := c.pullLayerHelper(l, manifest.Config.Size, true); err != nil {
 			multiError.Add(fmt.Errorf("pull image config %s: %s", l, err))
 			workers.Stop()
 			return
@@ -171,7 +203,55 @@ func (c DockerRegistryClient) Push(tag string) error {
 	if err != nil {
 		return fmt.Errorf("load manifest: %s", err)
 	}
+	if err := c.pushBlobs(manifest); err != nil {
+		return err
+	}
+
+	if err := c.PushManifest(tag, manifest); err != nil {
+		return fmt.Errorf("push manifest: %s", err)
+	}
+	log.Infow(fmt.Sprintf("* Pushed image %s", name), "duration", time.Since(starttime))
+	return nil
+}
+
+// PushIndex pushes an image like Push, but its manifest is only referenced by
+// digest, from an OCI index with the given annotations pushed as the tag. It
+// returns the digest of the index.
+func (c DockerRegistryClient) PushIndex(
+	tag string, annotations map[string]string) (image.Digest, error) {
 
+	name := image.NewImageName(c.registry, c.repository, tag)
+	log.Infof("* Started pushing image %s with an index", name)
+	starttime := time.Now()
+	manifest, err := c.loadManifest(tag)
+	if err != nil {
+		return "", fmt.Errorf("load manifest: %s", err)
+	}
+	config, err := c.loadImageConfig(manifest.Config.Digest)
+	if err != nil {
+		return "", fmt.Errorf("load image config: %s", err)
+	}
+	if err := c.pushBlobs(manifest); err != nil {
+		return "", err
+	}
+
+	manifestDescriptor, err := c.pushPayload(manifest, manifest.MediaType, "")
+	if err != nil {
+		return "", fmt.Errorf("push manifest: %s", err)
+	}
+	index := image.NewOCIIndexOf(manifestDescriptor, config.Platform())
+	index.Annotations = annotations
+	indexDescriptor, err := c.pushPayload(index, image.MediaTypeOCIIndex, tag)
+	if err != nil {
+		return "", fmt.Errorf("push index: %s", err)
+	}
+	log.Infow(fmt.Sprintf("* Pushed image %s", name),
+		"duration", time.Since(starttime), "index", indexDescriptor.Digest)
+	return indexDescriptor.Digest, nil
+}
+
+// pushBlobs pushes the layers and config of an image.
+func (c DockerRegistryClient) pushBlobs(manifest *image.DistributionManifest) error {
 	multiError := utils.NewMultiErrors()
 	workers := concurrency.NewWorkerPool(c.config.Concurrency)
 	layerSet := make(map[string]interface{})
@@ -200,26 +280,51 @@ func (c DockerRegistryClient) Push(tag string) error {
 		}
 	})
 	workers.Wait()
-	if err := multiError.Collect(); err != nil {
-		return err
-	}
-
-	if err := c.PushManifest(tag, manifest); err != nil {
-		return fmt.Errorf("push manifest: %s", err)
-	}
-	log.Infow(fmt.Sprintf("* Pushed image %s", name), "duration", time.Since(starttime))
-	return nil
+	return multiError.Collect()
 }
 
 // PullManifest pulls docker image manifest from the docker registry.
-// It does not save the manifest to the store.
+// It does not save the manifest to the store. If the tag is a manifest list
+// or OCI index, it pulls the manifest of the platform of the client.
 func (c DockerRegistryClient) PullManifest(tag string) (*image.DistributionManifest, error) {
+	mediaType, body, err := c.fetchManifest(tag, _pullManifestTypes)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType == image.MediaTypeManifestList || mediaType == image.MediaTypeOCIIndex {
+		var index image.OCIIndex
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, fmt.Errorf("unmarshal manifest list: %s", err)
+		}
+		desc, err := index.SelectManifest(c.platform)
+		if err != nil {
+			return nil, fmt.Errorf("select manifest: %s", err)
+		}
+		log.Infof("* Selected manifest %s of platform %s", desc.Digest, desc.Platform)
+		mediaType, body, err = c.fetchManifest(string(desc.Digest), _pullImageManifestTypes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	manifest, _, err := image.UnmarshalDistributionManifest(mediaType, body)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal distribution manifest: %s", err)
+	}
+	return &manifest, nil
+}
+
+// fetchManifest pulls a manifest by tag or digest, accepting the given media
+// types, and returns its media type and content.
+func (c DockerRegistryClient) fetchManifest(reference, accept string) (string, []byte, error) {
 	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
 	if err != nil {
-		return nil, fmt.Errorf("get security opt: %s", err)
+		return "", nil, fmt.Errorf("get security opt: %s", err)
 	}
 
-	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, tag)
+	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, reference)
+	if _notFound.contains(URL) {
+		return "", nil, fmt.Errorf("manifest not found")
+	}
 	resp, err := httputil.Send(
 		"GET",
 		URL,
@@ -228,43 +333,63 @@ func (c DockerRegistryClient) PullManifest(tag string) (*image.DistributionManif
 		httputil.SendTimeout(c.config.Timeout),
 		c.config.sendRetry(),
 		httputil.SendAcceptedCodes(http.StatusOK, http.StatusNotFound, http.StatusBadRequest),
-		httputil.SendHeaders(map[string]string{"Accept": image.MediaTypeManifest}))
+		httputil.SendHeaders(map[string]string{"Accept": accept}))
 	if err != nil {
-		return nil, fmt.Errorf("http send error: %s", err)
+		return "", nil, fmt.Errorf("http send error: %s", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
-		return nil, fmt.Errorf("manifest not found")
+		_notFound.add(URL, c.config.NotFoundTTL)
+		return "", nil, fmt.Errorf("manifest not found")
 	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("bad pull manifest request resp code: %d", resp.StatusCode)
+		return "", nil, fmt.Errorf("bad pull manifest request resp code: %d", resp.StatusCode)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("read resp body: %s", err)
-	}
-	// Parse the manifest according to the content type.
-	ctHeader := resp.Header.Get("Content-Type")
-	manifest, _, err := image.UnmarshalDistributionManifest(ctHeader, body)
-	if err != nil {
-		return nil, fmt.Errorf("unmarshal distribution manifest: %s", err)
+		return "", nil, fmt.Errorf("read resp body: %s", err)
+	}
+	var mediaType string
+	if ctHeader := resp.Header.Get("Content-Type"); ctHeader != "" {
+		// Need to look up by the actual media type, not the raw contents of
+		// the header.
+		if mediaType, _, err = mime.ParseMediaType(ctHeader); err != nil {
+			return "", nil, fmt.Errorf("parse content type: %s", err)
+		}
 	}
-	return &manifest, nil
+	return mediaType, body, nil
 }
 
-// PushManifest pushes the manifest to the registry.
+// PushManifest pushes the manifest to the registry. It's encoded like in the
+// image store, so both have the same digest.
 func (c DockerRegistryClient) PushManifest(tag string, manifest *image.DistributionManifest) error {
-	payload, err := json.MarshalIndent(manifest, "", "   ")
+	_, err := c.pushPayload(manifest, manifest.MediaType, tag)
+	return err
+}
+
+// pushPayload pushes a manifest or index as the tag, or by digest if tag is
+// empty, and returns its descriptor.
+func (c DockerRegistryClient) pushPayload(
+	v interface{}, mediaType, tag string) (image.Descriptor, error) {
+
+	payload, err := json.Marshal(v)
 	if err != nil {
-		return fmt.Errorf("marshal manifest: %s", err)
+		return image.Descriptor{}, fmt.Errorf("marshal manifest: %s", err)
+	}
+	digest, err := image.NewDigester().FromBytes(payload)
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("digest manifest: %s", err)
+	}
+	if tag == "" {
+		tag = string(digest)
 	}
 	headers := map[string]string{
-		"Content-Type": manifest.MediaType,
+		"Content-Type": mediaType,
 		"Host":         c.registry,
 	}
 	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
 	if err != nil {
-		return fmt.Errorf("get security opt: %s", err)
+		return image.Descriptor{}, fmt.Errorf("get security opt: %s", err)
 	}
 
 	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, tag)
@@ -279,28 +404,58 @@ func (c DockerRegistryClient) PushManifest(tag string, manifest *image.Distribut
 		httputil.SendHeaders(headers),
 		httputil.SendBody(bytes.NewReader(payload)))
 	if err != nil {
-		return err
+		return image.Descriptor{}, err
 	}
 	defer resp.Body.Close()
-	return nil
+	_notFound.remove(URL)
+	return image.Descriptor{MediaType: mediaType, Size: int64(len(payload)), Digest: digest}, nil
 }
 
 // PullLayer pulls image layer from the registry, and verifies that the contents
 // of that layer match the digest of the manifest.
 // If the layer already exists in the imagestore, the download is skipped.
 func (c DockerRegistryClient) PullLayer(layerDigest image.Digest) (os.FileInfo, error) {
-	return c.pullLayerHelper(layerDigest, false)
+	return c.pullLayerHelper(layerDigest, 0, false)
 }
 
 // PullImageConfig pulls image config blob from the registry.
 // Same as PullLayer, with slightly different log message.
 func (c DockerRegistryClient) PullImageConfig(layerDigest image.Digest) (os.FileInfo, error) {
-	return c.pullLayerHelper(layerDigest, true)
+	return c.pullLayerHelper(layerDigest, 0, true)
 }
 
+// corruptBlobError is returned when a downloaded blob doesn't match the size
+// or digest it was pulled for.
+type corruptBlobError struct {
+	msg string
+}
+
+func (e corruptBlobError) Error() string {
+	return e.msg
+}
+
+// pullLayerHelper pulls a blob, and verifies it against its digest and, if
+// not 0, its size. Corrupt downloads are deleted, and pulled again up to
+// VerifyRetries times.
 func (c DockerRegistryClient) pullLayerHelper(
-	layerDigest image.Digest, isConfig bool) (os.FileInfo, error) {
+	layerDigest image.Digest, size int64, isConfig bool) (os.FileInfo, error) {
 
+	// Builds sharing the storage dir download each blob once: the others wait
+	// for it, and find it in store.
+	unlock, err := c.store.Layers.LockBlob(layerDigest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("lock layer: %s", err)
+	}
+	defer unlock()
+
+	// Blobs are only left in download state if they failed verification, by
+	// versions that didn't delete them. Verify them again instead of using
+	// them.
+	if _, err := c.store.Layers.GetDownloadFileStat(layerDigest.Hex()); err == nil {
+		if err := c.saveLayer(layerDigest, size); err != nil {
+			log.Warnf("* Found invalid blob %s in store, pulling it again: %s", layerDigest, err)
+		}
+	}
 	if info, err := c.store.Layers.GetDownloadOrCacheFileStat(layerDigest.Hex()); err == nil {
 		if isConfig {
 			log.Infof("* Skipped pulling existing image config %s:%s", c.repository, layerDigest)
@@ -320,45 +475,119 @@ func (c DockerRegistryClient) pullLayerHelper(
 		log.Infof("* Started pulling layer %s/%s:%s", c.registry, c.repository, layerDigest)
 	}
 
+	for attempt := 0; ; attempt++ {
+		err := c.downloadBlob(layerDigest, size, opt)
+		if err == nil {
+			break
+		}
+		if _, ok := err.(corruptBlobError); !ok {
+			return nil, err
+		}
+		if attempt >= c.config.VerifyRetries {
+			return nil, fmt.Errorf(
+				"blob pulled from %s failed verification %d times, last: %s",
+				c.registry, attempt+1, err)
+		}
+		log.Warnf("* Deleted corrupt blob %s pulled from %s, pulling it again: %s",
+			layerDigest, c.registry, err)
+	}
+
+	info, err := c.store.Layers.GetDownloadOrCacheFileStat(layerDigest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get layer stat: %s", err)
+	}
+	if isConfig {
+		log.Infof("* Finished pulling image config %s:%s", c.repository, layerDigest.Hex())
+	} else {
+		log.Infof("* Finished pulling layer %s:%s", c.repository, layerDigest.Hex())
+	}
+	return info, nil
+}
+
+// downloadBlob downloads a blob to the transfer store, and moves it to the
+// store once verified.
+func (c DockerRegistryClient) downloadBlob(
+	layerDigest image.Digest, size int64, opt httputil.SendOption) error {
+
+	// The content is downloaded to the transfer store, so that the download
+	// can be resumed by another process if this one is killed.
+	w, offset, err := c.store.Transfers.OpenPartialDownload(layerDigest.Hex())
+	if err != nil {
+		return fmt.Errorf("open partial download: %s", err)
+	}
+	defer w.Close()
+	if size > 0 && offset >= size {
+		// The process was killed after the download completed, but before
+		// it was moved: it's verified instead of resumed past its end.
+		log.Infof("* Found complete partial download of layer %s", layerDigest)
+		return c.finishDownload(w, layerDigest, size)
+	}
+
 	URL := fmt.Sprintf(baseLayerQuery, c.registry, c.repository, string(layerDigest))
-	resp, err := httputil.Send(
-		"GET",
-		URL,
+	options := []httputil.SendOption{
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
-		c.config.sendRetry())
-	if err != nil {
-		return nil, fmt.Errorf("send pull layer request %s: %s", URL, err)
+		c.config.sendRetry(),
+		httputil.SendAcceptedCodes(
+			http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable),
 	}
-	defer resp.Body.Close()
-
-	if err := c.store.Layers.CreateDownloadFile(layerDigest.Hex(), 0); err != nil {
-		return nil, fmt.Errorf("create layer file: %s", err)
+	if offset > 0 {
+		options = append(options, httputil.SendHeaders(map[string]string{
+			"Range": fmt.Sprintf("bytes=%d-", offset),
+		}))
 	}
-	w, err := c.store.Layers.GetDownloadFileReadWriter(layerDigest.Hex())
+	resp, err := httputil.Send("GET", URL, options...)
 	if err != nil {
-		return nil, fmt.Errorf("get layer file readwriter: %s", err)
+		return fmt.Errorf("send pull layer request %s: %s", URL, err)
 	}
-	defer w.Close()
+	defer resp.Body.Close()
 
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		return nil, fmt.Errorf("copy layer file: %s", err)
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The partial download is at least as long as the blob, whose size
+		// wasn't known. It's started over, without a range.
+		if offset == 0 {
+			return fmt.Errorf("send pull layer request %s: unexpected status %d", URL, resp.StatusCode)
+		}
+		log.Warnf("* Partial download of layer %s is past its end, pulling it again", layerDigest)
+		w.Close()
+		if err := c.store.Transfers.RemovePartialDownload(layerDigest.Hex()); err != nil {
+			return fmt.Errorf("remove partial download: %s", err)
+		}
+		return c.downloadBlob(layerDigest, size, opt)
+	} else if resp.StatusCode == http.StatusPartialContent {
+		log.Infof("* Resumed pulling layer %s at byte %d", layerDigest, offset)
+	} else if offset > 0 {
+		// The registry ignored the range, and sent the whole blob.
+		if err := w.Truncate(0); err != nil {
+			return fmt.Errorf("truncate partial download: %s", err)
+		}
 	}
-	if err := c.saveLayer(layerDigest); err != nil {
-		return nil, fmt.Errorf("save layer file: %s", err)
+	if err := storage.CheckFreeSpace(
+		c.store.SandboxDir, resp.ContentLength, "pull "+layerDigest.Hex()); err != nil {
+		return err
 	}
 
-	info, err := c.store.Layers.GetDownloadOrCacheFileStat(layerDigest.Hex())
+	n, err := io.Copy(w, resp.Body)
+	storage.AddWritten(storage.SpacePhasePull, n)
+	metrics.AddPulledBytes(n)
 	if err != nil {
-		return nil, fmt.Errorf("get layer stat: %s", err)
+		return fmt.Errorf("copy layer file: %s", err)
 	}
-	if isConfig {
-		log.Infof("* Finished pulling image config %s:%s", c.repository, layerDigest.Hex())
-	} else {
-		log.Infof("* Finished pulling layer %s:%s", c.repository, layerDigest.Hex())
+	return c.finishDownload(w, layerDigest, size)
+}
+
+// finishDownload moves the completed partial download w to the store, and
+// verifies it.
+func (c DockerRegistryClient) finishDownload(w *os.File, layerDigest image.Digest, size int64) error {
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("close layer file: %s", err)
 	}
-	return info, nil
+	if err := c.store.Layers.MoveFileToDownload(
+		layerDigest.Hex(), c.store.Transfers.PartialDownloadPath(layerDigest.Hex())); err != nil {
+		return fmt.Errorf("move partial download: %s", err)
+	}
+	return c.saveLayer(layerDigest, size)
 }
 
 // PushLayer pushes the image layer to the registry.
@@ -402,9 +631,21 @@ func (c DockerRegistryClient) pushLayerWithBackoff(layerDigest image.Digest, isC
 }
 
 func (c DockerRegistryClient) pushLayerHelper(layerDigest image.Digest, isConfig bool) error {
+	key := c.uploadKey(layerDigest)
+	unlock, waited, err := c.store.Transfers.LockUpload(key)
+	if err != nil {
+		return fmt.Errorf("lock upload %s: %s", layerDigest, err)
+	}
+	defer unlock()
+	if waited {
+		// Another build may have pushed the blob while this one waited for
+		// the lock, so the registry is asked again instead of the cache.
+		_notFound.remove(c.blobURL(layerDigest))
+	}
 	if found, err := c.layerExists(layerDigest); err != nil {
 		return fmt.Errorf("check layer exists: %s/%s (%s): %w", c.registry, c.repository, layerDigest, err)
 	} else if found {
+		c.removeUpload(key)
 		if isConfig {
 			log.Infof("* Skipped pushing existing image config %s:%s", c.repository, layerDigest)
 		} else {
@@ -412,9 +653,59 @@ func (c DockerRegistryClient) pushLayerHelper(layerDigest image.Digest, isConfig
 		}
 		return nil
 	}
+	URL, start, err := c.resumeUpload(key)
+	if err != nil {
+		log.Warnf("* Failed to resume pushing %s, restarting: %s", layerDigest, err)
+		c.removeUpload(key)
+	}
+	if URL == "" {
+		if URL, err = c.startUpload(); err != nil {
+			return err
+		}
+		if isConfig {
+			log.Infof("* Started pushing image config %s", layerDigest)
+		} else {
+			log.Infof("* Started pushing layer %s", layerDigest)
+		}
+	} else {
+		log.Infof("* Resumed pushing %s at byte %d", layerDigest, start)
+	}
+
+	URL, err = c.pushLayerContent(layerDigest, key, URL, start)
+	if err != nil {
+		if start > 0 {
+			// The next attempt starts over, in case the registry can't
+			// resume this upload.
+			c.removeUpload(key)
+		}
+		return fmt.Errorf("push layer content %s: %w", layerDigest, err)
+	}
+
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		return fmt.Errorf("failed to parse location: %s", err)
+	}
+	q := parsed.Query()
+	q.Add("digest", string(layerDigest))
+	parsed.RawQuery = q.Encode()
+	if err := c.commitLayer(parsed.String()); err != nil {
+		return fmt.Errorf("commit layer push %s: %w", layerDigest, err)
+	}
+	c.removeUpload(key)
+	_notFound.remove(c.blobURL(layerDigest))
+	if isConfig {
+		log.Infof("* Finished pushing image config %s", layerDigest)
+	} else {
+		log.Infof("* Finished pushing layer %s", layerDigest)
+	}
+	return nil
+}
+
+// startUpload starts a blob upload, and returns its location.
+func (c DockerRegistryClient) startUpload() (string, error) {
 	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
 	if err != nil {
-		return fmt.Errorf("get security opt: %s", err)
+		return "", fmt.Errorf("get security opt: %s", err)
 	}
 
 	URL := fmt.Sprintf(baseStartQuery, c.registry, c.repository)
@@ -428,41 +719,89 @@ func (c DockerRegistryClient) pushLayerHelper(layerDigest image.Digest, isConfig
 		httputil.SendAcceptedCodes(http.StatusAccepted),
 		httputil.SendHeaders(map[string]string{"Host": c.registry}))
 	if err != nil {
-		return fmt.Errorf("send start push layer request %s: %w", URL, err)
+		return "", fmt.Errorf("send start push layer request %s: %w", URL, err)
 	}
 	defer resp.Body.Close()
-	URL = resp.Header.Get("Location")
-	if URL == "" {
-		return fmt.Errorf("empty layer upload URL")
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("empty layer upload URL")
 	}
+	return location, nil
+}
 
-	if isConfig {
-		log.Infof("* Started pushing image config %s", layerDigest)
-	} else {
-		log.Infof("* Started pushing layer %s", layerDigest)
+// uploadKey returns the key of the upload state of a blob in the transfer
+// store.
+func (c DockerRegistryClient) uploadKey(digest image.Digest) string {
+	return fmt.Sprintf("%s/%s@%s", c.registry, c.repository, digest)
+}
+
+// resumeUpload returns the location of the upload saved under key, and the
+// number of bytes the registry received, or an empty location if there is no
+// upload to resume.
+func (c DockerRegistryClient) resumeUpload(key string) (string, int64, error) {
+	state, err := c.store.Transfers.GetUpload(key)
+	if err != nil {
+		return "", 0, fmt.Errorf("get upload state: %s", err)
+	} else if state == nil {
+		return "", 0, nil
+	}
+	location, end, err := c.uploadStatus(state.Location)
+	if err != nil {
+		return "", 0, err
+	} else if end == 0 {
+		return "", 0, fmt.Errorf("no content to resume")
 	}
+	return location, end + 1, nil
+}
 
-	URL, err = c.pushLayerContent(layerDigest, URL)
+// uploadStatus returns the current location of the upload at location, and
+// the inclusive end of the range of bytes the registry received. The range is
+// "0-0" both when nothing or one byte was received.
+func (c DockerRegistryClient) uploadStatus(location string) (string, int64, error) {
+	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
 	if err != nil {
-		return fmt.Errorf("push layer content %s: %w", layerDigest, err)
+		return "", 0, fmt.Errorf("get security opt: %s", err)
 	}
 
-	parsed, err := url.Parse(URL)
+	resp, err := httputil.Send(
+		"GET",
+		c.resolveLocation(location),
+		httputil.SendClient(c.client),
+		opt,
+		httputil.SendTimeout(c.config.Timeout),
+		c.config.sendRetry(),
+		httputil.SendAcceptedCodes(http.StatusNoContent),
+		httputil.SendHeaders(map[string]string{"Host": c.registry}))
 	if err != nil {
-		return fmt.Errorf("failed to parse location: %s", err)
+		return "", 0, fmt.Errorf("get upload status: %w", err)
 	}
-	q := parsed.Query()
-	q.Add("digest", string(layerDigest))
-	parsed.RawQuery = q.Encode()
-	if err := c.commitLayer(parsed.String()); err != nil {
-		return fmt.Errorf("commit layer push %s: %w", layerDigest, err)
+	defer resp.Body.Close()
+
+	var end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Range"), "0-%d", &end); err != nil {
+		return "", 0, fmt.Errorf("parse upload range %q: %s", resp.Header.Get("Range"), err)
 	}
-	if isConfig {
-		log.Infof("* Finished pushing image config %s", layerDigest)
-	} else {
-		log.Infof("* Finished pushing layer %s", layerDigest)
+	if newLocation := resp.Header.Get("Location"); newLocation != "" {
+		location = newLocation
 	}
-	return nil
+	return location, end, nil
+}
+
+// removeUpload removes the upload state saved under key. Failures are only
+// logged, since the state is checked against the registry before resuming.
+func (c DockerRegistryClient) removeUpload(key string) {
+	if err := c.store.Transfers.RemoveUpload(key); err != nil {
+		log.Warnf("Failed to remove upload state: %s", err)
+	}
+}
+
+// resolveLocation returns the URL of an upload location returned by the
+// registry, which can be either absolute or relative to the registry.
+func (c DockerRegistryClient) resolveLocation(location string) string {
+	if u, err := url.Parse(location); err == nil && u.IsAbs() {
+		return location
+	}
+	return fmt.Sprintf("https://%s%s", c.registry, location)
 }
 
 // manifestExists checks with the registry to see if an image is present and available for download.
@@ -473,6 +812,9 @@ func (c DockerRegistryClient) manifestExists(tag string) (bool, error) {
 	}
 
 	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, tag)
+	if _notFound.contains(URL) {
+		return false, nil
+	}
 	resp, err := httputil.Send(
 		"HEAD",
 		URL,
@@ -487,11 +829,17 @@ func (c DockerRegistryClient) manifestExists(tag string) (bool, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
+		_notFound.add(URL, c.config.NotFoundTTL)
 		return false, nil
 	}
 	return true, nil
 }
 
+// LayerExists checks with the registry to see if a layer exists.
+func (c DockerRegistryClient) LayerExists(digest image.Digest) (bool, error) {
+	return c.layerExists(digest)
+}
+
 // layerExists checks with the registry to see if a layer exists and is downloadable.
 func (c DockerRegistryClient) layerExists(digest image.Digest) (bool, error) {
 	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
@@ -499,7 +847,10 @@ func (c DockerRegistryClient) layerExists(digest image.Digest) (bool, error) {
 		return false, fmt.Errorf("get security opt: %s", err)
 	}
 
-	URL := fmt.Sprintf(baseLayerQuery, c.registry, c.repository, digest)
+	URL := c.blobURL(digest)
+	if _notFound.contains(URL) {
+		return false, nil
+	}
 	resp, err := httputil.Send(
 		"HEAD",
 		URL,
@@ -513,39 +864,96 @@ func (c DockerRegistryClient) layerExists(digest image.Digest) (bool, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusNotFound {
+		_notFound.add(URL, c.config.NotFoundTTL)
 		return false, nil
 	}
 	return true, nil
 }
 
-func (c DockerRegistryClient) pushLayerContent(digest image.Digest, location string) (string, error) {
+// blobURL returns the URL of the blob with the given digest.
+func (c DockerRegistryClient) blobURL(digest image.Digest) string {
+	return fmt.Sprintf(baseLayerQuery, c.registry, c.repository, digest)
+}
+
+// pushLayerContent pushes the layer from byte start, and saves the progress of
+// the upload under key after each chunk.
+func (c DockerRegistryClient) pushLayerContent(
+	digest image.Digest, key, location string, start int64) (string, error) {
+
 	info, err := c.store.Layers.GetStoreFileStat(digest.Hex())
 	if err != nil {
 		return "", fmt.Errorf("get layer file stat: %s", err)
 	}
 	size := info.Size()
+	if start > size {
+		return "", fmt.Errorf("upload offset %d is past layer size %d", start, size)
+	}
 	pushChunk := c.config.PushChunk
 	if pushChunk == -1 {
 		pushChunk = size
 	}
-	start, endInclusive := int64(0), utils.Min(pushChunk-1, size-1)
 
 	r, err := c.store.Layers.GetStoreFileReader(digest.Hex())
 	if err != nil {
 		return "", fmt.Errorf("get layer file reader: %s", err)
 	}
 	defer r.Close()
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return "", fmt.Errorf("seek layer file: %s", err)
+	}
 
+	var reauthorized bool
 	for start < size {
-		location, err = c.pushOneLayerChunk(location, start, endInclusive, r)
-		if err != nil {
+		endInclusive := utils.Min(start+pushChunk-1, size-1)
+		newLocation, err := c.pushOneLayerChunk(location, start, endInclusive, r)
+		if httputil.IsStatus(err, http.StatusUnauthorized) && !reauthorized {
+			// The token expired during a long upload. The transport gets a
+			// new one for the next request, so the upload resumes where the
+			// registry stopped receiving instead of starting over.
+			log.Infof("* Authorization expired while pushing %s, resuming upload", digest)
+			if location, start, err = c.resumeUnauthorizedUpload(location, size, r); err != nil {
+				return location, fmt.Errorf("resume upload after authorization expired: %w", err)
+			}
+			reauthorized = true
+			continue
+		} else if err != nil {
 			return location, fmt.Errorf("push layer chunk: %w", err)
 		}
-		start, endInclusive = endInclusive+1, utils.Min(start+pushChunk-1, size-1)
+		reauthorized = false
+		location = newLocation
+		start = endInclusive + 1
+		state := storage.UploadState{Location: location, Offset: start}
+		if err := c.store.Transfers.SaveUpload(key, state); err != nil {
+			log.Warnf("Failed to save upload state of %s: %s", digest, err)
+		}
 	}
 	return location, nil
 }
 
+// resumeUnauthorizedUpload returns the location and offset to resume the upload
+// at location from, after a chunk was rejected as unauthorized, and seeks r to
+// the offset.
+func (c DockerRegistryClient) resumeUnauthorizedUpload(
+	location string, size int64, r io.Seeker) (string, int64, error) {
+
+	location, end, err := c.uploadStatus(location)
+	if err != nil {
+		return location, 0, err
+	}
+	// A rejected first chunk leaves the range at "0-0".
+	start := end + 1
+	if end == 0 {
+		start = 0
+	}
+	if start > size {
+		return location, 0, fmt.Errorf("upload offset %d is past layer size %d", start, size)
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return location, 0, fmt.Errorf("seek layer file: %s", err)
+	}
+	return location, start, nil
+}
+
 func (c DockerRegistryClient) pushOneLayerChunk(location string, start, endIncluded int64, r io.Reader) (string, error) {
 	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
 	if err != nil {
@@ -562,7 +970,7 @@ func (c DockerRegistryClient) pushOneLayerChunk(location string, start, endInclu
 	}
 	resp, err := httputil.Send(
 		"PATCH",
-		c.registry + location,
+		c.resolveLocation(location),
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
@@ -577,6 +985,7 @@ func (c DockerRegistryClient) pushOneLayerChunk(location string, start, endInclu
 		return "", fmt.Errorf("send push chunk request: %w", err)
 	}
 	defer resp.Body.Close()
+	metrics.AddPushedBytes(chunckSize)
 
 	newLocation := resp.Header.Get("Location")
 	if newLocation == "" {
@@ -598,7 +1007,7 @@ func (c DockerRegistryClient) commitLayer(location string) error {
 	}
 	resp, err := httputil.Send(
 		"PUT",
-		c.registry + location,
+		c.resolveLocation(location),
 		httputil.SendClient(c.client),
 		opt,
 		httputil.SendTimeout(c.config.Timeout),
@@ -613,29 +1022,64 @@ func (c DockerRegistryClient) commitLayer(location string) error {
 	return nil
 }
 
-// saveLayer moves the layer from the download file to the permanent storage in store.
-func (c DockerRegistryClient) saveLayer(layerDigest image.Digest) error {
-	// Verify that the layers downloaded were correct.
+// saveLayer moves the layer from the download file to the permanent storage in
+// store, if it has the expected digest and size. Otherwise the download file is
+// deleted, and a corruptBlobError returned.
+func (c DockerRegistryClient) saveLayer(layerDigest image.Digest, size int64) error {
+	if err := c.verifyDownload(layerDigest, size); err != nil {
+		if _, ok := err.(corruptBlobError); ok {
+			if err := c.store.Layers.DeleteDownloadFile(layerDigest.Hex()); err != nil {
+				return fmt.Errorf("delete corrupt layer: %s", err)
+			}
+		}
+		return err
+	}
+
+	if err := c.store.Layers.MoveDownloadFileToStore(layerDigest.Hex()); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("commit layer to store: %s", err)
+	}
+	return nil
+}
+
+// verifyDownload checks the download file of a layer against its digest and,
+// if not 0, its size.
+func (c DockerRegistryClient) verifyDownload(layerDigest image.Digest, size int64) error {
 	r, err := c.store.Layers.GetDownloadFileReader(layerDigest.Hex())
 	if err != nil {
 		return fmt.Errorf("get layer file reader: %s", err)
 	}
 	defer r.Close()
+	if size > 0 {
+		info, err := c.store.Layers.GetDownloadFileStat(layerDigest.Hex())
+		if err != nil {
+			return fmt.Errorf("get layer stat: %s", err)
+		}
+		if info.Size() != size {
+			return corruptBlobError{fmt.Sprintf(
+				"layer size %d did not match the %d bytes of the manifest", info.Size(), size)}
+		}
+	}
 	if verified, err := layerDigest.Equals(r); err != nil {
 		return fmt.Errorf("verify layer: %s", err)
 	} else if !verified {
-		return fmt.Errorf("layer digest did not match")
-	}
-
-	if err := c.store.Layers.MoveDownloadFileToStore(layerDigest.Hex()); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("commit layer to store: %s", err)
+		return corruptBlobError{"layer digest did not match"}
 	}
 	return nil
 }
 
-// saveManifest saves given distribution manifest into local store.
+// saveManifest saves given distribution manifest into local store. The
+// manifest of a tag that moved to another image since it was saved is
+// replaced, so the store holds the image last pulled.
 func (c DockerRegistryClient) saveManifest(tag string, manifest *image.DistributionManifest) error {
-	if _, err := c.store.Manifests.GetDownloadOrCacheFileStat(c.repository, tag); err == nil {
+	if _, err := c.store.Manifests.GetStoreFileStat(c.repository, tag); err == nil {
+		stored, err := c.loadManifest(tag)
+		if err == nil && stored.Config.Digest == manifest.Config.Digest {
+			return nil
+		} else if err := c.store.Manifests.DeleteStoreFile(c.repository, tag); err != nil {
+			return fmt.Errorf("delete outdated manifest: %s", err)
+		}
+	} else if _, err := c.store.Manifests.GetDownloadOrCacheFileStat(c.repository, tag); err == nil {
+		// Being saved by another pull.
 		return nil
 	}
 	if err := c.store.Manifests.CreateDownloadFile(c.repository, tag, 0); err != nil {
@@ -660,6 +1104,20 @@ func (c DockerRegistryClient) saveManifest(tag string, manifest *image.Distribut
 }
 
 // loadManifest reads distribution manifest content from local manifest store.
+// loadImageConfig loads an image config from the image store.
+func (c DockerRegistryClient) loadImageConfig(digest image.Digest) (*image.Config, error) {
+	r, err := c.store.Layers.GetStoreFileReader(digest.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get image config file reader: %s", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read image config: %s", err)
+	}
+	return image.NewImageConfigFromJSON(b)
+}
+
 func (c DockerRegistryClient) loadManifest(tag string) (*image.DistributionManifest, error) {
 	r, err := c.store.Manifests.GetStoreFileReader(c.repository, tag)
 	if err != nil {
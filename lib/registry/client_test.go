@@ -16,14 +16,20 @@ package registry
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/uber/makisu/lib/context"
 	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/platform"
+	"github.com/uber/makisu/lib/storage"
 	"github.com/uber/makisu/lib/utils/testutil"
 
 	"github.com/stretchr/testify/require"
@@ -42,6 +48,51 @@ func TestPullManifest(t *testing.T) {
 	require.NoError(err)
 }
 
+func TestPullManifestList(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	transport := newMemRegistryTransport()
+	var descriptors []image.Descriptor
+	for _, p := range []string{"linux/amd64", "linux/arm/v6", "linux/arm64"} {
+		config := transport.addBlob("app", []byte(p))
+		digest := transport.addManifest("app", p, image.MediaTypeManifest, image.DistributionManifest{
+			SchemaVersion: 2,
+			MediaType:     image.MediaTypeManifest,
+			Config:        image.Descriptor{MediaType: image.MediaTypeConfig, Digest: config},
+		})
+		parsed, err := platform.Parse(p)
+		require.NoError(err)
+		descriptors = append(descriptors, image.Descriptor{
+			MediaType: image.MediaTypeManifest, Digest: digest, Platform: &parsed})
+	}
+	transport.addManifest("app", "v1", image.MediaTypeManifestList, image.OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifestList,
+		Manifests:     descriptors,
+	})
+	client := NewWithClient(ctx.ImageStore, "registry.example.com", "app", &http.Client{Transport: transport})
+	client.config.Security.TLS.Client.Disabled = true
+
+	for p, expected := range map[string]string{
+		"linux/arm64":  "linux/arm64",
+		"linux/arm/v7": "linux/arm/v6",
+		"linux/amd64":  "linux/amd64",
+	} {
+		parsed, err := platform.Parse(p)
+		require.NoError(err)
+		manifest, err := client.WithPlatform(parsed).PullManifest("v1")
+		require.NoError(err)
+		digest, _ := image.NewDigester().FromBytes([]byte(expected))
+		require.Equal(digest, manifest.Config.Digest)
+	}
+
+	_, err := client.WithPlatform(platform.Platform{OS: "linux", Architecture: "s390x"}).PullManifest("v1")
+	require.Error(err)
+	require.Contains(err.Error(), "no manifest for platform linux/s390x")
+}
+
 func TestPullImage(t *testing.T) {
 	require := require.New(t)
 	ctx, cleanup := context.BuildContextFixture()
@@ -109,6 +160,96 @@ func TestPullWithExistingLayerInCache(t *testing.T) {
 	require.NoError(err)
 }
 
+// corruptLayerTransport serves garbage for the first corrupt pulls of the
+// sample layer.
+type corruptLayerTransport struct {
+	http.RoundTripper
+	corrupt *int
+}
+
+func (t corruptLayerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method == "GET" && path.Base(r.URL.Path) == "sha256:"+testutil.SampleLayerTarDigest && *t.corrupt > 0 {
+		*t.corrupt--
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte("garbage"))),
+			Header:     make(http.Header),
+		}, nil
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func TestPullCorruptLayer(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpine(ctx)
+	require.NoError(err)
+	corrupt := 2
+	p.client = &http.Client{Transport: corruptLayerTransport{p.client.Transport, &corrupt}}
+
+	// Corrupt downloads are deleted and pulled again.
+	_, err = p.PullLayer(image.Digest("sha256:" + testutil.SampleLayerTarDigest))
+	require.NoError(err)
+	require.Equal(0, corrupt)
+	_, err = p.store.Layers.GetStoreFileStat(testutil.SampleLayerTarDigest)
+	require.NoError(err)
+	require.NoError(p.store.Layers.DeleteStoreFile(testutil.SampleLayerTarDigest))
+
+	// Past the retries, the pull fails and nothing is left in store.
+	corrupt = 3
+	_, err = p.PullLayer(image.Digest("sha256:" + testutil.SampleLayerTarDigest))
+	require.Error(err)
+	require.Contains(err.Error(), "from localhost:5055 failed verification 3 times")
+	_, err = p.store.Layers.GetDownloadOrCacheFileStat(testutil.SampleLayerTarDigest)
+	require.Error(err)
+}
+
+func TestPullLayerSizeMismatch(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpine(ctx)
+	require.NoError(err)
+	p.config.VerifyRetries = -1
+
+	_, err = p.pullLayerHelper(image.Digest("sha256:"+testutil.SampleLayerTarDigest), 1, false)
+	require.Error(err)
+	require.Contains(err.Error(), "did not match the 1 bytes of the manifest")
+	_, err = p.store.Layers.GetDownloadOrCacheFileStat(testutil.SampleLayerTarDigest)
+	require.Error(err)
+}
+
+func TestPullLayerWithCorruptDownloadLeft(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpine(ctx)
+	require.NoError(err)
+
+	// A corrupt blob left in download state is pulled again, not used.
+	require.NoError(ctx.ImageStore.Layers.CreateDownloadFile(testutil.SampleLayerTarDigest, 0))
+	w, err := ctx.ImageStore.Layers.GetDownloadFileReadWriter(testutil.SampleLayerTarDigest)
+	require.NoError(err)
+	_, err = w.Write([]byte("garbage"))
+	require.NoError(err)
+	w.Close()
+
+	_, err = p.PullLayer(image.Digest("sha256:" + testutil.SampleLayerTarDigest))
+	require.NoError(err)
+	_, err = p.store.Layers.GetDownloadFileStat(testutil.SampleLayerTarDigest)
+	require.Error(err)
+	r, err := p.store.Layers.GetStoreFileReader(testutil.SampleLayerTarDigest)
+	require.NoError(err)
+	defer r.Close()
+	verified, err := image.Digest("sha256:" + testutil.SampleLayerTarDigest).Equals(r)
+	require.NoError(err)
+	require.True(verified)
+}
+
 func TestManifestExists(t *testing.T) {
 	require := require.New(t)
 	ctx, cleanup := context.BuildContextFixture()
@@ -156,6 +297,61 @@ func TestPushImage(t *testing.T) {
 	require.NoError(p.Push(testutil.SampleImageTag))
 }
 
+// manifestRecorder accepts the manifests pushed through it, and records them
+// by reference.
+type manifestRecorder struct {
+	http.RoundTripper
+	manifests map[string][]byte
+}
+
+func (r *manifestRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "PUT" || !strings.Contains(req.URL.Path, "/manifests/") {
+		return r.RoundTripper.RoundTrip(req)
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.manifests[path.Base(req.URL.Path)] = b
+	return &http.Response{
+		StatusCode: http.StatusCreated,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Header:     make(http.Header),
+		Request:    req,
+	}, nil
+}
+
+func TestPushIndex(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	p, err := PushClientFixture(ctx)
+	require.NoError(err)
+	recorder := &manifestRecorder{p.client.Transport, make(map[string][]byte)}
+	p.client = &http.Client{Transport: recorder}
+
+	digest, err := p.PushIndex(testutil.SampleImageTag, map[string]string{"a": "b"})
+	require.NoError(err)
+	require.Len(recorder.manifests, 2)
+
+	indexData := recorder.manifests[testutil.SampleImageTag]
+	indexDigest, err := image.NewDigester().FromBytes(indexData)
+	require.NoError(err)
+	require.Equal(indexDigest, digest)
+	var index image.OCIIndex
+	require.NoError(json.Unmarshal(indexData, &index))
+	require.Equal(image.MediaTypeOCIIndex, index.MediaType)
+	require.Equal(map[string]string{"a": "b"}, index.Annotations)
+	require.Len(index.Manifests, 1)
+	require.NotNil(index.Manifests[0].Platform)
+	require.Equal("linux", index.Manifests[0].Platform.OS)
+
+	manifestData := recorder.manifests[string(index.Manifests[0].Digest)]
+	require.NotNil(manifestData)
+	require.Equal(int64(len(manifestData)), index.Manifests[0].Size)
+}
+
 func TestPushLayerRetry(t *testing.T) {
 	require := require.New(t)
 	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
@@ -191,3 +387,265 @@ func TestPushLayerNoRetry(t *testing.T) {
 	p.config.Retries = 1
 	require.EqualError(p.PushLayer(image.NewEmptyDigest()), "push layer content : get layer file stat: file does not exist")
 }
+
+func TestStartLayerUpload(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := PushClientFixture(ctx)
+	require.NoError(err)
+	upload, err := p.StartLayerUpload()
+	require.NoError(err)
+	_, err = upload.Write([]byte("layer content"))
+	require.NoError(err)
+	require.NoError(upload.Commit(image.Digest("sha256:" + testutil.SampleLayerTarDigest)))
+
+	p.config.PushChunk = -1
+	_, err = p.StartLayerUpload()
+	require.Error(err)
+}
+
+type recordingTransport struct {
+	http.RoundTripper
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, r)
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func TestPullLayerResumesPartialDownload(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpine(ctx)
+	require.NoError(err)
+	transport := &recordingTransport{RoundTripper: p.client.Transport}
+	p.client.Transport = transport
+
+	layerTarData, err := ioutil.ReadFile(path.Join(_testFileDirAlpine, "test_layer.tar"))
+	require.NoError(err)
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	partial := ctx.ImageStore.Transfers.PartialDownloadPath(digest.Hex())
+	require.NoError(ioutil.WriteFile(partial, layerTarData[:100], 0644))
+
+	_, err = p.PullLayer(digest)
+	require.NoError(err)
+	require.Len(transport.requests, 1)
+	require.Equal("bytes=100-", transport.requests[0].Header.Get("Range"))
+
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(layerTarData, content)
+	_, err = os.Stat(partial)
+	require.True(os.IsNotExist(err))
+}
+
+func TestPullLayerDiscardsCorruptPartialDownload(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpine(ctx)
+	require.NoError(err)
+
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	partial := ctx.ImageStore.Transfers.PartialDownloadPath(digest.Hex())
+	require.NoError(ioutil.WriteFile(partial, bytes.Repeat([]byte{'x'}, 100), 0644))
+
+	// The resumed download doesn't match the digest, and is pulled again
+	// from the start.
+	_, err = p.PullLayer(digest)
+	require.NoError(err)
+	_, err = os.Stat(partial)
+	require.True(os.IsNotExist(err))
+}
+
+func TestPullLayerVerifiesCompletePartialDownload(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	p, err := PullClientFixtureWithAlpine(ctx)
+	require.NoError(err)
+	transport := &recordingTransport{RoundTripper: p.client.Transport}
+	p.client.Transport = transport
+
+	layerTarData, err := ioutil.ReadFile(path.Join(_testFileDirAlpine, "test_layer.tar"))
+	require.NoError(err)
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	partial := ctx.ImageStore.Transfers.PartialDownloadPath(digest.Hex())
+
+	// With the size of the manifest, the complete download isn't requested
+	// again.
+	require.NoError(ioutil.WriteFile(partial, layerTarData, 0644))
+	_, err = p.pullLayerHelper(digest, int64(len(layerTarData)), false)
+	require.NoError(err)
+	require.Empty(transport.requests)
+	_, err = os.Stat(partial)
+	require.True(os.IsNotExist(err))
+
+	// Without it, the range is rejected by the registry, and the download
+	// started over.
+	require.NoError(ctx.ImageStore.Layers.DeleteStoreFile(digest.Hex()))
+	require.NoError(ioutil.WriteFile(partial, layerTarData, 0644))
+	_, err = p.PullLayer(digest)
+	require.NoError(err)
+	require.Len(transport.requests, 2)
+	require.Equal("", transport.requests[1].Header.Get("Range"))
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(layerTarData, content)
+}
+
+func TestPushLayerResumesUpload(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	name := image.MustParseName(fmt.Sprintf("localhost:5055/%s:%s", testutil.SampleImageRepoName, testutil.SampleImageTag))
+	upload := uploadRequest{name}
+	header := make(http.Header)
+	header.Set("Range", "0-99")
+	header.Set("Location", upload.getResumeLoc())
+	p, err := PushClientFixture(ctx, responseOverride{
+		Method: "GET",
+		Target: simpleRequest{upload.getResumeLoc()},
+		Response: &http.Response{
+			StatusCode: http.StatusNoContent,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+			Header:     header,
+		},
+	})
+	require.NoError(err)
+	transport := &recordingTransport{RoundTripper: p.client.Transport}
+	p.client.Transport = transport
+
+	key := p.uploadKey(digest)
+	require.NoError(ctx.ImageStore.Transfers.SaveUpload(key, storage.UploadState{
+		Location: upload.getResumeLoc(),
+		Offset:   100,
+	}))
+	require.NoError(p.PushLayer(digest))
+
+	var ranges []string
+	for _, r := range transport.requests {
+		require.NotEqual("POST", r.Method)
+		if r.Method == "PATCH" {
+			ranges = append(ranges, r.Header.Get("Content-Range"))
+		}
+	}
+	info, err := ctx.ImageStore.Layers.GetStoreFileStat(digest.Hex())
+	require.NoError(err)
+	require.Equal([]string{fmt.Sprintf("100-%d", info.Size()-1)}, ranges)
+
+	state, err := ctx.ImageStore.Transfers.GetUpload(key)
+	require.NoError(err)
+	require.Nil(state)
+}
+
+func TestPushLayerConcurrentBuilds(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	// The second build has its own store in the same storage dir, like
+	// another makisu process on the host.
+	other, err := storage.NewImageStore(ctx.ImageStore.RootDir)
+	require.NoError(err)
+	defer other.CleanupSandbox()
+
+	transport := newMemRegistryTransport()
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, store := range []*storage.ImageStore{ctx.ImageStore, other} {
+		wg.Add(1)
+		go func(i int, store *storage.ImageStore) {
+			defer wg.Done()
+			client := NewWithClient(store, "registry.example.com", "app", &http.Client{Transport: transport})
+			client.config.Security.TLS.Client.Disabled = true
+			errs[i] = client.PushLayer(digest)
+		}(i, store)
+	}
+	wg.Wait()
+	require.NoError(errs[0])
+	require.NoError(errs[1])
+
+	// The build that waited for the lock finds the blob pushed by the other
+	// one, and doesn't upload it again.
+	require.Len(transport.uploads, 1)
+	require.Contains(transport.blobs, "app@"+string(digest))
+}
+
+// expiringTokenTransport rejects the PATCH requests in reject as
+// unauthorized, like a registry whose token expired during a long upload.
+type expiringTokenTransport struct {
+	http.RoundTripper
+	reject  map[int]bool
+	patches int
+}
+
+func (t *expiringTokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method == "PATCH" {
+		t.patches++
+		if t.reject[t.patches] {
+			resp := memResponse(http.StatusUnauthorized, nil, nil)
+			resp.Request = r
+			return resp, nil
+		}
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func TestPushLayerResumesAfterAuthorizationExpired(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	registry := newMemRegistryTransport()
+	transport := &expiringTokenTransport{RoundTripper: registry, reject: map[int]bool{2: true}}
+	client := NewWithClient(ctx.ImageStore, "registry.example.com", "app", &http.Client{Transport: transport})
+	client.config.Security.TLS.Client.Disabled = true
+	client.config.PushChunk = 16 * 1024
+
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	require.NoError(client.PushLayer(digest))
+
+	// The rejected chunk is sent again in the same upload.
+	require.Len(registry.uploads, 1)
+	r, err := ctx.ImageStore.Layers.GetStoreFileReader(digest.Hex())
+	require.NoError(err)
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(content, registry.blobs["app@"+string(digest)])
+}
+
+func TestPushLayerAuthorizationExpiredTwice(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	registry := newMemRegistryTransport()
+	transport := &expiringTokenTransport{RoundTripper: registry, reject: map[int]bool{2: true, 3: true}}
+	client := NewWithClient(ctx.ImageStore, "registry.example.com", "app", &http.Client{Transport: transport})
+	client.config.Security.TLS.Client.Disabled = true
+	client.config.PushChunk = 16 * 1024
+
+	// Credentials rejected again after resuming aren't expired tokens.
+	err := client.PushLayer(image.Digest("sha256:" + testutil.SampleLayerTarDigest))
+	require.Error(err)
+	require.Contains(err.Error(), "401")
+	require.Equal(3, transport.patches)
+}
@@ -58,8 +58,16 @@ type Config struct {
 	// If not specify, a default chunk size will be used.
 	// Set it to -1 to turn off chunk upload.
 	// NOTE: gcr and ecr do not support chunked upload.
-	PushChunk int64           `yaml:"push_chunk" json:"push_chunk"`
-	Security  security.Config `yaml:"security" json:"security"`
+	PushChunk int64 `yaml:"push_chunk" json:"push_chunk"`
+	// How long "blob not present" and "manifest not found" answers are
+	// remembered. If not specified, a default TTL will be used.
+	// Set it to a negative duration to always ask the registry.
+	NotFoundTTL time.Duration `yaml:"not_found_ttl" json:"not_found_ttl"`
+	// How many times a blob that doesn't match the size and digest of the
+	// manifest is deleted and pulled again. If not specified, a default
+	// will be used. Set it to -1 to fail on the first corrupt download.
+	VerifyRetries int             `yaml:"verify_retries" json:"verify_retries"`
+	Security      security.Config `yaml:"security" json:"security"`
 }
 
 func (c Config) applyDefaults() Config {
@@ -88,6 +96,12 @@ func (c Config) applyDefaults() Config {
 	if c.PushChunk == 0 {
 		c.PushChunk = 50 * 1024 * 1024 // 50 MB
 	}
+	if c.NotFoundTTL == 0 {
+		c.NotFoundTTL = 30 * time.Second
+	}
+	if c.VerifyRetries == 0 {
+		c.VerifyRetries = 2
+	}
 	c.Security = c.Security.ApplyDefaults()
 	return c
 }
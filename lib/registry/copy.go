@@ -0,0 +1,169 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/concurrency"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/utils"
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// _copyManifestTypes are the manifest media types accepted when copying
+// images, including the lists of multi-platform images.
+var _copyManifestTypes = strings.Join([]string{
+	image.MediaTypeManifest,
+	image.MediaTypeManifestList,
+	image.MediaTypeOCIManifest,
+	image.MediaTypeOCIIndex,
+}, ", ")
+
+// Copy copies an image from the repository of src to the repository of dst,
+// including all the images of a manifest list or OCI index. Manifests are
+// copied byte for byte, so they keep their digests. The blobs missing from dst
+// go through the image store of src, which dst must share.
+func Copy(src, dst *DockerRegistryClient, srcTag, dstTag string) error {
+	srcName := image.NewImageName(src.registry, src.repository, srcTag)
+	dstName := image.NewImageName(dst.registry, dst.repository, dstTag)
+	log.Infof("* Started copying image %s to %s", srcName, dstName)
+	starttime := time.Now()
+
+	mediaType, content, err := src.pullRawManifest(srcTag)
+	if err != nil {
+		return fmt.Errorf("pull manifest: %s", err)
+	}
+	if mediaType == image.MediaTypeManifestList || mediaType == image.MediaTypeOCIIndex {
+		var index image.OCIIndex
+		if err := json.Unmarshal(content, &index); err != nil {
+			return fmt.Errorf("unmarshal manifest list: %s", err)
+		}
+		for _, desc := range index.Manifests {
+			digest := string(desc.Digest)
+			childType, childContent, err := src.pullRawManifest(digest)
+			if err != nil {
+				return fmt.Errorf("pull manifest %s: %s", digest, err)
+			}
+			if err := copyBlobs(src, dst, childContent); err != nil {
+				return fmt.Errorf("copy blobs of manifest %s: %s", digest, err)
+			}
+			if err := dst.pushRawManifest(digest, childType, childContent); err != nil {
+				return fmt.Errorf("push manifest %s: %s", digest, err)
+			}
+			if desc.Platform != nil {
+				log.Infof("* Copied manifest %s of platform %s", digest, desc.Platform)
+			}
+		}
+	} else if err := copyBlobs(src, dst, content); err != nil {
+		return fmt.Errorf("copy blobs: %s", err)
+	}
+	if err := dst.pushRawManifest(dstTag, mediaType, content); err != nil {
+		return fmt.Errorf("push manifest: %s", err)
+	}
+	log.Infow(fmt.Sprintf("* Copied image %s to %s", srcName, dstName),
+		"duration", time.Since(starttime))
+	return nil
+}
+
+// copyBlobs copies the layers and config of an image manifest that dst doesn't
+// have yet.
+func copyBlobs(src, dst *DockerRegistryClient, content []byte) error {
+	var manifest image.DistributionManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return fmt.Errorf("unmarshal manifest: %s", err)
+	}
+
+	multiError := utils.NewMultiErrors()
+	workers := concurrency.NewWorkerPool(src.config.Concurrency)
+	blobSet := make(map[image.Digest]bool)
+	for _, blob := range append(manifest.GetLayerDigests(), manifest.GetConfigDigest()) {
+		if blobSet[blob] {
+			continue
+		}
+		blobSet[blob] = true
+		blob := blob
+		isConfig := blob == manifest.GetConfigDigest()
+		workers.Do(func() {
+			if err := copyBlob(src, dst, blob, isConfig); err != nil {
+				multiError.Add(fmt.Errorf("copy blob %s: %s", blob, err))
+				workers.Stop()
+			}
+		})
+	}
+	workers.Wait()
+	return multiError.Collect()
+}
+
+func copyBlob(src, dst *DockerRegistryClient, blob image.Digest, isConfig bool) error {
+	if found, err := dst.layerExists(blob); err != nil {
+		return fmt.Errorf("check blob exists: %s", err)
+	} else if found {
+		log.Infof("* Skipped copying existing blob %s:%s", dst.repository, blob)
+		return nil
+	}
+	if isConfig {
+		if _, err := src.PullImageConfig(blob); err != nil {
+			return fmt.Errorf("pull: %s", err)
+		}
+		return dst.PushImageConfig(blob)
+	}
+	if _, err := src.PullLayer(blob); err != nil {
+		return fmt.Errorf("pull: %s", err)
+	}
+	return dst.PushLayer(blob)
+}
+
+// pullRawManifest pulls a manifest, manifest list or OCI index by tag or
+// digest, and returns its media type and content as is.
+func (c DockerRegistryClient) pullRawManifest(reference string) (string, []byte, error) {
+	return c.fetchManifest(reference, _copyManifestTypes)
+}
+
+// pushRawManifest pushes the content of a manifest, manifest list or OCI index
+// as is.
+func (c DockerRegistryClient) pushRawManifest(reference, mediaType string, content []byte) error {
+	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+	if err != nil {
+		return fmt.Errorf("get security opt: %s", err)
+	}
+
+	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, reference)
+	resp, err := httputil.Send(
+		"PUT",
+		URL,
+		httputil.SendClient(c.client),
+		opt,
+		httputil.SendTimeout(c.config.Timeout),
+		c.config.sendRetry(),
+		httputil.SendHeaders(map[string]string{
+			"Content-Type": mediaType,
+			"Host":         c.registry,
+		}),
+		httputil.SendBody(bytes.NewReader(content)),
+		httputil.SendAcceptedCodes(http.StatusOK, http.StatusCreated))
+	if err != nil {
+		return fmt.Errorf("send push manifest request: %s", err)
+	}
+	defer resp.Body.Close()
+	_notFound.remove(URL)
+	return nil
+}
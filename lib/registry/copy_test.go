@@ -0,0 +1,194 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// memRegistryTransport is an in-memory registry, which keeps blobs and
+// manifests by repository.
+type memRegistryTransport struct {
+	sync.Mutex
+	manifests map[string]memManifest
+	blobs     map[string][]byte
+	uploads   map[string]*memUpload
+}
+
+type memUpload struct {
+	repo    string
+	content bytes.Buffer
+}
+
+func newMemRegistryTransport() *memRegistryTransport {
+	return &memRegistryTransport{
+		manifests: make(map[string]memManifest),
+		blobs:     make(map[string][]byte),
+		uploads:   make(map[string]*memUpload),
+	}
+}
+
+func memResponse(code int, body []byte, header http.Header) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		StatusCode: code,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Header:     header,
+	}
+}
+
+func (t *memRegistryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	var body []byte
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if strings.HasPrefix(p, "/upload/") {
+		upload := t.uploads[p]
+		if r.Method == "PATCH" {
+			upload.content.Write(body)
+			return memResponse(http.StatusAccepted, nil, http.Header{"Location": {p}}), nil
+		}
+		if r.Method == "GET" {
+			end := upload.content.Len() - 1
+			if end < 0 {
+				end = 0
+			}
+			return memResponse(http.StatusNoContent, nil, http.Header{
+				"Location": {p},
+				"Range":    {fmt.Sprintf("0-%d", end)},
+			}), nil
+		}
+		t.blobs[upload.repo+"@"+r.URL.Query().Get("digest")] = upload.content.Bytes()
+		return memResponse(http.StatusCreated, nil, nil), nil
+	}
+	if strings.HasSuffix(p, "/blobs/uploads/") {
+		location := fmt.Sprintf("/upload/%d", len(t.uploads))
+		t.uploads[location] = &memUpload{repo: strings.TrimSuffix(p, "/blobs/uploads/")}
+		return memResponse(http.StatusAccepted, nil, http.Header{"Location": {location}}), nil
+	}
+	if i := strings.LastIndex(p, "/blobs/"); i >= 0 {
+		blob, ok := t.blobs[p[:i]+"@"+p[i+len("/blobs/"):]]
+		if !ok {
+			return memResponse(http.StatusNotFound, nil, nil), nil
+		}
+		return memResponse(http.StatusOK, blob, nil), nil
+	}
+	if i := strings.LastIndex(p, "/manifests/"); i >= 0 {
+		key := p[:i] + "@" + p[i+len("/manifests/"):]
+		if r.Method == "PUT" {
+			m := memManifest{r.Header.Get("Content-Type"), body}
+			digest, _ := image.NewDigester().FromBytes(body)
+			t.manifests[key] = m
+			t.manifests[p[:i]+"@"+string(digest)] = m
+			return memResponse(http.StatusCreated, nil, nil), nil
+		}
+		m, ok := t.manifests[key]
+		if !ok {
+			return memResponse(http.StatusNotFound, nil, nil), nil
+		}
+		digest, _ := image.NewDigester().FromBytes(m.content)
+		if r.Method == "DELETE" {
+			// Tags pointing to the manifest are deleted with it.
+			for k, other := range t.manifests {
+				if strings.HasPrefix(k, p[:i]+"@") && bytes.Equal(other.content, m.content) {
+					delete(t.manifests, k)
+				}
+			}
+			return memResponse(http.StatusAccepted, nil, nil), nil
+		}
+		return memResponse(http.StatusOK, m.content, http.Header{
+			"Content-Type":          {m.mediaType},
+			"Docker-Content-Digest": {string(digest)},
+		}), nil
+	}
+	return memResponse(http.StatusNotFound, nil, nil), nil
+}
+
+func (t *memRegistryTransport) addBlob(repo string, content []byte) image.Digest {
+	digest, _ := image.NewDigester().FromBytes(content)
+	t.blobs[repo+"@"+string(digest)] = content
+	return digest
+}
+
+func (t *memRegistryTransport) addManifest(repo, reference, mediaType string, v interface{}) image.Digest {
+	content, _ := json.Marshal(v)
+	digest, _ := image.NewDigester().FromBytes(content)
+	t.manifests[repo+"@"+reference] = memManifest{mediaType, content}
+	t.manifests[repo+"@"+string(digest)] = memManifest{mediaType, content}
+	return digest
+}
+
+func TestCopyManifestList(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	transport := newMemRegistryTransport()
+	layer := transport.addBlob("src/app", []byte("layer"))
+	config := transport.addBlob("src/app", []byte("config"))
+	manifest := image.DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifest,
+		Config:        image.Descriptor{MediaType: image.MediaTypeConfig, Digest: config, Size: 6},
+		Layers:        []image.Descriptor{{MediaType: image.MediaTypeLayer, Digest: layer, Size: 5}},
+	}
+	manifestDigest := transport.addManifest("src/app", "v1-amd64", image.MediaTypeManifest, manifest)
+	transport.addManifest("src/app", "v1", image.MediaTypeManifestList, image.OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifestList,
+		Manifests:     []image.Descriptor{{MediaType: image.MediaTypeManifest, Digest: manifestDigest}},
+	})
+
+	client := &http.Client{Transport: transport}
+	src := NewWithClient(ctx.ImageStore, "src.example.com", "src/app", client)
+	src.config.Security.TLS.Client.Disabled = true
+	dst := NewWithClient(ctx.ImageStore, "dst.example.com", "dst/app", client)
+	dst.config.Security.TLS.Client.Disabled = true
+
+	require.NoError(Copy(src, dst, "v1", "v2"))
+	require.Equal([]byte("layer"), transport.blobs["dst/app@"+string(layer)])
+	require.Equal([]byte("config"), transport.blobs["dst/app@"+string(config)])
+	require.Equal(transport.manifests["src/app@v1"], transport.manifests["dst/app@v2"])
+	require.Equal(
+		transport.manifests["src/app@"+string(manifestDigest)],
+		transport.manifests["dst/app@"+string(manifestDigest)])
+
+	// Blobs that already exist are skipped.
+	require.NoError(Copy(src, dst, "v1-amd64", "v2-amd64"))
+	require.Equal(image.MediaTypeManifest, transport.manifests["dst/app@v2-amd64"].mediaType)
+}
@@ -0,0 +1,92 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// ResolveManifestDigest returns the digest of the manifest a tag points to, or
+// the reference itself if it's already a digest.
+func (c DockerRegistryClient) ResolveManifestDigest(reference string) (image.Digest, error) {
+	if strings.Contains(reference, ":") {
+		return image.Digest(reference), nil
+	}
+	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+	if err != nil {
+		return "", fmt.Errorf("get security opt: %s", err)
+	}
+
+	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, reference)
+	resp, err := httputil.Send(
+		"HEAD",
+		URL,
+		httputil.SendClient(c.client),
+		opt,
+		httputil.SendTimeout(c.config.Timeout),
+		c.config.sendRetry(),
+		httputil.SendAcceptedCodes(http.StatusOK, http.StatusNotFound),
+		httputil.SendHeaders(map[string]string{"Accept": _copyManifestTypes}))
+	if err != nil {
+		return "", fmt.Errorf("check manifest: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("manifest not found")
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry returned no Docker-Content-Digest header")
+	}
+	return image.Digest(digest), nil
+}
+
+// DeleteManifest deletes a manifest by digest. All the tags pointing to it are
+// removed with it. The registry must allow deletes.
+func (c DockerRegistryClient) DeleteManifest(digest image.Digest) error {
+	opt, err := c.config.Security.GetHTTPOption(c.registry, c.repository)
+	if err != nil {
+		return fmt.Errorf("get security opt: %s", err)
+	}
+
+	URL := fmt.Sprintf(baseManifestQuery, c.registry, c.repository, digest)
+	resp, err := httputil.Send(
+		"DELETE",
+		URL,
+		httputil.SendClient(c.client),
+		opt,
+		httputil.SendTimeout(c.config.Timeout),
+		c.config.sendRetry(),
+		httputil.SendAcceptedCodes(http.StatusAccepted, http.StatusOK, http.StatusNotFound),
+		httputil.SendHeaders(map[string]string{"Host": c.registry}))
+	if err != nil {
+		if httputil.IsStatus(err, http.StatusMethodNotAllowed) {
+			return fmt.Errorf("registry %s doesn't allow deletes", c.registry)
+		}
+		return fmt.Errorf("send delete manifest request: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("manifest not found")
+	}
+	log.Infof("* Deleted manifest %s/%s@%s", c.registry, c.repository, digest)
+	return nil
+}
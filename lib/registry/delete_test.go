@@ -0,0 +1,49 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteManifest(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	transport := newMemRegistryTransport()
+	digest := transport.addManifest("app", "tmp", image.MediaTypeManifest, image.DistributionManifest{})
+	c := NewWithClient(ctx.ImageStore, "registry.example.com", "app", &http.Client{Transport: transport})
+	c.config.Security.TLS.Client.Disabled = true
+
+	resolved, err := c.ResolveManifestDigest("tmp")
+	require.NoError(err)
+	require.Equal(digest, resolved)
+	resolved, err = c.ResolveManifestDigest(string(digest))
+	require.NoError(err)
+	require.Equal(digest, resolved)
+
+	require.NoError(c.DeleteManifest(digest))
+	require.NotContains(transport.manifests, "app@tmp")
+	_, err = c.ResolveManifestDigest("tmp")
+	require.Error(err)
+	require.Error(c.DeleteManifest(digest))
+}
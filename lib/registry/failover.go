@@ -0,0 +1,47 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+// PushWithFailover pushes an image to the first of endpoints that accepts it,
+// in order: a primary registry followed by its standbys. Each push is expected
+// to retry on its own, so an endpoint is only given up once push fails. It
+// returns the name the image was pushed as.
+func PushWithFailover(endpoints []image.Name, push func(image.Name) error) (image.Name, error) {
+	var errs []string
+	for i, name := range endpoints {
+		err := push(name)
+		if err == nil {
+			if i > 0 {
+				log.Warnf("Pushed %s to standby registry %s instead of %s",
+					name, name.GetRegistry(), endpoints[0].GetRegistry())
+			}
+			return name, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", name.GetRegistry(), err))
+		if i < len(endpoints)-1 {
+			log.Warnf("Failed to push %s, trying standby registry %s: %s",
+				name, endpoints[i+1].GetRegistry(), err)
+		}
+	}
+	return image.Name{}, fmt.Errorf("push failed on every registry: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,58 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushWithFailover(t *testing.T) {
+	require := require.New(t)
+	primary := image.MustParseName("primary.example.com/app:v1")
+	standby := primary.WithRegistry("standby.example.com")
+
+	var tried []string
+	pushed, err := PushWithFailover([]image.Name{primary, standby}, func(name image.Name) error {
+		tried = append(tried, name.GetRegistry())
+		return nil
+	})
+	require.NoError(err)
+	require.Equal(primary, pushed)
+	require.Equal([]string{"primary.example.com"}, tried)
+
+	tried = nil
+	pushed, err = PushWithFailover([]image.Name{primary, standby}, func(name image.Name) error {
+		tried = append(tried, name.GetRegistry())
+		if name.GetRegistry() == "primary.example.com" {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	require.NoError(err)
+	require.Equal(standby, pushed)
+	require.Equal([]string{"primary.example.com", "standby.example.com"}, tried)
+
+	_, err = PushWithFailover([]image.Name{primary, standby}, func(name image.Name) error {
+		return errors.New("connection refused")
+	})
+	require.Error(err)
+	require.Contains(err.Error(), "primary.example.com: connection refused")
+	require.Contains(err.Error(), "standby.example.com: connection refused")
+}
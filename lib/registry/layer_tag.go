@@ -0,0 +1,63 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+// PushLayerTag pushes a manifest of the given layer as tag. The layer must
+// have been pushed already. Registries garbage collect the blobs that no
+// manifest references, so this keeps the layers pushed to a repository
+// without images, like a cache repository, until the tag is deleted.
+func (c DockerRegistryClient) PushLayerTag(tag string, layer image.Descriptor, diffID image.Digest) error {
+	if layer.MediaType == "" {
+		layer.MediaType = image.MediaTypeLayer
+	}
+	if layer.Size == 0 {
+		info, err := c.store.Layers.GetStoreFileStat(layer.Digest.Hex())
+		if err != nil {
+			return fmt.Errorf("stat layer %s: %s", layer.Digest, err)
+		}
+		layer.Size = info.Size()
+	}
+
+	config := image.Config{RootFS: &image.RootFS{Type: "layers", DiffIDs: []image.Digest{diffID}}}
+	configJSON, err := json.Marshal(&config)
+	if err != nil {
+		return fmt.Errorf("marshal layer config: %s", err)
+	}
+	configDescriptor, err := c.pushBlob(configJSON, true)
+	if err != nil {
+		return fmt.Errorf("push layer config: %s", err)
+	}
+	configDescriptor.MediaType = image.MediaTypeConfig
+
+	manifest := &image.DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeManifest,
+		Config:        configDescriptor,
+		Layers:        []image.Descriptor{layer},
+	}
+	if err := c.PushManifest(tag, manifest); err != nil {
+		return fmt.Errorf("push layer manifest: %s", err)
+	}
+	log.Infof("* Tagged layer %s as %s/%s:%s", layer.Digest, c.registry, c.repository, tag)
+	return nil
+}
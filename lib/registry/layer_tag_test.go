@@ -0,0 +1,58 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushLayerTag(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+
+	transport := newMemRegistryTransport()
+	client := NewWithClient(ctx.ImageStore, "registry.example.com", "cache/makisu", &http.Client{Transport: transport})
+	client.config.Security.TLS.Client.Disabled = true
+
+	layer := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	diffID := image.Digest("sha256:" + testutil.SampleImageConfigDigest)
+	require.NoError(client.PushLayer(layer))
+	require.NoError(client.PushLayerTag("makisu-cache-1", image.Descriptor{Digest: layer}, diffID))
+
+	m, ok := transport.manifests["cache/makisu@makisu-cache-1"]
+	require.True(ok)
+	require.Equal(image.MediaTypeManifest, m.mediaType)
+	var manifest image.DistributionManifest
+	require.NoError(json.Unmarshal(m.content, &manifest))
+	require.Len(manifest.Layers, 1)
+	require.Equal(layer, manifest.Layers[0].Digest)
+	require.Equal(image.MediaTypeLayer, manifest.Layers[0].MediaType)
+	info, err := ctx.ImageStore.Layers.GetStoreFileStat(layer.Hex())
+	require.NoError(err)
+	require.Equal(info.Size(), manifest.Layers[0].Size)
+
+	var config image.Config
+	require.NoError(json.Unmarshal(transport.blobs["cache/makisu@"+string(manifest.Config.Digest)], &config))
+	require.Equal([]image.Digest{diffID}, config.RootFS.DiffIDs)
+}
@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sync"
+	"time"
+)
+
+// _notFound remembers the blobs and manifests that registries reported
+// missing, so that retried stages and pushes to multiple destinations don't
+// send the same requests again. It is shared by all the clients of the
+// process, and entries are dropped when the client pushes the missing content.
+var _notFound = newNotFoundCache()
+
+// notFoundCache maps the URLs of missing blobs and manifests to the time
+// their entries expire.
+type notFoundCache struct {
+	sync.Mutex
+	entries map[string]time.Time
+	now     func() time.Time
+}
+
+func newNotFoundCache() *notFoundCache {
+	return &notFoundCache{
+		entries: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// contains returns true if the content at URL was reported missing less than
+// its TTL ago.
+func (c *notFoundCache) contains(URL string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	expiration, ok := c.entries[URL]
+	if !ok {
+		return false
+	}
+	if !c.now().Before(expiration) {
+		delete(c.entries, URL)
+		return false
+	}
+	return true
+}
+
+// add records that the content at URL is missing. It is a no-op if the TTL
+// is not positive.
+func (c *notFoundCache) add(URL string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.entries[URL] = c.now().Add(ttl)
+}
+
+// remove drops the entry of URL, after its content was pushed.
+func (c *notFoundCache) remove(URL string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, URL)
+}
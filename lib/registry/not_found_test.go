@@ -0,0 +1,115 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+type countingTransport struct {
+	http.RoundTripper
+	requests map[string]int
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.requests[r.Method+r.URL.String()]++
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func TestNotFoundCacheExpiration(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	c := newNotFoundCache()
+	c.now = func() time.Time { return now }
+
+	c.add("a", time.Minute)
+	c.add("b", -1)
+	require.True(c.contains("a"))
+	require.False(c.contains("b"))
+
+	now = now.Add(time.Minute)
+	require.False(c.contains("a"))
+
+	c.add("a", time.Minute)
+	c.remove("a")
+	require.False(c.contains("a"))
+}
+
+func TestLayerExistsCachesNotFound(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixtureWithSampleImage()
+	defer cleanup()
+	_notFound = newNotFoundCache()
+
+	p, err := PushClientFixture(ctx)
+	require.NoError(err)
+	transport := &countingTransport{p.client.Transport, make(map[string]int)}
+	p.client.Transport = transport
+
+	digest := image.Digest("sha256:" + testutil.SampleLayerTarDigest)
+	head := "HEAD" + p.blobURL(digest)
+	for i := 0; i < 3; i++ {
+		exists, err := p.layerExists(digest)
+		require.NoError(err)
+		require.False(exists)
+	}
+	require.Equal(1, transport.requests[head])
+
+	// Pushing the layer forgets that it was missing.
+	require.NoError(p.PushLayer(digest))
+	require.Equal(1, transport.requests[head])
+	_, err = p.layerExists(digest)
+	require.NoError(err)
+	require.Equal(2, transport.requests[head])
+}
+
+func TestManifestExistsCachesNotFound(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	_notFound = newNotFoundCache()
+
+	p, err := PushClientFixture(ctx)
+	require.NoError(err)
+	p.config.NotFoundTTL = -1
+	transport := &countingTransport{p.client.Transport, make(map[string]int)}
+	p.client.Transport = transport
+
+	head := "HEAD" + fmt.Sprintf(baseManifestQuery, p.registry, p.repository, testutil.SampleImageTag)
+	for i := 0; i < 2; i++ {
+		exists, err := p.manifestExists(testutil.SampleImageTag)
+		require.NoError(err)
+		require.False(exists)
+	}
+	require.Equal(2, transport.requests[head])
+
+	p.config.NotFoundTTL = time.Minute
+	for i := 0; i < 2; i++ {
+		exists, err := p.manifestExists(testutil.SampleImageTag)
+		require.NoError(err)
+		require.False(exists)
+	}
+	require.Equal(3, transport.requests[head])
+}
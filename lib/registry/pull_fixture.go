@@ -3,6 +3,7 @@ package registry
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -90,11 +91,36 @@ func (t pullTransportFixture) imageConfigResponse() (*http.Response, error) {
 	}, nil
 }
 
-func (t pullTransportFixture) layerResponse() (*http.Response, error) {
+func (t pullTransportFixture) layerResponse(r *http.Request) (*http.Response, error) {
 	layerTar, err := os.Open(t.layerTarPath)
 	if err != nil {
 		return nil, err
 	}
+	var offset int64
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil {
+		// Like registries, ranges starting at the end of the blob are
+		// rejected.
+		if info, err := layerTar.Stat(); err != nil {
+			layerTar.Close()
+			return nil, err
+		} else if offset >= info.Size() {
+			layerTar.Close()
+			return &http.Response{
+				StatusCode: http.StatusRequestedRangeNotSatisfiable,
+				Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+				Header:     make(http.Header),
+			}, nil
+		}
+		if _, err := layerTar.Seek(offset, io.SeekStart); err != nil {
+			layerTar.Close()
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Body:       layerTar,
+			Header:     make(http.Header),
+		}, nil
+	}
 	return &http.Response{
 		StatusCode: http.StatusOK,
 		Body:       layerTar,
@@ -130,7 +156,7 @@ func (t pullTransportFixture) RoundTrip(r *http.Request) (*http.Response, error)
 	} else if r.URL.String() == imageConfigURL {
 		return t.imageConfigResponse()
 	} else if r.URL.String() == layerTarURL {
-		return t.layerResponse()
+		return t.layerResponse(r)
 	}
 
 	return &http.Response{
@@ -0,0 +1,244 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// _minTokenLifetime is the lifetime of tokens that expire sooner or
+	// don't tell, like docker assumes.
+	_minTokenLifetime = 60 * time.Second
+
+	_clientID = "docker"
+)
+
+// Authorizer adds credentials to the requests sent to a registry, following
+// the challenge of the registry.
+type Authorizer interface {
+	Authorize(req *http.Request) error
+}
+
+// invalidator is implemented by the Authorizers caching credentials, which
+// registries can reject before they expire.
+type invalidator interface {
+	// invalidate forgets the credentials sent in the authorization header,
+	// and returns true if other ones will be sent.
+	invalidate(authorization string) bool
+}
+
+// NewAuthorizer returns the Authorizer answering the first supported
+// challenge of a registry, with the given credentials. Tokens are requested
+// with pull and push access to repo, using tr. It returns nil if there are no
+// supported challenges, which means the registry doesn't require
+// authentication.
+func NewAuthorizer(
+	challenges []Challenge, authConfig AuthConfig, repo string, tr http.RoundTripper) Authorizer {
+
+	for _, c := range challenges {
+		switch c.Scheme {
+		case "basic":
+			return &basicAuthorizer{authConfig}
+		case "bearer":
+			return &tokenAuthorizer{
+				realm:      c.Parameters["realm"],
+				service:    c.Parameters["service"],
+				scope:      repositoryScope(repo, "pull", "push"),
+				authConfig: authConfig,
+				client:     &http.Client{Transport: tr, Timeout: time.Minute},
+				now:        time.Now,
+			}
+		}
+	}
+	return nil
+}
+
+// basicAuthorizer sends the username and password with every request.
+type basicAuthorizer struct {
+	authConfig AuthConfig
+}
+
+func (a *basicAuthorizer) Authorize(req *http.Request) error {
+	if a.authConfig.Username == "" || a.authConfig.Password == "" {
+		return errors.New("no basic auth credentials")
+	}
+	req.SetBasicAuth(a.authConfig.Username, a.authConfig.Password)
+	return nil
+}
+
+// tokenAuthorizer sends a bearer token with every request, requested from
+// the realm of the challenge and cached until it expires.
+type tokenAuthorizer struct {
+	realm      string
+	service    string
+	scope      string
+	authConfig AuthConfig
+	client     *http.Client
+	now        func() time.Time
+
+	sync.Mutex
+	token      string
+	expiration time.Time
+}
+
+// tokenResponse is the response of a token server. access_token is the OAuth
+// name of token.
+type tokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+func (a *tokenAuthorizer) Authorize(req *http.Request) error {
+	token, err := a.getToken(req.URL.Query().Get("from"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// invalidate forgets the cached token if it was sent in authorization, so
+// the next request gets a new one.
+func (a *tokenAuthorizer) invalidate(authorization string) bool {
+	if a.authConfig.RegistryToken != "" {
+		return false
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.token == "" || authorization != "Bearer "+a.token {
+		return false
+	}
+	a.token, a.expiration = "", time.Time{}
+	return true
+}
+
+// getToken returns the cached token, or requests a new one if it expired.
+// Mounts of blobs from another repository need pull access to it, and get a
+// token of their own.
+func (a *tokenAuthorizer) getToken(from string) (string, error) {
+	if a.authConfig.RegistryToken != "" {
+		return a.authConfig.RegistryToken, nil
+	}
+	scopes := []string{a.scope}
+	if from != "" {
+		if scope := repositoryScope(from, "pull"); scope != a.scope {
+			token, _, err := a.fetchToken(append(scopes, scope))
+			return token, err
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if a.token != "" && a.now().Before(a.expiration) {
+		return a.token, nil
+	}
+	token, expiration, err := a.fetchToken(scopes)
+	if err != nil {
+		return "", err
+	}
+	a.token, a.expiration = token, expiration
+	return token, nil
+}
+
+// fetchToken requests a token from the realm: with OAuth if there is an
+// identity token, and with basic auth otherwise.
+func (a *tokenAuthorizer) fetchToken(scopes []string) (string, time.Time, error) {
+	if a.realm == "" {
+		return "", time.Time{}, errors.New("no realm in token auth challenge")
+	}
+	realm, err := url.Parse(a.realm)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid token auth challenge realm: %s", err)
+	}
+
+	var req *http.Request
+	if a.authConfig.IdentityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", a.authConfig.IdentityToken)
+		form.Set("service", a.service)
+		form.Set("scope", strings.Join(scopes, " "))
+		form.Set("client_id", _clientID)
+		req, err = http.NewRequest("POST", realm.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("create token request: %s", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realm.Query()
+		if a.service != "" {
+			query.Set("service", a.service)
+		}
+		for _, scope := range scopes {
+			query.Add("scope", scope)
+		}
+		if a.authConfig.Username != "" && a.authConfig.Password != "" {
+			query.Set("account", a.authConfig.Username)
+		}
+		realm.RawQuery = query.Encode()
+		req, err = http.NewRequest("GET", realm.String(), nil)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("create token request: %s", err)
+		}
+		if a.authConfig.Username != "" && a.authConfig.Password != "" {
+			req.SetBasicAuth(a.authConfig.Username, a.authConfig.Password)
+		}
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("request token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", time.Time{}, fmt.Errorf("request token: status %d: %s", resp.StatusCode, body)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", time.Time{}, fmt.Errorf("decode token response: %s", err)
+	}
+	if tr.AccessToken != "" {
+		tr.Token = tr.AccessToken
+	}
+	if tr.Token == "" {
+		return "", time.Time{}, errors.New("no token in token response")
+	}
+	lifetime := time.Duration(tr.ExpiresIn) * time.Second
+	if lifetime < _minTokenLifetime {
+		lifetime = _minTokenLifetime
+	}
+	if tr.IssuedAt.IsZero() {
+		tr.IssuedAt = a.now()
+	}
+	return tr.Token, tr.IssuedAt.Add(lifetime), nil
+}
+
+// repositoryScope returns the scope of a token giving access to repo.
+func repositoryScope(repo string, actions ...string) string {
+	return fmt.Sprintf("repository:%s:%s", repo, strings.Join(actions, ","))
+}
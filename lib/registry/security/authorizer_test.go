@@ -0,0 +1,250 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tokenServer issues "token-<n>" to user:pass, or to the refresh token
+// "refresh".
+type tokenServer struct {
+	sync.Mutex
+	requests []*http.Request
+	forms    []string
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	r.ParseForm()
+	s.requests = append(s.requests, r)
+	if r.Method == "POST" {
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", len(s.requests)), "expires_in": 300})
+		return
+	}
+	if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token": fmt.Sprintf("token-%d", len(s.requests)), "expires_in": 300})
+}
+
+// newRegistry returns a v2 registry answering challenge to unauthenticated
+// pings, accepting requests with authorization auth, and redirecting blob
+// requests to redirect.
+func newRegistry(challenge, auth, redirect string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(registryVersionHeader, registryV2Version)
+		if r.Header.Get("Authorization") != auth {
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/blobs/sha256") {
+			http.Redirect(w, r, redirect, http.StatusTemporaryRedirect)
+		}
+	}))
+}
+
+func insecureTransport() http.RoundTripper {
+	return &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+}
+
+func TestBasicAuthTransportToken(t *testing.T) {
+	require := require.New(t)
+
+	tokens := &tokenServer{}
+	tokenServer := httptest.NewServer(tokens)
+	defer tokenServer.Close()
+	var blobAuth []string
+	blobs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blobAuth = append(blobAuth, r.Header.Get("Authorization"))
+	}))
+	defer blobs.Close()
+	registry := newRegistry(
+		fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, tokenServer.URL),
+		"Bearer token-1", blobs.URL+"/blob")
+	defer registry.Close()
+
+	addr := strings.TrimPrefix(registry.URL, "https://")
+	rt, err := BasicAuthTransport(addr, "app", insecureTransport(),
+		AuthConfig{Username: "user", Password: "pass"})
+	require.NoError(err)
+	client := &http.Client{Transport: rt}
+
+	// The token is cached.
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(registry.URL + "/v2/app/manifests/latest")
+		require.NoError(err)
+		require.Equal(http.StatusOK, resp.StatusCode)
+	}
+	require.Len(tokens.requests, 1)
+	query := tokens.requests[0].URL.Query()
+	require.Equal("registry.test", query.Get("service"))
+	require.Equal([]string{"repository:app:pull,push"}, query["scope"])
+	require.Equal("user", query.Get("account"))
+
+	// Credentials aren't sent to the blob storage.
+	resp, err := client.Get(registry.URL + "/v2/app/blobs/sha256:abcd")
+	require.NoError(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Equal([]string{""}, blobAuth)
+
+	// Mounts get a token with pull access to the source repository.
+	resp, err = client.Post(registry.URL+"/v2/app/blobs/uploads/?mount=sha256:abcd&from=base", "", nil)
+	require.NoError(err)
+	require.Equal(http.StatusUnauthorized, resp.StatusCode)
+	require.Len(tokens.requests, 2)
+	require.Equal([]string{"repository:app:pull,push", "repository:base:pull"},
+		tokens.requests[1].URL.Query()["scope"])
+}
+
+func TestBasicAuthTransportBasic(t *testing.T) {
+	require := require.New(t)
+
+	registry := newRegistry(`Basic realm="registry"`, "Basic dXNlcjpwYXNz", "")
+	defer registry.Close()
+	addr := strings.TrimPrefix(registry.URL, "https://")
+
+	rt, err := BasicAuthTransport(addr, "app", insecureTransport(),
+		AuthConfig{Username: "user", Password: "pass"})
+	require.NoError(err)
+	resp, err := (&http.Client{Transport: rt}).Get(registry.URL + "/v2/app/manifests/latest")
+	require.NoError(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	rt, err = BasicAuthTransport(addr, "app", insecureTransport(), AuthConfig{})
+	require.NoError(err)
+	_, err = (&http.Client{Transport: rt}).Get(registry.URL + "/v2/app/manifests/latest")
+	require.Error(err)
+	require.Contains(err.Error(), "no basic auth credentials")
+}
+
+func TestBasicAuthTransportPing(t *testing.T) {
+	require := require.New(t)
+
+	// Registries that don't require authentication get requests as is.
+	open := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(registryVersionHeader, "registry/1.0, "+registryV2Version)
+	}))
+	defer open.Close()
+	tr := insecureTransport()
+	rt, err := BasicAuthTransport(strings.TrimPrefix(open.URL, "https://"), "app", tr, AuthConfig{})
+	require.NoError(err)
+	require.Equal(tr, rt)
+
+	v1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer v1.Close()
+	_, err = BasicAuthTransport(strings.TrimPrefix(v1.URL, "https://"), "app", tr, AuthConfig{})
+	require.Error(err)
+	require.Contains(err.Error(), "registry is not v2")
+}
+
+func TestTokenAuthorizer(t *testing.T) {
+	require := require.New(t)
+
+	tokens := &tokenServer{}
+	server := httptest.NewServer(tokens)
+	defer server.Close()
+
+	now := time.Now()
+	a := NewAuthorizer([]Challenge{
+		{Scheme: "digest"},
+		{Scheme: "bearer", Parameters: map[string]string{"realm": server.URL, "service": "registry.test"}},
+	}, AuthConfig{IdentityToken: "refresh"}, "app", http.DefaultTransport).(*tokenAuthorizer)
+	a.now = func() time.Time { return now }
+
+	// Identity tokens are exchanged with OAuth.
+	req, _ := http.NewRequest("GET", "https://registry.test/v2/app/manifests/latest", nil)
+	require.NoError(a.Authorize(req))
+	require.Equal("Bearer token-1", req.Header.Get("Authorization"))
+	require.Equal("POST", tokens.requests[0].Method)
+	require.Equal("repository:app:pull,push", tokens.requests[0].PostForm.Get("scope"))
+	require.Equal("registry.test", tokens.requests[0].PostForm.Get("service"))
+
+	// Tokens are renewed once they expire.
+	require.NoError(a.Authorize(req))
+	require.Equal("Bearer token-1", req.Header.Get("Authorization"))
+	now = now.Add(301 * time.Second)
+	require.NoError(a.Authorize(req))
+	require.Equal("Bearer token-2", req.Header.Get("Authorization"))
+
+	// Registry tokens are sent as is.
+	a.authConfig = AuthConfig{RegistryToken: "static"}
+	require.NoError(a.Authorize(req))
+	require.Equal("Bearer static", req.Header.Get("Authorization"))
+
+	// Failures of the token server are returned.
+	a.authConfig, a.token = AuthConfig{Username: "user", Password: "wrong"}, ""
+	require.Error(a.Authorize(req))
+
+	require.Nil(NewAuthorizer(nil, AuthConfig{}, "app", http.DefaultTransport))
+}
+
+func TestBasicAuthTransportTokenRejected(t *testing.T) {
+	require := require.New(t)
+
+	tokens := &tokenServer{}
+	tokenServer := httptest.NewServer(tokens)
+	defer tokenServer.Close()
+	// The registry only accepts the second token, like when it revokes the
+	// first one before it expires.
+	registry := newRegistry(
+		fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, tokenServer.URL),
+		"Bearer token-2", "")
+	defer registry.Close()
+
+	addr := strings.TrimPrefix(registry.URL, "https://")
+	rt, err := BasicAuthTransport(addr, "app", insecureTransport(),
+		AuthConfig{Username: "user", Password: "pass"})
+	require.NoError(err)
+	client := &http.Client{Transport: rt}
+
+	// Requests that can be sent again are, with a new token.
+	resp, err := client.Post(
+		registry.URL+"/v2/app/blobs/uploads/", "", strings.NewReader("content"))
+	require.NoError(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Len(tokens.requests, 2)
+
+	// Streamed requests get the 401, and the rejected token is forgotten so
+	// the next request gets a new one.
+	a := rt.(*authTransport).authorizer.(*tokenAuthorizer)
+	a.token = "token-0"
+	resp, err = client.Post(
+		registry.URL+"/v2/app/blobs/uploads/", "", ioutil.NopCloser(strings.NewReader("content")))
+	require.NoError(err)
+	require.Equal(http.StatusUnauthorized, resp.StatusCode)
+	require.Len(tokens.requests, 2)
+	require.Empty(a.token)
+}
@@ -16,55 +16,37 @@ package security
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strings"
 
-	"github.com/docker/distribution/registry/client/auth"
-	"github.com/docker/distribution/registry/client/auth/challenge"
-	"github.com/docker/distribution/registry/client/transport"
-	"github.com/docker/engine-api/types"
 	"github.com/uber/makisu/lib/utils/httputil"
 )
 
 const (
 	basePingQuery         = "https://%s/v2/"
 	registryVersionHeader = "Docker-Distribution-Api-Version"
+	registryV2Version     = "registry/2.0"
 )
 
-var v2Version = auth.APIVersion{
-	Type:    "registry",
-	Version: "2.0",
-}
-
-// BasicAuthTransport creates a transport that does basic authentication.
-func BasicAuthTransport(addr, repo string, tr http.RoundTripper, authConfig types.AuthConfig) (http.RoundTripper, error) {
-	cm, err := ping(addr, tr)
+// BasicAuthTransport creates a transport that authenticates the requests sent
+// to the registry at addr with the given credentials, as the registry asks for
+// when pinged.
+func BasicAuthTransport(addr, repo string, tr http.RoundTripper, authConfig AuthConfig) (http.RoundTripper, error) {
+	challenges, err := ping(addr, tr)
 	if err != nil {
 		return nil, fmt.Errorf("ping v2 registry: %s", err)
 	}
-	// This looks weird but when using AWS ECR (especially the docker ecr helper) we get a Username and a Password
-	// Then, the ping will create a challenge by parsing the www-authenticate header from the ECR server (it will return a "Basic ...")
-	// So if we use the `NewTokenHandlerWithOptions` we will always fail the Scheme checking in vendor/github.com/docker/distribution/registry/client/auth/session.go#L98 ("basic" != "bearer")
-	if authConfig.Username != "" && authConfig.Password != "" && strings.HasSuffix(addr, "amazonaws.com") {
-		return transport.NewTransport(tr, auth.NewAuthorizer(cm, auth.NewBasicHandler(defaultCredStore{authConfig}))), nil
-	} else {
-		return transport.NewTransport(tr, auth.NewAuthorizer(cm, auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
-			Transport:   tr,
-			Credentials: defaultCredStore{authConfig},
-			Scopes: []auth.Scope{
-				auth.RepositoryScope{
-					Repository: repo,
-					Actions:    []string{"pull", "push"},
-				},
-			},
-			ClientID:   "docker",
-			ForceOAuth: false, // Only support basic auth.
-		}))), nil
+	authorizer := NewAuthorizer(challenges, authConfig, repo, tr)
+	if authorizer == nil {
+		return tr, nil
 	}
+	return &authTransport{base: tr, host: addr, authorizer: authorizer}, nil
 }
 
-func ping(addr string, tr http.RoundTripper) (challenge.Manager, error) {
+// ping returns the challenges of a v2 registry.
+func ping(addr string, tr http.RoundTripper) ([]Challenge, error) {
 	resp, err := httputil.Send(
 		"GET",
 		fmt.Sprintf(basePingQuery, addr),
@@ -74,30 +56,70 @@ func ping(addr string, tr http.RoundTripper) (challenge.Manager, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	versions := auth.APIVersions(resp, registryVersionHeader)
-	for _, version := range versions {
-		if version == v2Version {
-			cm := challenge.NewSimpleManager()
-			if err := cm.AddResponse(resp); err != nil {
-				return nil, fmt.Errorf("add response: %s", err)
+	for _, value := range resp.Header[http.CanonicalHeaderKey(registryVersionHeader)] {
+		for _, version := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if version == registryV2Version {
+				return ResponseChallenges(resp), nil
 			}
-			return cm, nil
 		}
 	}
 	return nil, fmt.Errorf("registry is not v2")
 }
 
-type defaultCredStore struct {
-	config types.AuthConfig
+// authTransport authorizes the requests to the API of a registry. Requests to
+// other hosts, like redirects to blob storage, are sent as is, so credentials
+// don't leak to them.
+type authTransport struct {
+	base       http.RoundTripper
+	host       string
+	authorizer Authorizer
 }
 
-func (scs defaultCredStore) Basic(*url.URL) (string, string) {
-	return scs.config.Username, scs.config.Password
-}
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host || !strings.Contains(req.URL.Path, "/v2/") {
+		return t.base.RoundTrip(req)
+	}
+	resp, authorization, err := t.authorizedRoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
 
-func (scs defaultCredStore) RefreshToken(*url.URL, string) string {
-	return scs.config.IdentityToken
+	// Tokens can be rejected before they expire, when the registry gives
+	// them a shorter lifetime than it announced or revokes them. The request
+	// is sent again once with a new token, if its body can be sent again.
+	// Callers streaming bodies, like chunked uploads, get the 401 and resume
+	// with the new token instead.
+	i, ok := t.authorizer.(invalidator)
+	if !ok || !i.invalidate(authorization) {
+		return resp, nil
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	resp, _, err = t.authorizedRoundTrip(req)
+	return resp, err
 }
 
-func (scs defaultCredStore) SetRefreshToken(*url.URL, string, string) {}
+// authorizedRoundTrip sends a copy of req with credentials, and returns the
+// authorization header it was sent with.
+func (t *authTransport) authorizedRoundTrip(req *http.Request) (*http.Response, string, error) {
+	// Round trippers must not modify the request.
+	req = req.Clone(req.Context())
+	if err := t.authorizer.Authorize(req); err != nil {
+		return nil, "", fmt.Errorf("authorize request: %s", err)
+	}
+	resp, err := t.base.RoundTrip(req)
+	return resp, req.Header.Get("Authorization"), err
+}
@@ -0,0 +1,110 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Challenge is an authentication challenge of a registry, parsed from a
+// WWW-Authenticate header, like:
+//
+//	Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+type Challenge struct {
+	// Scheme is the lower case scheme of the challenge, like "basic" or
+	// "bearer".
+	Scheme string
+	// Parameters are the parameters of the challenge, with lower case keys.
+	Parameters map[string]string
+}
+
+// ResponseChallenges returns the challenges of a response, which only 401
+// responses have.
+func ResponseChallenges(resp *http.Response) []Challenge {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	return ParseChallenges(resp.Header)
+}
+
+// ParseChallenges returns the challenges of the WWW-Authenticate headers.
+// Invalid parameters end the parameters of their challenge.
+func ParseChallenges(header http.Header) []Challenge {
+	var challenges []Challenge
+	for _, h := range header[http.CanonicalHeaderKey("WWW-Authenticate")] {
+		scheme, rest := readToken(h)
+		if scheme == "" {
+			continue
+		}
+		c := Challenge{Scheme: strings.ToLower(scheme), Parameters: make(map[string]string)}
+		rest = "," + skipSpace(rest)
+		for strings.HasPrefix(rest, ",") {
+			var key, value string
+			key, rest = readToken(skipSpace(rest[1:]))
+			if key == "" || !strings.HasPrefix(rest, "=") {
+				break
+			}
+			value, rest = readTokenOrQuoted(rest[1:])
+			if value == "" {
+				break
+			}
+			c.Parameters[strings.ToLower(key)] = value
+			rest = skipSpace(rest)
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges
+}
+
+// isTokenChar returns true if c can be part of a token of RFC 7230.
+func isTokenChar(c byte) bool {
+	return c > 31 && c < 127 && !strings.ContainsRune(" \t\"(),/:;<=>?@[]\\{}", rune(c))
+}
+
+func skipSpace(s string) string {
+	return strings.TrimLeft(s, " \t\r\n")
+}
+
+func readToken(s string) (string, string) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// readTokenOrQuoted reads a token, or a quoted string with its escapes
+// removed. Unterminated strings read as empty.
+func readTokenOrQuoted(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		return readToken(s)
+	}
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return value.String(), s[i+1:]
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+			}
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,57 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChallenges(t *testing.T) {
+	require := require.New(t)
+
+	header := http.Header{}
+	header.Add("WWW-Authenticate",
+		`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`)
+	header.Add("WWW-Authenticate", `Basic realm=registry`)
+	header.Add("WWW-Authenticate", `Bearer realm="https://auth.example.com/\"token\"", error=invalid_token`)
+	header.Add("WWW-Authenticate", `Bearer realm="unterminated`)
+	header.Add("WWW-Authenticate", ``)
+
+	require.Equal([]Challenge{
+		{Scheme: "bearer", Parameters: map[string]string{
+			"realm":   "https://auth.docker.io/token",
+			"service": "registry.docker.io",
+			"scope":   "repository:library/alpine:pull",
+		}},
+		{Scheme: "basic", Parameters: map[string]string{"realm": "registry"}},
+		{Scheme: "bearer", Parameters: map[string]string{
+			"realm": `https://auth.example.com/"token"`,
+			"error": "invalid_token",
+		}},
+		{Scheme: "bearer", Parameters: map[string]string{}},
+	}, ParseChallenges(header))
+}
+
+func TestResponseChallenges(t *testing.T) {
+	require := require.New(t)
+
+	header := http.Header{}
+	header.Set("WWW-Authenticate", `Basic realm="registry"`)
+	require.Len(ResponseChallenges(&http.Response{StatusCode: http.StatusUnauthorized, Header: header}), 1)
+	require.Empty(ResponseChallenges(&http.Response{StatusCode: http.StatusOK, Header: header}))
+}
@@ -0,0 +1,144 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/GoogleCloudPlatform/docker-credential-gcr/config"
+	"github.com/GoogleCloudPlatform/docker-credential-gcr/credhelper"
+	"github.com/GoogleCloudPlatform/docker-credential-gcr/store"
+	"github.com/uber/makisu/lib/pathutils"
+
+	ecr "github.com/awslabs/amazon-ecr-credential-helper/ecr-login"
+	"github.com/awslabs/amazon-ecr-credential-helper/ecr-login/api"
+	"github.com/docker/docker-credential-helpers/client"
+)
+
+const tokenUsername = "<token>"
+
+var credentialHelperPrefix = path.Join(pathutils.DefaultInternalDir, "docker-credential-")
+
+// CredentialProvider returns the credentials to authenticate with a registry.
+type CredentialProvider interface {
+	Credentials(addr string) (AuthConfig, error)
+}
+
+// credentialGetter is the part of the ECR and GCR credential helpers used to
+// get credentials.
+type credentialGetter interface {
+	Get(serverURL string) (string, string, error)
+}
+
+// The credential helpers are created by functions that tests replace, to
+// test without network.
+var (
+	_newECRHelper = func() (credentialGetter, error) {
+		return ecr.ECRHelper{ClientFactory: api.DefaultClientFactory{}}, nil
+	}
+	_newGCRHelper = func() (credentialGetter, error) {
+		store, err := store.DefaultGCRCredStore()
+		if err != nil {
+			return nil, err
+		}
+		userCfg, err := config.LoadUserConfig()
+		if err != nil {
+			return nil, err
+		}
+		return credhelper.NewGCRCredentialHelper(store, userCfg), nil
+	}
+	_newHelperProgram = client.NewShellProgramFunc
+)
+
+// NewCredentialProvider returns the provider of the credentials of a config:
+// its credentials store if set, or its basic auth config. It returns nil if
+// the config has neither.
+func NewCredentialProvider(c Config) CredentialProvider {
+	switch {
+	case c.RemoteCredentialsStore == "ecr-login":
+		return &helperCredentials{name: "ECR", newHelper: _newECRHelper}
+	case c.RemoteCredentialsStore == "gcr":
+		return &helperCredentials{name: "GCR", newHelper: _newGCRHelper}
+	case c.RemoteCredentialsStore != "":
+		return &programCredentials{
+			program: credentialHelperPrefix + c.RemoteCredentialsStore,
+			basic:   c.BasicAuth,
+		}
+	case c.BasicAuth != nil:
+		return &basicCredentials{c.BasicAuth}
+	}
+	return nil
+}
+
+// basicCredentials are the credentials of the basic auth config.
+type basicCredentials struct {
+	config *BasicAuthConfig
+}
+
+func (b *basicCredentials) Credentials(addr string) (AuthConfig, error) {
+	authConfig, err := b.config.Get()
+	if err != nil {
+		return AuthConfig{}, fmt.Errorf("get basic auth config: %s", err)
+	}
+	return authConfig, nil
+}
+
+// helperCredentials get credentials from a credential helper built in
+// makisu.
+type helperCredentials struct {
+	name      string
+	newHelper func() (credentialGetter, error)
+}
+
+func (h *helperCredentials) Credentials(addr string) (AuthConfig, error) {
+	helper, err := h.newHelper()
+	if err != nil {
+		return AuthConfig{}, fmt.Errorf("get credentials from helper %s: %s", h.name, err)
+	}
+	username, password, err := helper.Get(addr)
+	if err != nil {
+		return AuthConfig{}, fmt.Errorf("get credentials from helper %s: %s", h.name, err)
+	}
+	return AuthConfig{Username: username, Password: password}, nil
+}
+
+// programCredentials get credentials from a docker credential helper
+// program, installed in the internal dir of makisu. The basic auth config,
+// if any, is the base of the credentials.
+type programCredentials struct {
+	program string
+	basic   *BasicAuthConfig
+}
+
+func (p *programCredentials) Credentials(addr string) (AuthConfig, error) {
+	creds, err := client.Get(_newHelperProgram(p.program), addr)
+	if err != nil {
+		return AuthConfig{}, fmt.Errorf("get credentials from helper %s: %s", p.program, err)
+	}
+	var authConfig AuthConfig
+	if p.basic != nil {
+		if authConfig, err = p.basic.Get(); err != nil {
+			return AuthConfig{}, fmt.Errorf("get basic auth config: %s", err)
+		}
+	}
+	authConfig.ServerAddress = addr
+	if creds.Username == tokenUsername {
+		authConfig.IdentityToken = creds.Secret
+	} else {
+		authConfig.Username, authConfig.Password = creds.Username, creds.Secret
+	}
+	return authConfig, nil
+}
@@ -0,0 +1,172 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+type fakeHelper struct {
+	username, password string
+	err                error
+	servers            []string
+}
+
+func (h *fakeHelper) Get(serverURL string) (string, string, error) {
+	h.servers = append(h.servers, serverURL)
+	return h.username, h.password, h.err
+}
+
+// fakeProgram answers the "get" command of docker credential helpers.
+type fakeProgram struct {
+	username, secret string
+	server           string
+}
+
+func (p *fakeProgram) Input(in io.Reader) {
+	b, _ := ioutil.ReadAll(in)
+	p.server = strings.TrimSpace(string(b))
+}
+
+func (p *fakeProgram) Output() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"ServerURL":%q,"Username":%q,"Secret":%q}`,
+		p.server, p.username, p.secret)), nil
+}
+
+func fakeHelperProgram(username, secret string, names *[]string) func(string) client.ProgramFunc {
+	return func(name string) client.ProgramFunc {
+		*names = append(*names, name)
+		return func(args ...string) client.Program {
+			return &fakeProgram{username: username, secret: secret}
+		}
+	}
+}
+
+func TestCredentialProviderHelpers(t *testing.T) {
+	require := require.New(t)
+
+	ecr := &fakeHelper{username: "AWS", password: "ecr-password"}
+	gcr := &fakeHelper{err: errors.New("no credentials")}
+	defer func(ecrHelper, gcrHelper func() (credentialGetter, error)) {
+		_newECRHelper, _newGCRHelper = ecrHelper, gcrHelper
+	}(_newECRHelper, _newGCRHelper)
+	_newECRHelper = func() (credentialGetter, error) { return ecr, nil }
+	_newGCRHelper = func() (credentialGetter, error) { return gcr, nil }
+
+	authConfig, err := NewCredentialProvider(Config{RemoteCredentialsStore: "ecr-login"}).
+		Credentials("1234.dkr.ecr.us-east-1.amazonaws.com")
+	require.NoError(err)
+	require.Equal(AuthConfig{Username: "AWS", Password: "ecr-password"}, authConfig)
+	require.Equal([]string{"1234.dkr.ecr.us-east-1.amazonaws.com"}, ecr.servers)
+
+	_, err = NewCredentialProvider(Config{RemoteCredentialsStore: "gcr"}).Credentials("gcr.io")
+	require.Error(err)
+	require.Contains(err.Error(), "helper GCR: no credentials")
+}
+
+func TestCredentialProviderProgram(t *testing.T) {
+	require := require.New(t)
+
+	var names []string
+	defer func(f func(string) client.ProgramFunc) { _newHelperProgram = f }(_newHelperProgram)
+	_newHelperProgram = fakeHelperProgram("user", "pass", &names)
+
+	provider := NewCredentialProvider(Config{
+		RemoteCredentialsStore: "secretservice",
+		BasicAuth:              &BasicAuthConfig{AuthConfig: AuthConfig{Username: "basic", Email: "me@example.com"}},
+	})
+	authConfig, err := provider.Credentials("registry.example.com")
+	require.NoError(err)
+	require.Equal(AuthConfig{
+		Username:      "user",
+		Password:      "pass",
+		Email:         "me@example.com",
+		ServerAddress: "registry.example.com",
+	}, authConfig)
+	require.Equal([]string{credentialHelperPrefix + "secretservice"}, names)
+
+	// Helpers return identity tokens with a special username.
+	_newHelperProgram = fakeHelperProgram(tokenUsername, "refresh", &names)
+	authConfig, err = NewCredentialProvider(Config{RemoteCredentialsStore: "secretservice"}).
+		Credentials("registry.example.com")
+	require.NoError(err)
+	require.Equal(AuthConfig{ServerAddress: "registry.example.com", IdentityToken: "refresh"}, authConfig)
+}
+
+func TestCredentialProviderBasic(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(NewCredentialProvider(Config{}))
+
+	tmpDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	passwordFile := filepath.Join(tmpDir, "password")
+	require.NoError(ioutil.WriteFile(passwordFile, []byte("pass"), 0600))
+
+	authConfig, err := NewCredentialProvider(Config{BasicAuth: &BasicAuthConfig{
+		AuthConfig:   AuthConfig{Username: "user"},
+		PasswordFile: passwordFile,
+	}}).Credentials("registry.example.com")
+	require.NoError(err)
+	require.Equal(AuthConfig{Username: "user", Password: "pass"}, authConfig)
+
+	_, err = NewCredentialProvider(Config{BasicAuth: &BasicAuthConfig{
+		PasswordFile: filepath.Join(tmpDir, "missing"),
+	}}).Credentials("registry.example.com")
+	require.Error(err)
+}
+
+func TestGetHTTPOptionECR(t *testing.T) {
+	require := require.New(t)
+
+	defer func(f func() (credentialGetter, error)) { _newECRHelper = f }(_newECRHelper)
+	_newECRHelper = func() (credentialGetter, error) {
+		return &fakeHelper{username: "AWS", password: "ecr-password"}, nil
+	}
+
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(registryVersionHeader, registryV2Version)
+		if username, password, ok := r.BasicAuth(); !ok || username != "AWS" || password != "ecr-password" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ecr"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer registry.Close()
+	addr := strings.TrimPrefix(registry.URL, "https://")
+
+	config := Config{
+		RemoteCredentialsStore: "ecr-login",
+		TLS:                    &httputil.TLSConfig{CA: httputil.X509Pair{Disabled: true}},
+	}
+	opt, err := config.GetHTTPOption(addr, "app")
+	require.NoError(err)
+	resp, err := httputil.Send("GET", registry.URL+"/v2/app/manifests/latest", opt)
+	require.NoError(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+}
@@ -19,38 +19,45 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"path"
 
-	"github.com/GoogleCloudPlatform/docker-credential-gcr/config"
-	"github.com/GoogleCloudPlatform/docker-credential-gcr/credhelper"
-	"github.com/GoogleCloudPlatform/docker-credential-gcr/store"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/utils"
 	"github.com/uber/makisu/lib/utils/httputil"
-
-	ecr "github.com/awslabs/amazon-ecr-credential-helper/ecr-login"
-	"github.com/awslabs/amazon-ecr-credential-helper/ecr-login/api"
-	"github.com/docker/docker-credential-helpers/client"
-	"github.com/docker/engine-api/types"
 )
 
-const tokenUsername = "<token>"
+// AuthConfig holds the credentials of a registry. Its fields and their keys
+// are the ones of the auth config of docker.
+type AuthConfig struct {
+	Username string `yaml:"username" json:"username,omitempty"`
+	Password string `yaml:"password" json:"password,omitempty"`
+	Auth     string `yaml:"auth" json:"auth,omitempty"`
+
+	// Email is deprecated, and ignored.
+	Email string `yaml:"email" json:"email,omitempty"`
+
+	ServerAddress string `yaml:"serveraddress" json:"serveraddress,omitempty"`
+
+	// IdentityToken is a refresh token, exchanged for an access token with
+	// OAuth.
+	IdentityToken string `yaml:"identitytoken" json:"identitytoken,omitempty"`
 
-var credentialHelperPrefix = path.Join(pathutils.DefaultInternalDir, "docker-credential-")
+	// RegistryToken is a bearer token sent to the registry as is.
+	RegistryToken string `yaml:"registrytoken" json:"registrytoken,omitempty"`
+}
 
-// BasicAuthConfig is a simple wrapper of Docker's types.AuthConfig with addtional support
-// for a password file.
+// BasicAuthConfig is an AuthConfig with addtional support for a password
+// file.
 type BasicAuthConfig struct {
-	types.AuthConfig `yaml:",inline"`
-	PasswordFile     string `yaml:"password_file" json:"password_file"`
+	AuthConfig   `yaml:",inline"`
+	PasswordFile string `yaml:"password_file" json:"password_file"`
 }
 
 // Get returns an AuthConfig.
-func (c *BasicAuthConfig) Get() (types.AuthConfig, error) {
+func (c *BasicAuthConfig) Get() (AuthConfig, error) {
 	if c.PasswordFile != "" {
 		password, err := ioutil.ReadFile(c.PasswordFile)
 		if err != nil {
-			return types.AuthConfig{}, fmt.Errorf("read password file: %s", err)
+			return AuthConfig{}, fmt.Errorf("read password file: %s", err)
 		}
 		c.AuthConfig.Password = string(password)
 	}
@@ -77,7 +84,7 @@ func (c Config) ApplyDefaults() Config {
 
 // GetHTTPOption returns httputil.Option based on the security configuration.
 func (c Config) GetHTTPOption(addr, repo string) (httputil.SendOption, error) {
-	shouldUseBasicAuth := (c.BasicAuth != nil || c.RemoteCredentialsStore != "")
+	provider := NewCredentialProvider(c)
 
 	var tlsClientConfig *tls.Config
 	var err error
@@ -86,17 +93,17 @@ func (c Config) GetHTTPOption(addr, repo string) (httputil.SendOption, error) {
 		if err != nil {
 			return nil, fmt.Errorf("build tls config: %s", err)
 		}
-		if !shouldUseBasicAuth {
+		if provider == nil {
 			return httputil.SendTLS(tlsClientConfig), nil
 		}
 	}
 
-	if shouldUseBasicAuth {
-		authConfig, err := c.getCredentials(c.RemoteCredentialsStore, addr)
+	if provider != nil {
+		authConfig, err := provider.Credentials(addr)
 		if err != nil {
 			return nil, fmt.Errorf("get credentials: %s", err)
 		}
-		tr := http.DefaultTransport.(*http.Transport)
+		tr := http.DefaultTransport.(*http.Transport).Clone()
 		tr.TLSClientConfig = tlsClientConfig // If tlsClientConfig is nil, default is used.
 		rt, err := BasicAuthTransport(addr, repo, tr, authConfig)
 		if err != nil {
@@ -106,75 +113,3 @@ func (c Config) GetHTTPOption(addr, repo string) (httputil.SendOption, error) {
 	}
 	return httputil.SendNoop(), nil
 }
-
-func (c Config) getCredentials(helper, addr string) (types.AuthConfig, error) {
-	var authConfig types.AuthConfig
-	var err error
-	if c.BasicAuth != nil {
-		authConfig, err = c.BasicAuth.Get()
-		if err != nil {
-			return types.AuthConfig{}, fmt.Errorf("get basic auth config: %s", err)
-		}
-	}
-	if helper != "" {
-		authConfig, err = c.getCredentialFromHelper(helper, addr)
-		if err != nil {
-			return types.AuthConfig{}, fmt.Errorf("get credentials from helper %s: %s", helper, err)
-		}
-	}
-	return authConfig, nil
-}
-
-func (c Config) getCredentialFromHelper(helper, addr string) (types.AuthConfig, error) {
-	switch helper {
-	case "ecr-login":
-		client := ecr.ECRHelper{ClientFactory: api.DefaultClientFactory{}}
-		username, password, err := client.Get(addr)
-		if err != nil {
-			return types.AuthConfig{}, fmt.Errorf("get credentials from helper ECR: %s", err)
-		}
-		return types.AuthConfig{
-			Username: username,
-			Password: password,
-		}, nil
-	case "gcr":
-		store, err := store.DefaultGCRCredStore()
-		if err != nil {
-			return types.AuthConfig{}, fmt.Errorf("get credentials from helper GCR: %s", err)
-		}
-		userCfg, err := config.LoadUserConfig()
-		if err != nil {
-			return types.AuthConfig{}, fmt.Errorf("get credentials from helper GCR: %s", err)
-		}
-		username, password, err := credhelper.NewGCRCredentialHelper(store, userCfg).Get(addr)
-		if err != nil {
-			return types.AuthConfig{}, fmt.Errorf("get credentials from helper GCR: %s", err)
-		}
-		return types.AuthConfig{
-			Username: username,
-			Password: password,
-		}, nil
-	default:
-		helperFullName := credentialHelperPrefix + helper
-		creds, err := client.Get(client.NewShellProgramFunc(helperFullName), addr)
-		if err != nil {
-			return types.AuthConfig{}, err
-		}
-
-		var ret types.AuthConfig
-		if c.BasicAuth != nil {
-			ret, err = c.BasicAuth.Get()
-			if err != nil {
-				return types.AuthConfig{}, fmt.Errorf("get basic auth config: %s", err)
-			}
-		}
-		ret.ServerAddress = addr
-		if creds.Username == tokenUsername {
-			ret.IdentityToken = creds.Secret
-		} else {
-			ret.Password = creds.Secret
-			ret.Username = creds.Username
-		}
-		return ret, nil
-	}
-}
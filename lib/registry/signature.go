@@ -0,0 +1,181 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+)
+
+const (
+	// MediaTypeSimpleSigning is the media type of the payloads signed by cosign.
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// SignatureAnnotation is the annotation of signature layers holding the
+	// base64 encoded signature of their payload.
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// SignatureTag returns the tag of the signatures of a manifest, which cosign
+// derives from its digest.
+func SignatureTag(digest image.Digest) string {
+	return strings.Replace(string(digest), ":", "-", 1) + ".sig"
+}
+
+// PushSignature pushes a signature of the manifest with the given digest, in
+// the format of cosign: an image tagged with SignatureTag whose layers are the
+// signed payloads, annotated with their signatures. Signatures already pushed
+// under that tag are kept.
+func (c DockerRegistryClient) PushSignature(
+	digest image.Digest, payload []byte, signature string) error {
+
+	tag := SignatureTag(digest)
+	manifest := image.DistributionManifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIManifest,
+	}
+	if found, err := c.manifestExists(tag); err != nil {
+		return fmt.Errorf("check signature manifest exists: %s", err)
+	} else if found {
+		mediaType, content, err := c.pullRawManifest(tag)
+		if err != nil {
+			return fmt.Errorf("pull signature manifest: %s", err)
+		} else if mediaType != image.MediaTypeOCIManifest && mediaType != image.MediaTypeManifest {
+			return fmt.Errorf("unsupported signature manifest media type %s", mediaType)
+		}
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return fmt.Errorf("unmarshal signature manifest: %s", err)
+		}
+	}
+
+	layer, err := c.pushBlob(payload, false)
+	if err != nil {
+		return fmt.Errorf("push signature payload: %s", err)
+	}
+	layer.MediaType = MediaTypeSimpleSigning
+	layer.Annotations = map[string]string{SignatureAnnotation: signature}
+	for _, l := range manifest.Layers {
+		if l.Digest == layer.Digest && l.Annotations[SignatureAnnotation] == signature {
+			log.Infof("* Signature of %s already exists", digest)
+			return nil
+		}
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+
+	// The payloads are not compressed, so their digests are also the diff IDs.
+	config := image.Config{RootFS: &image.RootFS{Type: "layers"}}
+	for _, l := range manifest.Layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, l.Digest)
+	}
+	configJSON, err := json.Marshal(&config)
+	if err != nil {
+		return fmt.Errorf("marshal signature config: %s", err)
+	}
+	if manifest.Config, err = c.pushBlob(configJSON, true); err != nil {
+		return fmt.Errorf("push signature config: %s", err)
+	}
+	manifest.Config.MediaType = image.MediaTypeOCIConfig
+	if manifest.MediaType == image.MediaTypeManifest {
+		manifest.Config.MediaType = image.MediaTypeConfig
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("marshal signature manifest: %s", err)
+	}
+	if err := c.pushRawManifest(tag, manifest.MediaType, content); err != nil {
+		return fmt.Errorf("push signature manifest: %s", err)
+	}
+	log.Infof("* Pushed signature of %s to %s/%s:%s", digest, c.registry, c.repository, tag)
+	return nil
+}
+
+// pushBlob saves content in the image store, and pushes it as a blob.
+func (c DockerRegistryClient) pushBlob(content []byte, isConfig bool) (image.Descriptor, error) {
+	digest, err := image.NewDigester().FromBytes(content)
+	if err != nil {
+		return image.Descriptor{}, fmt.Errorf("compute digest: %s", err)
+	}
+	blobPath := path.Join(c.store.SandboxDir, digest.Hex())
+	if err := ioutil.WriteFile(blobPath, content, 0644); err != nil {
+		return image.Descriptor{}, fmt.Errorf("write blob: %s", err)
+	}
+	if err := c.store.Layers.LinkStoreFileFrom(digest.Hex(), blobPath); err != nil && !os.IsExist(err) {
+		return image.Descriptor{}, fmt.Errorf("commit blob to store: %s", err)
+	}
+	if err := c.pushLayerWithBackoff(digest, isConfig); err != nil {
+		return image.Descriptor{}, err
+	}
+	return image.Descriptor{Size: int64(len(content)), Digest: digest}, nil
+}
+
+// Signature is a signed payload, with its signature encoded in base64.
+type Signature struct {
+	Payload   []byte
+	Signature string
+}
+
+// PullSignatures pulls the signatures of the manifest with the given digest
+// pushed in the format of cosign. It returns no signatures if there are none.
+func (c DockerRegistryClient) PullSignatures(digest image.Digest) ([]Signature, error) {
+	tag := SignatureTag(digest)
+	if found, err := c.manifestExists(tag); err != nil {
+		return nil, fmt.Errorf("check signature manifest exists: %s", err)
+	} else if !found {
+		return nil, nil
+	}
+	_, content, err := c.pullRawManifest(tag)
+	if err != nil {
+		return nil, fmt.Errorf("pull signature manifest: %s", err)
+	}
+	var manifest image.DistributionManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("unmarshal signature manifest: %s", err)
+	}
+
+	var signatures []Signature
+	for _, layer := range manifest.Layers {
+		signature, ok := layer.Annotations[SignatureAnnotation]
+		if layer.MediaType != MediaTypeSimpleSigning || !ok {
+			continue
+		}
+		if _, err := c.PullLayer(layer.Digest); err != nil {
+			return nil, fmt.Errorf("pull signature payload %s: %s", layer.Digest, err)
+		}
+		payload, err := c.readBlob(layer.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("read signature payload %s: %s", layer.Digest, err)
+		}
+		signatures = append(signatures, Signature{Payload: payload, Signature: signature})
+	}
+	return signatures, nil
+}
+
+// readBlob reads a blob of the image store.
+func (c DockerRegistryClient) readBlob(digest image.Digest) ([]byte, error) {
+	r, err := c.store.Layers.GetStoreFileReader(digest.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
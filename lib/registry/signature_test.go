@@ -0,0 +1,82 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushSignature(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+
+	transport := newMemRegistryTransport()
+	c := NewWithClient(ctx.ImageStore, "example.com", "app", &http.Client{Transport: transport})
+	c.config.Security.TLS.Client.Disabled = true
+
+	digest := image.Digest("sha256:abcd")
+	tag := SignatureTag(digest)
+	require.Equal("sha256-abcd.sig", tag)
+
+	getManifest := func() image.DistributionManifest {
+		m, ok := transport.manifests["app@"+tag]
+		require.True(ok)
+		require.Equal(image.MediaTypeOCIManifest, m.mediaType)
+		var manifest image.DistributionManifest
+		require.NoError(json.Unmarshal(m.content, &manifest))
+		return manifest
+	}
+
+	require.NoError(c.PushSignature(digest, []byte("payload"), "sig1"))
+	manifest := getManifest()
+	require.Len(manifest.Layers, 1)
+	layer := manifest.Layers[0]
+	require.Equal(MediaTypeSimpleSigning, layer.MediaType)
+	require.Equal("sig1", layer.Annotations[SignatureAnnotation])
+	require.Equal([]byte("payload"), transport.blobs["app@"+string(layer.Digest)])
+	require.Equal(image.MediaTypeOCIConfig, manifest.Config.MediaType)
+	require.Contains(transport.blobs, "app@"+string(manifest.Config.Digest))
+
+	// Other signatures are kept, and existing ones aren't duplicated.
+	require.NoError(c.PushSignature(digest, []byte("payload"), "sig2"))
+	require.NoError(c.PushSignature(digest, []byte("payload"), "sig1"))
+	manifest = getManifest()
+	require.Len(manifest.Layers, 2)
+	require.Equal("sig1", manifest.Layers[0].Annotations[SignatureAnnotation])
+	require.Equal("sig2", manifest.Layers[1].Annotations[SignatureAnnotation])
+
+	var config image.Config
+	require.NoError(json.Unmarshal(transport.blobs["app@"+string(manifest.Config.Digest)], &config))
+	require.Equal([]image.Digest{layer.Digest, layer.Digest}, config.RootFS.DiffIDs)
+
+	signatures, err := c.PullSignatures(digest)
+	require.NoError(err)
+	require.Equal([]Signature{
+		{Payload: []byte("payload"), Signature: "sig1"},
+		{Payload: []byte("payload"), Signature: "sig2"},
+	}, signatures)
+
+	signatures, err = c.PullSignatures("sha256:ef")
+	require.NoError(err)
+	require.Empty(signatures)
+}
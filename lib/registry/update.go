@@ -0,0 +1,57 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// ImageUpdate compares the image a tag points to in the local store, as of the
+// last pull, with the one it points to in the registry. Images are compared by
+// the digest of their config, that is their image ID, since manifests are
+// saved for the platform of the client only.
+type ImageUpdate struct {
+	// Local is empty if the tag was never pulled.
+	Local  image.Digest
+	Remote image.Digest
+}
+
+// Outdated returns true if the tag points to another image in the registry
+// than in the local store.
+func (u ImageUpdate) Outdated() bool {
+	return u.Local != "" && u.Local != u.Remote
+}
+
+// StoredManifest returns the manifest of a tag saved in the local store.
+func (c DockerRegistryClient) StoredManifest(tag string) (*image.DistributionManifest, error) {
+	return c.loadManifest(tag)
+}
+
+// CheckUpdate compares the image of a tag in the local store with the one in
+// the registry, without pulling it.
+func (c DockerRegistryClient) CheckUpdate(tag string) (ImageUpdate, error) {
+	var update ImageUpdate
+	if stored, err := c.loadManifest(tag); err == nil {
+		update.Local = stored.Config.Digest
+	}
+	manifest, err := c.PullManifest(tag)
+	if err != nil {
+		return update, fmt.Errorf("pull manifest: %s", err)
+	}
+	update.Remote = manifest.Config.Digest
+	return update, nil
+}
@@ -0,0 +1,71 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"testing"
+
+	"github.com/uber/makisu/lib/context"
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/utils/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckUpdate(t *testing.T) {
+	require := require.New(t)
+	ctx, cleanup := context.BuildContextFixture()
+	defer cleanup()
+	// Other tests report the manifest missing.
+	_notFound = newNotFoundCache()
+
+	p, err := PullClientFixtureWithAlpine(ctx)
+	require.NoError(err)
+
+	// Never pulled.
+	update, err := p.CheckUpdate(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Empty(update.Local)
+	require.NotEmpty(update.Remote)
+	require.False(update.Outdated())
+
+	manifest, err := p.Pull(testutil.SampleImageTag)
+	require.NoError(err)
+	update, err = p.CheckUpdate(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(manifest.Config.Digest, update.Local)
+	require.False(update.Outdated())
+
+	// The tag pointed to another image when it was last pulled.
+	previous := *manifest
+	previous.Config.Digest = image.Digest(
+		"sha256:2a3dd484ecfcf9343994e0f6c2af0a6faf1af7f7e499905793643f91e90edcb3")
+	require.NoError(p.saveManifest(testutil.SampleImageTag, &previous))
+	stored, err := p.StoredManifest(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(previous.Config.Digest, stored.Config.Digest)
+	update, err = p.CheckUpdate(testutil.SampleImageTag)
+	require.NoError(err)
+	require.Equal(previous.Config.Digest, update.Local)
+	require.Equal(manifest.Config.Digest, update.Remote)
+	require.True(update.Outdated())
+
+	// Pulls replace the outdated manifest.
+	_, err = p.Pull(testutil.SampleImageTag)
+	require.NoError(err)
+	update, err = p.CheckUpdate(testutil.SampleImageTag)
+	require.NoError(err)
+	require.False(update.Outdated())
+}
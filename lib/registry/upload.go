@@ -0,0 +1,131 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package registry
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/uber/makisu/lib/docker/image"
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+// LayerUpload is a chunked blob upload that receives the content of a layer
+// while it is being generated, before its digest is known. It buffers at most
+// one chunk of the configured push_chunk size in memory.
+type LayerUpload struct {
+	client   DockerRegistryClient
+	location string
+	offset   int64
+	buf      []byte
+}
+
+// StartLayerUpload starts a streamed layer upload. It fails if chunked upload
+// is turned off in the registry config, since registries that don't support it
+// need the size of the layer upfront.
+func (c DockerRegistryClient) StartLayerUpload() (*LayerUpload, error) {
+	if c.config.PushChunk <= 0 {
+		return nil, errors.New("chunked upload is disabled for this registry")
+	}
+	location, err := c.startUpload()
+	if err != nil {
+		return nil, err
+	}
+	return &LayerUpload{
+		client:   c,
+		location: location,
+		buf:      make([]byte, 0, c.config.PushChunk),
+	}, nil
+}
+
+// Write implements io.Writer. It sends a chunk every time the buffer is full.
+func (u *LayerUpload) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := copy(u.buf[len(u.buf):cap(u.buf)], p)
+		u.buf = u.buf[:len(u.buf)+n]
+		p = p[n:]
+		written += n
+		if len(u.buf) == cap(u.buf) {
+			if err := u.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush sends the buffered content as one chunk.
+func (u *LayerUpload) flush() error {
+	if len(u.buf) == 0 {
+		return nil
+	}
+	end := u.offset + int64(len(u.buf)) - 1
+	location, err := u.client.pushOneLayerChunk(u.location, u.offset, end, bytes.NewReader(u.buf))
+	if err != nil {
+		return fmt.Errorf("push layer chunk: %w", err)
+	}
+	u.location = location
+	u.offset = end + 1
+	u.buf = u.buf[:0]
+	return nil
+}
+
+// Commit sends the remaining content, and completes the upload of the layer
+// with the given digest.
+func (u *LayerUpload) Commit(digest image.Digest) error {
+	if err := u.flush(); err != nil {
+		return err
+	}
+	parsed, err := url.Parse(u.location)
+	if err != nil {
+		return fmt.Errorf("failed to parse location: %s", err)
+	}
+	q := parsed.Query()
+	q.Add("digest", string(digest))
+	parsed.RawQuery = q.Encode()
+	if err := u.client.commitLayer(parsed.String()); err != nil {
+		return fmt.Errorf("commit layer push %s: %w", digest, err)
+	}
+	_notFound.remove(u.client.blobURL(digest))
+	log.Infof("* Finished streaming layer %s", digest)
+	return nil
+}
+
+// Cancel aborts the upload. Errors are only logged, since registries clean up
+// stale uploads anyway.
+func (u *LayerUpload) Cancel() {
+	opt, err := u.client.config.Security.GetHTTPOption(u.client.registry, u.client.repository)
+	if err != nil {
+		log.Warnf("Failed to cancel layer upload: get security opt: %s", err)
+		return
+	}
+	resp, err := httputil.Send(
+		"DELETE",
+		u.client.resolveLocation(u.location),
+		httputil.SendClient(u.client.client),
+		opt,
+		httputil.SendTimeout(u.client.config.Timeout),
+		httputil.SendAcceptedCodes(http.StatusNoContent, http.StatusAccepted, http.StatusNotFound),
+		httputil.SendHeaders(map[string]string{"Host": u.client.registry}))
+	if err != nil {
+		log.Warnf("Failed to cancel layer upload: %s", err)
+		return
+	}
+	resp.Body.Close()
+}
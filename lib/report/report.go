@@ -0,0 +1,302 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package report writes the summary of a build in formats CI systems render
+// natively, like the job summaries of GitHub Actions or the metrics reports
+// of GitLab.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber/makisu/lib/profile"
+	"github.com/uber/makisu/lib/storage"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Formats of reports.
+const (
+	// FormatJSON is the JSON encoding of Summary.
+	FormatJSON = "json"
+	// FormatGitHub is the markdown of a GitHub Actions job summary.
+	FormatGitHub = "github"
+	// FormatGitLab is the text of a GitLab metrics report.
+	FormatGitLab = "gitlab"
+)
+
+// _maxWarnings is the number of warnings kept in a summary.
+const _maxWarnings = 100
+
+// ValidFormat returns an error if format is not a known format.
+func ValidFormat(format string) error {
+	switch format {
+	case FormatJSON, FormatGitHub, FormatGitLab:
+		return nil
+	}
+	return fmt.Errorf("invalid report format %q, expected json, github or gitlab", format)
+}
+
+// Step is the summary of a step of the build.
+type Step struct {
+	Stage     string  `json:"stage"`
+	Step      int     `json:"step"`
+	Directive string  `json:"directive"`
+	Cache     string  `json:"cache,omitempty"`
+	Duration  float64 `json:"duration"`
+	// Size is the number of bytes committed or pulled by the step.
+	Size int64 `json:"size,omitempty"`
+}
+
+// Layer is the summary of a layer of the image.
+type Layer struct {
+	Digest string `json:"digest"`
+	// Size is the compressed size of the layer.
+	Size      int64  `json:"size"`
+	Files     int    `json:"files"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// Summary is the summary of a build: its steps and their cache hits, the
+// digest and size of the image, and the warnings logged.
+type Summary struct {
+	Image    string  `json:"image"`
+	Result   string  `json:"result"`
+	Duration float64 `json:"duration"`
+	Digest   string  `json:"digest,omitempty"`
+	// Size is the compressed size of the layers and config of the image.
+	Size        int64  `json:"size,omitempty"`
+	CacheHits   int    `json:"cache_hits"`
+	CacheMisses int    `json:"cache_misses"`
+	Steps       []Step `json:"steps"`
+	// Layers are the layers of the image, if their files were counted.
+	Layers   []Layer  `json:"layers,omitempty"`
+	Warnings []string `json:"warnings"`
+}
+
+// NewSummary returns the summary of a build from its spans. Steps skipped
+// because a later step was cached count as hits.
+func NewSummary(
+	image, result string, duration time.Duration, spans []profile.Span) *Summary {
+
+	summary := &Summary{
+		Image:    image,
+		Result:   result,
+		Duration: duration.Seconds(),
+		Steps:    []Step{},
+		Warnings: []string{},
+	}
+	sizes := make(map[string]int64)
+	for _, span := range spans {
+		if span.Phase == profile.PhaseCommit || span.Phase == profile.PhasePull {
+			sizes[fmt.Sprintf("%s/%d", span.Stage, span.Step)] += span.Size
+		}
+	}
+	for _, span := range spans {
+		if span.Phase != profile.PhaseStep {
+			continue
+		}
+		switch span.Cache {
+		case "hit", "skipped":
+			summary.CacheHits++
+		case "miss":
+			summary.CacheMisses++
+		}
+		summary.Steps = append(summary.Steps, Step{
+			Stage:     span.Stage,
+			Step:      span.Step,
+			Directive: span.Directive,
+			Cache:     span.Cache,
+			Duration:  span.Duration.Seconds(),
+			Size:      sizes[fmt.Sprintf("%s/%d", span.Stage, span.Step)],
+		})
+	}
+	return summary
+}
+
+// Write writes the summary in format to path. GitHub job summaries are
+// appended, as the steps of a job share the file, and other formats replace
+// the file.
+func (s *Summary) Write(path, format string) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if format == FormatGitHub {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("open report: %s", err)
+	}
+	defer f.Close()
+	switch format {
+	case FormatGitHub:
+		err = s.WriteGitHub(f)
+	case FormatGitLab:
+		err = s.WriteGitLab(f)
+	default:
+		err = s.WriteJSON(f)
+	}
+	if err != nil {
+		return fmt.Errorf("write report: %s", err)
+	}
+	return f.Close()
+}
+
+// WriteJSON writes the summary as JSON.
+func (s *Summary) WriteJSON(w io.Writer) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal summary: %s", err)
+	}
+	_, err = w.Write(append(content, '\n'))
+	return err
+}
+
+// WriteGitHub writes the summary as the markdown of a GitHub Actions job
+// summary: a table of the result, a table of the steps, and the warnings.
+func (s *Summary) WriteGitHub(w io.Writer) error {
+	var b strings.Builder
+	icon := ":white_check_mark:"
+	if !s.succeeded() {
+		icon = ":x:"
+	}
+	fmt.Fprintf(&b, "### %s makisu build of `%s`\n\n", icon, s.Image)
+	fmt.Fprintf(&b, "| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Result | %s |\n", s.Result)
+	if s.Digest != "" {
+		fmt.Fprintf(&b, "| Digest | `%s` |\n", s.Digest)
+	}
+	if s.Size != 0 {
+		fmt.Fprintf(&b, "| Size | %s |\n", storage.FormatSize(s.Size))
+	}
+	fmt.Fprintf(&b, "| Duration | %s |\n", formatSeconds(s.Duration))
+	fmt.Fprintf(&b, "| Cache | %d hits, %d misses |\n", s.CacheHits, s.CacheMisses)
+	if len(s.Steps) > 0 {
+		fmt.Fprintf(&b, "\n| Stage | Step | Directive | Cache | Duration | Size |\n")
+		fmt.Fprintf(&b, "|---|---:|---|---|---:|---:|\n")
+		for _, step := range s.Steps {
+			size := "-"
+			if step.Size != 0 {
+				size = storage.FormatSize(step.Size)
+			}
+			fmt.Fprintf(&b, "| %s | %d | %s | %s | %s | %s |\n",
+				markdownCell(step.Stage), step.Step, markdownCode(step.Directive),
+				step.Cache, formatSeconds(step.Duration), size)
+		}
+	}
+	if len(s.Layers) > 0 {
+		fmt.Fprintf(&b, "\n| Layer | Size | Files | Created by |\n")
+		fmt.Fprintf(&b, "|---:|---:|---:|---|\n")
+		for i, layer := range s.Layers {
+			fmt.Fprintf(&b, "| %d | %s | %d | %s |\n",
+				i, storage.FormatSize(layer.Size), layer.Files, markdownCode(layer.CreatedBy))
+		}
+	}
+	if len(s.Warnings) > 0 {
+		fmt.Fprintf(&b, "\n<details><summary>%d warnings</summary>\n\n", len(s.Warnings))
+		for _, warning := range s.Warnings {
+			fmt.Fprintf(&b, "- %s\n", markdownCell(warning))
+		}
+		fmt.Fprintf(&b, "\n</details>\n")
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteGitLab writes the summary as a GitLab metrics report, which merge
+// requests compare to the report of their target branch.
+func (s *Summary) WriteGitLab(w io.Writer) error {
+	success := 0
+	if s.succeeded() {
+		success = 1
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "makisu_build_success %d\n", success)
+	fmt.Fprintf(&b, "makisu_build_duration_seconds %.3f\n", s.Duration)
+	if s.Size != 0 {
+		fmt.Fprintf(&b, "makisu_image_size_bytes %d\n", s.Size)
+	}
+	fmt.Fprintf(&b, "makisu_steps %d\n", len(s.Steps))
+	fmt.Fprintf(&b, "makisu_cache_hits %d\n", s.CacheHits)
+	fmt.Fprintf(&b, "makisu_cache_misses %d\n", s.CacheMisses)
+	if len(s.Layers) > 0 {
+		var maxFiles int
+		for _, layer := range s.Layers {
+			if layer.Files > maxFiles {
+				maxFiles = layer.Files
+			}
+		}
+		fmt.Fprintf(&b, "makisu_max_layer_files %d\n", maxFiles)
+	}
+	fmt.Fprintf(&b, "makisu_warnings %d\n", len(s.Warnings))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (s *Summary) succeeded() bool {
+	return s.Result == "success"
+}
+
+// Warnings collects the warnings logged during a build.
+type Warnings struct {
+	sync.Mutex
+	messages []string
+}
+
+// Hook records the message of entries of level warn, to be used with
+// zap.Hooks.
+func (w *Warnings) Hook(entry zapcore.Entry) error {
+	if entry.Level != zapcore.WarnLevel {
+		return nil
+	}
+	w.Lock()
+	defer w.Unlock()
+	if len(w.messages) < _maxWarnings {
+		w.messages = append(w.messages, entry.Message)
+	}
+	return nil
+}
+
+// Messages returns the warnings recorded, in the order they were logged.
+func (w *Warnings) Messages() []string {
+	w.Lock()
+	defer w.Unlock()
+	return append([]string{}, w.messages...)
+}
+
+// formatSeconds formats a duration in seconds, rounded to the millisecond.
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+// markdownCell escapes s to be a single line of a markdown table.
+func markdownCell(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.Replace(s, "|", `\|`, -1)
+}
+
+// markdownCode formats s as inline code in a markdown table.
+func markdownCode(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > 80 {
+		s = s[:77] + "..."
+	}
+	return "`" + markdownCell(strings.Replace(s, "`", "'", -1)) + "`"
+}
@@ -0,0 +1,153 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/profile"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func testSummary() *Summary {
+	spans := []profile.Span{
+		{Phase: profile.PhaseCommit, Stage: "build", Step: 2, Size: 2048},
+		{Phase: profile.PhaseStep, Stage: "build", Step: 1, Directive: "FROM alpine", Cache: "skipped", Duration: time.Second},
+		{Phase: profile.PhaseStep, Stage: "build", Step: 2, Directive: "RUN echo a | cat", Cache: "miss", Duration: 2 * time.Second},
+		{Phase: profile.PhasePush, Duration: time.Second},
+	}
+	summary := NewSummary("app:1.0", "success", 4*time.Second, spans)
+	summary.Digest = "sha256:abc"
+	summary.Size = 4096
+	summary.Warnings = []string{"Failed to push cache"}
+	return summary
+}
+
+func TestNewSummary(t *testing.T) {
+	require := require.New(t)
+
+	summary := testSummary()
+	require.Equal(1, summary.CacheHits)
+	require.Equal(1, summary.CacheMisses)
+	require.Equal([]Step{
+		{Stage: "build", Step: 1, Directive: "FROM alpine", Cache: "skipped", Duration: 1},
+		{Stage: "build", Step: 2, Directive: "RUN echo a | cat", Cache: "miss", Duration: 2, Size: 2048},
+	}, summary.Steps)
+}
+
+func TestSummaryWriteGitHub(t *testing.T) {
+	require := require.New(t)
+
+	var b bytes.Buffer
+	require.NoError(testSummary().WriteGitHub(&b))
+	require.Equal("### :white_check_mark: makisu build of `app:1.0`\n\n"+
+		"| | |\n|---|---|\n"+
+		"| Result | success |\n"+
+		"| Digest | `sha256:abc` |\n"+
+		"| Size | 4.0KB |\n"+
+		"| Duration | 4s |\n"+
+		"| Cache | 1 hits, 1 misses |\n\n"+
+		"| Stage | Step | Directive | Cache | Duration | Size |\n"+
+		"|---|---:|---|---|---:|---:|\n"+
+		"| build | 1 | `FROM alpine` | skipped | 1s | - |\n"+
+		"| build | 2 | `RUN echo a \\| cat` | miss | 2s | 2.0KB |\n\n"+
+		"<details><summary>1 warnings</summary>\n\n"+
+		"- Failed to push cache\n\n"+
+		"</details>\n\n", b.String())
+}
+
+func TestSummaryWriteLayers(t *testing.T) {
+	require := require.New(t)
+
+	summary := testSummary()
+	summary.Warnings = nil
+	summary.Layers = []Layer{
+		{Digest: "sha256:base", Size: 3072, Files: 120, CreatedBy: "FROM alpine"},
+		{Digest: "sha256:deps", Size: 1024, Files: 90000, CreatedBy: "RUN npm install"},
+	}
+	var b bytes.Buffer
+	require.NoError(summary.WriteGitHub(&b))
+	require.Contains(b.String(), "| Layer | Size | Files | Created by |\n"+
+		"|---:|---:|---:|---|\n"+
+		"| 0 | 3.0KB | 120 | `FROM alpine` |\n"+
+		"| 1 | 1.0KB | 90000 | `RUN npm install` |\n")
+
+	b.Reset()
+	require.NoError(summary.WriteGitLab(&b))
+	require.Contains(b.String(), "makisu_max_layer_files 90000\n")
+}
+
+func TestSummaryWriteGitLab(t *testing.T) {
+	require := require.New(t)
+
+	summary := testSummary()
+	summary.Result = "exec"
+	var b bytes.Buffer
+	require.NoError(summary.WriteGitLab(&b))
+	require.Equal("makisu_build_success 0\n"+
+		"makisu_build_duration_seconds 4.000\n"+
+		"makisu_image_size_bytes 4096\n"+
+		"makisu_steps 2\n"+
+		"makisu_cache_hits 1\n"+
+		"makisu_cache_misses 1\n"+
+		"makisu_warnings 1\n", b.String())
+}
+
+func TestSummaryWrite(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// GitHub summaries are appended.
+	path := filepath.Join(dir, "summary.md")
+	require.NoError(ioutil.WriteFile(path, []byte("previous\n"), 0644))
+	require.NoError(testSummary().Write(path, FormatGitHub))
+	content, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Contains(string(content), "previous\n### :white_check_mark:")
+
+	path = filepath.Join(dir, "summary.json")
+	require.NoError(ioutil.WriteFile(path, []byte("previous\n"), 0644))
+	require.NoError(testSummary().Write(path, FormatJSON))
+	content, err = ioutil.ReadFile(path)
+	require.NoError(err)
+	var summary Summary
+	require.NoError(json.Unmarshal(content, &summary))
+	require.Equal(testSummary(), &summary)
+}
+
+func TestWarnings(t *testing.T) {
+	require := require.New(t)
+
+	var warnings Warnings
+	core, _ := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core, zap.Hooks(warnings.Hook)).Sugar()
+	logger.Info("info")
+	logger.Warnf("warn %d", 1)
+	logger.Error("error")
+	require.Equal([]string{"warn 1"}, warnings.Messages())
+}
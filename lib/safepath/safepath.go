@@ -0,0 +1,124 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package safepath resolves the paths of archive entries, hard link targets
+// and copy destinations under a root dir, and rejects the ones that would make
+// writes escape it: ".." components going above the root, and symlinks
+// leading outside of it. Extraction sites check entries with it before
+// writing them, instead of each implementing its own checks.
+package safepath
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// _maxLinks is the number of symlinks followed before giving up on a path, as
+// the kernel does for loops.
+const _maxLinks = 255
+
+// Join joins name, the name or link target of an archive entry, to root.
+// Names are relative to root even if they are absolute. Unlike filepath.Join,
+// which cleans them away, ".." components going above root are an error.
+func Join(root, name string) (string, error) {
+	depth := 0
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return "", fmt.Errorf("%s goes above the root", name)
+			}
+		default:
+			depth++
+		}
+	}
+	return filepath.Join(root, name), nil
+}
+
+// Resolve returns the path that p, a path under root, is written at, after
+// following the symlinks of its parent dirs and, if followLast is true, of p
+// itself. Absolute symlink targets are under root if root is "/", like in
+// the chroot of a build, and must be prefixed with root otherwise. It returns
+// an error if a symlink leads outside of root. Missing components are kept as
+// they are.
+func Resolve(root, p string, followLast bool) (string, error) {
+	root = filepath.Clean(root)
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is outside of %s", p, root)
+	}
+
+	parts := split(rel)
+	var resolved []string
+	var links int
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		if part == ".." {
+			if len(resolved) == 0 {
+				if root == "/" {
+					continue
+				}
+				return "", fmt.Errorf("%s leads outside of %s", p, root)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		current := filepath.Join(root, filepath.Join(resolved...), part)
+		if len(parts) == 0 && !followLast {
+			resolved = append(resolved, part)
+			break
+		}
+		fi, err := os.Lstat(current)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// Writes fail on missing components anyway.
+			resolved = append(resolved, part)
+			continue
+		}
+		if links++; links > _maxLinks {
+			return "", fmt.Errorf("too many links in %s", p)
+		}
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", fmt.Errorf("read link %s: %s", current, err)
+		}
+		if filepath.IsAbs(target) {
+			if root != "/" {
+				if target != root && !strings.HasPrefix(target, root+"/") {
+					return "", fmt.Errorf(
+						"symlink %s => %s leads outside of %s", current, target, root)
+				}
+				target = strings.TrimPrefix(target, root)
+			}
+			resolved = nil
+		}
+		parts = append(split(target), parts...)
+	}
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
+
+// split returns the non-empty components of p, other than ".".
+func split(p string) []string {
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
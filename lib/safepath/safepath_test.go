@@ -0,0 +1,163 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safepath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/require"
+)
+
+// within returns true if p is root or under it.
+func within(root, p string) bool {
+	return p == root || strings.HasPrefix(p, root+"/")
+}
+
+// symlinkTree creates a root with symlinks inside and outside of it.
+func symlinkTree(t *testing.T) (string, func()) {
+	require := require.New(t)
+	tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	root := filepath.Join(tmp, "root")
+	require.NoError(os.MkdirAll(filepath.Join(root, "usr/bin"), 0755))
+	require.NoError(os.MkdirAll(filepath.Join(tmp, "outside"), 0755))
+	for link, target := range map[string]string{
+		"bin":       "usr/bin",
+		"abs":       filepath.Join(root, "usr"),
+		"up":        "..",
+		"escape":    "../outside",
+		"host":      "/etc",
+		"usr/lib":   "../../outside",
+		"usr/local": ".",
+		"loop":      "loop",
+	} {
+		require.NoError(os.Symlink(target, filepath.Join(root, link)))
+	}
+	return root, func() { os.RemoveAll(tmp) }
+}
+
+func TestJoin(t *testing.T) {
+	require := require.New(t)
+
+	for name, expected := range map[string]string{
+		"a/b":         "/root/a/b",
+		"/a/b":        "/root/a/b",
+		"./a/../b":    "/root/b",
+		"a/b/../../c": "/root/c",
+		"":            "/root",
+	} {
+		p, err := Join("/root", name)
+		require.NoError(err, name)
+		require.Equal(expected, p, name)
+	}
+	for _, name := range []string{"..", "../a", "a/../../b", "/../etc/passwd", "a/./../.."} {
+		_, err := Join("/root", name)
+		require.Error(err, name)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	require := require.New(t)
+	root, cleanup := symlinkTree(t)
+	defer cleanup()
+
+	for p, expected := range map[string]string{
+		"bin/sh":        "usr/bin/sh",
+		"abs/bin/sh":    "usr/bin/sh",
+		"usr/local/bin": "usr/bin",
+		"new/dir/file":  "new/dir/file",
+		// The last component isn't followed.
+		"escape": "escape",
+		"host":   "host",
+	} {
+		resolved, err := Resolve(root, filepath.Join(root, p), false)
+		require.NoError(err, p)
+		require.Equal(filepath.Join(root, expected), resolved, p)
+	}
+
+	for _, p := range []string{
+		"escape/file", "host/passwd", "up/file", "usr/lib/file", "bin/../../outside", "loop/file",
+	} {
+		_, err := Resolve(root, filepath.Join(root, p), false)
+		require.Error(err, p)
+	}
+	for _, p := range []string{"escape", "host"} {
+		_, err := Resolve(root, filepath.Join(root, p), true)
+		require.Error(err, p)
+	}
+	_, err := Resolve(root, "/etc/passwd", false)
+	require.Error(err)
+
+	// In the root of a build, nothing is outside.
+	resolved, err := Resolve("/", "/a/../../b", false)
+	require.NoError(err)
+	require.Equal("/b", resolved)
+}
+
+func TestJoinStaysInRoot(t *testing.T) {
+	check := func(name string) bool {
+		p, err := Join("/root", name)
+		if err == nil && !within("/root", p) {
+			t.Logf("%q joined to %s", name, p)
+			return false
+		}
+		return true
+	}
+	for _, name := range []string{"a/b", "/a", "..", "a/../..", "./.", "a//../b", "\x00/.."} {
+		require.True(t, check(name))
+	}
+	require.NoError(t, quick.Check(func(parts []string) bool {
+		return check(strings.Join(parts, "/../"))
+	}, nil))
+}
+
+func TestResolveStaysInRoot(t *testing.T) {
+	root, cleanup := symlinkTree(t)
+	defer cleanup()
+
+	check := func(p string, followLast bool) bool {
+		joined, err := Join(root, p)
+		if err != nil {
+			return true
+		}
+		resolved, err := Resolve(root, joined, followLast)
+		if err == nil && !within(root, resolved) {
+			t.Logf("%q resolved to %s", p, resolved)
+			return false
+		}
+		return true
+	}
+	for _, p := range []string{
+		"bin/sh", "abs/bin", "escape/x", "up/x", "usr/lib/x", "usr/local/../../x", "loop", "a/../../x",
+	} {
+		require.True(t, check(p, false))
+		require.True(t, check(p, true))
+	}
+
+	// Random paths through the links of the tree.
+	segments := []string{"..", ".", "", "a", "x", "bin", "abs", "escape", "up", "usr", "lib", "local", "loop", "host"}
+	require.NoError(t, quick.Check(func(picks []uint8, followLast bool) bool {
+		parts := make([]string, len(picks))
+		for i, pick := range picks {
+			parts[i] = segments[int(pick)%len(segments)]
+		}
+		return check(strings.Join(parts, "/"), followLast)
+	}, nil))
+}
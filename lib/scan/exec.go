@@ -0,0 +1,75 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/uber/makisu/lib/failure"
+)
+
+// Placeholder is replaced by the path of the OCI image layout in scanner
+// commands.
+const Placeholder = "{}"
+
+// Scanner scans images for vulnerabilities.
+type Scanner interface {
+	// Scan scans the image of an OCI image layout directory.
+	Scan(layoutDir string) (*Report, error)
+}
+
+// ExecScanner runs a scanner command, which prints a JSON report of Trivy or
+// Grype to stdout.
+type ExecScanner struct {
+	command string
+}
+
+// NewExecScanner returns a scanner running command with sh. The path of the
+// OCI image layout replaces the placeholders of command, or is appended to it
+// if there are none.
+func NewExecScanner(command string) *ExecScanner {
+	return &ExecScanner{command: command}
+}
+
+// Scan implements Scanner.
+func (s *ExecScanner) Scan(layoutDir string) (*Report, error) {
+	quoted := "'" + strings.Replace(layoutDir, "'", `'\''`, -1) + "'"
+	command := s.command
+	if strings.Contains(command, Placeholder) {
+		command = strings.Replace(command, Placeholder, quoted, -1)
+	} else {
+		command += " " + quoted
+	}
+
+	var stdout bytes.Buffer
+	stderr := failure.NewTail(failure.MaxOutputLines)
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	cmd.Env = os.Environ()
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("run scanner %q: %s: %s",
+			command, err, strings.Join(stderr.Lines(), "\n"))
+	}
+	report, err := ParseReport(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("parse output of scanner %q: %s", command, err)
+	}
+	return report, nil
+}
@@ -0,0 +1,56 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecScanner(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "makisu-scan")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	layoutDir := path.Join(tmpDir, "oci layout")
+	require.NoError(os.Mkdir(layoutDir, 0755))
+	require.NoError(ioutil.WriteFile(path.Join(layoutDir, "report.json"), []byte(_trivyReport), 0644))
+
+	t.Run("Placeholder", func(t *testing.T) {
+		report, err := NewExecScanner("cat {}/report.json").Scan(layoutDir)
+		require.NoError(err)
+		require.Len(report.Findings, 3)
+	})
+
+	t.Run("Appended", func(t *testing.T) {
+		report, err := NewExecScanner(`f() { cat "$1/report.json"; }; f`).Scan(layoutDir)
+		require.NoError(err)
+		require.Len(report.Findings, 3)
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		_, err := NewExecScanner("echo database unavailable >&2; exit 1").Scan(layoutDir)
+		require.Error(err)
+		require.Contains(err.Error(), "database unavailable")
+
+		_, err = NewExecScanner("echo no report; true").Scan(layoutDir)
+		require.Error(err)
+	})
+}
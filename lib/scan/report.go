@@ -0,0 +1,196 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scan checks images for vulnerabilities with an external scanner
+// before they're pushed.
+package scan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Severity is the severity of a vulnerability.
+type Severity int
+
+// Severities, from the lowest.
+const (
+	SeverityUnknown Severity = iota
+	SeverityNegligible
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var _severityNames = []string{"UNKNOWN", "NEGLIGIBLE", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(_severityNames) {
+		return _severityNames[SeverityUnknown]
+	}
+	return _severityNames[s]
+}
+
+// ParseSeverity parses the name of a severity, in any case.
+func ParseSeverity(name string) (Severity, error) {
+	for i, n := range _severityNames {
+		if strings.EqualFold(name, n) {
+			return Severity(i), nil
+		}
+	}
+	return SeverityUnknown, fmt.Errorf("invalid severity %q, expected one of %s",
+		name, strings.Join(_severityNames, ", "))
+}
+
+// parseReportSeverity parses the severity of a vulnerability in a report.
+// Severities that aren't known are unknown.
+func parseReportSeverity(name string) Severity {
+	s, _ := ParseSeverity(name)
+	return s
+}
+
+// Finding is a vulnerability found in a package of the image.
+type Finding struct {
+	ID               string
+	Package          string
+	InstalledVersion string
+	FixedVersion     string
+	Severity         Severity
+}
+
+func (f Finding) String() string {
+	s := fmt.Sprintf("%s %s %s %s", f.Severity, f.ID, f.Package, f.InstalledVersion)
+	if f.FixedVersion != "" {
+		s += " (fixed in " + f.FixedVersion + ")"
+	}
+	return s
+}
+
+// Report is the result of a scan.
+type Report struct {
+	Findings []Finding
+}
+
+// AtLeast returns the findings with at least the given severity, the most
+// severe first.
+func (r *Report) AtLeast(threshold Severity) []Finding {
+	var findings []Finding
+	for _, f := range r.Findings {
+		if f.Severity >= threshold {
+			findings = append(findings, f)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+	return findings
+}
+
+// trivyResult is a result of a Trivy JSON report, for one target of the image.
+type trivyResult struct {
+	Vulnerabilities []struct {
+		VulnerabilityID  string
+		PkgName          string
+		InstalledVersion string
+		FixedVersion     string
+		Severity         string
+	}
+}
+
+// trivyReport is a Trivy JSON report. Reports of Trivy before 0.20 are only
+// the list of results.
+type trivyReport struct {
+	Results []trivyResult
+}
+
+// grypeReport is a Grype JSON report.
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID       string `json:"id"`
+			Severity string `json:"severity"`
+			Fix      struct {
+				Versions []string `json:"versions"`
+			} `json:"fix"`
+		} `json:"vulnerability"`
+		Artifact struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"artifact"`
+	} `json:"matches"`
+}
+
+// ParseReport parses a JSON report of Trivy or Grype.
+func ParseReport(content []byte) (*Report, error) {
+	content = bytes.TrimSpace(content)
+	var results []trivyResult
+	if bytes.HasPrefix(content, []byte("[")) {
+		if err := json.Unmarshal(content, &results); err != nil {
+			return nil, fmt.Errorf("unmarshal Trivy report: %s", err)
+		}
+	} else {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(content, &fields); err != nil {
+			return nil, fmt.Errorf("unmarshal report: %s", err)
+		}
+		if _, ok := fields["matches"]; ok {
+			return parseGrypeReport(content)
+		} else if _, ok := fields["SchemaVersion"]; !ok {
+			if _, ok := fields["Results"]; !ok {
+				return nil, fmt.Errorf("unknown report format, expected a Trivy or Grype JSON report")
+			}
+		}
+		var trivy trivyReport
+		if err := json.Unmarshal(content, &trivy); err != nil {
+			return nil, fmt.Errorf("unmarshal Trivy report: %s", err)
+		}
+		results = trivy.Results
+	}
+
+	report := new(Report)
+	for _, result := range results {
+		for _, v := range result.Vulnerabilities {
+			report.Findings = append(report.Findings, Finding{
+				ID:               v.VulnerabilityID,
+				Package:          v.PkgName,
+				InstalledVersion: v.InstalledVersion,
+				FixedVersion:     v.FixedVersion,
+				Severity:         parseReportSeverity(v.Severity),
+			})
+		}
+	}
+	return report, nil
+}
+
+func parseGrypeReport(content []byte) (*Report, error) {
+	var grype grypeReport
+	if err := json.Unmarshal(content, &grype); err != nil {
+		return nil, fmt.Errorf("unmarshal Grype report: %s", err)
+	}
+	report := new(Report)
+	for _, m := range grype.Matches {
+		report.Findings = append(report.Findings, Finding{
+			ID:               m.Vulnerability.ID,
+			Package:          m.Artifact.Name,
+			InstalledVersion: m.Artifact.Version,
+			FixedVersion:     strings.Join(m.Vulnerability.Fix.Versions, ", "),
+			Severity:         parseReportSeverity(m.Vulnerability.Severity),
+		})
+	}
+	return report, nil
+}
@@ -0,0 +1,142 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const _trivyReport = `{
+  "SchemaVersion": 2,
+  "ArtifactName": "image",
+  "Results": [
+    {
+      "Target": "image (debian 10.13)",
+      "Vulnerabilities": [
+        {"VulnerabilityID": "CVE-2023-0001", "PkgName": "openssl", "InstalledVersion": "1.1.1n", "FixedVersion": "1.1.1t", "Severity": "HIGH"},
+        {"VulnerabilityID": "CVE-2023-0002", "PkgName": "zlib", "InstalledVersion": "1.2.11", "Severity": "LOW"}
+      ]
+    },
+    {
+      "Target": "app/requirements.txt",
+      "Vulnerabilities": [
+        {"VulnerabilityID": "CVE-2023-0003", "PkgName": "pyyaml", "InstalledVersion": "5.3", "FixedVersion": "5.4", "Severity": "CRITICAL"}
+      ]
+    },
+    {"Target": "app/go.sum"}
+  ]
+}`
+
+const _grypeReport = `{
+  "matches": [
+    {
+      "vulnerability": {"id": "CVE-2023-0001", "severity": "High", "fix": {"versions": ["1.1.1t"]}},
+      "artifact": {"name": "openssl", "version": "1.1.1n"}
+    },
+    {
+      "vulnerability": {"id": "CVE-2023-0004", "severity": "Negligible"},
+      "artifact": {"name": "tar", "version": "1.30"}
+    }
+  ],
+  "source": {"type": "image"}
+}`
+
+func TestParseSeverity(t *testing.T) {
+	require := require.New(t)
+
+	s, err := ParseSeverity("high")
+	require.NoError(err)
+	require.Equal(SeverityHigh, s)
+	s, err = ParseSeverity("Critical")
+	require.NoError(err)
+	require.Equal(SeverityCritical, s)
+	require.True(SeverityMedium > SeverityLow)
+	require.Equal("NEGLIGIBLE", SeverityNegligible.String())
+
+	_, err = ParseSeverity("severe")
+	require.Error(err)
+}
+
+func TestParseReport(t *testing.T) {
+	t.Run("Trivy", func(t *testing.T) {
+		require := require.New(t)
+
+		report, err := ParseReport([]byte(_trivyReport))
+		require.NoError(err)
+		require.Len(report.Findings, 3)
+		require.Equal(Finding{
+			ID:               "CVE-2023-0001",
+			Package:          "openssl",
+			InstalledVersion: "1.1.1n",
+			FixedVersion:     "1.1.1t",
+			Severity:         SeverityHigh,
+		}, report.Findings[0])
+		require.Equal(SeverityCritical, report.Findings[2].Severity)
+	})
+
+	t.Run("TrivyLegacy", func(t *testing.T) {
+		require := require.New(t)
+
+		report, err := ParseReport([]byte(`[{"Target": "image", "Vulnerabilities": [
+			{"VulnerabilityID": "CVE-2019-0001", "PkgName": "bash", "Severity": "MEDIUM"}]}]`))
+		require.NoError(err)
+		require.Len(report.Findings, 1)
+		require.Equal(SeverityMedium, report.Findings[0].Severity)
+	})
+
+	t.Run("Grype", func(t *testing.T) {
+		require := require.New(t)
+
+		report, err := ParseReport([]byte(_grypeReport))
+		require.NoError(err)
+		require.Equal([]Finding{{
+			ID:               "CVE-2023-0001",
+			Package:          "openssl",
+			InstalledVersion: "1.1.1n",
+			FixedVersion:     "1.1.1t",
+			Severity:         SeverityHigh,
+		}, {
+			ID:               "CVE-2023-0004",
+			Package:          "tar",
+			InstalledVersion: "1.30",
+			Severity:         SeverityNegligible,
+		}}, report.Findings)
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		require := require.New(t)
+
+		_, err := ParseReport([]byte(`{"vulnerabilities": []}`))
+		require.Error(err)
+		_, err = ParseReport([]byte(`not json`))
+		require.Error(err)
+	})
+}
+
+func TestReportAtLeast(t *testing.T) {
+	require := require.New(t)
+
+	report, err := ParseReport([]byte(_trivyReport))
+	require.NoError(err)
+
+	findings := report.AtLeast(SeverityHigh)
+	require.Len(findings, 2)
+	require.Equal("CVE-2023-0003", findings[0].ID)
+	require.Equal("CVE-2023-0001", findings[1].ID)
+	require.Len(report.AtLeast(SeverityUnknown), 3)
+	require.Empty(report.AtLeast(SeverityCritical + 1))
+}
@@ -0,0 +1,194 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package secrets detects credentials in the files of layers, so they don't
+// ship in images.
+package secrets
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+// MaxFileSize is the size of the largest file scanned. Larger files are
+// skipped, like binary files.
+const MaxFileSize = 16 << 20
+
+// maxLineSize is the size of the longest line scanned. Files are only scanned
+// up to their first longer line.
+const maxLineSize = 1 << 20
+
+// Rule detects a kind of secret.
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	// Files are the path patterns of the files the rule applies to, see
+	// pathutils.MatchesAnyPattern. The rule applies to all files if empty.
+	Files []string
+}
+
+// DefaultRules are the rules of the kinds of secrets most often found in
+// images.
+var DefaultRules = []Rule{{
+	Name:    "AWS access key ID",
+	Pattern: regexp.MustCompile(`\b(AKIA|ASIA|AGPA|AIDA|AROA|AIPA|ANPA|ANVA)[A-Z0-9]{16}\b`),
+}, {
+	Name:    "AWS secret access key",
+	Pattern: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+]{40}\b`),
+}, {
+	Name:    "private key",
+	Pattern: regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`),
+}, {
+	// Tokens read from env vars, like ${NPM_TOKEN}, are fine.
+	Name:    "npm token",
+	Pattern: regexp.MustCompile(`(_authToken|_auth|_password)\s*=\s*["']?[^\s"'$]`),
+	Files:   []string{"**/.npmrc"},
+}, {
+	Name:    "GitHub token",
+	Pattern: regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`),
+}, {
+	Name:    "Slack token",
+	Pattern: regexp.MustCompile(`\bxox[abposr]-[0-9A-Za-z-]{10,}`),
+}}
+
+// Finding is a secret found in a file. It doesn't include the secret itself,
+// so it can be logged.
+type Finding struct {
+	Path string
+	Line int
+	Rule string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: %s", f.Path, f.Line, f.Rule)
+}
+
+// Detector finds secrets in files.
+type Detector struct {
+	rules []Rule
+	allow []string
+
+	// WarnOnly makes steps only log the secrets found in their layers,
+	// instead of failing.
+	WarnOnly bool
+}
+
+// NewDetector returns a new Detector with the default rules. Files matching
+// the allow patterns are never scanned.
+func NewDetector(allow []string, warnOnly bool) *Detector {
+	return &Detector{rules: DefaultRules, allow: allow, WarnOnly: warnOnly}
+}
+
+// ScanFile returns the secrets found in the content of the file at p. Binary
+// files are skipped.
+func (d *Detector) ScanFile(p string, r io.Reader) ([]Finding, error) {
+	if pathutils.MatchesAnyPattern(p, d.allow) {
+		return nil, nil
+	}
+	var rules []Rule
+	for _, rule := range d.rules {
+		if len(rule.Files) == 0 || pathutils.MatchesAnyPattern(p, rule.Files) {
+			rules = append(rules, rule)
+		}
+	}
+
+	br := bufio.NewReaderSize(r, 8192)
+	if head, err := br.Peek(8000); err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("read %s: %s", p, err)
+	} else if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	var findings []Finding
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64<<10), maxLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		for _, rule := range rules {
+			if rule.Pattern.Match(scanner.Bytes()) {
+				findings = append(findings, Finding{Path: p, Line: line, Rule: rule.Name})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+		return nil, fmt.Errorf("read %s: %s", p, err)
+	}
+	return findings, nil
+}
+
+// ScanTar returns the secrets found in the regular files of a tarball.
+func (d *Detector) ScanTar(r io.Reader) ([]Finding, error) {
+	var findings []Finding
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return findings, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("read header: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		} else if hdr.Size > MaxFileSize {
+			continue
+		}
+		found, err := d.ScanFile(pathutils.AbsPath(hdr.Name), tr)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, found...)
+	}
+}
+
+// TarScanner scans a tarball for secrets as it's written.
+type TarScanner struct {
+	pw       *io.PipeWriter
+	done     chan struct{}
+	findings []Finding
+	err      error
+}
+
+// NewTarScanner returns a new TarScanner. Close must be called once the whole
+// tarball was written.
+func (d *Detector) NewTarScanner() *TarScanner {
+	pr, pw := io.Pipe()
+	s := &TarScanner{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		s.findings, s.err = d.ScanTar(pr)
+		// Drain the end of the tarball, or all of it if it couldn't be read,
+		// so writes never block.
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return s
+}
+
+// Write implements io.Writer.
+func (s *TarScanner) Write(p []byte) (int, error) {
+	return s.pw.Write(p)
+}
+
+// Close waits for the scan of the tarball to finish, and returns the secrets
+// found in it.
+func (s *TarScanner) Close() ([]Finding, error) {
+	s.pw.Close()
+	<-s.done
+	return s.findings, s.err
+}
@@ -15,23 +15,51 @@
 package shell
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/uber/makisu/lib/isolation"
 	"github.com/uber/makisu/lib/utils"
 )
 
 // ShellStreamBufferSize is the size of the output buffers when streaming command stdout and stderr
 const ShellStreamBufferSize = 1 << 20
 
+// ErrTimeout is returned when a command is killed for running past its
+// deadline.
+var ErrTimeout = errors.New("command timed out")
+
+// ExitError is returned when a command exits with a non-zero status, or is
+// killed by a signal, in which case Code is -1.
+type ExitError struct {
+	Code int
+	err  error
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("cmd wait: %s", e.err)
+}
+
 type formatStream func(string, ...interface{})
 
 // ExecCommand exec a cmd and args inside workingDir as user, returns error if cmd fails
 func ExecCommand(outStream, errStream formatStream, workingDir, user, cmdName string, cmdArgs ...string) error {
+	return ExecCommandInRoot(outStream, errStream, time.Time{}, "", nil, workingDir, user, cmdName, cmdArgs...)
+}
+
+// ExecCommandInRoot is like ExecCommand, but chroots the cmd in root first,
+// unless root is empty. cmdName is resolved outside of root.
+// Unless deadline is zero, the process group of the cmd is killed once it's
+// reached, and ErrTimeout is returned. The cmd runs with env, or with the env
+// of makisu if env is nil.
+func ExecCommandInRoot(outStream, errStream formatStream, deadline time.Time, root string, env []string, workingDir, user, cmdName string, cmdArgs ...string) error {
 	cmd := exec.Command(cmdName, cmdArgs...)
 	if workingDir != "" {
 		cmd.Dir = workingDir
@@ -40,19 +68,63 @@ func ExecCommand(outStream, errStream formatStream, workingDir, user, cmdName st
 	if err := setProcAttributes(cmd, user); err != nil {
 		return fmt.Errorf("set command creds: %v", err)
 	}
+	cmd.SysProcAttr.Chroot = root
+	cmd.Env = commandEnv(env, user)
+	return streamCmd(outStream, errStream, cmd, deadline)
+}
 
-	cmd.Env = os.Environ()
+// ExecCommandIsolated is like ExecCommandInRoot, but runtime runs the cmd in
+// namespaces of its own with the given paths of root masked, see package
+// isolation. stage is an empty dir used to set up the new root. Unlike with
+// ExecCommandInRoot, cmdName is resolved in root. With noNetwork, the cmd has
+// no network access.
+func ExecCommandIsolated(outStream, errStream formatStream, deadline time.Time, runtime isolation.Runtime,
+	root, stage string, masked []string,
+	noNetwork bool, env []string, workingDir, user, cmdName string, cmdArgs ...string) error {
+
+	config := &isolation.Config{
+		Root:      root,
+		Stage:     stage,
+		Masked:    masked,
+		NoNetwork: noNetwork,
+		Dir:       workingDir,
+		Args:      append([]string{cmdName}, cmdArgs...),
+		Env:       commandEnv(env, user),
+	}
+	if user != "" {
+		uid, gid, err := utils.ResolveChown(user)
+		if err != nil {
+			return fmt.Errorf("set command creds: cmd user resolve: %s", err)
+		}
+		config.Credential, config.UID, config.GID = true, uid, gid
+	}
+	cmd, err := runtime.Command(config)
+	if err != nil {
+		return fmt.Errorf("isolate command: %s", err)
+	}
+	return streamCmd(outStream, errStream, cmd, deadline)
+}
+
+// commandEnv returns the env of commands run as user, from env or from the
+// env of makisu if env is nil.
+func commandEnv(env []string, user string) []string {
+	if env == nil {
+		env = os.Environ()
+	} else if user == "" && !hasEnv(env, "HOME") {
+		// Like docker, root commands run with the HOME of root.
+		env = append(env, "HOME=/root")
+	}
 	if user != "" {
 		// We also need to change the HOME env var if we change user
 		home := fmt.Sprintf("HOME=/home/%s", strings.Split(user, ":")[0])
 
 		// Append it so it has a priority on any other env var from before (and will override previous HOME definition)
-		cmd.Env = append(cmd.Env, home)
+		env = append(env, home)
 	}
-	return streamCmd(outStream, errStream, cmd)
+	return env
 }
 
-func streamCmd(outStream, errStream formatStream, cmd *exec.Cmd) error {
+func streamCmd(outStream, errStream formatStream, cmd *exec.Cmd, deadline time.Time) error {
 	outReader, outWriter := io.Pipe()
 	errReader, errWriter := io.Pipe()
 	cmd.Stdout, cmd.Stderr = outWriter, errWriter
@@ -71,8 +143,26 @@ func streamCmd(outStream, errStream formatStream, cmd *exec.Cmd) error {
 
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("cmd start: %s", err)
-	} else if err := cmd.Wait(); err != nil {
+	}
+	var timedOut int32
+	if !deadline.IsZero() {
+		// Commands run in their own process group, see setProcAttributes, so
+		// their children are killed too.
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			atomic.StoreInt32(&timedOut, 1)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+	if err := cmd.Wait(); err != nil {
+		if atomic.LoadInt32(&timedOut) == 1 {
+			errStream("Command killed after reaching its deadline\n")
+			return ErrTimeout
+		}
 		errStream("Command exited with %d\n", cmd.ProcessState.ExitCode())
+		if _, ok := err.(*exec.ExitError); ok {
+			return &ExitError{Code: cmd.ProcessState.ExitCode(), err: err}
+		}
 		return fmt.Errorf("cmd wait: %s", err)
 	}
 	return nil
@@ -17,12 +17,24 @@ package shell
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/isolation"
 
 	"github.com/stretchr/testify/require"
 )
 
+func TestMain(m *testing.M) {
+	// Isolated commands run the test binary again.
+	isolation.Init()
+	os.Exit(m.Run())
+}
+
 type bufferedSyncWriter struct {
 	b *bytes.Buffer
 
@@ -66,3 +78,75 @@ func TestExecCommandError(t *testing.T) {
 	require.Error(err)
 	require.NotEmpty(stderr.String())
 }
+
+func TestExecCommandInRootDeadline(t *testing.T) {
+	require := require.New(t)
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+
+	// The background sleep is in the process group of the command, and is
+	// killed too, so its output pipe is closed.
+	start := time.Now()
+	err := ExecCommandInRoot(stdout.Write, stderr.Write, time.Now().Add(200*time.Millisecond),
+		"", nil, ".", "", "sh", "-c", "sleep 60 & sleep 60")
+	require.Equal(ErrTimeout, err)
+	require.True(time.Since(start) < 10*time.Second)
+	require.Contains(stderr.String(), "deadline")
+
+	err = ExecCommandInRoot(stdout.Write, stderr.Write, time.Now().Add(time.Minute),
+		"", nil, ".", "", "true")
+	require.NoError(err)
+}
+
+func TestExecCommandExitError(t *testing.T) {
+	require := require.New(t)
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+	err := ExecCommand(stdout.Write, stderr.Write, ".", "", "sh", "-c", "exit 100")
+	exitErr, ok := err.(*ExitError)
+	require.True(ok)
+	require.Equal(100, exitErr.Code)
+	require.EqualError(err, "cmd wait: exit status 100")
+}
+
+func TestExecCommandIsolatedUser(t *testing.T) {
+	require := require.New(t)
+	stdout, stderr := syncWriterFixture(), syncWriterFixture()
+
+	dir, err := ioutil.TempDir("", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	run := func(user string) error {
+		return ExecCommandIsolated(stdout.Write, stderr.Write, time.Time{}, isolation.Namespaces,
+			"/", filepath.Join(dir, "stage"), nil, false, []string{"PATH=" + os.Getenv("PATH")},
+			"/", user, "sh", "-c", "id -u; id -g; id -G")
+	}
+	if err := run(""); err != nil {
+		t.Skipf("Cannot isolate command: %s: %s", err, stderr.String())
+	}
+
+	// Like a RUN step of a stage with USER 1000:1001.
+	stdout = syncWriterFixture()
+	require.NoError(run("1000:1001"), stderr.String())
+	require.Equal("1000\n1001\n1001\n", stdout.String())
+}
+
+func TestRetryPolicy(t *testing.T) {
+	require := require.New(t)
+	exitErr := &ExitError{Code: 100}
+
+	var policy RetryPolicy
+	require.False(policy.Retryable(exitErr, 1))
+
+	policy = RetryPolicy{Retries: 2, Backoff: time.Second}
+	require.True(policy.Retryable(exitErr, 1))
+	require.True(policy.Retryable(exitErr, 2))
+	require.False(policy.Retryable(exitErr, 3))
+	require.False(policy.Retryable(ErrTimeout, 1))
+	require.Equal(time.Second, policy.Delay(1))
+	require.Equal(4*time.Second, policy.Delay(3))
+
+	policy.ExitCodes = []int{1}
+	require.False(policy.Retryable(exitErr, 1))
+	policy.ExitCodes = []int{1, 100}
+	require.True(policy.Retryable(exitErr, 1))
+}
@@ -0,0 +1,49 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// PassthroughEnv returns the variables of environ whose name matches one of
+// the patterns, which can use the wildcards of path.Match, sorted by name.
+// The result isn't nil, even if no variable matches.
+func PassthroughEnv(environ, patterns []string) []string {
+	env := []string{}
+	for _, kv := range environ {
+		name := strings.SplitN(kv, "=", 2)[0]
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// hasEnv returns true if env sets the variable name.
+func hasEnv(env []string, name string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
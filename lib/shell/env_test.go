@@ -0,0 +1,39 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassthroughEnv(t *testing.T) {
+	require := require.New(t)
+
+	environ := []string{"PATH=/bin", "HTTP_PROXY=proxy", "HTTPS_PROXY=proxy", "GOPROXY=direct", "SECRET=x"}
+	require.Equal([]string{}, PassthroughEnv(environ, nil))
+	require.Equal([]string{"GOPROXY=direct", "HTTPS_PROXY=proxy", "HTTP_PROXY=proxy"},
+		PassthroughEnv(environ, []string{"HTTP*_PROXY", "GOPROXY"}))
+	require.Len(PassthroughEnv(environ, []string{"*"}), len(environ))
+}
+
+func TestCommandEnv(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal([]string{"HOME=/root"}, commandEnv([]string{}, ""))
+	require.Equal([]string{"HOME=/home/app"}, commandEnv([]string{"HOME=/home/app"}, ""))
+	require.Equal([]string{"FOO=bar", "HOME=/home/app"}, commandEnv([]string{"FOO=bar"}, "app:app"))
+}
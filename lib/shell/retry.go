@@ -0,0 +1,60 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shell
+
+import (
+	"time"
+)
+
+// RetryPolicy is how many times commands that exit with a non-zero status are
+// run again, like flaky package installs. The zero value doesn't retry.
+type RetryPolicy struct {
+	// Retries is the number of times a failed command is run again.
+	Retries int
+	// Backoff is the delay before the first retry, doubled before each of
+	// the next ones.
+	Backoff time.Duration
+	// ExitCodes, if set, are the only exit codes retried.
+	ExitCodes []int
+}
+
+// Retryable returns true if a command that failed with err on its given
+// attempt, starting at 1, can run again. Only ExitErrors are retried, not
+// timeouts or failures to start.
+func (p RetryPolicy) Retryable(err error, attempt int) bool {
+	exitErr, ok := err.(*ExitError)
+	if !ok || attempt > p.Retries {
+		return false
+	}
+	if len(p.ExitCodes) == 0 {
+		return true
+	}
+	for _, code := range p.ExitCodes {
+		if code == exitErr.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait before running a command again after its
+// given attempt failed, starting at 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	// The delay stops doubling after 10 attempts.
+	if attempt > 10 {
+		attempt = 10
+	}
+	return p.Backoff << uint(attempt-1)
+}
@@ -0,0 +1,104 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+const _awsKMSScheme = "awskms"
+
+// _awsSigningAlgorithms are the signing algorithms of AWS KMS keys that cosign
+// can verify, by order of preference.
+var _awsSigningAlgorithms = []string{
+	kms.SigningAlgorithmSpecEcdsaSha256,
+	kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+}
+
+// awsKMSSigner signs payloads with an asymmetric AWS KMS key.
+type awsKMSSigner struct {
+	client    kmsiface.KMSAPI
+	keyID     string
+	algorithm string
+}
+
+// NewAWSKMSSigner returns a signer using an AWS KMS key referenced as
+// "[endpoint]/<key id, alias or ARN>", like "/alias/name". Credentials and
+// region come from the usual AWS environment variables and config files,
+// except for the region of ARNs.
+func NewAWSKMSSigner(ref string) (Signer, error) {
+	i := strings.Index(ref, "/")
+	if i < 0 || i == len(ref)-1 {
+		return nil, fmt.Errorf("invalid AWS KMS key reference %s, expected [endpoint]/<key>", ref)
+	}
+	endpoint, keyID := ref[:i], ref[i+1:]
+	config := aws.NewConfig()
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	if keyARN, err := arn.Parse(keyID); err == nil {
+		config = config.WithRegion(keyARN.Region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create AWS session: %s", err)
+	}
+	return newAWSKMSSigner(kms.New(sess), keyID)
+}
+
+// newAWSKMSSigner looks up the signing algorithm of the key.
+func newAWSKMSSigner(client kmsiface.KMSAPI, keyID string) (*awsKMSSigner, error) {
+	out, err := client.GetPublicKey(&kms.GetPublicKeyInput{KeyId: aws.String(keyID)})
+	if err != nil {
+		return nil, fmt.Errorf("get public key of %s: %s", keyID, err)
+	}
+	supported := make(map[string]bool)
+	for _, algorithm := range out.SigningAlgorithms {
+		supported[aws.StringValue(algorithm)] = true
+	}
+	for _, algorithm := range _awsSigningAlgorithms {
+		if supported[algorithm] {
+			return &awsKMSSigner{client, keyID, algorithm}, nil
+		}
+	}
+	return nil, fmt.Errorf(
+		"key %s supports none of the signing algorithms %s", keyID, strings.Join(_awsSigningAlgorithms, ", "))
+}
+
+// Sign implements Signer.
+func (s *awsKMSSigner) Sign(payload []byte) ([]byte, error) {
+	digest := sha256.Sum256(payload)
+	out, err := s.client.Sign(&kms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		Message:          digest[:],
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(s.algorithm),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sign with %s: %s", s.keyID, err)
+	}
+	return out.Signature, nil
+}
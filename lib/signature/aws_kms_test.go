@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKMS signs digests with a local key.
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	key        *ecdsa.PrivateKey
+	algorithms []string
+}
+
+func (f *fakeKMS) GetPublicKey(input *kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error) {
+	return &kms.GetPublicKeyOutput{
+		KeyId:             input.KeyId,
+		SigningAlgorithms: aws.StringSlice(f.algorithms),
+	}, nil
+}
+
+func (f *fakeKMS) Sign(input *kms.SignInput) (*kms.SignOutput, error) {
+	signature, err := ecdsa.SignASN1(rand.Reader, f.key, input.Message)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{
+		KeyId:            input.KeyId,
+		Signature:        signature,
+		SigningAlgorithm: input.SigningAlgorithm,
+	}, nil
+}
+
+func TestAWSKMSSigner(t *testing.T) {
+	require := require.New(t)
+	key := newECDSAKey(t)
+
+	client := &fakeKMS{key: key, algorithms: []string{kms.SigningAlgorithmSpecEcdsaSha256}}
+	signer, err := newAWSKMSSigner(client, "alias/release")
+	require.NoError(err)
+	require.Equal(kms.SigningAlgorithmSpecEcdsaSha256, signer.algorithm)
+
+	payload := []byte("payload")
+	signature, err := signer.Sign(payload)
+	require.NoError(err)
+	digest := sha256.Sum256(payload)
+	require.True(ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature))
+
+	client.algorithms = []string{kms.SigningAlgorithmSpecRsassaPssSha256}
+	_, err = newAWSKMSSigner(client, "alias/release")
+	require.Error(err)
+
+	_, err = NewSigner("awskms://alias")
+	require.Error(err)
+}
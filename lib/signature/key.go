@@ -0,0 +1,151 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordEnv is the environment variable holding the password of encrypted
+// cosign keys.
+const PasswordEnv = "COSIGN_PASSWORD"
+
+// PEM block types of encrypted keys generated by cosign.
+var _encryptedKeyTypes = map[string]bool{
+	"ENCRYPTED COSIGN PRIVATE KEY":   true,
+	"ENCRYPTED SIGSTORE PRIVATE KEY": true,
+}
+
+// encryptedKey is a private key encrypted by cosign, with a key derived from
+// its password by scrypt.
+type encryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// keySigner signs payloads with a private key.
+type keySigner struct {
+	key crypto.Signer
+}
+
+// NewKeyFileSigner returns a signer using the private key of a PEM file. The
+// password is only used by encrypted cosign keys.
+func NewKeyFileSigner(path string, password []byte) (Signer, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %s", err)
+	}
+	key, err := ParsePrivateKey(content, password)
+	if err != nil {
+		return nil, fmt.Errorf("parse key file %s: %s", path, err)
+	}
+	return keySigner{key}, nil
+}
+
+// ParsePrivateKey parses a PEM encoded private key, either generated by cosign
+// or in the PKCS #8, SEC 1 or PKCS #1 format.
+func ParsePrivateKey(content, password []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	der := block.Bytes
+	if _encryptedKeyTypes[block.Type] {
+		var err error
+		if der, err = decryptKey(block.Bytes, password); err != nil {
+			return nil, err
+		}
+	} else {
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(der)
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(der)
+		case "PRIVATE KEY":
+		default:
+			return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
+		}
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse PKCS #8 key: %s", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// decryptKey decrypts the content of an encrypted cosign key.
+func decryptKey(content, password []byte) ([]byte, error) {
+	var k encryptedKey
+	if err := json.Unmarshal(content, &k); err != nil {
+		return nil, fmt.Errorf("unmarshal encrypted key: %s", err)
+	}
+	if k.KDF.Name != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation function %s", k.KDF.Name)
+	} else if k.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("unsupported cipher %s", k.Cipher.Name)
+	} else if len(k.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("invalid nonce length %d", len(k.Cipher.Nonce))
+	}
+	derived, err := scrypt.Key(password, k.KDF.Salt, k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %s", err)
+	}
+	var secret [32]byte
+	var nonce [24]byte
+	copy(secret[:], derived)
+	copy(nonce[:], k.Cipher.Nonce)
+	der, ok := secretbox.Open(nil, k.Ciphertext, &nonce, &secret)
+	if !ok {
+		return nil, fmt.Errorf("decrypt key: wrong password")
+	}
+	return der, nil
+}
+
+// Sign implements Signer. Ed25519 keys sign the payload itself, as they hash
+// it internally.
+func (s keySigner) Sign(payload []byte) ([]byte, error) {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return s.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(payload)
+	return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
@@ -0,0 +1,141 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+func newECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func pemPKCS8(t *testing.T, key crypto.Signer) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// pemEncrypted encrypts a key like "cosign generate-key-pair", with cheaper
+// scrypt parameters.
+func pemEncrypted(t *testing.T, key crypto.Signer, password []byte) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	var k encryptedKey
+	k.KDF.Name = "scrypt"
+	k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P = 1024, 8, 1
+	k.KDF.Salt = make([]byte, 32)
+	k.Cipher.Name = "nacl/secretbox"
+	k.Cipher.Nonce = make([]byte, 24)
+	_, err = rand.Read(k.KDF.Salt)
+	require.NoError(t, err)
+	_, err = rand.Read(k.Cipher.Nonce)
+	require.NoError(t, err)
+
+	derived, err := scrypt.Key(password, k.KDF.Salt, 1024, 8, 1, 32)
+	require.NoError(t, err)
+	var secret [32]byte
+	var nonce [24]byte
+	copy(secret[:], derived)
+	copy(nonce[:], k.Cipher.Nonce)
+	k.Ciphertext = secretbox.Seal(nil, der, &nonce, &secret)
+
+	content, err := json.Marshal(k)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED COSIGN PRIVATE KEY", Bytes: content})
+}
+
+func writeKeyFile(t *testing.T, content []byte) string {
+	dir, err := ioutil.TempDir("", "signature")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	keyPath := filepath.Join(dir, "cosign.key")
+	require.NoError(t, ioutil.WriteFile(keyPath, content, 0600))
+	return keyPath
+}
+
+func TestKeyFileSignerECDSA(t *testing.T) {
+	require := require.New(t)
+	key := newECDSAKey(t)
+	payload := []byte("payload")
+	digest := sha256.Sum256(payload)
+
+	for name, content := range map[string][]byte{
+		"pkcs8":     pemPKCS8(t, key),
+		"encrypted": pemEncrypted(t, key, []byte("secret")),
+	} {
+		signer, err := NewKeyFileSigner(writeKeyFile(t, content), []byte("secret"))
+		require.NoError(err, name)
+		signature, err := signer.Sign(payload)
+		require.NoError(err, name)
+		require.True(ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature), name)
+	}
+}
+
+func TestKeyFileSignerRSAAndEd25519(t *testing.T) {
+	require := require.New(t)
+	payload := []byte("payload")
+	digest := sha256.Sum256(payload)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	content := pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	signer, err := NewKeyFileSigner(writeKeyFile(t, content), nil)
+	require.NoError(err)
+	signature, err := signer.Sign(payload)
+	require.NoError(err)
+	require.NoError(rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature))
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	signer, err = NewKeyFileSigner(writeKeyFile(t, pemPKCS8(t, private)), nil)
+	require.NoError(err)
+	signature, err = signer.Sign(payload)
+	require.NoError(err)
+	require.True(ed25519.Verify(public, payload, signature))
+}
+
+func TestParsePrivateKeyErrors(t *testing.T) {
+	require := require.New(t)
+	key := newECDSAKey(t)
+
+	_, err := ParsePrivateKey([]byte("not a key"), nil)
+	require.Error(err)
+	_, err = ParsePrivateKey(pemEncrypted(t, key, []byte("secret")), []byte("wrong"))
+	require.EqualError(err, "decrypt key: wrong password")
+	_, err = ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY"}), nil)
+	require.Error(err)
+}
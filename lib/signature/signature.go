@@ -0,0 +1,78 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package signature signs images in the format of cosign, so that their
+// signatures can be verified with "cosign verify".
+package signature
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// _payloadType is the type of the simple signing payloads signed by cosign.
+const _payloadType = "cosign container image signature"
+
+// payload is a simple signing payload, which binds a manifest digest to the
+// repository it was pushed to.
+type payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest image.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// Payload returns the payload signed for the manifest digest of an image
+// pushed to the given repository, like "registry.example.com/team/app".
+func Payload(repository string, digest image.Digest) ([]byte, error) {
+	var p payload
+	p.Critical.Identity.DockerReference = repository
+	p.Critical.Image.DockerManifestDigest = digest
+	p.Critical.Type = _payloadType
+	return json.Marshal(p)
+}
+
+// Signer signs payloads.
+type Signer interface {
+	// Sign returns the signature of payload, computed over its SHA-256 digest.
+	Sign(payload []byte) ([]byte, error)
+}
+
+// NewSigner returns the signer of a key reference, which is either a KMS URI
+// like "awskms:///alias/name" or "hashivault://name", or the path of a private
+// key file. Encrypted cosign keys are decrypted with $COSIGN_PASSWORD.
+func NewSigner(ref string) (Signer, error) {
+	i := strings.Index(ref, "://")
+	if i < 0 {
+		return NewKeyFileSigner(ref, []byte(os.Getenv(PasswordEnv)))
+	}
+	switch scheme := ref[:i]; scheme {
+	case _awsKMSScheme:
+		return NewAWSKMSSigner(ref[i+len("://"):])
+	case _vaultScheme:
+		return NewVaultSigner(ref[i+len("://"):])
+	default:
+		return nil, fmt.Errorf("unsupported key reference scheme %s://", scheme)
+	}
+}
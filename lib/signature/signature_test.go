@@ -0,0 +1,47 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayload(t *testing.T) {
+	require := require.New(t)
+
+	payload, err := Payload("example.com/team/app", "sha256:abcd")
+	require.NoError(err)
+	require.Equal(
+		`{"critical":{"identity":{"docker-reference":"example.com/team/app"},`+
+			`"image":{"docker-manifest-digest":"sha256:abcd"},`+
+			`"type":"cosign container image signature"},"optional":null}`,
+		string(payload))
+}
+
+func TestNewSigner(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewSigner("gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k")
+	require.Error(err)
+	_, err = NewSigner("/does/not/exist.key")
+	require.Error(err)
+
+	keyPath := writeKeyFile(t, pemPKCS8(t, newECDSAKey(t)))
+	signer, err := NewSigner(keyPath)
+	require.NoError(err)
+	require.IsType(keySigner{}, signer)
+}
@@ -0,0 +1,113 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/uber/makisu/lib/utils/httputil"
+)
+
+const _vaultScheme = "hashivault"
+
+// Environment variables configuring the Vault signer, as in cosign.
+const (
+	VaultAddrEnv        = "VAULT_ADDR"
+	VaultTokenEnv       = "VAULT_TOKEN"
+	VaultTransitPathEnv = "TRANSIT_SECRET_ENGINE_PATH"
+)
+
+// vaultSigner signs payloads with a key of the transit secrets engine of
+// HashiCorp Vault.
+type vaultSigner struct {
+	addr  string
+	token string
+	path  string
+	key   string
+}
+
+// NewVaultSigner returns a signer using the Vault transit key with the given
+// name. The address and token of Vault come from $VAULT_ADDR and $VAULT_TOKEN,
+// and the path of the engine from $TRANSIT_SECRET_ENGINE_PATH, or "transit".
+func NewVaultSigner(key string) (Signer, error) {
+	s := &vaultSigner{
+		addr:  strings.TrimSuffix(os.Getenv(VaultAddrEnv), "/"),
+		token: os.Getenv(VaultTokenEnv),
+		path:  strings.Trim(os.Getenv(VaultTransitPathEnv), "/"),
+		key:   key,
+	}
+	if key == "" {
+		return nil, fmt.Errorf("no Vault key name")
+	} else if s.addr == "" {
+		return nil, fmt.Errorf("$%s is not set", VaultAddrEnv)
+	} else if s.token == "" {
+		return nil, fmt.Errorf("$%s is not set", VaultTokenEnv)
+	}
+	if s.path == "" {
+		s.path = "transit"
+	}
+	return s, nil
+}
+
+// Sign implements Signer.
+func (s *vaultSigner) Sign(payload []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{
+		"input": base64.StdEncoding.EncodeToString(payload),
+		// Only used by RSA keys, which default to PSS.
+		"signature_algorithm": "pkcs1v15",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal sign request: %s", err)
+	}
+	URL := fmt.Sprintf("%s/v1/%s/sign/%s/sha2-256", s.addr, s.path, s.key)
+	resp, err := httputil.Send(
+		"POST",
+		URL,
+		httputil.SendHeaders(map[string]string{
+			"Content-Type":  "application/json",
+			"X-Vault-Token": s.token,
+		}),
+		httputil.SendBody(bytes.NewReader(body)),
+		httputil.SendAcceptedCodes(http.StatusOK))
+	if err != nil {
+		return nil, fmt.Errorf("sign with %s: %s", s.key, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode sign response: %s", err)
+	}
+	// Signatures are formatted as "vault:v<key version>:<base64 signature>".
+	parts := strings.SplitN(result.Data.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("invalid signature %q", result.Data.Signature)
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("decode signature: %s", err)
+	}
+	return signature, nil
+}
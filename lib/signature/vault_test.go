@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultSigner(t *testing.T) {
+	require := require.New(t)
+	key := newECDSAKey(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/transit/sign/release/sha2-256" || r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Input string `json:"input"`
+		}
+		require.NoError(json.NewDecoder(r.Body).Decode(&req))
+		input, err := base64.StdEncoding.DecodeString(req.Input)
+		require.NoError(err)
+		digest := sha256.Sum256(input)
+		signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		require.NoError(err)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]string{
+				"signature": "vault:v1:" + base64.StdEncoding.EncodeToString(signature),
+			},
+		})
+	}))
+	defer server.Close()
+
+	os.Setenv(VaultAddrEnv, server.URL)
+	defer os.Unsetenv(VaultAddrEnv)
+	_, err := NewSigner("hashivault://release")
+	require.Error(err)
+
+	os.Setenv(VaultTokenEnv, "token")
+	defer os.Unsetenv(VaultTokenEnv)
+	signer, err := NewSigner("hashivault://release")
+	require.NoError(err)
+	payload := []byte("payload")
+	signature, err := signer.Sign(payload)
+	require.NoError(err)
+	digest := sha256.Sum256(payload)
+	require.True(ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature))
+
+	signer, err = NewSigner("hashivault://other")
+	require.NoError(err)
+	_, err = signer.Sign(payload)
+	require.Error(err)
+}
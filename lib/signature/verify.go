@@ -0,0 +1,86 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// LoadPublicKey reads a PEM encoded public key, like the cosign.pub files
+// generated by cosign.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read public key: %s", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key %s: %s", path, err)
+	}
+	return key, nil
+}
+
+// Verify checks the signature of a payload, created by a Signer with the
+// private key of key.
+func Verify(key crypto.PublicKey, payload, signature []byte) error {
+	digest := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("invalid RSA signature: %s", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, signature) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
+
+// VerifyPayload checks that a payload was created by Payload for the manifest
+// digest.
+func VerifyPayload(content []byte, digest image.Digest) error {
+	var p payload
+	if err := json.Unmarshal(content, &p); err != nil {
+		return fmt.Errorf("unmarshal payload: %s", err)
+	}
+	if p.Critical.Type != _payloadType {
+		return fmt.Errorf("unsupported payload type %q", p.Critical.Type)
+	} else if p.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("payload signs %s instead of %s", p.Critical.Image.DockerManifestDigest, digest)
+	}
+	return nil
+}
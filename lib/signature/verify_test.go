@@ -0,0 +1,47 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	require := require.New(t)
+	key := newECDSAKey(t)
+	other := newECDSAKey(t)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(err)
+	keyPath := writeKeyFile(t, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	public, err := LoadPublicKey(keyPath)
+	require.NoError(err)
+
+	payload, err := Payload("example.com/app", "sha256:abcd")
+	require.NoError(err)
+	signature, err := keySigner{key}.Sign(payload)
+	require.NoError(err)
+	require.NoError(Verify(public, payload, signature))
+	require.Error(Verify(&other.PublicKey, payload, signature))
+	require.Error(Verify(public, []byte("other payload"), signature))
+
+	require.NoError(VerifyPayload(payload, "sha256:abcd"))
+	require.Error(VerifyPayload(payload, "sha256:ef"))
+	require.Error(VerifyPayload([]byte(`{"critical":{"type":"other"}}`), "sha256:abcd"))
+}
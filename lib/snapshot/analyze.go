@@ -0,0 +1,171 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// LayerUsage is the space used by the files of one layer.
+type LayerUsage struct {
+	// Files is the number of entries of the layer, whiteouts excluded.
+	Files int `json:"files"`
+	// Size is the size of the content of the files of the layer.
+	Size int64 `json:"size"`
+	// Wasted is the size of the files of the layer that are overwritten or
+	// deleted by later layers, or by the layer itself.
+	Wasted int64 `json:"wasted"`
+}
+
+// FileUsage is a file of the image and the layer it comes from.
+type FileUsage struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Layer int    `json:"layer"`
+}
+
+// LayerAnalysis describes how the layers of an image use space.
+type LayerAnalysis struct {
+	Layers []LayerUsage `json:"layers"`
+	// Size is the size of the content of the files of all layers.
+	Size int64 `json:"size"`
+	// Wasted is the size of the files hidden in the image by later layers.
+	Wasted int64 `json:"wasted"`
+	// Largest are the largest files of the image, by decreasing size. Empty
+	// files and directories are left out.
+	Largest []FileUsage `json:"largest"`
+}
+
+// Efficiency returns the share of the content of the layers that is visible in
+// the image, 1 if the layers are empty.
+func (a *LayerAnalysis) Efficiency() float64 {
+	if a.Size == 0 {
+		return 1
+	}
+	return float64(a.Size-a.Wasted) / float64(a.Size)
+}
+
+// analyzedFile is the latest version of a path while layers are analyzed.
+type analyzedFile struct {
+	layer int
+	size  int64
+}
+
+// AnalyzeLayers reads the given layers, from the lowest to the topmost one, and
+// returns the space used by each of them, the space wasted by files that later
+// layers overwrite or delete, and the top largest files of the image.
+func AnalyzeLayers(layers []LayerOpener, top int) (*LayerAnalysis, error) {
+	analysis := &LayerAnalysis{Layers: make([]LayerUsage, len(layers))}
+	files := make(map[string]analyzedFile)
+	waste := func(p string) {
+		if f, ok := files[p]; ok {
+			analysis.Layers[f.layer].Wasted += f.size
+			analysis.Wasted += f.size
+			delete(files, p)
+		}
+	}
+	wasteDescendants := func(dir string, below int) {
+		prefix := strings.TrimSuffix(dir, "/") + "/"
+		for p, f := range files {
+			if strings.HasPrefix(p, prefix) && f.layer < below {
+				waste(p)
+			}
+		}
+	}
+	for i, open := range layers {
+		if err := analyzeLayer(open, func(hdr *tar.Header) {
+			p := squashPath(hdr.Name)
+			switch kind, target := parseWhiteout(p); kind {
+			case fileWhiteout:
+				// Whiteouts never apply to files of their own layer.
+				if f, ok := files[target]; ok && f.layer < i {
+					waste(target)
+				}
+				wasteDescendants(target, i)
+			case opaqueWhiteout:
+				wasteDescendants(target, i)
+			case metaWhiteout:
+			default:
+				if hdr.Typeflag != tar.TypeDir {
+					wasteDescendants(p, i+1)
+				}
+				waste(p)
+				size := diffSize(hdr)
+				files[p] = analyzedFile{i, size}
+				analysis.Layers[i].Files++
+				analysis.Layers[i].Size += size
+				analysis.Size += size
+			}
+		}); err != nil {
+			return nil, fmt.Errorf("analyze layer %d: %s", i, err)
+		}
+	}
+
+	analysis.Largest = make([]FileUsage, 0, len(files))
+	for p, f := range files {
+		if f.size == 0 {
+			continue
+		}
+		analysis.Largest = append(analysis.Largest, FileUsage{p, f.size, f.layer})
+	}
+	sort.Slice(analysis.Largest, func(i, j int) bool {
+		a, b := analysis.Largest[i], analysis.Largest[j]
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.Path < b.Path
+	})
+	if len(analysis.Largest) > top {
+		analysis.Largest = analysis.Largest[:top]
+	}
+	return analysis, nil
+}
+
+// CountLayerFiles returns the number of entries of a layer, whiteouts excluded,
+// like the Files of LayerUsage, without looking for the files later layers
+// hide, which is slow for layers with many files.
+func CountLayerFiles(open LayerOpener) (int, error) {
+	var files int
+	err := analyzeLayer(open, func(hdr *tar.Header) {
+		if kind, _ := parseWhiteout(squashPath(hdr.Name)); kind == notWhiteout {
+			files++
+		}
+	})
+	return files, err
+}
+
+// analyzeLayer calls f on the header of each entry of a layer.
+func analyzeLayer(open LayerOpener, f func(*tar.Header)) error {
+	r, err := open()
+	if err != nil {
+		return fmt.Errorf("open: %s", err)
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read header: %s", err)
+		}
+		f(hdr)
+	}
+}
@@ -0,0 +1,64 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeLayers(t *testing.T) {
+	require := require.New(t)
+
+	// Files contain their own path, so "a/1" is 3 bytes.
+	layers := [][]layerEntry{
+		{"a/", "a/1", "a/2", "b/", "b/x"},
+		{"a/", "a/1", "a/.wh.2", "c"},
+		{"b/", "b/.wh..wh..opq", "b/y"},
+	}
+	var openers []LayerOpener
+	for _, layer := range layers {
+		content := tarLayerBytes(require, layer...)
+		openers = append(openers, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		})
+	}
+
+	analysis, err := AnalyzeLayers(openers, 2)
+	require.NoError(err)
+	require.Equal([]LayerUsage{
+		{Files: 5, Size: 9, Wasted: 9},
+		{Files: 3, Size: 4},
+		{Files: 2, Size: 3},
+	}, analysis.Layers)
+	require.Equal(int64(16), analysis.Size)
+	require.Equal(int64(9), analysis.Wasted)
+	require.InDelta(7.0/16, analysis.Efficiency(), 0.001)
+	require.Equal([]FileUsage{
+		{"/a/1", 3, 1},
+		{"/b/y", 3, 2},
+	}, analysis.Largest)
+
+	// Counts match the analysis.
+	for i, open := range openers {
+		files, err := CountLayerFiles(open)
+		require.NoError(err)
+		require.Equal(analysis.Layers[i].Files, files)
+	}
+}
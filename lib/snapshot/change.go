@@ -0,0 +1,102 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// Paranoid makes scans hash the content of all regular files whose metadata
+// didn't change, instead of only the ambiguous ones.
+//
+// By default, a file is unchanged if its mtime, size, mode and owner match
+// the version in MemFS. If the version in MemFS was recorded from disk, the
+// inode and ctime must match too: a replaced or rewritten file whose mtime was
+// restored is ambiguous, and its content is hashed and compared to the hash
+// recorded when the file was untarred or scanned. Without a recorded hash, it
+// is considered changed.
+var Paranoid = false
+
+// fileStat identifies the version of a regular file on disk recorded in MemFS.
+type fileStat struct {
+	ino   uint64
+	ctime time.Time
+
+	hash   uint64
+	hashed bool
+}
+
+// newFileStat returns the stat of the regular file src, or nil for other types.
+// The content is only hashed in paranoid mode, other modes hash it on demand.
+func newFileStat(src string, fi os.FileInfo, hdr *tar.Header) (*fileStat, error) {
+	if !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	stat := &fileStat{
+		ino:   utils.FileInfoStat(fi).Ino,
+		ctime: hdr.ChangeTime,
+	}
+	if Paranoid {
+		if err := stat.hashFile(src); err != nil {
+			return nil, err
+		}
+	}
+	return stat, nil
+}
+
+// hashFile hashes the content of src, unless it was already hashed.
+func (s *fileStat) hashFile(src string) error {
+	if s.hashed {
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open %s: %s", src, err)
+	}
+	defer f.Close()
+	h := xxhash.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("hash %s: %s", src, err)
+	}
+	s.hash, s.hashed = h.Sum64(), true
+	return nil
+}
+
+// isContentUpdated returns true if the content of the regular file src
+// changed since n was recorded, given their metadata match.
+func isContentUpdated(n *memFSNode, src string, stat *fileStat) (bool, error) {
+	known := n.stat
+	if known == nil {
+		// Recorded from a tar header only, metadata is all there is.
+		return false, nil
+	}
+	ambiguous := known.ino != stat.ino || !known.ctime.Equal(stat.ctime)
+	if !ambiguous && !Paranoid {
+		return false, nil
+	} else if !known.hashed {
+		return true, nil
+	}
+	if err := stat.hashFile(src); err != nil {
+		return false, err
+	}
+	return known.hash != stat.hash, nil
+}
@@ -0,0 +1,142 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+// rewriteKeepingMtime replaces the content of a file in place, and restores
+// its mtime.
+func rewriteKeepingMtime(require *require.Assertions, p, content string) {
+	fi, err := os.Lstat(p)
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(p, []byte(content), 0644))
+	require.NoError(os.Chtimes(p, fi.ModTime(), fi.ModTime()))
+}
+
+func scanLayerNames(require *require.Assertions, fs *MemFS) []string {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	require.NoError(fs.AddLayerByScan(w))
+	require.NoError(w.Close())
+
+	var names []string
+	r := tar.NewReader(&buf)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return names
+		}
+		require.NoError(err)
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestChangeDetection(t *testing.T) {
+	setup := func(require *require.Assertions) (string, *MemFS, func()) {
+		root, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		fs, err := NewMemFS(clock.New(), root, pathutils.DefaultBlacklist)
+		require.NoError(err)
+		fs.blacklist = nil
+		return root, fs, func() { os.RemoveAll(root) }
+	}
+
+	t.Run("UntarredFilesAreHashed", func(t *testing.T) {
+		require := require.New(t)
+		root, fs, cleanup := setup(require)
+		defer cleanup()
+
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		mtime := time.Now().Truncate(time.Second)
+		require.NoError(w.WriteHeader(&tar.Header{
+			Name: "a/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}))
+		for _, name := range []string{"a/same", "a/diff"} {
+			require.NoError(w.WriteHeader(&tar.Header{
+				Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(name)), ModTime: mtime}))
+			_, err := w.Write([]byte(name))
+			require.NoError(err)
+		}
+		require.NoError(w.Close())
+		require.NoError(fs.UpdateFromTarReader(tar.NewReader(&buf), true))
+		n := fs.tree.children["a"].children["same"]
+		require.NotNil(n.stat)
+		require.True(n.stat.hashed)
+
+		// Untarred paths aren't under the test root, so the content check is
+		// called directly instead of scanning.
+		isUpdated := func(content string) bool {
+			p := filepath.Join(root, "a/same")
+			rewriteKeepingMtime(require, p, content)
+			fi, err := os.Lstat(p)
+			require.NoError(err)
+			hdr, err := tar.FileInfoHeader(fi, "")
+			require.NoError(err)
+			stat, err := newFileStat(p, fi, hdr)
+			require.NoError(err)
+			updated, err := isContentUpdated(n, p, stat)
+			require.NoError(err)
+			return updated
+		}
+		require.False(isUpdated("a/same"))
+		require.True(isUpdated("a/SAME"))
+	})
+
+	t.Run("ScannedFilesWithoutHash", func(t *testing.T) {
+		require := require.New(t)
+		root, fs, cleanup := setup(require)
+		defer cleanup()
+
+		p := filepath.Join(root, "file")
+		require.NoError(ioutil.WriteFile(p, []byte("content"), 0644))
+		require.Equal([]string{"file"}, scanLayerNames(require, fs))
+		require.Empty(scanLayerNames(require, fs))
+
+		// The content wasn't hashed, so the file can only be assumed changed.
+		rewriteKeepingMtime(require, p, "content")
+		require.Equal([]string{"file"}, scanLayerNames(require, fs))
+		require.Empty(scanLayerNames(require, fs))
+	})
+
+	t.Run("Paranoid", func(t *testing.T) {
+		require := require.New(t)
+		root, fs, cleanup := setup(require)
+		defer cleanup()
+		Paranoid = true
+		defer func() { Paranoid = false }()
+
+		p := filepath.Join(root, "file")
+		require.NoError(ioutil.WriteFile(p, []byte("content"), 0644))
+		require.Equal([]string{"file"}, scanLayerNames(require, fs))
+
+		rewriteKeepingMtime(require, p, "content")
+		require.Empty(scanLayerNames(require, fs))
+		rewriteKeepingMtime(require, p, "CONTENT")
+		require.Equal([]string{"file"}, scanLayerNames(require, fs))
+	})
+}
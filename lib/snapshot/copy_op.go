@@ -22,6 +22,7 @@ import (
 
 	"github.com/uber/makisu/lib/fileio"
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/safepath"
 	"github.com/uber/makisu/lib/utils"
 )
 
@@ -81,6 +82,13 @@ func NewCopyOperation(
 
 // Execute performs the actual copying of files specified by the CopyOperation.
 func (c *CopyOperation) Execute() error {
+	// The destination may be under symlinks of the base image.
+	if resolved, err := safepath.Resolve("/", c.dst, true); err != nil {
+		return fmt.Errorf("resolve destination %s: %s", c.dst, err)
+	} else if pathutils.IsBlacklisted(resolved, c.blacklist) {
+		return fmt.Errorf("destination %s resolves to blacklisted %s", c.dst, resolved)
+	}
+
 	var err error
 	for _, src := range c.srcs {
 		src, err = evalSymlinks(src, c.srcRoot)
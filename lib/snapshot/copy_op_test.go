@@ -102,6 +102,29 @@ func TestExecuteCopyOperation(t *testing.T) {
 		require.Equal(_hello, b)
 	})
 
+	t.Run("destination through symlink to blacklisted dir", func(t *testing.T) {
+		require := require.New(t)
+
+		srcRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(srcRoot)
+		workDir, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		defer os.RemoveAll(workDir)
+
+		require.NoError(ioutil.WriteFile(filepath.Join(srcRoot, "test.txt"), _hello, os.ModePerm))
+		blacklisted := filepath.Join(workDir, "internal")
+		require.NoError(os.Mkdir(blacklisted, 0755))
+		require.NoError(os.Symlink(blacklisted, filepath.Join(workDir, "app")))
+
+		c, err := NewCopyOperation(
+			[]string{"/test.txt"}, srcRoot, workDir, "app/", validChown, []string{blacklisted}, false, false)
+		require.NoError(err)
+		require.Error(c.Execute())
+		_, err = os.Stat(filepath.Join(blacklisted, "test.txt"))
+		require.True(os.IsNotExist(err))
+	})
+
 	t.Run("absolute file to relative file", func(t *testing.T) {
 		require := require.New(t)
 
@@ -0,0 +1,131 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"sort"
+)
+
+// FileChange is a file added, removed or modified between two filesystems.
+// Sizes are 0 for files missing in a filesystem, and for non regular files.
+type FileChange struct {
+	Path    string `json:"path"`
+	Mode    string `json:"mode"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+}
+
+// Delta returns how much bigger the file got.
+func (c FileChange) Delta() int64 {
+	return c.NewSize - c.OldSize
+}
+
+// FSDiff lists the files that differ between two filesystems. Each list is
+// sorted by decreasing size change, so the files making an image grow the most
+// come first.
+type FSDiff struct {
+	Added    []FileChange `json:"added"`
+	Removed  []FileChange `json:"removed"`
+	Modified []FileChange `json:"modified"`
+}
+
+// Delta returns how much bigger the files of the second filesystem are.
+func (d FSDiff) Delta() int64 {
+	var delta int64
+	for _, changes := range [][]FileChange{d.Added, d.Removed, d.Modified} {
+		for _, c := range changes {
+			delta += c.Delta()
+		}
+	}
+	return delta
+}
+
+// DiffFS compares the merged layers of two filesystems. Files are modified if
+// their headers differ, ignoring mod times if ignoreModTime is set.
+func DiffFS(fs1, fs2 *MemFS, ignoreModTime bool) FSDiff {
+	missing1 := make(map[string]*memFSNode)
+	missing2 := make(map[string]*memFSNode)
+	diff1 := make(map[string]*memFSNode)
+	diff2 := make(map[string]*memFSNode)
+	compareNode(fs1.tree, fs2.tree, missing1, missing2, diff1, diff2, "/", ignoreModTime)
+
+	diff := FSDiff{
+		Added:    make([]FileChange, 0),
+		Removed:  make([]FileChange, 0),
+		Modified: make([]FileChange, 0),
+	}
+	for p, node := range missing1 {
+		walkDiffNode(p, node, func(p string, hdr *tar.Header) {
+			diff.Added = append(diff.Added, FileChange{
+				Path: p, Mode: hdr.FileInfo().Mode().String(), NewSize: diffSize(hdr),
+			})
+		})
+	}
+	for p, node := range missing2 {
+		walkDiffNode(p, node, func(p string, hdr *tar.Header) {
+			diff.Removed = append(diff.Removed, FileChange{
+				Path: p, Mode: hdr.FileInfo().Mode().String(), OldSize: diffSize(hdr),
+			})
+		})
+	}
+	for p, node := range diff2 {
+		diff.Modified = append(diff.Modified, FileChange{
+			Path:    p,
+			Mode:    node.hdr.FileInfo().Mode().String(),
+			OldSize: diffSize(diff1[p].hdr),
+			NewSize: diffSize(node.hdr),
+		})
+	}
+	for _, changes := range [][]FileChange{diff.Added, diff.Removed, diff.Modified} {
+		sortFileChanges(changes)
+	}
+	return diff
+}
+
+// walkDiffNode calls f on a node missing in one of the filesystems, and on all
+// its descendants.
+func walkDiffNode(p string, node *memFSNode, f func(string, *tar.Header)) {
+	f(p, node.hdr)
+	for name, child := range node.children {
+		walkDiffNode(filepath.Join(p, name), child, f)
+	}
+}
+
+// diffSize returns the size of the content of a file.
+func diffSize(hdr *tar.Header) int64 {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return 0
+	}
+	return hdr.Size
+}
+
+// sortFileChanges sorts changes by decreasing absolute size change, then path.
+func sortFileChanges(changes []FileChange) {
+	abs := func(n int64) int64 {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		di, dj := abs(changes[i].Delta()), abs(changes[j].Delta())
+		if di != dj {
+			return di > dj
+		}
+		return changes[i].Path < changes[j].Path
+	})
+}
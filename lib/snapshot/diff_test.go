@@ -0,0 +1,66 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+func TestDiffFS(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	clk := clock.NewMock()
+	fs1, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	l1 := newMemLayer()
+	require.NoError(addDirectoryToLayer(l1, tmpRoot, "/common", 0755))
+	require.NoError(addDirectoryToLayer(l1, tmpRoot, "/common/old", 0755))
+	require.NoError(addRegularFileToLayer(l1, tmpRoot, "/common/old/a", "aaaa", 0644))
+	require.NoError(addRegularFileToLayer(l1, tmpRoot, "/common/world", "hello", 0644))
+	require.NoError(fs1.merge(l1))
+
+	fs2, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	l2 := newMemLayer()
+	require.NoError(addDirectoryToLayer(l2, tmpRoot, "/common", 0755))
+	require.NoError(addRegularFileToLayer(l2, tmpRoot, "/common/world", "hello world", 0644))
+	require.NoError(addRegularFileToLayer(l2, tmpRoot, "/common/small", "s", 0644))
+	require.NoError(addRegularFileToLayer(l2, tmpRoot, "/common/big", "bigger", 0644))
+	require.NoError(fs2.merge(l2))
+
+	diff := DiffFS(fs1, fs2, true)
+	require.Equal([]FileChange{
+		{Path: "/common/big", Mode: "-rw-r--r--", NewSize: 6},
+		{Path: "/common/small", Mode: "-rw-r--r--", NewSize: 1},
+	}, diff.Added)
+	require.Equal([]FileChange{
+		{Path: "/common/old/a", Mode: "-rw-r--r--", OldSize: 4},
+		{Path: "/common/old", Mode: "drwxr-xr-x"},
+	}, diff.Removed)
+	require.Equal([]FileChange{
+		{Path: "/common/world", Mode: "-rw-r--r--", OldSize: 5, NewSize: 11},
+	}, diff.Modified)
+	require.Equal(int64(6+1-4+6), diff.Delta())
+}
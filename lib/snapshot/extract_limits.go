@@ -0,0 +1,78 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/storage"
+)
+
+// ExtractLimits bound what the layers of an image can expand to when they are
+// extracted, so that a malicious base image can't fill the disk or exhaust the
+// inodes of build nodes. Zero values are unlimited.
+type ExtractLimits struct {
+	// Size is the total size of the regular files of the image.
+	Size int64
+	// Files is the number of files, directories and links of the image.
+	Files int
+	// PathDepth is the number of components of the paths of the image.
+	PathDepth int
+}
+
+// IsZero returns true if the limits are all unlimited.
+func (l ExtractLimits) IsZero() bool {
+	return l == ExtractLimits{}
+}
+
+// NewCounter returns a counter of what the layers of one image expand to,
+// against the limits.
+func (l ExtractLimits) NewCounter() *ExtractCounter {
+	return &ExtractCounter{limits: l}
+}
+
+// ExtractCounter counts the files extracted from the layers of an image.
+type ExtractCounter struct {
+	limits ExtractLimits
+	size   int64
+	files  int
+}
+
+// add counts an entry about to be extracted, and returns an error if it
+// exceeds a limit.
+func (c *ExtractCounter) add(hdr *tar.Header) error {
+	c.files++
+	if c.limits.Files > 0 && c.files > c.limits.Files {
+		return fmt.Errorf("image exceeds the limit of %d files", c.limits.Files)
+	}
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+		c.size += hdr.Size
+		if c.limits.Size > 0 && c.size > c.limits.Size {
+			return fmt.Errorf("image expands to more than the limit of %s",
+				storage.FormatSize(c.limits.Size))
+		}
+	}
+	if c.limits.PathDepth > 0 {
+		depth := len(strings.Split(filepath.Clean(hdr.Name), "/"))
+		if depth > c.limits.PathDepth {
+			return fmt.Errorf("path %s is %d levels deep, past the limit of %d",
+				hdr.Name, depth, c.limits.PathDepth)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func extractLimitsTar(t *testing.T, files map[string]int) *bytes.Buffer {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for name, size := range files {
+		require.NoError(t, w.WriteHeader(&tar.Header{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(size)}))
+		_, err := w.Write(make([]byte, size))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return &buf
+}
+
+func TestUpdateFromTarReaderWithLimits(t *testing.T) {
+	require := require.New(t)
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	fs, err := NewMemFS(clock.New(), tmpRoot, nil)
+	require.NoError(err)
+
+	limits := ExtractLimits{Size: 100, Files: 3, PathDepth: 3}
+	require.False(limits.IsZero())
+	require.True(ExtractLimits{}.IsZero())
+
+	// The counter is shared by the layers of an image.
+	counter := limits.NewCounter()
+	require.NoError(fs.UpdateFromTarReaderWithLimits(
+		tar.NewReader(extractLimitsTar(t, map[string]int{"a": 60, "c": 10})), true, counter))
+	err = fs.UpdateFromTarReaderWithLimits(
+		tar.NewReader(extractLimitsTar(t, map[string]int{"d": 60})), true, counter)
+	require.Error(err)
+	require.Contains(err.Error(), "expands to more than the limit of")
+	_, err = os.Stat(filepath.Join(tmpRoot, "d"))
+	require.True(os.IsNotExist(err))
+
+	counter = limits.NewCounter()
+	err = fs.UpdateFromTarReaderWithLimits(
+		tar.NewReader(extractLimitsTar(t, map[string]int{"e": 0, "f": 0, "g": 0, "h": 0})), true, counter)
+	require.Error(err)
+	require.Contains(err.Error(), "exceeds the limit of 3 files")
+
+	counter = limits.NewCounter()
+	deep := strings.Repeat("x/", 3) + "y"
+	err = fs.UpdateFromTarReaderWithLimits(
+		tar.NewReader(extractLimitsTar(t, map[string]int{deep: 0})), false, counter)
+	require.Error(err)
+	require.Contains(err.Error(), "is 4 levels deep, past the limit of 3")
+
+	// Without counter, nothing is limited.
+	require.NoError(fs.UpdateFromTarReader(
+		tar.NewReader(extractLimitsTar(t, map[string]int{"i": 200})), true))
+}
@@ -20,16 +20,18 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/andres-erbsen/clock"
-	"github.com/uber/makisu/lib/docker/image"
+	"github.com/cespare/xxhash/v2"
 	"github.com/uber/makisu/lib/fileio"
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/mountutils"
 	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/safepath"
 	"github.com/uber/makisu/lib/tario"
 	"github.com/uber/makisu/lib/utils"
 )
@@ -63,6 +65,19 @@ type MemFS struct {
 
 	blacklist []string
 	layers    []*memLayer
+
+	// SpaceCheck, if set, is called with the estimated size of each layer
+	// before it's committed, and aborts the commit if it returns an error.
+	SpaceCheck func(size int64) error
+
+	// watcher, if set, records the directories to scan for the next layer.
+	watcher *Watcher
+	// skipped are the paths left out of the last scan by excludes. The
+	// watcher won't report them again, so watched scans rescan them.
+	skipped map[string]bool
+	// overlayChanges, if set, are the directories changed by the overlays
+	// committed since the last scan.
+	overlayChanges map[string]bool
 }
 
 // NewMemFS inits a new MemFS instance.
@@ -79,6 +94,7 @@ func NewMemFS(clk clock.Clock, root string, blacklist []string) (*MemFS, error)
 		clk:       clk,
 		tree:      newMemFSNode(newContentMemFile(root, "/", hdr)),
 		blacklist: blacklist,
+		skipped:   make(map[string]bool),
 	}, nil
 }
 
@@ -153,9 +169,9 @@ func (fs *MemFS) UpdateFromTarPath(source string, untar bool) error {
 		return fmt.Errorf("open tar file: %s", err)
 	}
 	defer reader.Close()
-	gzipReader, err := tario.NewGzipReader(reader)
+	gzipReader, err := tario.NewDecompressReader(reader)
 	if err != nil {
-		return fmt.Errorf("new gzip reader: %s", err)
+		return fmt.Errorf("new decompress reader: %s", err)
 	}
 	return fs.UpdateFromTarReader(tar.NewReader(gzipReader), untar)
 }
@@ -163,6 +179,15 @@ func (fs *MemFS) UpdateFromTarPath(source string, untar bool) error {
 // UpdateFromTarReader updates MemFS with the contents of the tarball from the
 // given reader, and optionally untars the tarball onto the root of MemFS.
 func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
+	return fs.UpdateFromTarReaderWithLimits(r, untar, nil)
+}
+
+// UpdateFromTarReaderWithLimits is like UpdateFromTarReader, but if counter is
+// not nil, fails before extracting an entry past its limits. A counter can be
+// shared by the layers of an image, to limit what they expand to together.
+func (fs *MemFS) UpdateFromTarReaderWithLimits(
+	r *tar.Reader, untar bool, counter *ExtractCounter) error {
+
 	start := time.Now()
 	// Keep a list of all hard links that we will create in a second pass.
 	hardlinks := make(map[string]*tar.Header)
@@ -171,6 +196,9 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 	// reset them.
 	modtimes := make(map[string]time.Time)
 
+	// Paths added by this layer, which its whiteouts don't apply to.
+	added := make(map[string]struct{})
+
 	var count int
 	l := newMemLayer()
 	for {
@@ -185,7 +213,10 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 			return fmt.Errorf("read header: %s", err)
 		}
 
-		path := filepath.Join(fs.tree.src, hdr.Name)
+		path, err := safepath.Join(fs.tree.src, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("invalid tar entry: %s", err)
+		}
 		if skip, err := shouldSkip(path, hdr.FileInfo(), fs.blacklist); err != nil {
 			return fmt.Errorf("check if should skip %s: %s", path, err)
 		} else if skip {
@@ -212,6 +243,27 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 
 		hdr.Name = pathutils.RelPath(hdr.Name)
 
+		switch kind, target := parseWhiteout(pathutils.AbsPath(hdr.Name)); kind {
+		case opaqueWhiteout:
+			if err := fs.applyOpaqueWhiteout(l, target, added, untar); err != nil {
+				return fmt.Errorf("apply opaque whiteout %s: %s", hdr.Name, err)
+			}
+			count++
+			continue
+		case fileWhiteout:
+			if _, ok := added[target]; ok {
+				log.Warnf("Ignoring whiteout of %s added by the same layer", target)
+				continue
+			}
+		case notWhiteout:
+			if counter != nil {
+				if err := counter.add(hdr); err != nil {
+					return err
+				}
+			}
+			markAdded(added, hdr.Name)
+		}
+
 		// If the new file is a hard link, then append it to the list
 		// that will be created later.
 		if hdr.Typeflag == tar.TypeLink {
@@ -219,12 +271,18 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 			hdr.Linkname = pathutils.AbsPath(hdr.Linkname)
 			hardlinks[path] = hdr
 		} else {
+			var stat *fileStat
 			if untar {
-				if err := fs.untarOneItem(path, hdr, r); err != nil {
+				if skip, err := fs.checkEscape(path, hdr); err != nil {
+					return err
+				} else if skip {
+					continue
+				}
+				if stat, err = fs.untarOneItem(path, hdr, r); err != nil {
 					return fmt.Errorf("untar one item %s: %s", path, err)
 				}
 			}
-			if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr, false); err != nil {
+			if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr, false, stat); err != nil {
 				return fmt.Errorf("add hdr from tar to layer: %s", err)
 			}
 		}
@@ -234,11 +292,16 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 	// Run through all the hard links and create them.
 	for path, hdr := range hardlinks {
 		if untar {
-			if err := fs.untarOneItem(path, hdr, nil); err != nil {
+			if skip, err := fs.checkEscape(path, hdr); err != nil {
+				return err
+			} else if skip {
+				continue
+			}
+			if _, err := fs.untarOneItem(path, hdr, nil); err != nil {
 				return fmt.Errorf("untar one item %s: %s", path, err)
 			}
 		}
-		if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr, false); err != nil {
+		if err := fs.maybeAddToLayer(l, pathutils.AbsPath(hdr.Name), pathutils.AbsPath(hdr.Name), hdr, false, nil); err != nil {
 			return fmt.Errorf("add hdr from tar to layer: %s", err)
 		}
 	}
@@ -258,17 +321,71 @@ func (fs *MemFS) UpdateFromTarReader(r *tar.Reader, untar bool) error {
 // between the file system and existing in-memory merged layers. The
 // resulting layer is merged in memory and written to the tar writer.
 func (fs *MemFS) AddLayerByScan(w *tar.Writer) error {
+	return fs.AddLayerByScanExcluding(nil, w)
+}
+
+// AddLayerByScanExcluding is like AddLayerByScan, but leaves out the paths
+// matching the exclude patterns (see pathutils.MatchesAnyPattern). Excluded
+// paths are not merged in memory either, so they are scanned again by the
+// next layer.
+func (fs *MemFS) AddLayerByScanExcluding(excludes []string, w *tar.Writer) error {
 	fs.sync()
-	if l, err := fs.createLayerByScan(); err != nil {
+	var l *memLayer
+	var err error
+	changes, watchErr := fs.stopWatching()
+	if changes == nil && watchErr == nil {
+		changes = fs.overlayChanges
+	}
+	fs.overlayChanges = nil
+	if changes != nil {
+		l, err = fs.createLayerByWatchedScan(changes, excludes)
+	} else {
+		if watchErr != nil {
+			log.Warnf("Falling back to full scan, changes may have been missed: %s", watchErr)
+		}
+		l, err = fs.createLayerByScan(excludes)
+	}
+	if err != nil {
 		return fmt.Errorf("create layer by scan: %s", err)
 	} else if err := fs.commitLayer(l, w); err != nil {
 		return fmt.Errorf("commit layer by scan: %s", err)
-	} else {
-		log.Infof("* Created layer by scanning filesystem; %d files found", l.count())
 	}
+	log.Infof("* Created layer by scanning filesystem; %d files found", l.count())
+	return nil
+}
+
+// StartWatching records the directories changed from now on, so the next
+// AddLayerByScan only scans them instead of the whole file system. It's a
+// no-op if the file system is already watched.
+func (fs *MemFS) StartWatching() error {
+	if fs.watcher != nil {
+		return nil
+	}
+	w, err := newWatcher(fs.tree.src, fs.blacklist)
+	if err != nil {
+		return fmt.Errorf("start watcher: %s", err)
+	}
+	fs.watcher = w
 	return nil
 }
 
+// StopWatching stops recording changes, and makes the next AddLayerByScan
+// scan the whole file system.
+func (fs *MemFS) StopWatching() {
+	fs.stopWatching()
+}
+
+// stopWatching stops the watcher, and returns the directories it recorded, or
+// nil if there was no watcher or it failed.
+func (fs *MemFS) stopWatching() (map[string]bool, error) {
+	if fs.watcher == nil {
+		return nil, nil
+	}
+	w := fs.watcher
+	fs.watcher = nil
+	return w.Close()
+}
+
 // AddLayerByCopyOps creates an in-memory layer by performing copy operations
 // on the given src-dst pairs. The file system is not modified during this
 // operation. The resulting layer is merged in memory and written to the tar
@@ -312,34 +429,97 @@ func (fs *MemFS) sync() {
 
 // createLayerByScan computes the differences between the file system and merged
 // layers in memory, updating MemFS as it goes and returning the diffs as a single layer.
-func (fs *MemFS) createLayerByScan() (*memLayer, error) {
+// Paths matching the exclude patterns are skipped.
+func (fs *MemFS) createLayerByScan(excludes []string) (*memLayer, error) {
 	start := time.Now()
 	log.Info("* Collecting filesystem diff")
 
 	l := newMemLayer()
 	root := fs.tree.src
-	if err := walk(
-		root, fs.blacklist, func(src string, fi os.FileInfo) error {
-			dst, err := pathutils.TrimRoot(src, root)
-			if err != nil {
-				return err
-			}
-			hdr, err := l.createHeader(fs.tree.src, src, dst, fi)
-			if err != nil {
-				return fmt.Errorf("create header %s: %s", dst, err)
-			}
-			if err := fs.maybeAddToLayer(l, src, dst, hdr, true); err != nil {
-				return fmt.Errorf("add to layer: %s", err)
+	fs.skipped = make(map[string]bool)
+	if err := fs.scanSubtree(l, root, excludes); err != nil {
+		return nil, fmt.Errorf("scan %s: %s", root, err)
+	}
+
+	log.Infow(fmt.Sprintf("* Collected diff: %d files found", l.count()), "duration", time.Since(start).Round(time.Millisecond))
+	return l, nil
+}
+
+// createLayerByWatchedScan is like createLayerByScan, but only scans the
+// directories recorded by the watcher or by overlays, and the paths skipped by
+// the last scan.
+func (fs *MemFS) createLayerByWatchedScan(
+	changes map[string]bool, excludes []string) (*memLayer, error) {
+
+	start := time.Now()
+	for p := range fs.skipped {
+		changes[p] = true
+	}
+	log.Infof("* Collecting filesystem diff of %d changed paths", len(changes))
+	var paths []string
+	for p := range changes {
+		paths = append(paths, p)
+	}
+	// Parents are sorted before their children.
+	sort.Strings(paths)
+
+	l := newMemLayer()
+	root := fs.tree.src
+	fs.skipped = make(map[string]bool)
+	f := fs.scanFunc(l, excludes)
+	var subtrees []string
+	for _, dst := range paths {
+		if pathutils.IsDescendantOfAny(dst, subtrees) {
+			continue
+		}
+		src := filepath.Join(root, dst)
+		if _, err := os.Lstat(src); os.IsNotExist(err) {
+			// Its parent was changed too.
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("lstat %s: %s", src, err)
+		}
+		if changes[dst] {
+			subtrees = append(subtrees, dst)
+			if err := fs.scanSubtree(l, src, excludes); err != nil {
+				return nil, fmt.Errorf("scan %s: %s", src, err)
 			}
-			return nil
-		}); err != nil {
-		return nil, fmt.Errorf("walk %s: %s", root, err)
+		} else if err := walkChildren(src, fs.blacklist, f); err != nil {
+			return nil, fmt.Errorf("walk children of %s: %s", src, err)
+		}
 	}
 
 	log.Infow(fmt.Sprintf("* Collected diff: %d files found", l.count()), "duration", time.Since(start).Round(time.Millisecond))
 	return l, nil
 }
 
+// scanFunc returns the function applied to each path scanned for layer l by
+// walkChildren.
+func (fs *MemFS) scanFunc(l *memLayer, excludes []string) func(string, os.FileInfo) error {
+	return func(src string, fi os.FileInfo) error {
+		n, err := fs.newScanNode(l, src, fi, excludes)
+		if err != nil || n == nil {
+			return err
+		} else if err := fs.applyScanTree(l, n); err != nil {
+			return err
+		} else if n.excluded && fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+}
+
+// scanSubtree adds the changes of the tree under src to layer l.
+func (fs *MemFS) scanSubtree(l *memLayer, src string, excludes []string) error {
+	tree, err := fs.scanTree(l, src, excludes)
+	if err != nil {
+		return fmt.Errorf("scan tree: %s", err)
+	} else if tree == nil {
+		return nil
+	}
+	return fs.applyScanTree(l, tree)
+}
+
 // addToLayer computes the in-memory differences created by the copy operation,
 // updating MemFS as it goes and returning the diffs as a single layer.
 // There are 3 cases:
@@ -405,13 +585,19 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 				// destination in dst (strip src prefix & append to dst).
 				currDst = filepath.Join(c.dst, currSrc[len(src):])
 			}
+			if isReservedName(currDst) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 			hdr, err := l.createHeader(fs.tree.src, currSrc, currDst, fi)
 			if err != nil {
 				return fmt.Errorf("create header %s: %s", currDst, err)
 			}
 			hdr.Uid = c.uid
 			hdr.Gid = c.gid
-			return fs.maybeAddToLayer(l, currSrc, currDst, hdr, false)
+			return fs.maybeAddToLayer(l, currSrc, currDst, hdr, false, nil)
 		}); err != nil {
 			return fmt.Errorf("copy src %s to dst %s: %s", src, c.dst, err)
 		}
@@ -422,6 +608,14 @@ func (fs *MemFS) addToLayer(l *memLayer, c *CopyOperation) error {
 // commitLayer writes the layer content into the given tar writer.
 // It ensures all paths are alphabetically sorted.
 func (fs *MemFS) commitLayer(l *memLayer, w *tar.Writer) error {
+	if err := l.resolveHardlinks(); err != nil {
+		return fmt.Errorf("resolve hard links: %s", err)
+	}
+	if fs.SpaceCheck != nil {
+		if err := fs.SpaceCheck(l.tarSize()); err != nil {
+			return err
+		}
+	}
 	// Write to tar header in alphabetical order.
 	if err := l.rangeFiles(func(f memFile) error {
 		return f.commit(w)
@@ -437,20 +631,33 @@ func (fs *MemFS) commitLayer(l *memLayer, w *tar.Writer) error {
 // It ensures that all intermediate directories exist.
 // Set createWhiteout to false to avoid whiting out files, but that won't
 // prevent files/directories from being overwritten.
+// stat is the version of the regular file on disk at dst, if known.
 func (fs *MemFS) maybeAddToLayer(
-	l *memLayer, src, dst string, hdr *tar.Header, createWhiteout bool) error {
+	l *memLayer, src, dst string, hdr *tar.Header, createWhiteout bool, stat *fileStat) error {
 	// Check if the header already exists and is up-to-date.
 	updated, n, err := fs.isUpdated(dst, hdr)
 	if err != nil {
 		return fmt.Errorf("check header %s: %s", dst, err)
-	} else if updated {
+	} else if !updated && stat != nil {
+		if updated, err = isContentUpdated(n, src, stat); err != nil {
+			return fmt.Errorf("check content %s: %s", dst, err)
+		} else if !updated {
+			// Record the current version, so it isn't ambiguous next time.
+			n.stat = stat
+		}
+	}
+	if updated {
 		if dst != "/" { // Root itself is not added to layers.
 			// Add intermediate directories for changed file.
 			if _, err := fs.addAncestors(l, pathutils.AbsPath(dst), false, 0, 0, 0); err != nil {
 				return fmt.Errorf("add ancestors of %s: %s", dst, err)
 			}
 			// Add changed file.
-			if err := l.addHeader(src, dst, hdr).updateMemFS(fs.tree); err != nil {
+			f := l.addHeader(src, dst, hdr)
+			if cf, ok := f.(*contentMemFile); ok {
+				cf.stat = stat
+			}
+			if err := f.updateMemFS(fs.tree); err != nil {
 				return fmt.Errorf("update memfs with file %s: %s", dst, err)
 			}
 		}
@@ -560,6 +767,7 @@ func (fs *MemFS) addAncestors(l *memLayer, dst string, inclusive bool, depth, ui
 		hdr.ModTime = fs.clk.Now()
 		hdr.Uid = uid
 		hdr.Gid = gid
+		hdr.PAXRecords = nil
 		if err := l.addHeader("", curr, hdr).updateMemFS(fs.tree); err != nil {
 			return "", fmt.Errorf("update memfs with ancestor %s: %s", curr, err)
 		}
@@ -570,45 +778,48 @@ func (fs *MemFS) addAncestors(l *memLayer, dst string, inclusive bool, depth, ui
 
 // untarOneItem handles untarring a single header from a tar archive to local
 // disk. It handles existing files on disk, applying metainfo from the header,
-// and writing content.
-func (fs *MemFS) untarOneItem(path string, header *tar.Header, r *tar.Reader) error {
+// and writing content. It returns the stat of regular files.
+func (fs *MemFS) untarOneItem(path string, header *tar.Header, r io.Reader) (*fileStat, error) {
 	// If it's a whiteout file, there's no need to check existing path on disk.
 	if strings.HasPrefix(filepath.Base(path), _whiteoutPrefix) {
 		if err := fs.untarWhiteout(path); err != nil {
-			return fmt.Errorf("untar dir: %s", err)
+			return nil, fmt.Errorf("untar dir: %s", err)
 		}
-		return nil
+		return nil, nil
 	}
 
 	headerInfo := header.FileInfo()
 	localInfo, err := os.Lstat(path)
 	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("lstat %s: %s", path, err)
+		return nil, fmt.Errorf("lstat %s: %s", path, err)
 	} else if err == nil {
 		var linkTarget string
 		if localInfo.Mode()&os.ModeSymlink != 0 {
 			linkTarget, err = os.Readlink(path)
 			if err != nil {
-				return fmt.Errorf("read link %s: %s", linkTarget, err)
+				return nil, fmt.Errorf("read link %s: %s", linkTarget, err)
 			}
 
 			if filepath.IsAbs(linkTarget) {
 				linkTarget, err = pathutils.TrimRoot(linkTarget, fs.tree.src)
 				if err != nil {
-					return fmt.Errorf("trim link %s: %s", linkTarget, err)
+					return nil, fmt.Errorf("trim link %s: %s", linkTarget, err)
 				}
 			}
 		}
 		localHeader, err := tar.FileInfoHeader(localInfo, linkTarget)
 		if err != nil {
-			return fmt.Errorf("create header %s: %s", path, err)
+			return nil, fmt.Errorf("create header %s: %s", path, err)
+		}
+		if err := tario.AddXattrs(path, localHeader); err != nil {
+			return nil, fmt.Errorf("add xattrs %s: %s", path, err)
 		}
 
 		// If the file is already on disk, nothing needs to be done.
 		if similar, err := tario.IsSimilarHeader(localHeader, header, false); err != nil {
-			return fmt.Errorf("compare headers %s: %s", path, err)
+			return nil, fmt.Errorf("compare headers %s: %s", path, err)
 		} else if similar {
-			return nil
+			return newFileStat(path, localInfo, localHeader)
 		}
 
 		// For existing directories, only update information instead of deleting.
@@ -616,47 +827,73 @@ func (fs *MemFS) untarOneItem(path string, header *tar.Header, r *tar.Reader) er
 		// like /etc/resolv.conf cannot be removed.
 		if headerInfo.IsDir() && localInfo.IsDir() {
 			if err := tario.ApplyHeader(path, header); err != nil {
-				return fmt.Errorf("update fi %s: %s", path, err)
+				return nil, fmt.Errorf("update fi %s: %s", path, err)
 			}
-			return nil
+			return nil, nil
 		}
 
 		// If a different file already exists on the system, remove it so it can be
 		// recreated later.
 		if err := os.RemoveAll(path); err != nil {
-			return fmt.Errorf("clear existing file %s: %s", path, err)
+			return nil, fmt.Errorf("clear existing file %s: %s", path, err)
 		}
 	}
 
 	switch header.Typeflag {
 	case tar.TypeDir:
 		if err := fs.untarDirectory(path, header); err != nil {
-			return fmt.Errorf("untar dir: %s", err)
+			return nil, fmt.Errorf("untar dir: %s", err)
 		}
 	case tar.TypeSymlink:
 		if err := fs.untarSymlink(path, header); err != nil {
-			return fmt.Errorf("untar symlink: %s", err)
+			return nil, fmt.Errorf("untar symlink: %s", err)
 		}
 	case tar.TypeLink:
 		if err := fs.untarHardlink(path, header); err != nil {
-			return fmt.Errorf("untar hard link: %s", err)
+			return nil, fmt.Errorf("untar hard link: %s", err)
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := fs.untarDevice(path, header); err != nil {
+			return nil, fmt.Errorf("untar device: %s", err)
 		}
 	default:
-		if err := fs.untarFile(path, header, r); err != nil {
-			return fmt.Errorf("untar file: %s", err)
+		stat, err := fs.untarFile(path, header, r)
+		if err != nil {
+			return nil, fmt.Errorf("untar file: %s", err)
 		}
+		return stat, nil
 	}
-	return nil
+	return nil, nil
 }
 
-// untarWhiteout removes the contents under the path specified by the whiteout file.
-func (fs *MemFS) untarWhiteout(path string) error {
-	oldBase := strings.TrimPrefix(filepath.Base(path), _whiteoutPrefix)
-	err := os.RemoveAll(filepath.Join(filepath.Dir(path), oldBase))
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("untar whiteout: %s", err)
+// checkEscape returns an error if untarring hdr at path would write outside
+// of the root of fs, through the symlinks of its parent dirs, or if hdr is a
+// hard link to a file outside of it. Entries that would write to blacklisted
+// paths through symlinks, or hard links to blacklisted files, are skipped like
+// blacklisted entries.
+func (fs *MemFS) checkEscape(path string, hdr *tar.Header) (bool, error) {
+	resolved, err := safepath.Resolve(fs.tree.src, path, false)
+	if err != nil {
+		return false, fmt.Errorf("unsafe tar entry %s: %s", hdr.Name, err)
+	} else if pathutils.IsBlacklisted(resolved, fs.blacklist) {
+		log.Warnf("Skipping tar entry %s, which resolves to blacklisted %s", hdr.Name, resolved)
+		return true, nil
 	}
-	return nil
+	if hdr.Typeflag != tar.TypeLink {
+		return false, nil
+	}
+	target, err := safepath.Join(fs.tree.src, hdr.Linkname)
+	if err != nil {
+		return false, fmt.Errorf("unsafe hard link %s: %s", hdr.Name, err)
+	}
+	resolved, err = safepath.Resolve(fs.tree.src, target, false)
+	if err != nil {
+		return false, fmt.Errorf("unsafe hard link %s: %s", hdr.Name, err)
+	} else if pathutils.IsBlacklisted(resolved, fs.blacklist) {
+		log.Warnf("Skipping hard link %s to blacklisted %s", hdr.Name, resolved)
+		return true, nil
+	}
+	return false, nil
 }
 
 // untarDirectory creates the directory specified by path and applies the header metadata.
@@ -700,53 +937,64 @@ func (fs *MemFS) untarHardlink(path string, header *tar.Header) error {
 }
 
 // untarFile creates the file specified by header at path, copies its content from
-// the tar reader, and applies the metadata.
-func (fs *MemFS) untarFile(path string, header *tar.Header, r *tar.Reader) error {
+// the tar reader, and applies the metadata. It returns the stat of the file,
+// with the hash of the content.
+func (fs *MemFS) untarFile(path string, header *tar.Header, r io.Reader) (*fileStat, error) {
 	fi := header.FileInfo()
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode())
 	if err != nil {
-		return fmt.Errorf("open file %s: %s", path, err)
+		return nil, fmt.Errorf("open file %s: %s", path, err)
 	}
 	defer file.Close()
-	if _, err := io.Copy(file, r); err != nil {
-		return fmt.Errorf("read from file %s: %s", path, err)
+	h := xxhash.New()
+	content := io.TeeReader(r, h)
+	if tario.IsSparse(header) {
+		if err := tario.CopySparse(file, content, header.Size); err != nil {
+			return nil, fmt.Errorf("copy sparse file %s: %s", path, err)
+		}
+	} else if _, err := io.Copy(file, content); err != nil {
+		return nil, fmt.Errorf("read from file %s: %s", path, err)
 	}
 	if err := tario.ApplyHeader(path, header); err != nil {
-		return fmt.Errorf("update fi %s: %s", path, err)
+		return nil, fmt.Errorf("update fi %s: %s", path, err)
 	}
-	return nil
-}
 
-// CompareFS is the public API for comparing merged layers of two images for differences.
-func CompareFS(fs1, fs2 *MemFS, image1Name, image2Name image.Name, ignoreModTime bool) {
-	missing1 := make(map[string]*memFSNode)
-	missing2 := make(map[string]*memFSNode)
-	diff1 := make(map[string]*memFSNode)
-	diff2 := make(map[string]*memFSNode)
-
-	compareNode(fs1.tree, fs2.tree, missing1, missing2, diff1, diff2, "/", ignoreModTime)
-	image1Format := image1Name.GetRepository() + ":" + image1Name.GetTag()
-	image2Format := image2Name.GetRepository() + ":" + image2Name.GetTag()
-	// Files missing in first image but appeared in second image.
-	log.Infof("===== file missing in first image %s =====", image1Format)
-	for _, node := range missing1 {
-		logMemFSNodeInfo(node)
+	localInfo, err := os.Lstat(path)
+	if err != nil {
+		return nil, fmt.Errorf("lstat %s: %s", path, err)
 	}
-
-	// Files missing in second image but appeared in first image.
-	log.Infof("===== file missing in second image %s =====", image2Format)
-	for _, node := range missing2 {
-		logMemFSNodeInfo(node)
+	localHeader, err := tar.FileInfoHeader(localInfo, "")
+	if err != nil {
+		return nil, fmt.Errorf("create header %s: %s", path, err)
+	}
+	stat, err := newFileStat(path, localInfo, localHeader)
+	if err != nil {
+		return nil, err
 	}
+	stat.hash, stat.hashed = h.Sum64(), true
+	return stat, nil
+}
 
-	// File differences in two images.
-	log.Infof("===== difference between two images %s and %s =====", image1Format, image2Format)
-	for path := range diff1 {
-		hdr1, hdr2 := diff1[path].hdr, diff2[path].hdr
-		log.Infof("%s %s %d %d %d", path, hdr1.FileInfo().Mode(), hdr1.Uid, hdr1.Gid, hdr1.Size)
-		log.Infof("%s %s %d %d %d", path, hdr2.FileInfo().Mode(), hdr2.Uid, hdr2.Gid, hdr2.Size)
-		log.Infof("xxxxxxxxxxxxxxxxxxxxxxxxxxx")
+// untarDevice creates the device node or named pipe specified by header at
+// path, and applies the metadata.
+func (fs *MemFS) untarDevice(path string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	dev := mkdev(header.Devmajor, header.Devminor)
+	if err := syscall.Mknod(path, mode, dev); err != nil {
+		return fmt.Errorf("mknod %s: %s", path, err)
 	}
+	if err := tario.ApplyHeader(path, header); err != nil {
+		return fmt.Errorf("update fi %s: %s", path, err)
+	}
+	return nil
 }
 
 // compareNode compares two memFSNodes for differences.
@@ -779,12 +1027,3 @@ func compareNode(node1, node2 *memFSNode, missing1, missing2, diff1, diff2 map[s
 		}
 	}
 }
-
-//logMemFSNodeInfo logs the info of a memFSNode.
-func logMemFSNodeInfo(node *memFSNode) {
-	hdr := node.hdr
-	log.Infof("%s %s %d %d %d", hdr.Name, hdr.FileInfo().Mode(), hdr.Uid, hdr.Gid, hdr.Size)
-	for _, nxtNode := range node.children {
-		logMemFSNodeInfo(nxtNode)
-	}
-}
@@ -16,11 +16,14 @@ package snapshot
 
 import (
 	"archive/tar"
+	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"syscall"
 	"testing"
 
 	"github.com/andres-erbsen/clock"
@@ -28,6 +31,24 @@ import (
 	"github.com/uber/makisu/lib/pathutils"
 )
 
+// _netRawCapability is the security.capability xattr of a binary with
+// cap_net_raw+ep, like ping.
+var _netRawCapability = string([]byte{
+	0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+})
+
+// _userACL is the system.posix_acl_access xattr of a 0755 file that user 1000
+// can also read, i.e. "u::rwx,u:1000:r-x,g::r-x,m::r-x,o::r-x".
+var _userACL = string([]byte{
+	0x02, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x07, 0x00, 0xff, 0xff, 0xff, 0xff,
+	0x02, 0x00, 0x05, 0x00, 0xe8, 0x03, 0x00, 0x00,
+	0x04, 0x00, 0x05, 0x00, 0xff, 0xff, 0xff, 0xff,
+	0x10, 0x00, 0x05, 0x00, 0xff, 0xff, 0xff, 0xff,
+	0x20, 0x00, 0x05, 0x00, 0xff, 0xff, 0xff, 0xff,
+})
+
 func TestUntarFromPath(t *testing.T) {
 	require := require.New(t)
 
@@ -587,7 +608,7 @@ func TestCreateLayerByScan(t *testing.T) {
 		require.NoError(addDirectoryToLayer(l1, tmpRoot, dst11, 0755))
 		dst12 := "/test1/test.txt"
 		require.NoError(addRegularFileToLayer(l1, tmpRoot, dst12, "hello", 0755))
-		l, err := fs.createLayerByScan()
+		l, err := fs.createLayerByScan(nil)
 		require.NoError(err)
 		requireEqualLayers(require, l1, l)
 
@@ -597,7 +618,7 @@ func TestCreateLayerByScan(t *testing.T) {
 		require.NoError(addDirectoryToLayer(l2, tmpRoot, dst22, 0755))
 		dst23 := "/test1/test2/test3"
 		require.NoError(addDirectoryToLayer(l2, tmpRoot, dst23, 0755))
-		l, err = fs.createLayerByScan()
+		l, err = fs.createLayerByScan(nil)
 		require.NoError(err)
 		requireEqualLayers(require, l2, l)
 	})
@@ -621,7 +642,7 @@ func TestCreateLayerByScan(t *testing.T) {
 		require.NoError(addDirectoryToLayer(l1, tmpRoot, dst12, 0755))
 		dst13 := "/test11/test12/ignore1"
 		require.NoError(addDirectoryToLayer(l1, tmpRoot, dst13, 0755))
-		l, err := fs.createLayerByScan()
+		l, err := fs.createLayerByScan(nil)
 		require.NoError(err)
 		requireEqualLayers(require, l1, l)
 
@@ -634,7 +655,7 @@ func TestCreateLayerByScan(t *testing.T) {
 		require.NoError(addSymlinkToLayer(l2, tmpRoot, dst23, dst11))
 		dst24 := "/test21/test22/ignore2"
 		require.NoError(addDirectoryToLayer(l2, tmpRoot, dst24, 0755))
-		l, err = fs.createLayerByScan()
+		l, err = fs.createLayerByScan(nil)
 		require.NoError(err)
 		requireEqualLayers(require, l2, l)
 	})
@@ -660,7 +681,7 @@ func TestCreateLayerByScan(t *testing.T) {
 		require.NoError(addRegularFileToLayer(l1, tmpRoot, dst13, "hello", 0755))
 		dst14 := "/test11/test14.txt"
 		require.NoError(addRegularFileToLayer(l1, tmpRoot, dst14, "hello", 0755))
-		l, err := fs.createLayerByScan()
+		l, err := fs.createLayerByScan(nil)
 		require.NoError(err)
 		requireEqualLayers(require, l1, l)
 
@@ -679,7 +700,7 @@ func TestCreateLayerByScan(t *testing.T) {
 		os.RemoveAll(filepath.Join(tmpRoot, dst14))
 		require.NoError(addDirectoryToLayer(l2, tmpRoot, dst24, 0755))
 		os.RemoveAll(filepath.Join(tmpRoot, dst24))
-		l, err = fs.createLayerByScan()
+		l, err = fs.createLayerByScan(nil)
 		require.NoError(err)
 		requireEqualLayers(require, l2, l)
 	})
@@ -1115,6 +1136,210 @@ func TestAddLayerByScanWhiteout(t *testing.T) {
 	require.Equal(1, count)
 }
 
+func TestAddLayerByScanHardlinksAndFifos(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	clk := clock.NewMock()
+	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+
+	require.NoError(os.Mkdir(filepath.Join(tmpRoot, "test"), 0755))
+	target := filepath.Join(tmpRoot, "test", "a.txt")
+	require.NoError(ioutil.WriteFile(target, []byte("hello"), 0644))
+	require.NoError(os.Link(target, filepath.Join(tmpRoot, "test", "b.txt")))
+	require.NoError(syscall.Mkfifo(filepath.Join(tmpRoot, "test", "fifo"), 0600))
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	require.NoError(fs.AddLayerByScan(w))
+	require.NoError(w.Close())
+
+	// The content of the hard linked file is only written once.
+	headers := make(map[string]*tar.Header)
+	r := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		headers[hdr.Name] = hdr
+	}
+	require.Equal(byte(tar.TypeReg), headers["test/a.txt"].Typeflag)
+	require.Equal(int64(5), headers["test/a.txt"].Size)
+	require.Equal(byte(tar.TypeLink), headers["test/b.txt"].Typeflag)
+	require.Equal("test/a.txt", headers["test/b.txt"].Linkname)
+	require.Equal(byte(tar.TypeFifo), headers["test/fifo"].Typeflag)
+
+	// Nothing changed, so the next scan is empty.
+	require.NoError(fs.AddLayerByScan(tar.NewWriter(ioutil.Discard)))
+	require.Equal(0, fs.layers[len(fs.layers)-1].count())
+
+	// Untar the layer to another root.
+	outRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(outRoot)
+	outFS, err := NewMemFS(clk, outRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	outFS.blacklist = nil
+	require.NoError(outFS.UpdateFromTarReader(tar.NewReader(bytes.NewReader(buf.Bytes())), true))
+
+	fi1, err := os.Lstat(filepath.Join(outRoot, "test", "a.txt"))
+	require.NoError(err)
+	fi2, err := os.Lstat(filepath.Join(outRoot, "test", "b.txt"))
+	require.NoError(err)
+	require.True(os.SameFile(fi1, fi2))
+	fi, err := os.Lstat(filepath.Join(outRoot, "test", "fifo"))
+	require.NoError(err)
+	require.True(fi.Mode()&os.ModeNamedPipe != 0)
+}
+
+func TestAddLayerByScanExcluding(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+
+	for _, p := range []string{"var/cache/apt/a.deb", "app/main.py", "app/main.pyc", "app/lib/util.pyc"} {
+		require.NoError(os.MkdirAll(filepath.Join(tmpRoot, filepath.Dir(p)), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, p), []byte(p), 0644))
+	}
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	require.NoError(fs.AddLayerByScanExcluding([]string{"/var/cache/apt", "**/*.pyc"}, w))
+	require.NoError(w.Close())
+
+	listNames := func(content []byte) []string {
+		var names []string
+		r := tar.NewReader(bytes.NewReader(content))
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			names = append(names, hdr.Name)
+		}
+		return names
+	}
+	require.Equal([]string{"app/", "app/lib/", "app/main.py", "var/", "var/cache/"}, listNames(buf.Bytes()))
+
+	// Excluded files are not merged, so a scan without excludes picks them up.
+	buf.Reset()
+	w = tar.NewWriter(&buf)
+	require.NoError(fs.AddLayerByScan(w))
+	require.NoError(w.Close())
+	names := listNames(buf.Bytes())
+	require.Contains(names, "var/cache/apt/a.deb")
+	require.Contains(names, "app/main.pyc")
+	require.Contains(names, "app/lib/util.pyc")
+	require.NotContains(names, "app/main.py")
+}
+
+func TestAddLayerSpaceCheck(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+
+	require.NoError(os.MkdirAll(filepath.Join(tmpRoot, "a"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, "a/1"), make([]byte, 1000), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, "a/2"), make([]byte, 1000), 0644))
+
+	var size int64
+	fs.SpaceCheck = func(s int64) error {
+		size = s
+		return errors.New("no space")
+	}
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	require.EqualError(fs.AddLayerByScan(w), "commit layer by scan: no space")
+	// A header block per entry, and the content of the files padded to blocks.
+	require.Equal(int64(3*512+2*1024), size)
+	require.Equal(0, buf.Len())
+}
+
+func TestAddLayerByWatchedScan(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	for _, p := range []string{"a/b/c", "a/b/d", "e/f", "g/h/i", "j/k", "cache/old"} {
+		require.NoError(os.MkdirAll(filepath.Join(tmpRoot, filepath.Dir(p)), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, p), []byte(p), 0644))
+	}
+
+	// fs1 scans the directories changed while it's watching, fs2 always scans
+	// everything.
+	var fss []*MemFS
+	for i := 0; i < 2; i++ {
+		fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist)
+		require.NoError(err)
+		fs.blacklist = nil
+		require.NoError(fs.AddLayerByScan(tar.NewWriter(ioutil.Discard)))
+		fss = append(fss, fs)
+	}
+	fs1 := fss[0]
+
+	scan := func(excludes []string) (map[string]*tar.Header, map[string]*tar.Header) {
+		var results []map[string]*tar.Header
+		for _, fs := range fss {
+			var buf bytes.Buffer
+			w := tar.NewWriter(&buf)
+			require.NoError(fs.AddLayerByScanExcluding(excludes, w))
+			require.NoError(w.Close())
+			headers, err := readTarHelper(tar.NewReader(&buf))
+			require.NoError(err)
+			results = append(results, headers)
+		}
+		return results[0], results[1]
+	}
+
+	require.NoError(fs1.StartWatching())
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, "a/b/c"), []byte("changed"), 0644))
+	require.NoError(os.Remove(filepath.Join(tmpRoot, "e/f")))
+	require.NoError(os.Chmod(filepath.Join(tmpRoot, "j/k"), 0600))
+	require.NoError(os.RemoveAll(filepath.Join(tmpRoot, "g")))
+	require.NoError(os.MkdirAll(filepath.Join(tmpRoot, "l/m/n"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, "l/m/n/o"), []byte("new"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, "cache/new"), []byte("new"), 0644))
+	require.NoError(os.Rename(filepath.Join(tmpRoot, "l/m"), filepath.Join(tmpRoot, "p")))
+	watched, full := scan([]string{"/cache"})
+	require.NotEmpty(full)
+	require.Equal(len(full), len(watched))
+	for name, hdr := range full {
+		require.Contains(watched, name)
+		require.Equal(hdr.Typeflag, watched[name].Typeflag, name)
+		require.Equal(hdr.Size, watched[name].Size, name)
+		require.Equal(hdr.Mode, watched[name].Mode, name)
+	}
+
+	// The paths left out by excludes are scanned again.
+	require.NoError(fs1.StartWatching())
+	watched, full = scan(nil)
+	require.Contains(full, "cache/new")
+	require.Contains(watched, "cache/new")
+	require.Equal(len(full), len(watched))
+}
+
 func TestAddLayersEqual(t *testing.T) {
 	require := require.New(t)
 
@@ -1277,3 +1502,132 @@ func TestCompareFS(t *testing.T) {
 	require.Equal(expectedDiff, actualDiff1)
 	require.Equal(expectedDiff, actualDiff2)
 }
+
+func TestSpecialPermissionsThroughMemFS(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	probe := filepath.Join(tmpRoot, "probe")
+	require.NoError(ioutil.WriteFile(probe, nil, 0644))
+	if err := syscall.Setxattr(probe, "security.capability", []byte(_netRawCapability), 0); err != nil {
+		t.Skipf("File capabilities not supported: %s", err)
+	} else if err := syscall.Setxattr(probe, "system.posix_acl_access", []byte(_userACL), 0); err != nil {
+		t.Skipf("ACLs not supported: %s", err)
+	}
+	require.NoError(os.Remove(probe))
+
+	// A base layer with ping and sudo like binaries.
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0755, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": _netRawCapability}},
+		{Name: "bin/sudo", Typeflag: tar.TypeReg, Mode: 0755 | 04000},
+		{Name: "bin/data", Typeflag: tar.TypeReg, Mode: 0755, PAXRecords: map[string]string{
+			"SCHILY.xattr.system.posix_acl_access": _userACL}},
+		{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 0777 | 01000},
+	} {
+		require.NoError(w.WriteHeader(hdr))
+	}
+	require.NoError(w.Close())
+
+	fs, err := NewMemFS(clock.New(), tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+	require.NoError(fs.UpdateFromTarReader(tar.NewReader(&buf), true))
+
+	getXattr := func(name, attr string) string {
+		value := make([]byte, 256)
+		size, err := syscall.Getxattr(filepath.Join(tmpRoot, name), attr, value)
+		require.NoError(err)
+		return string(value[:size])
+	}
+	require.Equal(_netRawCapability, getXattr("bin/ping", "security.capability"))
+	require.Equal(_userACL, getXattr("bin/data", "system.posix_acl_access"))
+	fi, err := os.Stat(filepath.Join(tmpRoot, "bin/sudo"))
+	require.NoError(err)
+	require.Equal(0755|os.ModeSetuid, fi.Mode())
+	fi, err = os.Stat(filepath.Join(tmpRoot, "tmp"))
+	require.NoError(err)
+	require.Equal(0777|os.ModeDir|os.ModeSticky, fi.Mode())
+
+	// Copy the binaries with a different owner.
+	c, err := NewCopyOperation(
+		[]string{"/bin"}, tmpRoot, "", "/usr/bin/", "1:1", pathutils.DefaultBlacklist, false, false)
+	require.NoError(err)
+	var layer bytes.Buffer
+	w = tar.NewWriter(&layer)
+	require.NoError(fs.AddLayerByCopyOps([]*CopyOperation{c}, w))
+	require.NoError(w.Close())
+
+	headers := make(map[string]*tar.Header)
+	r := tar.NewReader(&layer)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		headers[hdr.Name] = hdr
+	}
+	require.Equal(1, headers["usr/bin/ping"].Uid)
+	require.Equal(_netRawCapability, headers["usr/bin/ping"].PAXRecords["SCHILY.xattr.security.capability"])
+	require.Equal(int64(0755|04000), headers["usr/bin/sudo"].Mode)
+	require.Equal(_userACL, headers["usr/bin/data"].PAXRecords["SCHILY.xattr.system.posix_acl_access"])
+}
+
+func TestUpdateFromTarReaderEscapes(t *testing.T) {
+	require := require.New(t)
+
+	// untar untars the entries to root, which has a blacklisted internal dir,
+	// in tmp.
+	untar := func(hdrs ...*tar.Header) (string, error) {
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			require.NoError(w.WriteHeader(hdr))
+		}
+		require.NoError(w.Close())
+		tmp, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		root := filepath.Join(tmp, "root")
+		internal := filepath.Join(root, "internal")
+		require.NoError(os.MkdirAll(internal, 0755))
+		fs, err := NewMemFS(clock.New(), root, []string{internal})
+		require.NoError(err)
+		return tmp, fs.UpdateFromTarReader(tar.NewReader(&buf), true)
+	}
+
+	// Entries can't go above the root.
+	tmp, err := untar(&tar.Header{Name: "../file", Typeflag: tar.TypeReg, Mode: 0644})
+	defer os.RemoveAll(tmp)
+	require.Error(err)
+	_, err = os.Stat(filepath.Join(tmp, "file"))
+	require.True(os.IsNotExist(err))
+
+	tmp, err = untar(&tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"})
+	defer os.RemoveAll(tmp)
+	require.Error(err)
+
+	// Nor be written through symlinks leading outside of it.
+	tmp, err = untar(
+		&tar.Header{Name: "up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		&tar.Header{Name: "up/file", Typeflag: tar.TypeReg, Mode: 0644})
+	defer os.RemoveAll(tmp)
+	require.Error(err)
+	_, err = os.Stat(filepath.Join(tmp, "file"))
+	require.True(os.IsNotExist(err))
+
+	// Entries written to blacklisted paths through symlinks are skipped.
+	tmp, err = untar(
+		&tar.Header{Name: "app", Typeflag: tar.TypeSymlink, Linkname: "internal"},
+		&tar.Header{Name: "app/file", Typeflag: tar.TypeReg, Mode: 0644})
+	defer os.RemoveAll(tmp)
+	require.NoError(err)
+	_, err = os.Stat(filepath.Join(tmp, "root/internal/file"))
+	require.True(os.IsNotExist(err))
+}
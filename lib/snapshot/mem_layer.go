@@ -23,9 +23,9 @@ import (
 	"sort"
 	"strings"
 
-	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/pathutils"
 	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils"
 )
 
 // memFile represents one file in an in-memory layer.
@@ -39,6 +39,13 @@ type contentMemFile struct {
 	src string // Location to read content from while creating tar
 	dst string // Location to write content to. Key to layer.files
 	hdr *tar.Header
+
+	// Set if the content was already committed at another path of the same
+	// layer, in which case a hard link to that path is written instead.
+	linkname string
+
+	// stat is set for regular files recorded from disk, see Paranoid.
+	stat *fileStat
 }
 
 // newContentMemFile inits a new contentMemFile.
@@ -81,65 +88,33 @@ func (f *contentMemFile) updateMemFS(node *memFSNode) error {
 
 // commit writes the contentMemFile's contents to the tar writer.
 func (f *contentMemFile) commit(w *tar.Writer) error {
-	if err := tario.WriteEntry(w, f.src, f.hdr); err != nil {
-		return fmt.Errorf("content commit %s: %s", f.hdr.Name, err)
-	}
-	return nil
-}
-
-// whiteoutMemFile represents a MemFile implementation that deletes contents.
-type whiteoutMemFile struct {
-	del string // Location to delete. Key to layer.files key
-	hdr *tar.Header
-}
-
-// newWhiteoutMemFile inits a new whiteoutMemFile.
-func newWhiteoutMemFile(deletedPath, whiteoutPath string) *whiteoutMemFile {
-	return &whiteoutMemFile{
-		del: deletedPath,
-		hdr: &tar.Header{Name: pathutils.RelPath(whiteoutPath)},
-	}
-}
-
-// updateMemFS deletes the memFSNode designated by whiteoutMemFile from the tree rooted at node.
-func (f *whiteoutMemFile) updateMemFS(node *memFSNode) error {
-	parts := pathutils.SplitPath(f.del)
-	for i, part := range parts {
-		if n, ok := node.children[part]; ok {
-			if i == len(parts)-1 {
-				delete(node.children, part)
-			} else {
-				node = n
-			}
-		} else {
-			if i != len(parts)-1 {
-				return fmt.Errorf("missing intermediate dir %s in %s", part, f.del)
-			}
-			// This could happen to files that's cleaned up in the background, like
-			// python package's .dist-info or .pth file.
-			log.Warnf("Trying to whiteout nonexistent path: %s", f.del)
-		}
+	hdr := f.hdr
+	if f.linkname != "" {
+		// Keep the header in the in-memory fs untouched, since it describes
+		// the regular file on disk.
+		link := *f.hdr
+		link.Typeflag = tar.TypeLink
+		link.Linkname = pathutils.RelPath(f.linkname)
+		link.Size = 0
+		hdr = &link
 	}
-	return nil
-}
-
-// commit writes an empty whiteout file to the tar writer.
-func (f *whiteoutMemFile) commit(w *tar.Writer) error {
-	if err := tario.WriteHeader(w, f.hdr); err != nil {
-		return fmt.Errorf("whiteout commit %s: %s", f.hdr.Name, err)
+	if err := tario.WriteEntry(w, f.src, hdr); err != nil {
+		return fmt.Errorf("content commit %s: %s", f.hdr.Name, err)
 	}
 	return nil
 }
 
 // memLayer is an in-memory path to tar header map for one image layer.
 type memLayer struct {
-	files map[string]memFile // Path to memFile map
+	files  map[string]memFile // Path to memFile map
+	inodes map[string]uint64  // Path to inode map of hard linked files
 }
 
 // newMemLayer inits a new memLayer instance.
 func newMemLayer() *memLayer {
 	return &memLayer{
-		files: make(map[string]memFile),
+		files:  make(map[string]memFile),
+		inodes: make(map[string]uint64),
 	}
 }
 
@@ -148,6 +123,19 @@ func (l *memLayer) count() int {
 	return len(l.files)
 }
 
+// tarSize returns the estimated size of the layer tar: a header block per file,
+// and the content of regular files, padded to blocks.
+func (l *memLayer) tarSize() int64 {
+	var size int64
+	for _, f := range l.files {
+		size += 512
+		if cf, ok := f.(*contentMemFile); ok && cf.linkname == "" && cf.hdr.Typeflag == tar.TypeReg {
+			size += (cf.hdr.Size + 511) / 512 * 512
+		}
+	}
+	return size
+}
+
 // createHeader creates a new tar header from given path and file info.
 func (l *memLayer) createHeader(root, src, dst string, fi os.FileInfo) (*tar.Header, error) {
 	hdr, err := tar.FileInfoHeader(fi, "")
@@ -161,6 +149,12 @@ func (l *memLayer) createHeader(root, src, dst string, fi os.FileInfo) (*tar.Hea
 	hdr.Uname = ""
 	hdr.Gname = ""
 
+	// Synthesized ancestors have no src to read xattrs from.
+	if src != "" {
+		if err := tario.AddXattrs(src, hdr); err != nil {
+			return nil, fmt.Errorf("add xattrs %s: %s", src, err)
+		}
+	}
 	src = pathutils.AbsPath(src)
 
 	switch hdr.Typeflag {
@@ -183,12 +177,41 @@ func (l *memLayer) createHeader(root, src, dst string, fi os.FileInfo) (*tar.Hea
 			}
 			hdr.Linkname = target
 		}
-	case tar.TypeLink, tar.TypeReg, tar.TypeRegA:
-		// TODO: Handle hard link detection here.
 	}
 	return hdr, nil
 }
 
+// addInode records the inode of a regular file with multiple links, so files
+// sharing it are committed as hard links by resolveHardlinks.
+func (l *memLayer) addInode(src, dst string, fi os.FileInfo) {
+	if !fi.Mode().IsRegular() || utils.FileInfoStat(fi).Nlink < 2 {
+		return
+	}
+	l.inodes[pathutils.AbsPath(dst)] = resolveHardLink(src, fi)
+}
+
+// resolveHardlinks makes files of the layer that share an inode hard links to
+// the first of them in commit order, so their content is only written once.
+func (l *memLayer) resolveHardlinks() error {
+	targets := make(map[uint64]string)
+	return l.rangeFiles(func(f memFile) error {
+		cf, ok := f.(*contentMemFile)
+		if !ok || (cf.hdr.Typeflag != tar.TypeReg && cf.hdr.Typeflag != tar.TypeRegA) {
+			return nil
+		}
+		inode, ok := l.inodes[cf.dst]
+		if !ok {
+			return nil
+		}
+		if target, ok := targets[inode]; ok {
+			cf.linkname = target
+		} else {
+			targets[inode] = cf.dst
+		}
+		return nil
+	})
+}
+
 // addHeader adds given tar header to layer.
 // If the given path has whiteout prefix, path of the deleted file/dir will be
 // used as key.
@@ -197,11 +220,9 @@ func (l *memLayer) createHeader(root, src, dst string, fi os.FileInfo) (*tar.Hea
 func (l *memLayer) addHeader(src, dst string, hdr *tar.Header) memFile {
 	src = pathutils.AbsPath(src)
 	dst = pathutils.AbsPath(dst)
-	d, b := filepath.Split(dst)
 
 	var mf memFile
-	if strings.HasPrefix(b, _whiteoutPrefix) {
-		deleted := d + strings.TrimPrefix(b, _whiteoutPrefix)
+	if kind, deleted := parseWhiteout(dst); kind == fileWhiteout {
 		mf = newWhiteoutMemFile(deleted, dst)
 		l.files[deleted] = mf
 	} else {
@@ -0,0 +1,211 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/tario"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// Overlay is an overlayfs mounted on top of the root of a MemFS. Commands
+// chrooted in it write their changes to its upper dir instead of the root, so
+// the layer can be derived from the upper dir without scanning the whole file
+// system.
+type Overlay struct {
+	dir    string
+	upper  string
+	work   string
+	merged string
+
+	// mounts are the mountpoints of the root bound in merged, in mount order.
+	mounts []string
+	// xattrPrefix is the prefix of the extended attributes overlayfs sets in
+	// the upper dir, which depends on the mount options.
+	xattrPrefix string
+}
+
+// Root returns the merged view of the overlay, which commands must be chrooted
+// in.
+func (o *Overlay) Root() string {
+	return o.merged
+}
+
+// MountOverlay mounts an overlay of the file system in dir. It's only supported
+// on linux, and requires the permission to mount overlayfs, either privileged
+// or in a user namespace. The upper dir must not be on the file system of the
+// root itself, so dir should be on a mounted volume.
+func (fs *MemFS) MountOverlay(dir string) (*Overlay, error) {
+	// Leftovers of a failed build.
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("clear overlay dir %s: %s", dir, err)
+	}
+	o, err := mountOverlay(fs.tree.src, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return o, nil
+}
+
+// CommitOverlay unmounts the overlay, and applies the changes of its upper dir
+// to the file system. The changed directories are recorded, so the next
+// AddLayerByScan only scans them.
+func (fs *MemFS) CommitOverlay(o *Overlay) error {
+	defer os.RemoveAll(o.dir)
+	if err := o.unmount(); err != nil {
+		return fmt.Errorf("unmount overlay: %s", err)
+	}
+	start := time.Now()
+	if err := fs.applyOverlay(o); err != nil {
+		return fmt.Errorf("apply overlay: %s", err)
+	}
+	log.Infow(fmt.Sprintf("* Applied overlay changes, %d directories changed", len(fs.overlayChanges)),
+		"duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// HasOverlayChanges returns true if overlays were committed since the last
+// scan.
+func (fs *MemFS) HasOverlayChanges() bool {
+	return fs.overlayChanges != nil
+}
+
+// ResetOverlayChanges forgets the directories changed by the overlays
+// committed since the last scan, so the next AddLayerByScan scans the whole
+// file system. It must be called when the file system is changed outside of
+// overlays after an overlay was committed.
+func (fs *MemFS) ResetOverlayChanges() {
+	fs.overlayChanges = nil
+}
+
+// applyOverlay moves the content of the upper dir of the overlay to the root,
+// and records the directories it changed. Directories are recorded with true
+// if they are opaque, since their whole subtree must be scanned again.
+func (fs *MemFS) applyOverlay(o *Overlay) error {
+	if fs.overlayChanges == nil {
+		fs.overlayChanges = make(map[string]bool)
+	}
+	// Hard links of the upper dir, by inode.
+	links := make(map[uint64]string)
+	// Mod times of the directories, reset once their children were moved.
+	modtimes := make(map[string]time.Time)
+	if err := filepath.Walk(o.upper, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("walk %s: %s", p, err)
+		}
+		rel, err := filepath.Rel(o.upper, p)
+		if err != nil {
+			return fmt.Errorf("rel path of %s: %s", p, err)
+		}
+		dst := path.Join("/", rel)
+		target := filepath.Join(fs.tree.src, dst)
+
+		if o.isWhiteout(fi) {
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("remove %s: %s", target, err)
+			}
+			return nil
+		} else if fi.IsDir() {
+			opaque, err := o.isOpaque(p)
+			if err != nil {
+				return fmt.Errorf("check opaque %s: %s", p, err)
+			}
+			fs.overlayChanges[dst] = fs.overlayChanges[dst] || opaque
+			if dst == "/" {
+				// The upper dir itself isn't copied from the root.
+				return nil
+			} else if opaque {
+				if err := removeChildren(target); err != nil {
+					return fmt.Errorf("clear opaque dir %s: %s", target, err)
+				}
+			}
+		} else if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("remove %s: %s", target, err)
+		}
+
+		var linkTarget string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if linkTarget, err = os.Readlink(p); err != nil {
+				return fmt.Errorf("read link %s: %s", p, err)
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, linkTarget)
+		if err != nil {
+			return fmt.Errorf("create header %s: %s", p, err)
+		} else if err := tario.AddXattrs(p, hdr); err != nil {
+			return fmt.Errorf("add xattrs %s: %s", p, err)
+		}
+		if fi.Mode().IsRegular() {
+			stat := utils.FileInfoStat(fi)
+			if first, ok := links[stat.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+			} else if stat.Nlink > 1 {
+				links[stat.Ino] = dst
+			}
+		}
+
+		var r io.Reader
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(p)
+			if err != nil {
+				return fmt.Errorf("open %s: %s", p, err)
+			}
+			defer f.Close()
+			r = f
+		}
+		if _, err := fs.untarOneItem(target, hdr, r); err != nil {
+			return fmt.Errorf("move %s: %s", dst, err)
+		} else if fi.IsDir() {
+			modtimes[target] = fi.ModTime()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for dir, modtime := range modtimes {
+		if err := os.Chtimes(dir, modtime, modtime); err != nil {
+			return fmt.Errorf("chtimes on directory %s: %s", dir, err)
+		}
+	}
+	return nil
+}
+
+// removeChildren removes the content of dir.
+func removeChildren(dir string) error {
+	children, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range children {
+		if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
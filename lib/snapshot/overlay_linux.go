@@ -0,0 +1,143 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/mountutils"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// _overlayOptions are the mount options tried in order, with the prefix of the
+// extended attributes they make overlayfs use. Redirects and metacopy are
+// disabled, so the upper dir holds the full content of the changed files and
+// directories. userxattr allows mounting in a user namespace.
+var _overlayOptions = []struct {
+	options     string
+	xattrPrefix string
+}{
+	{"index=off,redirect_dir=off,metacopy=off", "trusted.overlay."},
+	{"userxattr,index=off,redirect_dir=off,metacopy=off", "user.overlay."},
+}
+
+// mountOverlay mounts an overlay of lower in dir, and binds the mountpoints
+// under lower in it.
+func mountOverlay(lower, dir string) (*Overlay, error) {
+	o := &Overlay{
+		dir:    dir,
+		upper:  filepath.Join(dir, "upper"),
+		work:   filepath.Join(dir, "work"),
+		merged: filepath.Join(dir, "merged"),
+	}
+	for _, d := range []string{o.upper, o.work, o.merged} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, fmt.Errorf("create dir %s: %s", d, err)
+		}
+	}
+
+	var err error
+	for _, opt := range _overlayOptions {
+		data := fmt.Sprintf(
+			"lowerdir=%s,upperdir=%s,workdir=%s,%s", lower, o.upper, o.work, opt.options)
+		if err = syscall.Mount("overlay", o.merged, "overlay", 0, data); err == nil {
+			o.xattrPrefix = opt.xattrPrefix
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mount overlay: %s", err)
+	}
+	if err := o.bindMounts(lower); err != nil {
+		o.unmount()
+		return nil, fmt.Errorf("bind mounts: %s", err)
+	}
+	return o, nil
+}
+
+// bindMounts binds the mountpoints under lower in the overlay, like /proc or
+// /etc/resolv.conf, since overlayfs only shows the file system of lower
+// itself. Changes to them aren't recorded by the overlay, like they aren't
+// scanned. Mountpoints that contain the overlay are left out.
+func (o *Overlay) bindMounts(lower string) error {
+	mountpoints, err := mountutils.Mountpoints()
+	if err != nil {
+		return fmt.Errorf("list mountpoints: %s", err)
+	}
+	var handled []string
+	for _, mp := range mountpoints {
+		if mp == lower || !pathutils.IsDescendantOfAny(mp, []string{lower}) ||
+			pathutils.IsDescendantOfAny(mp, handled) {
+			continue
+		}
+		handled = append(handled, mp)
+		if pathutils.IsDescendantOfAny(o.dir, []string{mp}) {
+			log.Debugf("Skipping mountpoint %s in overlay, it contains the overlay", mp)
+			continue
+		}
+		rel, err := filepath.Rel(lower, mp)
+		if err != nil {
+			return fmt.Errorf("rel path of %s: %s", mp, err)
+		}
+		target := filepath.Join(o.merged, rel)
+		if err := syscall.Mount(mp, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %s", mp, err)
+		}
+		o.mounts = append(o.mounts, target)
+	}
+	return nil
+}
+
+// unmount unmounts the bound mountpoints and the overlay. Unmounts are lazy,
+// in case commands left processes running in the overlay.
+func (o *Overlay) unmount() error {
+	for i := len(o.mounts) - 1; i >= 0; i-- {
+		if err := syscall.Unmount(o.mounts[i], syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("unmount %s: %s", o.mounts[i], err)
+		}
+	}
+	o.mounts = nil
+	if err := syscall.Unmount(o.merged, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount %s: %s", o.merged, err)
+	}
+	return nil
+}
+
+// isWhiteout returns true if the file of the upper dir marks a deleted path,
+// which overlayfs does with a 0/0 character device.
+func (o *Overlay) isWhiteout(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeCharDevice != 0 && utils.FileInfoStat(fi).Rdev == 0
+}
+
+// isOpaque returns true if the directory of the upper dir hides the content of
+// the lower one.
+func (o *Overlay) isOpaque(p string) (bool, error) {
+	value := make([]byte, 1)
+	size, err := syscall.Getxattr(p, o.xattrPrefix+"opaque", value)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return false, nil
+	} else if err == syscall.ERANGE {
+		// Longer than "y".
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return size == 1 && value[0] == 'y', nil
+}
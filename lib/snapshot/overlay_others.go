@@ -0,0 +1,38 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package snapshot
+
+import (
+	"errors"
+	"os"
+)
+
+func mountOverlay(lower, dir string) (*Overlay, error) {
+	return nil, errors.New("overlay snapshots are only supported on linux")
+}
+
+func (o *Overlay) unmount() error {
+	return errors.New("overlay snapshots are only supported on linux")
+}
+
+func (o *Overlay) isWhiteout(fi os.FileInfo) bool {
+	return false
+}
+
+func (o *Overlay) isOpaque(p string) (bool, error) {
+	return false, nil
+}
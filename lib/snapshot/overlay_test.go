@@ -0,0 +1,82 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+func TestOverlay(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	sandbox, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(sandbox)
+
+	for _, p := range []string{"a/keep", "a/del", "a/mod", "b/x"} {
+		require.NoError(os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755))
+		require.NoError(ioutil.WriteFile(filepath.Join(root, p), []byte(p), 0644))
+	}
+	fs, err := NewMemFS(clock.New(), root, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+	scanLayerNames(require, fs)
+
+	o, err := fs.MountOverlay(filepath.Join(sandbox, "overlay"))
+	if err != nil {
+		t.Skipf("Cannot mount overlay: %s", err)
+	}
+	merged := o.Root()
+	require.NoError(ioutil.WriteFile(filepath.Join(merged, "a/mod"), []byte("new"), 0644))
+	require.NoError(os.Remove(filepath.Join(merged, "a/del")))
+	require.NoError(ioutil.WriteFile(filepath.Join(merged, "a/new"), []byte("new"), 0644))
+	require.NoError(os.Link(filepath.Join(merged, "a/new"), filepath.Join(merged, "a/link")))
+	require.NoError(os.RemoveAll(filepath.Join(merged, "b")))
+	require.NoError(os.Mkdir(filepath.Join(merged, "b"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(merged, "b/y"), []byte("b/y"), 0644))
+
+	// Changes are only visible in the overlay until it's committed.
+	_, err = os.Lstat(filepath.Join(root, "a/new"))
+	require.True(os.IsNotExist(err))
+	require.NoError(fs.CommitOverlay(o))
+	require.True(fs.HasOverlayChanges())
+
+	require.Equal([]string{"/a", "/a/keep", "/a/link", "/a/mod", "/a/new", "/b", "/b/y"}, listDisk(require, root))
+	content, err := ioutil.ReadFile(filepath.Join(root, "a/mod"))
+	require.NoError(err)
+	require.Equal("new", string(content))
+	newInfo, err := os.Lstat(filepath.Join(root, "a/new"))
+	require.NoError(err)
+	linkInfo, err := os.Lstat(filepath.Join(root, "a/link"))
+	require.NoError(err)
+	require.True(os.SameFile(newInfo, linkInfo))
+	_, err = os.Lstat(filepath.Join(sandbox, "overlay"))
+	require.True(os.IsNotExist(err))
+
+	require.ElementsMatch([]string{
+		"a/", "a/.wh.del", "a/link", "a/mod", "a/new", "b/", "b/.wh.x", "b/y",
+	}, scanLayerNames(require, fs))
+	require.False(fs.HasOverlayChanges())
+}
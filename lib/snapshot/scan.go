@@ -0,0 +1,161 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/uber/makisu/lib/concurrency"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/utils"
+)
+
+// ScanConcurrency is the number of directories listed in parallel by scans.
+// Default is the number of CPUs.
+var ScanConcurrency = runtime.NumCPU()
+
+// SetScanConcurrency sets global var ScanConcurrency.
+func SetScanConcurrency(concurrency int) error {
+	if concurrency < 1 {
+		return fmt.Errorf("invalid scan concurrency %d", concurrency)
+	}
+	ScanConcurrency = concurrency
+	return nil
+}
+
+// scanNode is a path found by scanTree, with the header to compare against
+// MemFS.
+type scanNode struct {
+	src      string
+	dst      string
+	fi       os.FileInfo
+	hdr      *tar.Header
+	stat     *fileStat
+	excluded bool
+	children []*scanNode
+}
+
+// scanTree lists the tree under src and creates the headers of its paths,
+// skipping blacklisted paths and not descending into excluded ones. The
+// directories of each level of the tree are listed in parallel by
+// ScanConcurrency goroutines. It returns nil if src itself is skipped.
+func (fs *MemFS) scanTree(l *memLayer, src string, excludes []string) (*scanNode, error) {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return nil, fmt.Errorf("lstat %s: %s", src, err)
+	}
+	root, err := fs.newScanNode(l, src, fi, excludes)
+	if err != nil || root == nil {
+		return nil, err
+	}
+
+	level := []*scanNode{root}
+	for len(level) > 0 {
+		multiError := utils.NewMultiErrors()
+		workers := concurrency.NewWorkerPool(ScanConcurrency)
+		for _, n := range level {
+			if n.excluded || !n.fi.IsDir() {
+				continue
+			}
+			n := n
+			workers.Do(func() {
+				if err := fs.scanDir(l, n, excludes); err != nil {
+					multiError.Add(err)
+					workers.Stop()
+				}
+			})
+		}
+		workers.Wait()
+		if err := multiError.Collect(); err != nil {
+			return nil, err
+		}
+
+		var next []*scanNode
+		for _, n := range level {
+			next = append(next, n.children...)
+		}
+		level = next
+	}
+	return root, nil
+}
+
+// scanDir lists the children of directory n, in lexical order.
+func (fs *MemFS) scanDir(l *memLayer, n *scanNode, excludes []string) error {
+	children, err := ioutil.ReadDir(n.src)
+	if err != nil {
+		return fmt.Errorf("read dir %s: %s", n.src, err)
+	}
+	for _, fi := range children {
+		child, err := fs.newScanNode(l, filepath.Join(n.src, fi.Name()), fi, excludes)
+		if err != nil {
+			return err
+		} else if child != nil {
+			n.children = append(n.children, child)
+		}
+	}
+	return nil
+}
+
+// newScanNode returns the node of src, or nil if src is skipped.
+func (fs *MemFS) newScanNode(
+	l *memLayer, src string, fi os.FileInfo, excludes []string) (*scanNode, error) {
+
+	if skip, err := shouldSkip(src, fi, fs.blacklist); err != nil {
+		return nil, fmt.Errorf("check should skip: %s", err)
+	} else if skip {
+		return nil, nil
+	}
+	dst, err := pathutils.TrimRoot(src, fs.tree.src)
+	if err != nil {
+		return nil, err
+	} else if isReservedName(dst) {
+		return nil, nil
+	}
+	n := &scanNode{src: src, dst: dst, fi: fi}
+	if dst != "/" && pathutils.MatchesAnyPattern(dst, excludes) {
+		n.excluded = true
+		return n, nil
+	}
+	if n.hdr, err = l.createHeader(fs.tree.src, src, dst, fi); err != nil {
+		return nil, fmt.Errorf("create header %s: %s", dst, err)
+	} else if n.stat, err = newFileStat(src, fi, n.hdr); err != nil {
+		return nil, fmt.Errorf("stat %s: %s", dst, err)
+	}
+	return n, nil
+}
+
+// applyScanTree adds the nodes of the tree that changed to the layer, in the
+// same order as a walk.
+func (fs *MemFS) applyScanTree(l *memLayer, n *scanNode) error {
+	if n.excluded {
+		fs.skipped[n.dst] = true
+		return nil
+	}
+	l.addInode(n.src, n.dst, n.fi)
+	if err := fs.maybeAddToLayer(l, n.src, n.dst, n.hdr, true, n.stat); err != nil {
+		return fmt.Errorf("add to layer: %s", err)
+	}
+	for _, child := range n.children {
+		if err := fs.applyScanTree(l, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
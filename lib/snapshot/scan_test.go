@@ -0,0 +1,211 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+func TestScanTreeConcurrency(t *testing.T) {
+	require := require.New(t)
+	defer SetScanConcurrency(ScanConcurrency)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			p := filepath.Join(tmpRoot, fmt.Sprintf("d%d/e%d/f", i, j))
+			require.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+			require.NoError(ioutil.WriteFile(p, []byte(p), 0644))
+		}
+	}
+	require.NoError(os.Symlink("d0/e0/f", filepath.Join(tmpRoot, "link")))
+	require.NoError(os.MkdirAll(filepath.Join(tmpRoot, "skipped/sub"), 0755))
+
+	var layers [][]string
+	for _, concurrency := range []int{1, 8} {
+		require.NoError(SetScanConcurrency(concurrency))
+		fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist)
+		require.NoError(err)
+		fs.blacklist = []string{filepath.Join(tmpRoot, "skipped")}
+
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		require.NoError(fs.AddLayerByScanExcluding([]string{"/d9"}, w))
+		require.NoError(w.Close())
+
+		var names []string
+		r := tar.NewReader(&buf)
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			names = append(names, hdr.Name)
+		}
+		layers = append(layers, names)
+	}
+
+	require.Equal(layers[0], layers[1])
+	require.Len(layers[0], 9*(1+10*2)+1)
+	require.Contains(layers[0], "link")
+	require.NotContains(layers[0], "d9/")
+	require.NotContains(layers[0], "skipped/")
+}
+
+// TestScanExoticNames checks that names exotic base images may contain survive
+// a scan followed by an untar to another root, and that files named like
+// whiteouts are left out of layers.
+func TestScanExoticNames(t *testing.T) {
+	require := require.New(t)
+	clk := clock.NewMock()
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	deep := ""
+	for i := 0; i < 30; i++ {
+		deep = filepath.Join(deep, strings.Repeat(string(rune('a'+i)), 100))
+	}
+	names := []string{
+		"new\nline",
+		"\xff\xfe",
+		strings.Repeat("x", 255),
+		"日本語",
+		"back\\slash",
+		"Case", "case",
+		filepath.Join(deep, "f"),
+	}
+	for _, name := range names {
+		p := filepath.Join(tmpRoot, name)
+		require.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(ioutil.WriteFile(p, []byte(name), 0644))
+	}
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, ".wh.case"), nil, 0644))
+	require.NoError(os.MkdirAll(filepath.Join(tmpRoot, ".wh..wh.dir"), 0755))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpRoot, ".wh..wh.dir", "f"), nil, 0644))
+
+	fs, err := NewMemFS(clk, tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	require.NoError(fs.AddLayerByScan(w))
+	require.NoError(w.Close())
+
+	r := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		require.NotContains(hdr.Name, _whiteoutPrefix)
+	}
+
+	outRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(outRoot)
+	outFS, err := NewMemFS(clk, outRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	outFS.blacklist = nil
+	require.NoError(outFS.UpdateFromTarReader(tar.NewReader(bytes.NewReader(buf.Bytes())), true))
+
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(outRoot, name))
+		require.NoError(err, "%q", name)
+		require.Equal(name, string(content))
+	}
+	_, err = os.Lstat(filepath.Join(outRoot, ".wh.case"))
+	require.True(os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(outRoot, ".wh..wh.dir"))
+	require.True(os.IsNotExist(err))
+}
+
+// checkUntarName returns an error if updating a memfs with an entry named
+// name crashes, or adds a path that isn't under the root.
+func checkUntarName(name string, dir bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%q: panic: %v", name, r)
+		}
+	}()
+	hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+	if dir {
+		hdr.Typeflag = tar.TypeDir
+		hdr.Mode = 0755
+	}
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	if err := w.WriteHeader(hdr); err != nil {
+		// Names tar can't encode can't be in layers either.
+		return nil
+	} else if err := w.Close(); err != nil {
+		return err
+	}
+
+	fs, err := NewMemFS(clock.NewMock(), "/", pathutils.DefaultBlacklist)
+	if err != nil {
+		return err
+	}
+	if err := fs.UpdateFromTarReader(tar.NewReader(&buf), false); err != nil {
+		return nil
+	}
+	for _, p := range listMemFS(fs) {
+		if pathutils.AbsPath(p) != p {
+			return fmt.Errorf("%q: path %q isn't under the root", name, p)
+		}
+	}
+	return nil
+}
+
+// TestUntarNames checks that arbitrary entry names never crash the in-memory
+// update, and always end up under the root.
+func TestUntarNames(t *testing.T) {
+	for _, name := range []string{
+		"a", "a/b/", "./a//b", "a/./b/../c", "../../etc/passwd", "/abs",
+		"new\nline", "\xff", ".wh.a", "a/.wh..wh..opq", ".wh..wh.plnk/1",
+		strings.Repeat("long/", 100),
+	} {
+		require.NoError(t, checkUntarName(name, false))
+		require.NoError(t, checkUntarName(name, true))
+	}
+
+	// Random names, joined with dot segments to climb out of the root.
+	require.NoError(t, quick.Check(func(parts []string, dir bool) bool {
+		err := checkUntarName(strings.Join(parts, "/../"), dir)
+		if err != nil {
+			t.Log(err)
+		}
+		return err == nil
+	}, nil))
+}
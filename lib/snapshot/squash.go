@@ -0,0 +1,217 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// LayerOpener opens the uncompressed tar stream of a layer.
+type LayerOpener func() (io.ReadCloser, error)
+
+// squashEntry is the latest version of a path across squashed layers.
+type squashEntry struct {
+	layer int
+	index int
+	// dir overrides the header of a directory, which keeps the position of
+	// its first version so it's written before its children.
+	dir *tar.Header
+
+	// whiteout is set if the path was deleted, and must stay deleted in the
+	// layers below the squashed ones.
+	whiteout *tar.Header
+	// opaque is set if the directory must hide the content of the layers below
+	// the squashed ones.
+	opaque bool
+}
+
+// SquashLayers merges the given layers, from the lowest to the topmost one,
+// into a single layer written to w. The result has the same effect as the
+// original layers when applied on top of the same lower layers: files that
+// were overwritten or deleted are dropped, and whiteouts are only kept for
+// paths that could exist in the lower layers.
+// Layers are read twice, first to find the latest version of each path, then
+// to copy the entries.
+func SquashLayers(layers []LayerOpener, w *tar.Writer) error {
+	entries, err := mergeLayers(layers, w)
+	if err != nil {
+		return err
+	}
+
+	// Whiteouts apply to lower layers wherever they appear in the tarball, so
+	// they are all written at the end, in a deterministic order.
+	var paths []string
+	for p, e := range entries {
+		if e.whiteout != nil || e.opaque {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		e := entries[p]
+		if e.whiteout != nil {
+			if err := w.WriteHeader(e.whiteout); err != nil {
+				return fmt.Errorf("write whiteout %s: %s", p, err)
+			}
+		}
+		if e.opaque {
+			if err := w.WriteHeader(&tar.Header{
+				Name:     strings.TrimPrefix(path.Join(p, _whiteoutOpaqueDir), "/"),
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+			}); err != nil {
+				return fmt.Errorf("write opaque whiteout %s: %s", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// FlattenLayers merges the given layers, from the lowest to the topmost one,
+// into the root filesystem they make up, written to w. Unlike SquashLayers, no
+// whiteouts are written since there is nothing below the layers to hide.
+func FlattenLayers(layers []LayerOpener, w *tar.Writer) error {
+	_, err := mergeLayers(layers, w)
+	return err
+}
+
+// mergeLayers writes the latest version of each path of the given layers to w,
+// and returns the entries of all paths, including the whiteouts left to write.
+func mergeLayers(layers []LayerOpener, w *tar.Writer) (map[string]*squashEntry, error) {
+	entries := make(map[string]*squashEntry)
+	for i, open := range layers {
+		if err := scanSquashLayer(i, open, entries); err != nil {
+			return nil, fmt.Errorf("scan layer %d: %s", i, err)
+		}
+	}
+	for i, open := range layers {
+		if err := copySquashLayer(i, open, entries, w); err != nil {
+			return nil, fmt.Errorf("copy layer %d: %s", i, err)
+		}
+	}
+	return entries, nil
+}
+
+// squashPath returns the key of a tar entry name.
+func squashPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// scanSquashLayer updates entries with the content of one layer.
+func scanSquashLayer(layer int, open LayerOpener, entries map[string]*squashEntry) error {
+	r, err := open()
+	if err != nil {
+		return fmt.Errorf("open: %s", err)
+	}
+	defer r.Close()
+
+	// Whiteouts never apply to files of their own layer, so entries added by
+	// this layer are tracked to be kept.
+	added := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read header: %s", err)
+		}
+		p := squashPath(hdr.Name)
+		switch kind, target := parseWhiteout(p); kind {
+		case fileWhiteout:
+			if added[target] {
+				continue
+			}
+			removeSquashDescendants(entries, target, added)
+			entries[target] = &squashEntry{layer: -1, whiteout: hdr}
+		case opaqueWhiteout:
+			removeSquashDescendants(entries, target, added)
+			if e, ok := entries[target]; ok {
+				e.opaque = true
+			} else {
+				entries[target] = &squashEntry{layer: -1, opaque: true}
+			}
+		case metaWhiteout:
+		default:
+			e := &squashEntry{layer: layer, index: index}
+			if prev, ok := entries[p]; ok && hdr.Typeflag == tar.TypeDir {
+				if prev.layer >= 0 && prev.whiteout == nil && prev.dir != nil {
+					e.layer, e.index = prev.layer, prev.index
+				}
+				// A directory recreated after being deleted must hide the
+				// content of the lower layers.
+				e.opaque = prev.opaque || prev.whiteout != nil
+			} else if ok {
+				removeSquashDescendants(entries, p, added)
+			}
+			if hdr.Typeflag == tar.TypeDir {
+				e.dir = hdr
+			}
+			entries[p] = e
+			added[p] = true
+		}
+	}
+}
+
+// removeSquashDescendants removes the entries under dir that weren't added by
+// the current layer.
+func removeSquashDescendants(entries map[string]*squashEntry, dir string, added map[string]bool) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for p := range entries {
+		if strings.HasPrefix(p, prefix) && !added[p] {
+			delete(entries, p)
+		}
+	}
+}
+
+// copySquashLayer writes the entries of one layer that are the latest version
+// of their path.
+func copySquashLayer(
+	layer int, open LayerOpener, entries map[string]*squashEntry, w *tar.Writer) error {
+
+	r, err := open()
+	if err != nil {
+		return fmt.Errorf("open: %s", err)
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read header: %s", err)
+		}
+		e, ok := entries[squashPath(hdr.Name)]
+		if !ok || e.layer != layer || e.index != index {
+			continue
+		}
+		if e.dir != nil {
+			hdr = e.dir
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("write header %s: %s", hdr.Name, err)
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return fmt.Errorf("copy %s: %s", hdr.Name, err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+func TestSquashLayers(t *testing.T) {
+	base := []layerEntry{
+		"a/", "a/1", "a/2", "a/sub/", "a/sub/3",
+		"b/", "b/x", "b/y",
+		"c/", "c/z",
+	}
+
+	for _, test := range []struct {
+		desc     string
+		layers   [][]layerEntry
+		expected []string
+	}{
+		{
+			desc: "OverwrittenFiles",
+			layers: [][]layerEntry{
+				{"d/", "d/1", "a/", "a/1"},
+				{"d/", "d/1", "d/2"},
+			},
+			expected: []string{
+				"/a", "/a/1", "/a/2", "/a/sub", "/a/sub/3",
+				"/b", "/b/x", "/b/y",
+				"/c", "/c/z",
+				"/d", "/d/1", "/d/2",
+			},
+		},
+		{
+			desc: "WhiteoutsOfLowerLayers",
+			layers: [][]layerEntry{
+				{"a/", "a/.wh.sub", "b/", "b/.wh.x"},
+				{".wh.c", "d/", "d/1"},
+			},
+			expected: []string{
+				"/a", "/a/1", "/a/2",
+				"/b", "/b/y",
+				"/d", "/d/1",
+			},
+		},
+		{
+			desc: "WhiteoutOfSquashedLayer",
+			layers: [][]layerEntry{
+				{"d/", "d/1", "d/2"},
+				{"d/", "d/.wh.1"},
+			},
+			expected: []string{
+				"/a", "/a/1", "/a/2", "/a/sub", "/a/sub/3",
+				"/b", "/b/x", "/b/y",
+				"/c", "/c/z",
+				"/d", "/d/2",
+			},
+		},
+		{
+			desc: "DirRecreatedAfterWhiteout",
+			layers: [][]layerEntry{
+				{".wh.a"},
+				{"a/", "a/new"},
+			},
+			expected: []string{
+				"/a", "/a/new",
+				"/b", "/b/x", "/b/y",
+				"/c", "/c/z",
+			},
+		},
+		{
+			desc: "OpaqueDirs",
+			layers: [][]layerEntry{
+				{"b/", "b/new", "c/", "c/.wh..wh..opq", "c/new"},
+				{"b/", "b/.wh..wh..opq", "b/newer"},
+			},
+			expected: []string{
+				"/a", "/a/1", "/a/2", "/a/sub", "/a/sub/3",
+				"/b", "/b/newer",
+				"/c", "/c/new",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			var openers []LayerOpener
+			for _, layer := range test.layers {
+				content := tarLayerBytes(require, layer...)
+				openers = append(openers, func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(bytes.NewReader(content)), nil
+				})
+			}
+			var squashed bytes.Buffer
+			w := tar.NewWriter(&squashed)
+			require.NoError(SquashLayers(openers, w))
+			require.NoError(w.Close())
+
+			// Applying the squashed layer has the same result as applying the
+			// original layers.
+			for _, layers := range [][][]byte{nil, {squashed.Bytes()}} {
+				tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+				require.NoError(err)
+				defer os.RemoveAll(tmpRoot)
+
+				fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist)
+				require.NoError(err)
+				fs.blacklist = nil
+
+				require.NoError(fs.UpdateFromTarReader(tarLayer(require, base...), true))
+				if layers == nil {
+					for _, layer := range test.layers {
+						layers = append(layers, tarLayerBytes(require, layer...))
+					}
+				}
+				for _, layer := range layers {
+					require.NoError(fs.UpdateFromTarReader(
+						tar.NewReader(bytes.NewReader(layer)), true))
+				}
+				require.Equal(test.expected, listDisk(require, tmpRoot))
+				require.Equal(test.expected, listMemFS(fs))
+			}
+		})
+	}
+}
+
+func TestFlattenLayers(t *testing.T) {
+	require := require.New(t)
+
+	layers := [][]layerEntry{
+		{"a/", "a/1", "a/2", "a/sub/", "a/sub/3", "b/", "b/x", "c/", "c/z"},
+		{"a/", "a/.wh.sub", "b/", "b/.wh.x", "b/y"},
+		{".wh.c", "d/", "d/1", "d/2"},
+		{"d/", "d/.wh.1", "b/", "b/.wh..wh..opq", "b/new"},
+	}
+	var openers []LayerOpener
+	for _, layer := range layers {
+		content := tarLayerBytes(require, layer...)
+		openers = append(openers, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		})
+	}
+	var flattened bytes.Buffer
+	w := tar.NewWriter(&flattened)
+	require.NoError(FlattenLayers(openers, w))
+	require.NoError(w.Close())
+
+	// The rootfs has no whiteouts left.
+	var paths []string
+	tr := tar.NewReader(&flattened)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		paths = append(paths, squashPath(hdr.Name))
+	}
+	require.Equal([]string{"/a", "/a/1", "/a/2", "/b", "/d", "/d/2", "/b/new"}, paths)
+}
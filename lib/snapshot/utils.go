@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/uber/makisu/lib/log"
@@ -32,16 +33,17 @@ import (
 	"github.com/uber/makisu/lib/utils"
 )
 
-// shouldSkip returns true if the path is a descendent of any path in the blacklist,
-// a special file, or a mount point.
+// shouldSkip returns true if the path is blacklisted (see pathutils.IsBlacklisted),
+// an unsupported file, or a mount point.
 func shouldSkip(path string, fi os.FileInfo, blacklist []string) (bool, error) {
-	if strings.HasPrefix(filepath.Base(path), _whiteoutMetaPrefix) {
-		// If it's a AUFS metadata file or dir, simply ignore.
+	if isWhiteoutMeta(path) {
+		// If it's a AUFS metadata file or dir, simply ignore. Opaque
+		// whiteouts are not skipped, they are applied by UpdateFromTarReader.
 		// TODO: There could be hardlinks pointing to files under /.wh..wh.plnk.
 		// Taking the simplest solution for now, but this is preventing us from
 		// deduping hardlinks.
 		return true, nil
-	} else if pathutils.IsDescendantOfAny(path, blacklist) || (fi != nil && utils.IsSpecialFile(fi)) {
+	} else if pathutils.IsBlacklisted(path, blacklist) || (fi != nil && isUnsupportedFile(fi)) {
 		return true, nil
 	} else if isMountpoint, err := mountutils.IsMountpoint(path); err != nil {
 		return false, fmt.Errorf("check mount point: %s", err)
@@ -64,7 +66,9 @@ func walk(srcRoot string, blacklist []string, f func(string, os.FileInfo) error)
 			return nil
 		}
 
-		if err := f(p, fi); err != nil {
+		if err := f(p, fi); err == filepath.SkipDir {
+			return err
+		} else if err != nil {
 			return fmt.Errorf("applying f to %s: %s", p, err)
 		}
 		return nil
@@ -74,6 +78,43 @@ func walk(srcRoot string, blacklist []string, f func(string, os.FileInfo) error)
 	return nil
 }
 
+// walkChildren is like walk, but only applies f to dir and its direct
+// children.
+func walkChildren(dir string, blacklist []string, f func(string, os.FileInfo) error) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("lstat %s: %s", dir, err)
+	} else if skip, err := shouldSkip(dir, fi, blacklist); err != nil {
+		return fmt.Errorf("check should skip: %s", err)
+	} else if skip {
+		return nil
+	}
+	if err := f(dir, fi); err == filepath.SkipDir {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("applying f to %s: %s", dir, err)
+	} else if !fi.IsDir() {
+		return nil
+	}
+
+	children, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read dir %s: %s", dir, err)
+	}
+	for _, fi := range children {
+		p := filepath.Join(dir, fi.Name())
+		if skip, err := shouldSkip(p, fi, blacklist); err != nil {
+			return fmt.Errorf("check should skip: %s", err)
+		} else if skip {
+			continue
+		}
+		if err := f(p, fi); err != nil && err != filepath.SkipDir {
+			return fmt.Errorf("applying f to %s: %s", p, err)
+		}
+	}
+	return nil
+}
+
 // removePathRecursive attempts to recursively remove everything under the given path,
 // excluding paths specified by the blacklist. Returns true if it succeeds in removing
 // everything under the path.
@@ -132,6 +173,29 @@ func removeAllChildren(srcRoot string, blacklist []string) error {
 	return nil
 }
 
+// isUnsupportedFile returns true for sockets, which cannot be stored in layers,
+// and overlayfs whiteouts, which are 0/0 character devices. Other device nodes
+// and named pipes are kept.
+func isUnsupportedFile(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeSocket != 0 {
+		return true
+	} else if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	switch sys := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		return sys.Rdev == 0
+	case *tar.Header:
+		return sys.Devmajor == 0 && sys.Devminor == 0
+	}
+	return false
+}
+
+// mkdev encodes device numbers the way linux stores them in st_rdev.
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12)
+}
+
 // resolveHardLink linked inode the the given path.
 // For docker's implementation, see:
 //   https://github.com/moby/moby/blob/master/pkg/archive/archive.go
@@ -204,8 +268,8 @@ func tarOneItem(root, p string, fi os.FileInfo, tw *tar.Writer, inodes map[uint6
 		return fmt.Errorf("trim root: %s", err)
 	}
 	hdr.Name = pathutils.RelPath(trimmed)
-	if err := tw.WriteHeader(hdr); err != nil {
-		return fmt.Errorf("write header: %s", err)
+	if err := tario.AddXattrs(p, hdr); err != nil {
+		return fmt.Errorf("add xattrs: %s", err)
 	}
 
 	// Note: For hard links and regular files, if it points to an inode this
@@ -224,9 +288,12 @@ func tarOneItem(root, p string, fi os.FileInfo, tw *tar.Writer, inodes map[uint6
 			inodes[inode] = hdr.Name
 		}
 	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write header: %s", err)
+	}
 
 	// Copy file content for regular files only.
-	if fi.Mode().IsRegular() {
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
 		f, err := os.Open(p)
 		if err != nil {
 			return fmt.Errorf("open f: %s", err)
@@ -0,0 +1,216 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+// _watchMask lists the inotify events that change the content of a watched
+// directory or of its direct children.
+const _watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+// _watchPollInterval is how long the watcher waits for new events once its
+// queue is empty.
+const _watchPollInterval = 10 * time.Millisecond
+
+// Watcher records the directories changed under a root with inotify, so scans
+// can be restricted to them. fanotify would avoid watching each directory, but
+// it requires CAP_SYS_ADMIN, which build containers usually don't have.
+type Watcher struct {
+	root      string
+	blacklist []string
+	fd        int
+
+	mu      sync.Mutex
+	wds     map[int32]string
+	changes map[string]bool
+	err     error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newWatcher watches all directories under root, except the blacklisted ones.
+func newWatcher(root string, blacklist []string) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("init inotify: %s", err)
+	}
+	w := &Watcher{
+		root:      root,
+		blacklist: blacklist,
+		fd:        fd,
+		wds:       make(map[int32]string),
+		changes:   make(map[string]bool),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if err := w.addWatches(root); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("add watches: %s", err)
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Close stops the watcher, and returns the directories changed since it
+// started, relative to the root. Directories mapped to true must be scanned
+// with their whole subtree, others only with their direct children.
+// It returns an error if changes may have been missed, e.g. if the event queue
+// overflowed; a full scan is needed then.
+func (w *Watcher) Close() (map[string]bool, error) {
+	close(w.stop)
+	<-w.done
+	syscall.Close(w.fd)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.changes, nil
+}
+
+// addWatches watches dir and all directories under it.
+func (w *Watcher) addWatches(dir string) error {
+	if skip, err := shouldSkip(dir, nil, w.blacklist); err != nil {
+		return fmt.Errorf("check should skip: %s", err)
+	} else if skip {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, _watchMask)
+	if err == syscall.ENOENT || err == syscall.ENOTDIR {
+		// Removed or replaced since it was listed.
+		return nil
+	} else if err == syscall.ENOSPC {
+		return fmt.Errorf("watch %s: too many watches, see fs.inotify.max_user_watches", dir)
+	} else if err != nil {
+		return fmt.Errorf("watch %s: %s", dir, err)
+	}
+	dst, err := pathutils.TrimRoot(dir, w.root)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.wds[int32(wd)] = dst
+	w.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read dir %s: %s", dir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if err := w.addWatches(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readEvents handles events until the watcher is stopped and the queue is
+// drained.
+func (w *Watcher) readEvents() {
+	defer close(w.done)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	var stopping bool
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EAGAIN {
+			if stopping {
+				return
+			}
+			// Events queued before the stop are read once more after it.
+			select {
+			case <-w.stop:
+				stopping = true
+			case <-time.After(_watchPollInterval):
+			}
+			continue
+		} else if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			w.fail(fmt.Errorf("read events: %s", err))
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+			name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+			w.handleEvent(event.Wd, event.Mask, name)
+		}
+	}
+}
+
+func (w *Watcher) handleEvent(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.fail(fmt.Errorf("event queue overflowed, see fs.inotify.max_queued_events"))
+		return
+	}
+	w.mu.Lock()
+	dir, ok := w.wds[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.wds, wd)
+	}
+	w.mu.Unlock()
+	if !ok || mask&syscall.IN_IGNORED != 0 {
+		return
+	}
+
+	w.touch(dir, false)
+	if name != "" && mask&syscall.IN_ISDIR != 0 &&
+		mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		// Content may be added to the new directory before it's watched, so
+		// its whole subtree is changed.
+		p := path.Join(dir, name)
+		w.touch(p, true)
+		if err := w.addWatches(filepath.Join(w.root, p)); err != nil {
+			w.fail(err)
+		}
+	}
+}
+
+func (w *Watcher) touch(dir string, recursive bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.changes[dir] = w.changes[dir] || recursive
+}
+
+func (w *Watcher) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
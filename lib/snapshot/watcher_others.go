@@ -0,0 +1,32 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package snapshot
+
+import "errors"
+
+// Watcher records the directories changed under a root. It's only supported on
+// linux.
+type Watcher struct{}
+
+func newWatcher(root string, blacklist []string) (*Watcher, error) {
+	return nil, errors.New("file system watching is only supported on linux")
+}
+
+// Close always returns an error, since the watcher cannot be created.
+func (w *Watcher) Close() (map[string]bool, error) {
+	return nil, errors.New("file system watching is only supported on linux")
+}
@@ -0,0 +1,251 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/uber/makisu/lib/log"
+	"github.com/uber/makisu/lib/pathutils"
+	"github.com/uber/makisu/lib/tario"
+)
+
+// Whiteouts mark deletions in image layers, following the OCI image spec and
+// the AUFS conventions used by docker and buildkit:
+//   - /a/.wh.b deletes /a/b from lower layers;
+//   - /a/.wh..wh..opq deletes all children of /a from lower layers, but keeps
+//     the ones added by the same layer, wherever they appear in the tarball;
+//   - other names prefixed by .wh..wh. are AUFS metadata, and are ignored.
+// Whiteouts never apply to files of their own layer.
+
+const _whiteoutPrefix = ".wh."
+
+// _whiteoutMetaPrefix means it is AUFS metadata, not for removing files.
+// Should be ignored during untar, except for opaque directory markers.
+// TODO: There could be hardlinks pointing to files under /.wh..wh.plnk.
+const _whiteoutMetaPrefix = _whiteoutPrefix + _whiteoutPrefix
+
+// _whiteoutOpaqueDir marks its parent directory as opaque.
+const _whiteoutOpaqueDir = _whiteoutMetaPrefix + ".opq"
+
+type whiteoutKind int
+
+const (
+	notWhiteout whiteoutKind = iota
+	fileWhiteout
+	opaqueWhiteout
+	metaWhiteout
+)
+
+// parseWhiteout returns the kind of whiteout at path p, and the path it
+// applies to: the deleted path for file whiteouts, and the directory for
+// opaque whiteouts.
+func parseWhiteout(p string) (whiteoutKind, string) {
+	d, b := filepath.Split(p)
+	switch {
+	case b == _whiteoutOpaqueDir:
+		return opaqueWhiteout, filepath.Clean(d)
+	case strings.HasPrefix(b, _whiteoutMetaPrefix):
+		return metaWhiteout, ""
+	case strings.HasPrefix(b, _whiteoutPrefix):
+		return fileWhiteout, d + strings.TrimPrefix(b, _whiteoutPrefix)
+	}
+	return notWhiteout, ""
+}
+
+// isWhiteoutMeta returns true if p is AUFS metadata, or is under an AUFS
+// metadata directory like /.wh..wh.plnk.
+func isWhiteoutMeta(p string) bool {
+	for _, part := range pathutils.SplitPath(p) {
+		if strings.HasPrefix(part, _whiteoutMetaPrefix) && part != _whiteoutOpaqueDir {
+			return true
+		}
+	}
+	return false
+}
+
+// isReservedName returns true if the base name of path p would be read as a
+// whiteout once in a layer. Files with such names can't be represented in
+// layers, so they are skipped with a warning instead of deleting paths from
+// the image.
+func isReservedName(p string) bool {
+	if kind, _ := parseWhiteout(p); kind != notWhiteout {
+		log.Warnf("Skipping %q, its name is reserved for whiteouts", p)
+		return true
+	}
+	return false
+}
+
+// whiteoutMemFile represents a MemFile implementation that deletes contents.
+type whiteoutMemFile struct {
+	del string // Location to delete. Key to layer.files key
+	hdr *tar.Header
+}
+
+// newWhiteoutMemFile inits a new whiteoutMemFile.
+func newWhiteoutMemFile(deletedPath, whiteoutPath string) *whiteoutMemFile {
+	return &whiteoutMemFile{
+		del: deletedPath,
+		hdr: &tar.Header{Name: pathutils.RelPath(whiteoutPath)},
+	}
+}
+
+// updateMemFS deletes the memFSNode designated by whiteoutMemFile from the tree rooted at node.
+func (f *whiteoutMemFile) updateMemFS(node *memFSNode) error {
+	parts := pathutils.SplitPath(f.del)
+	for i, part := range parts {
+		if n, ok := node.children[part]; ok {
+			if i == len(parts)-1 {
+				delete(node.children, part)
+			} else {
+				node = n
+			}
+		} else {
+			if i != len(parts)-1 {
+				return fmt.Errorf("missing intermediate dir %s in %s", part, f.del)
+			}
+			// This could happen to files that's cleaned up in the background, like
+			// python package's .dist-info or .pth file.
+			log.Warnf("Trying to whiteout nonexistent path: %s", f.del)
+		}
+	}
+	return nil
+}
+
+// commit writes an empty whiteout file to the tar writer.
+func (f *whiteoutMemFile) commit(w *tar.Writer) error {
+	if err := tario.WriteHeader(w, f.hdr); err != nil {
+		return fmt.Errorf("whiteout commit %s: %s", f.hdr.Name, err)
+	}
+	return nil
+}
+
+// opaqueMemFile represents a MemFile implementation that deletes the contents
+// of a directory inherited from lower layers.
+type opaqueMemFile struct {
+	dir  string              // Directory to empty
+	keep map[string]struct{} // Paths added by the same layer
+	hdr  *tar.Header
+}
+
+// newOpaqueMemFile inits a new opaqueMemFile.
+func newOpaqueMemFile(dir string, keep map[string]struct{}) *opaqueMemFile {
+	return &opaqueMemFile{
+		dir:  dir,
+		keep: keep,
+		hdr:  &tar.Header{Name: pathutils.RelPath(path.Join(dir, _whiteoutOpaqueDir))},
+	}
+}
+
+// updateMemFS deletes the children of the directory designated by
+// opaqueMemFile from the tree rooted at node, except the ones to keep.
+func (f *opaqueMemFile) updateMemFS(node *memFSNode) error {
+	for _, part := range pathutils.SplitPath(f.dir) {
+		n, ok := node.children[part]
+		if !ok {
+			// Nothing to hide.
+			return nil
+		}
+		node = n
+	}
+	for name := range node.children {
+		if _, ok := f.keep[path.Join(f.dir, name)]; !ok {
+			delete(node.children, name)
+		}
+	}
+	return nil
+}
+
+// commit writes an empty opaque whiteout file to the tar writer.
+func (f *opaqueMemFile) commit(w *tar.Writer) error {
+	if err := tario.WriteHeader(w, f.hdr); err != nil {
+		return fmt.Errorf("opaque whiteout commit %s: %s", f.hdr.Name, err)
+	}
+	return nil
+}
+
+// addOpaqueWhiteout adds an opaque whiteout for directory dir to the layer,
+// which keeps the given paths added by the layer.
+func (l *memLayer) addOpaqueWhiteout(dir string, keep map[string]struct{}) memFile {
+	dir = pathutils.AbsPath(dir)
+	mf := newOpaqueMemFile(dir, keep)
+	l.files[path.Join(dir, _whiteoutOpaqueDir)] = mf
+	return mf
+}
+
+// untarWhiteout removes the contents under the path deleted by the whiteout
+// file at path, skipping blacklisted paths and mount points.
+func (fs *MemFS) untarWhiteout(path string) error {
+	_, deleted := parseWhiteout(path)
+	fi, err := os.Lstat(deleted)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("lstat %s: %s", deleted, err)
+	}
+	removePathRecursive(deleted, fi, fs.blacklist)
+	return nil
+}
+
+// untarOpaqueWhiteout removes the children of dir on disk, except the ones in
+// keep, skipping blacklisted paths and mount points.
+func (fs *MemFS) untarOpaqueWhiteout(dir string, keep map[string]struct{}) error {
+	children, err := ioutil.ReadDir(filepath.Join(fs.tree.src, dir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read dir %s: %s", dir, err)
+	}
+	for _, child := range children {
+		p := path.Join(dir, child.Name())
+		if _, ok := keep[p]; ok {
+			continue
+		}
+		removePathRecursive(filepath.Join(fs.tree.src, p), child, fs.blacklist)
+	}
+	return nil
+}
+
+// applyOpaqueWhiteout empties directory dir in memory, and on disk if untar is
+// true, except for the paths added by the layer.
+func (fs *MemFS) applyOpaqueWhiteout(
+	l *memLayer, dir string, added map[string]struct{}, untar bool) error {
+
+	dir = pathutils.AbsPath(dir)
+	if untar {
+		if err := fs.untarOpaqueWhiteout(dir, added); err != nil {
+			return fmt.Errorf("untar opaque whiteout: %s", err)
+		}
+	}
+	if err := l.addOpaqueWhiteout(dir, added).updateMemFS(fs.tree); err != nil {
+		return fmt.Errorf("update memfs with opaque whiteout %s: %s", dir, err)
+	}
+	log.Debugf("Applied opaque whiteout to %s", dir)
+	return nil
+}
+
+// markAdded records path p and its ancestors as added by the current layer,
+// so whiteouts of the same layer don't apply to them.
+func markAdded(added map[string]struct{}, p string) {
+	for p = pathutils.AbsPath(p); p != "/"; p = path.Dir(p) {
+		added[p] = struct{}{}
+	}
+}
@@ -0,0 +1,270 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/andres-erbsen/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/makisu/lib/pathutils"
+)
+
+// layerEntry describes one entry of a test layer tarball. Names ending with
+// "/" are directories, others are regular files with their name as content.
+type layerEntry string
+
+// tarLayer writes the entries to a tarball, in the given order.
+func tarLayer(require *require.Assertions, entries ...layerEntry) *tar.Reader {
+	return tar.NewReader(bytes.NewReader(tarLayerBytes(require, entries...)))
+}
+
+// tarLayerBytes returns the content of the tarball written by tarLayer.
+func tarLayerBytes(require *require.Assertions, entries ...layerEntry) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, e := range entries {
+		name := string(e)
+		if strings.HasSuffix(name, "/") {
+			require.NoError(w.WriteHeader(&tar.Header{
+				Name: name, Typeflag: tar.TypeDir, Mode: 0755}))
+			continue
+		}
+		var content []byte
+		if kind, _ := parseWhiteout(name); kind == notWhiteout {
+			content = []byte(name)
+		}
+		require.NoError(w.WriteHeader(&tar.Header{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := w.Write(content)
+		require.NoError(err)
+	}
+	require.NoError(w.Close())
+	return buf.Bytes()
+}
+
+// listDisk returns all paths under root.
+func listDisk(require *require.Assertions, root string) []string {
+	var paths []string
+	require.NoError(filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		require.NoError(err)
+		if p != root {
+			paths = append(paths, strings.TrimPrefix(p, root))
+		}
+		return nil
+	}))
+	sort.Strings(paths)
+	return paths
+}
+
+// listMemFS returns all paths in the in-memory tree.
+func listMemFS(fs *MemFS) []string {
+	var paths []string
+	var list func(prefix string, n *memFSNode)
+	list = func(prefix string, n *memFSNode) {
+		for name, child := range n.children {
+			p := prefix + "/" + name
+			paths = append(paths, p)
+			list(p, child)
+		}
+	}
+	list("", fs.tree)
+	sort.Strings(paths)
+	return paths
+}
+
+func TestParseWhiteout(t *testing.T) {
+	require := require.New(t)
+
+	for _, test := range []struct {
+		path   string
+		kind   whiteoutKind
+		target string
+	}{
+		{"/a/b", notWhiteout, ""},
+		{"/a/.wh.b", fileWhiteout, "/a/b"},
+		{"/.wh.b", fileWhiteout, "/b"},
+		{"/a/.wh..wh..opq", opaqueWhiteout, "/a"},
+		{"/.wh..wh..opq", opaqueWhiteout, "/"},
+		{"/a/.wh..wh.plnk", metaWhiteout, ""},
+		{"/a/.wh..wh.aufs", metaWhiteout, ""},
+	} {
+		kind, target := parseWhiteout(test.path)
+		require.Equal(test.kind, kind, test.path)
+		require.Equal(test.target, target, test.path)
+	}
+}
+
+// TestWhiteoutConformance applies a base layer followed by layers laid out
+// the way docker and buildkit produce them, and checks both the files on disk
+// and the in-memory tree.
+func TestWhiteoutConformance(t *testing.T) {
+	base := []layerEntry{
+		"a/", "a/1", "a/2", "a/sub/", "a/sub/3",
+		"b/", "b/x", "b/y",
+		"c/", "c/z",
+	}
+
+	for _, test := range []struct {
+		desc     string
+		layer    []layerEntry
+		expected []string
+	}{
+		{
+			// Docker writes the opaque marker right after its directory.
+			desc: "DockerOpaqueDir",
+			layer: []layerEntry{
+				"a/", "a/.wh..wh..opq", "a/new",
+			},
+			expected: []string{
+				"/a", "/a/new",
+				"/b", "/b/x", "/b/y",
+				"/c", "/c/z",
+			},
+		},
+		{
+			// Buildkit sorts entries, so children named before the marker
+			// must survive it.
+			desc: "BuildkitOpaqueDirSorted",
+			layer: []layerEntry{
+				"a/", "a/.hidden", "a/.wh..wh..opq", "a/new/", "a/new/4",
+			},
+			expected: []string{
+				"/a", "/a/.hidden", "/a/new", "/a/new/4",
+				"/b", "/b/x", "/b/y",
+				"/c", "/c/z",
+			},
+		},
+		{
+			desc: "FileAndDirWhiteouts",
+			layer: []layerEntry{
+				"a/", "a/.wh.sub", "b/", "b/.wh.x", ".wh.c",
+			},
+			expected: []string{
+				"/a", "/a/1", "/a/2",
+				"/b", "/b/y",
+			},
+		},
+		{
+			desc: "WhiteoutOfSameLayerIgnored",
+			layer: []layerEntry{
+				"b/", "b/w", "b/.wh.w", "b/.wh.x",
+			},
+			expected: []string{
+				"/a", "/a/1", "/a/2", "/a/sub", "/a/sub/3",
+				"/b", "/b/w", "/b/y",
+				"/c", "/c/z",
+			},
+		},
+		{
+			desc: "AUFSMetadataIgnored",
+			layer: []layerEntry{
+				".wh..wh.plnk/", ".wh..wh.plnk/123", "a/", "a/.wh..wh.aufs",
+			},
+			expected: []string{
+				"/a", "/a/1", "/a/2", "/a/sub", "/a/sub/3",
+				"/b", "/b/x", "/b/y",
+				"/c", "/c/z",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+			require.NoError(err)
+			defer os.RemoveAll(tmpRoot)
+
+			fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist)
+			require.NoError(err)
+			fs.blacklist = nil
+
+			require.NoError(fs.UpdateFromTarReader(tarLayer(require, base...), true))
+			require.NoError(fs.UpdateFromTarReader(tarLayer(require, test.layer...), true))
+
+			require.Equal(test.expected, listDisk(require, tmpRoot))
+			require.Equal(test.expected, listMemFS(fs))
+		})
+	}
+}
+
+func TestOpaqueWhiteoutMemFSOnly(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	fs, err := NewMemFS(clock.NewMock(), tmpRoot, pathutils.DefaultBlacklist)
+	require.NoError(err)
+	fs.blacklist = nil
+
+	// Without untar, only the in-memory tree is updated.
+	require.NoError(fs.UpdateFromTarReader(tarLayer(require, "a/", "a/1"), false))
+	require.NoError(fs.UpdateFromTarReader(tarLayer(require, "a/", "a/.wh..wh..opq", "a/2"), false))
+	require.Equal([]string{"/a", "/a/2"}, listMemFS(fs))
+	require.Empty(listDisk(require, tmpRoot))
+}
+
+// checkParseWhiteout returns an error unless parseWhiteout recognizes p as a
+// whiteout exactly when its base name has the whiteout prefix, and returns the
+// path it hides.
+func checkParseWhiteout(p string) error {
+	kind, target := parseWhiteout(p)
+	dir, base := filepath.Split(p)
+	if strings.HasPrefix(base, _whiteoutPrefix) != (kind != notWhiteout) {
+		return fmt.Errorf("%q: unexpected kind %v", p, kind)
+	}
+	switch kind {
+	case fileWhiteout:
+		if expected := filepath.Clean(dir + base[len(_whiteoutPrefix):]); expected != filepath.Clean(target) {
+			return fmt.Errorf("%q: target %q, expected %q", p, target, expected)
+		}
+	case opaqueWhiteout:
+		if expected := filepath.Clean(dir); expected != target {
+			return fmt.Errorf("%q: target %q, expected %q", p, target, expected)
+		}
+	}
+	return nil
+}
+
+func TestParseWhiteoutNames(t *testing.T) {
+	for _, p := range []string{
+		"/a/b", "/a/.wh.b", "/.wh..wh..opq", "/a/.wh..wh.plnk", "/.wh.",
+		"/a/.wh.\n", "/\xff/.wh.\xfe", "relative/.wh.x", ".wh./", "",
+	} {
+		require.NoError(t, checkParseWhiteout(p))
+	}
+
+	// Random names, half of them with the whiteout prefix.
+	require.NoError(t, quick.Check(func(dir, name string, whiteout bool) bool {
+		if whiteout {
+			name = _whiteoutPrefix + name
+		}
+		err := checkParseWhiteout(dir + "/" + name)
+		if err != nil {
+			t.Log(err)
+		}
+		return err == nil
+	}, nil))
+}
@@ -0,0 +1,189 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package steplog writes the output of RUN steps to files, one per step and
+// stream, so the logs of a failed step can be kept as CI artifacts.
+package steplog
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// _unsafeChars matches the characters of stage aliases replaced in file
+// names.
+var _unsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// Dir writes the logs of steps in a directory. Its methods can be called on a
+// nil Dir, which writes nothing.
+type Dir struct {
+	sync.Mutex
+
+	path    string
+	maxSize int64
+	stage   string
+	step    int
+}
+
+// NewDir returns a Dir writing logs in path, created if missing. Logs larger
+// than maxSize are truncated, unless maxSize is 0.
+func NewDir(path string, maxSize int64) (*Dir, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("create step log dir: %s", err)
+	}
+	return &Dir{path: path, maxSize: maxSize}, nil
+}
+
+// StartStep sets the step the next logs are opened for.
+func (d *Dir) StartStep(stage string, step int) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.stage, d.step = stage, step
+}
+
+// Open creates the stdout and stderr logs of the current step,
+// <stage>-<step>.stdout.log and <stage>-<step>.stderr.log. Existing logs are
+// overwritten.
+func (d *Dir) Open() (stdout, stderr io.WriteCloser, err error) {
+	if d == nil {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, nil
+	}
+	d.Lock()
+	prefix := fmt.Sprintf("%s-%d", _unsafeChars.ReplaceAllString(d.stage, "_"), d.step)
+	d.Unlock()
+
+	stdout, err = d.create(prefix + ".stdout.log")
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err = d.create(prefix + ".stderr.log")
+	if err != nil {
+		stdout.Close()
+		return nil, nil, err
+	}
+	return stdout, stderr, nil
+}
+
+func (d *Dir) create(name string) (io.WriteCloser, error) {
+	f, err := os.Create(filepath.Join(d.path, name))
+	if err != nil {
+		return nil, fmt.Errorf("create step log: %s", err)
+	}
+	if d.maxSize <= 0 {
+		return f, nil
+	}
+	return newTruncatedFile(f, d.maxSize), nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// truncatedFile writes the first half of maxSize bytes to a file, and keeps
+// the last half in memory, which is written with a truncation notice once
+// closed. Write errors are returned by Close, so commands are never
+// interrupted by their log.
+type truncatedFile struct {
+	sync.Mutex
+
+	f       *os.File
+	head    int64
+	written int64
+	err     error
+
+	// tail is a ring buffer of the last bytes past the head, starting at
+	// start.
+	tail    []byte
+	start   int
+	n       int
+	dropped int64
+}
+
+func newTruncatedFile(f *os.File, maxSize int64) *truncatedFile {
+	head := maxSize / 2
+	return &truncatedFile{f: f, head: head, tail: make([]byte, maxSize-head)}
+}
+
+// Write implements io.Writer.
+func (t *truncatedFile) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	size := len(p)
+	if t.written < t.head {
+		n := int64(len(p))
+		if n > t.head-t.written {
+			n = t.head - t.written
+		}
+		t.write(p[:n])
+		t.written += n
+		p = p[n:]
+	}
+	if len(p) > len(t.tail) {
+		t.dropped += int64(t.n + len(p) - len(t.tail))
+		t.start, t.n = 0, copy(t.tail, p[len(p)-len(t.tail):])
+		return size, nil
+	}
+	if len(p) > 0 {
+		end := (t.start + t.n) % len(t.tail)
+		copied := copy(t.tail[end:], p)
+		copy(t.tail, p[copied:])
+		if overflow := t.n + len(p) - len(t.tail); overflow > 0 {
+			t.dropped += int64(overflow)
+			t.start = (t.start + overflow) % len(t.tail)
+			t.n = len(t.tail)
+		} else {
+			t.n += len(p)
+		}
+	}
+	return size, nil
+}
+
+// Close writes the tail and closes the file.
+func (t *truncatedFile) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.dropped > 0 {
+		t.write([]byte(fmt.Sprintf("\n[... %d bytes truncated ...]\n", t.dropped)))
+	}
+	if t.start+t.n > len(t.tail) {
+		t.write(t.tail[t.start:])
+		t.write(t.tail[:t.start+t.n-len(t.tail)])
+	} else {
+		t.write(t.tail[t.start : t.start+t.n])
+	}
+	if err := t.f.Close(); err != nil && t.err == nil {
+		t.err = err
+	}
+	if t.err != nil {
+		return fmt.Errorf("write step log: %s", t.err)
+	}
+	return nil
+}
+
+// write writes p to the file, unless a write failed before.
+func (t *truncatedFile) write(p []byte) {
+	if t.err == nil && len(p) > 0 {
+		_, t.err = t.f.Write(p)
+	}
+}
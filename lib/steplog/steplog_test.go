@@ -0,0 +1,99 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package steplog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirOpen(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "steplog")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	d, err := NewDir(filepath.Join(dir, "logs"), 0)
+	require.NoError(err)
+	d.StartStep("build/stage", 3)
+	stdout, stderr, err := d.Open()
+	require.NoError(err)
+	stdout.Write([]byte("out\n"))
+	stderr.Write([]byte("err\n"))
+	require.NoError(stdout.Close())
+	require.NoError(stderr.Close())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "logs", "build_stage-3.stdout.log"))
+	require.NoError(err)
+	require.Equal("out\n", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(dir, "logs", "build_stage-3.stderr.log"))
+	require.NoError(err)
+	require.Equal("err\n", string(b))
+
+	// A nil Dir discards logs.
+	var nilDir *Dir
+	nilDir.StartStep("0", 1)
+	stdout, _, err = nilDir.Open()
+	require.NoError(err)
+	_, err = stdout.Write([]byte("out"))
+	require.NoError(err)
+}
+
+func TestTruncatedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "steplog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		desc   string
+		writes []string
+		result string
+	}{
+		{"fits", []string{"abc", "def"}, "abcdef"},
+		{"exactly fits", []string{"abcd", "efgh"}, "abcdefgh"},
+		{"small writes", strings.Split("abcdefghijkl", ""),
+			"abcd\n[... 4 bytes truncated ...]\nijkl"},
+		{"one large write", []string{"abcdefghijkl"},
+			"abcd\n[... 4 bytes truncated ...]\nijkl"},
+		{"wrapping writes", []string{"abcde", "fgh", "ijk", "lm"},
+			"abcd\n[... 5 bytes truncated ...]\njklm"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+
+			path := filepath.Join(dir, "log")
+			f, err := os.Create(path)
+			require.NoError(err)
+			w := newTruncatedFile(f, 8)
+			for _, s := range test.writes {
+				n, err := w.Write([]byte(s))
+				require.NoError(err)
+				require.Equal(len(s), n)
+			}
+			require.NoError(w.Close())
+
+			b, err := ioutil.ReadFile(path)
+			require.NoError(err)
+			require.Equal(test.result, string(b))
+		})
+	}
+}
@@ -0,0 +1,209 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/uber/makisu/lib/storage/base"
+)
+
+// BlobStore keeps the blobs committed to a LayerTarStore, named by the hex of
+// their digest.
+type BlobStore interface {
+	// Stat returns the FileInfo of a blob.
+	Stat(name string) (os.FileInfo, error)
+	// Open returns a reader of a blob.
+	Open(name string) (base.FileReader, error)
+	// Commit moves the file at src into the store. It returns os.ErrExist if
+	// the blob is already in the store, in which case src is left as is.
+	Commit(name, src string) error
+	// LinkTo makes target a hard link of the blob, or a copy if the store is
+	// on another file system.
+	LinkTo(name, target string) error
+	// Delete removes a blob.
+	Delete(name string) error
+	// List returns the names of all blobs.
+	List() ([]string, error)
+}
+
+// localBlobStore keeps blobs in a base.FileStore on the local disk.
+type localBlobStore struct {
+	backend base.FileStore
+	state   base.FileState
+}
+
+func (s *localBlobStore) op() base.FileOp {
+	return s.backend.NewFileOp().AcceptState(s.state)
+}
+
+func (s *localBlobStore) Stat(name string) (os.FileInfo, error) {
+	return s.op().GetFileStat(name)
+}
+
+func (s *localBlobStore) Open(name string) (base.FileReader, error) {
+	return s.op().GetFileReader(name)
+}
+
+func (s *localBlobStore) Commit(name, src string) error {
+	return s.op().MoveFileFrom(name, s.state, src)
+}
+
+func (s *localBlobStore) LinkTo(name, target string) error {
+	return s.op().LinkFileTo(name, target)
+}
+
+func (s *localBlobStore) Delete(name string) error {
+	return s.op().DeleteFile(name)
+}
+
+func (s *localBlobStore) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.state.GetDirectory())
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
+const (
+	sharedBlobsDir = "blobs"
+	sharedTempDir  = "tmp"
+	sharedLocksDir = "locks"
+)
+
+// SharedBlobStore keeps blobs on a volume shared by several hosts, like NFS or
+// CephFS. Blobs are plain files that are written to a temp file of the volume
+// first, then renamed into place, so other hosts never see partial blobs.
+// Blobs are never modified once committed, so they need no lock to be read;
+// the locks dir of the volume is used by LayerTarStore so that builders pull
+// each blob once. Linux emulates flock on NFS with byte-range locks, which
+// are coherent across clients.
+type SharedBlobStore struct {
+	blobsDir string
+	tempDir  string
+}
+
+// NewSharedBlobStore returns a SharedBlobStore in dir.
+func NewSharedBlobStore(dir string) (*SharedBlobStore, error) {
+	s := &SharedBlobStore{
+		blobsDir: filepath.Join(dir, sharedBlobsDir),
+		tempDir:  filepath.Join(dir, sharedTempDir),
+	}
+	for _, d := range []string{s.blobsDir, s.tempDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, fmt.Errorf("create dir %s: %s", d, err)
+		}
+	}
+	return s, nil
+}
+
+// Stat returns the FileInfo of a blob.
+func (s *SharedBlobStore) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(filepath.Join(s.blobsDir, name))
+}
+
+// Open returns a reader of a blob.
+func (s *SharedBlobStore) Open(name string) (base.FileReader, error) {
+	return os.Open(filepath.Join(s.blobsDir, name))
+}
+
+// Commit copies the file at src into the store through a temp file of the
+// volume, and removes src.
+func (s *SharedBlobStore) Commit(name, src string) error {
+	if _, err := s.Stat(name); err == nil {
+		return os.ErrExist
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(s.tempDir, name+".")
+	if err != nil {
+		return fmt.Errorf("create temp file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, in); err != nil {
+		return fmt.Errorf("copy %s: %s", src, err)
+	}
+	// Other hosts may read the blob as soon as it's renamed, so its content
+	// must reach the server first.
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("sync temp file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %s", err)
+	}
+	// Blobs are content addressed, so replacing a blob committed concurrently
+	// by another host is harmless.
+	if err := os.Rename(tmp.Name(), filepath.Join(s.blobsDir, name)); err != nil {
+		return fmt.Errorf("rename temp file: %s", err)
+	}
+	return os.Remove(src)
+}
+
+// LinkTo hard links the blob to target, or copies it if target is on another
+// file system.
+func (s *SharedBlobStore) LinkTo(name, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	p := filepath.Join(s.blobsDir, name)
+	if err := os.Link(p, target); err == nil || os.IsExist(err) {
+		return err
+	}
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("copy %s: %s", p, err)
+	}
+	return out.Close()
+}
+
+// Delete removes a blob.
+func (s *SharedBlobStore) Delete(name string) error {
+	return os.Remove(filepath.Join(s.blobsDir, name))
+}
+
+// List returns the names of all blobs.
+func (s *SharedBlobStore) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.blobsDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
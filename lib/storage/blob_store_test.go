@@ -0,0 +1,86 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedBlobStore(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	shared := filepath.Join(root, "shared")
+
+	store1, err := NewImageStore(filepath.Join(root, "storage1"))
+	require.NoError(err)
+	defer store1.CleanupSandbox()
+	require.NoError(store1.Layers.EnableSharedBlobStore(shared))
+	store2, err := NewImageStore(filepath.Join(root, "storage2"))
+	require.NoError(err)
+	defer store2.CleanupSandbox()
+	require.NoError(store2.Layers.EnableSharedBlobStore(shared))
+
+	// A layer pulled by one builder is visible to the other.
+	require.NoError(store1.Layers.CreateDownloadFile("layer", 0))
+	w, err := store1.Layers.GetDownloadFileReadWriter("layer")
+	require.NoError(err)
+	_, err = w.Write([]byte("content"))
+	require.NoError(err)
+	require.NoError(w.Close())
+	require.NoError(store1.Layers.MoveDownloadFileToStore("layer"))
+
+	info, err := store2.Layers.GetDownloadOrCacheFileStat("layer")
+	require.NoError(err)
+	require.Equal(int64(7), info.Size())
+	r, err := store2.Layers.GetStoreFileReader("layer")
+	require.NoError(err)
+	content, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.NoError(r.Close())
+	require.Equal("content", string(content))
+
+	// Committing a layer twice leaves the source file.
+	src := filepath.Join(store2.SandboxDir, "layertar")
+	require.NoError(ioutil.WriteFile(src, []byte("content"), 0644))
+	require.True(os.IsExist(store2.Layers.LinkStoreFileFrom("layer", src)))
+	_, err = os.Stat(src)
+	require.NoError(err)
+	require.NoError(store2.Layers.LinkStoreFileFrom("layer2", src))
+	_, err = os.Stat(src)
+	require.True(os.IsNotExist(err))
+
+	target := filepath.Join(root, "export", "layer")
+	require.NoError(store1.Layers.LinkStoreFileTo("layer2", target))
+	content, err = ioutil.ReadFile(target)
+	require.NoError(err)
+	require.Equal("content", string(content))
+
+	// No temp file is left behind.
+	tmps, err := ioutil.ReadDir(filepath.Join(shared, sharedTempDir))
+	require.NoError(err)
+	require.Empty(tmps)
+
+	require.NoError(store1.Layers.DeleteStoreFile("layer"))
+	_, err = store2.Layers.GetStoreFileStat("layer")
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,158 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cdc implements FastCDC content-defined chunking: chunk boundaries
+// depend on the content around them rather than on offsets, so an insertion
+// only changes the chunks next to it, and similar blobs share most chunks.
+package cdc
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Default chunk sizes.
+const (
+	DefaultMinSize = 16 << 10
+	DefaultAvgSize = 64 << 10
+	DefaultMaxSize = 256 << 10
+)
+
+// _gear maps each byte to a random 64 bits value for the gear rolling hash. It
+// is generated from a fixed seed, since chunk boundaries must be stable across
+// versions.
+var _gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6d616b697375) // "makisu"
+	for i := range table {
+		// splitmix64.
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker splits a stream into content-defined chunks.
+type Chunker struct {
+	r       io.Reader
+	minSize int
+	avgSize int
+	maxSize int
+
+	// Normalized chunking: a stricter mask before the average size and a
+	// looser one after, which narrows the distribution of chunk sizes.
+	maskS uint64
+	maskL uint64
+
+	buf []byte
+	// start and end delimit the buffered content not returned yet.
+	start int
+	end   int
+	eof   bool
+}
+
+// NewChunker returns a new Chunker with the given sizes. avgSize must be a
+// power of two, and minSize <= avgSize <= maxSize.
+func NewChunker(r io.Reader, minSize, avgSize, maxSize int) (*Chunker, error) {
+	if minSize <= 0 || minSize > avgSize || avgSize > maxSize {
+		return nil, fmt.Errorf("invalid chunk sizes %d/%d/%d", minSize, avgSize, maxSize)
+	} else if avgSize&(avgSize-1) != 0 {
+		return nil, fmt.Errorf("average chunk size %d is not a power of two", avgSize)
+	}
+	avgBits := uint(bits.TrailingZeros(uint(avgSize)))
+	if avgBits < 4 {
+		return nil, fmt.Errorf("average chunk size %d is too small", avgSize)
+	}
+	return &Chunker{
+		r:       r,
+		minSize: minSize,
+		avgSize: avgSize,
+		maxSize: maxSize,
+		// The gear hash shifts left, so the upper bits depend on the most
+		// bytes.
+		maskS: ^uint64(0) << (64 - (avgBits + 2)),
+		maskL: ^uint64(0) << (64 - (avgBits - 2)),
+		buf:   make([]byte, 2*maxSize),
+	}, nil
+}
+
+// Next returns the next chunk, or io.EOF once all content was returned. The
+// chunk is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill makes sure at least maxSize bytes are buffered, unless the end of the
+// stream was reached.
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.maxSize {
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return fmt.Errorf("read: %s", err)
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the first chunk of b.
+func (c *Chunker) cut(b []byte) int {
+	if len(b) <= c.minSize {
+		return len(b)
+	}
+	if len(b) > c.maxSize {
+		b = b[:c.maxSize]
+	}
+	normal := c.avgSize
+	if len(b) < normal {
+		normal = len(b)
+	}
+
+	var fp uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + _gear[b[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < len(b); i++ {
+		fp = (fp << 1) + _gear[b[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,91 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cdc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func chunkDigests(require *require.Assertions, content []byte) ([][32]byte, []byte) {
+	c, err := NewChunker(bytes.NewReader(content), 1<<10, 4<<10, 16<<10)
+	require.NoError(err)
+	var digests [][32]byte
+	var joined []byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		require.True(len(chunk) <= 16<<10)
+		digests = append(digests, sha256.Sum256(chunk))
+		joined = append(joined, chunk...)
+	}
+	return digests, joined
+}
+
+func TestChunker(t *testing.T) {
+	require := require.New(t)
+
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	digests, joined := chunkDigests(require, content)
+	require.Equal(content, joined)
+	// Sizes average around 4KB.
+	require.True(len(digests) > 128 && len(digests) < 512, "%d chunks", len(digests))
+
+	// Inserting bytes only changes the chunks around them.
+	modified := append(append(append([]byte{}, content[:500<<10]...), []byte("makisu")...), content[500<<10:]...)
+	modifiedDigests, joined := chunkDigests(require, modified)
+	require.Equal(modified, joined)
+	shared := make(map[[32]byte]bool)
+	for _, d := range digests {
+		shared[d] = true
+	}
+	var common int
+	for _, d := range modifiedDigests {
+		if shared[d] {
+			common++
+		}
+	}
+	require.True(common >= len(digests)-3, "%d/%d chunks shared", common, len(digests))
+}
+
+func TestChunkerEmpty(t *testing.T) {
+	require := require.New(t)
+
+	c, err := NewChunker(bytes.NewReader(nil), DefaultMinSize, DefaultAvgSize, DefaultMaxSize)
+	require.NoError(err)
+	_, err = c.Next()
+	require.Equal(io.EOF, err)
+}
+
+func TestNewChunkerInvalidSizes(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewChunker(nil, 0, 64, 128)
+	require.Error(err)
+	_, err = NewChunker(nil, 16, 48, 128)
+	require.Error(err)
+	_, err = NewChunker(nil, 16, 256, 128)
+	require.Error(err)
+}
@@ -0,0 +1,227 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/uber/makisu/lib/storage/cdc"
+)
+
+const (
+	chunkStoreChunksDir  = "layer_tar/chunks"
+	chunkStoreRecipesDir = "layer_tar/recipes"
+)
+
+// chunkRecipe lists the chunks of a blob, in order.
+type chunkRecipe struct {
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"`
+}
+
+// ChunkStore is an experimental store that splits blobs into content-defined
+// chunks, and stores each distinct chunk once across all blobs. Blobs are
+// stored byte for byte, so it dedups best with uncompressed layers: compressed
+// layers only share the chunks before their first difference.
+type ChunkStore struct {
+	chunksDir  string
+	recipesDir string
+}
+
+// NewChunkStore initializes and returns a new ChunkStore object.
+func NewChunkStore(rootdir string) (*ChunkStore, error) {
+	s := &ChunkStore{
+		chunksDir:  path.Join(rootdir, chunkStoreChunksDir),
+		recipesDir: path.Join(rootdir, chunkStoreRecipesDir),
+	}
+	for _, dir := range []string{s.chunksDir, s.recipesDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("create dir %s: %s", dir, err)
+		}
+	}
+	return s, nil
+}
+
+// Put splits the content of r into chunks, and stores the blob as fileName.
+// It returns the number of bytes of new chunks written to disk.
+func (s *ChunkStore) Put(fileName string, r io.Reader) (int64, error) {
+	chunker, err := cdc.NewChunker(r, cdc.DefaultMinSize, cdc.DefaultAvgSize, cdc.DefaultMaxSize)
+	if err != nil {
+		return 0, fmt.Errorf("new chunker: %s", err)
+	}
+	var recipe chunkRecipe
+	var written int64
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("chunk %s: %s", fileName, err)
+		}
+		digest := sha256.Sum256(chunk)
+		name := hex.EncodeToString(digest[:])
+		if n, err := s.putChunk(name, chunk); err != nil {
+			return 0, fmt.Errorf("put chunk %s: %s", name, err)
+		} else {
+			written += n
+		}
+		recipe.Size += int64(len(chunk))
+		recipe.Chunks = append(recipe.Chunks, name)
+	}
+
+	recipeJSON, err := json.Marshal(recipe)
+	if err != nil {
+		return 0, fmt.Errorf("marshal recipe: %s", err)
+	}
+	if err := writeFileAtomic(s.recipesDir, fileName, recipeJSON); err != nil {
+		return 0, fmt.Errorf("write recipe: %s", err)
+	}
+	return written, nil
+}
+
+// putChunk writes a chunk unless it already exists, and returns the number of
+// bytes written.
+func (s *ChunkStore) putChunk(name string, chunk []byte) (int64, error) {
+	if _, err := os.Stat(path.Join(s.chunksDir, name)); err == nil {
+		return 0, nil
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err := writeFileAtomic(s.chunksDir, name, chunk); err != nil {
+		return 0, err
+	}
+	return int64(len(chunk)), nil
+}
+
+// Has returns true if the store contains fileName.
+func (s *ChunkStore) Has(fileName string) bool {
+	_, err := os.Stat(path.Join(s.recipesDir, fileName))
+	return err == nil
+}
+
+// Size returns the size of fileName.
+func (s *ChunkStore) Size(fileName string) (int64, error) {
+	recipe, err := s.getRecipe(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return recipe.Size, nil
+}
+
+// Restore writes the content of fileName to w, verifying each chunk.
+func (s *ChunkStore) Restore(fileName string, w io.Writer) error {
+	recipe, err := s.getRecipe(fileName)
+	if err != nil {
+		return err
+	}
+	for _, name := range recipe.Chunks {
+		chunk, err := ioutil.ReadFile(path.Join(s.chunksDir, name))
+		if err != nil {
+			return fmt.Errorf("read chunk %s: %s", name, err)
+		}
+		if digest := sha256.Sum256(chunk); hex.EncodeToString(digest[:]) != name {
+			return fmt.Errorf("chunk %s is corrupted", name)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return fmt.Errorf("write chunk %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Delete removes fileName. Its chunks are only removed by GC.
+func (s *ChunkStore) Delete(fileName string) error {
+	if err := os.Remove(path.Join(s.recipesDir, fileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// GC removes the chunks that no blob refers to, and returns the number of
+// bytes freed.
+func (s *ChunkStore) GC() (int64, error) {
+	recipes, err := ioutil.ReadDir(s.recipesDir)
+	if err != nil {
+		return 0, fmt.Errorf("list recipes: %s", err)
+	}
+	used := make(map[string]bool)
+	for _, fi := range recipes {
+		if strings.HasPrefix(fi.Name(), ".") {
+			// Temp file being written.
+			continue
+		}
+		recipe, err := s.getRecipe(fi.Name())
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range recipe.Chunks {
+			used[name] = true
+		}
+	}
+
+	chunks, err := ioutil.ReadDir(s.chunksDir)
+	if err != nil {
+		return 0, fmt.Errorf("list chunks: %s", err)
+	}
+	var freed int64
+	for _, fi := range chunks {
+		if used[fi.Name()] || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if err := os.Remove(path.Join(s.chunksDir, fi.Name())); err != nil {
+			return freed, fmt.Errorf("remove chunk %s: %s", fi.Name(), err)
+		}
+		freed += fi.Size()
+	}
+	return freed, nil
+}
+
+func (s *ChunkStore) getRecipe(fileName string) (*chunkRecipe, error) {
+	recipeJSON, err := ioutil.ReadFile(path.Join(s.recipesDir, fileName))
+	if err != nil {
+		return nil, fmt.Errorf("read recipe %s: %s", fileName, err)
+	}
+	recipe := new(chunkRecipe)
+	if err := json.Unmarshal(recipeJSON, recipe); err != nil {
+		return nil, fmt.Errorf("unmarshal recipe %s: %s", fileName, err)
+	}
+	return recipe, nil
+}
+
+// writeFileAtomic writes a file in dir through a temp file, so readers never
+// see partial content.
+func writeFileAtomic(dir, name string, content []byte) error {
+	f, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return fmt.Errorf("create temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		return fmt.Errorf("write temp file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close temp file: %s", err)
+	}
+	return os.Rename(f.Name(), path.Join(dir, name))
+}
@@ -0,0 +1,76 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkStore(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	store, err := NewChunkStore(root)
+	require.NoError(err)
+
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(content)
+	// The second blob only differs by a few bytes in the middle.
+	content2 := append([]byte{}, content[:500<<10]...)
+	content2 = append(content2, []byte("inserted")...)
+	content2 = append(content2, content[500<<10:]...)
+
+	n, err := store.Put("blob1", bytes.NewReader(content))
+	require.NoError(err)
+	require.Equal(int64(len(content)), n)
+	n2, err := store.Put("blob2", bytes.NewReader(content2))
+	require.NoError(err)
+	require.True(n2 < int64(len(content2))/2)
+
+	for name, expected := range map[string][]byte{"blob1": content, "blob2": content2} {
+		require.True(store.Has(name))
+		size, err := store.Size(name)
+		require.NoError(err)
+		require.Equal(int64(len(expected)), size)
+		var buf bytes.Buffer
+		require.NoError(store.Restore(name, &buf))
+		require.Equal(expected, buf.Bytes())
+	}
+
+	// Chunks shared with blob2 are kept.
+	require.NoError(store.Delete("blob1"))
+	require.False(store.Has("blob1"))
+	freed, err := store.GC()
+	require.NoError(err)
+	require.True(freed > 0 && freed < int64(len(content))/2)
+	var buf bytes.Buffer
+	require.NoError(store.Restore("blob2", &buf))
+	require.Equal(content2, buf.Bytes())
+
+	require.NoError(store.Delete("blob2"))
+	_, err = store.GC()
+	require.NoError(err)
+	chunks, err := ioutil.ReadDir(store.chunksDir)
+	require.NoError(err)
+	require.Empty(chunks)
+}
@@ -25,7 +25,7 @@ func TestStoreFixture(t *testing.T) {
 
 	store, cleanup := StoreFixture()
 	require.NotNil(store)
-	require.NoError(CleanupSandbox(store.RootDir))
+	require.NoError(store.CleanupSandbox())
 	defer cleanup()
 }
 
@@ -34,6 +34,6 @@ func TestStoreFixtureWithSampleImage(t *testing.T) {
 
 	store, cleanup := StoreFixtureWithSampleImage()
 	require.NotNil(store)
-	require.NoError(CleanupSandbox(store.RootDir))
+	require.NoError(store.CleanupSandbox())
 	defer cleanup()
 }
@@ -20,51 +20,166 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/uber/makisu/lib/docker/image"
 )
 
+const _sandboxLockSuffix = ".lock"
+
 // ImageStore contains a manifeststore, a layertarstore, and a sandbox dir.
+// Multiple builds can share the same root dir: each one gets its own sandbox
+// dir, locked for the duration of the build.
 type ImageStore struct {
 	RootDir    string
 	SandboxDir string
 	Manifests  *ManifestStore
 	Layers     *LayerTarStore
+	Transfers  *TransferStore
+	// ScratchDir is the fast dir temp files go to when they fit, if set. See
+	// TempDir.
+	ScratchDir string
+
+	sandboxLock *FileLock
+	scratch     *scratch
 }
 
 // NewImageStore creates a new ImageStore.
 func NewImageStore(rootDir string) (*ImageStore, error) {
+	// Remove the sandboxes left behind by builds that were killed.
+	if err := CleanupStaleSandboxes(rootDir); err != nil {
+		return nil, fmt.Errorf("cleanup stale sandboxes: %s", err)
+	}
 	sandboxParent := filepath.Join(rootDir, "sandbox")
 	if err := os.MkdirAll(sandboxParent, 0755); err != nil {
 		return nil, fmt.Errorf("init sandbox parent dir: %s", err)
 	}
-	sandboxDir, err := ioutil.TempDir(sandboxParent, "sandbox")
+	sandboxDir, sandboxLock, err := newSandbox(sandboxParent)
 	if err != nil {
 		return nil, fmt.Errorf("init sandbox dir: %s", err)
 	}
 
-	m, err := NewManifestStore(rootDir)
+	m, err := NewManifestStore(rootDir, sandboxDir)
 	if err != nil {
 		return nil, fmt.Errorf("init manifest store: %s", err)
 	}
-	l, err := NewLayerTarStore(rootDir)
+	l, err := NewLayerTarStore(rootDir, sandboxDir)
 	if err != nil {
 		return nil, fmt.Errorf("init layer store: %s", err)
 	}
+	t, err := NewTransferStore(rootDir)
+	if err != nil {
+		return nil, fmt.Errorf("init transfer store: %s", err)
+	}
 
 	return &ImageStore{
-		RootDir:    rootDir,
-		SandboxDir: sandboxDir,
-		Manifests:  m,
-		Layers:     l,
+		RootDir:     rootDir,
+		SandboxDir:  sandboxDir,
+		Manifests:   m,
+		Layers:      l,
+		Transfers:   t,
+		sandboxLock: sandboxLock,
 	}, nil
 }
 
-// CleanupSandbox removes sandbox dir. This should be done after every build.
-func CleanupSandbox(rootDir string) error {
+// newSandbox creates a sandbox dir in sandboxParent, locked until the build
+// ends. The lock is taken before the dir is created, so builds cleaning up
+// stale sandboxes never see it unlocked.
+func newSandbox(sandboxParent string) (string, *FileLock, error) {
+	for {
+		f, err := ioutil.TempFile(sandboxParent, "sandbox*"+_sandboxLockSuffix)
+		if err != nil {
+			return "", nil, fmt.Errorf("create lock: %s", err)
+		}
+		f.Close()
+		lock, err := TryLockFile(f.Name())
+		if err == os.ErrExist {
+			// A build cleaning up stale sandboxes locked it first, and
+			// removes it.
+			continue
+		} else if err != nil {
+			return "", nil, fmt.Errorf("lock: %s", err)
+		}
+		sandboxDir := strings.TrimSuffix(f.Name(), _sandboxLockSuffix)
+		if err := os.Mkdir(sandboxDir, 0700); err != nil {
+			lock.Unlock()
+			return "", nil, fmt.Errorf("create dir: %s", err)
+		}
+		return sandboxDir, lock, nil
+	}
+}
+
+// sandboxNames returns the names of the sandboxes of a sandbox parent dir,
+// from their dirs and their lock files: a sandbox is locked before its dir is
+// created, and its dir is removed before its lock.
+func sandboxNames(infos []os.FileInfo) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() {
+			if !strings.HasSuffix(name, _sandboxLockSuffix) {
+				continue
+			}
+			name = strings.TrimSuffix(name, _sandboxLockSuffix)
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CleanupSandbox removes the sandbox dirs of this store. This should be done
+// after every build.
+// The storage sandbox is removed even if the scratch one can't be, and the
+// first error is returned.
+func (store *ImageStore) CleanupSandbox() error {
+	defer store.sandboxLock.Unlock()
+	var err error
+	if store.scratch != nil {
+		err = store.scratch.cleanup()
+	}
+	if rerr := store.removeSandbox(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (store *ImageStore) removeSandbox() error {
+	if err := os.RemoveAll(store.SandboxDir); err != nil {
+		return fmt.Errorf("remove sandbox %s: %s", store.SandboxDir, err)
+	}
+	return os.Remove(store.SandboxDir + _sandboxLockSuffix)
+}
+
+// CleanupStaleSandboxes removes the sandbox dirs under rootDir that aren't
+// locked by a running build.
+func CleanupStaleSandboxes(rootDir string) error {
 	sandboxParent := filepath.Join(rootDir, "sandbox")
-	if err := os.RemoveAll(sandboxParent); err != nil {
-		return fmt.Errorf("remove sandbox parent %s: %s", sandboxParent, err)
+	infos, err := ioutil.ReadDir(sandboxParent)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read sandbox parent %s: %s", sandboxParent, err)
+	}
+	for _, name := range sandboxNames(infos) {
+		sandboxDir := filepath.Join(sandboxParent, name)
+		lock, err := TryLockFile(sandboxDir + _sandboxLockSuffix)
+		if err == os.ErrExist {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("lock sandbox %s: %s", sandboxDir, err)
+		}
+		err = os.RemoveAll(sandboxDir)
+		if err == nil {
+			err = os.Remove(sandboxDir + _sandboxLockSuffix)
+		}
+		lock.Unlock()
+		if err != nil {
+			return fmt.Errorf("remove sandbox %s: %s", sandboxDir, err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,90 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentImageStores(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	store1, err := NewImageStore(root)
+	require.NoError(err)
+	require.NoError(store1.Layers.CreateDownloadFile("layer", 0))
+
+	// A concurrent build keeps the sandbox and downloads of the first one.
+	store2, err := NewImageStore(root)
+	require.NoError(err)
+	require.NotEqual(store1.SandboxDir, store2.SandboxDir)
+	_, err = store1.Layers.GetDownloadOrCacheFileStat("layer")
+	require.NoError(err)
+	require.NoError(store2.CleanupSandbox())
+	_, err = os.Stat(store1.SandboxDir)
+	require.NoError(err)
+
+	// The sandbox of a killed build is removed by the next one.
+	require.NoError(store1.sandboxLock.Unlock())
+	store3, err := NewImageStore(root)
+	require.NoError(err)
+	defer store3.CleanupSandbox()
+	_, err = os.Stat(store1.SandboxDir)
+	require.True(os.IsNotExist(err))
+}
+
+func TestImageStoresStartingTogether(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	// Only the lock is left of a build killed before creating its sandbox.
+	require.NoError(os.MkdirAll(filepath.Join(root, "sandbox"), 0755))
+	stale := filepath.Join(root, "sandbox", "sandbox1"+_sandboxLockSuffix)
+	require.NoError(ioutil.WriteFile(stale, nil, 0644))
+
+	// Builds starting together clean up stale sandboxes while the others
+	// create theirs, and none of them loses its sandbox.
+	var wg sync.WaitGroup
+	stores := make([]*ImageStore, 20)
+	errs := make([]error, len(stores))
+	for i := range stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stores[i], errs[i] = NewImageStore(root)
+		}(i)
+	}
+	wg.Wait()
+	for i, store := range stores {
+		require.NoError(errs[i])
+		_, err := os.Stat(store.SandboxDir)
+		require.NoError(err)
+		defer store.CleanupSandbox()
+	}
+	_, err = os.Stat(stale)
+	require.True(os.IsNotExist(err))
+}
@@ -15,9 +15,11 @@
 package storage
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
 
 	"github.com/uber/makisu/lib/log"
 	"github.com/uber/makisu/lib/storage/base"
@@ -31,6 +33,7 @@ type layerTarState int
 const (
 	layerTarDownloadDir = "layer_tar/download"
 	layerTarCacheDir    = "layer_tar/cache"
+	layerTarLocksDir    = "layer_tar/locks"
 )
 const layerLRUSize = 256
 
@@ -38,17 +41,23 @@ const layerLRUSize = 256
 type LayerTarStore struct {
 	backend       base.FileStore
 	downloadState base.FileState
-	cacheState    base.FileState
+	blobs         BlobStore
+
+	// chunks, if set, keeps the layers deduped by DedupStoreFiles.
+	chunks    *ChunkStore
+	restoreMu sync.Mutex
+
+	locks *blobLocks
 }
 
-// NewLayerTarStore initializes and returns a new LayerTarStore object.
-func NewLayerTarStore(rootdir string) (*LayerTarStore, error) {
+// NewLayerTarStore initializes and returns a new LayerTarStore object. The
+// cache dir under rootdir is shared with the other builds using it, while
+// downloads go to the sandbox dir of this build.
+func NewLayerTarStore(rootdir, sandboxDir string) (*LayerTarStore, error) {
 	// Init all directories.
-	downloadDir := path.Join(rootdir, layerTarDownloadDir)
+	downloadDir := path.Join(sandboxDir, layerTarDownloadDir)
 	cacheDir := path.Join(rootdir, layerTarCacheDir)
 
-	// Remove and recreate download dir.
-	os.RemoveAll(downloadDir)
 	if err := os.MkdirAll(downloadDir, 0755); err != nil {
 		log.Fatalf("Failed to create layer download dir %s: %s", downloadDir, err)
 	}
@@ -77,19 +86,45 @@ func NewLayerTarStore(rootdir string) (*LayerTarStore, error) {
 		}
 	}
 
+	locks, err := newBlobLocks(path.Join(rootdir, layerTarLocksDir))
+	if err != nil {
+		return nil, err
+	}
+
 	return &LayerTarStore{
 		backend:       backend,
 		downloadState: downloadState,
-		cacheState:    cacheState,
+		blobs:         &localBlobStore{backend, cacheState},
+		locks:         locks,
 	}, nil
 }
 
+// LockBlob blocks until no other build or goroutine holds the lock of fileName,
+// and returns a function releasing it. Holding it while downloading a blob
+// ensures concurrent pulls download it once, the others finding it in store.
+func (s *LayerTarStore) LockBlob(fileName string) (func(), error) {
+	return s.locks.lock(fileName)
+}
+
 // CreateDownloadFile creates an empty file in download directory with specified size.
 func (s *LayerTarStore) CreateDownloadFile(fileName string, len int64) error {
 	return s.backend.NewFileOp().AcceptState(s.downloadState).CreateFile(
 		fileName, s.downloadState, len)
 }
 
+// MoveFileToDownload moves the file at src into the download directory. src
+// must be on the same filesystem.
+func (s *LayerTarStore) MoveFileToDownload(fileName, src string) error {
+	if err := s.CreateDownloadFile(fileName, 0); err != nil {
+		return err
+	}
+	p, err := s.backend.NewFileOp().AcceptState(s.downloadState).GetFilePath(fileName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(src, p)
+}
+
 // GetDownloadFileReader returns a FileReader for a file in download directory.
 func (s *LayerTarStore) GetDownloadFileReader(fileName string) (base.FileReader, error) {
 	return s.backend.NewFileOp().AcceptState(s.downloadState).GetFileReader(fileName)
@@ -100,38 +135,193 @@ func (s *LayerTarStore) GetDownloadFileReadWriter(fileName string) (base.FileRea
 	return s.backend.NewFileOp().AcceptState(s.downloadState).GetFileReadWriter(fileName)
 }
 
+// GetDownloadFileStat returns os.FileInfo for a file in download directory.
+func (s *LayerTarStore) GetDownloadFileStat(fileName string) (os.FileInfo, error) {
+	return s.backend.NewFileOp().AcceptState(s.downloadState).GetFileStat(fileName)
+}
+
+// DeleteDownloadFile deletes a file from download directory.
+func (s *LayerTarStore) DeleteDownloadFile(fileName string) error {
+	return s.backend.NewFileOp().AcceptState(s.downloadState).DeleteFile(fileName)
+}
+
 // MoveDownloadFileToStore moves a file from store directory to cache directory.
 func (s *LayerTarStore) MoveDownloadFileToStore(fileName string) error {
-	return s.backend.NewFileOp().AcceptState(s.downloadState).MoveFile(fileName, s.cacheState)
+	op := s.backend.NewFileOp().AcceptState(s.downloadState)
+	p, err := op.GetFilePath(fileName)
+	if err != nil {
+		return err
+	}
+	// The file is moved out of the download dir first, since a name can only
+	// be in one state of the backend.
+	tmp := path.Join(s.downloadState.GetDirectory(), "."+fileName)
+	if err := os.Rename(p, tmp); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := op.DeleteFile(fileName); err != nil {
+		return err
+	}
+	return s.blobs.Commit(fileName, tmp)
 }
 
 // LinkStoreFileFrom create a hardlink in store from given source path.
 func (s *LayerTarStore) LinkStoreFileFrom(fileName, src string) error {
-	return s.backend.NewFileOp().AcceptState(s.cacheState).MoveFileFrom(fileName, s.cacheState, src)
+	return s.blobs.Commit(fileName, src)
 }
 
 // GetStoreFileReader returns a FileReader for a file in store directory.
 func (s *LayerTarStore) GetStoreFileReader(fileName string) (base.FileReader, error) {
-	return s.backend.NewFileOp().AcceptState(s.cacheState).GetFileReader(fileName)
+	s.maybeRestore(fileName)
+	return s.blobs.Open(fileName)
 }
 
 // GetDownloadOrCacheFileStat returns os.FileInfo for a file in download or cache directory.
 func (s *LayerTarStore) GetDownloadOrCacheFileStat(fileName string) (os.FileInfo, error) {
-	return s.backend.NewFileOp().AcceptState(s.downloadState).AcceptState(s.cacheState).GetFileStat(
-		fileName)
+	if info, err := s.backend.NewFileOp().AcceptState(s.downloadState).GetFileStat(fileName); err == nil {
+		return info, nil
+	}
+	s.maybeRestore(fileName)
+	return s.blobs.Stat(fileName)
 }
 
 // GetStoreFileStat returns FileInfo of the specified file.
 func (s *LayerTarStore) GetStoreFileStat(fileName string) (os.FileInfo, error) {
-	return s.backend.NewFileOp().AcceptState(s.cacheState).GetFileStat(fileName)
+	s.maybeRestore(fileName)
+	return s.blobs.Stat(fileName)
 }
 
 // DeleteStoreFile deletes a file from store directory.
 func (s *LayerTarStore) DeleteStoreFile(fileName string) error {
-	return s.backend.NewFileOp().AcceptState(s.cacheState).DeleteFile(fileName)
+	if s.chunks != nil {
+		if err := s.chunks.Delete(fileName); err != nil {
+			return fmt.Errorf("delete from chunk store: %s", err)
+		}
+	}
+	return s.blobs.Delete(fileName)
 }
 
 // LinkStoreFileTo hardlinks file from store to target
 func (s *LayerTarStore) LinkStoreFileTo(fileName, target string) error {
-	return s.backend.NewFileOp().AcceptState(s.cacheState).LinkFileTo(fileName, target)
+	s.maybeRestore(fileName)
+	return s.blobs.LinkTo(fileName, target)
+}
+
+// EnableSharedBlobStore keeps the blobs of the store in dir, on a volume that
+// can be shared by builders on several hosts, like NFS or CephFS. Downloads
+// stay in the sandbox dir, and are copied to the volume once verified. The
+// blob locks are taken in dir too, so the builders sharing it pull each blob
+// once.
+func (s *LayerTarStore) EnableSharedBlobStore(dir string) error {
+	blobs, err := NewSharedBlobStore(dir)
+	if err != nil {
+		return fmt.Errorf("init shared blob store: %s", err)
+	}
+	locks, err := newBlobLocks(path.Join(dir, sharedLocksDir))
+	if err != nil {
+		return err
+	}
+	s.blobs = blobs
+	s.locks = locks
+	return nil
+}
+
+// EnableChunkStore enables the experimental chunk store under rootdir: layers
+// are deduped into it by DedupStoreFiles, and restored on demand.
+func (s *LayerTarStore) EnableChunkStore(rootdir string) error {
+	chunks, err := NewChunkStore(rootdir)
+	if err != nil {
+		return fmt.Errorf("init chunk store: %s", err)
+	}
+	s.chunks = chunks
+	return nil
+}
+
+// DedupStoreFiles moves all files of the store directory into the chunk
+// store, and removes the chunks no file refers to anymore.
+func (s *LayerTarStore) DedupStoreFiles() error {
+	if s.chunks == nil {
+		return fmt.Errorf("chunk store is not enabled")
+	}
+	files, err := s.blobs.List()
+	if err != nil {
+		return fmt.Errorf("list store files: %s", err)
+	}
+	var total, written int64
+	for _, f := range files {
+		n, size, err := s.dedupStoreFile(f)
+		if err != nil {
+			return fmt.Errorf("dedup %s: %s", f, err)
+		}
+		total += size
+		written += n
+	}
+	freed, err := s.chunks.GC()
+	if err != nil {
+		return fmt.Errorf("gc chunk store: %s", err)
+	}
+	log.Infof("Deduped %d layers: %d bytes, %d bytes of new chunks, %d bytes of chunks freed",
+		len(files), total, written, freed)
+	return nil
+}
+
+// dedupStoreFile moves one file into the chunk store, and returns the number
+// of bytes of new chunks and the size of the file.
+func (s *LayerTarStore) dedupStoreFile(fileName string) (int64, int64, error) {
+	r, err := s.blobs.Open(fileName)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get reader: %s", err)
+	}
+	defer r.Close()
+	n, err := s.chunks.Put(fileName, r)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := s.chunks.Size(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := s.blobs.Delete(fileName); err != nil {
+		return 0, 0, fmt.Errorf("delete store file: %s", err)
+	}
+	return n, size, nil
+}
+
+// maybeRestore rebuilds a file of the chunk store in the store directory, if
+// it's missing there. Failures are logged, and surface as missing files.
+func (s *LayerTarStore) maybeRestore(fileName string) {
+	if s.chunks == nil || !s.chunks.Has(fileName) {
+		return
+	}
+	s.restoreMu.Lock()
+	defer s.restoreMu.Unlock()
+	if _, err := s.blobs.Stat(fileName); err == nil {
+		return
+	}
+	if err := s.restore(fileName); err != nil {
+		log.Warnf("Failed to restore %s from chunk store: %s", fileName, err)
+		s.backend.NewFileOp().AcceptState(s.downloadState).DeleteFile(fileName)
+	}
+}
+
+func (s *LayerTarStore) restore(fileName string) error {
+	size, err := s.chunks.Size(fileName)
+	if err != nil {
+		return err
+	}
+	if err := s.CreateDownloadFile(fileName, size); err != nil {
+		return fmt.Errorf("create download file: %s", err)
+	}
+	w, err := s.GetDownloadFileReadWriter(fileName)
+	if err != nil {
+		return fmt.Errorf("get download file writer: %s", err)
+	}
+	defer w.Close()
+	if err := s.chunks.Restore(fileName, w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("close download file: %s", err)
+	}
+	return s.MoveDownloadFileToStore(fileName)
 }
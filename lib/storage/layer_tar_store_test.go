@@ -73,12 +73,12 @@ func TestLayerTarStore(t *testing.T) {
 
 			err := store.Layers.CreateDownloadFile(testFileName, 1)
 			require.NoError(err)
-			_, err = os.Stat(filepath.Join(root, layerTarDownloadDir, testFileName))
+			_, err = os.Stat(filepath.Join(store.SandboxDir, layerTarDownloadDir, testFileName))
 			require.NoError(err)
 
 			err = store.Layers.MoveDownloadFileToStore(testFileName)
 			require.NoError(err)
-			_, err = os.Stat(filepath.Join(root, layerTarDownloadDir, testFileName))
+			_, err = os.Stat(filepath.Join(store.SandboxDir, layerTarDownloadDir, testFileName))
 			require.True(os.IsNotExist(err))
 			_, err = os.Stat(filepath.Join(root, layerTarCacheDir, testFileName))
 			require.NoError(err)
@@ -92,7 +92,7 @@ func TestLayerTarStore(t *testing.T) {
 
 			err = store.Layers.DeleteStoreFile(testFileName)
 			require.NoError(err)
-			_, err = os.Stat(filepath.Join(root, layerTarDownloadDir, testFileName))
+			_, err = os.Stat(filepath.Join(store.SandboxDir, layerTarDownloadDir, testFileName))
 			require.True(os.IsNotExist(err))
 			_, err = os.Stat(filepath.Join(root, layerTarCacheDir, testFileName))
 			require.True(os.IsNotExist(err))
@@ -103,3 +103,39 @@ func TestLayerTarStore(t *testing.T) {
 
 	waitGroup.Wait()
 }
+
+func TestLayerTarStoreDedupStoreFiles(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	store, err := NewImageStore(root)
+	require.NoError(err)
+	require.NoError(store.Layers.EnableChunkStore(root))
+
+	content := []byte("layer content")
+	require.NoError(store.Layers.CreateDownloadFile("layer", int64(len(content))))
+	w, err := store.Layers.GetDownloadFileReadWriter("layer")
+	require.NoError(err)
+	_, err = w.Write(content)
+	require.NoError(err)
+	require.NoError(w.Close())
+	require.NoError(store.Layers.MoveDownloadFileToStore("layer"))
+
+	require.NoError(store.Layers.DedupStoreFiles())
+	_, err = os.Stat(filepath.Join(root, layerTarCacheDir, "layer"))
+	require.True(os.IsNotExist(err))
+
+	// The layer is restored when read.
+	r, err := store.Layers.GetStoreFileReader("layer")
+	require.NoError(err)
+	restored, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.NoError(r.Close())
+	require.Equal(content, restored)
+
+	require.NoError(store.Layers.DeleteStoreFile("layer"))
+	_, err = store.Layers.GetStoreFileStat("layer")
+	require.Error(err)
+}
@@ -0,0 +1,164 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// FileLock is an advisory lock on a file, shared by all the makisu processes
+// using the same storage dir.
+type FileLock struct {
+	f *os.File
+}
+
+// LockFile blocks until it acquires an exclusive lock on the file at p,
+// creating the file if needed.
+func LockFile(p string) (*FileLock, error) {
+	return lockFile(p, syscall.LOCK_EX)
+}
+
+// TryLockFile is like LockFile, but returns os.ErrExist instead of blocking if
+// the file is already locked.
+func TryLockFile(p string) (*FileLock, error) {
+	l, err := lockFile(p, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return nil, os.ErrExist
+	}
+	return l, err
+}
+
+// lockFile locks the file at p. Lock files can be removed by the process
+// holding their lock, like sandbox locks, so the file is opened again if it
+// was removed or replaced before it was locked.
+func lockFile(p string, how int) (*FileLock, error) {
+	for {
+		f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			err = syscall.Flock(int(f.Fd()), how)
+			if err != syscall.EINTR {
+				break
+			}
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if linked, err := isLinked(f, p); err != nil {
+			f.Close()
+			return nil, err
+		} else if linked {
+			return &FileLock{f}, nil
+		}
+		f.Close()
+	}
+}
+
+// isLinked returns true if f is still the file at p.
+func isLinked(f *os.File, p string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	pfi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, pfi), nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	defer l.f.Close()
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
+
+// blobLocks hands out per blob locks that exclude both the other processes and
+// the other goroutines of this process. Goroutines waiting on the same blob
+// share one entry, which is reference counted so it's released by the last
+// one.
+type blobLocks struct {
+	sync.Mutex
+	dir   string
+	locks map[string]*blobLock
+}
+
+type blobLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newBlobLocks(dir string) (*blobLocks, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create locks dir %s: %s", dir, err)
+	}
+	return &blobLocks{dir: dir, locks: make(map[string]*blobLock)}, nil
+}
+
+// lock blocks until it holds the lock of blob name, and returns a function
+// releasing it.
+func (b *blobLocks) lock(name string) (func(), error) {
+	unlock, _, err := b.lockWaited(name)
+	return unlock, err
+}
+
+// lockWaited is like lock, and also reports whether another build or
+// goroutine held or was waiting for the lock.
+func (b *blobLocks) lockWaited(name string) (func(), bool, error) {
+	b.Lock()
+	bl, ok := b.locks[name]
+	if !ok {
+		bl = &blobLock{}
+		b.locks[name] = bl
+	}
+	bl.refs++
+	waited := bl.refs > 1
+	b.Unlock()
+
+	release := func() {
+		b.Lock()
+		defer b.Unlock()
+		if bl.refs--; bl.refs == 0 {
+			delete(b.locks, name)
+		}
+	}
+
+	bl.Lock()
+	p := path.Join(b.dir, name+".lock")
+	fl, err := TryLockFile(p)
+	if err == os.ErrExist {
+		waited = true
+		fl, err = LockFile(p)
+	}
+	if err != nil {
+		bl.Unlock()
+		release()
+		return nil, false, fmt.Errorf("lock %s: %s", name, err)
+	}
+	return func() {
+		fl.Unlock()
+		bl.Unlock()
+		release()
+	}, waited, nil
+}
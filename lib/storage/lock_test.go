@@ -0,0 +1,87 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTryLockFile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "lock")
+
+	l, err := TryLockFile(p)
+	require.NoError(err)
+	_, err = TryLockFile(p)
+	require.Equal(os.ErrExist, err)
+	require.NoError(l.Unlock())
+
+	l, err = TryLockFile(p)
+	require.NoError(err)
+	require.NoError(l.Unlock())
+}
+
+func TestBlobLocks(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	locks, err := newBlobLocks(dir)
+	require.NoError(err)
+
+	var mu sync.Mutex
+	var holders, maxHolders int
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locks.lock("blob")
+			require.NoError(err)
+			mu.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			mu.Unlock()
+
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	require.Equal(1, maxHolders)
+	require.Empty(locks.locks)
+
+	// Other processes are excluded through the lock file.
+	unlock, err := locks.lock("blob")
+	require.NoError(err)
+	_, err = TryLockFile(filepath.Join(dir, "blob.lock"))
+	require.Equal(os.ErrExist, err)
+	unlock()
+}
@@ -47,14 +47,13 @@ type ManifestStore struct {
 	cacheState    base.FileState
 }
 
-// NewManifestStore initializes and returns a new ManifestStore object.
-func NewManifestStore(rootdir string) (*ManifestStore, error) {
+// NewManifestStore initializes and returns a new ManifestStore object. Like
+// layers, manifests are downloaded to the sandbox dir of this build.
+func NewManifestStore(rootdir, sandboxDir string) (*ManifestStore, error) {
 	// Init all directories.
-	downloadDir := path.Join(rootdir, manifestDownloadDir)
+	downloadDir := path.Join(sandboxDir, manifestDownloadDir)
 	cacheDir := path.Join(rootdir, manifestCacheDir)
 
-	// Remove and recreate download dir.
-	os.RemoveAll(downloadDir)
 	if err := os.MkdirAll(downloadDir, 0755); err != nil {
 		log.Fatalf("Failed to create manifest download dir %s: %s", downloadDir, err)
 	}
@@ -40,7 +40,7 @@ func TestManifestStoreCreateDownloadFile(t *testing.T) {
 	require.NoError(store.Manifests.CreateDownloadFile(repoName, tagName, 1))
 
 	fileName := encodeRepoTag(repoName, tagName)
-	_, err = os.Stat(filepath.Join(root, manifestDownloadDir, fileName))
+	_, err = os.Stat(filepath.Join(store.SandboxDir, manifestDownloadDir, fileName))
 	require.NoError(err)
 	_, err = store.Manifests.GetDownloadOrCacheFileStat(repoName, tagName)
 	require.NoError(err)
@@ -82,19 +82,19 @@ func TestManifestStore(t *testing.T) {
 
 			err = store.Manifests.CreateDownloadFile(repoName, tagName, 1)
 			require.NoError(err)
-			_, err = os.Stat(filepath.Join(root, manifestDownloadDir, fileName))
+			_, err = os.Stat(filepath.Join(store.SandboxDir, manifestDownloadDir, fileName))
 			require.NoError(err)
 
 			err = store.Manifests.MoveDownloadFileToStore(repoName, tagName)
 			require.NoError(err)
-			_, err = os.Stat(filepath.Join(root, manifestDownloadDir, fileName))
+			_, err = os.Stat(filepath.Join(store.SandboxDir, manifestDownloadDir, fileName))
 			require.True(os.IsNotExist(err))
 			_, err = os.Stat(filepath.Join(root, manifestCacheDir, fileName))
 			require.NoError(err)
 
 			err = store.Manifests.DeleteStoreFile(repoName, tagName)
 			require.NoError(err)
-			_, err = os.Stat(filepath.Join(root, manifestDownloadDir, fileName))
+			_, err = os.Stat(filepath.Join(store.SandboxDir, manifestDownloadDir, fileName))
 			require.True(os.IsNotExist(err))
 			_, err = os.Stat(filepath.Join(root, manifestCacheDir, fileName))
 			require.True(os.IsNotExist(err))
@@ -0,0 +1,269 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/uber/makisu/lib/storage/base"
+)
+
+// CheckpointsDir is the dir of the storage dir that keeps the checkpoints of
+// interrupted builds.
+const CheckpointsDir = "checkpoints"
+
+// PruneOptions selects the files Prune removes from a storage dir.
+type PruneOptions struct {
+	// MaxAge is how long files are kept after they were last written. Zero
+	// keeps them regardless of age.
+	MaxAge time.Duration
+	// MaxSize is the size budget of the files of the storage dir: the oldest
+	// ones are removed until the rest fits. Zero disables the budget.
+	MaxSize int64
+	// DryRun only reports the files that would be removed.
+	DryRun bool
+}
+
+// PrunedFile is a file or dir removed by Prune.
+type PrunedFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// PruneReport lists what Prune removed, or would remove in dry-run mode.
+type PruneReport struct {
+	Removed []PrunedFile
+	// Freed is the number of bytes freed, including chunks of the chunk store
+	// no layer refers to anymore.
+	Freed int64
+	// Kept is the size of the files left in the storage dir.
+	Kept int64
+}
+
+// pruneEntry is a file or dir of the storage dir that Prune can remove.
+type pruneEntry struct {
+	PrunedFile
+	// layer is the name of the blob lock to hold while removing the entry.
+	layer string
+}
+
+// Prune removes the sandboxes left behind by builds that were killed, and the
+// cached layers, manifests, checkpoints and transfer states that are older than opts.MaxAge or
+// exceed opts.MaxSize, oldest first. Files written since the oldest running
+// build started are always kept, since that build might still use them.
+func Prune(rootDir string, opts PruneOptions) (*PruneReport, error) {
+	report := &PruneReport{}
+	activeSince, err := pruneSandboxes(rootDir, opts.DryRun, report)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []pruneEntry
+	for _, dir := range []string{layerTarCacheDir, chunkStoreRecipesDir} {
+		dirEntries, err := listPruneEntries(filepath.Join(rootDir, dir), true)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dirEntries...)
+	}
+	for _, dir := range []string{
+		manifestCacheDir, CheckpointsDir, transferDownloadsDir, transferUploadsDir} {
+
+		dirEntries, err := listPruneEntries(filepath.Join(rootDir, dir), false)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dirEntries...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime.Before(entries[j].ModTime)
+	})
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	locks, err := newBlobLocks(filepath.Join(rootDir, layerTarLocksDir))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var prunedLayers bool
+	for _, e := range entries {
+		expired := opts.MaxAge > 0 && now.Sub(e.ModTime) > opts.MaxAge
+		overBudget := opts.MaxSize > 0 && total > opts.MaxSize
+		if !expired && !overBudget || !activeSince.IsZero() && !e.ModTime.Before(activeSince) {
+			continue
+		}
+		if !opts.DryRun {
+			if err := removePruneEntry(locks, e); err != nil {
+				return nil, err
+			}
+		}
+		report.Removed = append(report.Removed, e.PrunedFile)
+		report.Freed += e.Size
+		total -= e.Size
+		prunedLayers = prunedLayers || e.layer != ""
+	}
+	report.Kept = total
+
+	// The chunks of the removed layers are only known once their recipes are
+	// gone.
+	if prunedLayers && !opts.DryRun {
+		if _, err := os.Stat(filepath.Join(rootDir, chunkStoreChunksDir)); err == nil {
+			chunks, err := NewChunkStore(rootDir)
+			if err != nil {
+				return nil, err
+			}
+			freed, err := chunks.GC()
+			if err != nil {
+				return nil, fmt.Errorf("gc chunk store: %s", err)
+			}
+			report.Freed += freed
+		}
+	}
+	return report, nil
+}
+
+// pruneSandboxes removes the sandboxes that aren't locked by a running build,
+// and returns when the oldest running build started, if any.
+func pruneSandboxes(rootDir string, dryRun bool, report *PruneReport) (time.Time, error) {
+	var activeSince time.Time
+	sandboxParent := filepath.Join(rootDir, "sandbox")
+	infos, err := ioutil.ReadDir(sandboxParent)
+	if os.IsNotExist(err) {
+		return activeSince, nil
+	} else if err != nil {
+		return activeSince, fmt.Errorf("read sandbox parent %s: %s", sandboxParent, err)
+	}
+	for _, name := range sandboxNames(infos) {
+		sandboxDir := filepath.Join(sandboxParent, name)
+		lock, err := TryLockFile(sandboxDir + _sandboxLockSuffix)
+		if err == os.ErrExist {
+			// The lock file is created when the build starts, and never
+			// written.
+			fi, err := os.Stat(sandboxDir + _sandboxLockSuffix)
+			if err != nil {
+				return activeSince, fmt.Errorf("stat sandbox lock: %s", err)
+			}
+			if activeSince.IsZero() || fi.ModTime().Before(activeSince) {
+				activeSince = fi.ModTime()
+			}
+			continue
+		} else if err != nil {
+			return activeSince, fmt.Errorf("lock sandbox %s: %s", sandboxDir, err)
+		}
+		// Only the lock is left of a build killed before creating its dir.
+		info, err := os.Stat(sandboxDir)
+		if os.IsNotExist(err) {
+			if !dryRun {
+				err = os.Remove(sandboxDir + _sandboxLockSuffix)
+			} else {
+				err = nil
+			}
+			lock.Unlock()
+			if err != nil {
+				return activeSince, fmt.Errorf("remove sandbox lock %s: %s", sandboxDir, err)
+			}
+			continue
+		}
+		var size int64
+		if err == nil {
+			size, err = dirSize(sandboxDir)
+		}
+		if err == nil && !dryRun {
+			err = os.RemoveAll(sandboxDir)
+			if err == nil {
+				err = os.Remove(sandboxDir + _sandboxLockSuffix)
+			}
+		}
+		lock.Unlock()
+		if err != nil {
+			return activeSince, fmt.Errorf("remove sandbox %s: %s", sandboxDir, err)
+		}
+		report.Removed = append(report.Removed, PrunedFile{sandboxDir, size, info.ModTime()})
+		report.Freed += size
+	}
+	return activeSince, nil
+}
+
+// listPruneEntries returns the entries of a store dir. The entries of layer
+// dirs are removed under their blob lock.
+func listPruneEntries(dir string, layers bool) ([]pruneEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read dir %s: %s", dir, err)
+	}
+	var entries []pruneEntry
+	for _, info := range infos {
+		p := filepath.Join(dir, info.Name())
+		size, modTime := info.Size(), info.ModTime()
+		if info.IsDir() {
+			if size, err = dirSize(p); err != nil {
+				return nil, err
+			}
+			// Store files are kept in a dir along with their metadata.
+			if fi, err := os.Stat(filepath.Join(p, base.DefaultDataFileName)); err == nil {
+				modTime = fi.ModTime()
+			}
+		}
+		e := pruneEntry{PrunedFile: PrunedFile{p, size, modTime}}
+		if layers {
+			e.layer = info.Name()
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func removePruneEntry(locks *blobLocks, e pruneEntry) error {
+	if e.layer != "" {
+		unlock, err := locks.lock(e.layer)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := os.RemoveAll(e.Path); err != nil {
+		return fmt.Errorf("remove %s: %s", e.Path, err)
+	}
+	return nil
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("walk %s: %s", dir, err)
+	}
+	return size, nil
+}
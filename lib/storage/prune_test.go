@@ -0,0 +1,94 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	// A sandbox left behind by a killed build.
+	stale, err := NewImageStore(root)
+	require.NoError(err)
+	require.NoError(stale.sandboxLock.Unlock())
+
+	now := time.Now()
+	writeLayer := func(name string, size int, age time.Duration) string {
+		p := filepath.Join(root, layerTarCacheDir, name, "data")
+		require.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(ioutil.WriteFile(p, make([]byte, size), 0644))
+		require.NoError(os.Chtimes(p, now.Add(-age), now.Add(-age)))
+		return filepath.Dir(p)
+	}
+	old := writeLayer("old", 100, 48*time.Hour)
+	older := writeLayer("older", 100, 72*time.Hour)
+	recent := writeLayer("recent", 100, time.Hour)
+	checkpoint := filepath.Join(root, CheckpointsDir, "a.json")
+	require.NoError(os.MkdirAll(filepath.Dir(checkpoint), 0755))
+	require.NoError(ioutil.WriteFile(checkpoint, []byte("{}"), 0644))
+	require.NoError(os.Chtimes(checkpoint, now.Add(-96*time.Hour), now.Add(-96*time.Hour)))
+
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+
+	// Dry runs only report.
+	report, err := Prune(root, PruneOptions{MaxAge: 24 * time.Hour, DryRun: true})
+	require.NoError(err)
+	require.Len(report.Removed, 4)
+	require.Equal(stale.SandboxDir, report.Removed[0].Path)
+	require.Equal(checkpoint, report.Removed[1].Path)
+	require.Equal(older, report.Removed[2].Path)
+	require.Equal(old, report.Removed[3].Path)
+	require.Equal(int64(100), report.Kept)
+	require.True(exists(stale.SandboxDir))
+	require.True(exists(old))
+
+	// The size budget removes the oldest layers first.
+	report, err = Prune(root, PruneOptions{MaxSize: 150})
+	require.NoError(err)
+	require.Len(report.Removed, 4)
+	require.Equal(int64(100), report.Kept)
+	require.False(exists(stale.SandboxDir))
+	require.False(exists(checkpoint))
+	require.False(exists(older))
+	require.False(exists(old))
+	require.True(exists(recent))
+
+	// Files written since a running build started are kept.
+	running, err := NewImageStore(root)
+	require.NoError(err)
+	defer running.CleanupSandbox()
+	fresh := writeLayer("fresh", 100, -time.Hour)
+	report, err = Prune(root, PruneOptions{MaxSize: 1})
+	require.NoError(err)
+	require.Len(report.Removed, 1)
+	require.Equal(recent, report.Removed[0].Path)
+	require.True(exists(fresh))
+	require.True(exists(running.SandboxDir))
+}
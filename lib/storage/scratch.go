@@ -0,0 +1,132 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// _scratchUnknownSize is the room a scratch write of unknown size needs in the
+// scratch dir, since it can't spill over once it started.
+const _scratchUnknownSize = 256 << 20
+
+// scratch is the sandbox of a build in a fast scratch dir, typically a tmpfs,
+// which temp files use as long as they fit in it.
+type scratch struct {
+	dir     string
+	maxSize int64
+	lock    *FileLock
+
+	// mu serializes the choices, so two writes don't both get the last room
+	// of the dir.
+	mu sync.Mutex
+}
+
+// SetScratchDir makes the temp files of the build that fit in dir, up to
+// maxSize bytes in total if maxSize > 0, go to a sandbox under dir instead of
+// the sandbox of the storage dir. The others spill over to the storage dir.
+// Like in the storage dir, the sandboxes left in dir by builds that were
+// killed are removed.
+func (store *ImageStore) SetScratchDir(dir string, maxSize int64) error {
+	if err := CleanupStaleSandboxes(dir); err != nil {
+		return fmt.Errorf("cleanup stale scratch sandboxes: %s", err)
+	}
+	sandboxParent := filepath.Join(dir, "sandbox")
+	if err := os.MkdirAll(sandboxParent, 0755); err != nil {
+		return fmt.Errorf("init scratch parent dir: %s", err)
+	}
+	sandboxDir, lock, err := newSandbox(sandboxParent)
+	if err != nil {
+		return fmt.Errorf("init scratch dir: %s", err)
+	}
+	store.ScratchDir = dir
+	store.scratch = &scratch{dir: sandboxDir, maxSize: maxSize, lock: lock}
+	return nil
+}
+
+// TempDir returns the dir a temp file or dir of size bytes should be created
+// in: the scratch dir if it's set and has room for it, or the sandbox dir.
+// Sizes < 0 are unknown, and need _scratchUnknownSize bytes of room.
+func (store *ImageStore) TempDir(size int64) string {
+	s := store.scratch
+	if s == nil {
+		return store.SandboxDir
+	}
+	if size < 0 {
+		size = _scratchUnknownSize
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, err := s.room()
+	if err != nil {
+		log.Warnf("Failed to check scratch dir space, using storage dir: %s", err)
+		return store.SandboxDir
+	}
+	if size > room {
+		log.Infof("* Spilling %s over to storage dir, %s left in scratch dir",
+			FormatSize(size), FormatSize(room))
+		return store.SandboxDir
+	}
+	return s.dir
+}
+
+// room returns the number of bytes that can still be written to the scratch
+// dir: its free space, capped by what's left of maxSize.
+func (s *scratch) room() (int64, error) {
+	room, err := FreeSpace(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	if s.maxSize <= 0 {
+		return room, nil
+	}
+	var used int64
+	if err := filepath.Walk(s.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Files can be removed while walking.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			used += fi.Size()
+		}
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("walk %s: %s", s.dir, err)
+	}
+	if s.maxSize-used < room {
+		room = s.maxSize - used
+	}
+	if room < 0 {
+		room = 0
+	}
+	return room, nil
+}
+
+// cleanup removes the scratch sandbox.
+func (s *scratch) cleanup() error {
+	defer s.lock.Unlock()
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("remove scratch sandbox %s: %s", s.dir, err)
+	}
+	return os.Remove(s.dir + _sandboxLockSuffix)
+}
@@ -0,0 +1,75 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScratchDir(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	scratchDir, err := ioutil.TempDir("/tmp", "makisu-test-scratch")
+	require.NoError(err)
+	defer os.RemoveAll(scratchDir)
+
+	store, err := NewImageStore(root)
+	require.NoError(err)
+	require.Equal(store.SandboxDir, store.TempDir(1024))
+
+	require.NoError(store.SetScratchDir(scratchDir, 4<<20))
+	require.Equal(scratchDir, store.ScratchDir)
+	hot := store.TempDir(1024)
+	require.Equal(filepath.Join(scratchDir, "sandbox"), filepath.Dir(hot))
+
+	// Writes spill over once the files of the build fill the scratch dir.
+	require.Equal(store.SandboxDir, store.TempDir(4<<20+1))
+	require.NoError(ioutil.WriteFile(filepath.Join(hot, "big"), make([]byte, 1<<20), 0644))
+	require.Equal(hot, store.TempDir(3<<20))
+	require.Equal(store.SandboxDir, store.TempDir(3<<20+1))
+
+	require.NoError(store.CleanupSandbox())
+	_, err = os.Stat(hot)
+	require.True(os.IsNotExist(err))
+}
+
+func TestScratchDirCleanupError(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	scratchDir, err := ioutil.TempDir("/tmp", "makisu-test-scratch")
+	require.NoError(err)
+	defer os.RemoveAll(scratchDir)
+
+	store, err := NewImageStore(root)
+	require.NoError(err)
+	require.NoError(store.SetScratchDir(scratchDir, 0))
+
+	// The storage sandbox is removed even if the scratch one fails to.
+	require.NoError(os.Remove(store.scratch.dir + _sandboxLockSuffix))
+	require.Error(store.CleanupSandbox())
+	_, err = os.Stat(store.SandboxDir)
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,151 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// Phases of a build that write to the storage dir.
+const (
+	SpacePhasePull   = "pull"
+	SpacePhaseCommit = "commit"
+)
+
+// _spaceMargin is kept free on top of the expected size of a write, since the
+// estimates are rough and the storage dir also holds temp files.
+const _spaceMargin = 64 << 20
+
+var _written = struct {
+	sync.Mutex
+	phases map[string]int64
+}{phases: make(map[string]int64)}
+
+// FreeSpace returns the number of bytes available to unprivileged users on the
+// file system of dir.
+func FreeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("statfs %s: %s", dir, err)
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
+
+// CheckFreeSpace returns an error if the file system of dir doesn't have room
+// for need bytes, so builds fail before writing, instead of with ENOSPC half
+// way through a layer. Unknown sizes (need < 0) always pass, and so does a
+// failed statfs, which only logs a warning.
+func CheckFreeSpace(dir string, need int64, action string) error {
+	if need < 0 {
+		return nil
+	}
+	free, err := FreeSpace(dir)
+	if err != nil {
+		log.Warnf("Failed to check free disk space: %s", err)
+		return nil
+	}
+	if need+_spaceMargin > free {
+		return fmt.Errorf("not enough disk space in %s to %s: need ~%s free, have %s",
+			dir, action, FormatSize(need+_spaceMargin), FormatSize(free))
+	}
+	return nil
+}
+
+// AddWritten records n bytes written to the storage dir by the given phase.
+func AddWritten(phase string, n int64) {
+	_written.Lock()
+	defer _written.Unlock()
+	_written.phases[phase] += n
+}
+
+// Written returns the number of bytes written to the storage dir by the given
+// phase so far.
+func Written(phase string) int64 {
+	_written.Lock()
+	defer _written.Unlock()
+	return _written.phases[phase]
+}
+
+// LogSpaceUsage logs the bytes written to the storage dir by each phase, and
+// the space left in dir.
+func LogSpaceUsage(dir string) {
+	_written.Lock()
+	var phases []string
+	var total int64
+	for phase, n := range _written.phases {
+		phases = append(phases, fmt.Sprintf("%s %s", phase, FormatSize(n)))
+		total += n
+	}
+	_written.Unlock()
+	sort.Strings(phases)
+
+	free, err := FreeSpace(dir)
+	if err != nil {
+		log.Warnf("Failed to check free disk space: %s", err)
+		return
+	}
+	log.Infof("* Wrote %s to storage (%s), %s left",
+		FormatSize(total), strings.Join(phases, ", "), FormatSize(free))
+}
+
+// ParseSize parses a size like "512MB" or "1.5G", in powers of 1024. Sizes
+// without unit are in bytes.
+func ParseSize(s string) (int64, error) {
+	units := map[string]float64{
+		"": 1, "B": 1,
+		"K": 1 << 10, "KB": 1 << 10,
+		"M": 1 << 20, "MB": 1 << 20,
+		"G": 1 << 30, "GB": 1 << 30,
+		"T": 1 << 40, "TB": 1 << 40,
+	}
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	i := strings.IndexFunc(upper, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(upper)
+	}
+	unit, ok := units[strings.TrimSpace(upper[i:])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+	n, err := strconv.ParseFloat(upper[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * unit), nil
+}
+
+// FormatSize returns a human readable size, like "1.5GB".
+func FormatSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%s", size, units[i])
+}
@@ -0,0 +1,83 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFreeSpace(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	free, err := FreeSpace(dir)
+	require.NoError(err)
+	require.True(free > 0)
+
+	require.NoError(CheckFreeSpace(dir, 1024, "commit layer"))
+	require.NoError(CheckFreeSpace(dir, -1, "pull layer"))
+
+	err = CheckFreeSpace(dir, free+1, "pull layer")
+	require.Error(err)
+	require.Contains(err.Error(), "to pull layer: need ~")
+
+	// Statfs failures don't fail builds.
+	require.NoError(CheckFreeSpace("/does/not/exist", free+1, "pull layer"))
+}
+
+func TestFormatSize(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("0B", FormatSize(0))
+	require.Equal("1023B", FormatSize(1023))
+	require.Equal("1.5KB", FormatSize(1536))
+	require.Equal("2.0GB", FormatSize(2<<30))
+}
+
+func TestParseSize(t *testing.T) {
+	require := require.New(t)
+
+	for s, expected := range map[string]int64{
+		"100":   100,
+		"100B":  100,
+		"2k":    2048,
+		"1.5GB": 3 << 29,
+		"10 MB": 10 << 20,
+	} {
+		n, err := ParseSize(s)
+		require.NoError(err, s)
+		require.Equal(expected, n, s)
+	}
+	for _, s := range []string{"", "GB", "10XB", "-1"} {
+		_, err := ParseSize(s)
+		require.Error(err, s)
+	}
+}
+
+func TestAddWritten(t *testing.T) {
+	require := require.New(t)
+
+	before := Written(SpacePhasePull)
+	AddWritten(SpacePhasePull, 10)
+	AddWritten(SpacePhasePull, 5)
+	require.Equal(before+15, Written(SpacePhasePull))
+}
@@ -0,0 +1,164 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	transferDownloadsDir = "transfers/downloads"
+	transferUploadsDir   = "transfers/uploads"
+	transferLocksDir     = "transfers/locks"
+)
+
+// UploadState is the progress of a chunked blob upload.
+type UploadState struct {
+	// Location is the URL of the upload session.
+	Location string `json:"location"`
+	// Offset is the number of bytes the registry acknowledged.
+	Offset int64 `json:"offset"`
+}
+
+// TransferStore keeps the state of in-progress blob transfers in the storage
+// dir, instead of the sandbox dir of the build, so that a restarted process
+// can resume them: the content downloaded so far, and the upload sessions.
+// Callers hold the lock of the blob while downloading it, and the lock of the
+// upload while pushing it, so concurrent builds on the same host upload each
+// blob once.
+type TransferStore struct {
+	downloadsDir string
+	uploadsDir   string
+	locks        *blobLocks
+}
+
+// NewTransferStore creates a new TransferStore under rootdir.
+func NewTransferStore(rootdir string) (*TransferStore, error) {
+	s := &TransferStore{
+		downloadsDir: filepath.Join(rootdir, transferDownloadsDir),
+		uploadsDir:   filepath.Join(rootdir, transferUploadsDir),
+	}
+	for _, dir := range []string{s.downloadsDir, s.uploadsDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("create transfer dir %s: %s", dir, err)
+		}
+	}
+	locks, err := newBlobLocks(filepath.Join(rootdir, transferLocksDir))
+	if err != nil {
+		return nil, err
+	}
+	s.locks = locks
+	return s, nil
+}
+
+// OpenPartialDownload opens the file holding the content of blob downloaded
+// so far for appending, creating it if needed, and returns its size.
+func (s *TransferStore) OpenPartialDownload(blob string) (*os.File, int64, error) {
+	f, err := os.OpenFile(s.PartialDownloadPath(blob), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// PartialDownloadPath returns the path of the partial download of blob.
+func (s *TransferStore) PartialDownloadPath(blob string) string {
+	return filepath.Join(s.downloadsDir, blob)
+}
+
+// RemovePartialDownload removes the partial download of blob, if any.
+func (s *TransferStore) RemovePartialDownload(blob string) error {
+	if err := os.Remove(s.PartialDownloadPath(blob)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// GetUpload returns the state of the upload with the given key, or nil if
+// there is none.
+func (s *TransferStore) GetUpload(key string) (*UploadState, error) {
+	data, err := ioutil.ReadFile(s.uploadPath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state UploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("unmarshal upload state: %s", err)
+	}
+	return &state, nil
+}
+
+// SaveUpload saves the state of the upload with the given key. The state is
+// replaced atomically, so a process killed while saving it leaves the
+// previous one.
+func (s *TransferStore) SaveUpload(key string, state UploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal upload state: %s", err)
+	}
+	f, err := ioutil.TempFile(s.uploadsDir, ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.uploadPath(key))
+}
+
+// RemoveUpload removes the state of the upload with the given key, if any.
+func (s *TransferStore) RemoveUpload(key string) error {
+	if err := os.Remove(s.uploadPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// LockUpload blocks until no other build or goroutine holds the lock of the
+// upload with the given key, and returns a function releasing it. It also
+// reports whether it waited for another holder, which may have completed the
+// upload in the meantime.
+func (s *TransferStore) LockUpload(key string) (func(), bool, error) {
+	return s.locks.lockWaited(hashKey(key))
+}
+
+// uploadPath returns the path of the state of an upload. Keys are hashed,
+// since they contain registry and repository names.
+func (s *TransferStore) uploadPath(key string) string {
+	return filepath.Join(s.uploadsDir, hashKey(key))
+}
+
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,124 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferStorePartialDownload(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	s, err := NewTransferStore(root)
+	require.NoError(err)
+
+	f, offset, err := s.OpenPartialDownload("blob")
+	require.NoError(err)
+	require.Equal(int64(0), offset)
+	_, err = f.Write([]byte("abc"))
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	// A restarted process appends to the content downloaded so far.
+	s, err = NewTransferStore(root)
+	require.NoError(err)
+	f, offset, err = s.OpenPartialDownload("blob")
+	require.NoError(err)
+	require.Equal(int64(3), offset)
+	_, err = f.Write([]byte("def"))
+	require.NoError(err)
+	require.NoError(f.Close())
+	content, err := ioutil.ReadFile(s.PartialDownloadPath("blob"))
+	require.NoError(err)
+	require.Equal("abcdef", string(content))
+
+	require.NoError(s.RemovePartialDownload("blob"))
+	require.NoError(s.RemovePartialDownload("blob"))
+	_, err = os.Stat(s.PartialDownloadPath("blob"))
+	require.True(os.IsNotExist(err))
+}
+
+func TestTransferStoreUpload(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	s, err := NewTransferStore(root)
+	require.NoError(err)
+
+	key := "registry.example.com/app@sha256:abc"
+	state, err := s.GetUpload(key)
+	require.NoError(err)
+	require.Nil(state)
+
+	require.NoError(s.SaveUpload(key, UploadState{Location: "/v2/app/blobs/uploads/1", Offset: 10}))
+	require.NoError(s.SaveUpload(key, UploadState{Location: "/v2/app/blobs/uploads/2", Offset: 20}))
+	state, err = s.GetUpload(key)
+	require.NoError(err)
+	require.Equal(&UploadState{Location: "/v2/app/blobs/uploads/2", Offset: 20}, state)
+
+	infos, err := ioutil.ReadDir(s.uploadsDir)
+	require.NoError(err)
+	require.Len(infos, 1)
+
+	require.NoError(s.RemoveUpload(key))
+	require.NoError(s.RemoveUpload(key))
+	state, err = s.GetUpload(key)
+	require.NoError(err)
+	require.Nil(state)
+}
+
+func TestTransferStoreLockUpload(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+	s, err := NewTransferStore(root)
+	require.NoError(err)
+	other, err := NewTransferStore(root)
+	require.NoError(err)
+
+	key := "registry.example.com/app@sha256:abc"
+	unlock, waited, err := s.LockUpload(key)
+	require.NoError(err)
+	require.False(waited)
+
+	// A build with another store in the same storage dir waits for the lock.
+	done := make(chan bool)
+	go func() {
+		unlock, waited, err := other.LockUpload(key)
+		require.NoError(err)
+		unlock()
+		done <- waited
+	}()
+	time.Sleep(100 * time.Millisecond)
+	unlock()
+	require.True(<-done)
+
+	unlock, waited, err = s.LockUpload(key)
+	require.NoError(err)
+	require.False(waited)
+	unlock()
+}
@@ -16,12 +16,17 @@ package tario
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"os"
+
+	"github.com/uber/makisu/lib/log"
 )
 
-// ApplyHeader updates file owner, mtime, and permission bits according to
-// header.
+var errXattrNotSupported = errors.New("xattrs not supported")
+
+// ApplyHeader updates file owner, mtime, permission bits and extended
+// attributes according to header.
 // It doesn't change size or type (i.e file to dir).
 func ApplyHeader(path string, header *tar.Header) error {
 	fi, err := os.Lstat(path)
@@ -41,6 +46,15 @@ func ApplyHeader(path string, header *tar.Header) error {
 	if err := os.Chmod(path, header.FileInfo().Mode()); err != nil {
 		return fmt.Errorf("chmod %s: %s", path, err)
 	}
+	// Note: Xattrs need to be set after chown too, since it clears
+	// security.capability.
+	for name, value := range HeaderXattrs(header) {
+		if err := setXattr(path, name, value); err == errXattrNotSupported {
+			log.Warnf("Dropping xattr %s of %s: %s", name, path, err)
+		} else if err != nil {
+			return fmt.Errorf("set xattr %s of %s: %s", name, path, err)
+		}
+	}
 	mtime := header.FileInfo().ModTime()
 	if err := os.Chtimes(path, mtime, mtime); err != nil {
 		return fmt.Errorf("chtimes %s: %s", path, err)
@@ -0,0 +1,104 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	// _tarMagic is at offset 257 of the first header, in ustar and GNU tars.
+	_tarMagic       = []byte("ustar")
+	_tarMagicOffset = 257
+)
+
+// archiveReader is a tar archive read through its decompressor.
+type archiveReader struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// NewArchiveReader returns a reader of the tar archive in r, decompressed if
+// it is compressed with gzip, zstd, bzip2 or xz, and false if r is not a tar
+// archive. Archives are recognized by their content, not their name, like
+// docker does for ADD.
+func NewArchiveReader(r io.Reader) (io.ReadCloser, bool, error) {
+	br := bufio.NewReader(r)
+	format, err := detectCompression(br)
+	if err != nil {
+		return nil, false, err
+	}
+	content := ioutil.NopCloser(br)
+	if format != CompressionNone {
+		content, err = newDecompressReader(format, br)
+		if err != nil {
+			return nil, false, nil
+		}
+	}
+
+	// Compressed files that aren't tars, or not valid, are not archives.
+	tr := bufio.NewReaderSize(content, _tarMagicOffset+len(_tarMagic))
+	header, err := tr.Peek(_tarMagicOffset + len(_tarMagic))
+	if err != nil || !bytes.Equal(header[_tarMagicOffset:], _tarMagic) {
+		content.Close()
+		return nil, false, nil
+	}
+	return archiveReader{tr, content}, true, nil
+}
+
+// IsArchive returns true if the file at path is a tar archive, possibly
+// compressed, that NewArchiveReader can read.
+func IsArchive(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r, ok, err := NewArchiveReader(f)
+	if ok {
+		r.Close()
+	}
+	return ok, err
+}
+
+// ExtractArchive extracts the tar archive, possibly compressed, at path into
+// dir, with the owners of its entries. Entries named like whiteouts are
+// skipped: extracted archives are merged with the files already there, and
+// never delete any.
+func ExtractArchive(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open archive: %s", err)
+	}
+	defer f.Close()
+	r, ok, err := NewArchiveReader(f)
+	if err != nil {
+		return fmt.Errorf("read archive %s: %s", path, err)
+	} else if !ok {
+		return fmt.Errorf("%s is not a tar archive", path)
+	}
+	defer r.Close()
+	if err := untar(r, dir, untarOptions{skipWhiteouts: true, chown: true}); err != nil {
+		return fmt.Errorf("extract %s: %s", path, err)
+	}
+	// Drain the padding of the archive, so that compressed ones are verified.
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
@@ -0,0 +1,129 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// _bzip2Archive is a tar with a file "a" containing "foo", compressed with
+// bzip2, which the standard library can't write.
+var _bzip2Archive = []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xf8\x3f\x89\x79\x00\x00" +
+	"\x6c\xfb\x80\xc9\x80\x00\x00\xc0\x00\x6d\x00\x00\x00\xe1\x00\x9e\x00\x08\x08\x20" +
+	"\x00\x54\x46\xa3\x40\x03\x43\x4d\x04\x51\x40\xd0\x7a\x80\x1f\x6f\x62\x51\x0e\x6f" +
+	"\x44\x4d\x3a\xab\x15\xae\x79\x20\x90\x10\x54\x8c\xc0\x9c\x4a\x54\xc9\x35\x67\x9c" +
+	"\x42\x2b\x22\xf5\x99\xaa\x00\x22\xf8\xbb\x92\x29\xc2\x84\x87\xc1\xfc\x4b\xc8")
+
+func writeTestArchive(t *testing.T, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	cw, err := newWriter(&buf)
+	require.NoError(err)
+	w := tar.NewWriter(cw)
+	for _, name := range []string{"a", ".wh.b"} {
+		require.NoError(w.WriteHeader(&tar.Header{
+			Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 3,
+			Uid: os.Getuid(), Gid: os.Getgid()}))
+		_, err = w.Write([]byte("foo"))
+		require.NoError(err)
+	}
+	require.NoError(w.Close())
+	require.NoError(cw.Close())
+	return buf.Bytes()
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestNewArchiveReader(t *testing.T) {
+	plain := func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }
+	for name, content := range map[string][]byte{
+		"tar":     writeTestArchive(t, plain),
+		"tar.gz":  writeTestArchive(t, NewGzipWriter),
+		"tar.zst": writeTestArchive(t, NewZstdWriter),
+		"tar.bz2": _bzip2Archive,
+	} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			r, ok, err := NewArchiveReader(bytes.NewReader(content))
+			require.NoError(err)
+			require.True(ok)
+			defer r.Close()
+			hdr, err := tar.NewReader(r).Next()
+			require.NoError(err)
+			require.Equal("a", hdr.Name)
+		})
+	}
+
+	t.Run("NotArchive", func(t *testing.T) {
+		require := require.New(t)
+		for _, content := range [][]byte{
+			nil, []byte("foo"), _gzipMagic, make([]byte, 1024),
+		} {
+			_, ok, err := NewArchiveReader(bytes.NewReader(content))
+			require.NoError(err)
+			require.False(ok)
+		}
+	})
+
+	t.Run("tar.xz", func(t *testing.T) {
+		require := require.New(t)
+		plain := func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }
+		content := xzCompress(t, writeTestArchive(t, plain))
+		r, ok, err := NewArchiveReader(bytes.NewReader(content))
+		require.NoError(err)
+		require.True(ok)
+		defer r.Close()
+		hdr, err := tar.NewReader(r).Next()
+		require.NoError(err)
+		require.Equal("a", hdr.Name)
+	})
+}
+
+func TestExtractArchive(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "archive.tar.gz")
+	require.NoError(ioutil.WriteFile(archive, writeTestArchive(t, NewGzipWriter), 0644))
+	ok, err := IsArchive(archive)
+	require.NoError(err)
+	require.True(ok)
+
+	target := filepath.Join(dir, "target")
+	require.NoError(os.Mkdir(target, 0755))
+	require.NoError(ExtractArchive(archive, target))
+	content, err := ioutil.ReadFile(filepath.Join(target, "a"))
+	require.NoError(err)
+	require.Equal("foo", string(content))
+	// Whiteouts are not extracted.
+	_, err = os.Lstat(filepath.Join(target, ".wh.b"))
+	require.True(os.IsNotExist(err))
+
+	require.Error(ExtractArchive(filepath.Join(target, "a"), target))
+}
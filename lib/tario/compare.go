@@ -27,6 +27,10 @@ func IsSimilarHeader(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, erro
 		return true, nil
 	}
 
+	if h.Typeflag != tar.TypeSymlink && !isSimilarXattrs(h, nh) {
+		return false, nil
+	}
+
 	switch h.Typeflag {
 	case tar.TypeSymlink:
 		if nh.Typeflag != tar.TypeSymlink {
@@ -34,7 +38,9 @@ func IsSimilarHeader(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, erro
 		}
 		return isSimilarSymlink(h, nh)
 	case tar.TypeLink:
-		if nh.Typeflag != tar.TypeLink {
+		// A hard link describes the same inode as the regular file it was
+		// found as on disk.
+		if nh.Typeflag != tar.TypeLink && !isRegularFile(nh) {
 			return false, nil
 		}
 		return isSimilarHardLink(h, nh, ignoreTime)
@@ -43,16 +49,26 @@ func IsSimilarHeader(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, erro
 			return false, nil
 		}
 		return isSimilarDirectory(h, nh, ignoreTime)
-	case tar.TypeReg, tar.TypeRegA:
-		if nh.Typeflag != tar.TypeReg && nh.Typeflag != tar.TypeRegA {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		if !isRegularFile(nh) {
 			return false, nil
 		}
 		return isSimilarRegularFile(h, nh, ignoreTime)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if nh.Typeflag != h.Typeflag {
+			return false, nil
+		}
+		return isSimilarDevice(h, nh, ignoreTime)
 	default:
 		return false, fmt.Errorf("unsupported type %b", h.Typeflag)
 	}
 }
 
+func isRegularFile(h *tar.Header) bool {
+	return h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA ||
+		h.Typeflag == tar.TypeGNUSparse
+}
+
 // isSimilarSymlink returns if the given headers are describing similar
 // symlinks. It only checks mtime and link target.
 func isSimilarSymlink(h *tar.Header, nh *tar.Header) (bool, error) {
@@ -60,7 +76,8 @@ func isSimilarSymlink(h *tar.Header, nh *tar.Header) (bool, error) {
 }
 
 // isSimilarHardLink returns if the given headers are describing similar hard
-// links. It only checks mtime and link target.
+// links. It only checks mtime, owner and link target, which is ignored if nh
+// is a regular file.
 func isSimilarHardLink(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, error) {
 	timeIsEqual := true
 	if !ignoreTime {
@@ -70,7 +87,7 @@ func isSimilarHardLink(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, er
 	}
 
 	if timeIsEqual &&
-		h.Linkname == nh.Linkname &&
+		(h.Linkname == nh.Linkname || nh.Typeflag != tar.TypeLink) &&
 		h.Uid == nh.Uid &&
 		h.Gid == nh.Gid &&
 		h.FileInfo().Mode() == nh.FileInfo().Mode() {
@@ -118,3 +135,24 @@ func isSimilarRegularFile(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool,
 	}
 	return false, nil
 }
+
+// isSimilarDevice returns if the given headers are describing similar device
+// nodes or named pipes. It only checks mtime, owner and device numbers.
+func isSimilarDevice(h *tar.Header, nh *tar.Header, ignoreTime bool) (bool, error) {
+	timeIsEqual := true
+	if !ignoreTime {
+		hMtime := h.ModTime.Truncate(1 * time.Second)
+		nhMtime := nh.ModTime.Truncate(1 * time.Second)
+		timeIsEqual = hMtime.Equal(nhMtime)
+	}
+
+	if timeIsEqual &&
+		h.Uid == nh.Uid &&
+		h.Gid == nh.Gid &&
+		h.Devmajor == nh.Devmajor &&
+		h.Devminor == nh.Devminor &&
+		h.FileInfo().Mode() == nh.FileInfo().Mode() {
+		return true, nil
+	}
+	return false, nil
+}
@@ -744,3 +744,61 @@ func TestIsSimilarRegularFile(t *testing.T) {
 		require.NoError(err)
 	})
 }
+
+func TestIsSimilarDevice(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	h := &tar.Header{
+		Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, ModTime: now, Devmajor: 1, Devminor: 3}
+
+	same := *h
+	similar, err := IsSimilarHeader(h, &same, false)
+	require.NoError(err)
+	require.True(similar)
+
+	other := *h
+	other.Devminor = 5
+	similar, err = IsSimilarHeader(h, &other, false)
+	require.NoError(err)
+	require.False(similar)
+
+	block := *h
+	block.Typeflag = tar.TypeBlock
+	similar, err = IsSimilarHeader(h, &block, false)
+	require.NoError(err)
+	require.False(similar)
+}
+
+func TestIsSimilarXattrs(t *testing.T) {
+	require := require.New(t)
+
+	h := &tar.Header{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0755, Size: 1,
+		PAXRecords: map[string]string{XattrPAXPrefix + "security.capability": "cap"}}
+
+	same := *h
+	similar, err := IsSimilarHeader(h, &same, false)
+	require.NoError(err)
+	require.True(similar)
+
+	stripped := *h
+	stripped.PAXRecords = nil
+	similar, err = IsSimilarHeader(h, &stripped, false)
+	require.NoError(err)
+	require.False(similar)
+}
+
+func TestIsSimilarHardlinkToRegularFile(t *testing.T) {
+	require := require.New(t)
+
+	h := &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "target", Mode: 0644}
+	file := &tar.Header{Name: "link", Typeflag: tar.TypeReg, Mode: 0644, Size: 10}
+	similar, err := IsSimilarHeader(h, file, false)
+	require.NoError(err)
+	require.True(similar)
+
+	file.Mode = 0600
+	similar, err = IsSimilarHeader(h, file, false)
+	require.NoError(err)
+	require.False(similar)
+}
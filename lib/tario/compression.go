@@ -0,0 +1,125 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// Compression formats of image layers.
+const (
+	CompressionGzip    = "gzip"
+	CompressionZstd    = "zstd"
+	CompressionEstargz = "estargz"
+	CompressionBzip2   = "bzip2"
+	CompressionXz      = "xz"
+	CompressionNone    = "none"
+)
+
+// CompressionFormat is the compression format of generated image layers.
+// Default is gzip.
+var CompressionFormat = CompressionGzip
+
+var (
+	_gzipMagic  = []byte{0x1f, 0x8b}
+	_zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	_bzip2Magic = []byte("BZh")
+	_xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// NewCompressWriter returns a new writer that compresses with the configured
+// CompressionFormat. eStargz layers need the tar entries and are created by
+// WriteEstargz instead, so this falls back to plain gzip for them.
+func NewCompressWriter(w io.Writer) (io.WriteCloser, error) {
+	if CompressionFormat == CompressionZstd {
+		return NewZstdWriter(w)
+	}
+	return NewGzipWriter(w)
+}
+
+// NewDecompressReader returns a new reader that decompresses gzip, zstd, bzip2
+// or xz content, based on its magic number. bzip2 and xz are only read, some
+// base images have such layers.
+func NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	format, err := DetectCompression(br)
+	if err != nil {
+		return nil, err
+	}
+	return newDecompressReader(format, br)
+}
+
+// newDecompressReader returns a new reader that decompresses content of the
+// given format.
+func newDecompressReader(format string, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case CompressionZstd:
+		return NewZstdReader(r)
+	case CompressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case CompressionXz:
+		return NewXzReader(r)
+	}
+	return NewGzipReader(r)
+}
+
+// DetectCompression returns the compression format of the content of r, based
+// on its magic number. Content that is not zstd, bzip2 or xz is assumed to be
+// gzip.
+func DetectCompression(r *bufio.Reader) (string, error) {
+	format, err := detectCompression(r)
+	if err != nil {
+		return "", err
+	} else if format == CompressionNone {
+		return CompressionGzip, nil
+	}
+	return format, nil
+}
+
+// detectCompression returns the compression format of the content of r, based
+// on its magic number, or CompressionNone.
+func detectCompression(r *bufio.Reader) (string, error) {
+	magic, err := r.Peek(len(_xzMagic))
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("peek magic number: %s", err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, _gzipMagic):
+		return CompressionGzip, nil
+	case bytes.HasPrefix(magic, _zstdMagic):
+		return CompressionZstd, nil
+	case bytes.HasPrefix(magic, _bzip2Magic):
+		return CompressionBzip2, nil
+	case bytes.HasPrefix(magic, _xzMagic):
+		return CompressionXz, nil
+	}
+	return CompressionNone, nil
+}
+
+// LayerMediaType returns the media type of layers compressed with the given
+// format.
+func LayerMediaType(format string) string {
+	if format == CompressionZstd {
+		return image.MediaTypeLayerZstd
+	}
+	return image.MediaTypeLayer
+}
@@ -0,0 +1,136 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/uber/makisu/lib/docker/image"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+func TestSetCompressionLevelZstd(t *testing.T) {
+	require := require.New(t)
+	defer SetCompressionLevel("default")
+
+	require.NoError(SetCompressionLevel("zstd"))
+	require.Equal(CompressionZstd, CompressionFormat)
+	require.Equal(zstd.SpeedDefault, ZstdCompressionLevel)
+
+	require.NoError(SetCompressionLevel("zstd:1"))
+	require.Equal(zstd.SpeedFastest, ZstdCompressionLevel)
+
+	require.Error(SetCompressionLevel("zstd:0"))
+	require.Error(SetCompressionLevel("zstd:abc"))
+	require.Error(SetCompressionLevel("zstdx"))
+
+	require.NoError(SetCompressionLevel("speed"))
+	require.Equal(CompressionGzip, CompressionFormat)
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, level := range []string{"default", "zstd"} {
+		t.Run(level, func(t *testing.T) {
+			require := require.New(t)
+			defer SetCompressionLevel("default")
+			require.NoError(SetCompressionLevel(level))
+
+			content := bytes.Repeat([]byte("makisu"), 1000)
+			var buf bytes.Buffer
+			w, err := NewCompressWriter(&buf)
+			require.NoError(err)
+			_, err = w.Write(content)
+			require.NoError(err)
+			require.NoError(w.Close())
+
+			format, err := DetectCompression(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+			require.NoError(err)
+			require.Equal(CompressionFormat, format)
+
+			r, err := NewDecompressReader(&buf)
+			require.NoError(err)
+			defer r.Close()
+			result, err := ioutil.ReadAll(r)
+			require.NoError(err)
+			require.Equal(content, result)
+		})
+	}
+}
+
+// xzCompress compresses content with xz, which makisu only reads.
+func xzCompress(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDecompressReadOnlyFormats(t *testing.T) {
+	t.Run("bzip2", func(t *testing.T) {
+		require := require.New(t)
+		r, err := NewDecompressReader(bytes.NewReader(_bzip2Archive))
+		require.NoError(err)
+		defer r.Close()
+		result, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		require.Len(result, 10240)
+	})
+
+	t.Run("xz", func(t *testing.T) {
+		require := require.New(t)
+		content := bytes.Repeat([]byte("makisu"), 1000)
+		compressed := xzCompress(t, content)
+		format, err := DetectCompression(bufio.NewReader(bytes.NewReader(compressed)))
+		require.NoError(err)
+		require.Equal(CompressionXz, format)
+
+		r, err := NewDecompressReader(bytes.NewReader(compressed))
+		require.NoError(err)
+		defer r.Close()
+		result, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		require.Equal(content, result)
+
+		// Corrupt content fails at the end.
+		r, err = NewDecompressReader(bytes.NewReader(compressed[:len(compressed)-8]))
+		require.NoError(err)
+		defer r.Close()
+		_, err = ioutil.ReadAll(r)
+		require.Error(err)
+
+		// Content doesn't have to be read until the end.
+		r, err = NewDecompressReader(bytes.NewReader(compressed))
+		require.NoError(err)
+		_, err = r.Read(make([]byte, 10))
+		require.NoError(err)
+		require.NoError(r.Close())
+	})
+}
+
+func TestLayerMediaType(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(image.MediaTypeLayer, LayerMediaType(CompressionGzip))
+	require.Equal(image.MediaTypeLayerZstd, LayerMediaType(CompressionZstd))
+}
@@ -0,0 +1,358 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/docker/image"
+)
+
+// eStargz layers are gzip compatible tarballs, in which every file chunk
+// starts a new gzip member, followed by a table of contents (TOC) listing the
+// compressed offset of each chunk, and a footer pointing at the TOC. Lazy
+// pulling runtimes like stargz-snapshotter use them to fetch files on demand.
+// See https://github.com/containerd/stargz-snapshotter/blob/main/docs/estargz.md.
+const (
+	// EstargzTOCName is the name of the tar entry holding the TOC.
+	EstargzTOCName = "stargz.index.json"
+
+	// EstargzTOCDigestAnnotation is the layer descriptor annotation holding
+	// the digest of the TOC.
+	EstargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// EstargzUncompressedSizeAnnotation is the layer descriptor annotation
+	// holding the size of the uncompressed layer.
+	EstargzUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+
+	_estargzFooterSize         = 51
+	_estargzNoPrefetchLandmark = ".no.prefetch.landmark"
+	_estargzLandmarkContents   = 0xf
+)
+
+// EstargzChunkSize is the maximum size of file chunks in eStargz layers.
+var EstargzChunkSize int64 = 4 << 20
+
+type estargzTOC struct {
+	Version int                `json:"version"`
+	Entries []*estargzTOCEntry `json:"entries"`
+}
+
+type estargzTOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// estargzWriter compresses everything written to it into the current gzip
+// member, opening a new one if needed, and copies the uncompressed content to
+// diff.
+type estargzWriter struct {
+	out      *countingWriter
+	diff     io.Writer
+	diffSize int64
+	gz       *gzip.Writer
+	tw       *tar.Writer
+}
+
+func (w *estargzWriter) Write(p []byte) (int, error) {
+	if w.gz == nil {
+		gz, err := gzip.NewWriterLevel(w.out, CompressionLevel)
+		if err != nil {
+			return 0, fmt.Errorf("new gzip writer: %s", err)
+		}
+		gz.Header.OS = gzipHeaderOS()
+		w.gz = gz
+	}
+	n, err := w.gz.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := w.diff.Write(p[:n]); err != nil {
+		return n, err
+	}
+	w.diffSize += int64(n)
+	return n, nil
+}
+
+// closeGz ends the current gzip member, if any.
+func (w *estargzWriter) closeGz() error {
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz = nil
+	return err
+}
+
+// writeEntry writes a tar entry, starting a new gzip member for each chunk of
+// its content, and appends the corresponding TOC entries to toc.
+func (w *estargzWriter) writeEntry(toc *estargzTOC, hdr *tar.Header, r io.Reader) error {
+	entry, err := newEstargzTOCEntry(hdr)
+	if err != nil {
+		return err
+	}
+	toc.Entries = append(toc.Entries, entry)
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write header %s: %s", hdr.Name, err)
+	}
+	if entry.Type != "reg" {
+		return nil
+	}
+
+	fileDigester := sha256.New()
+	chunk := entry
+	for written := int64(0); written < hdr.Size; {
+		if err := w.closeGz(); err != nil {
+			return fmt.Errorf("close gzip member: %s", err)
+		}
+		size := hdr.Size - written
+		if size > EstargzChunkSize {
+			size = EstargzChunkSize
+		}
+		if written > 0 {
+			chunk = &estargzTOCEntry{Name: entry.Name, Type: "chunk"}
+			toc.Entries = append(toc.Entries, chunk)
+		}
+		chunk.Offset = w.out.n
+		chunk.ChunkOffset = written
+		chunk.ChunkSize = size
+
+		chunkDigester := sha256.New()
+		tee := io.TeeReader(r, io.MultiWriter(chunkDigester, fileDigester))
+		if _, err := io.CopyN(w.tw, tee, size); err != nil {
+			return fmt.Errorf("write content %s: %s", hdr.Name, err)
+		}
+		chunk.ChunkDigest = "sha256:" + hex.EncodeToString(chunkDigester.Sum(nil))
+		written += size
+	}
+	entry.Digest = "sha256:" + hex.EncodeToString(fileDigester.Sum(nil))
+	return nil
+}
+
+func newEstargzTOCEntry(hdr *tar.Header) (*estargzTOCEntry, error) {
+	entry := &estargzTOCEntry{
+		Name:     path.Clean(strings.TrimLeft(hdr.Name, "/")),
+		Mode:     hdr.Mode,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		LinkName: hdr.Linkname,
+	}
+	if !hdr.ModTime.IsZero() {
+		entry.ModTime = hdr.ModTime.UTC().Format(time.RFC3339)
+	}
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, XattrPAXPrefix) {
+			if entry.Xattrs == nil {
+				entry.Xattrs = make(map[string][]byte)
+			}
+			entry.Xattrs[strings.TrimPrefix(k, XattrPAXPrefix)] = []byte(v)
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		entry.Type = "reg"
+		entry.Size = hdr.Size
+	case tar.TypeLink:
+		entry.Type = "hardlink"
+	case tar.TypeSymlink:
+		entry.Type = "symlink"
+	case tar.TypeDir:
+		entry.Type = "dir"
+	case tar.TypeChar:
+		entry.Type = "char"
+		entry.DevMajor, entry.DevMinor = hdr.Devmajor, hdr.Devminor
+	case tar.TypeBlock:
+		entry.Type = "block"
+		entry.DevMajor, entry.DevMinor = hdr.Devmajor, hdr.Devminor
+	case tar.TypeFifo:
+		entry.Type = "fifo"
+	default:
+		return nil, fmt.Errorf("unsupported tar entry type %q for %s", hdr.Typeflag, hdr.Name)
+	}
+	return entry, nil
+}
+
+// WriteEstargz converts the tarball read from r to an eStargz layer written to
+// w. The uncompressed content of the layer, which differs from the input
+// tarball by the landmark and TOC entries, is written to diff to compute the
+// diff ID. Returns the annotations of the layer descriptor.
+func WriteEstargz(r *tar.Reader, w, diff io.Writer) (map[string]string, error) {
+	ew := &estargzWriter{out: &countingWriter{w: w}, diff: diff}
+	ew.tw = tar.NewWriter(ew)
+	toc := &estargzTOC{Version: 1}
+
+	// No file is prioritized, which is signaled to lazy pullers by a landmark
+	// as the first entry.
+	landmark := &tar.Header{
+		Name:     _estargzNoPrefetchLandmark,
+		Typeflag: tar.TypeReg,
+		Mode:     0444,
+		Size:     1,
+	}
+	landmarkContents := bytes.NewReader([]byte{_estargzLandmarkContents})
+	if err := ew.writeEntry(toc, landmark, landmarkContents); err != nil {
+		return nil, fmt.Errorf("write landmark: %s", err)
+	}
+
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read header: %s", err)
+		}
+		if err := ew.writeEntry(toc, hdr, r); err != nil {
+			return nil, err
+		}
+	}
+
+	// The TOC and the end of the tarball share the last gzip member.
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return nil, fmt.Errorf("marshal toc: %s", err)
+	}
+	if err := ew.closeGz(); err != nil {
+		return nil, fmt.Errorf("close gzip member: %s", err)
+	}
+	tocOffset := ew.out.n
+	if err := ew.tw.WriteHeader(&tar.Header{
+		Name:     EstargzTOCName,
+		Typeflag: tar.TypeReg,
+		Mode:     0444,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return nil, fmt.Errorf("write toc header: %s", err)
+	}
+	if _, err := ew.tw.Write(tocJSON); err != nil {
+		return nil, fmt.Errorf("write toc: %s", err)
+	}
+	if err := ew.tw.Close(); err != nil {
+		return nil, fmt.Errorf("close tar writer: %s", err)
+	}
+	if err := ew.closeGz(); err != nil {
+		return nil, fmt.Errorf("close gzip member: %s", err)
+	}
+	if _, err := ew.out.Write(estargzFooter(tocOffset)); err != nil {
+		return nil, fmt.Errorf("write footer: %s", err)
+	}
+
+	tocDigest := sha256.Sum256(tocJSON)
+	return map[string]string{
+		EstargzTOCDigestAnnotation:        "sha256:" + hex.EncodeToString(tocDigest[:]),
+		EstargzUncompressedSizeAnnotation: strconv.FormatInt(ew.diffSize, 10),
+	}, nil
+}
+
+// estargzFooter returns an empty gzip member whose extra field points at the
+// offset of the TOC. It is built by hand since its size must be exactly
+// _estargzFooterSize, which depends on how the empty deflate stream is encoded.
+func estargzFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	footer := make([]byte, 0, _estargzFooterSize)
+	// Gzip header with the FEXTRA flag, zero mtime and unknown OS.
+	footer = append(footer, 0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff)
+	footer = append(footer, byte(len(subfield)+4), 0)
+	footer = append(footer, 'S', 'G', byte(len(subfield)), 0)
+	footer = append(footer, subfield...)
+	// Final empty stored deflate block, then CRC32 and size of empty content.
+	footer = append(footer, 0x01, 0x00, 0x00, 0xff, 0xff)
+	footer = append(footer, 0, 0, 0, 0, 0, 0, 0, 0)
+	return footer
+}
+
+// EstargzTOCDigest returns the digest of the TOC of the eStargz layer of the
+// given size read from r, or an empty digest if the layer is not eStargz.
+func EstargzTOCDigest(r io.ReaderAt, size int64) (image.Digest, error) {
+	if size < _estargzFooterSize {
+		return "", nil
+	}
+	footer := make([]byte, _estargzFooterSize)
+	if _, err := r.ReadAt(footer, size-_estargzFooterSize); err != nil {
+		return "", fmt.Errorf("read footer: %s", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		return "", nil
+	}
+	extra := gz.Header.Extra
+	if len(extra) != 26 || extra[0] != 'S' || extra[1] != 'G' ||
+		!bytes.HasSuffix(extra, []byte("STARGZ")) {
+		return "", nil
+	}
+	tocOffset, err := strconv.ParseInt(string(extra[4:20]), 16, 64)
+	if err != nil || tocOffset >= size {
+		return "", nil
+	}
+
+	tocGz, err := gzip.NewReader(io.NewSectionReader(r, tocOffset, size-tocOffset))
+	if err != nil {
+		return "", fmt.Errorf("open toc: %s", err)
+	}
+	tr := tar.NewReader(tocGz)
+	hdr, err := tr.Next()
+	if err != nil {
+		return "", fmt.Errorf("read toc header: %s", err)
+	} else if hdr.Name != EstargzTOCName {
+		return "", fmt.Errorf("unexpected toc entry %s", hdr.Name)
+	}
+	tocJSON, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return "", fmt.Errorf("read toc: %s", err)
+	}
+	tocDigest := sha256.Sum256(tocJSON)
+	return image.Digest("sha256:" + hex.EncodeToString(tocDigest[:])), nil
+}
@@ -0,0 +1,146 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteEstargz(t *testing.T) {
+	require := require.New(t)
+
+	defer func(size int64) { EstargzChunkSize = size }(EstargzChunkSize)
+	EstargzChunkSize = 16
+
+	small := []byte("hello")
+	big := bytes.Repeat([]byte("0123456789"), 5)
+	var input bytes.Buffer
+	tw := tar.NewWriter(&input)
+	for _, e := range []struct {
+		hdr     *tar.Header
+		content []byte
+	}{
+		{&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}, nil},
+		{&tar.Header{Name: "dir/small", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(small)),
+			PAXRecords: map[string]string{"SCHILY.xattr.user.test": "value"}}, small},
+		{&tar.Header{Name: "dir/big", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(big))}, big},
+		{&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "small"}, nil},
+	} {
+		require.NoError(tw.WriteHeader(e.hdr))
+		_, err := tw.Write(e.content)
+		require.NoError(err)
+	}
+	require.NoError(tw.Close())
+
+	var layer, diff bytes.Buffer
+	annotations, err := WriteEstargz(tar.NewReader(&input), &layer, &diff)
+	require.NoError(err)
+	require.Equal(strconv.Itoa(diff.Len()), annotations[EstargzUncompressedSizeAnnotation])
+
+	// The layer decompresses to the diff as regular gzip.
+	gz, err := NewDecompressReader(bytes.NewReader(layer.Bytes()))
+	require.NoError(err)
+	decompressed, err := ioutil.ReadAll(gz)
+	require.NoError(err)
+	require.Equal(diff.Bytes(), decompressed)
+
+	var names []string
+	var tocJSON []byte
+	tr := tar.NewReader(bytes.NewReader(decompressed))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		names = append(names, hdr.Name)
+		if hdr.Name == EstargzTOCName {
+			tocJSON, err = ioutil.ReadAll(tr)
+			require.NoError(err)
+		}
+	}
+	require.Equal([]string{
+		_estargzNoPrefetchLandmark, "dir/", "dir/small", "dir/big", "dir/link", EstargzTOCName,
+	}, names)
+
+	// The TOC digest can be read back from the footer.
+	tocDigest := sha256.Sum256(tocJSON)
+	require.Equal("sha256:"+hex.EncodeToString(tocDigest[:]), annotations[EstargzTOCDigestAnnotation])
+	digest, err := EstargzTOCDigest(bytes.NewReader(layer.Bytes()), int64(layer.Len()))
+	require.NoError(err)
+	require.Equal(annotations[EstargzTOCDigestAnnotation], string(digest))
+
+	// Each chunk can be read from its own gzip member.
+	var toc estargzTOC
+	require.NoError(json.Unmarshal(tocJSON, &toc))
+	var chunks int
+	for _, entry := range toc.Entries {
+		if entry.Name == "dir/small" {
+			require.Equal([]byte("value"), entry.Xattrs["user.test"])
+		}
+		if entry.Name != "dir/big" || (entry.Type != "reg" && entry.Type != "chunk") {
+			continue
+		}
+		chunks++
+		r, err := gzip.NewReader(bytes.NewReader(layer.Bytes()[entry.Offset:]))
+		require.NoError(err)
+		chunk := make([]byte, entry.ChunkSize)
+		_, err = io.ReadFull(r, chunk)
+		require.NoError(err)
+		require.Equal(big[entry.ChunkOffset:entry.ChunkOffset+entry.ChunkSize], chunk)
+		chunkDigest := sha256.Sum256(chunk)
+		require.Equal("sha256:"+hex.EncodeToString(chunkDigest[:]), entry.ChunkDigest)
+	}
+	require.Equal(4, chunks)
+}
+
+func TestEstargzTOCDigestNotEstargz(t *testing.T) {
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	w, err := NewGzipWriter(&buf)
+	require.NoError(err)
+	_, err = w.Write(bytes.Repeat([]byte("makisu"), 100))
+	require.NoError(err)
+	require.NoError(w.Close())
+
+	digest, err := EstargzTOCDigest(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(err)
+	require.Equal("", string(digest))
+}
+
+func TestEstargzFooter(t *testing.T) {
+	require := require.New(t)
+
+	footer := estargzFooter(0x1234)
+	require.Len(footer, _estargzFooterSize)
+	gz, err := gzip.NewReader(bytes.NewReader(footer))
+	require.NoError(err)
+	require.Equal("SG\x16\x000000000000001234STARGZ", string(gz.Header.Extra))
+	content, err := ioutil.ReadAll(gz)
+	require.NoError(err)
+	require.Empty(content)
+}
@@ -15,8 +15,13 @@
 package tario
 
 import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
 )
 
@@ -25,3 +30,59 @@ func TestSetCompressionLevelFail(t *testing.T) {
 
 	require.Error(SetCompressionLevel("invalid"))
 }
+
+func TestSetNumericCompressionLevel(t *testing.T) {
+	require := require.New(t)
+	defer SetCompressionLevel("default")
+
+	require.NoError(SetNumericCompressionLevel(3))
+	require.Equal(3, CompressionLevel)
+	require.Error(SetNumericCompressionLevel(10))
+
+	require.NoError(SetCompressionLevel("zstd"))
+	require.NoError(SetNumericCompressionLevel(1))
+	require.Equal(zstd.SpeedFastest, ZstdCompressionLevel)
+	require.Error(SetNumericCompressionLevel(23))
+}
+
+func TestSetCompressionThreads(t *testing.T) {
+	require := require.New(t)
+	defer SetCompressionThreads(runtime.NumCPU())
+
+	require.Error(SetCompressionThreads(0))
+	require.NoError(SetCompressionThreads(2))
+	require.Equal(2, CompressionThreads)
+}
+
+// BenchmarkGzipWriter compresses a layer-like mix of text and random data with
+// different levels and thread counts, reporting the compression ratio.
+func BenchmarkGzipWriter(b *testing.B) {
+	content := make([]byte, 32<<20)
+	rand.New(rand.NewSource(0)).Read(content[:len(content)/4])
+	for i := len(content) / 4; i < len(content); i++ {
+		content[i] = "makisu layer\n"[i%13]
+	}
+
+	defer SetCompressionLevel("default")
+	defer SetCompressionThreads(runtime.NumCPU())
+	for _, level := range []string{"speed", "default", "size"} {
+		for _, threads := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("%s/threads=%d", level, threads), func(b *testing.B) {
+				require.NoError(b, SetCompressionLevel(level))
+				require.NoError(b, SetCompressionThreads(threads))
+				b.SetBytes(int64(len(content)))
+				var compressed int
+				for i := 0; i < b.N; i++ {
+					var buf bytes.Buffer
+					w, err := NewGzipWriter(&buf)
+					require.NoError(b, err)
+					_, err = w.Write(content)
+					require.NoError(b, err)
+					require.NoError(b, w.Close())
+					compressed = buf.Len()
+				}
+				b.ReportMetric(float64(len(content))/float64(compressed), "ratio")
+			})
+		}
+	}
+}
@@ -0,0 +1,81 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SourceDateEpoch is the timestamp of all entries of generated layers.
+// If nil (the default), entries keep the timestamps of the files on disk and
+// layers are not reproducible.
+var SourceDateEpoch *time.Time
+
+// SetSourceDateEpoch sets global var SourceDateEpoch from a number of seconds
+// since the unix epoch, following https://reproducible-builds.org/specs/source-date-epoch/.
+// An empty string disables reproducible layers.
+func SetSourceDateEpoch(epochStr string) error {
+	if epochStr == "" {
+		SourceDateEpoch = nil
+		return nil
+	}
+	seconds, err := strconv.ParseInt(epochStr, 10, 64)
+	if err != nil || seconds < 0 {
+		return fmt.Errorf("invalid source date epoch %s", epochStr)
+	}
+	epoch := time.Unix(seconds, 0).UTC()
+	SourceDateEpoch = &epoch
+	return nil
+}
+
+// normalizedHeader returns a copy of h without the fields that depend on the
+// build host or the build time, so identical inputs produce identical layers.
+// h is left untouched, since it may still describe the file on disk. It
+// returns h itself if SourceDateEpoch is not set.
+func normalizedHeader(h *tar.Header) *tar.Header {
+	if SourceDateEpoch == nil {
+		return h
+	}
+	normalized := *h
+	normalized.ModTime = *SourceDateEpoch
+	normalized.AccessTime = time.Time{}
+	normalized.ChangeTime = time.Time{}
+	normalized.Uname = ""
+	normalized.Gname = ""
+	if h.PAXRecords != nil {
+		normalized.PAXRecords = make(map[string]string, len(h.PAXRecords))
+		for key, value := range h.PAXRecords {
+			switch key {
+			case "atime", "ctime", "mtime", "uname", "gname":
+			default:
+				normalized.PAXRecords[key] = value
+			}
+		}
+	}
+	return &normalized
+}
+
+// gzipHeaderOS is the OS field of the gzip headers of generated layers.
+// The gzip writer defaults to 255 (unknown), it is zeroed along with the
+// header mtime when layers are reproducible.
+func gzipHeaderOS() byte {
+	if SourceDateEpoch == nil {
+		return 255
+	}
+	return 0
+}
@@ -0,0 +1,88 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetSourceDateEpoch(t *testing.T) {
+	require := require.New(t)
+
+	defer SetSourceDateEpoch("")
+
+	require.NoError(SetSourceDateEpoch("1500000000"))
+	require.Equal(time.Unix(1500000000, 0).UTC(), *SourceDateEpoch)
+
+	require.NoError(SetSourceDateEpoch(""))
+	require.Nil(SourceDateEpoch)
+
+	require.Error(SetSourceDateEpoch("yesterday"))
+	require.Error(SetSourceDateEpoch("-1"))
+}
+
+func TestWriteHeaderSourceDateEpoch(t *testing.T) {
+	require := require.New(t)
+
+	defer SetSourceDateEpoch("")
+	require.NoError(SetSourceDateEpoch("1500000000"))
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	mtime := time.Unix(1600000000, 0)
+	hdr := &tar.Header{
+		Name:       "/file",
+		Typeflag:   tar.TypeReg,
+		ModTime:    mtime,
+		AccessTime: time.Now(),
+		Uname:      "user",
+		Gname:      "group",
+		Format:     tar.FormatPAX,
+	}
+	require.NoError(WriteHeader(w, hdr))
+	require.NoError(w.Close())
+
+	// The given header still describes the file on disk.
+	require.Equal(mtime, hdr.ModTime)
+	require.Equal("user", hdr.Uname)
+
+	h, err := tar.NewReader(&buf).Next()
+	require.NoError(err)
+	require.Equal(time.Unix(1500000000, 0), h.ModTime)
+	require.True(h.AccessTime.IsZero())
+	require.Empty(h.Uname)
+	require.Empty(h.Gname)
+}
+
+func TestNewGzipWriterSourceDateEpoch(t *testing.T) {
+	require := require.New(t)
+
+	defer SetSourceDateEpoch("")
+	require.NoError(SetSourceDateEpoch("0"))
+
+	var buf bytes.Buffer
+	w, err := NewGzipWriter(&buf)
+	require.NoError(err)
+	require.NoError(w.Close())
+
+	// Bytes 4 to 7 of the gzip header are the mtime, byte 9 is the OS.
+	require.Equal([]byte{0, 0, 0, 0}, buf.Bytes()[4:8])
+	require.Equal(byte(0), buf.Bytes()[9])
+}
@@ -0,0 +1,75 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// _sparseBlockSize is the granularity at which holes are recreated.
+const _sparseBlockSize = 4096
+
+// IsSparse returns if the header describes a sparse file, either in the old
+// GNU format or in one of the GNU PAX formats.
+// Note: tar.Reader expands sparse files transparently, and tar.Writer writes
+// them as regular files, so sparse files in generated layers take their full
+// size, but their holes can be recreated on disk with CopySparse.
+func IsSparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// CopySparse copies size bytes from r to f, seeking over blocks of zeros
+// instead of writing them so they become holes.
+func CopySparse(f *os.File, r io.Reader, size int64) error {
+	buf := make([]byte, _sparseBlockSize)
+	zeros := make([]byte, _sparseBlockSize)
+	var written int64
+	for written < size {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("read: %s", err)
+		}
+		if bytes.Equal(buf[:n], zeros[:n]) {
+			if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return fmt.Errorf("seek: %s", err)
+			}
+		} else if _, err := f.Write(buf[:n]); err != nil {
+			return fmt.Errorf("write: %s", err)
+		}
+		written += int64(n)
+	}
+	if written != size {
+		return fmt.Errorf("copied %d bytes, expected %d", written, size)
+	}
+	// Extend the file in case it ends with a hole.
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("truncate: %s", err)
+	}
+	return nil
+}
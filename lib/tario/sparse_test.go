@@ -0,0 +1,68 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsSparse(t *testing.T) {
+	require := require.New(t)
+
+	require.True(IsSparse(&tar.Header{Typeflag: tar.TypeGNUSparse}))
+	require.True(IsSparse(&tar.Header{
+		Typeflag: tar.TypeReg, PAXRecords: map[string]string{"GNU.sparse.major": "1"}}))
+	require.False(IsSparse(&tar.Header{Typeflag: tar.TypeReg}))
+}
+
+func TestCopySparse(t *testing.T) {
+	require := require.New(t)
+
+	f, err := ioutil.TempFile("/tmp", "makisu-test-sparse")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// 1MB hole, some data, and another 1MB hole at the end.
+	content := make([]byte, 2<<20+_sparseBlockSize)
+	copy(content[1<<20:], []byte("data"))
+	require.NoError(CopySparse(f, bytes.NewReader(content), int64(len(content))))
+
+	result, err := ioutil.ReadFile(f.Name())
+	require.NoError(err)
+	require.Equal(content, result)
+
+	fi, err := f.Stat()
+	require.NoError(err)
+	blocks := fi.Sys().(*syscall.Stat_t).Blocks
+	require.True(blocks*512 < int64(len(content)))
+}
+
+func TestCopySparseShortRead(t *testing.T) {
+	require := require.New(t)
+
+	f, err := ioutil.TempFile("/tmp", "makisu-test-sparse")
+	require.NoError(err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	require.Error(CopySparse(f, bytes.NewReader([]byte("data")), 10))
+}
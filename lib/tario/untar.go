@@ -24,17 +24,30 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/uber/makisu/lib/safepath"
 )
 
 // Note: This is copied from https://github.com/golang/build/blob/master/internal/untar/untar.go
 // Removed logic about gzip.
 
+// _whiteoutPrefix is the prefix of the names of whiteout entries of layers.
+const _whiteoutPrefix = ".wh."
+
 // Untar reads the tar file from r and writes it into dir.
 func Untar(r io.Reader, dir string) error {
-	return untar(r, dir)
+	return untar(r, dir, untarOptions{})
+}
+
+// untarOptions change how untar writes entries.
+type untarOptions struct {
+	// skipWhiteouts skips entries named like whiteouts.
+	skipWhiteouts bool
+	// chown sets the owners of entries to the ones of their headers.
+	chown bool
 }
 
-func untar(r io.Reader, dir string) (err error) {
+func untar(r io.Reader, dir string, opts untarOptions) (err error) {
 	t0 := time.Now()
 	nFiles := 0
 	madeDir := map[string]bool{}
@@ -57,15 +70,37 @@ func untar(r io.Reader, dir string) (err error) {
 			log.Printf("tar reading error: %v", err)
 			return fmt.Errorf("tar error: %v", err)
 		}
-		if !validRelPath(f.Name) {
-			return fmt.Errorf("tar contained invalid name error %q", f.Name)
+		if opts.skipWhiteouts && strings.HasPrefix(path.Base(f.Name), _whiteoutPrefix) {
+			log.Printf("skipping whiteout %s", f.Name)
+			continue
+		}
+		abs, err := safepath.Join(dir, f.Name)
+		if err != nil {
+			return fmt.Errorf("tar contained invalid name: %s", err)
+		}
+		// Entries are never written through symlinks leading outside of dir.
+		if _, err := safepath.Resolve(dir, abs, false); err != nil {
+			return fmt.Errorf("tar contained unsafe entry: %s", err)
 		}
-		rel := filepath.FromSlash(f.Name)
-		abs := filepath.Join(dir, rel)
 
 		fi := f.FileInfo()
 		mode := fi.Mode()
 		switch {
+		case f.Typeflag == tar.TypeLink:
+			target, err := safepath.Join(dir, f.Linkname)
+			if err != nil {
+				return fmt.Errorf("tar contained invalid link name: %s", err)
+			}
+			if _, err := safepath.Resolve(dir, target, false); err != nil {
+				return fmt.Errorf("tar contained unsafe link: %s", err)
+			}
+			if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(target, abs); err != nil {
+				return err
+			}
+			nFiles++
 		case mode.IsRegular():
 			// Make the directory. This is redundant because it should
 			// already be made by a directory entry in the tar
@@ -78,6 +113,12 @@ func untar(r io.Reader, dir string) (err error) {
 				}
 				madeDir[dir] = true
 			}
+			// Replace symlinks instead of writing through them.
+			if fi, err := os.Lstat(abs); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(abs); err != nil {
+					return err
+				}
+			}
 			wf, err := os.OpenFile(abs, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode.Perm())
 			if err != nil {
 				return err
@@ -117,9 +158,24 @@ func untar(r io.Reader, dir string) (err error) {
 				return err
 			}
 			madeDir[abs] = true
+		case mode&os.ModeSymlink != 0:
+			// Entries are never written through symlinks leading outside of
+			// dir, so their targets don't need to be inside it.
+			if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(f.Linkname, abs); err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("tar file entry %s contained unsupported file type %v", f.Name, mode)
 		}
+		// Hard links share the owner of their target.
+		if opts.chown && f.Typeflag != tar.TypeLink {
+			if err := os.Lchown(abs, f.Uid, f.Gid); err != nil {
+				return fmt.Errorf("chown %s: %s", abs, err)
+			}
+		}
 	}
 	return nil
 }
@@ -134,10 +190,3 @@ func validRelativeDir(dir string) bool {
 	}
 	return true
 }
-
-func validRelPath(p string) bool {
-	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") || strings.Contains(p, "../") {
-		return false
-	}
-	return true
-}
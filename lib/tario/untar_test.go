@@ -0,0 +1,101 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUntarLinks(t *testing.T) {
+	require := require.New(t)
+
+	untarEntries := func(hdrs ...*tar.Header) (string, error) {
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			require.NoError(w.WriteHeader(hdr))
+			if hdr.Size > 0 {
+				_, err := w.Write(make([]byte, hdr.Size))
+				require.NoError(err)
+			}
+		}
+		require.NoError(w.Close())
+		dir, err := ioutil.TempDir("/tmp", "makisu-test")
+		require.NoError(err)
+		return dir, Untar(&buf, dir)
+	}
+
+	dir, err := untarEntries(
+		&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		&tar.Header{Name: "dir/b", Typeflag: tar.TypeLink, Linkname: "a"},
+		&tar.Header{Name: "dir/c", Typeflag: tar.TypeSymlink, Linkname: "../a"})
+	defer os.RemoveAll(dir)
+	require.NoError(err)
+	fi, err := os.Stat(filepath.Join(dir, "dir/b"))
+	require.NoError(err)
+	require.Equal(int64(3), fi.Size())
+	target, err := os.Readlink(filepath.Join(dir, "dir/c"))
+	require.NoError(err)
+	require.Equal("../a", target)
+
+	// Entries can't be written through symlinks.
+	dir, err = untarEntries(
+		&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "/tmp"},
+		&tar.Header{Name: "escape/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	defer os.RemoveAll(dir)
+	require.Error(err)
+
+	dir, err = untarEntries(
+		&tar.Header{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "dir/../.."},
+		&tar.Header{Name: "up/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	defer os.RemoveAll(dir)
+	require.Error(err)
+
+	// Entries and hard links can't go above dir.
+	dir, err = untarEntries(
+		&tar.Header{Name: "../file", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	defer os.RemoveAll(dir)
+	require.Error(err)
+
+	dir, err = untarEntries(
+		&tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"})
+	defer os.RemoveAll(dir)
+	require.Error(err)
+
+	// Symlinks inside dir are followed.
+	dir, err = untarEntries(
+		&tar.Header{Name: "real/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "real"},
+		&tar.Header{Name: "link/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	defer os.RemoveAll(dir)
+	require.NoError(err)
+	_, err = os.Stat(filepath.Join(dir, "real/file"))
+	require.NoError(err)
+
+	dir, err = untarEntries(
+		&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "/tmp/makisu-untar-escape"},
+		&tar.Header{Name: "escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	defer os.RemoveAll(dir)
+	require.NoError(err)
+	_, err = os.Stat("/tmp/makisu-untar-escape")
+	require.True(os.IsNotExist(err))
+}
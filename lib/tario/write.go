@@ -31,7 +31,7 @@ func WriteEntry(w *tar.Writer, src string, h *tar.Header) error {
 	}
 
 	switch h.Typeflag {
-	case tar.TypeDir, tar.TypeLink, tar.TypeSymlink:
+	case tar.TypeDir, tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
 		return nil
 	case tar.TypeReg, tar.TypeRegA:
 		f, err := os.Open(src)
@@ -61,7 +61,7 @@ func WriteHeader(w *tar.Writer, h *tar.Header) error {
 	// to avoid inconsistency.
 	h.ModTime = h.ModTime.Truncate(1 * time.Second)
 
-	if err := w.WriteHeader(h); err != nil {
+	if err := w.WriteHeader(normalizedHeader(h)); err != nil {
 		return fmt.Errorf("write header %s: %s", h.Name, err)
 	}
 	return nil
@@ -0,0 +1,126 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tario
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+
+	"github.com/uber/makisu/lib/log"
+)
+
+// XattrPAXPrefix is the prefix of the PAX records that hold extended
+// attributes, as written by GNU tar and docker.
+const XattrPAXPrefix = "SCHILY.xattr."
+
+// _ignoredXattrs lists extended attributes that describe the build host
+// rather than the file, and are never added to layers.
+var _ignoredXattrs = []string{
+	"security.selinux",
+	"trusted.overlay.",
+	"user.overlay.",
+}
+
+func isIgnoredXattr(name string) bool {
+	for _, prefix := range _ignoredXattrs {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HeaderXattrs returns the extended attributes stored in the PAX records of
+// the header.
+func HeaderXattrs(h *tar.Header) map[string]string {
+	xattrs := make(map[string]string)
+	for k, v := range h.PAXRecords {
+		if strings.HasPrefix(k, XattrPAXPrefix) {
+			xattrs[strings.TrimPrefix(k, XattrPAXPrefix)] = v
+		}
+	}
+	return xattrs
+}
+
+// AddXattrs reads the extended attributes of path, including security
+// capabilities, and stores them in the PAX records of the header.
+// Symlinks are skipped, since linux doesn't allow user xattrs on them.
+func AddXattrs(path string, h *tar.Header) error {
+	if h.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range xattrs {
+		if isIgnoredXattr(name) {
+			continue
+		}
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+		h.PAXRecords[XattrPAXPrefix+name] = value
+	}
+	return nil
+}
+
+// CopyXattrs sets the extended attributes of src on dst, including security
+// capabilities and POSIX ACLs, and removes the other ones of dst. It must be
+// called after dst is chowned, since chown clears security.capability.
+func CopyXattrs(src, dst string) error {
+	xattrs, err := readXattrs(src)
+	if err != nil {
+		return err
+	}
+	existing, err := readXattrs(dst)
+	if err != nil {
+		return err
+	}
+	for name := range existing {
+		if _, ok := xattrs[name]; ok || isIgnoredXattr(name) {
+			continue
+		}
+		if err := removeXattr(dst, name); err != nil {
+			return fmt.Errorf("remove xattr %s of %s: %s", name, dst, err)
+		}
+	}
+	for name, value := range xattrs {
+		if isIgnoredXattr(name) {
+			continue
+		}
+		if err := setXattr(dst, name, value); err == errXattrNotSupported {
+			log.Warnf("Dropping xattr %s of %s: %s", name, dst, err)
+		} else if err != nil {
+			return fmt.Errorf("set xattr %s of %s: %s", name, dst, err)
+		}
+	}
+	return nil
+}
+
+// isSimilarXattrs returns if the given headers have the same extended
+// attributes.
+func isSimilarXattrs(h *tar.Header, nh *tar.Header) bool {
+	hx, nhx := HeaderXattrs(h), HeaderXattrs(nh)
+	if len(hx) != len(nhx) {
+		return false
+	}
+	for k, v := range hx {
+		if nv, ok := nhx[k]; !ok || nv != v {
+			return false
+		}
+	}
+	return true
+}
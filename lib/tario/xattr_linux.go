@@ -0,0 +1,79 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tario
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+)
+
+// readXattrs returns all extended attributes of path.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("list xattrs of %s: %s", path, err)
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, fmt.Errorf("list xattrs of %s: %s", path, err)
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getXattr(path, string(name))
+		if err == syscall.ENODATA {
+			// Removed since it was listed.
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("get xattr %s of %s: %s", name, path, err)
+		}
+		xattrs[string(name)] = string(value)
+	}
+	return xattrs, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// setXattr sets an extended attribute of path. It returns errXattrNotSupported
+// if the filesystem doesn't support extended attributes.
+func setXattr(path, name, value string) error {
+	err := syscall.Setxattr(path, name, []byte(value), 0)
+	if err == syscall.ENOTSUP {
+		return errXattrNotSupported
+	}
+	return err
+}
+
+// removeXattr removes an extended attribute of path.
+func removeXattr(path, name string) error {
+	return syscall.Removexattr(path, name)
+}
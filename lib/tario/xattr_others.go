@@ -0,0 +1,34 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !linux
+
+package tario
+
+// readXattrs returns all extended attributes of path. Extended attributes are
+// only supported on linux.
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// setXattr always returns errXattrNotSupported, since extended attributes are
+// only supported on linux.
+func setXattr(path, name, value string) error {
+	return errXattrNotSupported
+}
+
+// removeXattr is a no-op, since extended attributes are only supported on
+// linux.
+func removeXattr(path, name string) error {
+	return nil
+}
@@ -0,0 +1,88 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tario
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestXattrsRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	src, err := ioutil.TempFile(tmpRoot, "src")
+	require.NoError(err)
+	src.Close()
+	if err := syscall.Setxattr(src.Name(), "user.test", []byte("value"), 0); err != nil {
+		t.Skipf("xattrs not supported: %s", err)
+	}
+
+	fi, err := os.Lstat(src.Name())
+	require.NoError(err)
+	h, err := tar.FileInfoHeader(fi, "")
+	require.NoError(err)
+	require.NoError(AddXattrs(src.Name(), h))
+	require.Equal("value", h.PAXRecords[XattrPAXPrefix+"user.test"])
+	require.Equal(map[string]string{"user.test": "value"}, HeaderXattrs(h))
+
+	dst, err := ioutil.TempFile(tmpRoot, "dst")
+	require.NoError(err)
+	dst.Close()
+	require.NoError(ApplyHeader(dst.Name(), h))
+	xattrs, err := readXattrs(dst.Name())
+	require.NoError(err)
+	require.Equal("value", xattrs["user.test"])
+}
+
+func TestIsIgnoredXattr(t *testing.T) {
+	require := require.New(t)
+
+	require.True(isIgnoredXattr("security.selinux"))
+	require.True(isIgnoredXattr("trusted.overlay.opaque"))
+	require.False(isIgnoredXattr("security.capability"))
+	require.False(isIgnoredXattr("user.test"))
+}
+
+func TestCopyXattrs(t *testing.T) {
+	require := require.New(t)
+
+	tmpRoot, err := ioutil.TempDir("/tmp", "makisu-test")
+	require.NoError(err)
+	defer os.RemoveAll(tmpRoot)
+
+	src, err := ioutil.TempFile(tmpRoot, "src")
+	require.NoError(err)
+	src.Close()
+	dst, err := ioutil.TempFile(tmpRoot, "dst")
+	require.NoError(err)
+	dst.Close()
+	if err := syscall.Setxattr(src.Name(), "user.test", []byte("value"), 0); err != nil {
+		t.Skipf("xattrs not supported: %s", err)
+	}
+	require.NoError(syscall.Setxattr(dst.Name(), "user.stale", []byte("value"), 0))
+
+	require.NoError(CopyXattrs(src.Name(), dst.Name()))
+	xattrs, err := readXattrs(dst.Name())
+	require.NoError(err)
+	require.Equal(map[string]string{"user.test": "value"}, xattrs)
+}
@@ -0,0 +1,33 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ulikunitz/xz"
+)
+
+// NewXzReader returns a new xz reader. There is no xz decompressor in the
+// standard library, so it uses a pure Go one instead of the xz command.
+func NewXzReader(r io.Reader) (io.ReadCloser, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("xz: %s", err)
+	}
+	return ioutil.NopCloser(xr), nil
+}
@@ -0,0 +1,64 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tario
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ZstdCompressionLevel is the compression level of image layers when
+// CompressionFormat is zstd.
+var ZstdCompressionLevel = zstd.SpeedDefault
+
+// setZstdCompressionLevel parses "zstd" or "zstd:<level>", where level is a
+// standard zstd level between 1 and 22, and switches CompressionFormat to zstd.
+func setZstdCompressionLevel(compressionLevelStr string) error {
+	level := zstd.SpeedDefault
+	if compressionLevelStr != CompressionZstd {
+		levelStr := strings.TrimPrefix(compressionLevelStr, CompressionZstd+":")
+		if levelStr == compressionLevelStr {
+			return fmt.Errorf("invalid compression level %s", compressionLevelStr)
+		}
+		n, err := strconv.Atoi(levelStr)
+		if err != nil || n < 1 || n > 22 {
+			return fmt.Errorf("invalid zstd compression level %s", levelStr)
+		}
+		level = zstd.EncoderLevelFromZstd(n)
+	}
+	CompressionFormat = CompressionZstd
+	ZstdCompressionLevel = level
+	return nil
+}
+
+// NewZstdWriter returns a new zstd writer with compression level.
+func NewZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w,
+		zstd.WithEncoderLevel(ZstdCompressionLevel),
+		zstd.WithEncoderConcurrency(CompressionThreads))
+}
+
+// NewZstdReader returns a new zstd reader.
+func NewZstdReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
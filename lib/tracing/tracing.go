@@ -0,0 +1,284 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing exports the spans of a build as OpenTelemetry traces, to a
+// collector speaking OTLP over HTTP, so a slow build can be inspected in
+// Jaeger or Tempo with the rest of its CI pipeline.
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uber/makisu/lib/profile"
+)
+
+const (
+	_scopeName = "github.com/uber/makisu"
+
+	// OTLP span kind and status codes.
+	_kindInternal = 1
+	_statusError  = 2
+)
+
+// Exporter sends traces to an OTLP/HTTP collector.
+type Exporter struct {
+	// Endpoint is the base URL of the collector, like http://collector:4318.
+	// Traces are posted to its /v1/traces.
+	Endpoint string
+	// Headers are added to the requests, for authentication.
+	Headers map[string]string
+	// Parent is the W3C traceparent of the CI job running the build, if any.
+	// The build is traced as its child.
+	Parent string
+	// Client sends the requests.
+	Client *http.Client
+}
+
+// Build is the build to export.
+type Build struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+	Spans []profile.Span
+	// Err is the error of a failed build.
+	Err error
+	// Attributes describe the build, like its target image.
+	Attributes map[string]string
+}
+
+// Export sends the trace of a build: a root span for the build, with a span
+// per step and the build phases that aren't part of steps under it, and the
+// phases of each step under the step.
+func (e *Exporter) Export(build *Build) error {
+	body, err := json.Marshal(e.request(build))
+	if err != nil {
+		return fmt.Errorf("marshal traces: %s", err)
+	}
+	url := strings.TrimSuffix(e.Endpoint, "/") + "/v1/traces"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send traces: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("send traces: status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// request returns the OTLP request holding the trace of the build.
+func (e *Exporter) request(build *Build) *exportRequest {
+	traceID, parentID, ok := ParseTraceparent(e.Parent)
+	if !ok {
+		traceID, parentID = newID(16), ""
+	}
+	root := span{
+		TraceID:      traceID,
+		SpanID:       newID(8),
+		ParentSpanID: parentID,
+		Name:         build.Name,
+		Kind:         _kindInternal,
+		Start:        unixNano(build.Start),
+		End:          unixNano(build.End),
+	}
+	var keys []string
+	for k := range build.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		root.Attributes = append(root.Attributes, stringAttribute(k, build.Attributes[k]))
+	}
+	if build.Err != nil {
+		root.Status = &status{Code: _statusError, Message: build.Err.Error()}
+	}
+
+	// Steps are recorded when they end, after their phases, so their span
+	// IDs are assigned first.
+	stepIDs := make(map[string]string)
+	for _, s := range build.Spans {
+		if s.Phase == profile.PhaseStep {
+			stepIDs[stepKey(s)] = newID(8)
+		}
+	}
+	spans := []span{root}
+	for _, s := range build.Spans {
+		parent, id := root.SpanID, newID(8)
+		if s.Phase == profile.PhaseStep {
+			id = stepIDs[stepKey(s)]
+		} else if stepID, ok := stepIDs[stepKey(s)]; ok && s.Step != 0 {
+			parent = stepID
+		}
+		spans = append(spans, span{
+			TraceID:      traceID,
+			SpanID:       id,
+			ParentSpanID: parent,
+			Name:         spanName(s),
+			Kind:         _kindInternal,
+			Start:        unixNano(s.Start),
+			End:          unixNano(s.Start.Add(s.Duration)),
+			Attributes:   spanAttributes(s),
+		})
+	}
+	return &exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: []attribute{stringAttribute("service.name", "makisu")}},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: _scopeName},
+			Spans: spans,
+		}},
+	}}}
+}
+
+// ParseTraceparent returns the trace and span IDs of a W3C traceparent, like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceparent(traceparent string) (string, string, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	traceID, spanID := strings.ToLower(parts[1]), strings.ToLower(parts[2])
+	if !isID(traceID, 16) || !isID(spanID, 8) {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+// isID returns true if id is the hex encoding of n bytes, not all zero.
+func isID(id string, n int) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == n && strings.Trim(id, "0") != ""
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func stepKey(s profile.Span) string {
+	return fmt.Sprintf("%s/%d", s.Stage, s.Step)
+}
+
+func spanName(s profile.Span) string {
+	if s.Phase == profile.PhaseStep {
+		return fmt.Sprintf("%s %d: %s", s.Stage, s.Step, s.Directive)
+	}
+	return s.Phase
+}
+
+func spanAttributes(s profile.Span) []attribute {
+	var attributes []attribute
+	if s.Step != 0 {
+		attributes = append(attributes,
+			stringAttribute("makisu.stage", s.Stage),
+			intAttribute("makisu.step", int64(s.Step)),
+			stringAttribute("makisu.directive", s.Directive))
+	}
+	if s.Cache != "" {
+		attributes = append(attributes, stringAttribute("makisu.cache", s.Cache))
+	}
+	if s.Size != 0 {
+		attributes = append(attributes, intAttribute("makisu.size", s.Size))
+	}
+	return attributes
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// The types below are the JSON encoding of an OTLP export request. IDs are
+// hex encoded, and 64 bit integers are strings.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope  `json:"scope"`
+	Spans []span `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type span struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []attribute `json:"attributes,omitempty"`
+	Status       *status     `json:"status,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type attribute struct {
+	Key   string         `json:"key"`
+	Value attributeValue `json:"value"`
+}
+
+type attributeValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key, value string) attribute {
+	return attribute{Key: key, Value: attributeValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) attribute {
+	s := strconv.FormatInt(value, 10)
+	return attribute{Key: key, Value: attributeValue{IntValue: &s}}
+}
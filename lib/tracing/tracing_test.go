@@ -0,0 +1,130 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uber/makisu/lib/profile"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	require := require.New(t)
+
+	traceID, spanID, ok := ParseTraceparent("00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01")
+	require.True(ok)
+	require.Equal("4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	require.Equal("00f067aa0ba902b7", spanID)
+
+	for _, traceparent := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f35-00f067aa0ba902b7-01",
+	} {
+		_, _, ok := ParseTraceparent(traceparent)
+		require.False(ok, traceparent)
+	}
+}
+
+func TestExport(t *testing.T) {
+	require := require.New(t)
+
+	var req exportRequest
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("/v1/traces", r.URL.Path)
+		header = r.Header
+		require.NoError(json.NewDecoder(r.Body).Decode(&req))
+	}))
+	defer server.Close()
+
+	start := time.Unix(1000, 0)
+	build := &Build{
+		Name:  "build",
+		Start: start,
+		End:   start.Add(10 * time.Second),
+		Spans: []profile.Span{
+			{Phase: profile.PhaseParse, Start: start, Duration: time.Second},
+			{Phase: profile.PhaseExec, Stage: "0", Step: 2, Start: start.Add(time.Second), Duration: 2 * time.Second},
+			{Phase: profile.PhaseStep, Stage: "0", Step: 2, Directive: "RUN make", Start: start.Add(time.Second),
+				Duration: 3 * time.Second, Cache: "miss"},
+			{Phase: profile.PhasePush, Start: start.Add(4 * time.Second), Duration: time.Second},
+		},
+		Err:        errors.New("failed"),
+		Attributes: map[string]string{"makisu.tag": "app:v1"},
+	}
+	e := &Exporter{
+		Endpoint: server.URL + "/",
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+		Parent:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+	require.NoError(e.Export(build))
+	require.Equal("Bearer token", header.Get("Authorization"))
+
+	require.Len(req.ResourceSpans, 1)
+	require.Len(req.ResourceSpans[0].ScopeSpans, 1)
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(spans, 5)
+	for _, s := range spans {
+		require.Equal("4bf92f3577b34da6a3ce929d0e0e4736", s.TraceID)
+	}
+
+	root, parse, exec, step, push := spans[0], spans[1], spans[2], spans[3], spans[4]
+	require.Equal("build", root.Name)
+	require.Equal("00f067aa0ba902b7", root.ParentSpanID)
+	require.Equal("1000000000000", root.Start)
+	require.Equal("1010000000000", root.End)
+	require.Equal(&status{Code: _statusError, Message: "failed"}, root.Status)
+	require.Equal("makisu.tag", root.Attributes[0].Key)
+
+	require.Equal("parse", parse.Name)
+	require.Equal(root.SpanID, parse.ParentSpanID)
+	require.Equal("0 2: RUN make", step.Name)
+	require.Equal(root.SpanID, step.ParentSpanID)
+	require.Equal("exec", exec.Name)
+	require.Equal(step.SpanID, exec.ParentSpanID)
+	require.Equal("1003000000000", exec.End)
+	require.Equal(root.SpanID, push.ParentSpanID)
+
+	var cache string
+	for _, a := range step.Attributes {
+		if a.Key == "makisu.cache" {
+			cache = *a.Value.StringValue
+		}
+	}
+	require.Equal("miss", cache)
+}
+
+func TestExportError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	e := &Exporter{Endpoint: server.URL}
+	err := e.Export(&Build{Name: "build", Start: time.Now(), End: time.Now()})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "status 401")
+}
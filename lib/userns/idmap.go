@@ -0,0 +1,130 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package userns runs makisu in a user and mount namespace with a root file
+// system of its own, so builds can run RUN steps and own files as root without
+// makisu running as root.
+package userns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Files listing the subordinate IDs users can map in user namespaces.
+const (
+	SubUIDFile = "/etc/subuid"
+	SubGIDFile = "/etc/subgid"
+)
+
+// IDRange maps Size IDs from ContainerID in the namespace to HostID outside.
+type IDRange struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// Mapping are the user and group ID ranges of a namespace.
+type Mapping struct {
+	UIDs []IDRange
+	GIDs []IDRange
+}
+
+// LoadSubIDs returns the subordinate ID ranges of a user in a file like
+// /etc/subuid, where lines are "<user name or ID>:<first ID>:<count>".
+func LoadSubIDs(path, username string, id int) ([]IDRange, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []IDRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid line in %s: %q", path, line)
+		}
+		if parts[0] != username && parts[0] != strconv.Itoa(id) {
+			continue
+		}
+		start, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid first ID in %s: %q", path, line)
+		}
+		count, err := strconv.Atoi(parts[2])
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid count in %s: %q", path, line)
+		}
+		ranges = append(ranges, IDRange{HostID: start, Size: count})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %s", path, err)
+	}
+	return ranges, nil
+}
+
+// newRanges maps root of the namespace to id, and the following IDs to the
+// subordinate ranges, in order.
+func newRanges(id int, subIDs []IDRange) []IDRange {
+	ranges := []IDRange{{ContainerID: 0, HostID: id, Size: 1}}
+	next := 1
+	for _, r := range subIDs {
+		ranges = append(ranges, IDRange{ContainerID: next, HostID: r.HostID, Size: r.Size})
+		next += r.Size
+	}
+	return ranges
+}
+
+// NewMapping returns the mapping of a namespace where root is the user with
+// the given name and IDs, and the other users and groups are the subordinate
+// IDs of the user in /etc/subuid and /etc/subgid. Without subordinate IDs,
+// only root is mapped.
+func NewMapping(username string, uid, gid int) (*Mapping, error) {
+	subUIDs, err := LoadSubIDs(SubUIDFile, username, uid)
+	if err != nil {
+		return nil, fmt.Errorf("load subordinate uids: %s", err)
+	}
+	subGIDs, err := LoadSubIDs(SubGIDFile, username, uid)
+	if err != nil {
+		return nil, fmt.Errorf("load subordinate gids: %s", err)
+	}
+	return &Mapping{UIDs: newRanges(uid, subUIDs), GIDs: newRanges(gid, subGIDs)}, nil
+}
+
+// RootOnly returns true if only root is mapped.
+func (m *Mapping) RootOnly() bool {
+	return len(m.UIDs) == 1 && len(m.GIDs) == 1
+}
+
+// mapArgs returns the arguments of newuidmap or newgidmap for the ranges of
+// the process pid.
+func mapArgs(pid int, ranges []IDRange) []string {
+	args := []string{strconv.Itoa(pid)}
+	for _, r := range ranges {
+		args = append(args,
+			strconv.Itoa(r.ContainerID), strconv.Itoa(r.HostID), strconv.Itoa(r.Size))
+	}
+	return args
+}
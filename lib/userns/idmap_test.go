@@ -0,0 +1,81 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package userns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSubIDs(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "userns")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "subuid")
+	require.NoError(ioutil.WriteFile(path, []byte(
+		"# comment\nbuilder:100000:65536\nother:165536:65536\n\n1000:300000:10\n"), 0644))
+
+	ranges, err := LoadSubIDs(path, "builder", 1000)
+	require.NoError(err)
+	require.Equal([]IDRange{
+		{HostID: 100000, Size: 65536},
+		{HostID: 300000, Size: 10},
+	}, ranges)
+
+	ranges, err = LoadSubIDs(path, "nobody", 2000)
+	require.NoError(err)
+	require.Empty(ranges)
+
+	ranges, err = LoadSubIDs(filepath.Join(dir, "missing"), "builder", 1000)
+	require.NoError(err)
+	require.Empty(ranges)
+
+	require.NoError(ioutil.WriteFile(path, []byte("builder:100000\n"), 0644))
+	_, err = LoadSubIDs(path, "builder", 1000)
+	require.Error(err)
+
+	require.NoError(ioutil.WriteFile(path, []byte("builder:100000:0\n"), 0644))
+	_, err = LoadSubIDs(path, "builder", 1000)
+	require.Error(err)
+}
+
+func TestNewRanges(t *testing.T) {
+	require := require.New(t)
+
+	ranges := newRanges(1000, []IDRange{
+		{HostID: 100000, Size: 65536},
+		{HostID: 300000, Size: 10},
+	})
+	require.Equal([]IDRange{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+		{ContainerID: 65537, HostID: 300000, Size: 10},
+	}, ranges)
+	require.Equal([]string{
+		"42", "0", "1000", "1", "1", "100000", "65536", "65537", "300000", "10",
+	}, mapArgs(42, ranges))
+
+	m := &Mapping{UIDs: newRanges(1000, nil), GIDs: newRanges(1000, nil)}
+	require.True(m.RootOnly())
+	m.GIDs = ranges
+	require.False(m.RootOnly())
+}
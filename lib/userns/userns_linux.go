@@ -0,0 +1,230 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package userns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// _stateEnv tells processes started by Reexec how far the namespace was set
+// up.
+const _stateEnv = "_MAKISU_USERNS"
+
+const (
+	stateMapping = "mapping"
+	stateReady   = "ready"
+)
+
+// _syncOK is written by Reexec to the sync pipe once the ID mappings are
+// written.
+const _syncOK = "ok"
+
+// Init must be called before anything else by makisu. In processes started by
+// Reexec, it waits for the ID mappings of the namespace, then executes makisu
+// again: capabilities are computed on exec, so the process only gets those of
+// root in the namespace once root is mapped.
+func Init() {
+	if os.Getenv(_stateEnv) != stateMapping {
+		return
+	}
+	sync := os.NewFile(3, "userns-sync")
+	content, err := ioutil.ReadAll(sync)
+	sync.Close()
+	if err != nil || string(content) != _syncOK {
+		fmt.Fprintln(os.Stderr, "User namespace of makisu wasn't set up")
+		os.Exit(1)
+	}
+	os.Setenv(_stateEnv, stateReady)
+	err = syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+	fmt.Fprintf(os.Stderr, "Failed to execute makisu in user namespace: %s\n", err)
+	os.Exit(1)
+}
+
+// InNamespace returns true if makisu runs in the namespaces created by Reexec.
+func InNamespace() bool {
+	return os.Getenv(_stateEnv) == stateReady
+}
+
+// Reexec runs makisu again with the same arguments in a new mount namespace,
+// and in a new user namespace with the given mapping unless m is nil. It
+// returns the exit code of makisu in the namespaces.
+func Reexec(m *Mapping) (int, error) {
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("create sync pipe: %s", err)
+	}
+	defer syncWriter.Close()
+
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), _stateEnv+"="+stateMapping)
+	cmd.ExtraFiles = []*os.File{syncReader}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	if m != nil {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		if m.RootOnly() {
+			// Processes can map their own IDs without newuidmap, as long as
+			// setgroups is denied.
+			cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: m.UIDs[0].HostID, Size: 1}}
+			cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: m.GIDs[0].HostID, Size: 1}}
+			cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+		}
+	}
+	err = cmd.Start()
+	syncReader.Close()
+	if err != nil {
+		return 0, fmt.Errorf("start makisu in namespaces: %s", err)
+	}
+
+	if m != nil && !m.RootOnly() {
+		if err := writeMappings(cmd.Process.Pid, m); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return 0, err
+		}
+	}
+	if _, err := syncWriter.Write([]byte(_syncOK)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("write sync pipe: %s", err)
+	}
+	syncWriter.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for s := range signals {
+			cmd.Process.Signal(s)
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), nil
+		}
+		return 0, fmt.Errorf("wait for makisu in namespaces: %s", err)
+	}
+	return 0, nil
+}
+
+// writeMappings maps the IDs of the user namespace of pid with the setuid
+// helpers newuidmap and newgidmap, which allow subordinate IDs.
+func writeMappings(pid int, m *Mapping) error {
+	for _, helper := range []struct {
+		name   string
+		ranges []IDRange
+	}{{"newuidmap", m.UIDs}, {"newgidmap", m.GIDs}} {
+		output, err := exec.Command(helper.name, mapArgs(pid, helper.ranges)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", helper.name, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// EnterRoot makes dir the root of makisu, after deleting its content. The
+// given paths of the current root are bind mounted at the same location in
+// dir, and missing ones are skipped. It returns a function restoring the
+// current root.
+// Mounts must be made in a mount namespace of makisu's own, see Reexec.
+func EnterRoot(dir string, binds []string) (func() error, error) {
+	// Keep the mounts from propagating to the parent namespace.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return nil, fmt.Errorf("make mounts private: %s", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("remove root dir %s: %s", dir, err)
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create root dir %s: %s", dir, err)
+	} else if err := syscall.Mount(dir, dir, "", syscall.MS_BIND, ""); err != nil {
+		// The root must be a mountpoint for RUN steps to pivot_root.
+		return nil, fmt.Errorf("bind mount root dir %s: %s", dir, err)
+	}
+	for _, p := range binds {
+		if err := bindMount(p, filepath.Join(dir, p)); err != nil {
+			return nil, fmt.Errorf("bind mount %s: %s", p, err)
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("get working dir: %s", err)
+	}
+	oldRoot, err := os.Open("/")
+	if err != nil {
+		return nil, fmt.Errorf("open root: %s", err)
+	}
+	if err := syscall.Chroot(dir); err != nil {
+		oldRoot.Close()
+		return nil, fmt.Errorf("chroot %s: %s", dir, err)
+	} else if err := os.Chdir("/"); err != nil {
+		oldRoot.Close()
+		return nil, fmt.Errorf("chdir to new root: %s", err)
+	}
+
+	var restored bool
+	return func() error {
+		if restored {
+			return nil
+		}
+		restored = true
+		defer oldRoot.Close()
+		if err := syscall.Fchdir(int(oldRoot.Fd())); err != nil {
+			return fmt.Errorf("chdir to old root: %s", err)
+		} else if err := syscall.Chroot("."); err != nil {
+			return fmt.Errorf("chroot to old root: %s", err)
+		}
+		return os.Chdir(cwd)
+	}, nil
+}
+
+// bindMount bind mounts src and its submounts at dst, creating dst first.
+func bindMount(src, dst string) error {
+	fi, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(dst, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, "")
+}
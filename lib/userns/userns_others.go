@@ -0,0 +1,37 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package userns
+
+import "errors"
+
+// Init must be called before anything else by makisu.
+func Init() {}
+
+// InNamespace returns true if makisu runs in the namespaces created by Reexec.
+func InNamespace() bool {
+	return false
+}
+
+// Reexec runs makisu again with the same arguments in new namespaces.
+func Reexec(m *Mapping) (int, error) {
+	return 0, errors.New("user namespaces are only supported on linux")
+}
+
+// EnterRoot makes dir the root of makisu.
+func EnterRoot(dir string, binds []string) (func() error, error) {
+	return nil, errors.New("user namespaces are only supported on linux")
+}
@@ -0,0 +1,220 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flagconfig sets the flags of commands from a YAML config file and
+// from env vars, so the settings of a fleet of builders don't have to be
+// passed on each command line.
+package flagconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultPath is the config file used if it exists and no other one is set.
+const DefaultPath = "/etc/makisu/makisu.yaml"
+
+// EnvPrefix is the prefix of the env vars that set flags.
+const EnvPrefix = "MAKISU_"
+
+// Config contains the flag values of a config file. Top level keys are flag
+// names, that apply to all commands with that flag. A key can also be the path
+// of a command without the root command, like "build" or "cache warm", mapped
+// to the flags of that command only.
+type Config struct {
+	values   map[string]interface{}
+	sections map[string]map[string]interface{}
+}
+
+// Load reads and parses a config file.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %s", err)
+	}
+	config, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s: %s", path, err)
+	}
+	return config, nil
+}
+
+// Parse parses the content of a config file.
+func Parse(b []byte) (*Config, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshal yaml: %s", err)
+	}
+	config := &Config{
+		values:   make(map[string]interface{}),
+		sections: make(map[string]map[string]interface{}),
+	}
+	for key, value := range raw {
+		section, ok := value.(map[interface{}]interface{})
+		if !ok {
+			config.values[key] = value
+			continue
+		}
+		config.sections[key] = make(map[string]interface{})
+		for name, v := range section {
+			config.sections[key][fmt.Sprint(name)] = v
+		}
+	}
+	return config, nil
+}
+
+// Validate returns an error if the config sets a flag that none of the
+// commands has, or if a section sets a flag its command doesn't have.
+// Commands are indexed by path, and their flag sets must include inherited
+// flags.
+func (c *Config) Validate(commands map[string]*pflag.FlagSet) error {
+	for _, name := range sortedKeys(c.values) {
+		var found bool
+		for _, flags := range commands {
+			if flags.Lookup(name) != nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown flag: %s", name)
+		}
+	}
+	for command, section := range c.sections {
+		flags, ok := commands[command]
+		if !ok {
+			return fmt.Errorf("unknown command: %s", command)
+		}
+		for _, name := range sortedKeys(section) {
+			if flags.Lookup(name) == nil {
+				return fmt.Errorf("unknown flag of %s: %s", command, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Apply sets the flags that weren't set on the command line, from their env
+// var if it's set, then from the section of the command, then from the top
+// level flags of the config. A nil config only applies env vars. Flags in skip
+// are left untouched.
+func (c *Config) Apply(flags *pflag.FlagSet, command string, skip ...string) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || contains(skip, f.Name) {
+			return
+		}
+		if value, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			var values []string
+			if isList(f) {
+				values = strings.Split(value, ",")
+			} else {
+				values = []string{value}
+			}
+			if setErr := set(flags, f, values); setErr != nil {
+				err = fmt.Errorf("env %s: %s", EnvName(f.Name), setErr)
+			}
+			return
+		}
+		if c == nil {
+			return
+		}
+		value, ok := c.sections[command][f.Name]
+		if !ok {
+			value, ok = c.values[f.Name]
+		}
+		if !ok {
+			return
+		}
+		values, valuesErr := toStrings(value)
+		if valuesErr != nil {
+			err = fmt.Errorf("flag %s: %s", f.Name, valuesErr)
+			return
+		}
+		if setErr := set(flags, f, values); setErr != nil {
+			err = fmt.Errorf("flag %s: %s", f.Name, setErr)
+		}
+	})
+	return err
+}
+
+// EnvName returns the env var that sets a flag, like MAKISU_REDIS_CACHE_ADDR
+// for --redis-cache-addr.
+func EnvName(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// set sets a flag to the given values, which must be a single one unless the
+// flag is a list.
+func set(flags *pflag.FlagSet, f *pflag.Flag, values []string) error {
+	if len(values) != 1 && !isList(f) {
+		return fmt.Errorf("expected a single value, got %d", len(values))
+	}
+	for _, value := range values {
+		if err := flags.Set(f.Name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isList returns true if the flag can be set several times.
+func isList(f *pflag.Flag) bool {
+	t := f.Value.Type()
+	return strings.HasSuffix(t, "Array") || strings.HasSuffix(t, "Slice")
+}
+
+// toStrings converts a scalar or a list of scalars parsed from yaml.
+func toStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, fmt.Errorf("no value")
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			switch item.(type) {
+			case nil, []interface{}, map[interface{}]interface{}:
+				return nil, fmt.Errorf("list items must be scalars")
+			}
+			values = append(values, fmt.Sprint(item))
+		}
+		return values, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
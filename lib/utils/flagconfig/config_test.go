@@ -0,0 +1,148 @@
+//  Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+const _testConfig = `
+compression: speed
+modifyfs: true
+blacklist:
+  - /foo
+  - /bar
+build:
+  compression: size
+  redis-cache-addr: redis:6379
+`
+
+func testFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("compression", "default", "")
+	flags.String("redis-cache-addr", "", "")
+	flags.Bool("modifyfs", false, "")
+	flags.StringArray("blacklist", nil, "")
+	flags.Int("compression-level", -1, "")
+	return flags
+}
+
+func TestConfigApply(t *testing.T) {
+	require := require.New(t)
+
+	config, err := Parse([]byte(_testConfig))
+	require.NoError(err)
+
+	// The section of the command overrides top level flags.
+	flags := testFlags()
+	require.NoError(config.Apply(flags, "build"))
+	compression, _ := flags.GetString("compression")
+	require.Equal("size", compression)
+	addr, _ := flags.GetString("redis-cache-addr")
+	require.Equal("redis:6379", addr)
+	modifyfs, _ := flags.GetBool("modifyfs")
+	require.True(modifyfs)
+	blacklist, _ := flags.GetStringArray("blacklist")
+	require.Equal([]string{"/foo", "/bar"}, blacklist)
+
+	// Other commands only get top level flags.
+	flags = testFlags()
+	require.NoError(config.Apply(flags, "pull"))
+	compression, _ = flags.GetString("compression")
+	require.Equal("speed", compression)
+	addr, _ = flags.GetString("redis-cache-addr")
+	require.Equal("", addr)
+}
+
+func TestConfigApplyPrecedence(t *testing.T) {
+	require := require.New(t)
+
+	config, err := Parse([]byte(_testConfig))
+	require.NoError(err)
+
+	os.Setenv("MAKISU_COMPRESSION", "no")
+	defer os.Unsetenv("MAKISU_COMPRESSION")
+	os.Setenv("MAKISU_BLACKLIST", "/a,/b")
+	defer os.Unsetenv("MAKISU_BLACKLIST")
+
+	// Command line flags override env vars, which override the config.
+	flags := testFlags()
+	require.NoError(flags.Parse([]string{"--blacklist=/c"}))
+	require.NoError(config.Apply(flags, "build"))
+	compression, _ := flags.GetString("compression")
+	require.Equal("no", compression)
+	blacklist, _ := flags.GetStringArray("blacklist")
+	require.Equal([]string{"/c"}, blacklist)
+
+	flags = testFlags()
+	require.NoError((*Config)(nil).Apply(flags, "build", "compression"))
+	compression, _ = flags.GetString("compression")
+	require.Equal("default", compression)
+	blacklist, _ = flags.GetStringArray("blacklist")
+	require.Equal([]string{"/a", "/b"}, blacklist)
+}
+
+func TestConfigErrors(t *testing.T) {
+	require := require.New(t)
+
+	_, err := Parse([]byte("compression: [speed"))
+	require.Error(err)
+
+	config, err := Parse([]byte("compression: [speed, size]"))
+	require.NoError(err)
+	require.Error(config.Apply(testFlags(), "build"))
+
+	config, err = Parse([]byte("compression-level: high"))
+	require.NoError(err)
+	require.Error(config.Apply(testFlags(), "build"))
+
+	commands := map[string]*pflag.FlagSet{"build": testFlags(), "pull": testFlags()}
+	config, err = Parse([]byte(_testConfig))
+	require.NoError(err)
+	require.NoError(config.Validate(commands))
+
+	config, err = Parse([]byte("compresion: speed"))
+	require.NoError(err)
+	require.Error(config.Validate(commands))
+
+	config, err = Parse([]byte("push:\n  compression: speed"))
+	require.NoError(err)
+	require.Error(config.Validate(commands))
+}
+
+func TestLoad(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "flagconfig")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	_, err = Load(filepath.Join(dir, "missing.yaml"))
+	require.Error(err)
+
+	path := filepath.Join(dir, "makisu.yaml")
+	require.NoError(ioutil.WriteFile(path, []byte(_testConfig), 0644))
+	config, err := Load(path)
+	require.NoError(err)
+	require.Equal("speed", config.values["compression"])
+	require.Equal("redis:6379", config.sections["build"]["redis-cache-addr"])
+	require.Equal("MAKISU_REDIS_CACHE_ADDR", EnvName("redis-cache-addr"))
+}
@@ -103,18 +103,35 @@ func ConvertStringSliceToMap(values []string) map[string]string {
 
 // MergeEnv merges a new env key value pair into existing list.
 // This is needed because Docker image config defines Env as []string, but
-// actually uses it as map[string]string.
+// actually uses it as map[string]string. Like docker, existing variables keep
+// their position, so the env of base images isn't reordered, and new ones are
+// appended in sorted order.
 func MergeEnv(envList []string, newEnvMap map[string]string) []string {
-	envMap := ConvertStringSliceToMap(envList)
-	for newK, newV := range newEnvMap {
-		envMap[newK] = newV
+	result := []string{}
+	index := make(map[string]int)
+	for _, env := range envList {
+		k := strings.SplitN(env, "=", 2)[0]
+		if i, ok := index[k]; ok {
+			result[i] = env
+			continue
+		}
+		index[k] = len(result)
+		result = append(result, env)
 	}
 
-	result := []string{}
-	for k, v := range envMap {
-		result = append(result, fmt.Sprintf("%s=%s", k, v))
+	var newKeys []string
+	for k := range newEnvMap {
+		newKeys = append(newKeys, k)
+	}
+	sort.Strings(newKeys)
+	for _, k := range newKeys {
+		env := fmt.Sprintf("%s=%s", k, newEnvMap[k])
+		if i, ok := index[k]; ok {
+			result[i] = env
+		} else {
+			result = append(result, env)
+		}
 	}
-	sort.Strings(result)
 	return result
 }
 
@@ -226,3 +243,24 @@ func ResolveChown(chown string) (uid, gid int, err error) {
 	}
 	return uid, gid, nil
 }
+
+// ParseNumericChown converts a chown string of numeric ids to uid and gid
+// integers, without looking up names on the host.
+// Format: <uid>[:<gid>]
+// If <gid> is not specified, gid will be set to uid.
+func ParseNumericChown(chown string) (uid, gid int, err error) {
+	split := strings.Split(chown, ":")
+	if len(split) > 2 {
+		return 0, 0, errors.New("failed to split on ':'")
+	}
+	if uid, err = strconv.Atoi(split[0]); err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid uid '%s'", split[0])
+	}
+	if len(split) == 1 {
+		return uid, uid, nil
+	}
+	if gid, err = strconv.Atoi(split[1]); err != nil || gid < 0 {
+		return 0, 0, fmt.Errorf("invalid gid '%s'", split[1])
+	}
+	return uid, gid, nil
+}
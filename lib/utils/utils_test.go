@@ -111,6 +111,10 @@ func TestMergeEnv(t *testing.T) {
 	require.NotNil(out)
 	require.Contains(out, "a=e")
 	require.Contains(out, "g=h")
+
+	// Existing variables keep their position, and duplicates are merged.
+	out = MergeEnv([]string{"z=1", "a=2", "z=3"}, map[string]string{"b": "4", "a": "5", "c": "6"})
+	require.Equal([]string{"z=3", "a=5", "b=4", "c=6"}, out)
 }
 
 func TestMergeStringMaps(t *testing.T) {
@@ -208,3 +212,35 @@ func TestResolveChown(t *testing.T) {
 		})
 	}
 }
+
+func TestParseNumericChown(t *testing.T) {
+	tests := []struct {
+		desc    string
+		succeed bool
+		chown   string
+		uid     int
+		gid     int
+	}{
+		{"empty", false, "", 0, 0},
+		{"user name", false, "root", 0, 0},
+		{"group name", false, "0:root", 0, 0},
+		{"negative uid", false, "-1:0", 0, 0},
+		{"too many parts", false, "1:2:3", 0, 0},
+		{"uid no group", true, "1000", 1000, 1000},
+		{"uid and gid", true, "1000:100", 1000, 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require := require.New(t)
+			uid, gid, err := ParseNumericChown(test.chown)
+			if test.succeed {
+				require.NoError(err)
+				require.Equal(test.uid, uid)
+				require.Equal(test.gid, gid)
+			} else {
+				require.Error(err)
+			}
+		})
+	}
+}
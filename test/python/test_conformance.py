@@ -0,0 +1,82 @@
+import hashlib
+import json
+import os
+import subprocess
+import tarfile
+import tempfile
+
+import pytest
+
+from .utils import docker_build_image, makisu_build_image, new_image_name
+
+CONFORMANCE_DIR = os.path.join(os.getcwd(), 'testdata/conformance')
+
+# Config fields that docker build and makisu build --strict must agree on.
+CONFIG_FIELDS = [
+    'Cmd', 'Entrypoint', 'Env', 'ExposedPorts', 'Healthcheck', 'Labels',
+    'StopSignal', 'User', 'Volumes', 'WorkingDir',
+]
+
+# Files docker creates in every container.
+CONTAINER_FILES = ['.dockerenv', 'etc/hostname', 'etc/hosts', 'etc/resolv.conf']
+CONTAINER_DIRS = ['dev', 'proc', 'sys']
+
+
+def image_config(image):
+    output = subprocess.check_output(
+        ['docker', 'image', 'inspect', '--format', '{{json .Config}}', image],
+        encoding='utf-8')
+    config = json.loads(output)
+    # Docker reports empty lists and maps as null or omits them.
+    return {k: config.get(k) or None for k in CONFIG_FIELDS}
+
+
+def image_files(image):
+    container = subprocess.check_output(
+        ['docker', 'create', image], encoding='utf-8').strip()
+    try:
+        with tempfile.TemporaryFile() as f:
+            exit_code = subprocess.call(['docker', 'export', container], stdout=f)
+            assert exit_code == 0
+            f.seek(0)
+            return tar_files(f)
+    finally:
+        subprocess.call(['docker', 'rm', container])
+
+
+def tar_files(f):
+    files = {}
+    with tarfile.open(fileobj=f) as tar:
+        for member in tar:
+            name = os.path.normpath(member.name).lstrip('/')
+            if name in CONTAINER_FILES or name.split('/')[0] in CONTAINER_DIRS:
+                continue
+            content = None
+            if member.isreg():
+                content = hashlib.sha256(tar.extractfile(member).read()).hexdigest()
+            files[name] = (
+                member.type, oct(member.mode), member.uid, member.gid,
+                member.linkname, content)
+    return files
+
+
+@pytest.mark.parametrize('case', sorted(os.listdir(CONFORMANCE_DIR)))
+def test_conformance(case, storage_dir):
+    context_dir = os.path.join(CONFORMANCE_DIR, case)
+    docker_image = new_image_name()
+    makisu_image = new_image_name()
+
+    docker_build_image(docker_image, context_dir)
+    makisu_build_image(
+        makisu_image, context_dir, storage_dir, load=True, strict=True)
+
+    assert image_config(makisu_image) == image_config(docker_image)
+
+    makisu_files = image_files(makisu_image)
+    docker_files = image_files(docker_image)
+    diff = {
+        name: (makisu_files.get(name), docker_files.get(name))
+        for name in set(makisu_files) | set(docker_files)
+        if makisu_files.get(name) != docker_files.get(name)
+    }
+    assert diff == {}
@@ -62,6 +62,13 @@ def docker_run_image(registry, image):
     return proc.returncode, err
 
 
+def docker_build_image(image, context_dir):
+    env = dict(os.environ, DOCKER_BUILDKIT='1')
+    exit_code = subprocess.call(
+        ['docker', 'build', '-t', image, context_dir], env=env)
+    assert exit_code == 0
+
+
 def registry_image_exists(image, registry):
     repotag = image.split(':')
     assert len(repotag) >= 2
@@ -108,7 +115,7 @@ def makisu_run_cmd(volumes, args):
 def makisu_build_image(
         new_image_tag, context_dir, storage_dir, cache_dir=None, volumes=None,
         docker_args=None, load=False, registry=None, replicas=None,
-        registry_cfg=None, target=None):
+        registry_cfg=None, target=None, strict=False):
 
     volumes = volumes or {}
     volumes[storage_dir] = storage_dir  # Sandbox and file store
@@ -123,8 +130,12 @@ def makisu_build_image(
         '-t', '{}'.format(new_image_tag),
         '--storage', storage_dir,
         '--modifyfs=true',
-        '--commit=explicit',
     ]
+    # Strict builds follow docker build, which commits every step.
+    if strict:
+        args.append('--strict')
+    else:
+        args.append('--commit=explicit')
     for docker_arg in docker_args:
         args.extend(['--build-arg', docker_arg])
 